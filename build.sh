@@ -3,4 +3,4 @@
 # Put installed packages into ./bin
 export GOBIN=$PWD/`dirname $0`/bin
 
-go install -v $PWD/`dirname $0`/cmd/...
\ No newline at end of file
+go install -tags sqlite_fts5 -v $PWD/`dirname $0`/cmd/...
\ No newline at end of file
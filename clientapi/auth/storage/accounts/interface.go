@@ -26,6 +26,8 @@ import (
 type Database interface {
 	common.PartitionStorer
 	GetAccountByPassword(ctx context.Context, localpart, plaintextPassword string) (*authtypes.Account, error)
+	SetPassword(ctx context.Context, localpart, plaintextPassword string) error
+	DeactivateAccount(ctx context.Context, localpart string) error
 	GetProfileByLocalpart(ctx context.Context, localpart string) (*authtypes.Profile, error)
 	SetAvatarURL(ctx context.Context, localpart string, avatarURL string) error
 	SetDisplayName(ctx context.Context, localpart string, displayName string) error
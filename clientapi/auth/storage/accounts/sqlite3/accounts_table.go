@@ -36,12 +36,22 @@ CREATE TABLE IF NOT EXISTS account_accounts (
     -- The password hash for this account. Can be NULL if this is a passwordless account.
     password_hash TEXT,
     -- Identifies which application service this account belongs to, if any.
-    appservice_id TEXT
+    appservice_id TEXT,
+    -- Whether the account has been deactivated. Deactivated accounts can't log in.
+    is_deactivated BOOLEAN NOT NULL DEFAULT FALSE
     -- TODO:
     -- is_guest, is_admin, upgraded_ts, devices, any email reset stuff?
 );
 `
 
+// SQLite has no ADD COLUMN IF NOT EXISTS, so accounts tables created before
+// deactivation was supported are migrated by hand.
+const selectAccountsColumnsSQL = "" +
+	"PRAGMA table_info(account_accounts)"
+
+const addIsDeactivatedColumnSQL = "" +
+	"ALTER TABLE account_accounts ADD COLUMN is_deactivated BOOLEAN NOT NULL DEFAULT FALSE"
+
 const insertAccountSQL = "" +
 	"INSERT INTO account_accounts(localpart, created_ts, password_hash, appservice_id) VALUES ($1, $2, $3, $4)"
 
@@ -49,18 +59,24 @@ const selectAccountByLocalpartSQL = "" +
 	"SELECT localpart, appservice_id FROM account_accounts WHERE localpart = $1"
 
 const selectPasswordHashSQL = "" +
-	"SELECT password_hash FROM account_accounts WHERE localpart = $1"
+	"SELECT password_hash FROM account_accounts WHERE localpart = $1 AND is_deactivated = FALSE"
 
 const selectNewNumericLocalpartSQL = "" +
 	"SELECT COUNT(localpart) FROM account_accounts"
 
-// TODO: Update password
+const updatePasswordSQL = "" +
+	"UPDATE account_accounts SET password_hash = $1 WHERE localpart = $2"
+
+const deactivateAccountSQL = "" +
+	"UPDATE account_accounts SET is_deactivated = TRUE WHERE localpart = $1"
 
 type accountsStatements struct {
 	insertAccountStmt             *sql.Stmt
 	selectAccountByLocalpartStmt  *sql.Stmt
 	selectPasswordHashStmt        *sql.Stmt
 	selectNewNumericLocalpartStmt *sql.Stmt
+	updatePasswordStmt            *sql.Stmt
+	deactivateAccountStmt         *sql.Stmt
 	serverName                    gomatrixserverlib.ServerName
 }
 
@@ -69,6 +85,9 @@ func (s *accountsStatements) prepare(db *sql.DB, server gomatrixserverlib.Server
 	if err != nil {
 		return
 	}
+	if err = addIsDeactivatedColumn(db); err != nil {
+		return
+	}
 	if s.insertAccountStmt, err = db.Prepare(insertAccountSQL); err != nil {
 		return
 	}
@@ -81,10 +100,48 @@ func (s *accountsStatements) prepare(db *sql.DB, server gomatrixserverlib.Server
 	if s.selectNewNumericLocalpartStmt, err = db.Prepare(selectNewNumericLocalpartSQL); err != nil {
 		return
 	}
+	if s.updatePasswordStmt, err = db.Prepare(updatePasswordSQL); err != nil {
+		return
+	}
+	if s.deactivateAccountStmt, err = db.Prepare(deactivateAccountSQL); err != nil {
+		return
+	}
 	s.serverName = server
 	return
 }
 
+// addIsDeactivatedColumn adds the is_deactivated column to the accounts table
+// if it doesn't have one yet.
+func addIsDeactivatedColumn(db *sql.DB) error {
+	found, err := hasIsDeactivatedColumn(db)
+	if err != nil || found {
+		return err
+	}
+	_, err = db.Exec(addIsDeactivatedColumnSQL)
+	return err
+}
+
+func hasIsDeactivatedColumn(db *sql.DB) (bool, error) {
+	rows, err := db.Query(selectAccountsColumnsSQL)
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close() // nolint: errcheck
+	for rows.Next() {
+		var cid int
+		var name, columnType string
+		var notNull, primaryKey bool
+		var defaultValue sql.NullString
+		if err = rows.Scan(&cid, &name, &columnType, &notNull, &defaultValue, &primaryKey); err != nil {
+			return false, err
+		}
+		if name == "is_deactivated" {
+			return true, nil
+		}
+	}
+	return false, rows.Err()
+}
+
 // insertAccount creates a new account. 'hash' should be the password hash for this account. If it is missing,
 // this account will be passwordless. Returns an error if this account already exists. Returns the account
 // on success.
@@ -112,6 +169,20 @@ func (s *accountsStatements) insertAccount(
 	}, nil
 }
 
+func (s *accountsStatements) updatePassword(
+	ctx context.Context, localpart, passwordHash string,
+) error {
+	_, err := s.updatePasswordStmt.ExecContext(ctx, passwordHash, localpart)
+	return err
+}
+
+func (s *accountsStatements) deactivateAccount(
+	ctx context.Context, localpart string,
+) error {
+	_, err := s.deactivateAccountStmt.ExecContext(ctx, localpart)
+	return err
+}
+
 func (s *accountsStatements) selectPasswordHash(
 	ctx context.Context, localpart string,
 ) (hash string, err error) {
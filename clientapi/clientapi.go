@@ -24,6 +24,9 @@ import (
 	"github.com/matrix-org/dendrite/common/basecomponent"
 	"github.com/matrix-org/dendrite/common/transactions"
 	federationSenderAPI "github.com/matrix-org/dendrite/federationsender/api"
+	keyServerAPI "github.com/matrix-org/dendrite/keyserver/api"
+	presenceServerAPI "github.com/matrix-org/dendrite/presenceserver/api"
+	publicRoomsAPI "github.com/matrix-org/dendrite/publicroomsapi/api"
 	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
 	typingServerAPI "github.com/matrix-org/dendrite/typingserver/api"
 	"github.com/matrix-org/gomatrixserverlib"
@@ -42,12 +45,17 @@ func SetupClientAPIComponent(
 	inputAPI roomserverAPI.RoomserverInputAPI,
 	queryAPI roomserverAPI.RoomserverQueryAPI,
 	typingInputAPI typingServerAPI.TypingServerInputAPI,
+	presenceInputAPI presenceServerAPI.PresenceServerInputAPI,
+	presenceQueryAPI presenceServerAPI.PresenceServerQueryAPI,
 	asAPI appserviceAPI.AppServiceQueryAPI,
 	transactionsCache *transactions.Cache,
 	fedSenderAPI federationSenderAPI.FederationSenderQueryAPI,
+	publicRoomsInputAPI publicRoomsAPI.PublicRoomsInputAPI,
+	keyServerInputAPI keyServerAPI.KeyServerInputAPI,
 ) {
 	roomserverProducer := producers.NewRoomserverProducer(inputAPI, queryAPI)
 	typingProducer := producers.NewTypingServerProducer(typingInputAPI)
+	presenceProducer := producers.NewPresenceServerProducer(presenceInputAPI)
 
 	userUpdateProducer := &producers.UserUpdateProducer{
 		Producer: base.KafkaProducer,
@@ -59,6 +67,16 @@ func SetupClientAPIComponent(
 		Topic:    string(base.Cfg.Kafka.Topics.OutputClientData),
 	}
 
+	sendToDeviceProducer := &producers.SendToDeviceProducer{
+		Producer: base.KafkaProducer,
+		Topic:    string(base.Cfg.Kafka.Topics.OutputSendToDeviceEvent),
+	}
+
+	receiptProducer := &producers.ReceiptProducer{
+		Producer: base.KafkaProducer,
+		Topic:    string(base.Cfg.Kafka.Topics.OutputReceiptEvent),
+	}
+
 	consumer := consumers.NewOutputRoomEventConsumer(
 		base.Cfg, base.KafkaConsumer, accountsDB, queryAPI,
 	)
@@ -69,6 +87,8 @@ func SetupClientAPIComponent(
 	routing.Setup(
 		base.APIMux, base.Cfg, roomserverProducer, queryAPI, aliasAPI, asAPI,
 		accountsDB, deviceDB, federation, *keyRing, userUpdateProducer,
-		syncProducer, typingProducer, transactionsCache, fedSenderAPI,
+		syncProducer, typingProducer, sendToDeviceProducer, receiptProducer,
+		presenceProducer, presenceQueryAPI, transactionsCache, fedSenderAPI,
+		publicRoomsInputAPI, keyServerInputAPI,
 	)
 }
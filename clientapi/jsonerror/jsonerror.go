@@ -80,6 +80,12 @@ func InvalidArgumentValue(msg string) *MatrixError {
 	return &MatrixError{"M_INVALID_ARGUMENT_VALUE", msg}
 }
 
+// InvalidParam is an error when the client provides a query parameter with
+// a value that is not allowed.
+func InvalidParam(msg string) *MatrixError {
+	return &MatrixError{"M_INVALID_PARAM", msg}
+}
+
 // MissingToken is an error when the client tries to access a resource which
 // requires authentication without supplying credentials.
 func MissingToken(msg string) *MatrixError {
@@ -110,6 +116,12 @@ func UserInUse(msg string) *MatrixError {
 	return &MatrixError{"M_USER_IN_USE", msg}
 }
 
+// RoomInUse is an error returned when the client tries to create a room with
+// an alias that already exists
+func RoomInUse(msg string) *MatrixError {
+	return &MatrixError{"M_ROOM_IN_USE", msg}
+}
+
 // ASExclusive is an error returned when an application service tries to
 // register an username that is outside of its registered namespace, or if a
 // user attempts to register a username or room alias within an exclusive
@@ -130,6 +142,22 @@ func UnsupportedRoomVersion(msg string) *MatrixError {
 	return &MatrixError{"M_UNSUPPORTED_ROOM_VERSION", msg}
 }
 
+// IncompatibleRoomVersionError is returned when a server asks to take part
+// in a room with a version that it doesn't support.
+type IncompatibleRoomVersionError struct {
+	MatrixError
+	RoomVersion string `json:"room_version"`
+}
+
+// IncompatibleRoomVersion is an error which is returned when the room version
+// of a room isn't one of the versions supported by the other server.
+func IncompatibleRoomVersion(roomVersion string) *IncompatibleRoomVersionError {
+	return &IncompatibleRoomVersionError{
+		MatrixError: MatrixError{"M_INCOMPATIBLE_ROOM_VERSION", "Your homeserver does not support the features required to join this room"},
+		RoomVersion: roomVersion,
+	}
+}
+
 // LimitExceededError is a rate-limiting error.
 type LimitExceededError struct {
 	MatrixError
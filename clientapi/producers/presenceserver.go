@@ -0,0 +1,54 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package producers
+
+import (
+	"context"
+
+	"github.com/matrix-org/dendrite/presenceserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// PresenceServerProducer produces events for the presence server to consume
+type PresenceServerProducer struct {
+	InputAPI api.PresenceServerInputAPI
+}
+
+// NewPresenceServerProducer creates a new PresenceServerProducer
+func NewPresenceServerProducer(inputAPI api.PresenceServerInputAPI) *PresenceServerProducer {
+	return &PresenceServerProducer{
+		InputAPI: inputAPI,
+	}
+}
+
+// Send presence update to presence server. If statusMsg is nil then the user
+// keeps their current status message.
+func (p *PresenceServerProducer) Send(
+	ctx context.Context, userID, presence string, statusMsg *string,
+	lastActiveTS gomatrixserverlib.Timestamp, currentlyActive bool,
+) error {
+	requestData := api.InputPresenceEvent{
+		UserID:          userID,
+		Presence:        presence,
+		StatusMsg:       statusMsg,
+		LastActiveTS:    lastActiveTS,
+		CurrentlyActive: currentlyActive,
+	}
+
+	var response api.InputPresenceEventResponse
+	return p.InputAPI.InputPresenceEvent(
+		ctx, &api.InputPresenceEventRequest{InputPresenceEvent: requestData}, &response,
+	)
+}
@@ -0,0 +1,58 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package producers
+
+import (
+	"encoding/json"
+
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/gomatrixserverlib"
+
+	sarama "gopkg.in/Shopify/sarama.v1"
+)
+
+// ReceiptProducer produces read receipts for the sync API server and the
+// federation sender to consume
+type ReceiptProducer struct {
+	Topic    string
+	Producer sarama.SyncProducer
+}
+
+// SendReceipt sends a receipt that a user sent for an event in a room
+func (p *ReceiptProducer) SendReceipt(
+	roomID, receiptType, userID, eventID string,
+	timestamp gomatrixserverlib.Timestamp,
+) error {
+	var m sarama.ProducerMessage
+
+	data := common.Receipt{
+		RoomID:    roomID,
+		Type:      receiptType,
+		UserID:    userID,
+		EventID:   eventID,
+		Timestamp: timestamp,
+	}
+	value, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	m.Topic = string(p.Topic)
+	m.Key = sarama.StringEncoder(roomID)
+	m.Value = sarama.ByteEncoder(value)
+
+	_, _, err = p.Producer.SendMessage(&m)
+	return err
+}
@@ -0,0 +1,56 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package producers
+
+import (
+	"encoding/json"
+
+	"github.com/matrix-org/dendrite/common"
+
+	sarama "gopkg.in/Shopify/sarama.v1"
+)
+
+// SendToDeviceProducer produces send-to-device messages for the sync API
+// server and the federation sender to consume
+type SendToDeviceProducer struct {
+	Topic    string
+	Producer sarama.SyncProducer
+}
+
+// SendToDevice sends a batch of send-to-device messages
+func (p *SendToDeviceProducer) SendToDevice(
+	sender, eventType, messageID string,
+	messages map[string]map[string]json.RawMessage,
+) error {
+	var m sarama.ProducerMessage
+
+	data := common.SendToDevice{
+		Sender:    sender,
+		Type:      eventType,
+		MessageID: messageID,
+		Messages:  messages,
+	}
+	value, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	m.Topic = string(p.Topic)
+	m.Key = sarama.StringEncoder(sender)
+	m.Value = sarama.ByteEncoder(value)
+
+	_, _, err = p.Producer.SendMessage(&m)
+	return err
+}
@@ -15,13 +15,16 @@
 package routing
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"net/url"
 	"strings"
 	"time"
 
 	appserviceAPI "github.com/matrix-org/dendrite/appservice/api"
+	publicRoomsAPI "github.com/matrix-org/dendrite/publicroomsapi/api"
 	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
 	roomserverVersion "github.com/matrix-org/dendrite/roomserver/version"
 
@@ -30,6 +33,7 @@ import (
 	"github.com/matrix-org/dendrite/clientapi/httputil"
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
 	"github.com/matrix-org/dendrite/clientapi/producers"
+	"github.com/matrix-org/dendrite/clientapi/threepid"
 	"github.com/matrix-org/dendrite/common"
 	"github.com/matrix-org/dendrite/common/config"
 	"github.com/matrix-org/gomatrixserverlib"
@@ -49,6 +53,24 @@ type createRoomRequest struct {
 	RoomAliasName   string                        `json:"room_alias_name"`
 	GuestCanJoin    bool                          `json:"guest_can_join"`
 	RoomVersion     gomatrixserverlib.RoomVersion `json:"room_version"`
+	Invite3PID      []invite3PID                  `json:"invite_3pid"`
+	IsDirect        bool                          `json:"is_direct"`
+
+	PowerLevelContentOverride json.RawMessage `json:"power_level_content_override"`
+}
+
+// invite3PID is an invite of a user identified by a third-party identifier,
+// which is looked up on an identity server.
+type invite3PID struct {
+	IDServer string `json:"id_server"`
+	Medium   string `json:"medium"`
+	Address  string `json:"address"`
+}
+
+// inviteContent is the content of the invites sent when creating a room.
+type inviteContent struct {
+	gomatrixserverlib.MemberContent
+	IsDirect bool `json:"is_direct,omitempty"`
 }
 
 const (
@@ -59,11 +81,15 @@ const (
 
 const (
 	historyVisibilityShared = "shared"
-	// TODO: These should be implemented once history visibility is implemented
-	// historyVisibilityWorldReadable = "world_readable"
-	// historyVisibilityInvited       = "invited"
 )
 
+const (
+	guestAccessCanJoin   = "can_join"
+	guestAccessForbidden = "forbidden"
+)
+
+const visibilityPrivate = "private"
+
 func (r createRoomRequest) Validate() *util.JSONResponse {
 	whitespace := "\t\n\x0b\x0c\r " // https://docs.python.org/2/library/string.html#string.whitespace
 	// https://github.com/matrix-org/synapse/blob/v0.19.2/synapse/handlers/room.py#L81
@@ -87,6 +113,14 @@ func (r createRoomRequest) Validate() *util.JSONResponse {
 			}
 		}
 	}
+	for _, invite := range r.Invite3PID {
+		if invite.IDServer == "" || invite.Medium == "" || invite.Address == "" {
+			return &util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.BadJSON("invite_3pid entries must have an id_server, a medium and an address"),
+			}
+		}
+	}
 	switch r.Preset {
 	case presetPrivateChat, presetTrustedPrivateChat, presetPublicChat, "":
 	default:
@@ -95,6 +129,23 @@ func (r createRoomRequest) Validate() *util.JSONResponse {
 			JSON: jsonerror.BadJSON("preset must be any of 'private_chat', 'trusted_private_chat', 'public_chat'"),
 		}
 	}
+	switch r.Visibility {
+	case gomatrixserverlib.Public, visibilityPrivate, "":
+	default:
+		return &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.BadJSON("visibility must be either 'public' or 'private'"),
+		}
+	}
+	if len(r.PowerLevelContentOverride) > 0 {
+		var override map[string]interface{}
+		if err := json.Unmarshal(r.PowerLevelContentOverride, &override); err != nil {
+			return &util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.BadJSON("power_level_content_override must be an object"),
+			}
+		}
+	}
 
 	// Validate creation_content fields defined in the spec by marshalling the
 	// creation_content map into bytes and then unmarshalling the bytes into
@@ -137,13 +188,18 @@ type fledglingEvent struct {
 func CreateRoom(
 	req *http.Request, device *authtypes.Device,
 	cfg *config.Dendrite, producer *producers.RoomserverProducer,
+	queryAPI roomserverAPI.RoomserverQueryAPI,
 	accountDB accounts.Database, aliasAPI roomserverAPI.RoomserverAliasAPI,
 	asAPI appserviceAPI.AppServiceQueryAPI,
+	publicRoomsInputAPI publicRoomsAPI.PublicRoomsInputAPI,
+	federation *gomatrixserverlib.FederationClient,
 ) util.JSONResponse {
 	// TODO (#267): Check room ID doesn't clash with an existing one, and we
 	//              probably shouldn't be using pseudo-random strings, maybe GUIDs?
 	roomID := fmt.Sprintf("!%s:%s", util.RandomString(16), cfg.Matrix.ServerName)
-	return createRoom(req, device, cfg, roomID, producer, accountDB, aliasAPI, asAPI)
+	return createRoom(
+		req, device, cfg, roomID, producer, queryAPI, accountDB, aliasAPI, asAPI, publicRoomsInputAPI, federation,
+	)
 }
 
 // createRoom implements /createRoom
@@ -151,8 +207,11 @@ func CreateRoom(
 func createRoom(
 	req *http.Request, device *authtypes.Device,
 	cfg *config.Dendrite, roomID string, producer *producers.RoomserverProducer,
+	queryAPI roomserverAPI.RoomserverQueryAPI,
 	accountDB accounts.Database, aliasAPI roomserverAPI.RoomserverAliasAPI,
 	asAPI appserviceAPI.AppServiceQueryAPI,
+	publicRoomsInputAPI publicRoomsAPI.PublicRoomsInputAPI,
+	federation *gomatrixserverlib.FederationClient,
 ) util.JSONResponse {
 	logger := util.GetLogger(req.Context())
 	userID := device.UserID
@@ -196,9 +255,30 @@ func createRoom(
 	}
 	r.CreationContent["room_version"] = roomVersion
 
-	// TODO: visibility/presets/raw initial state
-	// TODO: Create room alias association
-	// Make sure this doesn't fall into an application service's namespace though!
+	// Check that the alias is free before creating the room. It is only
+	// associated with the room once the room exists.
+	var roomAlias string
+	if r.RoomAliasName != "" {
+		roomAlias = fmt.Sprintf("#%s:%s", r.RoomAliasName, cfg.Matrix.ServerName)
+		if aliasInExclusiveNamespace(cfg, userID, roomAlias) {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.ASExclusive("Alias is reserved by an application service"),
+			}
+		}
+		aliasReq := roomserverAPI.GetRoomIDForAliasRequest{Alias: roomAlias}
+		var aliasRes roomserverAPI.GetRoomIDForAliasResponse
+		if err = aliasAPI.GetRoomIDForAlias(req.Context(), &aliasReq, &aliasRes); err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("aliasAPI.GetRoomIDForAlias failed")
+			return jsonerror.InternalServerError()
+		}
+		if aliasRes.RoomID != "" {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.RoomInUse("Room alias already taken"),
+			}
+		}
+	}
 
 	logger.WithFields(log.Fields{
 		"userID":      userID,
@@ -218,41 +298,81 @@ func createRoom(
 		AvatarURL:   profile.AvatarURL,
 	}
 
-	var joinRules, historyVisibility string
-	switch r.Preset {
+	// The preset defaults to the one matching the visibility of the room.
+	preset := r.Preset
+	if preset == "" {
+		if r.Visibility == gomatrixserverlib.Public {
+			preset = presetPublicChat
+		} else {
+			preset = presetPrivateChat
+		}
+	}
+
+	powerLevelContent := common.InitialPowerLevelsContent(userID)
+	var joinRules, historyVisibility, guestAccess string
+	switch preset {
 	case presetPrivateChat:
 		joinRules = gomatrixserverlib.Invite
 		historyVisibility = historyVisibilityShared
+		guestAccess = guestAccessCanJoin
 	case presetTrustedPrivateChat:
 		joinRules = gomatrixserverlib.Invite
 		historyVisibility = historyVisibilityShared
-		// TODO If trusted_private_chat, all invitees are given the same power level as the room creator.
+		guestAccess = guestAccessCanJoin
+		// All invitees are given the same power level as the room creator.
+		for _, invitee := range r.Invite {
+			powerLevelContent.Users[invitee] = powerLevelContent.Users[userID]
+		}
 	case presetPublicChat:
 		joinRules = gomatrixserverlib.Public
 		historyVisibility = historyVisibilityShared
-	default:
-		// Default room rules, r.Preset was previously checked for valid values so
-		// only a request with no preset should end up here.
-		joinRules = gomatrixserverlib.Invite
-		historyVisibility = historyVisibilityShared
+		guestAccess = guestAccessForbidden
+	}
+	if r.GuestCanJoin {
+		guestAccess = guestAccessCanJoin
 	}
 
-	var builtEvents []gomatrixserverlib.HeaderedEvent
+	// Events in initial_state replace the ones that the preset would make.
+	initialState := r.InitialState
+	presetEvent := func(eventType string, content interface{}) fledglingEvent {
+		for i, e := range initialState {
+			if e.Type == eventType && e.StateKey == "" {
+				initialState = append(initialState[:i:i], initialState[i+1:]...)
+				return e
+			}
+		}
+		return fledglingEvent{eventType, "", content}
+	}
+
+	// The power_level_content_override applies on top of the power levels,
+	// whether they come from the preset or from initial_state.
+	powerLevelsEvent := presetEvent("m.room.power_levels", powerLevelContent)
+	if len(r.PowerLevelContentOverride) > 0 {
+		if powerLevelsEvent.Content, err = overridePowerLevels(
+			powerLevelsEvent.Content, r.PowerLevelContentOverride,
+		); err != nil {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.BadJSON("m.room.power_levels in initial_state must be an object"),
+			}
+		}
+	}
 
 	// send events into the room in order of:
 	//  1- m.room.create
 	//  2- room creator join member
 	//  3- m.room.power_levels
-	//  4- m.room.canonical_alias (opt) TODO
+	//  4- m.room.canonical_alias (opt)
 	//  5- m.room.join_rules
 	//  6- m.room.history_visibility
-	//  7- m.room.guest_access (opt)
+	//  7- m.room.guest_access
 	//  8- other initial state items
 	//  9- m.room.name (opt)
 	//  10- m.room.topic (opt)
-	//  11- invite events (opt) - with is_direct flag if applicable TODO
-	//  12- 3pid invite events (opt) TODO
-	//  13- m.room.aliases event for HS (if alias specified) TODO
+	//  11- invite events (opt) - with is_direct flag if applicable, remote
+	//      users are invited over federation once the room exists
+	//  12- 3pid invite events (opt)
+	//  13- m.room.aliases event for HS (if alias specified)
 	// This differs from Synapse slightly. Synapse would vary the ordering of 3-7
 	// depending on if those events were in "initial_state" or not. This made it
 	// harder to reason about, hence sticking to a strict static ordering.
@@ -260,63 +380,57 @@ func createRoom(
 	eventsToMake := []fledglingEvent{
 		{"m.room.create", "", r.CreationContent},
 		{"m.room.member", userID, membershipContent},
-		{"m.room.power_levels", "", common.InitialPowerLevelsContent(userID)},
-		// TODO: m.room.canonical_alias
-		{"m.room.join_rules", "", gomatrixserverlib.JoinRuleContent{JoinRule: joinRules}},
-		{"m.room.history_visibility", "", common.HistoryVisibilityContent{HistoryVisibility: historyVisibility}},
+		powerLevelsEvent,
 	}
-	if r.GuestCanJoin {
-		eventsToMake = append(eventsToMake, fledglingEvent{"m.room.guest_access", "", common.GuestAccessContent{GuestAccess: "can_join"}})
+	if roomAlias != "" {
+		eventsToMake = append(eventsToMake, fledglingEvent{"m.room.canonical_alias", "", common.CanonicalAliasContent{Alias: roomAlias}})
 	}
-	eventsToMake = append(eventsToMake, r.InitialState...)
+	eventsToMake = append(eventsToMake,
+		presetEvent("m.room.join_rules", gomatrixserverlib.JoinRuleContent{JoinRule: joinRules}),
+		presetEvent("m.room.history_visibility", common.HistoryVisibilityContent{HistoryVisibility: historyVisibility}),
+		presetEvent("m.room.guest_access", common.GuestAccessContent{GuestAccess: guestAccess}),
+	)
+	eventsToMake = append(eventsToMake, initialState...)
 	if r.Name != "" {
 		eventsToMake = append(eventsToMake, fledglingEvent{"m.room.name", "", common.NameContent{Name: r.Name}})
 	}
 	if r.Topic != "" {
 		eventsToMake = append(eventsToMake, fledglingEvent{"m.room.topic", "", common.TopicContent{Topic: r.Topic}})
 	}
-	// TODO: invite events
-	// TODO: 3pid invite events
-	// TODO: m.room.aliases
-
-	authEvents := gomatrixserverlib.NewAuthEvents(nil)
-	for i, e := range eventsToMake {
-		depth := i + 1 // depth starts at 1
-
-		builder := gomatrixserverlib.EventBuilder{
-			Sender:   userID,
-			RoomID:   roomID,
-			Type:     e.Type,
-			StateKey: &e.StateKey,
-			Depth:    int64(depth),
+	var remoteInvitees []string
+	for _, invitee := range r.Invite {
+		if invitee == userID {
+			continue
 		}
-		err = builder.SetContent(e.Content)
-		if err != nil {
-			util.GetLogger(req.Context()).WithError(err).Error("builder.SetContent failed")
-			return jsonerror.InternalServerError()
+		if _, domain, _ := gomatrixserverlib.SplitID('@', invitee); domain != cfg.Matrix.ServerName {
+			remoteInvitees = append(remoteInvitees, invitee)
+			continue
 		}
-		if i > 0 {
-			builder.PrevEvents = []gomatrixserverlib.EventReference{builtEvents[i-1].EventReference()}
-		}
-		var ev *gomatrixserverlib.Event
-		ev, err = buildEvent(&builder, &authEvents, cfg, evTime, roomVersion)
-		if err != nil {
-			util.GetLogger(req.Context()).WithError(err).Error("buildEvent failed")
-			return jsonerror.InternalServerError()
-		}
-
-		if err = gomatrixserverlib.Allowed(*ev, &authEvents); err != nil {
-			util.GetLogger(req.Context()).WithError(err).Error("gomatrixserverlib.Allowed failed")
+		var inviteeProfile *authtypes.Profile
+		inviteeProfile, err = appserviceAPI.RetrieveUserProfile(req.Context(), invitee, asAPI, accountDB)
+		if err == common.ErrProfileNoExists {
+			return util.JSONResponse{
+				Code: http.StatusNotFound,
+				JSON: jsonerror.NotFound("Unknown user " + invitee),
+			}
+		} else if err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("appserviceAPI.RetrieveUserProfile failed")
 			return jsonerror.InternalServerError()
 		}
+		eventsToMake = append(eventsToMake, fledglingEvent{"m.room.member", invitee, inviteContent{
+			MemberContent: gomatrixserverlib.MemberContent{
+				Membership:  gomatrixserverlib.Invite,
+				DisplayName: inviteeProfile.DisplayName,
+				AvatarURL:   inviteeProfile.AvatarURL,
+			},
+			IsDirect: r.IsDirect,
+		}})
+	}
 
-		// Add the event to the list of auth events
-		builtEvents = append(builtEvents, (*ev).Headered(roomVersion))
-		err = authEvents.AddEvent(ev)
-		if err != nil {
-			util.GetLogger(req.Context()).WithError(err).Error("authEvents.AddEvent failed")
-			return jsonerror.InternalServerError()
-		}
+	builtEvents, err := buildRoomEvents(cfg, roomID, userID, evTime, roomVersion, eventsToMake)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("buildRoomEvents failed")
+		return jsonerror.InternalServerError()
 	}
 
 	// send events to the room server
@@ -326,13 +440,57 @@ func createRoom(
 		return jsonerror.InternalServerError()
 	}
 
-	// TODO(#269): Reserve room alias while we create the room. This stops us
-	// from creating the room but still failing due to the alias having already
-	// been taken.
-	var roomAlias string
-	if r.RoomAliasName != "" {
-		roomAlias = fmt.Sprintf("#%s:%s", r.RoomAliasName, cfg.Matrix.ServerName)
+	for _, invitee := range remoteInvitees {
+		if err = inviteRemoteUser(
+			req.Context(), cfg, userID, roomID, invitee, r.IsDirect, evTime, roomVersion,
+			producer, queryAPI, federation,
+		); err != nil {
+			// The room exists by now, so finish setting it up rather than
+			// failing the request because of one unreachable server.
+			util.GetLogger(req.Context()).WithError(err).WithField("invitee", invitee).Warn("Failed to invite remote user")
+		}
+	}
+
+	// The 3PID invites need the room to exist, as the identity server is
+	// asked about each of them before sending an invite.
+	for _, invite := range r.Invite3PID {
+		body := threepid.MembershipRequest{
+			IDServer: invite.IDServer,
+			Medium:   invite.Medium,
+			Address:  invite.Address,
+		}
+		inviteStored, resErr := checkAndProcessThreepid(
+			req, device, &body, cfg, queryAPI, accountDB, producer,
+			gomatrixserverlib.Invite, roomID, evTime,
+		)
+		if resErr != nil {
+			return *resErr
+		}
+		if inviteStored {
+			continue
+		}
+		// The identity server knows the Matrix ID of the invitee, so invite
+		// them directly.
+		var event *gomatrixserverlib.Event
+		event, err = buildMembershipEvent(
+			req.Context(), body, accountDB, device, gomatrixserverlib.Invite, roomID, cfg, evTime, queryAPI, asAPI,
+		)
+		if err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("buildMembershipEvent failed")
+			return jsonerror.InternalServerError()
+		}
+		if _, err = producer.SendEvents(
+			req.Context(), []gomatrixserverlib.HeaderedEvent{event.Headered(roomVersion)}, cfg.Matrix.ServerName, nil,
+		); err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("producer.SendEvents failed")
+			return jsonerror.InternalServerError()
+		}
+	}
 
+	// TODO(#269): Reserve room alias while we create the room. This stops us
+	// from creating the room but still failing due to the alias having been
+	// taken since we checked it.
+	if roomAlias != "" {
 		aliasReq := roomserverAPI.SetRoomAliasRequest{
 			Alias:  roomAlias,
 			RoomID: roomID,
@@ -347,7 +505,22 @@ func createRoom(
 		}
 
 		if aliasResp.AliasExists {
-			return util.MessageResponse(400, "Alias already exists")
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.RoomInUse("Room alias already taken"),
+			}
+		}
+	}
+
+	if r.Visibility == gomatrixserverlib.Public {
+		visibilityReq := publicRoomsAPI.InputRoomVisibilityRequest{
+			RoomID:     roomID,
+			Visibility: gomatrixserverlib.Public,
+		}
+		var visibilityRes publicRoomsAPI.InputRoomVisibilityResponse
+		if err = publicRoomsInputAPI.InputRoomVisibility(req.Context(), &visibilityReq, &visibilityRes); err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("publicRoomsInputAPI.InputRoomVisibility failed")
+			return jsonerror.InternalServerError()
 		}
 	}
 
@@ -362,6 +535,161 @@ func createRoom(
 	}
 }
 
+// buildRoomEvents builds the first events of a new room, in the given order.
+// Each event is checked against the auth rules with the state made by the
+// events before it.
+func buildRoomEvents(
+	cfg *config.Dendrite, roomID, userID string, evTime time.Time,
+	roomVersion gomatrixserverlib.RoomVersion, eventsToMake []fledglingEvent,
+) ([]gomatrixserverlib.HeaderedEvent, error) {
+	builtEvents := make([]gomatrixserverlib.HeaderedEvent, 0, len(eventsToMake))
+	authEvents := gomatrixserverlib.NewAuthEvents(nil)
+	for i, e := range eventsToMake {
+		depth := i + 1 // depth starts at 1
+
+		builder := gomatrixserverlib.EventBuilder{
+			Sender:   userID,
+			RoomID:   roomID,
+			Type:     e.Type,
+			StateKey: &e.StateKey,
+			Depth:    int64(depth),
+		}
+		if err := builder.SetContent(e.Content); err != nil {
+			return nil, fmt.Errorf("builder.SetContent: %w", err)
+		}
+		if i > 0 {
+			builder.PrevEvents = []gomatrixserverlib.EventReference{builtEvents[i-1].EventReference()}
+		}
+		ev, err := buildEvent(&builder, &authEvents, cfg, evTime, roomVersion)
+		if err != nil {
+			return nil, err
+		}
+
+		if err = gomatrixserverlib.Allowed(*ev, &authEvents); err != nil {
+			return nil, fmt.Errorf("gomatrixserverlib.Allowed: %s event: %w", e.Type, err)
+		}
+
+		// Add the event to the list of auth events
+		builtEvents = append(builtEvents, (*ev).Headered(roomVersion))
+		if err = authEvents.AddEvent(ev); err != nil {
+			return nil, fmt.Errorf("authEvents.AddEvent: %w", err)
+		}
+	}
+	return builtEvents, nil
+}
+
+// inviteRemoteUserStateTypes are the types of state events that are sent to
+// the server of a remote invitee, so that it can show the room to the invitee.
+var inviteRemoteUserStateTypes = []string{
+	gomatrixserverlib.MRoomJoinRules,
+	"m.room.canonical_alias",
+	"m.room.avatar",
+	"m.room.encryption",
+	"m.room.name",
+}
+
+// inviteRemoteUser invites a user of another server into a room that was just
+// created. Their server isn't in the room, so the invite is sent to it over
+// federation, along with some of the state of the room, before it is sent
+// into the room.
+func inviteRemoteUser(
+	ctx context.Context, cfg *config.Dendrite, userID, roomID, invitee string, isDirect bool,
+	evTime time.Time, roomVersion gomatrixserverlib.RoomVersion,
+	producer *producers.RoomserverProducer, queryAPI roomserverAPI.RoomserverQueryAPI,
+	federation *gomatrixserverlib.FederationClient,
+) error {
+	_, serverName, err := gomatrixserverlib.SplitID('@', invitee)
+	if err != nil {
+		return err
+	}
+	builder := gomatrixserverlib.EventBuilder{
+		Sender:   userID,
+		RoomID:   roomID,
+		Type:     gomatrixserverlib.MRoomMember,
+		StateKey: &invitee,
+	}
+	if err = builder.SetContent(inviteContent{
+		MemberContent: gomatrixserverlib.MemberContent{Membership: gomatrixserverlib.Invite},
+		IsDirect:      isDirect,
+	}); err != nil {
+		return err
+	}
+	event, err := common.BuildEvent(ctx, &builder, cfg, evTime, queryAPI, nil)
+	if err != nil {
+		return err
+	}
+
+	stateReq := roomserverAPI.QueryLatestEventsAndStateRequest{
+		RoomID: roomID,
+		StateToFetch: []gomatrixserverlib.StateKeyTuple{
+			{EventType: gomatrixserverlib.MRoomMember, StateKey: userID},
+		},
+	}
+	for _, eventType := range inviteRemoteUserStateTypes {
+		stateReq.StateToFetch = append(stateReq.StateToFetch, gomatrixserverlib.StateKeyTuple{
+			EventType: eventType, StateKey: "",
+		})
+	}
+	var stateRes roomserverAPI.QueryLatestEventsAndStateResponse
+	if err = queryAPI.QueryLatestEventsAndState(ctx, &stateReq, &stateRes); err != nil {
+		return err
+	}
+	inviteRoomState := make([]roomserverAPI.StrippedEvent, len(stateRes.StateEvents))
+	for i := range stateRes.StateEvents {
+		inviteRoomState[i] = roomserverAPI.NewStrippedEvent(&stateRes.StateEvents[i].Event)
+	}
+
+	// The v1 invite API can't carry the room version, so servers only accept
+	// it for rooms of version 1 and 2.
+	path := "/_matrix/federation/v2/invite/" +
+		url.PathEscape(roomID) + "/" + url.PathEscape(event.EventID())
+	fedReq := gomatrixserverlib.NewFederationRequest(http.MethodPut, serverName, path)
+	if err = fedReq.SetContent(struct {
+		RoomVersion     gomatrixserverlib.RoomVersion `json:"room_version"`
+		Event           gomatrixserverlib.Event       `json:"event"`
+		InviteRoomState []roomserverAPI.StrippedEvent `json:"invite_room_state"`
+	}{roomVersion, *event, inviteRoomState}); err != nil {
+		return err
+	}
+	// The invitee's server counter-signs the event in its response, but the
+	// auth rules don't need its signature so the event is sent into the room
+	// as we built it.
+	var fedRes struct {
+		Event json.RawMessage `json:"event"`
+	}
+	if err = common.DoFederationRequest(ctx, cfg, federation, fedReq, &fedRes); err != nil {
+		return err
+	}
+	_, err = producer.SendEvents(
+		ctx, []gomatrixserverlib.HeaderedEvent{event.Headered(roomVersion)}, cfg.Matrix.ServerName, nil,
+	)
+	return err
+}
+
+// overridePowerLevels returns the content of the initial power levels with the
+// keys of the override replacing the ones of the content.
+func overridePowerLevels(content interface{}, override json.RawMessage) (map[string]interface{}, error) {
+	contentJSON, err := json.Marshal(content)
+	if err != nil {
+		return nil, err
+	}
+	var result map[string]interface{}
+	if err = json.Unmarshal(contentJSON, &result); err != nil {
+		return nil, err
+	}
+	if result == nil {
+		result = map[string]interface{}{}
+	}
+	var overrideFields map[string]interface{}
+	if err = json.Unmarshal(override, &overrideFields); err != nil {
+		return nil, err
+	}
+	for key, value := range overrideFields {
+		result[key] = value
+	}
+	return result, nil
+}
+
 // buildEvent fills out auth_events for the builder then builds the event
 func buildEvent(
 	builder *gomatrixserverlib.EventBuilder,
@@ -0,0 +1,267 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	appserviceAPI "github.com/matrix-org/dendrite/appservice/api"
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
+	"github.com/matrix-org/dendrite/clientapi/producers"
+	"github.com/matrix-org/dendrite/common/config"
+	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+	"golang.org/x/crypto/ed25519"
+)
+
+const createRoomTestRoomID = "!new:localhost"
+
+// createRoomRoomserver keeps the events sent to it so that it can answer
+// queries about the latest events and state of the new room.
+type createRoomRoomserver struct {
+	roomserverAPI.RoomserverQueryAPI
+	events []gomatrixserverlib.HeaderedEvent
+}
+
+func (r *createRoomRoomserver) InputRoomEvents(
+	ctx context.Context,
+	request *roomserverAPI.InputRoomEventsRequest,
+	response *roomserverAPI.InputRoomEventsResponse,
+) error {
+	for _, ire := range request.InputRoomEvents {
+		r.events = append(r.events, ire.Event)
+	}
+	return nil
+}
+
+func (r *createRoomRoomserver) QueryLatestEventsAndState(
+	ctx context.Context,
+	request *roomserverAPI.QueryLatestEventsAndStateRequest,
+	response *roomserverAPI.QueryLatestEventsAndStateResponse,
+) error {
+	if len(r.events) == 0 {
+		return nil
+	}
+	response.RoomExists = true
+	response.RoomVersion = r.events[0].RoomVersion
+	last := r.events[len(r.events)-1]
+	response.LatestEvents = []gomatrixserverlib.EventReference{last.EventReference()}
+	response.Depth = last.Depth() + 1
+	state := map[gomatrixserverlib.StateKeyTuple]gomatrixserverlib.HeaderedEvent{}
+	for _, ev := range r.events {
+		state[gomatrixserverlib.StateKeyTuple{EventType: ev.Type(), StateKey: *ev.StateKey()}] = ev
+	}
+	for _, ev := range state {
+		response.StateEvents = append(response.StateEvents, ev)
+	}
+	return nil
+}
+
+// stateEvent returns the content of the last event sent with the given type
+// and state key, or nil if there wasn't one.
+func (r *createRoomRoomserver) stateEvent(eventType, stateKey string) []byte {
+	var content []byte
+	for _, ev := range r.events {
+		if ev.Type() == eventType && ev.StateKeyEquals(stateKey) {
+			content = ev.Content()
+		}
+	}
+	return content
+}
+
+// createRoomAccountDB only knows about @alice:localhost.
+type createRoomAccountDB struct {
+	accounts.Database
+}
+
+func (d *createRoomAccountDB) GetProfileByLocalpart(
+	ctx context.Context, localpart string,
+) (*authtypes.Profile, error) {
+	if localpart != "alice" {
+		return nil, sql.ErrNoRows
+	}
+	return &authtypes.Profile{Localpart: localpart}, nil
+}
+
+type createRoomAppServiceAPI struct {
+	appserviceAPI.AppServiceQueryAPI
+}
+
+func (a *createRoomAppServiceAPI) UserIDExists(
+	ctx context.Context,
+	req *appserviceAPI.UserIDExistsRequest,
+	resp *appserviceAPI.UserIDExistsResponse,
+) error {
+	resp.UserIDExists = false
+	return nil
+}
+
+// inviteTripper answers the federation /invite requests of the tests. The
+// server "unreachable" fails every request.
+type inviteTripper struct {
+	destinations []string
+	paths        []string
+	sent         json.RawMessage
+}
+
+func (t *inviteTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.destinations = append(t.destinations, req.URL.Host)
+	t.paths = append(t.paths, req.URL.Path)
+	sent, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return nil, err
+	}
+	t.sent = sent
+	code, body := http.StatusOK, `{"event": {}}`
+	if req.URL.Host == "unreachable" {
+		code, body = http.StatusInternalServerError, `{}`
+	}
+	return &http.Response{
+		StatusCode: code,
+		Header:     http.Header{"Content-Type": []string{"application/json"}},
+		Body:       ioutil.NopCloser(strings.NewReader(body)),
+		Request:    req,
+	}, nil
+}
+
+func createTestRoom(
+	t *testing.T, body string,
+) (*util.JSONResponse, *createRoomRoomserver, *inviteTripper) {
+	_, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &config.Dendrite{}
+	cfg.Matrix.ServerName = "localhost"
+	cfg.Matrix.KeyID = "ed25519:test"
+	cfg.Matrix.PrivateKey = privateKey
+
+	roomserver := &createRoomRoomserver{}
+	tripper := &inviteTripper{}
+	transport := &http.Transport{}
+	transport.RegisterProtocol("matrix", tripper)
+	federation := gomatrixserverlib.NewFederationClientWithTransport(
+		cfg.Matrix.ServerName, cfg.Matrix.KeyID, privateKey, transport,
+	)
+
+	req := httptest.NewRequest(http.MethodPost, "/createRoom", strings.NewReader(body))
+	res := createRoom(
+		req, &authtypes.Device{UserID: "@alice:localhost"}, cfg, createRoomTestRoomID,
+		producers.NewRoomserverProducer(roomserver, roomserver), roomserver,
+		&createRoomAccountDB{}, nil, &createRoomAppServiceAPI{}, nil, federation,
+	)
+	return &res, roomserver, tripper
+}
+
+func TestCreateRoomUnknownLocalInvitee(t *testing.T) {
+	res, roomserver, _ := createTestRoom(t, `{"invite":["@nobody:localhost"]}`)
+	if res.Code != http.StatusNotFound {
+		t.Fatalf("got status %d, want %d", res.Code, http.StatusNotFound)
+	}
+	if len(roomserver.events) != 0 {
+		t.Errorf("got %d events sent, want none", len(roomserver.events))
+	}
+}
+
+func TestCreateRoomPowerLevelContentOverride(t *testing.T) {
+	res, roomserver, _ := createTestRoom(t, `{
+		"initial_state": [{
+			"type": "m.room.power_levels",
+			"state_key": "",
+			"content": {"users": {"@alice:localhost": 100}, "ban": 99, "state_default": 50}
+		}],
+		"power_level_content_override": {"state_default": 75}
+	}`)
+	if res.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d: %+v", res.Code, http.StatusOK, res.JSON)
+	}
+	var levels struct {
+		Ban          int64 `json:"ban"`
+		StateDefault int64 `json:"state_default"`
+	}
+	if err := json.Unmarshal(roomserver.stateEvent("m.room.power_levels", ""), &levels); err != nil {
+		t.Fatal(err)
+	}
+	if levels.Ban != 99 || levels.StateDefault != 75 {
+		t.Errorf("got ban %d and state_default %d, want 99 from initial_state and 75 from the override", levels.Ban, levels.StateDefault)
+	}
+
+	res, _, _ = createTestRoom(t, `{
+		"initial_state": [{"type": "m.room.power_levels", "state_key": "", "content": "not an object"}],
+		"power_level_content_override": {"state_default": 75}
+	}`)
+	if res.Code != http.StatusBadRequest {
+		t.Errorf("got status %d for power levels that can't be overridden, want %d", res.Code, http.StatusBadRequest)
+	}
+}
+
+func TestCreateRoomInvitesRemoteUsers(t *testing.T) {
+	res, roomserver, tripper := createTestRoom(t, `{"invite":["@bob:remote"],"is_direct":true}`)
+	if res.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d: %+v", res.Code, http.StatusOK, res.JSON)
+	}
+	if len(tripper.destinations) != 1 || tripper.destinations[0] != "remote" {
+		t.Fatalf("got invites sent to %v, want [remote]", tripper.destinations)
+	}
+	if !strings.HasPrefix(tripper.paths[0], "/_matrix/federation/v2/invite/") {
+		t.Errorf("got invite sent to %s, want the v2 invite API", tripper.paths[0])
+	}
+	var sent struct {
+		RoomVersion     gomatrixserverlib.RoomVersion `json:"room_version"`
+		InviteRoomState []roomserverAPI.StrippedEvent `json:"invite_room_state"`
+	}
+	if err := json.Unmarshal(tripper.sent, &sent); err != nil {
+		t.Fatal(err)
+	}
+	if sent.RoomVersion != roomserver.events[0].RoomVersion {
+		t.Errorf("got room version %q sent, want %q", sent.RoomVersion, roomserver.events[0].RoomVersion)
+	}
+	var sentJoinRules bool
+	for _, ev := range sent.InviteRoomState {
+		sentJoinRules = sentJoinRules || ev.Type == gomatrixserverlib.MRoomJoinRules
+	}
+	if !sentJoinRules {
+		t.Errorf("got invite room state %+v, want it to include the join rules", sent.InviteRoomState)
+	}
+	var invite inviteContent
+	if err := json.Unmarshal(roomserver.stateEvent("m.room.member", "@bob:remote"), &invite); err != nil {
+		t.Fatal(err)
+	}
+	if invite.Membership != gomatrixserverlib.Invite || !invite.IsDirect {
+		t.Errorf("got membership %q and is_direct %v, want a direct invite", invite.Membership, invite.IsDirect)
+	}
+}
+
+func TestCreateRoomUnreachableRemoteInvitee(t *testing.T) {
+	res, roomserver, tripper := createTestRoom(t, `{"invite":["@bob:unreachable"]}`)
+	if res.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d: %+v", res.Code, http.StatusOK, res.JSON)
+	}
+	if len(tripper.destinations) != 1 {
+		t.Errorf("got invites sent to %v, want [unreachable]", tripper.destinations)
+	}
+	if content := roomserver.stateEvent("m.room.member", "@bob:unreachable"); content != nil {
+		t.Errorf("got membership %s for the unreachable invitee, want none", content)
+	}
+}
@@ -0,0 +1,251 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	appserviceAPI "github.com/matrix-org/dendrite/appservice/api"
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/devices"
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/clientapi/producers"
+	"github.com/matrix-org/dendrite/clientapi/threepid"
+	"github.com/matrix-org/dendrite/common/config"
+	keyServerAPI "github.com/matrix-org/dendrite/keyserver/api"
+	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+type deactivateAccountRequest struct {
+	Auth *authDict `json:"auth"`
+}
+
+type deactivateAccountResponse struct {
+	// We don't unbind third-party identifiers from identity servers.
+	IDServerUnbindResult string `json:"id_server_unbind_result"`
+}
+
+// DeactivateAccount implements POST /account/deactivate
+func DeactivateAccount(
+	req *http.Request, device *authtypes.Device, cfg *config.Dendrite,
+	accountDB accounts.Database, deviceDB devices.Database,
+	keyAPI keyServerAPI.KeyServerInputAPI,
+	queryAPI roomserverAPI.RoomserverQueryAPI, asAPI appserviceAPI.AppServiceQueryAPI,
+	producer *producers.RoomserverProducer, federation *gomatrixserverlib.FederationClient,
+) util.JSONResponse {
+	var r deactivateAccountRequest
+	if resErr := httputil.UnmarshalJSONRequest(req, &r); resErr != nil {
+		return *resErr
+	}
+
+	if resErr := authenticateUserInteractive(req.Context(), device, r.Auth, accountDB); resErr != nil {
+		return *resErr
+	}
+
+	ctx := req.Context()
+	localpart, _, err := gomatrixserverlib.SplitID('@', device.UserID)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("gomatrixserverlib.SplitID failed")
+		return jsonerror.InternalServerError()
+	}
+
+	threepids, err := accountDB.GetThreePIDsForLocalpart(ctx, localpart)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("accountDB.GetThreePIDsForLocalpart failed")
+		return jsonerror.InternalServerError()
+	}
+	for _, tpid := range threepids {
+		if err = accountDB.RemoveThreePIDAssociation(ctx, tpid.Address, tpid.Medium); err != nil {
+			util.GetLogger(ctx).WithError(err).Error("accountDB.RemoveThreePIDAssociation failed")
+			return jsonerror.InternalServerError()
+		}
+	}
+
+	// Clear the profile before leaving the rooms so that the leave events
+	// don't carry it.
+	if err = accountDB.SetDisplayName(ctx, localpart, ""); err != nil {
+		util.GetLogger(ctx).WithError(err).Error("accountDB.SetDisplayName failed")
+		return jsonerror.InternalServerError()
+	}
+	if err = accountDB.SetAvatarURL(ctx, localpart, ""); err != nil {
+		util.GetLogger(ctx).WithError(err).Error("accountDB.SetAvatarURL failed")
+		return jsonerror.InternalServerError()
+	}
+
+	roomIDs, err := accountDB.GetRoomIDsByLocalPart(ctx, localpart)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("accountDB.GetRoomIDsByLocalPart failed")
+		return jsonerror.InternalServerError()
+	}
+	for _, roomID := range roomIDs {
+		if err = leaveRoom(ctx, device, roomID, cfg, accountDB, queryAPI, asAPI, producer); err != nil {
+			// Carry on with the other rooms: the account is going away
+			// regardless of whether we could leave all of them.
+			util.GetLogger(ctx).WithError(err).WithField("room_id", roomID).Error("Failed to leave room while deactivating account")
+		}
+	}
+
+	// Reject the pending invites too, so that the user doesn't linger in the
+	// member lists of the rooms that they were invited to.
+	invitesReq := roomserverAPI.QueryRoomsForUserRequest{
+		UserID:         device.UserID,
+		WantMembership: gomatrixserverlib.Invite,
+	}
+	var invitesRes roomserverAPI.QueryRoomsForUserResponse
+	if err = queryAPI.QueryRoomsForUser(ctx, &invitesReq, &invitesRes); err != nil {
+		util.GetLogger(ctx).WithError(err).Error("queryAPI.QueryRoomsForUser failed")
+		return jsonerror.InternalServerError()
+	}
+	for _, roomID := range invitesRes.RoomIDs {
+		if err = rejectInvite(ctx, device, roomID, cfg, accountDB, queryAPI, asAPI, producer, federation); err != nil {
+			util.GetLogger(ctx).WithError(err).WithField("room_id", roomID).Error("Failed to reject invite while deactivating account")
+		}
+	}
+
+	if err = accountDB.DeactivateAccount(ctx, localpart); err != nil {
+		util.GetLogger(ctx).WithError(err).Error("accountDB.DeactivateAccount failed")
+		return jsonerror.InternalServerError()
+	}
+	deviceIDs, err := localDeviceIDs(ctx, deviceDB, localpart)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("localDeviceIDs failed")
+		return jsonerror.InternalServerError()
+	}
+	if err = deviceDB.RemoveAllDevices(ctx, localpart); err != nil {
+		util.GetLogger(ctx).WithError(err).Error("deviceDB.RemoveAllDevices failed")
+		return jsonerror.InternalServerError()
+	}
+	if err = deleteDeviceKeys(ctx, keyAPI, device.UserID, deviceIDs); err != nil {
+		util.GetLogger(ctx).WithError(err).Error("deleteDeviceKeys failed")
+		return jsonerror.InternalServerError()
+	}
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: deactivateAccountResponse{IDServerUnbindResult: "no-support"},
+	}
+}
+
+// leaveRoom sends a leave event for the user of the device to a room.
+func leaveRoom(
+	ctx context.Context, device *authtypes.Device, roomID string,
+	cfg *config.Dendrite, accountDB accounts.Database,
+	queryAPI roomserverAPI.RoomserverQueryAPI, asAPI appserviceAPI.AppServiceQueryAPI,
+	producer *producers.RoomserverProducer,
+) error {
+	verReq := roomserverAPI.QueryRoomVersionForRoomRequest{RoomID: roomID}
+	verRes := roomserverAPI.QueryRoomVersionForRoomResponse{}
+	if err := queryAPI.QueryRoomVersionForRoom(ctx, &verReq, &verRes); err != nil {
+		return err
+	}
+	event, err := buildMembershipEvent(
+		ctx, threepid.MembershipRequest{}, accountDB, device, gomatrixserverlib.Leave,
+		roomID, cfg, time.Now(), queryAPI, asAPI,
+	)
+	if err != nil {
+		return err
+	}
+	_, err = producer.SendEvents(
+		ctx, []gomatrixserverlib.HeaderedEvent{event.Headered(verRes.RoomVersion)},
+		cfg.Matrix.ServerName, nil,
+	)
+	return err
+}
+
+// rejectInvite rejects the invite of the user of the device to a room. If this
+// server isn't in the room then the invite is rejected through the server of
+// the user who sent it.
+func rejectInvite(
+	ctx context.Context, device *authtypes.Device, roomID string,
+	cfg *config.Dendrite, accountDB accounts.Database,
+	queryAPI roomserverAPI.RoomserverQueryAPI, asAPI appserviceAPI.AppServiceQueryAPI,
+	producer *producers.RoomserverProducer, federation *gomatrixserverlib.FederationClient,
+) error {
+	latestReq := roomserverAPI.QueryLatestEventsAndStateRequest{RoomID: roomID}
+	var latestRes roomserverAPI.QueryLatestEventsAndStateResponse
+	if err := queryAPI.QueryLatestEventsAndState(ctx, &latestReq, &latestRes); err != nil {
+		return err
+	}
+	if len(latestRes.LatestEvents) > 0 {
+		return leaveRoom(ctx, device, roomID, cfg, accountDB, queryAPI, asAPI, producer)
+	}
+
+	invitesReq := roomserverAPI.QueryInvitesForUserRequest{RoomID: roomID, TargetUserID: device.UserID}
+	var invitesRes roomserverAPI.QueryInvitesForUserResponse
+	if err := queryAPI.QueryInvitesForUser(ctx, &invitesReq, &invitesRes); err != nil {
+		return err
+	}
+	if len(invitesRes.InviteSenderUserIDs) == 0 {
+		return fmt.Errorf("no invite for %q in room %q", device.UserID, roomID)
+	}
+	_, serverName, err := gomatrixserverlib.SplitID('@', invitesRes.InviteSenderUserIDs[0])
+	if err != nil {
+		return err
+	}
+	res, err := federation.MakeLeave(ctx, serverName, roomID, device.UserID)
+	if err != nil {
+		return err
+	}
+	builder := res.LeaveEvent
+	var content gomatrixserverlib.MemberContent
+	if err = json.Unmarshal(builder.Content, &content); err != nil {
+		return err
+	}
+	if builder.Type != gomatrixserverlib.MRoomMember || builder.Sender != device.UserID ||
+		builder.StateKey == nil || *builder.StateKey != device.UserID ||
+		content.Membership != gomatrixserverlib.Leave {
+		return fmt.Errorf("make_leave returned a bad event for %q in room %q", device.UserID, roomID)
+	}
+	event, err := builder.Build(
+		time.Now(), cfg.Matrix.ServerName, cfg.Matrix.KeyID, cfg.Matrix.PrivateKey, latestRes.RoomVersion,
+	)
+	if err != nil {
+		return err
+	}
+	return sendLeave(ctx, cfg, federation, serverName, event)
+}
+
+// sendLeave sends a leave event made through make_leave to a remote server.
+// It does what FederationClient.SendLeave does, except that it can parse the
+// response of a successful request.
+func sendLeave(
+	ctx context.Context, cfg *config.Dendrite, federation *gomatrixserverlib.FederationClient,
+	serverName gomatrixserverlib.ServerName, event gomatrixserverlib.Event,
+) error {
+	path := "/_matrix/federation/v2/send_leave/" +
+		url.PathEscape(event.RoomID()) + "/" + url.PathEscape(event.EventID())
+	req := gomatrixserverlib.NewFederationRequest(http.MethodPut, serverName, path)
+	if err := req.SetContent(event); err != nil {
+		return err
+	}
+	if err := req.Sign(cfg.Matrix.ServerName, cfg.Matrix.KeyID, cfg.Matrix.PrivateKey); err != nil {
+		return err
+	}
+	httpReq, err := req.HTTPRequest()
+	if err != nil {
+		return err
+	}
+	var res struct{}
+	return federation.DoRequestAndParseResponse(ctx, httpReq, &res)
+}
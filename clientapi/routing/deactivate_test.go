@@ -0,0 +1,180 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/producers"
+	"github.com/matrix-org/dendrite/common/config"
+	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"golang.org/x/crypto/ed25519"
+)
+
+// deactivateRoomserver is a createRoomRoomserver that also knows about an
+// invite from @bob:remote into a room that this server isn't in.
+type deactivateRoomserver struct {
+	createRoomRoomserver
+}
+
+func (r *deactivateRoomserver) QueryLatestEventsAndState(
+	ctx context.Context,
+	request *roomserverAPI.QueryLatestEventsAndStateRequest,
+	response *roomserverAPI.QueryLatestEventsAndStateResponse,
+) error {
+	if len(r.events) == 0 {
+		// The room is only known through the invite.
+		response.RoomExists = true
+		response.RoomVersion = gomatrixserverlib.RoomVersionV1
+		return nil
+	}
+	return r.createRoomRoomserver.QueryLatestEventsAndState(ctx, request, response)
+}
+
+func (r *deactivateRoomserver) QueryRoomVersionForRoom(
+	ctx context.Context,
+	request *roomserverAPI.QueryRoomVersionForRoomRequest,
+	response *roomserverAPI.QueryRoomVersionForRoomResponse,
+) error {
+	response.RoomVersion = gomatrixserverlib.RoomVersionV1
+	return nil
+}
+
+func (r *deactivateRoomserver) QueryInvitesForUser(
+	ctx context.Context,
+	request *roomserverAPI.QueryInvitesForUserRequest,
+	response *roomserverAPI.QueryInvitesForUserResponse,
+) error {
+	response.InviteSenderUserIDs = []string{"@bob:remote"}
+	return nil
+}
+
+// leaveTripper answers the federation make_leave and send_leave requests of
+// the tests.
+type leaveTripper struct {
+	requests []string
+	sent     json.RawMessage
+}
+
+func (t *leaveTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.requests = append(t.requests, req.Method+" "+req.URL.Host+" "+strings.Split(req.URL.Path, "/")[4])
+	body := `{}`
+	if req.Method == http.MethodGet {
+		body = `{"event": {
+			"type": "m.room.member", "state_key": "@alice:localhost", "sender": "@alice:localhost",
+			"room_id": "!remote:remote", "content": {"membership": "leave"},
+			"prev_events": [], "auth_events": [], "depth": 5
+		}}`
+	} else {
+		sent, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			return nil, err
+		}
+		t.sent = sent
+	}
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": []string{"application/json"}},
+		Body:       ioutil.NopCloser(strings.NewReader(body)),
+		Request:    req,
+	}, nil
+}
+
+func rejectTestInvite(
+	t *testing.T, roomID string, roomEvents []fledglingEvent,
+) (*deactivateRoomserver, *leaveTripper) {
+	_, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &config.Dendrite{}
+	cfg.Matrix.ServerName = "localhost"
+	cfg.Matrix.KeyID = "ed25519:test"
+	cfg.Matrix.PrivateKey = privateKey
+
+	roomserver := &deactivateRoomserver{}
+	if len(roomEvents) > 0 {
+		roomserver.events, err = buildRoomEvents(
+			cfg, roomID, "@bob:localhost", time.Now(), gomatrixserverlib.RoomVersionV1, roomEvents,
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	tripper := &leaveTripper{}
+	transport := &http.Transport{}
+	transport.RegisterProtocol("matrix", tripper)
+	federation := gomatrixserverlib.NewFederationClientWithTransport(
+		cfg.Matrix.ServerName, cfg.Matrix.KeyID, privateKey, transport,
+	)
+
+	if err = rejectInvite(
+		context.Background(), &authtypes.Device{UserID: "@alice:localhost"}, roomID, cfg,
+		&createRoomAccountDB{}, roomserver, &createRoomAppServiceAPI{},
+		producers.NewRoomserverProducer(roomserver, roomserver), federation,
+	); err != nil {
+		t.Fatal(err)
+	}
+	return roomserver, tripper
+}
+
+func TestRejectInviteToLocalRoom(t *testing.T) {
+	roomserver, tripper := rejectTestInvite(t, "!local:localhost", []fledglingEvent{
+		{"m.room.create", "", map[string]string{"creator": "@bob:localhost"}},
+		{"m.room.member", "@bob:localhost", gomatrixserverlib.MemberContent{Membership: gomatrixserverlib.Join}},
+		{"m.room.join_rules", "", gomatrixserverlib.JoinRuleContent{JoinRule: gomatrixserverlib.Invite}},
+		{"m.room.member", "@alice:localhost", gomatrixserverlib.MemberContent{Membership: gomatrixserverlib.Invite}},
+	})
+	if len(tripper.requests) != 0 {
+		t.Errorf("got federation requests %v, want none", tripper.requests)
+	}
+	var content gomatrixserverlib.MemberContent
+	if err := json.Unmarshal(roomserver.stateEvent("m.room.member", "@alice:localhost"), &content); err != nil {
+		t.Fatal(err)
+	}
+	if content.Membership != gomatrixserverlib.Leave {
+		t.Errorf("got membership %q, want %q", content.Membership, gomatrixserverlib.Leave)
+	}
+}
+
+func TestRejectInviteToRemoteRoom(t *testing.T) {
+	roomserver, tripper := rejectTestInvite(t, "!remote:remote", nil)
+	want := []string{"GET remote make_leave", "PUT remote send_leave"}
+	if len(tripper.requests) != len(want) || tripper.requests[0] != want[0] || tripper.requests[1] != want[1] {
+		t.Fatalf("got federation requests %v, want %v", tripper.requests, want)
+	}
+	var sent struct {
+		Type     string `json:"type"`
+		StateKey string `json:"state_key"`
+		Origin   string `json:"origin"`
+	}
+	if err := json.Unmarshal(tripper.sent, &sent); err != nil {
+		t.Fatal(err)
+	}
+	if sent.Type != "m.room.member" || sent.StateKey != "@alice:localhost" || sent.Origin != "localhost" {
+		t.Errorf("got %s sent to send_leave, want a leave built by localhost", tripper.sent)
+	}
+	if len(roomserver.events) != 0 {
+		t.Errorf("got %d events sent to the roomserver, want none", len(roomserver.events))
+	}
+}
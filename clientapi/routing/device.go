@@ -15,13 +15,17 @@
 package routing
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
+	"io"
 	"net/http"
 
 	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
 	"github.com/matrix-org/dendrite/clientapi/auth/storage/devices"
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	keyServerAPI "github.com/matrix-org/dendrite/keyserver/api"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
 )
@@ -40,7 +44,12 @@ type deviceUpdateJSON struct {
 }
 
 type devicesDeleteJSON struct {
-	Devices []string `json:"devices"`
+	Devices []string  `json:"devices"`
+	Auth    *authDict `json:"auth"`
+}
+
+type deviceDeleteJSON struct {
+	Auth *authDict `json:"auth"`
 }
 
 // GetDeviceByID handles /devices/{deviceID}
@@ -160,8 +169,8 @@ func UpdateDeviceByID(
 
 // DeleteDeviceById handles DELETE requests to /devices/{deviceId}
 func DeleteDeviceById(
-	req *http.Request, deviceDB devices.Database, device *authtypes.Device,
-	deviceID string,
+	req *http.Request, accountDB accounts.Database, deviceDB devices.Database,
+	keyAPI keyServerAPI.KeyServerInputAPI, device *authtypes.Device, deviceID string,
 ) util.JSONResponse {
 	localpart, _, err := gomatrixserverlib.SplitID('@', device.UserID)
 	if err != nil {
@@ -172,10 +181,28 @@ func DeleteDeviceById(
 
 	defer req.Body.Close() // nolint: errcheck
 
+	// The body is optional, as the first request of the user-interactive
+	// authentication doesn't need to have one.
+	payload := deviceDeleteJSON{}
+	if err = json.NewDecoder(req.Body).Decode(&payload); err != nil && err != io.EOF {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.BadJSON("The request body could not be decoded into valid JSON. " + err.Error()),
+		}
+	}
+
+	if resErr := authenticateUserInteractive(ctx, device, payload.Auth, accountDB); resErr != nil {
+		return *resErr
+	}
+
 	if err := deviceDB.RemoveDevice(ctx, deviceID, localpart); err != nil {
 		util.GetLogger(req.Context()).WithError(err).Error("deviceDB.RemoveDevice failed")
 		return jsonerror.InternalServerError()
 	}
+	if err := deleteDeviceKeys(ctx, keyAPI, device.UserID, []string{deviceID}); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("deleteDeviceKeys failed")
+		return jsonerror.InternalServerError()
+	}
 
 	return util.JSONResponse{
 		Code: http.StatusOK,
@@ -185,7 +212,8 @@ func DeleteDeviceById(
 
 // DeleteDevices handles POST requests to /delete_devices
 func DeleteDevices(
-	req *http.Request, deviceDB devices.Database, device *authtypes.Device,
+	req *http.Request, accountDB accounts.Database, deviceDB devices.Database,
+	keyAPI keyServerAPI.KeyServerInputAPI, device *authtypes.Device,
 ) util.JSONResponse {
 	localpart, _, err := gomatrixserverlib.SplitID('@', device.UserID)
 	if err != nil {
@@ -203,13 +231,52 @@ func DeleteDevices(
 
 	defer req.Body.Close() // nolint: errcheck
 
+	if resErr := authenticateUserInteractive(ctx, device, payload.Auth, accountDB); resErr != nil {
+		return *resErr
+	}
+
 	if err := deviceDB.RemoveDevices(ctx, localpart, payload.Devices); err != nil {
 		util.GetLogger(req.Context()).WithError(err).Error("deviceDB.RemoveDevices failed")
 		return jsonerror.InternalServerError()
 	}
+	if err := deleteDeviceKeys(ctx, keyAPI, device.UserID, payload.Devices); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("deleteDeviceKeys failed")
+		return jsonerror.InternalServerError()
+	}
 
 	return util.JSONResponse{
 		Code: http.StatusOK,
 		JSON: struct{}{},
 	}
 }
+
+// deleteDeviceKeys asks the key server to delete the keys of removed devices,
+// so that the users who share a room with their owner stop encrypting for them.
+func deleteDeviceKeys(
+	ctx context.Context, keyAPI keyServerAPI.KeyServerInputAPI, userID string, deviceIDs []string,
+) error {
+	if len(deviceIDs) == 0 {
+		return nil
+	}
+	request := keyServerAPI.InputDeleteDeviceKeysRequest{
+		UserID:    userID,
+		DeviceIDs: deviceIDs,
+	}
+	var response keyServerAPI.InputDeleteDeviceKeysResponse
+	return keyAPI.InputDeleteDeviceKeys(ctx, &request, &response)
+}
+
+// localDeviceIDs returns the IDs of all of the devices of a local user.
+func localDeviceIDs(
+	ctx context.Context, deviceDB devices.Database, localpart string,
+) ([]string, error) {
+	deviceList, err := deviceDB.GetDevicesByLocalpart(ctx, localpart)
+	if err != nil {
+		return nil, err
+	}
+	deviceIDs := make([]string, len(deviceList))
+	for i, dev := range deviceList {
+		deviceIDs[i] = dev.ID
+	}
+	return deviceIDs, nil
+}
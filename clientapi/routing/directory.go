@@ -134,23 +134,10 @@ func SetLocalAlias(
 
 	// Check that the alias does not fall within an exclusive namespace of an
 	// application service
-	// TODO: This code should eventually be refactored with:
-	// 1. The new method for checking for things matching an AS's namespace
-	// 2. Using an overall Regex object for all AS's just like we did for usernames
-	for _, appservice := range cfg.Derived.ApplicationServices {
-		// Don't prevent AS from creating aliases in its own namespace
-		// Note that Dendrite uses SenderLocalpart as UserID for AS users
-		if device.UserID != appservice.SenderLocalpart {
-			if aliasNamespaces, ok := appservice.NamespaceMap["aliases"]; ok {
-				for _, namespace := range aliasNamespaces {
-					if namespace.Exclusive && namespace.RegexpObject.MatchString(alias) {
-						return util.JSONResponse{
-							Code: http.StatusBadRequest,
-							JSON: jsonerror.ASExclusive("Alias is reserved by an application service"),
-						}
-					}
-				}
-			}
+	if aliasInExclusiveNamespace(cfg, device.UserID, alias) {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.ASExclusive("Alias is reserved by an application service"),
 		}
 	}
 
@@ -185,6 +172,28 @@ func SetLocalAlias(
 	}
 }
 
+// aliasInExclusiveNamespace returns whether the alias falls within an exclusive
+// namespace of an application service other than the one of the user.
+// TODO: This code should eventually be refactored with:
+// 1. The new method for checking for things matching an AS's namespace
+// 2. Using an overall Regex object for all AS's just like we did for usernames
+func aliasInExclusiveNamespace(cfg *config.Dendrite, userID, alias string) bool {
+	for _, appservice := range cfg.Derived.ApplicationServices {
+		// Don't prevent AS from creating aliases in its own namespace
+		// Note that Dendrite uses SenderLocalpart as UserID for AS users
+		if userID != appservice.SenderLocalpart {
+			if aliasNamespaces, ok := appservice.NamespaceMap["aliases"]; ok {
+				for _, namespace := range aliasNamespaces {
+					if namespace.Exclusive && namespace.RegexpObject.MatchString(alias) {
+						return true
+					}
+				}
+			}
+		}
+	}
+	return false
+}
+
 // RemoveLocalAlias implements DELETE /directory/room/{roomAlias}
 func RemoveLocalAlias(
 	req *http.Request,
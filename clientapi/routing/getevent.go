@@ -79,51 +79,34 @@ func GetEvent(
 		requestedEvent: requestedEvent,
 	}
 
-	stateReq := api.QueryStateAfterEventsRequest{
-		RoomID:       r.requestedEvent.RoomID(),
-		PrevEventIDs: r.requestedEvent.PrevEventIDs(),
-		StateToFetch: []gomatrixserverlib.StateKeyTuple{{
-			EventType: gomatrixserverlib.MRoomMember,
-			StateKey:  device.UserID,
-		}},
-	}
-	var stateResp api.QueryStateAfterEventsResponse
-	if err := queryAPI.QueryStateAfterEvents(req.Context(), &stateReq, &stateResp); err != nil {
-		util.GetLogger(req.Context()).WithError(err).Error("queryAPI.QueryStateAfterEvents failed")
-		return jsonerror.InternalServerError()
+	if r.requestedEvent.RoomID() != r.roomID {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("The event was not found or you do not have permission to read this event"),
+		}
 	}
 
-	if !stateResp.RoomExists {
-		util.GetLogger(req.Context()).Errorf("Expected to find room for event %s but failed", r.requestedEvent.EventID())
+	// Check the history visibility of the room and the membership of the user
+	// at the event to decide whether the user can see it.
+	visibilityReq := api.QueryUserAllowedToSeeEventsRequest{
+		UserID:   r.device.UserID,
+		EventIDs: []string{r.eventID},
+	}
+	var visibilityRes api.QueryUserAllowedToSeeEventsResponse
+	if err := queryAPI.QueryUserAllowedToSeeEvents(req.Context(), &visibilityReq, &visibilityRes); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("queryAPI.QueryUserAllowedToSeeEvents failed")
 		return jsonerror.InternalServerError()
 	}
 
-	if !stateResp.PrevEventsExist {
-		// Missing some events locally; stateResp.StateEvents unavailable.
+	if !visibilityRes.AllowedToSeeEvents[r.eventID] {
 		return util.JSONResponse{
 			Code: http.StatusNotFound,
 			JSON: jsonerror.NotFound("The event was not found or you do not have permission to read this event"),
 		}
 	}
 
-	for _, stateEvent := range stateResp.StateEvents {
-		if stateEvent.StateKeyEquals(r.device.UserID) {
-			membership, err := stateEvent.Membership()
-			if err != nil {
-				util.GetLogger(req.Context()).WithError(err).Error("stateEvent.Membership failed")
-				return jsonerror.InternalServerError()
-			}
-			if membership == gomatrixserverlib.Join {
-				return util.JSONResponse{
-					Code: http.StatusOK,
-					JSON: gomatrixserverlib.ToClientEvent(r.requestedEvent, gomatrixserverlib.FormatAll),
-				}
-			}
-		}
-	}
-
 	return util.JSONResponse{
-		Code: http.StatusNotFound,
-		JSON: jsonerror.NotFound("The event was not found or you do not have permission to read this event"),
+		Code: http.StatusOK,
+		JSON: gomatrixserverlib.ToClientEvent(r.requestedEvent, gomatrixserverlib.FormatAll),
 	}
 }
@@ -27,8 +27,10 @@ import (
 	"github.com/matrix-org/dendrite/clientapi/producers"
 	"github.com/matrix-org/dendrite/common"
 	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/dendrite/common/keydb"
 	"github.com/matrix-org/dendrite/roomserver/api"
 	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
+	roomserverVersion "github.com/matrix-org/dendrite/roomserver/version"
 	"github.com/matrix-org/gomatrix"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
@@ -333,7 +335,7 @@ func (r joinRoomReq) joinRoomUsingServer(roomID string, server gomatrixserverlib
 	if respMakeJoin.RoomVersion == "" {
 		respMakeJoin.RoomVersion = gomatrixserverlib.RoomVersionV1
 	}
-	if _, err = respMakeJoin.RoomVersion.EventFormat(); err != nil {
+	if _, err = roomserverVersion.SupportedRoomVersion(respMakeJoin.RoomVersion); err != nil {
 		return &util.JSONResponse{
 			Code: http.StatusBadRequest,
 			JSON: jsonerror.UnsupportedRoomVersion(
@@ -357,7 +359,9 @@ func (r joinRoomReq) joinRoomUsingServer(roomID string, server gomatrixserverlib
 		return nil, err
 	}
 
-	if err = respSendJoin.Check(r.req.Context(), r.keyRing, event); err != nil {
+	if err = respSendJoin.Check(
+		r.req.Context(), keydb.KeyRingForRoomVersion(r.keyRing, respMakeJoin.RoomVersion), event,
+	); err != nil {
 		return nil, err
 	}
 
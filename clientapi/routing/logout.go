@@ -20,13 +20,15 @@ import (
 	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
 	"github.com/matrix-org/dendrite/clientapi/auth/storage/devices"
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	keyServerAPI "github.com/matrix-org/dendrite/keyserver/api"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
 )
 
 // Logout handles POST /logout
 func Logout(
-	req *http.Request, deviceDB devices.Database, device *authtypes.Device,
+	req *http.Request, deviceDB devices.Database, keyAPI keyServerAPI.KeyServerInputAPI,
+	device *authtypes.Device,
 ) util.JSONResponse {
 	localpart, _, err := gomatrixserverlib.SplitID('@', device.UserID)
 	if err != nil {
@@ -38,6 +40,10 @@ func Logout(
 		util.GetLogger(req.Context()).WithError(err).Error("deviceDB.RemoveDevice failed")
 		return jsonerror.InternalServerError()
 	}
+	if err := deleteDeviceKeys(req.Context(), keyAPI, device.UserID, []string{device.ID}); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("deleteDeviceKeys failed")
+		return jsonerror.InternalServerError()
+	}
 
 	return util.JSONResponse{
 		Code: http.StatusOK,
@@ -47,7 +53,8 @@ func Logout(
 
 // LogoutAll handles POST /logout/all
 func LogoutAll(
-	req *http.Request, deviceDB devices.Database, device *authtypes.Device,
+	req *http.Request, deviceDB devices.Database, keyAPI keyServerAPI.KeyServerInputAPI,
+	device *authtypes.Device,
 ) util.JSONResponse {
 	localpart, _, err := gomatrixserverlib.SplitID('@', device.UserID)
 	if err != nil {
@@ -55,10 +62,19 @@ func LogoutAll(
 		return jsonerror.InternalServerError()
 	}
 
+	deviceIDs, err := localDeviceIDs(req.Context(), deviceDB, localpart)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("localDeviceIDs failed")
+		return jsonerror.InternalServerError()
+	}
 	if err := deviceDB.RemoveAllDevices(req.Context(), localpart); err != nil {
 		util.GetLogger(req.Context()).WithError(err).Error("deviceDB.RemoveAllDevices failed")
 		return jsonerror.InternalServerError()
 	}
+	if err := deleteDeviceKeys(req.Context(), keyAPI, device.UserID, deviceIDs); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("deleteDeviceKeys failed")
+		return jsonerror.InternalServerError()
+	}
 
 	return util.JSONResponse{
 		Code: http.StatusOK,
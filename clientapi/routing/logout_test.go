@@ -0,0 +1,101 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/devices"
+	keyServerAPI "github.com/matrix-org/dendrite/keyserver/api"
+)
+
+// logoutDeviceDB is a device database holding the devices of @alice:localhost.
+type logoutDeviceDB struct {
+	devices.Database
+	deviceIDs []string
+}
+
+func (d *logoutDeviceDB) GetDevicesByLocalpart(
+	ctx context.Context, localpart string,
+) ([]authtypes.Device, error) {
+	var deviceList []authtypes.Device
+	for _, deviceID := range d.deviceIDs {
+		deviceList = append(deviceList, authtypes.Device{ID: deviceID, UserID: "@alice:localhost"})
+	}
+	return deviceList, nil
+}
+
+func (d *logoutDeviceDB) RemoveDevice(ctx context.Context, deviceID, localpart string) error {
+	for i := range d.deviceIDs {
+		if d.deviceIDs[i] == deviceID {
+			d.deviceIDs = append(d.deviceIDs[:i], d.deviceIDs[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+func (d *logoutDeviceDB) RemoveAllDevices(ctx context.Context, localpart string) error {
+	d.deviceIDs = nil
+	return nil
+}
+
+// logoutKeyAPI records the devices whose keys it was asked to delete.
+type logoutKeyAPI struct {
+	keyServerAPI.KeyServerInputAPI
+	deleted []string
+}
+
+func (k *logoutKeyAPI) InputDeleteDeviceKeys(
+	ctx context.Context,
+	request *keyServerAPI.InputDeleteDeviceKeysRequest,
+	response *keyServerAPI.InputDeleteDeviceKeysResponse,
+) error {
+	k.deleted = append(k.deleted, request.DeviceIDs...)
+	return nil
+}
+
+func TestLogoutDeletesDeviceKeys(t *testing.T) {
+	deviceDB := &logoutDeviceDB{deviceIDs: []string{"PHONE", "LAPTOP"}}
+	keyAPI := &logoutKeyAPI{}
+	device := &authtypes.Device{ID: "PHONE", UserID: "@alice:localhost"}
+
+	req := httptest.NewRequest(http.MethodPost, "/logout", nil)
+	if res := Logout(req, deviceDB, keyAPI, device); res.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d", res.Code, http.StatusOK)
+	}
+	if want := []string{"PHONE"}; !reflect.DeepEqual(keyAPI.deleted, want) {
+		t.Errorf("got keys deleted for %v, want %v", keyAPI.deleted, want)
+	}
+}
+
+func TestLogoutAllDeletesDeviceKeys(t *testing.T) {
+	deviceDB := &logoutDeviceDB{deviceIDs: []string{"PHONE", "LAPTOP"}}
+	keyAPI := &logoutKeyAPI{}
+	device := &authtypes.Device{ID: "PHONE", UserID: "@alice:localhost"}
+
+	req := httptest.NewRequest(http.MethodPost, "/logout/all", nil)
+	if res := LogoutAll(req, deviceDB, keyAPI, device); res.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d", res.Code, http.StatusOK)
+	}
+	if want := []string{"PHONE", "LAPTOP"}; !reflect.DeepEqual(keyAPI.deleted, want) {
+		t.Errorf("got keys deleted for %v, want %v", keyAPI.deleted, want)
+	}
+}
@@ -35,7 +35,9 @@ type getJoinedRoomsResponse struct {
 	JoinedRooms []string `json:"joined_rooms"`
 }
 
-// GetMemberships implements GET /rooms/{roomId}/members
+// GetMemberships implements GET /rooms/{roomId}/joined_members. The sync API
+// implements GET /rooms/{roomId}/members, as it needs the sync tokens of the
+// "at" parameter.
 func GetMemberships(
 	req *http.Request, device *authtypes.Device, roomID string, joinedOnly bool,
 	_ *config.Dendrite,
@@ -0,0 +1,102 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"net/http"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/devices"
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	keyServerAPI "github.com/matrix-org/dendrite/keyserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+type changePasswordRequest struct {
+	NewPassword string `json:"new_password"`
+	// Whether the other devices of the user should be logged out. Defaults
+	// to true when omitted.
+	LogoutDevices *bool     `json:"logout_devices"`
+	Auth          *authDict `json:"auth"`
+}
+
+// ChangePassword implements POST /account/password
+func ChangePassword(
+	req *http.Request, device *authtypes.Device,
+	accountDB accounts.Database, deviceDB devices.Database,
+	keyAPI keyServerAPI.KeyServerInputAPI,
+) util.JSONResponse {
+	var r changePasswordRequest
+	if resErr := httputil.UnmarshalJSONRequest(req, &r); resErr != nil {
+		return *resErr
+	}
+
+	if r.NewPassword == "" {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.MissingArgument("'new_password' must be supplied"),
+		}
+	}
+	if resErr := validatePassword(r.NewPassword); resErr != nil {
+		return *resErr
+	}
+
+	if resErr := authenticateUserInteractive(req.Context(), device, r.Auth, accountDB); resErr != nil {
+		return *resErr
+	}
+
+	localpart, _, err := gomatrixserverlib.SplitID('@', device.UserID)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("gomatrixserverlib.SplitID failed")
+		return jsonerror.InternalServerError()
+	}
+
+	if err = accountDB.SetPassword(req.Context(), localpart, r.NewPassword); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("accountDB.SetPassword failed")
+		return jsonerror.InternalServerError()
+	}
+
+	if r.LogoutDevices == nil || *r.LogoutDevices {
+		deviceList, err := deviceDB.GetDevicesByLocalpart(req.Context(), localpart)
+		if err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("deviceDB.GetDevicesByLocalpart failed")
+			return jsonerror.InternalServerError()
+		}
+		var otherDeviceIDs []string
+		for _, dev := range deviceList {
+			if dev.ID != device.ID {
+				otherDeviceIDs = append(otherDeviceIDs, dev.ID)
+			}
+		}
+		if len(otherDeviceIDs) > 0 {
+			if err = deviceDB.RemoveDevices(req.Context(), localpart, otherDeviceIDs); err != nil {
+				util.GetLogger(req.Context()).WithError(err).Error("deviceDB.RemoveDevices failed")
+				return jsonerror.InternalServerError()
+			}
+			if err = deleteDeviceKeys(req.Context(), keyAPI, device.UserID, otherDeviceIDs); err != nil {
+				util.GetLogger(req.Context()).WithError(err).Error("deleteDeviceKeys failed")
+				return jsonerror.InternalServerError()
+			}
+		}
+	}
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct{}{},
+	}
+}
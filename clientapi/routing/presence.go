@@ -0,0 +1,108 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/clientapi/producers"
+	"github.com/matrix-org/dendrite/presenceserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+type presenceRequest struct {
+	Presence  string `json:"presence"`
+	StatusMsg string `json:"status_msg"`
+}
+
+type presenceResponse struct {
+	Presence        string  `json:"presence"`
+	LastActiveAgo   int64   `json:"last_active_ago,omitempty"`
+	StatusMsg       *string `json:"status_msg,omitempty"`
+	CurrentlyActive bool    `json:"currently_active"`
+}
+
+// SetPresence implements PUT /presence/{userID}/status
+func SetPresence(
+	req *http.Request, device *authtypes.Device, userID string,
+	presenceProducer *producers.PresenceServerProducer,
+) util.JSONResponse {
+	if device.UserID != userID {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("Cannot set another user's presence"),
+		}
+	}
+
+	var r presenceRequest
+	if resErr := httputil.UnmarshalJSONRequest(req, &r); resErr != nil {
+		return *resErr
+	}
+	switch r.Presence {
+	case api.PresenceOnline, api.PresenceUnavailable, api.PresenceOffline:
+	default:
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("presence must be one of online, unavailable or offline"),
+		}
+	}
+
+	if err := presenceProducer.Send(
+		req.Context(), userID, r.Presence, &r.StatusMsg,
+		gomatrixserverlib.AsTimestamp(time.Now()), r.Presence == api.PresenceOnline,
+	); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("presenceProducer.Send failed")
+		return jsonerror.InternalServerError()
+	}
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct{}{},
+	}
+}
+
+// GetPresence implements GET /presence/{userID}/status
+func GetPresence(
+	req *http.Request, userID string,
+	presenceQueryAPI api.PresenceServerQueryAPI,
+) util.JSONResponse {
+	var queryRes api.QueryPresenceForUserResponse
+	if err := presenceQueryAPI.QueryPresenceForUser(
+		req.Context(), &api.QueryPresenceForUserRequest{UserID: userID}, &queryRes,
+	); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("presenceQueryAPI.QueryPresenceForUser failed")
+		return jsonerror.InternalServerError()
+	}
+
+	res := presenceResponse{
+		Presence:        queryRes.Presence,
+		CurrentlyActive: queryRes.CurrentlyActive,
+	}
+	if queryRes.LastActiveTS != 0 {
+		res.LastActiveAgo = time.Since(queryRes.LastActiveTS.Time()).Nanoseconds() / int64(time.Millisecond)
+	}
+	if queryRes.StatusMsg != "" {
+		res.StatusMsg = &queryRes.StatusMsg
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: res,
+	}
+}
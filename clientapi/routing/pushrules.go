@@ -0,0 +1,428 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/clientapi/producers"
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/dendrite/common/pushrules"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+// The only scope of push rules that we support.
+const pushRulesGlobalScope = "global"
+
+type putPushRuleRequest struct {
+	Actions    []pushrules.Action    `json:"actions"`
+	Conditions []pushrules.Condition `json:"conditions"`
+	Pattern    string                `json:"pattern"`
+}
+
+// GetAllPushRules implements GET /pushrules/
+func GetAllPushRules(
+	req *http.Request, device *authtypes.Device,
+	accountDB accounts.Database, cfg *config.Dendrite,
+) util.JSONResponse {
+	ruleSets, resErr := loadPushRules(req, device, accountDB, cfg)
+	if resErr != nil {
+		return *resErr
+	}
+	return util.JSONResponse{Code: http.StatusOK, JSON: ruleSets}
+}
+
+// GetPushRulesByScope implements GET /pushrules/{scope}/
+func GetPushRulesByScope(
+	req *http.Request, device *authtypes.Device,
+	accountDB accounts.Database, cfg *config.Dendrite, scope string,
+) util.JSONResponse {
+	ruleSets, resErr := loadPushRules(req, device, accountDB, cfg)
+	if resErr != nil {
+		return *resErr
+	}
+	ruleSet, resErr := pushRuleSetForScope(ruleSets, scope)
+	if resErr != nil {
+		return *resErr
+	}
+	return util.JSONResponse{Code: http.StatusOK, JSON: ruleSet}
+}
+
+// GetPushRulesByKind implements GET /pushrules/{scope}/{kind}/
+func GetPushRulesByKind(
+	req *http.Request, device *authtypes.Device,
+	accountDB accounts.Database, cfg *config.Dendrite, scope, kind string,
+) util.JSONResponse {
+	ruleSets, resErr := loadPushRules(req, device, accountDB, cfg)
+	if resErr != nil {
+		return *resErr
+	}
+	rules, resErr := pushRulesForKind(ruleSets, scope, kind)
+	if resErr != nil {
+		return *resErr
+	}
+	return util.JSONResponse{Code: http.StatusOK, JSON: *rules}
+}
+
+// GetPushRuleByRuleID implements GET /pushrules/{scope}/{kind}/{ruleID}
+func GetPushRuleByRuleID(
+	req *http.Request, device *authtypes.Device,
+	accountDB accounts.Database, cfg *config.Dendrite, scope, kind, ruleID string,
+) util.JSONResponse {
+	ruleSets, resErr := loadPushRules(req, device, accountDB, cfg)
+	if resErr != nil {
+		return *resErr
+	}
+	rules, resErr := pushRulesForKind(ruleSets, scope, kind)
+	if resErr != nil {
+		return *resErr
+	}
+	i := findPushRule(*rules, ruleID)
+	if i < 0 {
+		return pushRuleNotFound()
+	}
+	return util.JSONResponse{Code: http.StatusOK, JSON: (*rules)[i]}
+}
+
+// PutPushRuleByRuleID implements PUT /pushrules/{scope}/{kind}/{ruleID}
+// The optional "before" and "after" query parameters give the ID of the rule
+// that the new rule should be placed next to.
+func PutPushRuleByRuleID(
+	req *http.Request, device *authtypes.Device,
+	accountDB accounts.Database, cfg *config.Dendrite,
+	syncProducer *producers.SyncAPIProducer, scope, kind, ruleID string,
+) util.JSONResponse {
+	var r putPushRuleRequest
+	if resErr := httputil.UnmarshalJSONRequest(req, &r); resErr != nil {
+		return *resErr
+	}
+	if strings.HasPrefix(ruleID, ".") {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("Rule IDs starting with '.' are reserved for default rules"),
+		}
+	}
+	if r.Actions == nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.MissingArgument("Missing actions"),
+		}
+	}
+	if kind == pushrules.ContentKind && r.Pattern == "" {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.MissingArgument("Content rules must have a pattern"),
+		}
+	}
+
+	ruleSets, resErr := loadPushRules(req, device, accountDB, cfg)
+	if resErr != nil {
+		return *resErr
+	}
+	rules, resErr := pushRulesForKind(ruleSets, scope, kind)
+	if resErr != nil {
+		return *resErr
+	}
+
+	rule := &pushrules.Rule{
+		RuleID:  ruleID,
+		Enabled: true,
+		Actions: r.Actions,
+	}
+	switch kind {
+	case pushrules.OverrideKind, pushrules.UnderrideKind:
+		rule.Conditions = r.Conditions
+		if rule.Conditions == nil {
+			rule.Conditions = []pushrules.Condition{}
+		}
+	case pushrules.ContentKind:
+		rule.Pattern = r.Pattern
+	}
+
+	// Updating an existing rule keeps it in place unless it is being moved.
+	before := req.URL.Query().Get("before")
+	after := req.URL.Query().Get("after")
+	if i := findPushRule(*rules, ruleID); i >= 0 {
+		rule.Enabled = (*rules)[i].Enabled
+		if before == "" && after == "" {
+			(*rules)[i] = rule
+			return savePushRules(req, device, accountDB, syncProducer, ruleSets)
+		}
+		*rules = append((*rules)[:i], (*rules)[i+1:]...)
+	}
+
+	position := len(*rules)
+	if before != "" || after != "" {
+		relativeTo := before
+		if relativeTo == "" {
+			relativeTo = after
+		}
+		if strings.HasPrefix(relativeTo, ".") {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue("Rules cannot be placed relative to default rules"),
+			}
+		}
+		if position = findPushRule(*rules, relativeTo); position < 0 {
+			return pushRuleNotFound()
+		}
+		if before == "" {
+			position++
+		}
+	} else {
+		// New rules go after the user's own rules but before the default
+		// rules, so that they take precedence over the defaults.
+		for j, existing := range *rules {
+			if existing.Default {
+				position = j
+				break
+			}
+		}
+	}
+	*rules = append(*rules, nil)
+	copy((*rules)[position+1:], (*rules)[position:])
+	(*rules)[position] = rule
+
+	return savePushRules(req, device, accountDB, syncProducer, ruleSets)
+}
+
+// DeletePushRuleByRuleID implements DELETE /pushrules/{scope}/{kind}/{ruleID}
+func DeletePushRuleByRuleID(
+	req *http.Request, device *authtypes.Device,
+	accountDB accounts.Database, cfg *config.Dendrite,
+	syncProducer *producers.SyncAPIProducer, scope, kind, ruleID string,
+) util.JSONResponse {
+	ruleSets, resErr := loadPushRules(req, device, accountDB, cfg)
+	if resErr != nil {
+		return *resErr
+	}
+	rules, resErr := pushRulesForKind(ruleSets, scope, kind)
+	if resErr != nil {
+		return *resErr
+	}
+	i := findPushRule(*rules, ruleID)
+	if i < 0 {
+		return pushRuleNotFound()
+	}
+	if (*rules)[i].Default {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("Default rules cannot be deleted"),
+		}
+	}
+	*rules = append((*rules)[:i], (*rules)[i+1:]...)
+	return savePushRules(req, device, accountDB, syncProducer, ruleSets)
+}
+
+// GetPushRuleAttrByRuleID implements GET /pushrules/{scope}/{kind}/{ruleID}/{attr}
+func GetPushRuleAttrByRuleID(
+	req *http.Request, device *authtypes.Device,
+	accountDB accounts.Database, cfg *config.Dendrite, scope, kind, ruleID, attr string,
+) util.JSONResponse {
+	ruleSets, resErr := loadPushRules(req, device, accountDB, cfg)
+	if resErr != nil {
+		return *resErr
+	}
+	rules, resErr := pushRulesForKind(ruleSets, scope, kind)
+	if resErr != nil {
+		return *resErr
+	}
+	i := findPushRule(*rules, ruleID)
+	if i < 0 {
+		return pushRuleNotFound()
+	}
+	switch attr {
+	case "enabled":
+		return util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: map[string]bool{"enabled": (*rules)[i].Enabled},
+		}
+	case "actions":
+		return util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: map[string][]pushrules.Action{"actions": (*rules)[i].Actions},
+		}
+	}
+	return unknownPushRuleAttr()
+}
+
+// PutPushRuleAttrByRuleID implements PUT /pushrules/{scope}/{kind}/{ruleID}/{attr}
+func PutPushRuleAttrByRuleID(
+	req *http.Request, device *authtypes.Device,
+	accountDB accounts.Database, cfg *config.Dendrite,
+	syncProducer *producers.SyncAPIProducer, scope, kind, ruleID, attr string,
+) util.JSONResponse {
+	var r struct {
+		Enabled *bool              `json:"enabled"`
+		Actions []pushrules.Action `json:"actions"`
+	}
+	if resErr := httputil.UnmarshalJSONRequest(req, &r); resErr != nil {
+		return *resErr
+	}
+
+	ruleSets, resErr := loadPushRules(req, device, accountDB, cfg)
+	if resErr != nil {
+		return *resErr
+	}
+	rules, resErr := pushRulesForKind(ruleSets, scope, kind)
+	if resErr != nil {
+		return *resErr
+	}
+	i := findPushRule(*rules, ruleID)
+	if i < 0 {
+		return pushRuleNotFound()
+	}
+	switch attr {
+	case "enabled":
+		if r.Enabled == nil {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.MissingArgument("Missing enabled"),
+			}
+		}
+		(*rules)[i].Enabled = *r.Enabled
+	case "actions":
+		if r.Actions == nil {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.MissingArgument("Missing actions"),
+			}
+		}
+		(*rules)[i].Actions = r.Actions
+	default:
+		return unknownPushRuleAttr()
+	}
+	return savePushRules(req, device, accountDB, syncProducer, ruleSets)
+}
+
+// loadPushRules returns the push rules of the user, or the default rules if
+// the user hasn't got any stored.
+func loadPushRules(
+	req *http.Request, device *authtypes.Device,
+	accountDB accounts.Database, cfg *config.Dendrite,
+) (*pushrules.AccountRuleSets, *util.JSONResponse) {
+	localpart, _, err := gomatrixserverlib.SplitID('@', device.UserID)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("gomatrixserverlib.SplitID failed")
+		resErr := jsonerror.InternalServerError()
+		return nil, &resErr
+	}
+	data, err := accountDB.GetAccountDataByType(req.Context(), localpart, "", pushrules.AccountDataType)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("accountDB.GetAccountDataByType failed")
+		resErr := jsonerror.InternalServerError()
+		return nil, &resErr
+	}
+	ruleSets, err := pushrules.FromAccountData(data, localpart, cfg.Matrix.ServerName)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("pushrules.FromAccountData failed")
+		resErr := jsonerror.InternalServerError()
+		return nil, &resErr
+	}
+	return ruleSets, nil
+}
+
+// savePushRules stores the push rules of the user and tells the sync API
+// about the change.
+func savePushRules(
+	req *http.Request, device *authtypes.Device, accountDB accounts.Database,
+	syncProducer *producers.SyncAPIProducer, ruleSets *pushrules.AccountRuleSets,
+) util.JSONResponse {
+	localpart, _, err := gomatrixserverlib.SplitID('@', device.UserID)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("gomatrixserverlib.SplitID failed")
+		return jsonerror.InternalServerError()
+	}
+	content, err := json.Marshal(ruleSets)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("json.Marshal failed")
+		return jsonerror.InternalServerError()
+	}
+	if err = accountDB.SaveAccountData(
+		req.Context(), localpart, "", pushrules.AccountDataType, string(content),
+	); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("accountDB.SaveAccountData failed")
+		return jsonerror.InternalServerError()
+	}
+	if err = syncProducer.SendData(device.UserID, "", pushrules.AccountDataType); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("syncProducer.SendData failed")
+		return jsonerror.InternalServerError()
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct{}{},
+	}
+}
+
+func pushRuleSetForScope(
+	ruleSets *pushrules.AccountRuleSets, scope string,
+) (*pushrules.RuleSet, *util.JSONResponse) {
+	if scope != pushRulesGlobalScope {
+		return nil, &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("Unknown push rule scope " + scope),
+		}
+	}
+	return &ruleSets.Global, nil
+}
+
+func pushRulesForKind(
+	ruleSets *pushrules.AccountRuleSets, scope, kind string,
+) (*[]*pushrules.Rule, *util.JSONResponse) {
+	ruleSet, resErr := pushRuleSetForScope(ruleSets, scope)
+	if resErr != nil {
+		return nil, resErr
+	}
+	rules := ruleSet.RulesOfKind(kind)
+	if rules == nil {
+		return nil, &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("Unknown push rule kind " + kind),
+		}
+	}
+	return rules, nil
+}
+
+// findPushRule returns the index of the rule with the given ID, or -1 if
+// there is no such rule.
+func findPushRule(rules []*pushrules.Rule, ruleID string) int {
+	for i, rule := range rules {
+		if rule.RuleID == ruleID {
+			return i
+		}
+	}
+	return -1
+}
+
+func pushRuleNotFound() util.JSONResponse {
+	return util.JSONResponse{
+		Code: http.StatusNotFound,
+		JSON: jsonerror.NotFound("Push rule not found"),
+	}
+}
+
+func unknownPushRuleAttr() util.JSONResponse {
+	return util.JSONResponse{
+		Code: http.StatusBadRequest,
+		JSON: jsonerror.InvalidArgumentValue("Unknown push rule attribute"),
+	}
+}
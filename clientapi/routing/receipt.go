@@ -0,0 +1,155 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/clientapi/producers"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+// The only receipt type that the spec defines.
+const receiptTypeRead = "m.read"
+
+type readMarkersRequest struct {
+	FullyRead string `json:"m.fully_read"`
+	Read      string `json:"m.read"`
+}
+
+type fullyReadContent struct {
+	EventID string `json:"event_id"`
+}
+
+// SetReceipt implements POST /rooms/{roomID}/receipt/{receiptType}/{eventID}
+func SetReceipt(
+	req *http.Request, device *authtypes.Device,
+	roomID, receiptType, eventID string,
+	accountDB accounts.Database, receiptProducer *producers.ReceiptProducer,
+) util.JSONResponse {
+	if receiptType != receiptTypeRead {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("Unsupported receipt type " + receiptType),
+		}
+	}
+	if resErr := checkJoinedToRoom(req, device, roomID, accountDB); resErr != nil {
+		return *resErr
+	}
+
+	if err := receiptProducer.SendReceipt(
+		roomID, receiptType, device.UserID, eventID, gomatrixserverlib.AsTimestamp(time.Now()),
+	); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("receiptProducer.SendReceipt failed")
+		return jsonerror.InternalServerError()
+	}
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct{}{},
+	}
+}
+
+// SetReadMarkers implements POST /rooms/{roomID}/read_markers
+// The m.fully_read marker is stored as room account data, and m.read is sent
+// as a receipt.
+func SetReadMarkers(
+	req *http.Request, device *authtypes.Device, roomID string,
+	accountDB accounts.Database,
+	syncProducer *producers.SyncAPIProducer,
+	receiptProducer *producers.ReceiptProducer,
+) util.JSONResponse {
+	var r readMarkersRequest
+	if resErr := httputil.UnmarshalJSONRequest(req, &r); resErr != nil {
+		return *resErr
+	}
+	if r.FullyRead == "" {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.MissingArgument("m.fully_read must be given"),
+		}
+	}
+	if resErr := checkJoinedToRoom(req, device, roomID, accountDB); resErr != nil {
+		return *resErr
+	}
+
+	localpart, _, err := gomatrixserverlib.SplitID('@', device.UserID)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("gomatrixserverlib.SplitID failed")
+		return jsonerror.InternalServerError()
+	}
+	content, err := json.Marshal(fullyReadContent{EventID: r.FullyRead})
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("json.Marshal failed")
+		return jsonerror.InternalServerError()
+	}
+	if err = accountDB.SaveAccountData(
+		req.Context(), localpart, roomID, "m.fully_read", string(content),
+	); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("accountDB.SaveAccountData failed")
+		return jsonerror.InternalServerError()
+	}
+	if err = syncProducer.SendData(device.UserID, roomID, "m.fully_read"); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("syncProducer.SendData failed")
+		return jsonerror.InternalServerError()
+	}
+
+	if r.Read != "" {
+		if err = receiptProducer.SendReceipt(
+			roomID, receiptTypeRead, device.UserID, r.Read, gomatrixserverlib.AsTimestamp(time.Now()),
+		); err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("receiptProducer.SendReceipt failed")
+			return jsonerror.InternalServerError()
+		}
+	}
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct{}{},
+	}
+}
+
+// checkJoinedToRoom returns an error response if the user of the device is not
+// joined to the room.
+func checkJoinedToRoom(
+	req *http.Request, device *authtypes.Device, roomID string, accountDB accounts.Database,
+) *util.JSONResponse {
+	localpart, _, err := gomatrixserverlib.SplitID('@', device.UserID)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("gomatrixserverlib.SplitID failed")
+		resErr := jsonerror.InternalServerError()
+		return &resErr
+	}
+	_, err = accountDB.GetMembershipInRoomByLocalpart(req.Context(), localpart, roomID)
+	if err == sql.ErrNoRows {
+		return &util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("User not in this room"),
+		}
+	} else if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("accountDB.GetMembershipInRoomByLocalpart failed")
+		resErr := jsonerror.InternalServerError()
+		return &resErr
+	}
+	return nil
+}
@@ -0,0 +1,183 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/clientapi/producers"
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/dendrite/common/transactions"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+// https://matrix.org/docs/spec/client_server/r0.6.0#put-matrix-client-r0-rooms-roomid-redact-eventid-txnid
+type redactionRequest struct {
+	Reason string `json:"reason,omitempty"`
+}
+
+// SendRedaction implements PUT /rooms/{roomID}/redact/{eventID}/{txnID}
+func SendRedaction(
+	req *http.Request,
+	device *authtypes.Device,
+	roomID, eventID string, txnID *string,
+	cfg *config.Dendrite,
+	queryAPI api.RoomserverQueryAPI,
+	producer *producers.RoomserverProducer,
+	txnCache *transactions.Cache,
+) util.JSONResponse {
+	if txnID != nil {
+		// Try to fetch response from transactionsCache
+		if res, ok := txnCache.FetchTransaction(device.AccessToken, *txnID, req.URL.Path); ok {
+			return *res
+		}
+	}
+
+	var r redactionRequest
+	if resErr := httputil.UnmarshalJSONRequest(req, &r); resErr != nil {
+		return *resErr
+	}
+
+	evTime, err := httputil.ParseTSParam(req)
+	if err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue(err.Error()),
+		}
+	}
+
+	eventsReq := api.QueryEventsByIDRequest{EventIDs: []string{eventID}}
+	var eventsRes api.QueryEventsByIDResponse
+	if err = queryAPI.QueryEventsByID(req.Context(), &eventsReq, &eventsRes); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("queryAPI.QueryEventsByID failed")
+		return jsonerror.InternalServerError()
+	}
+	if len(eventsRes.Events) == 0 || eventsRes.Events[0].RoomID() != roomID {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("The event to redact was not found"),
+		}
+	}
+	redactedEvent := eventsRes.Events[0]
+
+	builder := gomatrixserverlib.EventBuilder{
+		Sender:  device.UserID,
+		RoomID:  roomID,
+		Type:    gomatrixserverlib.MRoomRedaction,
+		Redacts: eventID,
+	}
+	if err = builder.SetContent(r); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("builder.SetContent failed")
+		return jsonerror.InternalServerError()
+	}
+
+	var queryRes api.QueryLatestEventsAndStateResponse
+	e, err := common.BuildEvent(req.Context(), &builder, cfg, evTime, queryAPI, &queryRes)
+	if err == common.ErrRoomNoExists {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("Room does not exist"),
+		}
+	} else if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("common.BuildEvent failed")
+		return jsonerror.InternalServerError()
+	}
+
+	// The auth rules only check the domain of the redacted event, so we check
+	// here that the user is redacting one of their own events or that they
+	// have the power to redact the events of other users.
+	stateEvents := make([]*gomatrixserverlib.Event, len(queryRes.StateEvents))
+	for i := range queryRes.StateEvents {
+		stateEvents[i] = &queryRes.StateEvents[i].Event
+	}
+	provider := gomatrixserverlib.NewAuthEvents(stateEvents)
+	if err = gomatrixserverlib.Allowed(*e, &provider); err != nil {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden(err.Error()),
+		}
+	}
+	if redactedEvent.Sender() != device.UserID {
+		allowed, err := canRedactOthers(&provider, device.UserID)
+		if err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("canRedactOthers failed")
+			return jsonerror.InternalServerError()
+		}
+		if !allowed {
+			return util.JSONResponse{
+				Code: http.StatusForbidden,
+				JSON: jsonerror.Forbidden("You don't have permission to redact events sent by other users"),
+			}
+		}
+	}
+
+	var txnAndSessionID *api.TransactionID
+	if txnID != nil {
+		txnAndSessionID = &api.TransactionID{
+			TransactionID: *txnID,
+			SessionID:     device.SessionID,
+		}
+	}
+
+	redactionEventID, err := producer.SendEvents(
+		req.Context(),
+		[]gomatrixserverlib.HeaderedEvent{e.Headered(queryRes.RoomVersion)},
+		cfg.Matrix.ServerName,
+		txnAndSessionID,
+	)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("producer.SendEvents failed")
+		return jsonerror.InternalServerError()
+	}
+
+	res := util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: sendEventResponse{redactionEventID},
+	}
+	// Add response to transactionsCache
+	if txnID != nil {
+		txnCache.AddTransaction(device.AccessToken, *txnID, req.URL.Path, &res)
+	}
+	return res
+}
+
+// canRedactOthers returns whether the user has the power level needed to
+// redact the events of other users in the room.
+func canRedactOthers(
+	provider *gomatrixserverlib.AuthEvents, userID string,
+) (bool, error) {
+	createEvent, err := provider.Create()
+	if err != nil || createEvent == nil {
+		return false, err
+	}
+	var createContent struct {
+		Creator string `json:"creator"`
+	}
+	if err = json.Unmarshal(createEvent.Content(), &createContent); err != nil {
+		return false, err
+	}
+	powerLevels, err := gomatrixserverlib.NewPowerLevelContentFromAuthEvents(provider, createContent.Creator)
+	if err != nil {
+		return false, err
+	}
+	return powerLevels.UserLevel(userID) >= powerLevels.Redact, nil
+}
@@ -0,0 +1,79 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/clientapi/producers"
+	"github.com/matrix-org/dendrite/common/transactions"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+type sendToDeviceRequest struct {
+	Messages map[string]map[string]json.RawMessage `json:"messages"`
+}
+
+// SendToDevice handles PUT /sendToDevice/{eventType}/{txnID}
+// sends the messages to the sync API and the federation sender through the
+// sendToDeviceProducer
+func SendToDevice(
+	req *http.Request, device *authtypes.Device,
+	eventType, txnID string,
+	sendToDeviceProducer *producers.SendToDeviceProducer,
+	txnCache *transactions.Cache,
+) util.JSONResponse {
+	// Try to fetch response from transactionsCache
+	if res, ok := txnCache.FetchTransaction(device.AccessToken, txnID, req.URL.Path); ok {
+		return *res
+	}
+
+	var r sendToDeviceRequest
+	if resErr := httputil.UnmarshalJSONRequest(req, &r); resErr != nil {
+		return *resErr
+	}
+
+	for userID := range r.Messages {
+		if _, _, err := gomatrixserverlib.SplitID('@', userID); err != nil {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue("Invalid user ID " + userID),
+			}
+		}
+	}
+
+	if len(r.Messages) > 0 {
+		if err := sendToDeviceProducer.SendToDevice(
+			device.UserID, eventType, util.RandomString(32), r.Messages,
+		); err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("sendToDeviceProducer.SendToDevice failed")
+			return jsonerror.InternalServerError()
+		}
+	}
+
+	res := util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct{}{},
+	}
+	// Add response to transactionsCache
+	txnCache.AddTransaction(device.AccessToken, txnID, req.URL.Path, &res)
+
+	return res
+}
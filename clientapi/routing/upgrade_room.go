@@ -0,0 +1,438 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	appserviceAPI "github.com/matrix-org/dendrite/appservice/api"
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/clientapi/producers"
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/common/config"
+	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
+	roomserverVersion "github.com/matrix-org/dendrite/roomserver/version"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+// The state events that are copied as they are from the old room into the
+// replacement room.
+var upgradedStateEventTypes = []string{
+	gomatrixserverlib.MRoomJoinRules,
+	gomatrixserverlib.MRoomHistoryVisibility,
+	"m.room.guest_access",
+	"m.room.name",
+	"m.room.topic",
+	"m.room.avatar",
+	"m.room.encryption",
+	"m.room.canonical_alias",
+}
+
+type upgradeRoomRequest struct {
+	NewVersion string `json:"new_version"`
+}
+
+type upgradeRoomResponse struct {
+	ReplacementRoom string `json:"replacement_room"`
+}
+
+type tombstoneContent struct {
+	Body            string `json:"body"`
+	ReplacementRoom string `json:"replacement_room"`
+}
+
+type predecessorContent struct {
+	RoomID  string `json:"room_id"`
+	EventID string `json:"event_id"`
+}
+
+// UpgradeRoom implements POST /rooms/{roomID}/upgrade
+// nolint: gocyclo
+func UpgradeRoom(
+	req *http.Request, device *authtypes.Device,
+	cfg *config.Dendrite, roomID string, producer *producers.RoomserverProducer,
+	queryAPI roomserverAPI.RoomserverQueryAPI, aliasAPI roomserverAPI.RoomserverAliasAPI,
+	accountDB accounts.Database, asAPI appserviceAPI.AppServiceQueryAPI,
+) util.JSONResponse {
+	userID := device.UserID
+	var r upgradeRoomRequest
+	if resErr := httputil.UnmarshalJSONRequest(req, &r); resErr != nil {
+		return *resErr
+	}
+	newVersion := gomatrixserverlib.RoomVersion(r.NewVersion)
+	if _, err := roomserverVersion.SupportedRoomVersion(newVersion); err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.UnsupportedRoomVersion(err.Error()),
+		}
+	}
+
+	evTime, err := httputil.ParseTSParam(req)
+	if err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue(err.Error()),
+		}
+	}
+
+	newRoomID := fmt.Sprintf("!%s:%s", util.RandomString(16), cfg.Matrix.ServerName)
+
+	// The tombstone is built and checked before anything else happens: being
+	// allowed to send it into the old room is what allows the user to upgrade
+	// the room, so no replacement room is created if it isn't allowed.
+	tombstone, roomVersion, resErr := buildTombstone(req, cfg, userID, roomID, newRoomID, evTime, queryAPI)
+	if resErr != nil {
+		return *resErr
+	}
+
+	stateReq := roomserverAPI.QueryStateAndAuthChainRequest{
+		RoomID:       roomID,
+		PrevEventIDs: tombstone.PrevEventIDs(),
+	}
+	var stateRes roomserverAPI.QueryStateAndAuthChainResponse
+	if err = queryAPI.QueryStateAndAuthChain(req.Context(), &stateReq, &stateRes); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("queryAPI.QueryStateAndAuthChain failed")
+		return jsonerror.InternalServerError()
+	}
+	state := make(map[gomatrixserverlib.StateKeyTuple]*gomatrixserverlib.Event, len(stateRes.StateEvents))
+	for i := range stateRes.StateEvents {
+		ev := &stateRes.StateEvents[i].Event
+		state[gomatrixserverlib.StateKeyTuple{EventType: ev.Type(), StateKey: *ev.StateKey()}] = ev
+	}
+
+	profile, err := appserviceAPI.RetrieveUserProfile(req.Context(), userID, asAPI, accountDB)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("appserviceAPI.RetrieveUserProfile failed")
+		return jsonerror.InternalServerError()
+	}
+
+	eventsToMake, err := replacementRoomEvents(
+		roomID, userID, newVersion, tombstone.EventID(), profile, state, stateRes.StateEvents,
+	)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("replacementRoomEvents failed")
+		return jsonerror.InternalServerError()
+	}
+	builtEvents, err := buildRoomEvents(cfg, newRoomID, userID, evTime, newVersion, eventsToMake)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("buildRoomEvents failed")
+		return jsonerror.InternalServerError()
+	}
+	if _, err = producer.SendEvents(req.Context(), builtEvents, cfg.Matrix.ServerName, nil); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("producer.SendEvents failed")
+		return jsonerror.InternalServerError()
+	}
+
+	if _, err = producer.SendEvents(
+		req.Context(), []gomatrixserverlib.HeaderedEvent{tombstone.Headered(roomVersion)},
+		cfg.Matrix.ServerName, nil,
+	); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("producer.SendEvents failed")
+		return jsonerror.InternalServerError()
+	}
+
+	// Move the local aliases of the old room over to the replacement room.
+	aliasesReq := roomserverAPI.GetAliasesForRoomIDRequest{RoomID: roomID}
+	var aliasesRes roomserverAPI.GetAliasesForRoomIDResponse
+	if err = aliasAPI.GetAliasesForRoomID(req.Context(), &aliasesReq, &aliasesRes); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("aliasAPI.GetAliasesForRoomID failed")
+		return jsonerror.InternalServerError()
+	}
+	for _, alias := range aliasesRes.Aliases {
+		removeReq := roomserverAPI.RemoveRoomAliasRequest{UserID: userID, Alias: alias}
+		var removeRes roomserverAPI.RemoveRoomAliasResponse
+		if err = aliasAPI.RemoveRoomAlias(req.Context(), &removeReq, &removeRes); err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("aliasAPI.RemoveRoomAlias failed")
+			return jsonerror.InternalServerError()
+		}
+		setReq := roomserverAPI.SetRoomAliasRequest{UserID: userID, RoomID: newRoomID, Alias: alias}
+		var setRes roomserverAPI.SetRoomAliasResponse
+		if err = aliasAPI.SetRoomAlias(req.Context(), &setReq, &setRes); err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("aliasAPI.SetRoomAlias failed")
+			return jsonerror.InternalServerError()
+		}
+	}
+
+	if resErr := restrictOldRoom(req, cfg, userID, roomID, evTime, producer, queryAPI, state); resErr != nil {
+		return *resErr
+	}
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: upgradeRoomResponse{ReplacementRoom: newRoomID},
+	}
+}
+
+// buildTombstone builds the m.room.tombstone pointing the old room at the
+// replacement room and checks that the user is allowed to send it, which
+// depends on the power levels of the old room.
+func buildTombstone(
+	req *http.Request, cfg *config.Dendrite, userID, roomID, newRoomID string, evTime time.Time,
+	queryAPI roomserverAPI.RoomserverQueryAPI,
+) (*gomatrixserverlib.Event, gomatrixserverlib.RoomVersion, *util.JSONResponse) {
+	emptyString := ""
+	builder := gomatrixserverlib.EventBuilder{
+		Sender:   userID,
+		RoomID:   roomID,
+		Type:     "m.room.tombstone",
+		StateKey: &emptyString,
+	}
+	err := builder.SetContent(tombstoneContent{
+		Body:            "This room has been replaced",
+		ReplacementRoom: newRoomID,
+	})
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("builder.SetContent failed")
+		resErr := jsonerror.InternalServerError()
+		return nil, "", &resErr
+	}
+	var queryRes roomserverAPI.QueryLatestEventsAndStateResponse
+	tombstone, err := common.BuildEvent(req.Context(), &builder, cfg, evTime, queryAPI, &queryRes)
+	if err == common.ErrRoomNoExists {
+		return nil, "", &util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("Room does not exist"),
+		}
+	} else if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("common.BuildEvent failed")
+		resErr := jsonerror.InternalServerError()
+		return nil, "", &resErr
+	}
+	if err = allowedInRoom(tombstone, queryRes.StateEvents); err != nil {
+		return nil, "", &util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("You don't have permission to upgrade the room: " + err.Error()),
+		}
+	}
+	return tombstone, queryRes.RoomVersion, nil
+}
+
+// replacementRoomEvents returns the events that start the replacement room:
+// the create event pointing back at the old room, the join of the upgrading
+// user and a copy of the important state of the old room.
+func replacementRoomEvents(
+	oldRoomID, userID string, newVersion gomatrixserverlib.RoomVersion, tombstoneID string,
+	profile *authtypes.Profile,
+	state map[gomatrixserverlib.StateKeyTuple]*gomatrixserverlib.Event,
+	stateEvents []gomatrixserverlib.HeaderedEvent,
+) ([]fledglingEvent, error) {
+	createContent := map[string]interface{}{
+		"creator":      userID,
+		"room_version": newVersion,
+		"predecessor":  predecessorContent{RoomID: oldRoomID, EventID: tombstoneID},
+	}
+	if create := state[gomatrixserverlib.StateKeyTuple{EventType: gomatrixserverlib.MRoomCreate}]; create != nil {
+		var oldCreateContent map[string]interface{}
+		if err := json.Unmarshal(create.Content(), &oldCreateContent); err != nil {
+			return nil, err
+		}
+		if federate, ok := oldCreateContent["m.federate"]; ok {
+			createContent["m.federate"] = federate
+		}
+	}
+
+	eventsToMake := []fledglingEvent{
+		{gomatrixserverlib.MRoomCreate, "", createContent},
+		{gomatrixserverlib.MRoomMember, userID, gomatrixserverlib.MemberContent{
+			Membership:  gomatrixserverlib.Join,
+			DisplayName: profile.DisplayName,
+			AvatarURL:   profile.AvatarURL,
+		}},
+	}
+
+	// The user may not have the power to send all of the copied state, in
+	// which case they are given it until the old power levels are restored
+	// at the end.
+	var powerLevels map[string]interface{}
+	powerLevelsEvent := state[gomatrixserverlib.StateKeyTuple{EventType: gomatrixserverlib.MRoomPowerLevels}]
+	if powerLevelsEvent == nil {
+		eventsToMake = append(eventsToMake, fledglingEvent{
+			gomatrixserverlib.MRoomPowerLevels, "", common.InitialPowerLevelsContent(userID),
+		})
+	} else {
+		if err := json.Unmarshal(powerLevelsEvent.Content(), &powerLevels); err != nil {
+			return nil, err
+		}
+		levels, err := gomatrixserverlib.NewPowerLevelContentFromEvent(*powerLevelsEvent)
+		if err != nil {
+			return nil, err
+		}
+		if needed := neededPowerLevel(levels); levels.UserLevel(userID) < needed {
+			eventsToMake = append(eventsToMake, fledglingEvent{
+				gomatrixserverlib.MRoomPowerLevels, "", withUserLevel(powerLevels, userID, needed),
+			})
+		} else {
+			eventsToMake = append(eventsToMake, fledglingEvent{
+				gomatrixserverlib.MRoomPowerLevels, "", powerLevels,
+			})
+			powerLevels = nil
+		}
+	}
+
+	for _, eventType := range upgradedStateEventTypes {
+		if ev := state[gomatrixserverlib.StateKeyTuple{EventType: eventType}]; ev != nil {
+			eventsToMake = append(eventsToMake, fledglingEvent{eventType, "", json.RawMessage(ev.Content())})
+		}
+	}
+
+	for i := range stateEvents {
+		ev := &stateEvents[i]
+		if ev.Type() != gomatrixserverlib.MRoomMember {
+			continue
+		}
+		membership, err := ev.Membership()
+		if err != nil || membership != gomatrixserverlib.Ban {
+			continue
+		}
+		eventsToMake = append(eventsToMake, fledglingEvent{
+			gomatrixserverlib.MRoomMember, *ev.StateKey(),
+			gomatrixserverlib.MemberContent{Membership: gomatrixserverlib.Ban},
+		})
+	}
+
+	if powerLevels != nil {
+		eventsToMake = append(eventsToMake, fledglingEvent{gomatrixserverlib.MRoomPowerLevels, "", powerLevels})
+	}
+	return eventsToMake, nil
+}
+
+// restrictOldRoom raises the power levels needed to speak and invite users in
+// the old room, so that people move over to the replacement room. The old
+// room is left as it is if the user isn't allowed to change its power levels.
+func restrictOldRoom(
+	req *http.Request, cfg *config.Dendrite, userID, roomID string, evTime time.Time,
+	producer *producers.RoomserverProducer, queryAPI roomserverAPI.RoomserverQueryAPI,
+	state map[gomatrixserverlib.StateKeyTuple]*gomatrixserverlib.Event,
+) *util.JSONResponse {
+	powerLevelsEvent := state[gomatrixserverlib.StateKeyTuple{EventType: gomatrixserverlib.MRoomPowerLevels}]
+	if powerLevelsEvent == nil {
+		return nil
+	}
+	levels, err := gomatrixserverlib.NewPowerLevelContentFromEvent(*powerLevelsEvent)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("gomatrixserverlib.NewPowerLevelContentFromEvent failed")
+		resErr := jsonerror.InternalServerError()
+		return &resErr
+	}
+	var content map[string]interface{}
+	if err = json.Unmarshal(powerLevelsEvent.Content(), &content); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("json.Unmarshal failed")
+		resErr := jsonerror.InternalServerError()
+		return &resErr
+	}
+
+	restrictedLevel := levels.UsersDefault + 1
+	if restrictedLevel < 50 {
+		restrictedLevel = 50
+	}
+	changed := false
+	if levels.EventsDefault < restrictedLevel {
+		content["events_default"] = restrictedLevel
+		changed = true
+	}
+	if levels.Invite < restrictedLevel {
+		content["invite"] = restrictedLevel
+		changed = true
+	}
+	if !changed {
+		return nil
+	}
+
+	emptyString := ""
+	builder := gomatrixserverlib.EventBuilder{
+		Sender:   userID,
+		RoomID:   roomID,
+		Type:     gomatrixserverlib.MRoomPowerLevels,
+		StateKey: &emptyString,
+	}
+	if err = builder.SetContent(content); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("builder.SetContent failed")
+		resErr := jsonerror.InternalServerError()
+		return &resErr
+	}
+	var queryRes roomserverAPI.QueryLatestEventsAndStateResponse
+	event, err := common.BuildEvent(req.Context(), &builder, cfg, evTime, queryAPI, &queryRes)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("common.BuildEvent failed")
+		resErr := jsonerror.InternalServerError()
+		return &resErr
+	}
+	if err = allowedInRoom(event, queryRes.StateEvents); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Warn("Not allowed to restrict the old room")
+		return nil
+	}
+	if _, err = producer.SendEvents(
+		req.Context(), []gomatrixserverlib.HeaderedEvent{event.Headered(queryRes.RoomVersion)},
+		cfg.Matrix.ServerName, nil,
+	); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("producer.SendEvents failed")
+		resErr := jsonerror.InternalServerError()
+		return &resErr
+	}
+	return nil
+}
+
+// allowedInRoom checks the event against the auth rules with the given state
+// of its room.
+func allowedInRoom(event *gomatrixserverlib.Event, state []gomatrixserverlib.HeaderedEvent) error {
+	stateEvents := make([]*gomatrixserverlib.Event, len(state))
+	for i := range state {
+		stateEvents[i] = &state[i].Event
+	}
+	provider := gomatrixserverlib.NewAuthEvents(stateEvents)
+	return gomatrixserverlib.Allowed(*event, &provider)
+}
+
+// neededPowerLevel returns the highest power level named in the power levels,
+// which is enough to send any of the state of the room.
+func neededPowerLevel(levels gomatrixserverlib.PowerLevelContent) int64 {
+	needed := levels.StateDefault
+	for _, level := range []int64{levels.Ban, levels.Kick, levels.Redact, levels.Invite, levels.EventsDefault} {
+		if level > needed {
+			needed = level
+		}
+	}
+	for _, level := range levels.Events {
+		if level > needed {
+			needed = level
+		}
+	}
+	return needed
+}
+
+// withUserLevel returns a copy of the power levels content with the level of
+// the user set to the given level.
+func withUserLevel(content map[string]interface{}, userID string, level int64) map[string]interface{} {
+	result := make(map[string]interface{}, len(content)+1)
+	for key, value := range content {
+		result[key] = value
+	}
+	users := map[string]interface{}{}
+	if oldUsers, ok := content["users"].(map[string]interface{}); ok {
+		for key, value := range oldUsers {
+			users[key] = value
+		}
+	}
+	users[userID] = level
+	result["users"] = users
+	return result
+}
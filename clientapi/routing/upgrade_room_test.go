@@ -0,0 +1,199 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
+	"github.com/matrix-org/dendrite/clientapi/producers"
+	"github.com/matrix-org/dendrite/common/config"
+	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"golang.org/x/crypto/ed25519"
+)
+
+const upgradeTestRoomID = "!old:localhost"
+
+type upgradeQueryAPI struct {
+	roomserverAPI.RoomserverQueryAPI
+	state []gomatrixserverlib.HeaderedEvent
+}
+
+func (q *upgradeQueryAPI) QueryLatestEventsAndState(
+	ctx context.Context,
+	request *roomserverAPI.QueryLatestEventsAndStateRequest,
+	response *roomserverAPI.QueryLatestEventsAndStateResponse,
+) error {
+	response.RoomExists = request.RoomID == upgradeTestRoomID
+	if !response.RoomExists {
+		return nil
+	}
+	response.RoomVersion = gomatrixserverlib.RoomVersionV1
+	last := q.state[len(q.state)-1]
+	response.LatestEvents = []gomatrixserverlib.EventReference{last.EventReference()}
+	response.Depth = last.Depth() + 1
+	response.StateEvents = q.state
+	return nil
+}
+
+func (q *upgradeQueryAPI) QueryStateAndAuthChain(
+	ctx context.Context,
+	request *roomserverAPI.QueryStateAndAuthChainRequest,
+	response *roomserverAPI.QueryStateAndAuthChainResponse,
+) error {
+	response.RoomExists = true
+	response.RoomVersion = gomatrixserverlib.RoomVersionV1
+	response.StateEvents = q.state
+	return nil
+}
+
+type upgradeInputAPI struct {
+	events []gomatrixserverlib.HeaderedEvent
+}
+
+func (i *upgradeInputAPI) InputRoomEvents(
+	ctx context.Context,
+	request *roomserverAPI.InputRoomEventsRequest,
+	response *roomserverAPI.InputRoomEventsResponse,
+) error {
+	for _, ire := range request.InputRoomEvents {
+		i.events = append(i.events, ire.Event)
+	}
+	return nil
+}
+
+type upgradeAliasAPI struct {
+	roomserverAPI.RoomserverAliasAPI
+}
+
+func (a *upgradeAliasAPI) GetAliasesForRoomID(
+	ctx context.Context,
+	request *roomserverAPI.GetAliasesForRoomIDRequest,
+	response *roomserverAPI.GetAliasesForRoomIDResponse,
+) error {
+	return nil
+}
+
+type upgradeAccountDB struct {
+	accounts.Database
+}
+
+func (d *upgradeAccountDB) GetProfileByLocalpart(
+	ctx context.Context, localpart string,
+) (*authtypes.Profile, error) {
+	return &authtypes.Profile{Localpart: localpart}, nil
+}
+
+// upgradeTestState returns the state of a room where only @alice:localhost
+// is allowed to send the tombstone.
+func upgradeTestState(t *testing.T) []gomatrixserverlib.HeaderedEvent {
+	contents := []struct {
+		sender, eventType, stateKey, content string
+	}{
+		{"@alice:localhost", "m.room.create", "", `{"creator":"@alice:localhost"}`},
+		{"@alice:localhost", "m.room.member", "@alice:localhost", `{"membership":"join"}`},
+		{"@alice:localhost", "m.room.power_levels", "", `{"users":{"@alice:localhost":100},"events":{"m.room.tombstone":100},"state_default":50}`},
+		{"@bob:localhost", "m.room.member", "@bob:localhost", `{"membership":"join"}`},
+	}
+	var state []gomatrixserverlib.HeaderedEvent
+	for i, c := range contents {
+		eventJSON := fmt.Sprintf(
+			`{"event_id":"$%d:localhost","room_id":%q,"sender":%q,"type":%q,"state_key":%q,"content":%s,"depth":%d,"origin_server_ts":%d}`,
+			i+1, upgradeTestRoomID, c.sender, c.eventType, c.stateKey, c.content, i+1, i+1,
+		)
+		ev, err := gomatrixserverlib.NewEventFromTrustedJSON([]byte(eventJSON), false, gomatrixserverlib.RoomVersionV1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		state = append(state, ev.Headered(gomatrixserverlib.RoomVersionV1))
+	}
+	return state
+}
+
+func upgradeTestRoom(t *testing.T, userID string) (int, interface{}, []gomatrixserverlib.HeaderedEvent) {
+	_, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &config.Dendrite{}
+	cfg.Matrix.ServerName = "localhost"
+	cfg.Matrix.KeyID = "ed25519:test"
+	cfg.Matrix.PrivateKey = privateKey
+
+	queryAPI := &upgradeQueryAPI{state: upgradeTestState(t)}
+	inputAPI := &upgradeInputAPI{}
+	producer := producers.NewRoomserverProducer(inputAPI, queryAPI)
+	req := httptest.NewRequest(
+		http.MethodPost, "/rooms/"+upgradeTestRoomID+"/upgrade", strings.NewReader(`{"new_version":"5"}`),
+	)
+	res := UpgradeRoom(
+		req, &authtypes.Device{UserID: userID}, cfg, upgradeTestRoomID, producer,
+		queryAPI, &upgradeAliasAPI{}, &upgradeAccountDB{}, nil,
+	)
+	return res.Code, res.JSON, inputAPI.events
+}
+
+func TestUpgradeRoomNotAllowed(t *testing.T) {
+	code, _, events := upgradeTestRoom(t, "@bob:localhost")
+	if code != http.StatusForbidden {
+		t.Fatalf("got status %d, want %d", code, http.StatusForbidden)
+	}
+	if len(events) != 0 {
+		t.Errorf("got %d events sent, want none", len(events))
+	}
+}
+
+func TestUpgradeRoom(t *testing.T) {
+	code, body, events := upgradeTestRoom(t, "@alice:localhost")
+	if code != http.StatusOK {
+		t.Fatalf("got status %d, want %d: %+v", code, http.StatusOK, body)
+	}
+	newRoomID := body.(upgradeRoomResponse).ReplacementRoom
+
+	var tombstone *gomatrixserverlib.HeaderedEvent
+	for i := range events {
+		ev := &events[i]
+		if ev.RoomID() == newRoomID {
+			if tombstone != nil {
+				t.Errorf("event %s sent into the replacement room after the tombstone", ev.Type())
+			}
+			continue
+		}
+		if ev.Type() == "m.room.tombstone" {
+			tombstone = ev
+		}
+	}
+	if tombstone == nil {
+		t.Fatalf("no tombstone sent into the old room")
+	}
+	var content tombstoneContent
+	if err := json.Unmarshal(tombstone.Content(), &content); err != nil {
+		t.Fatal(err)
+	}
+	if content.ReplacementRoom != newRoomID {
+		t.Errorf("got replacement room %s, want %s", content.ReplacementRoom, newRoomID)
+	}
+	if events[0].RoomID() != newRoomID || events[0].Type() != gomatrixserverlib.MRoomCreate {
+		t.Errorf("got first event %s in %s, want the create event of %s", events[0].Type(), events[0].RoomID(), newRoomID)
+	}
+}
@@ -0,0 +1,315 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/clientapi/userutil"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+// userSessionTimeout is how long a logged in user has to complete the
+// user-interactive authentication of a request once it has started.
+const userSessionTimeout = 10 * time.Minute
+
+var (
+	// TODO: Remove old registration sessions. Need to do so on a
+	// session-specific timeout, like the sessions of logged in users.
+	// sessions stores the completed flow stages for all sessions. Referenced using their sessionID.
+	sessions = newSessionsDict()
+)
+
+// sessionsDict keeps track of completed auth stages for each session.
+// It shouldn't be passed by value because it contains a mutex.
+type sessionsDict struct {
+	sync.Mutex
+	sessions map[string][]authtypes.LoginType
+	// userIDs holds the user that started each session for a request from a
+	// logged in user, so that other users can't complete it on their behalf.
+	userIDs map[string]string
+	// expiries holds when each session in userIDs expires.
+	expiries map[string]time.Time
+}
+
+// GetCompletedStages returns the completed stages for a session.
+func (d *sessionsDict) GetCompletedStages(sessionID string) []authtypes.LoginType {
+	d.Lock()
+	defer d.Unlock()
+
+	if completedStages, ok := d.sessions[sessionID]; ok {
+		return completedStages
+	}
+	// Ensure that a empty slice is returned and not nil. See #399.
+	return make([]authtypes.LoginType, 0)
+}
+
+func newSessionsDict() *sessionsDict {
+	return &sessionsDict{
+		sessions: make(map[string][]authtypes.LoginType),
+		userIDs:  make(map[string]string),
+		expiries: make(map[string]time.Time),
+	}
+}
+
+// startUserSession starts a new session for a request from a logged in user
+// and returns its ID. The session expires after userSessionTimeout. Sessions
+// that have expired are forgotten at the same time, so that abandoned ones
+// don't pile up.
+func (d *sessionsDict) startUserSession(userID string) string {
+	d.Lock()
+	defer d.Unlock()
+
+	now := time.Now()
+	for sessionID, expiry := range d.expiries {
+		if now.After(expiry) {
+			d.removeSession(sessionID)
+		}
+	}
+
+	sessionID := util.RandomString(sessionIDLength)
+	d.sessions[sessionID] = make([]authtypes.LoginType, 0)
+	d.userIDs[sessionID] = userID
+	d.expiries[sessionID] = now.Add(userSessionTimeout)
+	return sessionID
+}
+
+// sessionUserID returns the user that started a session, or false if the
+// session wasn't started by a logged in user or has expired.
+func (d *sessionsDict) sessionUserID(sessionID string) (string, bool) {
+	d.Lock()
+	defer d.Unlock()
+
+	if expiry, ok := d.expiries[sessionID]; ok && time.Now().After(expiry) {
+		d.removeSession(sessionID)
+		return "", false
+	}
+	userID, ok := d.userIDs[sessionID]
+	return userID, ok
+}
+
+// addCompletedStage records that a session has completed an auth stage.
+func (d *sessionsDict) addCompletedStage(sessionID string, stage authtypes.LoginType) {
+	d.Lock()
+	defer d.Unlock()
+
+	for _, completedStage := range d.sessions[sessionID] {
+		if completedStage == stage {
+			return
+		}
+	}
+	d.sessions[sessionID] = append(d.sessions[sessionID], stage)
+}
+
+// deleteSession forgets a session once the request it authenticated has been
+// carried out, so that it can't be used again.
+func (d *sessionsDict) deleteSession(sessionID string) {
+	d.Lock()
+	defer d.Unlock()
+
+	d.removeSession(sessionID)
+}
+
+// removeSession forgets a session. The caller must hold the lock.
+func (d *sessionsDict) removeSession(sessionID string) {
+	delete(d.sessions, sessionID)
+	delete(d.userIDs, sessionID)
+	delete(d.expiries, sessionID)
+}
+
+// AddCompletedSessionStage records that a session has completed an auth stage.
+func AddCompletedSessionStage(sessionID string, stage authtypes.LoginType) {
+	sessions.addCompletedStage(sessionID, stage)
+}
+
+type authDict struct {
+	Type    authtypes.LoginType         `json:"type"`
+	Session string                      `json:"session"`
+	Mac     gomatrixserverlib.HexString `json:"mac"`
+
+	// Recaptcha
+	Response string `json:"response"`
+
+	// Password
+	Identifier loginIdentifier `json:"identifier"`
+	User       string          `json:"user"`
+	Password   string          `json:"password"`
+	// TODO: Lots of custom keys depending on the type
+}
+
+// http://matrix.org/speculator/spec/HEAD/client_server/unstable.html#user-interactive-authentication-api
+type userInteractiveResponse struct {
+	Flows     []authtypes.Flow       `json:"flows"`
+	Completed []authtypes.LoginType  `json:"completed"`
+	Params    map[string]interface{} `json:"params"`
+	Session   string                 `json:"session"`
+	// The error of the last attempt at an auth stage, if it failed.
+	ErrCode string `json:"errcode,omitempty"`
+	Err     string `json:"error,omitempty"`
+}
+
+// newUserInteractiveResponse will return a struct to be sent back to the client
+// during registration.
+func newUserInteractiveResponse(
+	sessionID string,
+	fs []authtypes.Flow,
+	params map[string]interface{},
+) userInteractiveResponse {
+	return userInteractiveResponse{
+		Flows:     fs,
+		Completed: sessions.GetCompletedStages(sessionID),
+		Params:    params,
+		Session:   sessionID,
+	}
+}
+
+// sensitiveRequestFlows are the flows that logged in users have to complete
+// before we carry out requests that could do lasting harm in the wrong hands,
+// like changing their password.
+var sensitiveRequestFlows = []authtypes.Flow{
+	{Stages: []authtypes.LoginType{authtypes.LoginTypePassword}},
+}
+
+// authenticateUserInteractive runs the user-interactive authentication of a
+// sensitive request from a logged in user. It returns nil once the user has
+// completed one of the flows, and otherwise the response to send so that the
+// client can carry on with the authentication.
+// https://matrix.org/docs/spec/client_server/r0.6.0#user-interactive-authentication-api
+func authenticateUserInteractive(
+	ctx context.Context, device *authtypes.Device, auth *authDict,
+	accountDB accounts.Database,
+) *util.JSONResponse {
+	if auth == nil || auth.Session == "" {
+		sessionID := sessions.startUserSession(device.UserID)
+		return userInteractiveAuthRequired(sessionID, "", "")
+	}
+	sessionID := auth.Session
+	if userID, ok := sessions.sessionUserID(sessionID); !ok || userID != device.UserID {
+		return &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.Unknown("Unknown session ID"),
+		}
+	}
+
+	switch auth.Type {
+	case authtypes.LoginTypePassword:
+		localpart, serverName, err := gomatrixserverlib.SplitID('@', device.UserID)
+		if err != nil {
+			util.GetLogger(ctx).WithError(err).Error("gomatrixserverlib.SplitID failed")
+			resErr := jsonerror.InternalServerError()
+			return &resErr
+		}
+		username := auth.Identifier.User
+		if username == "" {
+			username = auth.User
+		}
+		if username != "" {
+			if authLocalpart, err := userutil.ParseUsernameParam(username, &serverName); err != nil || authLocalpart != localpart {
+				return userInteractiveAuthRequired(sessionID, "M_FORBIDDEN", "The user doesn't match the user making the request")
+			}
+		}
+		if _, err := accountDB.GetAccountByPassword(ctx, localpart, auth.Password); err != nil {
+			return userInteractiveAuthRequired(sessionID, "M_FORBIDDEN", "Invalid password")
+		}
+		sessions.addCompletedStage(sessionID, authtypes.LoginTypePassword)
+
+	case "":
+		// The client is asking which stages it has completed so far.
+
+	default:
+		return &util.JSONResponse{
+			Code: http.StatusNotImplemented,
+			JSON: jsonerror.Unknown("unknown/unimplemented auth type"),
+		}
+	}
+
+	if !checkFlowCompleted(sessions.GetCompletedStages(sessionID), sensitiveRequestFlows) {
+		return userInteractiveAuthRequired(sessionID, "", "")
+	}
+	sessions.deleteSession(sessionID)
+	return nil
+}
+
+// userInteractiveAuthRequired builds the response that tells the client which
+// stages it still has to complete for a session.
+func userInteractiveAuthRequired(sessionID, errCode, errMsg string) *util.JSONResponse {
+	res := newUserInteractiveResponse(sessionID, sensitiveRequestFlows, map[string]interface{}{})
+	res.ErrCode = errCode
+	res.Err = errMsg
+	return &util.JSONResponse{
+		Code: http.StatusUnauthorized,
+		JSON: res,
+	}
+}
+
+// checkFlows checks a single completed flow against another required one. If
+// one contains at least all of the stages that the other does, checkFlows
+// returns true.
+func checkFlows(
+	completedStages []authtypes.LoginType,
+	requiredStages []authtypes.LoginType,
+) bool {
+	// Create temporary slices so they originals will not be modified on sorting
+	completed := make([]authtypes.LoginType, len(completedStages))
+	required := make([]authtypes.LoginType, len(requiredStages))
+	copy(completed, completedStages)
+	copy(required, requiredStages)
+
+	// Sort the slices for simple comparison
+	sort.Slice(completed, func(i, j int) bool { return completed[i] < completed[j] })
+	sort.Slice(required, func(i, j int) bool { return required[i] < required[j] })
+
+	// Iterate through each slice, going to the next required slice only once
+	// we've found a match.
+	i, j := 0, 0
+	for j < len(required) {
+		// Exit if we've reached the end of our input without being able to
+		// match all of the required stages.
+		if i >= len(completed) {
+			return false
+		}
+
+		// If we've found a stage we want, move on to the next required stage.
+		if completed[i] == required[j] {
+			j++
+		}
+		i++
+	}
+	return true
+}
+
+// checkFlowCompleted checks if a registration flow complies with any allowed flow
+// dictated by the server. Order of stages does not matter. A user may complete
+// extra stages as long as the required stages of at least one flow is met.
+func checkFlowCompleted(
+	flow []authtypes.LoginType,
+	allowedFlows []authtypes.Flow,
+) bool {
+	// Iterate through possible flows to check whether any have been fully completed.
+	for _, allowedFlow := range allowedFlows {
+		if checkFlows(flow, allowedFlow.Stages) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,101 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+)
+
+// TestUserSessionLifecycle checks that sessions started by logged in users
+// remember their user and can be deleted once they have been used.
+func TestUserSessionLifecycle(t *testing.T) {
+	d := newSessionsDict()
+	sessionID := d.startUserSession("@alice:localhost")
+
+	if userID, ok := d.sessionUserID(sessionID); !ok || userID != "@alice:localhost" {
+		t.Fatalf("sessionUserID returned %q, %v, want %q, true", userID, ok, "@alice:localhost")
+	}
+
+	d.addCompletedStage(sessionID, authtypes.LoginTypePassword)
+	d.addCompletedStage(sessionID, authtypes.LoginTypePassword)
+	if stages := d.GetCompletedStages(sessionID); len(stages) != 1 || stages[0] != authtypes.LoginTypePassword {
+		t.Errorf("GetCompletedStages returned %v, want [%s]", stages, authtypes.LoginTypePassword)
+	}
+
+	d.deleteSession(sessionID)
+	if _, ok := d.sessionUserID(sessionID); ok {
+		t.Error("sessionUserID found a deleted session")
+	}
+	if stages := d.GetCompletedStages(sessionID); len(stages) != 0 {
+		t.Errorf("GetCompletedStages returned %v for a deleted session, want []", stages)
+	}
+}
+
+// TestUserSessionExpiry checks that sessions of logged in users can't be used
+// once they have expired, and that expired sessions are cleaned up when new
+// ones start.
+func TestUserSessionExpiry(t *testing.T) {
+	d := newSessionsDict()
+	expired := d.startUserSession("@alice:localhost")
+	abandoned := d.startUserSession("@alice:localhost")
+	d.expiries[expired] = time.Now().Add(-time.Second)
+	d.expiries[abandoned] = time.Now().Add(-time.Second)
+
+	if _, ok := d.sessionUserID(expired); ok {
+		t.Error("sessionUserID found an expired session")
+	}
+	if _, ok := d.sessions[expired]; ok {
+		t.Error("an expired session was kept after it was looked up")
+	}
+
+	current := d.startUserSession("@alice:localhost")
+	if _, ok := d.sessions[abandoned]; ok {
+		t.Error("an expired session was kept after a new session started")
+	}
+	if userID, ok := d.sessionUserID(current); !ok || userID != "@alice:localhost" {
+		t.Errorf("sessionUserID returned %q, %v for a new session, want %q, true", userID, ok, "@alice:localhost")
+	}
+}
+
+// TestUserInteractiveAuthSessions checks that requests without a session are
+// challenged and that sessions can't be used by other users.
+func TestUserInteractiveAuthSessions(t *testing.T) {
+	alice := &authtypes.Device{UserID: "@alice:localhost", ID: "ALICE"}
+	bob := &authtypes.Device{UserID: "@bob:localhost", ID: "BOB"}
+
+	res := authenticateUserInteractive(context.Background(), alice, nil, nil)
+	if res == nil || res.Code != http.StatusUnauthorized {
+		t.Fatalf("expected a 401 challenge, got %+v", res)
+	}
+	challenge, ok := res.JSON.(userInteractiveResponse)
+	if !ok || challenge.Session == "" {
+		t.Fatalf("expected a user-interactive response with a session, got %+v", res.JSON)
+	}
+
+	res = authenticateUserInteractive(context.Background(), bob, &authDict{Session: challenge.Session}, nil)
+	if res == nil || res.Code != http.StatusBadRequest {
+		t.Errorf("expected another user's session to be rejected, got %+v", res)
+	}
+
+	res = authenticateUserInteractive(context.Background(), alice, &authDict{Session: challenge.Session}, nil)
+	if res == nil || res.Code != http.StatusUnauthorized {
+		t.Errorf("expected an incomplete session to be challenged again, got %+v", res)
+	}
+}
@@ -52,6 +52,8 @@ var (
 	clientAPIURL      = flag.String("client-api-server-url", "", "The base URL of the listening 'dendrite-client-api-server' process. E.g. 'http://localhost:4321'")
 	mediaAPIURL       = flag.String("media-api-server-url", "", "The base URL of the listening 'dendrite-media-api-server' process. E.g. 'http://localhost:7779'")
 	publicRoomsAPIURL = flag.String("public-rooms-api-server-url", "", "The base URL of the listening 'dendrite-public-rooms-api-server' process. E.g. 'http://localhost:7775'")
+	keyServerURL      = flag.String("key-server-url", "", "The base URL of the listening 'dendrite-key-server' process. E.g. 'http://localhost:7779'")
+	pushServerURL     = flag.String("push-server-url", "", "The base URL of the listening 'dendrite-push-server' process. E.g. 'http://localhost:7781'")
 	bindAddress       = flag.String("bind-address", ":8008", "The listening port for the proxy.")
 	certFile          = flag.String("tls-cert", "", "The PEM formatted X509 certificate to use for TLS")
 	keyFile           = flag.String("tls-key", "", "The PEM private key to use for TLS")
@@ -130,6 +132,18 @@ func main() {
 		os.Exit(1)
 	}
 
+	if *keyServerURL == "" {
+		flag.Usage()
+		fmt.Fprintln(os.Stderr, "no --key-server-url specified.")
+		os.Exit(1)
+	}
+
+	if *pushServerURL == "" {
+		flag.Usage()
+		fmt.Fprintln(os.Stderr, "no --push-server-url specified.")
+		os.Exit(1)
+	}
+
 	syncProxy, err := makeProxy(*syncServerURL)
 	if err != nil {
 		panic(err)
@@ -146,8 +160,20 @@ func main() {
 	if err != nil {
 		panic(err)
 	}
+	keyServerProxy, err := makeProxy(*keyServerURL)
+	if err != nil {
+		panic(err)
+	}
+	pushServerProxy, err := makeProxy(*pushServerURL)
+	if err != nil {
+		panic(err)
+	}
 
 	http.Handle("/_matrix/client/r0/sync", syncProxy)
+	http.Handle("/_matrix/client/r0/keys/changes", syncProxy)
+	http.Handle("/_matrix/client/r0/keys/", keyServerProxy)
+	http.Handle("/_matrix/client/r0/pushers", pushServerProxy)
+	http.Handle("/_matrix/client/r0/pushers/", pushServerProxy)
 	http.Handle("/_matrix/client/r0/directory/list/", publicRoomsProxy)
 	http.Handle("/_matrix/client/r0/publicRooms", publicRoomsProxy)
 	http.Handle("/_matrix/media/v1/", mediaProxy)
@@ -161,6 +187,9 @@ func main() {
 
 	fmt.Println("Proxying requests to:")
 	fmt.Println("  /_matrix/client/r0/sync            => ", *syncServerURL+"/api/_matrix/client/r0/sync")
+	fmt.Println("  /_matrix/client/r0/keys/changes    => ", *syncServerURL+"/api/_matrix/client/r0/keys/changes")
+	fmt.Println("  /_matrix/client/r0/keys            => ", *keyServerURL+"/api/_matrix/client/r0/keys")
+	fmt.Println("  /_matrix/client/r0/pushers         => ", *pushServerURL+"/api/_matrix/client/r0/pushers")
 	fmt.Println("  /_matrix/client/r0/directory/list  => ", *publicRoomsAPIURL+"/_matrix/client/r0/directory/list")
 	fmt.Println("  /_matrix/client/r0/publicRooms     => ", *publicRoomsAPIURL+"/_matrix/media/client/r0/publicRooms")
 	fmt.Println("  /_matrix/media/v1                  => ", *mediaAPIURL+"/api/_matrix/media/v1")
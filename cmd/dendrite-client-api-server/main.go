@@ -37,12 +37,16 @@ func main() {
 
 	asQuery := base.CreateHTTPAppServiceAPIs()
 	alias, input, query := base.CreateHTTPRoomserverAPIs()
-	fedSenderAPI := base.CreateHTTPFederationSenderAPIs()
+	_, fedSenderAPI := base.CreateHTTPFederationSenderAPIs()
 	typingInputAPI := typingserver.SetupTypingServerComponent(base, cache.NewTypingCache())
+	presenceInputAPI, presenceQueryAPI := base.CreateHTTPPresenceServerAPIs()
+	publicRoomsInputAPI := base.CreateHTTPPublicRoomsAPIs()
+	keyServerInputAPI, _ := base.CreateHTTPKeyServerAPIs()
 
 	clientapi.SetupClientAPIComponent(
 		base, deviceDB, accountDB, federation, &keyRing,
-		alias, input, query, typingInputAPI, asQuery, transactions.New(), fedSenderAPI,
+		alias, input, query, typingInputAPI, presenceInputAPI, presenceQueryAPI, asQuery, transactions.New(), fedSenderAPI,
+		publicRoomsInputAPI, keyServerInputAPI,
 	)
 
 	base.SetupAndServeHTTP(string(base.Cfg.Bind.ClientAPI), string(base.Cfg.Listen.ClientAPI))
@@ -29,15 +29,19 @@ func main() {
 	deviceDB := base.CreateDeviceDB()
 	keyDB := base.CreateKeyDB()
 	federation := base.CreateFederationClient()
-	federationSender := base.CreateHTTPFederationSenderAPIs()
+	fedSenderInput, fedSenderQuery := base.CreateHTTPFederationSenderAPIs()
 	keyRing := keydb.CreateKeyRing(federation.Client, keyDB)
 
 	alias, input, query := base.CreateHTTPRoomserverAPIs()
 	asQuery := base.CreateHTTPAppServiceAPIs()
+	typingInputAPI := base.CreateHTTPTypingServerAPIs()
+	presenceInputAPI, _ := base.CreateHTTPPresenceServerAPIs()
+	keyServerInputAPI, keyServerQueryAPI := base.CreateHTTPKeyServerAPIs()
 
 	federationapi.SetupFederationAPIComponent(
 		base, accountDB, deviceDB, federation, &keyRing,
-		alias, input, query, asQuery, federationSender,
+		alias, input, query, asQuery, fedSenderInput, fedSenderQuery,
+		typingInputAPI, presenceInputAPI, keyServerInputAPI, keyServerQueryAPI,
 	)
 
 	base.SetupAndServeHTTP(string(base.Cfg.Bind.FederationAPI), string(base.Cfg.Listen.FederationAPI))
@@ -26,8 +26,12 @@ import (
 	"github.com/matrix-org/dendrite/common/transactions"
 	"github.com/matrix-org/dendrite/federationapi"
 	"github.com/matrix-org/dendrite/federationsender"
+	"github.com/matrix-org/dendrite/keyserver"
 	"github.com/matrix-org/dendrite/mediaapi"
+	"github.com/matrix-org/dendrite/presenceserver"
+	presenceCache "github.com/matrix-org/dendrite/presenceserver/cache"
 	"github.com/matrix-org/dendrite/publicroomsapi"
+	"github.com/matrix-org/dendrite/pushserver"
 	"github.com/matrix-org/dendrite/roomserver"
 	"github.com/matrix-org/dendrite/syncapi"
 	"github.com/matrix-org/dendrite/typingserver"
@@ -57,20 +61,24 @@ func main() {
 
 	alias, input, query := roomserver.SetupRoomServerComponent(base)
 	typingInputAPI := typingserver.SetupTypingServerComponent(base, cache.NewTypingCache())
+	presenceInputAPI, presenceQueryAPI := presenceserver.SetupPresenceServerComponent(base, presenceCache.NewPresenceCache())
 	asQuery := appservice.SetupAppServiceAPIComponent(
 		base, accountDB, deviceDB, federation, alias, query, transactions.New(),
 	)
-	fedSenderAPI := federationsender.SetupFederationSenderComponent(base, federation, query)
+	fedSenderInputAPI, fedSenderAPI := federationsender.SetupFederationSenderComponent(base, federation, query)
+	keyServerInputAPI, keyServerQueryAPI := keyserver.SetupKeyServerComponent(base, deviceDB, federation)
+	pushQueryAPI := pushserver.SetupPushServerComponent(base, accountDB, deviceDB, query)
+	publicRoomsInputAPI := publicroomsapi.SetupPublicRoomsAPIComponent(base, deviceDB, query, federation, nil)
 
 	clientapi.SetupClientAPIComponent(
 		base, deviceDB, accountDB,
 		federation, &keyRing, alias, input, query,
-		typingInputAPI, asQuery, transactions.New(), fedSenderAPI,
+		typingInputAPI, presenceInputAPI, presenceQueryAPI, asQuery, transactions.New(), fedSenderAPI,
+		publicRoomsInputAPI, keyServerInputAPI,
 	)
-	federationapi.SetupFederationAPIComponent(base, accountDB, deviceDB, federation, &keyRing, alias, input, query, asQuery, fedSenderAPI)
+	federationapi.SetupFederationAPIComponent(base, accountDB, deviceDB, federation, &keyRing, alias, input, query, asQuery, fedSenderInputAPI, fedSenderAPI, typingInputAPI, presenceInputAPI, keyServerInputAPI, keyServerQueryAPI)
 	mediaapi.SetupMediaAPIComponent(base, deviceDB)
-	publicroomsapi.SetupPublicRoomsAPIComponent(base, deviceDB, query, federation, nil)
-	syncapi.SetupSyncAPIComponent(base, deviceDB, accountDB, query, federation, cfg)
+	syncapi.SetupSyncAPIComponent(base, deviceDB, accountDB, query, federation, cfg, keyServerQueryAPI, presenceInputAPI, pushQueryAPI)
 
 	httpHandler := common.WrapHandlerInCORS(base.APIMux)
 
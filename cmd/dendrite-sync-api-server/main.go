@@ -29,8 +29,11 @@ func main() {
 	federation := base.CreateFederationClient()
 
 	_, _, query := base.CreateHTTPRoomserverAPIs()
+	_, keyServerQueryAPI := base.CreateHTTPKeyServerAPIs()
+	presenceInputAPI, _ := base.CreateHTTPPresenceServerAPIs()
+	pushQueryAPI := base.CreateHTTPPushServerAPIs()
 
-	syncapi.SetupSyncAPIComponent(base, deviceDB, accountDB, query, federation, cfg)
+	syncapi.SetupSyncAPIComponent(base, deviceDB, accountDB, query, federation, cfg, keyServerQueryAPI, presenceInputAPI, pushQueryAPI)
 
 	base.SetupAndServeHTTP(string(base.Cfg.Bind.SyncAPI), string(base.Cfg.Listen.SyncAPI))
 
@@ -29,8 +29,12 @@ import (
 	"github.com/matrix-org/dendrite/common/transactions"
 	"github.com/matrix-org/dendrite/federationapi"
 	"github.com/matrix-org/dendrite/federationsender"
+	"github.com/matrix-org/dendrite/keyserver"
 	"github.com/matrix-org/dendrite/mediaapi"
+	"github.com/matrix-org/dendrite/presenceserver"
+	presenceCache "github.com/matrix-org/dendrite/presenceserver/cache"
 	"github.com/matrix-org/dendrite/publicroomsapi"
+	"github.com/matrix-org/dendrite/pushserver"
 	"github.com/matrix-org/dendrite/roomserver"
 	"github.com/matrix-org/dendrite/syncapi"
 	"github.com/matrix-org/dendrite/typingserver"
@@ -84,6 +88,8 @@ func main() {
 	cfg.Database.AppService = "file:dendritejs_appservice.db"
 	cfg.Database.Device = "file:dendritejs_device.db"
 	cfg.Database.FederationSender = "file:dendritejs_fedsender.db"
+	cfg.Database.KeyServer = "file:dendritejs_keyserver.db"
+	cfg.Database.PushServer = "file:dendritejs_pushserver.db"
 	cfg.Database.MediaAPI = "file:dendritejs_mediaapi.db"
 	cfg.Database.Naffka = "file:dendritejs_naffka.db"
 	cfg.Database.PublicRoomsAPI = "file:dendritejs_publicrooms.db"
@@ -94,6 +100,10 @@ func main() {
 	cfg.Kafka.Topics.OutputTypingEvent = "output_typing_event"
 	cfg.Kafka.Topics.OutputClientData = "output_client_data"
 	cfg.Kafka.Topics.OutputRoomEvent = "output_room_event"
+	cfg.Kafka.Topics.OutputKeyChangeEvent = "output_key_change_event"
+	cfg.Kafka.Topics.OutputSendToDeviceEvent = "output_send_to_device_event"
+	cfg.Kafka.Topics.OutputReceiptEvent = "output_receipt_event"
+	cfg.Kafka.Topics.OutputPresenceEvent = "output_presence_event"
 	cfg.Matrix.TrustedIDServers = []string{
 		"matrix.org", "vector.im",
 	}
@@ -123,20 +133,24 @@ func main() {
 
 	alias, input, query := roomserver.SetupRoomServerComponent(base)
 	typingInputAPI := typingserver.SetupTypingServerComponent(base, cache.NewTypingCache())
+	presenceInputAPI, presenceQueryAPI := presenceserver.SetupPresenceServerComponent(base, presenceCache.NewPresenceCache())
 	asQuery := appservice.SetupAppServiceAPIComponent(
 		base, accountDB, deviceDB, federation, alias, query, transactions.New(),
 	)
-	fedSenderAPI := federationsender.SetupFederationSenderComponent(base, federation, query)
+	fedSenderInputAPI, fedSenderAPI := federationsender.SetupFederationSenderComponent(base, federation, query)
+	keyServerInputAPI, keyServerQueryAPI := keyserver.SetupKeyServerComponent(base, deviceDB, federation)
+	pushQueryAPI := pushserver.SetupPushServerComponent(base, accountDB, deviceDB, query)
+	publicRoomsInputAPI := publicroomsapi.SetupPublicRoomsAPIComponent(base, deviceDB, query, federation, p2pPublicRoomProvider)
 
 	clientapi.SetupClientAPIComponent(
 		base, deviceDB, accountDB,
 		federation, &keyRing, alias, input, query,
-		typingInputAPI, asQuery, transactions.New(), fedSenderAPI,
+		typingInputAPI, presenceInputAPI, presenceQueryAPI, asQuery, transactions.New(), fedSenderAPI,
+		publicRoomsInputAPI, keyServerInputAPI,
 	)
-	federationapi.SetupFederationAPIComponent(base, accountDB, deviceDB, federation, &keyRing, alias, input, query, asQuery, fedSenderAPI)
+	federationapi.SetupFederationAPIComponent(base, accountDB, deviceDB, federation, &keyRing, alias, input, query, asQuery, fedSenderInputAPI, fedSenderAPI, typingInputAPI, presenceInputAPI, keyServerInputAPI, keyServerQueryAPI)
 	mediaapi.SetupMediaAPIComponent(base, deviceDB)
-	publicroomsapi.SetupPublicRoomsAPIComponent(base, deviceDB, query, federation, p2pPublicRoomProvider)
-	syncapi.SetupSyncAPIComponent(base, deviceDB, accountDB, query, federation, cfg)
+	syncapi.SetupSyncAPIComponent(base, deviceDB, accountDB, query, federation, cfg, keyServerQueryAPI, presenceInputAPI, pushQueryAPI)
 
 	httpHandler := common.WrapHandlerInCORS(base.APIMux)
 
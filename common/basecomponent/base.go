@@ -36,6 +36,10 @@ import (
 	appserviceAPI "github.com/matrix-org/dendrite/appservice/api"
 	"github.com/matrix-org/dendrite/common/config"
 	federationSenderAPI "github.com/matrix-org/dendrite/federationsender/api"
+	keyServerAPI "github.com/matrix-org/dendrite/keyserver/api"
+	presenceServerAPI "github.com/matrix-org/dendrite/presenceserver/api"
+	publicRoomsAPI "github.com/matrix-org/dendrite/publicroomsapi/api"
+	pushServerAPI "github.com/matrix-org/dendrite/pushserver/api"
 	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
 	typingServerAPI "github.com/matrix-org/dendrite/typingserver/api"
 	"github.com/sirupsen/logrus"
@@ -117,10 +121,49 @@ func (b *BaseDendrite) CreateHTTPTypingServerAPIs() typingServerAPI.TypingServer
 	return typingServerAPI.NewTypingServerInputAPIHTTP(b.Cfg.TypingServerURL(), nil)
 }
 
-// CreateHTTPFederationSenderAPIs returns FederationSenderQueryAPI for hitting
+// CreateHTTPFederationSenderAPIs returns the InputAPI and QueryAPI for hitting
 // the federation sender over HTTP
-func (b *BaseDendrite) CreateHTTPFederationSenderAPIs() federationSenderAPI.FederationSenderQueryAPI {
-	return federationSenderAPI.NewFederationSenderQueryAPIHTTP(b.Cfg.FederationSenderURL(), nil)
+func (b *BaseDendrite) CreateHTTPFederationSenderAPIs() (
+	federationSenderAPI.FederationSenderInputAPI,
+	federationSenderAPI.FederationSenderQueryAPI,
+) {
+	input := federationSenderAPI.NewFederationSenderInputAPIHTTP(b.Cfg.FederationSenderURL(), nil)
+	query := federationSenderAPI.NewFederationSenderQueryAPIHTTP(b.Cfg.FederationSenderURL(), nil)
+	return input, query
+}
+
+// CreateHTTPKeyServerAPIs returns the InputAPI and QueryAPI for hitting the
+// key server over HTTP
+func (b *BaseDendrite) CreateHTTPKeyServerAPIs() (
+	keyServerAPI.KeyServerInputAPI,
+	keyServerAPI.KeyServerQueryAPI,
+) {
+	input := keyServerAPI.NewKeyServerInputAPIHTTP(b.Cfg.KeyServerURL(), nil)
+	query := keyServerAPI.NewKeyServerQueryAPIHTTP(b.Cfg.KeyServerURL(), nil)
+	return input, query
+}
+
+// CreateHTTPPublicRoomsAPIs returns the InputAPI for hitting the public rooms
+// API over HTTP
+func (b *BaseDendrite) CreateHTTPPublicRoomsAPIs() publicRoomsAPI.PublicRoomsInputAPI {
+	return publicRoomsAPI.NewPublicRoomsInputAPIHTTP(b.Cfg.PublicRoomsAPIURL(), nil)
+}
+
+// CreateHTTPPresenceServerAPIs returns the InputAPI and QueryAPI for hitting
+// the presence server over HTTP
+func (b *BaseDendrite) CreateHTTPPresenceServerAPIs() (
+	presenceServerAPI.PresenceServerInputAPI,
+	presenceServerAPI.PresenceServerQueryAPI,
+) {
+	input := presenceServerAPI.NewPresenceServerInputAPIHTTP(b.Cfg.PresenceServerURL(), nil)
+	query := presenceServerAPI.NewPresenceServerQueryAPIHTTP(b.Cfg.PresenceServerURL(), nil)
+	return input, query
+}
+
+// CreateHTTPPushServerAPIs returns the QueryAPI for hitting the push server
+// over HTTP
+func (b *BaseDendrite) CreateHTTPPushServerAPIs() pushServerAPI.PushServerQueryAPI {
+	return pushServerAPI.NewPushServerQueryAPIHTTP(b.Cfg.PushServerURL(), nil)
 }
 
 // CreateDeviceDB creates a new instance of the device database. Should only be
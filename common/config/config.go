@@ -136,6 +136,14 @@ type Dendrite struct {
 			OutputClientData Topic `yaml:"output_client_data"`
 			// Topic for typingserver/api.OutputTypingEvent events.
 			OutputTypingEvent Topic `yaml:"output_typing_event"`
+			// Topic for keyserver/api.OutputKeyChangeEvent events.
+			OutputKeyChangeEvent Topic `yaml:"output_key_change_event"`
+			// Topic for common.SendToDevice messages.
+			OutputSendToDeviceEvent Topic `yaml:"output_send_to_device_event"`
+			// Topic for common.Receipt read receipts.
+			OutputReceiptEvent Topic `yaml:"output_receipt_event"`
+			// Topic for presenceserver/api.OutputPresenceEvent events.
+			OutputPresenceEvent Topic `yaml:"output_presence_event"`
 			// Topic for user updates (profile, presence)
 			UserUpdates Topic `yaml:"user_updates"`
 		}
@@ -170,6 +178,13 @@ type Dendrite struct {
 		// The PublicRoomsAPI database stores information used to compute the public
 		// room directory. It is only accessed by the PublicRoomsAPI server.
 		PublicRoomsAPI DataSource `yaml:"public_rooms_api"`
+		// The KeyServer database stores the end-to-end encryption keys of the
+		// devices of local users. It is only accessed by the KeyServer.
+		KeyServer DataSource `yaml:"key_server"`
+		// The PushServer database stores the pushers and the unread
+		// notification counts of local users. It is only accessed by the
+		// PushServer.
+		PushServer DataSource `yaml:"push_server"`
 		// The Naffka database is used internally by the naffka library, if used.
 		Naffka DataSource `yaml:"naffka,omitempty"`
 	} `yaml:"database"`
@@ -207,6 +222,9 @@ type Dendrite struct {
 		FederationSender Address `yaml:"federation_sender"`
 		PublicRoomsAPI   Address `yaml:"public_rooms_api"`
 		TypingServer     Address `yaml:"typing_server"`
+		KeyServer        Address `yaml:"key_server"`
+		PresenceServer   Address `yaml:"presence_server"`
+		PushServer       Address `yaml:"push_server"`
 	} `yaml:"bind"`
 
 	// The addresses for talking to other microservices.
@@ -220,6 +238,9 @@ type Dendrite struct {
 		FederationSender Address `yaml:"federation_sender"`
 		PublicRoomsAPI   Address `yaml:"public_rooms_api"`
 		TypingServer     Address `yaml:"typing_server"`
+		KeyServer        Address `yaml:"key_server"`
+		PresenceServer   Address `yaml:"presence_server"`
+		PushServer       Address `yaml:"push_server"`
 	} `yaml:"listen"`
 
 	// The config for tracing the dendrite servers.
@@ -551,6 +572,10 @@ func (config *Dendrite) checkKafka(configErrs *configErrors, monolithic bool) {
 	checkNotEmpty(configErrs, "kafka.topics.output_room_event", string(config.Kafka.Topics.OutputRoomEvent))
 	checkNotEmpty(configErrs, "kafka.topics.output_client_data", string(config.Kafka.Topics.OutputClientData))
 	checkNotEmpty(configErrs, "kafka.topics.output_typing_event", string(config.Kafka.Topics.OutputTypingEvent))
+	checkNotEmpty(configErrs, "kafka.topics.output_key_change_event", string(config.Kafka.Topics.OutputKeyChangeEvent))
+	checkNotEmpty(configErrs, "kafka.topics.output_send_to_device_event", string(config.Kafka.Topics.OutputSendToDeviceEvent))
+	checkNotEmpty(configErrs, "kafka.topics.output_receipt_event", string(config.Kafka.Topics.OutputReceiptEvent))
+	checkNotEmpty(configErrs, "kafka.topics.output_presence_event", string(config.Kafka.Topics.OutputPresenceEvent))
 	checkNotEmpty(configErrs, "kafka.topics.user_updates", string(config.Kafka.Topics.UserUpdates))
 }
 
@@ -572,6 +597,9 @@ func (config *Dendrite) checkListen(configErrs *configErrors) {
 	checkNotEmpty(configErrs, "listen.sync_api", string(config.Listen.SyncAPI))
 	checkNotEmpty(configErrs, "listen.room_server", string(config.Listen.RoomServer))
 	checkNotEmpty(configErrs, "listen.typing_server", string(config.Listen.TypingServer))
+	checkNotEmpty(configErrs, "listen.key_server", string(config.Listen.KeyServer))
+	checkNotEmpty(configErrs, "listen.presence_server", string(config.Listen.PresenceServer))
+	checkNotEmpty(configErrs, "listen.push_server", string(config.Listen.PushServer))
 }
 
 // checkLogging verifies the parameters logging.* are valid.
@@ -703,6 +731,43 @@ func (config *Dendrite) FederationSenderURL() string {
 	return "http://" + string(config.Listen.FederationSender)
 }
 
+// KeyServerURL returns an HTTP URL for where the key server is listening.
+func (config *Dendrite) KeyServerURL() string {
+	// Hard code the key server to talk HTTP for now.
+	// If we support HTTPS we need to think of a practical way to do certificate validation.
+	// People setting up servers shouldn't need to get a certificate valid for the public
+	// internet for an internal API.
+	return "http://" + string(config.Listen.KeyServer)
+}
+
+// PresenceServerURL returns an HTTP URL for where the presence server is listening.
+func (config *Dendrite) PresenceServerURL() string {
+	// Hard code the presence server to talk HTTP for now.
+	// If we support HTTPS we need to think of a practical way to do certificate validation.
+	// People setting up servers shouldn't need to get a certificate valid for the public
+	// internet for an internal API.
+	return "http://" + string(config.Listen.PresenceServer)
+}
+
+// PushServerURL returns an HTTP URL for where the push server is listening.
+func (config *Dendrite) PushServerURL() string {
+	// Hard code the push server to talk HTTP for now.
+	// If we support HTTPS we need to think of a practical way to do certificate validation.
+	// People setting up servers shouldn't need to get a certificate valid for the public
+	// internet for an internal API.
+	return "http://" + string(config.Listen.PushServer)
+}
+
+// PublicRoomsAPIURL returns an HTTP URL for where the public rooms API is
+// listening.
+func (config *Dendrite) PublicRoomsAPIURL() string {
+	// Hard code the public rooms API to talk HTTP for now.
+	// If we support HTTPS we need to think of a practical way to do certificate validation.
+	// People setting up servers shouldn't need to get a certificate valid for the public
+	// internet for an internal API.
+	return "http://" + string(config.Listen.PublicRoomsAPI)
+}
+
 // SetupTracing configures the opentracing using the supplied configuration.
 func (config *Dendrite) SetupTracing(serviceName string) (closer io.Closer, err error) {
 	if !config.Tracing.Enabled {
@@ -46,6 +46,10 @@ kafka:
     output_room_event: output.room
     output_client_data: output.client
     output_typing_event: output.typing
+    output_key_change_event: output.keychange
+    output_send_to_device_event: output.sendtodevice
+    output_receipt_event: output.receipt
+    output_presence_event: output.presence
     user_updates: output.user
 database:
   media_api: "postgresql:///media_api"
@@ -63,6 +67,9 @@ listen:
   media_api: "localhost:7774"
   appservice_api: "localhost:7777"
   typing_server: "localhost:7778"
+  key_server: "localhost:7779"
+  presence_server: "localhost:7780"
+  push_server: "localhost:7781"
 logging:
   - type: "file"
     level: "info"
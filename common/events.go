@@ -16,7 +16,9 @@ package common
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"time"
 
 	"github.com/matrix-org/dendrite/common/config"
@@ -124,3 +126,37 @@ func AddPrevEventsToEvent(
 
 	return nil
 }
+
+// RedactEvent returns the redacted form of the given event, with the
+// redaction event that caused it in its "redacted_because" unsigned key as
+// clients expect. The other unsigned keys of the event are kept.
+func RedactEvent(
+	redactedEvent, redactionEvent *gomatrixserverlib.Event,
+	roomVersion gomatrixserverlib.RoomVersion,
+) (*gomatrixserverlib.Event, error) {
+	if redactionEvent.Type() != gomatrixserverlib.MRoomRedaction {
+		return nil, fmt.Errorf("event %s is not a redaction event", redactionEvent.EventID())
+	}
+	if redactionEvent.Redacts() != redactedEvent.EventID() {
+		return nil, fmt.Errorf("event %s doesn't redact event %s", redactionEvent.EventID(), redactedEvent.EventID())
+	}
+	unsigned := map[string]interface{}{}
+	if len(redactedEvent.Unsigned()) > 0 {
+		if err := json.Unmarshal(redactedEvent.Unsigned(), &unsigned); err != nil {
+			return nil, err
+		}
+	}
+	unsigned["redacted_because"] = redactionEvent
+	// Event.Redact doesn't keep the room version of the event, so the
+	// redacted event has to be parsed again before it can be used.
+	stripped := redactedEvent.Redact()
+	redacted, err := gomatrixserverlib.NewEventFromTrustedJSON(stripped.JSON(), true, roomVersion)
+	if err != nil {
+		return nil, err
+	}
+	redacted, err = redacted.SetUnsigned(unsigned)
+	if err != nil {
+		return nil, err
+	}
+	return &redacted, nil
+}
@@ -0,0 +1,98 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"golang.org/x/crypto/ed25519"
+)
+
+func TestRedactEvent(t *testing.T) {
+	_, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	build := func(
+		roomVersion gomatrixserverlib.RoomVersion, eventType, redacts string,
+	) gomatrixserverlib.Event {
+		builder := gomatrixserverlib.EventBuilder{
+			Sender:     "@alice:localhost",
+			RoomID:     "!room:localhost",
+			Type:       eventType,
+			Redacts:    redacts,
+			PrevEvents: []gomatrixserverlib.EventReference{},
+			AuthEvents: []gomatrixserverlib.EventReference{},
+		}
+		if err = builder.SetContent(map[string]string{"body": "hello"}); err != nil {
+			t.Fatal(err)
+		}
+		event, err := builder.Build(time.Now(), "localhost", "ed25519:test", privateKey, roomVersion)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return event
+	}
+
+	for _, roomVersion := range []gomatrixserverlib.RoomVersion{
+		gomatrixserverlib.RoomVersionV1,
+		gomatrixserverlib.RoomVersionV5,
+	} {
+		message := build(roomVersion, "m.room.message", "")
+		message, err = message.SetUnsigned(map[string]interface{}{"transaction_id": "txn"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		redaction := build(roomVersion, gomatrixserverlib.MRoomRedaction, message.EventID())
+
+		redacted, err := RedactEvent(&message, &redaction, roomVersion)
+		if err != nil {
+			t.Fatalf("room version %s: %s", roomVersion, err)
+		}
+		if redacted.EventID() != message.EventID() {
+			t.Errorf("room version %s: got event ID %s, want %s", roomVersion, redacted.EventID(), message.EventID())
+		}
+		if string(redacted.Content()) != "{}" {
+			t.Errorf("room version %s: got content %s, want {}", roomVersion, redacted.Content())
+		}
+		var unsigned struct {
+			TransactionID   string `json:"transaction_id"`
+			RedactedBecause struct {
+				Type string `json:"type"`
+			} `json:"redacted_because"`
+		}
+		if err = json.Unmarshal(redacted.Unsigned(), &unsigned); err != nil {
+			t.Fatal(err)
+		}
+		if unsigned.TransactionID != "txn" {
+			t.Errorf("room version %s: the other unsigned keys weren't kept: %s", roomVersion, redacted.Unsigned())
+		}
+		if unsigned.RedactedBecause.Type != gomatrixserverlib.MRoomRedaction {
+			t.Errorf("room version %s: got redacted_because %s", roomVersion, redacted.Unsigned())
+		}
+
+		// Only redactions of the event itself can be applied.
+		other := build(roomVersion, "m.room.message", "")
+		if _, err = RedactEvent(&other, &redaction, roomVersion); err == nil {
+			t.Errorf("room version %s: redaction of another event was applied", roomVersion)
+		}
+		if _, err = RedactEvent(&message, &other, roomVersion); err == nil {
+			t.Errorf("room version %s: an event that isn't a redaction was applied", roomVersion)
+		}
+	}
+}
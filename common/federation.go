@@ -0,0 +1,45 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"context"
+
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// DoFederationRequest signs a federation request with the server's key and
+// sends it, parsing the JSON response into response. It is used for the
+// federation endpoints that gomatrixserverlib.FederationClient doesn't have
+// methods for yet.
+func DoFederationRequest(
+	ctx context.Context,
+	cfg *config.Dendrite,
+	federation *gomatrixserverlib.FederationClient,
+	request gomatrixserverlib.FederationRequest,
+	response interface{},
+) error {
+	if err := request.Sign(
+		cfg.Matrix.ServerName, cfg.Matrix.KeyID, cfg.Matrix.PrivateKey,
+	); err != nil {
+		return err
+	}
+	httpReq, err := request.HTTPRequest()
+	if err != nil {
+		return err
+	}
+	return federation.DoRequestAndParseResponse(ctx, httpReq, response)
+}
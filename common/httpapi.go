@@ -1,6 +1,7 @@
 package common
 
 import (
+	"context"
 	"net/http"
 	"time"
 
@@ -102,11 +103,22 @@ func MakeInternalAPI(metricsName string, f func(*http.Request) util.JSONResponse
 	return http.HandlerFunc(withSpan)
 }
 
+// FederationWakeup is notified whenever we receive a correctly signed request
+// from a remote server, which tells us that the server is reachable again.
+// Wakeup is called for every request, so it must return quickly and do any
+// slow work in the background.
+type FederationWakeup interface {
+	Wakeup(ctx context.Context, origin gomatrixserverlib.ServerName)
+}
+
 // MakeFedAPI makes an http.Handler that checks matrix federation authentication.
+// If wakeup is not nil then it is told about the origin of every request that
+// passes authentication.
 func MakeFedAPI(
 	metricsName string,
 	serverName gomatrixserverlib.ServerName,
 	keyRing gomatrixserverlib.KeyRing,
+	wakeup FederationWakeup,
 	f func(*http.Request, *gomatrixserverlib.FederationRequest) util.JSONResponse,
 ) http.Handler {
 	h := func(req *http.Request) util.JSONResponse {
@@ -116,6 +128,11 @@ func MakeFedAPI(
 		if fedReq == nil {
 			return errResp
 		}
+		if wakeup != nil {
+			// The request context is cancelled as soon as we respond, so
+			// don't tie the notification to it.
+			wakeup.Wakeup(context.Background(), fedReq.Origin())
+		}
 		return f(req, fedReq)
 	}
 	return MakeExternalAPI(metricsName, h)
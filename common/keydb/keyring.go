@@ -14,7 +14,11 @@
 
 package keydb
 
-import "github.com/matrix-org/gomatrixserverlib"
+import (
+	"context"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
 
 // CreateKeyRing creates and configures a KeyRing object.
 //
@@ -30,3 +34,34 @@ func CreateKeyRing(client gomatrixserverlib.Client,
 		KeyDatabase: keyDB,
 	}
 }
+
+// KeyRingForRoomVersion returns the verifier to use for the signatures on the
+// events of a room of the given version. Before room version 5 the validity
+// period of the signing keys wasn't enforced, so for those rooms the keys are
+// accepted regardless of when they are valid until, as Synapse does.
+func KeyRingForRoomVersion(
+	keyRing gomatrixserverlib.JSONVerifier, roomVersion gomatrixserverlib.RoomVersion,
+) gomatrixserverlib.JSONVerifier {
+	if enforced, err := roomVersion.EnforceSignatureChecks(); err == nil && !enforced {
+		return lenientKeyRing{keyRing}
+	}
+	return keyRing
+}
+
+// lenientKeyRing verifies signatures without checking that the keys were
+// valid when the signed JSON was sent.
+type lenientKeyRing struct {
+	gomatrixserverlib.JSONVerifier
+}
+
+// VerifyJSONs implements gomatrixserverlib.JSONVerifier
+func (k lenientKeyRing) VerifyJSONs(
+	ctx context.Context, requests []gomatrixserverlib.VerifyJSONRequest,
+) ([]gomatrixserverlib.VerifyJSONResult, error) {
+	lenientRequests := make([]gomatrixserverlib.VerifyJSONRequest, len(requests))
+	for i := range requests {
+		lenientRequests[i] = requests[i]
+		lenientRequests[i].AtTS = 0
+	}
+	return k.JSONVerifier.VerifyJSONs(ctx, lenientRequests)
+}
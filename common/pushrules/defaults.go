@@ -0,0 +1,158 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pushrules
+
+import (
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+var (
+	notify       = Action{Kind: NotifyAction}
+	dontNotify   = Action{Kind: DontNotifyAction}
+	soundDefault = Action{Kind: SetTweakAction, Tweak: SoundTweak, Value: "default"}
+	soundRing    = Action{Kind: SetTweakAction, Tweak: SoundTweak, Value: "ring"}
+	highlight    = Action{Kind: SetTweakAction, Tweak: HighlightTweak}
+	noHighlight  = Action{Kind: SetTweakAction, Tweak: HighlightTweak, Value: false}
+)
+
+func eventMatch(key, pattern string) Condition {
+	return Condition{Kind: EventMatchCondition, Key: key, Pattern: pattern}
+}
+
+// DefaultAccountRuleSets returns the predefined push rules that every user
+// starts with.
+// See https://matrix.org/docs/spec/client_server/r0.6.0#predefined-rules
+func DefaultAccountRuleSets(localpart string, serverName gomatrixserverlib.ServerName) *AccountRuleSets {
+	userID := "@" + localpart + ":" + string(serverName)
+	return &AccountRuleSets{
+		Global: RuleSet{
+			Override: []*Rule{
+				{
+					RuleID:     ".m.rule.master",
+					Default:    true,
+					Enabled:    false,
+					Conditions: []Condition{},
+					Actions:    []Action{dontNotify},
+				},
+				{
+					RuleID:     ".m.rule.suppress_notices",
+					Default:    true,
+					Enabled:    true,
+					Conditions: []Condition{eventMatch("content.msgtype", "m.notice")},
+					Actions:    []Action{dontNotify},
+				},
+				{
+					RuleID:  ".m.rule.invite_for_me",
+					Default: true,
+					Enabled: true,
+					Conditions: []Condition{
+						eventMatch("type", "m.room.member"),
+						eventMatch("content.membership", "invite"),
+						eventMatch("state_key", userID),
+					},
+					Actions: []Action{notify, soundDefault, noHighlight},
+				},
+				{
+					RuleID:     ".m.rule.member_event",
+					Default:    true,
+					Enabled:    true,
+					Conditions: []Condition{eventMatch("type", "m.room.member")},
+					Actions:    []Action{dontNotify},
+				},
+				{
+					RuleID:     ".m.rule.contains_display_name",
+					Default:    true,
+					Enabled:    true,
+					Conditions: []Condition{{Kind: ContainsDisplayNameCondition}},
+					Actions:    []Action{notify, soundDefault, highlight},
+				},
+				{
+					RuleID:  ".m.rule.tombstone",
+					Default: true,
+					Enabled: true,
+					Conditions: []Condition{
+						eventMatch("type", "m.room.tombstone"),
+						eventMatch("state_key", ""),
+					},
+					Actions: []Action{notify, highlight},
+				},
+				{
+					RuleID:  ".m.rule.roomnotif",
+					Default: true,
+					Enabled: true,
+					Conditions: []Condition{
+						eventMatch("content.body", "@room"),
+						{Kind: SenderNotificationPermissionCondition, Key: "room"},
+					},
+					Actions: []Action{notify, highlight},
+				},
+			},
+			Content: []*Rule{
+				{
+					RuleID:  ".m.rule.contains_user_name",
+					Default: true,
+					Enabled: true,
+					Pattern: localpart,
+					Actions: []Action{notify, soundDefault, highlight},
+				},
+			},
+			Room:   []*Rule{},
+			Sender: []*Rule{},
+			Underride: []*Rule{
+				{
+					RuleID:     ".m.rule.call",
+					Default:    true,
+					Enabled:    true,
+					Conditions: []Condition{eventMatch("type", "m.call.invite")},
+					Actions:    []Action{notify, soundRing, noHighlight},
+				},
+				{
+					RuleID:  ".m.rule.encrypted_room_one_to_one",
+					Default: true,
+					Enabled: true,
+					Conditions: []Condition{
+						{Kind: RoomMemberCountCondition, Is: "2"},
+						eventMatch("type", "m.room.encrypted"),
+					},
+					Actions: []Action{notify, soundDefault, noHighlight},
+				},
+				{
+					RuleID:  ".m.rule.room_one_to_one",
+					Default: true,
+					Enabled: true,
+					Conditions: []Condition{
+						{Kind: RoomMemberCountCondition, Is: "2"},
+						eventMatch("type", "m.room.message"),
+					},
+					Actions: []Action{notify, soundDefault, noHighlight},
+				},
+				{
+					RuleID:     ".m.rule.message",
+					Default:    true,
+					Enabled:    true,
+					Conditions: []Condition{eventMatch("type", "m.room.message")},
+					Actions:    []Action{notify, noHighlight},
+				},
+				{
+					RuleID:     ".m.rule.encrypted",
+					Default:    true,
+					Enabled:    true,
+					Conditions: []Condition{eventMatch("type", "m.room.encrypted")},
+					Actions:    []Action{notify, noHighlight},
+				},
+			},
+		},
+	}
+}
@@ -0,0 +1,259 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pushrules
+
+import (
+	"encoding/json"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// EvaluationContext holds the information about the room and the user whose
+// rules are being evaluated that isn't part of the event itself.
+type EvaluationContext struct {
+	// UserDisplayName is the display name of the user in the room, if any.
+	UserDisplayName string
+	// RoomMemberCount is the number of users joined to the room.
+	RoomMemberCount int
+	// PowerLevels is the m.room.power_levels event of the room, or nil if the
+	// room doesn't have one.
+	PowerLevels *gomatrixserverlib.Event
+}
+
+// Evaluate returns the actions of the first enabled rule that matches the
+// event, or nil if no rule matches.
+func (s *RuleSet) Evaluate(event *gomatrixserverlib.Event, ctx *EvaluationContext) ([]Action, error) {
+	var fields map[string]interface{}
+	if err := json.Unmarshal(event.JSON(), &fields); err != nil {
+		return nil, err
+	}
+	e := evaluator{event: event, fields: fields, ctx: ctx}
+	for _, kind := range Kinds {
+		for _, rule := range *s.RulesOfKind(kind) {
+			if !rule.Enabled {
+				continue
+			}
+			match, err := e.ruleMatches(kind, rule)
+			if err != nil {
+				return nil, err
+			}
+			if match {
+				return rule.Actions, nil
+			}
+		}
+	}
+	return nil, nil
+}
+
+type evaluator struct {
+	event  *gomatrixserverlib.Event
+	fields map[string]interface{}
+	ctx    *EvaluationContext
+}
+
+func (e *evaluator) ruleMatches(kind string, rule *Rule) (bool, error) {
+	switch kind {
+	case ContentKind:
+		return e.eventMatches("content.body", rule.Pattern), nil
+	case RoomKind:
+		return rule.RuleID == e.event.RoomID(), nil
+	case SenderKind:
+		return rule.RuleID == e.event.Sender(), nil
+	}
+	for _, cond := range rule.Conditions {
+		match, err := e.conditionMatches(&cond)
+		if err != nil || !match {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+func (e *evaluator) conditionMatches(cond *Condition) (bool, error) {
+	switch cond.Kind {
+	case EventMatchCondition:
+		return e.eventMatches(cond.Key, cond.Pattern), nil
+	case ContainsDisplayNameCondition:
+		if e.ctx.UserDisplayName == "" {
+			return false, nil
+		}
+		body, ok := e.lookup("content.body")
+		if !ok {
+			return false, nil
+		}
+		re, err := wordRegexp(regexp.QuoteMeta(e.ctx.UserDisplayName))
+		if err != nil {
+			return false, nil
+		}
+		return re.MatchString(body), nil
+	case RoomMemberCountCondition:
+		return memberCountMatches(cond.Is, e.ctx.RoomMemberCount), nil
+	case SenderNotificationPermissionCondition:
+		return e.senderHasNotificationPermission(cond.Key)
+	}
+	// Conditions that we don't understand never match, as required by the spec.
+	return false, nil
+}
+
+// eventMatches implements the event_match condition. The pattern is matched
+// against words in the body of messages and against the whole value of any
+// other field.
+func (e *evaluator) eventMatches(key, pattern string) bool {
+	value, ok := e.lookup(key)
+	if !ok {
+		return false
+	}
+	var re *regexp.Regexp
+	var err error
+	if key == "content.body" {
+		re, err = wordRegexp(globToRegexp(pattern))
+	} else {
+		re, err = regexp.Compile("(?i)^" + globToRegexp(pattern) + "$")
+	}
+	if err != nil {
+		return false
+	}
+	return re.MatchString(value)
+}
+
+// lookup returns the string value of the event field given as a
+// dot-separated path, e.g. "content.body".
+func (e *evaluator) lookup(key string) (string, bool) {
+	var value interface{} = e.fields
+	for _, part := range strings.Split(key, ".") {
+		obj, ok := value.(map[string]interface{})
+		if !ok {
+			return "", false
+		}
+		if value, ok = obj[part]; !ok {
+			return "", false
+		}
+	}
+	str, ok := value.(string)
+	return str, ok
+}
+
+func (e *evaluator) senderHasNotificationPermission(key string) (bool, error) {
+	var powerLevels gomatrixserverlib.PowerLevelContent
+	notificationLevel := int64(50)
+	if e.ctx.PowerLevels == nil {
+		powerLevels.Defaults()
+	} else {
+		var err error
+		if powerLevels, err = gomatrixserverlib.NewPowerLevelContentFromEvent(*e.ctx.PowerLevels); err != nil {
+			return false, err
+		}
+		var content struct {
+			Notifications map[string]interface{} `json:"notifications"`
+		}
+		if err = json.Unmarshal(e.ctx.PowerLevels.Content(), &content); err != nil {
+			return false, err
+		}
+		if level, ok := parseLevel(content.Notifications[key]); ok {
+			notificationLevel = level
+		}
+	}
+	return powerLevels.UserLevel(e.event.Sender()) >= notificationLevel, nil
+}
+
+// parseLevel parses a power level, which may be given as a number or as a
+// string for historical reasons.
+func parseLevel(value interface{}) (int64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return int64(v), true
+	case string:
+		level, err := strconv.ParseInt(v, 10, 64)
+		return level, err == nil
+	}
+	return 0, false
+}
+
+// memberCountMatches implements the room_member_count condition, where "is"
+// is a number optionally prefixed by one of ==, <, >, >= or <=.
+func memberCountMatches(is string, count int) bool {
+	op := "=="
+	for _, prefix := range []string{"==", "<=", ">=", "<", ">"} {
+		if strings.HasPrefix(is, prefix) {
+			op = prefix
+			is = is[len(prefix):]
+			break
+		}
+	}
+	n, err := strconv.Atoi(is)
+	if err != nil {
+		return false
+	}
+	switch op {
+	case "<":
+		return count < n
+	case ">":
+		return count > n
+	case "<=":
+		return count <= n
+	case ">=":
+		return count >= n
+	}
+	return count == n
+}
+
+// wordRegexp returns a case-insensitive regexp that matches the expression
+// only at word boundaries.
+func wordRegexp(expr string) (*regexp.Regexp, error) {
+	return regexp.Compile(`(?i)(^|\W)` + expr + `(\W|$)`)
+}
+
+// globToRegexp converts a glob pattern, where * matches any number of
+// characters, ? matches a single character and [...] matches a character
+// class, into a regular expression.
+func globToRegexp(glob string) string {
+	var sb strings.Builder
+	runes := []rune(glob)
+	for i := 0; i < len(runes); i++ {
+		switch c := runes[i]; c {
+		case '*':
+			sb.WriteString(".*?")
+		case '?':
+			sb.WriteString(".")
+		case '[':
+			end := indexRune(runes[i+1:], ']')
+			if end < 0 {
+				sb.WriteString(`\[`)
+				continue
+			}
+			class := string(runes[i+1 : i+1+end])
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			sb.WriteString("[" + strings.Replace(class, `\`, `\\`, -1) + "]")
+			i += end + 1
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	return sb.String()
+}
+
+func indexRune(runes []rune, r rune) int {
+	for i, c := range runes {
+		if c == r {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,138 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pushrules
+
+import (
+	"testing"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+func mustEvent(t *testing.T, eventJSON string) *gomatrixserverlib.Event {
+	event, err := gomatrixserverlib.NewEventFromTrustedJSON([]byte(eventJSON), false, gomatrixserverlib.RoomVersionV1)
+	if err != nil {
+		t.Fatalf("failed to create event: %s", err)
+	}
+	return &event
+}
+
+func TestEvaluateDefaultRules(t *testing.T) {
+	ruleSets := DefaultAccountRuleSets("alice", "localhost")
+	tests := []struct {
+		name          string
+		eventJSON     string
+		ctx           EvaluationContext
+		wantNotify    bool
+		wantHighlight bool
+	}{
+		{
+			name:       "message in a group room",
+			eventJSON:  `{"type":"m.room.message","room_id":"!r:localhost","sender":"@bob:localhost","event_id":"$1:localhost","content":{"msgtype":"m.text","body":"hello"}}`,
+			ctx:        EvaluationContext{RoomMemberCount: 5},
+			wantNotify: true,
+		},
+		{
+			name:      "notice",
+			eventJSON: `{"type":"m.room.message","room_id":"!r:localhost","sender":"@bob:localhost","event_id":"$1:localhost","content":{"msgtype":"m.notice","body":"alice"}}`,
+			ctx:       EvaluationContext{RoomMemberCount: 5},
+		},
+		{
+			name:          "user name mentioned",
+			eventJSON:     `{"type":"m.room.message","room_id":"!r:localhost","sender":"@bob:localhost","event_id":"$1:localhost","content":{"msgtype":"m.text","body":"hi ALICE!"}}`,
+			ctx:           EvaluationContext{RoomMemberCount: 5},
+			wantNotify:    true,
+			wantHighlight: true,
+		},
+		{
+			name:       "user name as part of a word",
+			eventJSON:  `{"type":"m.room.message","room_id":"!r:localhost","sender":"@bob:localhost","event_id":"$1:localhost","content":{"msgtype":"m.text","body":"malice"}}`,
+			ctx:        EvaluationContext{RoomMemberCount: 5},
+			wantNotify: true,
+		},
+		{
+			name:          "display name mentioned",
+			eventJSON:     `{"type":"m.room.message","room_id":"!r:localhost","sender":"@bob:localhost","event_id":"$1:localhost","content":{"msgtype":"m.text","body":"ping Wonder Land"}}`,
+			ctx:           EvaluationContext{RoomMemberCount: 5, UserDisplayName: "Wonder Land"},
+			wantNotify:    true,
+			wantHighlight: true,
+		},
+		{
+			name:       "@room without permission",
+			eventJSON:  `{"type":"m.room.message","room_id":"!r:localhost","sender":"@bob:localhost","event_id":"$1:localhost","content":{"msgtype":"m.text","body":"@room"}}`,
+			ctx:        EvaluationContext{RoomMemberCount: 5},
+			wantNotify: true,
+		},
+		{
+			name:      "@room with permission",
+			eventJSON: `{"type":"m.room.message","room_id":"!r:localhost","sender":"@bob:localhost","event_id":"$1:localhost","content":{"msgtype":"m.text","body":"@room"}}`,
+			ctx: EvaluationContext{
+				RoomMemberCount: 5,
+				PowerLevels:     mustEvent(t, `{"type":"m.room.power_levels","state_key":"","room_id":"!r:localhost","sender":"@bob:localhost","event_id":"$0:localhost","content":{"users":{"@bob:localhost":50}}}`),
+			},
+			wantNotify:    true,
+			wantHighlight: true,
+		},
+		{
+			name:       "invite for the user",
+			eventJSON:  `{"type":"m.room.member","state_key":"@alice:localhost","room_id":"!r:localhost","sender":"@bob:localhost","event_id":"$1:localhost","content":{"membership":"invite"}}`,
+			ctx:        EvaluationContext{RoomMemberCount: 1},
+			wantNotify: true,
+		},
+		{
+			name:      "other member event",
+			eventJSON: `{"type":"m.room.member","state_key":"@carol:localhost","room_id":"!r:localhost","sender":"@carol:localhost","event_id":"$1:localhost","content":{"membership":"join"}}`,
+			ctx:       EvaluationContext{RoomMemberCount: 3},
+		},
+		{
+			name:      "unknown event type",
+			eventJSON: `{"type":"org.example.custom","room_id":"!r:localhost","sender":"@bob:localhost","event_id":"$1:localhost","content":{}}`,
+			ctx:       EvaluationContext{RoomMemberCount: 2},
+		},
+	}
+	for _, tt := range tests {
+		actions, err := ruleSets.Global.Evaluate(mustEvent(t, tt.eventJSON), &tt.ctx)
+		if err != nil {
+			t.Fatalf("%s: Evaluate failed: %s", tt.name, err)
+		}
+		if got := ShouldNotify(actions); got != tt.wantNotify {
+			t.Errorf("%s: ShouldNotify = %v, want %v", tt.name, got, tt.wantNotify)
+		}
+		if got := ShouldHighlight(actions); got != tt.wantHighlight {
+			t.Errorf("%s: ShouldHighlight = %v, want %v", tt.name, got, tt.wantHighlight)
+		}
+	}
+}
+
+func TestGlobToRegexp(t *testing.T) {
+	tests := []struct {
+		glob  string
+		value string
+		want  bool
+	}{
+		{"cake*lie", "cakeisalie", true},
+		{"cake*lie", "cakeisalies", false},
+		{"c?ke", "cake", true},
+		{"[bc]ake", "bake", true},
+		{"[!bc]ake", "bake", false},
+		{"m.room.*", "m.room.message", true},
+		{"m.room.*", "m_room_message", false},
+	}
+	for _, tt := range tests {
+		e := evaluator{fields: map[string]interface{}{"type": tt.value}}
+		if got := e.eventMatches("type", tt.glob); got != tt.want {
+			t.Errorf("eventMatches(%q, %q) = %v, want %v", tt.glob, tt.value, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,209 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package pushrules implements the push rules described in
+// https://matrix.org/docs/spec/client_server/r0.6.0#push-rules
+package pushrules
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// AccountDataType is the type of the account data under which the push rules
+// of a user are stored.
+const AccountDataType = "m.push_rules"
+
+// The kinds of push rules, in the order in which they are evaluated.
+const (
+	OverrideKind  = "override"
+	ContentKind   = "content"
+	RoomKind      = "room"
+	SenderKind    = "sender"
+	UnderrideKind = "underride"
+)
+
+// Kinds lists the kinds of push rules in the order in which they are evaluated.
+var Kinds = []string{OverrideKind, ContentKind, RoomKind, SenderKind, UnderrideKind}
+
+// AccountRuleSets is the content of the m.push_rules account data.
+type AccountRuleSets struct {
+	Global RuleSet `json:"global"`
+}
+
+// RuleSet holds the push rules of each kind.
+type RuleSet struct {
+	Override  []*Rule `json:"override"`
+	Content   []*Rule `json:"content"`
+	Room      []*Rule `json:"room"`
+	Sender    []*Rule `json:"sender"`
+	Underride []*Rule `json:"underride"`
+}
+
+// RulesOfKind returns a pointer to the list of rules of the given kind, or nil
+// if the kind isn't known.
+func (s *RuleSet) RulesOfKind(kind string) *[]*Rule {
+	switch kind {
+	case OverrideKind:
+		return &s.Override
+	case ContentKind:
+		return &s.Content
+	case RoomKind:
+		return &s.Room
+	case SenderKind:
+		return &s.Sender
+	case UnderrideKind:
+		return &s.Underride
+	}
+	return nil
+}
+
+// Rule is a single push rule.
+type Rule struct {
+	RuleID  string   `json:"rule_id"`
+	Default bool     `json:"default"`
+	Enabled bool     `json:"enabled"`
+	Actions []Action `json:"actions"`
+	// Conditions are only used by override and underride rules.
+	Conditions []Condition `json:"conditions,omitempty"`
+	// Pattern is only used by content rules.
+	Pattern string `json:"pattern,omitempty"`
+}
+
+// The kinds of conditions.
+const (
+	EventMatchCondition                   = "event_match"
+	ContainsDisplayNameCondition          = "contains_display_name"
+	RoomMemberCountCondition              = "room_member_count"
+	SenderNotificationPermissionCondition = "sender_notification_permission"
+)
+
+// Condition is a condition that an event must meet for an override or
+// underride rule to apply.
+type Condition struct {
+	Kind string `json:"kind"`
+	// Key is the dot-separated path of the event field for event_match, or
+	// the notification level for sender_notification_permission.
+	Key string `json:"key,omitempty"`
+	// Pattern is the glob pattern for event_match.
+	Pattern string `json:"pattern,omitempty"`
+	// Is is the member count comparison for room_member_count, e.g. "2" or
+	// ">=10".
+	Is string `json:"is,omitempty"`
+}
+
+// The kinds of actions.
+const (
+	NotifyAction     = "notify"
+	DontNotifyAction = "dont_notify"
+	CoalesceAction   = "coalesce"
+	SetTweakAction   = "set_tweak"
+)
+
+// The tweaks that are defined by the spec.
+const (
+	SoundTweak     = "sound"
+	HighlightTweak = "highlight"
+)
+
+// Action is something that should happen when a rule matches. Simple actions
+// are encoded as a string in JSON, and tweaks as an object.
+type Action struct {
+	Kind string
+	// Tweak and Value are only used by set_tweak actions.
+	Tweak string
+	Value interface{}
+}
+
+// MarshalJSON implements json.Marshaller
+func (a Action) MarshalJSON() ([]byte, error) {
+	if a.Kind != SetTweakAction {
+		return json.Marshal(a.Kind)
+	}
+	tweak := map[string]interface{}{SetTweakAction: a.Tweak}
+	if a.Value != nil {
+		tweak["value"] = a.Value
+	}
+	return json.Marshal(tweak)
+}
+
+// UnmarshalJSON implements json.Unmarshaller
+func (a *Action) UnmarshalJSON(data []byte) error {
+	var kind string
+	if err := json.Unmarshal(data, &kind); err == nil {
+		*a = Action{Kind: kind}
+		return nil
+	}
+	var tweak struct {
+		SetTweak *string     `json:"set_tweak"`
+		Value    interface{} `json:"value"`
+	}
+	if err := json.Unmarshal(data, &tweak); err != nil {
+		return err
+	}
+	if tweak.SetTweak == nil {
+		return fmt.Errorf("pushrules: action %s is neither a string nor a tweak", string(data))
+	}
+	*a = Action{Kind: SetTweakAction, Tweak: *tweak.SetTweak, Value: tweak.Value}
+	return nil
+}
+
+// ShouldNotify returns whether the actions contain a notify action.
+func ShouldNotify(actions []Action) bool {
+	for _, a := range actions {
+		if a.Kind == NotifyAction {
+			return true
+		}
+	}
+	return false
+}
+
+// ShouldHighlight returns whether the actions set the highlight tweak. A
+// highlight tweak without a value means that the event is highlighted.
+func ShouldHighlight(actions []Action) bool {
+	for _, a := range actions {
+		if a.Kind == SetTweakAction && a.Tweak == HighlightTweak {
+			highlight, ok := a.Value.(bool)
+			return !ok || highlight
+		}
+	}
+	return false
+}
+
+// FromAccountData parses the push rules that are stored in the account data
+// of a user. The default rules are returned if the user has no rules stored
+// yet, or only the empty rule set that accounts used to be created with.
+func FromAccountData(
+	data *gomatrixserverlib.ClientEvent, localpart string, serverName gomatrixserverlib.ServerName,
+) (*AccountRuleSets, error) {
+	if data == nil {
+		return DefaultAccountRuleSets(localpart, serverName), nil
+	}
+	var ruleSets AccountRuleSets
+	if err := json.Unmarshal(data.Content, &ruleSets); err != nil {
+		return nil, err
+	}
+	empty := true
+	for _, kind := range Kinds {
+		if len(*ruleSets.Global.RulesOfKind(kind)) > 0 {
+			empty = false
+		}
+	}
+	if empty {
+		return DefaultAccountRuleSets(localpart, serverName), nil
+	}
+	return &ruleSets, nil
+}
@@ -26,9 +26,13 @@ type txnsMap map[CacheKey]*util.JSONResponse
 
 // CacheKey is the type for the key in a transactions cache.
 // This is needed because the spec requires transaction IDs to have a per-access token scope.
+// Transaction IDs are also scoped to the endpoint that they were used on, so that
+// the same transaction ID can be used on /send and /sendToDevice without one
+// returning the cached response of the other.
 type CacheKey struct {
 	AccessToken string
 	TxnID       string
+	Endpoint    string
 }
 
 // Cache represents a temporary store for response entries.
@@ -57,14 +61,14 @@ func NewWithCleanupPeriod(cleanupPeriod time.Duration) *Cache {
 	return &t
 }
 
-// FetchTransaction looks up an entry for the (accessToken, txnID) tuple in Cache.
+// FetchTransaction looks up an entry for the (accessToken, txnID, endpoint) tuple in Cache.
 // Looks in both the txnMaps.
 // Returns (JSON response, true) if txnID is found, else the returned bool is false.
-func (t *Cache) FetchTransaction(accessToken, txnID string) (*util.JSONResponse, bool) {
+func (t *Cache) FetchTransaction(accessToken, txnID, endpoint string) (*util.JSONResponse, bool) {
 	t.RLock()
 	defer t.RUnlock()
 	for _, txns := range t.txnsMaps {
-		res, ok := txns[CacheKey{accessToken, txnID}]
+		res, ok := txns[CacheKey{accessToken, txnID, endpoint}]
 		if ok {
 			return res, true
 		}
@@ -72,13 +76,13 @@ func (t *Cache) FetchTransaction(accessToken, txnID string) (*util.JSONResponse,
 	return nil, false
 }
 
-// AddTransaction adds an entry for the (accessToken, txnID) tuple in Cache.
+// AddTransaction adds an entry for the (accessToken, txnID, endpoint) tuple in Cache.
 // Adds to the front txnMap.
-func (t *Cache) AddTransaction(accessToken, txnID string, res *util.JSONResponse) {
+func (t *Cache) AddTransaction(accessToken, txnID, endpoint string, res *util.JSONResponse) {
 	t.Lock()
 	defer t.Unlock()
 
-	t.txnsMaps[0][CacheKey{accessToken, txnID}] = res
+	t.txnsMaps[0][CacheKey{accessToken, txnID, endpoint}] = res
 }
 
 // cacheCleanService is responsible for cleaning up entries after cleanupPeriod.
@@ -27,6 +27,8 @@ var (
 	fakeAccessToken  = "aRandomAccessToken"
 	fakeAccessToken2 = "anotherRandomAccessToken"
 	fakeTxnID        = "aRandomTxnID"
+	fakeEndpoint     = "/_matrix/client/r0/rooms/!room:test/send/m.room.message/aRandomTxnID"
+	fakeEndpoint2    = "/_matrix/client/r0/sendToDevice/m.room_key_request/aRandomTxnID"
 	fakeResponse     = &util.JSONResponse{
 		Code: http.StatusOK, JSON: fakeType{ID: "0"},
 	}
@@ -38,18 +40,19 @@ var (
 // TestCache creates a New Cache and tests AddTransaction & FetchTransaction
 func TestCache(t *testing.T) {
 	fakeTxnCache := New()
-	fakeTxnCache.AddTransaction(fakeAccessToken, fakeTxnID, fakeResponse)
+	fakeTxnCache.AddTransaction(fakeAccessToken, fakeTxnID, fakeEndpoint, fakeResponse)
 
 	// Add entries for noise.
 	for i := 1; i <= 100; i++ {
 		fakeTxnCache.AddTransaction(
 			fakeAccessToken,
 			fakeTxnID+string(i),
+			fakeEndpoint,
 			&util.JSONResponse{Code: http.StatusOK, JSON: fakeType{ID: string(i)}},
 		)
 	}
 
-	testResponse, ok := fakeTxnCache.FetchTransaction(fakeAccessToken, fakeTxnID)
+	testResponse, ok := fakeTxnCache.FetchTransaction(fakeAccessToken, fakeTxnID, fakeEndpoint)
 	if !ok {
 		t.Error("Failed to retrieve entry for txnID: ", fakeTxnID)
 	} else if testResponse.JSON != fakeResponse.JSON {
@@ -61,17 +64,35 @@ func TestCache(t *testing.T) {
 // across multiple access tokens.
 func TestCacheScope(t *testing.T) {
 	cache := New()
-	cache.AddTransaction(fakeAccessToken, fakeTxnID, fakeResponse)
-	cache.AddTransaction(fakeAccessToken2, fakeTxnID, fakeResponse2)
+	cache.AddTransaction(fakeAccessToken, fakeTxnID, fakeEndpoint, fakeResponse)
+	cache.AddTransaction(fakeAccessToken2, fakeTxnID, fakeEndpoint, fakeResponse2)
 
-	if res, ok := cache.FetchTransaction(fakeAccessToken, fakeTxnID); !ok {
+	if res, ok := cache.FetchTransaction(fakeAccessToken, fakeTxnID, fakeEndpoint); !ok {
 		t.Errorf("failed to retrieve entry for (%s, %s)", fakeAccessToken, fakeTxnID)
 	} else if res.JSON != fakeResponse.JSON {
 		t.Errorf("Wrong cache entry for (%s, %s). Expected: %v; got: %v", fakeAccessToken, fakeTxnID, fakeResponse.JSON, res.JSON)
 	}
-	if res, ok := cache.FetchTransaction(fakeAccessToken2, fakeTxnID); !ok {
+	if res, ok := cache.FetchTransaction(fakeAccessToken2, fakeTxnID, fakeEndpoint); !ok {
 		t.Errorf("failed to retrieve entry for (%s, %s)", fakeAccessToken, fakeTxnID)
 	} else if res.JSON != fakeResponse2.JSON {
 		t.Errorf("Wrong cache entry for (%s, %s). Expected: %v; got: %v", fakeAccessToken, fakeTxnID, fakeResponse2.JSON, res.JSON)
 	}
 }
+
+// TestCacheEndpointScope ensures transactions with the same transaction ID are not
+// shared across multiple endpoints.
+func TestCacheEndpointScope(t *testing.T) {
+	cache := New()
+	cache.AddTransaction(fakeAccessToken, fakeTxnID, fakeEndpoint, fakeResponse)
+
+	if _, ok := cache.FetchTransaction(fakeAccessToken, fakeTxnID, fakeEndpoint2); ok {
+		t.Errorf("entry for (%s, %s) was returned for endpoint %s", fakeAccessToken, fakeTxnID, fakeEndpoint2)
+	}
+
+	cache.AddTransaction(fakeAccessToken, fakeTxnID, fakeEndpoint2, fakeResponse2)
+	if res, ok := cache.FetchTransaction(fakeAccessToken, fakeTxnID, fakeEndpoint); !ok {
+		t.Errorf("failed to retrieve entry for (%s, %s, %s)", fakeAccessToken, fakeTxnID, fakeEndpoint)
+	} else if res.JSON != fakeResponse.JSON {
+		t.Errorf("Wrong cache entry for (%s, %s, %s). Expected: %v; got: %v", fakeAccessToken, fakeTxnID, fakeEndpoint, fakeResponse.JSON, res.JSON)
+	}
+}
@@ -15,8 +15,11 @@
 package common
 
 import (
+	"encoding/json"
 	"errors"
 	"strconv"
+
+	"github.com/matrix-org/gomatrixserverlib"
 )
 
 // ErrProfileNoExists is returned when trying to lookup a user's profile that
@@ -30,6 +33,30 @@ type AccountData struct {
 	Type   string `json:"type"`
 }
 
+// SendToDevice represents a batch of send-to-device messages sent by a user,
+// either locally through the client API or remotely over federation. It is
+// consumed by the sync API, which delivers the messages to local devices, and
+// by the federation sender, which relays them to remote servers.
+type SendToDevice struct {
+	Sender    string `json:"sender"`
+	Type      string `json:"type"`
+	MessageID string `json:"message_id"`
+	// A map of user ID => device ID => message content. A device ID of "*"
+	// means all of the devices of the user.
+	Messages map[string]map[string]json.RawMessage `json:"messages"`
+}
+
+// Receipt represents a receipt that a user sent for an event in a room, either
+// locally through the client API or remotely over federation. It is consumed
+// by the sync API and the federation sender.
+type Receipt struct {
+	RoomID    string                      `json:"room_id"`
+	Type      string                      `json:"type"`
+	UserID    string                      `json:"user_id"`
+	EventID   string                      `json:"event_id"`
+	Timestamp gomatrixserverlib.Timestamp `json:"ts"`
+}
+
 // ProfileResponse is a struct containing all known user profile data
 type ProfileResponse struct {
 	AvatarURL   string `json:"avatar_url"`
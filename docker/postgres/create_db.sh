@@ -1,5 +1,5 @@
 #!/bin/bash
 
-for db in account device mediaapi syncapi roomserver serverkey federationsender publicroomsapi appservice naffka; do
+for db in account device mediaapi syncapi roomserver serverkey federationsender publicroomsapi appservice keyserver pushserver naffka; do
     createdb -U dendrite -O dendrite dendrite_$db
 done
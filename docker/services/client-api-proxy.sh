@@ -7,3 +7,5 @@ bash ./docker/build.sh
     --sync-api-server-url "http://sync_api:7773" \
     --media-api-server-url "http://media_api:7774" \
     --public-rooms-api-server-url "http://public_rooms_api:7775" \
+    --key-server-url "http://key_server:7778" \
+    --push-server-url "http://push_server:7780" \
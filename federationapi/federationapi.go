@@ -20,7 +20,10 @@ import (
 	"github.com/matrix-org/dendrite/clientapi/auth/storage/devices"
 	"github.com/matrix-org/dendrite/common/basecomponent"
 	federationSenderAPI "github.com/matrix-org/dendrite/federationsender/api"
+	keyServerAPI "github.com/matrix-org/dendrite/keyserver/api"
+	presenceServerAPI "github.com/matrix-org/dendrite/presenceserver/api"
 	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
+	typingServerAPI "github.com/matrix-org/dendrite/typingserver/api"
 
 	// TODO: Are we really wanting to pull in the producer from clientapi
 	"github.com/matrix-org/dendrite/clientapi/producers"
@@ -40,13 +43,35 @@ func SetupFederationAPIComponent(
 	inputAPI roomserverAPI.RoomserverInputAPI,
 	queryAPI roomserverAPI.RoomserverQueryAPI,
 	asAPI appserviceAPI.AppServiceQueryAPI,
+	federationSenderInputAPI federationSenderAPI.FederationSenderInputAPI,
 	federationSenderAPI federationSenderAPI.FederationSenderQueryAPI,
+	typingInputAPI typingServerAPI.TypingServerInputAPI,
+	presenceInputAPI presenceServerAPI.PresenceServerInputAPI,
+	keyInputAPI keyServerAPI.KeyServerInputAPI,
+	keyQueryAPI keyServerAPI.KeyServerQueryAPI,
 ) {
 	roomserverProducer := producers.NewRoomserverProducer(inputAPI, queryAPI)
+	typingProducer := producers.NewTypingServerProducer(typingInputAPI)
+	presenceProducer := producers.NewPresenceServerProducer(presenceInputAPI)
+	sendToDeviceProducer := &producers.SendToDeviceProducer{
+		Producer: base.KafkaProducer,
+		Topic:    string(base.Cfg.Kafka.Topics.OutputSendToDeviceEvent),
+	}
+	receiptProducer := &producers.ReceiptProducer{
+		Producer: base.KafkaProducer,
+		Topic:    string(base.Cfg.Kafka.Topics.OutputReceiptEvent),
+	}
+
+	eduHandlers := routing.NewEDUHandlers()
+	eduHandlers.Register(gomatrixserverlib.MTyping, routing.TypingEDUHandler(typingProducer, federationSenderAPI))
+	eduHandlers.Register("m.direct_to_device", routing.SendToDeviceEDUHandler(base.Cfg.Matrix.ServerName, sendToDeviceProducer))
+	eduHandlers.Register("m.receipt", routing.ReceiptEDUHandler(receiptProducer, federationSenderAPI))
+	eduHandlers.Register("m.presence", routing.PresenceEDUHandler(presenceProducer))
+	eduHandlers.Register("m.device_list_update", routing.DeviceListUpdateEDUHandler(keyInputAPI))
 
 	routing.Setup(
 		base.APIMux, base.Cfg, queryAPI, aliasAPI, asAPI,
-		roomserverProducer, federationSenderAPI, *keyRing,
-		federation, accountsDB, deviceDB,
+		roomserverProducer, federationSenderInputAPI, federationSenderAPI, *keyRing,
+		federation, accountsDB, deviceDB, keyInputAPI, keyQueryAPI, eduHandlers,
 	)
 }
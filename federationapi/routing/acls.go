@@ -0,0 +1,65 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	federationSenderAPI "github.com/matrix-org/dendrite/federationsender/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+// checkServerACL returns an error response if the server ACL of the room
+// denies the origin of a federation request.
+func checkServerACL(
+	ctx context.Context,
+	fsAPI federationSenderAPI.FederationSenderQueryAPI,
+	origin gomatrixserverlib.ServerName,
+	roomID string,
+) *util.JSONResponse {
+	banned, err := isServerBannedFromRoom(ctx, fsAPI, origin, roomID)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("fsAPI.QueryServerBannedFromRoom failed")
+		resErr := jsonerror.InternalServerError()
+		return &resErr
+	}
+	if banned {
+		return &util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("Server is banned from the room by its server ACL"),
+		}
+	}
+	return nil
+}
+
+func isServerBannedFromRoom(
+	ctx context.Context,
+	fsAPI federationSenderAPI.FederationSenderQueryAPI,
+	serverName gomatrixserverlib.ServerName,
+	roomID string,
+) (bool, error) {
+	req := federationSenderAPI.QueryServerBannedFromRoomRequest{
+		ServerName: serverName,
+		RoomID:     roomID,
+	}
+	var res federationSenderAPI.QueryServerBannedFromRoomResponse
+	if err := fsAPI.QueryServerBannedFromRoom(ctx, &req, &res); err != nil {
+		return false, err
+	}
+	return res.Banned, nil
+}
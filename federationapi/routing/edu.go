@@ -0,0 +1,338 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/producers"
+	federationSenderAPI "github.com/matrix-org/dendrite/federationsender/api"
+	keyServerAPI "github.com/matrix-org/dendrite/keyserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+	"github.com/sirupsen/logrus"
+)
+
+// Remote servers don't tell us how long a user will be typing for, so we
+// use the same timeout that synapse does.
+const remoteTypingTimeoutMS = 30 * 1000
+
+// An EDUHandler processes the EDUs of a single type that we receive over
+// federation.
+type EDUHandler struct {
+	// Senders returns the IDs of the users that the EDU claims to be from,
+	// so that they can be checked against the server that sent it.
+	Senders func(content []byte) ([]string, error)
+	// Process is called with the content of the EDU once its senders have
+	// been checked.
+	Process func(ctx context.Context, origin gomatrixserverlib.ServerName, content []byte) error
+}
+
+// EDUHandlers maps EDU types to the handlers that process them. New EDU types
+// are supported by registering a handler for them.
+type EDUHandlers struct {
+	handlers map[string]EDUHandler
+}
+
+// NewEDUHandlers makes an empty EDUHandlers.
+func NewEDUHandlers() *EDUHandlers {
+	return &EDUHandlers{
+		handlers: map[string]EDUHandler{},
+	}
+}
+
+// Register sets the handler for EDUs of the given type, replacing any handler
+// that was registered for it before.
+func (h *EDUHandlers) Register(eduType string, handler EDUHandler) {
+	h.handlers[eduType] = handler
+}
+
+// processEDU checks that the EDU was sent on behalf of users on the origin
+// server and then passes it to the handler for its type. EDUs of types that
+// have no handler are ignored.
+func (h *EDUHandlers) processEDU(
+	ctx context.Context, origin gomatrixserverlib.ServerName, edu gomatrixserverlib.EDU,
+) error {
+	handler, ok := h.handlers[edu.Type]
+	if !ok {
+		util.GetLogger(ctx).WithField("edu_type", edu.Type).Debug("Ignoring EDU of unknown type")
+		return nil
+	}
+	if edu.Origin != "" && gomatrixserverlib.ServerName(edu.Origin) != origin {
+		return fmt.Errorf("EDU origin %q does not match request origin %q", edu.Origin, origin)
+	}
+	senders, err := handler.Senders(edu.Content)
+	if err != nil {
+		return err
+	}
+	for _, sender := range senders {
+		_, domain, err := gomatrixserverlib.SplitID('@', sender)
+		if err != nil {
+			return err
+		}
+		if domain != origin {
+			return fmt.Errorf("EDU sender %q does not belong to origin %q", sender, origin)
+		}
+	}
+	return handler.Process(ctx, origin, edu.Content)
+}
+
+// processEDUs processes each of the EDUs in a transaction. EDUs are not
+// persistent and the spec gives us no way to report errors for them, so a
+// bad EDU is logged and skipped rather than failing the whole transaction.
+func (h *EDUHandlers) processEDUs(
+	ctx context.Context, origin gomatrixserverlib.ServerName, edus []gomatrixserverlib.EDU,
+) {
+	for _, edu := range edus {
+		if err := h.processEDU(ctx, origin, edu); err != nil {
+			util.GetLogger(ctx).WithError(err).WithFields(logrus.Fields{
+				"edu_type": edu.Type,
+				"origin":   origin,
+			}).Warn("Failed to process incoming federation EDU, skipping it.")
+		}
+	}
+}
+
+type typingEDUContent struct {
+	RoomID string `json:"room_id"`
+	UserID string `json:"user_id"`
+	Typing bool   `json:"typing"`
+}
+
+// TypingEDUHandler returns an EDUHandler that passes m.typing EDUs on to the
+// typing server, unless the server ACL of the room denies their origin.
+func TypingEDUHandler(
+	typingProducer *producers.TypingServerProducer,
+	fsAPI federationSenderAPI.FederationSenderQueryAPI,
+) EDUHandler {
+	return EDUHandler{
+		Senders: func(content []byte) ([]string, error) {
+			var typing typingEDUContent
+			if err := json.Unmarshal(content, &typing); err != nil {
+				return nil, err
+			}
+			return []string{typing.UserID}, nil
+		},
+		Process: func(ctx context.Context, origin gomatrixserverlib.ServerName, content []byte) error {
+			var typing typingEDUContent
+			if err := json.Unmarshal(content, &typing); err != nil {
+				return err
+			}
+			banned, err := isServerBannedFromRoom(ctx, fsAPI, origin, typing.RoomID)
+			if err != nil {
+				return err
+			}
+			if banned {
+				return fmt.Errorf("origin %q is banned from room %q by its server ACL", origin, typing.RoomID)
+			}
+			return typingProducer.Send(
+				ctx, typing.UserID, typing.RoomID, typing.Typing, remoteTypingTimeoutMS,
+			)
+		},
+	}
+}
+
+type directToDeviceEDUContent struct {
+	Sender    string                                `json:"sender"`
+	Type      string                                `json:"type"`
+	MessageID string                                `json:"message_id"`
+	Messages  map[string]map[string]json.RawMessage `json:"messages"`
+}
+
+// SendToDeviceEDUHandler returns an EDUHandler that passes the messages in
+// m.direct_to_device EDUs for users on this server on to the sync API.
+func SendToDeviceEDUHandler(
+	serverName gomatrixserverlib.ServerName,
+	sendToDeviceProducer *producers.SendToDeviceProducer,
+) EDUHandler {
+	return EDUHandler{
+		Senders: func(content []byte) ([]string, error) {
+			var directToDevice directToDeviceEDUContent
+			if err := json.Unmarshal(content, &directToDevice); err != nil {
+				return nil, err
+			}
+			return []string{directToDevice.Sender}, nil
+		},
+		Process: func(ctx context.Context, origin gomatrixserverlib.ServerName, content []byte) error {
+			var directToDevice directToDeviceEDUContent
+			if err := json.Unmarshal(content, &directToDevice); err != nil {
+				return err
+			}
+			messages := map[string]map[string]json.RawMessage{}
+			for userID, devices := range directToDevice.Messages {
+				if _, domain, err := gomatrixserverlib.SplitID('@', userID); err != nil || domain != serverName {
+					continue
+				}
+				messages[userID] = devices
+			}
+			if len(messages) == 0 {
+				return nil
+			}
+			return sendToDeviceProducer.SendToDevice(
+				directToDevice.Sender, directToDevice.Type, directToDevice.MessageID, messages,
+			)
+		},
+	}
+}
+
+type receiptEDUUserReceipt struct {
+	EventIDs []string `json:"event_ids"`
+	Data     struct {
+		Timestamp gomatrixserverlib.Timestamp `json:"ts"`
+	} `json:"data"`
+}
+
+// The content of an m.receipt EDU, a map of room ID => receipt type =>
+// user ID => receipt.
+type receiptEDUContent map[string]map[string]map[string]receiptEDUUserReceipt
+
+// ReceiptEDUHandler returns an EDUHandler that passes the receipts in m.receipt
+// EDUs on to the sync API. Receipts for rooms whose server ACL denies the
+// origin are dropped.
+func ReceiptEDUHandler(
+	receiptProducer *producers.ReceiptProducer,
+	fsAPI federationSenderAPI.FederationSenderQueryAPI,
+) EDUHandler {
+	return EDUHandler{
+		Senders: func(content []byte) ([]string, error) {
+			var receipts receiptEDUContent
+			if err := json.Unmarshal(content, &receipts); err != nil {
+				return nil, err
+			}
+			var userIDs []string
+			for _, byType := range receipts {
+				for _, byUser := range byType {
+					for userID := range byUser {
+						userIDs = append(userIDs, userID)
+					}
+				}
+			}
+			return userIDs, nil
+		},
+		Process: func(ctx context.Context, origin gomatrixserverlib.ServerName, content []byte) error {
+			var receipts receiptEDUContent
+			if err := json.Unmarshal(content, &receipts); err != nil {
+				return err
+			}
+			for roomID, byType := range receipts {
+				banned, err := isServerBannedFromRoom(ctx, fsAPI, origin, roomID)
+				if err != nil {
+					return err
+				}
+				if banned {
+					util.GetLogger(ctx).WithField("room_id", roomID).Warn("Dropping receipts from server banned by the room's server ACL")
+					continue
+				}
+				for receiptType, byUser := range byType {
+					for userID, receipt := range byUser {
+						for _, eventID := range receipt.EventIDs {
+							if err := receiptProducer.SendReceipt(
+								roomID, receiptType, userID, eventID, receipt.Data.Timestamp,
+							); err != nil {
+								return err
+							}
+						}
+					}
+				}
+			}
+			return nil
+		},
+	}
+}
+
+type presenceEDUUpdate struct {
+	UserID          string  `json:"user_id"`
+	Presence        string  `json:"presence"`
+	StatusMsg       *string `json:"status_msg"`
+	LastActiveAgo   int64   `json:"last_active_ago"`
+	CurrentlyActive bool    `json:"currently_active"`
+}
+
+type presenceEDUContent struct {
+	Push []presenceEDUUpdate `json:"push"`
+}
+
+// PresenceEDUHandler returns an EDUHandler that passes the presence updates in
+// m.presence EDUs on to the presence server.
+func PresenceEDUHandler(presenceProducer *producers.PresenceServerProducer) EDUHandler {
+	return EDUHandler{
+		Senders: func(content []byte) ([]string, error) {
+			var presence presenceEDUContent
+			if err := json.Unmarshal(content, &presence); err != nil {
+				return nil, err
+			}
+			userIDs := make([]string, 0, len(presence.Push))
+			for _, update := range presence.Push {
+				userIDs = append(userIDs, update.UserID)
+			}
+			return userIDs, nil
+		},
+		Process: func(ctx context.Context, origin gomatrixserverlib.ServerName, content []byte) error {
+			var presence presenceEDUContent
+			if err := json.Unmarshal(content, &presence); err != nil {
+				return err
+			}
+			now := time.Now()
+			for _, update := range presence.Push {
+				lastActive := now.Add(-time.Duration(update.LastActiveAgo) * time.Millisecond)
+				if err := presenceProducer.Send(
+					ctx, update.UserID, update.Presence, update.StatusMsg,
+					gomatrixserverlib.AsTimestamp(lastActive), update.CurrentlyActive,
+				); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	}
+}
+
+type deviceListUpdateEDUContent struct {
+	UserID   string          `json:"user_id"`
+	DeviceID string          `json:"device_id"`
+	Deleted  bool            `json:"deleted"`
+	Keys     json.RawMessage `json:"keys"`
+}
+
+// DeviceListUpdateEDUHandler returns an EDUHandler that passes the changes in
+// m.device_list_update EDUs on to the key server.
+func DeviceListUpdateEDUHandler(keyAPI keyServerAPI.KeyServerInputAPI) EDUHandler {
+	return EDUHandler{
+		Senders: func(content []byte) ([]string, error) {
+			var update deviceListUpdateEDUContent
+			if err := json.Unmarshal(content, &update); err != nil {
+				return nil, err
+			}
+			return []string{update.UserID}, nil
+		},
+		Process: func(ctx context.Context, origin gomatrixserverlib.ServerName, content []byte) error {
+			var update deviceListUpdateEDUContent
+			if err := json.Unmarshal(content, &update); err != nil {
+				return err
+			}
+			request := keyServerAPI.InputDeviceListUpdateRequest{
+				UserID:   update.UserID,
+				DeviceID: update.DeviceID,
+				Keys:     update.Keys,
+				Deleted:  update.Deleted,
+			}
+			var response keyServerAPI.InputDeviceListUpdateResponse
+			return keyAPI.InputDeviceListUpdate(ctx, &request, &response)
+		},
+	}
+}
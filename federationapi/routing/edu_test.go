@@ -0,0 +1,185 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/matrix-org/dendrite/clientapi/producers"
+	federationSenderAPI "github.com/matrix-org/dendrite/federationsender/api"
+	keyServerAPI "github.com/matrix-org/dendrite/keyserver/api"
+	typingServerAPI "github.com/matrix-org/dendrite/typingserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	sarama "gopkg.in/Shopify/sarama.v1"
+)
+
+func TestProcessEDUChecksSender(t *testing.T) {
+	var processed []string
+	handlers := NewEDUHandlers()
+	handlers.Register("m.test", EDUHandler{
+		Senders: func(content []byte) ([]string, error) {
+			var c struct {
+				UserID string `json:"user_id"`
+			}
+			err := json.Unmarshal(content, &c)
+			return []string{c.UserID}, err
+		},
+		Process: func(ctx context.Context, origin gomatrixserverlib.ServerName, content []byte) error {
+			processed = append(processed, string(content))
+			return nil
+		},
+	})
+
+	tests := []struct {
+		edu     gomatrixserverlib.EDU
+		wantErr bool
+	}{
+		{gomatrixserverlib.EDU{Type: "m.test", Content: []byte(`{"user_id":"@alice:origin"}`)}, false},
+		{gomatrixserverlib.EDU{Type: "m.test", Content: []byte(`{"user_id":"@mallory:elsewhere"}`)}, true},
+		{gomatrixserverlib.EDU{Type: "m.test", Origin: "elsewhere", Content: []byte(`{"user_id":"@alice:origin"}`)}, true},
+		{gomatrixserverlib.EDU{Type: "m.test", Content: []byte(`{"user_id":"not a user ID"}`)}, true},
+		{gomatrixserverlib.EDU{Type: "m.unknown", Content: []byte(`{}`)}, false},
+	}
+	for _, tt := range tests {
+		err := handlers.processEDU(context.Background(), "origin", tt.edu)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("processEDU(%s): got error %v, want error %v", tt.edu.Content, err, tt.wantErr)
+		}
+	}
+	if len(processed) != 1 {
+		t.Errorf("expected exactly one EDU to be processed, got %v", processed)
+	}
+}
+
+// aclFederationSenderAPI bans every server from !banned:localhost.
+type aclFederationSenderAPI struct {
+	federationSenderAPI.FederationSenderQueryAPI
+}
+
+func (f *aclFederationSenderAPI) QueryServerBannedFromRoom(
+	ctx context.Context,
+	request *federationSenderAPI.QueryServerBannedFromRoomRequest,
+	response *federationSenderAPI.QueryServerBannedFromRoomResponse,
+) error {
+	response.Banned = request.RoomID == "!banned:localhost"
+	return nil
+}
+
+type fakeTypingServerInputAPI struct {
+	rooms []string
+}
+
+func (f *fakeTypingServerInputAPI) InputTypingEvent(
+	ctx context.Context,
+	request *typingServerAPI.InputTypingEventRequest,
+	response *typingServerAPI.InputTypingEventResponse,
+) error {
+	f.rooms = append(f.rooms, request.InputTypingEvent.RoomID)
+	return nil
+}
+
+type fakeSyncProducer struct {
+	sarama.SyncProducer
+	keys []string
+}
+
+func (f *fakeSyncProducer) SendMessage(msg *sarama.ProducerMessage) (int32, int64, error) {
+	key, err := msg.Key.Encode()
+	f.keys = append(f.keys, string(key))
+	return 0, 0, err
+}
+
+func TestTypingEDUHandlerChecksServerACL(t *testing.T) {
+	typingAPI := &fakeTypingServerInputAPI{}
+	handlers := NewEDUHandlers()
+	handlers.Register(gomatrixserverlib.MTyping, TypingEDUHandler(
+		producers.NewTypingServerProducer(typingAPI), &aclFederationSenderAPI{},
+	))
+
+	for _, roomID := range []string{"!room:localhost", "!banned:localhost"} {
+		edu := gomatrixserverlib.EDU{
+			Type:    gomatrixserverlib.MTyping,
+			Content: []byte(`{"room_id":"` + roomID + `","user_id":"@alice:origin","typing":true}`),
+		}
+		err := handlers.processEDU(context.Background(), "origin", edu)
+		if wantErr := roomID == "!banned:localhost"; (err != nil) != wantErr {
+			t.Errorf("processEDU(%s): got error %v, want error %v", edu.Content, err, wantErr)
+		}
+	}
+	if len(typingAPI.rooms) != 1 || typingAPI.rooms[0] != "!room:localhost" {
+		t.Errorf("got typing notifications for %v, want only !room:localhost", typingAPI.rooms)
+	}
+}
+
+func TestReceiptEDUHandlerChecksServerACL(t *testing.T) {
+	syncProducer := &fakeSyncProducer{}
+	handlers := NewEDUHandlers()
+	handlers.Register("m.receipt", ReceiptEDUHandler(
+		&producers.ReceiptProducer{Producer: syncProducer}, &aclFederationSenderAPI{},
+	))
+
+	receipt := `{"m.read":{"@alice:origin":{"event_ids":["$event:origin"],"data":{"ts":1}}}}`
+	edu := gomatrixserverlib.EDU{
+		Type:    "m.receipt",
+		Content: []byte(`{"!room:localhost":` + receipt + `,"!banned:localhost":` + receipt + `}`),
+	}
+	if err := handlers.processEDU(context.Background(), "origin", edu); err != nil {
+		t.Fatal(err)
+	}
+	if len(syncProducer.keys) != 1 || syncProducer.keys[0] != "!room:localhost" {
+		t.Errorf("got receipts for %v, want only !room:localhost", syncProducer.keys)
+	}
+}
+
+type fakeKeyServerInputAPI struct {
+	keyServerAPI.KeyServerInputAPI
+	updates []keyServerAPI.InputDeviceListUpdateRequest
+}
+
+func (f *fakeKeyServerInputAPI) InputDeviceListUpdate(
+	ctx context.Context,
+	request *keyServerAPI.InputDeviceListUpdateRequest,
+	response *keyServerAPI.InputDeviceListUpdateResponse,
+) error {
+	f.updates = append(f.updates, *request)
+	return nil
+}
+
+func TestDeviceListUpdateEDUHandler(t *testing.T) {
+	keyAPI := &fakeKeyServerInputAPI{}
+	handlers := NewEDUHandlers()
+	handlers.Register("m.device_list_update", DeviceListUpdateEDUHandler(keyAPI))
+
+	for _, userID := range []string{"@alice:origin", "@mallory:elsewhere"} {
+		edu := gomatrixserverlib.EDU{
+			Type: "m.device_list_update",
+			Content: []byte(`{"user_id":"` + userID + `","device_id":"DEVICE","stream_id":6,` +
+				`"prev_id":[5],"deleted":false,"keys":{"device_id":"DEVICE"}}`),
+		}
+		err := handlers.processEDU(context.Background(), "origin", edu)
+		if wantErr := userID != "@alice:origin"; (err != nil) != wantErr {
+			t.Errorf("processEDU(%s): got error %v, want error %v", edu.Content, err, wantErr)
+		}
+	}
+	if len(keyAPI.updates) != 1 {
+		t.Fatalf("got %d device list updates, want 1", len(keyAPI.updates))
+	}
+	update := keyAPI.updates[0]
+	if update.UserID != "@alice:origin" || update.DeviceID != "DEVICE" || string(update.Keys) != `{"device_id":"DEVICE"}` {
+		t.Errorf("got device list update %+v, want the update for @alice:origin's DEVICE", update)
+	}
+}
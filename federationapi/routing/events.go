@@ -18,6 +18,7 @@ import (
 	"context"
 	"net/http"
 
+	federationSenderAPI "github.com/matrix-org/dendrite/federationsender/api"
 	"github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
@@ -28,12 +29,16 @@ func GetEvent(
 	ctx context.Context,
 	request *gomatrixserverlib.FederationRequest,
 	query api.RoomserverQueryAPI,
+	federationSenderAPI federationSenderAPI.FederationSenderQueryAPI,
 	eventID string,
 ) util.JSONResponse {
 	event, err := getEvent(ctx, request, query, eventID)
 	if err != nil {
 		return *err
 	}
+	if err = checkServerACL(ctx, federationSenderAPI, request.Origin(), event.RoomID()); err != nil {
+		return *err
+	}
 
 	return util.JSONResponse{Code: http.StatusOK, JSON: event}
 }
@@ -0,0 +1,232 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/common/keydb"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+const (
+	// The maximum number of events that we will ask for with
+	// /get_missing_events. Larger gaps are handled by fetching the state.
+	maxMissingEvents = 20
+	// How far back in depth from the event we will look for missing events.
+	maxMissingEventsDepth = 20
+	// The maximum number of state events that we will fetch individually
+	// with /event after calling /state_ids. If we are missing more than
+	// this then we fetch the whole state with /state instead.
+	maxStateEventsToFetch = 50
+)
+
+type getMissingEventsResponse struct {
+	Events []json.RawMessage `json:"events"`
+}
+
+// fillGap asks the origin server for the events between the latest events we
+// know about in the room and the event e, using /get_missing_events, and
+// passes the ones it returns to the roomserver in order. It returns true if
+// all of the prev_events of e are known afterwards.
+func (t *txnReq) fillGap(
+	e gomatrixserverlib.Event, roomVersion gomatrixserverlib.RoomVersion,
+) (bool, error) {
+	latestReq := api.QueryLatestEventsAndStateRequest{RoomID: e.RoomID()}
+	var latestRes api.QueryLatestEventsAndStateResponse
+	if err := t.query.QueryLatestEventsAndState(t.context, &latestReq, &latestRes); err != nil {
+		return false, err
+	}
+	earliestEvents := make([]string, len(latestRes.LatestEvents))
+	for i := range latestRes.LatestEvents {
+		earliestEvents[i] = latestRes.LatestEvents[i].EventID
+	}
+
+	minDepth := e.Depth() - maxMissingEventsDepth
+	if minDepth < 0 {
+		minDepth = 0
+	}
+	request := gomatrixserverlib.NewFederationRequest(
+		http.MethodPost, t.Origin,
+		"/_matrix/federation/v1/get_missing_events/"+url.PathEscape(e.RoomID()),
+	)
+	if err := request.SetContent(getMissingEventRequest{
+		Limit:          maxMissingEvents,
+		MinDepth:       minDepth,
+		EarliestEvents: earliestEvents,
+		LatestEvents:   []string{e.EventID()},
+	}); err != nil {
+		return false, err
+	}
+	var response getMissingEventsResponse
+	if err := common.DoFederationRequest(t.context, t.cfg, t.federation, request, &response); err != nil {
+		return false, err
+	}
+
+	missing := make([]gomatrixserverlib.Event, 0, len(response.Events))
+	for _, raw := range response.Events {
+		event, err := gomatrixserverlib.NewEventFromUntrustedJSON(raw, roomVersion)
+		if err != nil {
+			return false, err
+		}
+		if event.RoomID() != e.RoomID() {
+			return false, fmt.Errorf("missing event %q is not in room %q", event.EventID(), e.RoomID())
+		}
+		missing = append(missing, event)
+	}
+	if err := gomatrixserverlib.VerifyAllEventSignatures(
+		t.context, missing, keydb.KeyRingForRoomVersion(t.keys, roomVersion),
+	); err != nil {
+		return false, err
+	}
+
+	// Process the events from the oldest to the newest so that the
+	// prev_events of each one are known before it is processed. We don't
+	// try to fill in any gaps before these events: the prev_events that we
+	// are missing for the earliest ones are fetched with their state instead.
+	sort.SliceStable(missing, func(i, j int) bool {
+		return missing[i].Depth() < missing[j].Depth()
+	})
+	for _, event := range missing {
+		if err := t.processEvent(event, false); err != nil {
+			util.GetLogger(t.context).WithError(err).WithField("event_id", event.EventID()).Warn(
+				"Failed to process event returned by /get_missing_events",
+			)
+		}
+	}
+
+	stateReq := api.QueryStateAfterEventsRequest{
+		RoomID:       e.RoomID(),
+		PrevEventIDs: e.PrevEventIDs(),
+	}
+	var stateRes api.QueryStateAfterEventsResponse
+	if err := t.query.QueryStateAfterEvents(t.context, &stateReq, &stateRes); err != nil {
+		return false, err
+	}
+	return stateRes.PrevEventsExist, nil
+}
+
+// lookupState fetches the state of the room before the given event from the
+// origin server. It asks for the IDs of the state events with /state_ids and
+// then only fetches the events that the roomserver doesn't already have. If
+// that fails, or if there are too many events to fetch individually, then it
+// falls back to fetching the entire state with /state.
+func (t *txnReq) lookupState(
+	roomID, eventID string, roomVersion gomatrixserverlib.RoomVersion,
+) (*gomatrixserverlib.RespState, error) {
+	state, err := t.lookupStateIDs(roomID, eventID, roomVersion)
+	if err != nil {
+		util.GetLogger(t.context).WithError(err).WithField("event_id", eventID).Warn(
+			"Failed to fetch state using /state_ids, falling back to /state",
+		)
+	}
+	if state != nil {
+		return state, nil
+	}
+	respState, err := t.federation.LookupState(t.context, t.Origin, roomID, eventID, roomVersion)
+	if err != nil {
+		return nil, err
+	}
+	return &respState, nil
+}
+
+// lookupStateIDs fetches the state before an event using /state_ids and
+// /event. It returns nil with no error if there are too many events missing
+// to fetch them individually.
+func (t *txnReq) lookupStateIDs(
+	roomID, eventID string, roomVersion gomatrixserverlib.RoomVersion,
+) (*gomatrixserverlib.RespState, error) {
+	stateIDs, err := t.federation.LookupStateIDs(t.context, t.Origin, roomID, eventID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Work out which of the events we already have.
+	wantIDs := append(append([]string{}, stateIDs.StateEventIDs...), stateIDs.AuthEventIDs...)
+	queryReq := api.QueryEventsByIDRequest{EventIDs: wantIDs}
+	var queryRes api.QueryEventsByIDResponse
+	if err = t.query.QueryEventsByID(t.context, &queryReq, &queryRes); err != nil {
+		return nil, err
+	}
+	events := make(map[string]gomatrixserverlib.Event, len(wantIDs))
+	for _, event := range queryRes.Events {
+		events[event.EventID()] = event.Unwrap()
+	}
+
+	var missingIDs []string
+	for _, id := range wantIDs {
+		if _, ok := events[id]; !ok {
+			missingIDs = append(missingIDs, id)
+			// Mark the event as seen so that an event in both lists is
+			// only fetched once.
+			events[id] = gomatrixserverlib.Event{}
+		}
+	}
+	if len(missingIDs) > maxStateEventsToFetch {
+		return nil, nil
+	}
+
+	for _, id := range missingIDs {
+		if events[id], err = t.fetchEvent(roomID, id, roomVersion); err != nil {
+			return nil, err
+		}
+	}
+
+	var state gomatrixserverlib.RespState
+	for _, id := range stateIDs.StateEventIDs {
+		state.StateEvents = append(state.StateEvents, events[id])
+	}
+	for _, id := range stateIDs.AuthEventIDs {
+		state.AuthEvents = append(state.AuthEvents, events[id])
+	}
+	return &state, nil
+}
+
+// fetchEvent fetches a single event in the room from the origin server using
+// /event and checks its signatures.
+func (t *txnReq) fetchEvent(
+	roomID, eventID string, roomVersion gomatrixserverlib.RoomVersion,
+) (gomatrixserverlib.Event, error) {
+	txn, err := t.federation.GetEvent(t.context, t.Origin, eventID)
+	if err != nil {
+		return gomatrixserverlib.Event{}, err
+	}
+	if len(txn.PDUs) != 1 {
+		return gomatrixserverlib.Event{}, fmt.Errorf("expected one PDU for event %q, got %d", eventID, len(txn.PDUs))
+	}
+	event, err := gomatrixserverlib.NewEventFromUntrustedJSON(txn.PDUs[0], roomVersion)
+	if err != nil {
+		return gomatrixserverlib.Event{}, err
+	}
+	if event.EventID() != eventID {
+		return gomatrixserverlib.Event{}, fmt.Errorf("asked for event %q, got %q", eventID, event.EventID())
+	}
+	if event.RoomID() != roomID {
+		return gomatrixserverlib.Event{}, fmt.Errorf("event %q is not in room %q", eventID, roomID)
+	}
+	if err = gomatrixserverlib.VerifyAllEventSignatures(
+		t.context, []gomatrixserverlib.Event{event}, keydb.KeyRingForRoomVersion(t.keys, roomVersion),
+	); err != nil {
+		return gomatrixserverlib.Event{}, err
+	}
+	return event, nil
+}
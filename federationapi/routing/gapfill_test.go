@@ -0,0 +1,346 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/producers"
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"golang.org/x/crypto/ed25519"
+)
+
+const (
+	gapFillRoomID = "!gap:origin"
+	gapFillKeyID  = gomatrixserverlib.KeyID("ed25519:origin")
+)
+
+// gapFillRoomserver keeps the events sent to it. It knows the state after
+// the events that weren't sent as outliers, and answers every state query
+// with the state that it started with.
+type gapFillRoomserver struct {
+	api.RoomserverQueryAPI
+	events   map[string]gomatrixserverlib.Event
+	hasState map[string]bool
+	state    []gomatrixserverlib.Event
+	latest   []gomatrixserverlib.EventReference
+	inputs   []api.InputRoomEvent
+}
+
+func (r *gapFillRoomserver) InputRoomEvents(
+	ctx context.Context,
+	request *api.InputRoomEventsRequest,
+	response *api.InputRoomEventsResponse,
+) error {
+	for _, ire := range request.InputRoomEvents {
+		r.inputs = append(r.inputs, ire)
+		r.events[ire.Event.EventID()] = ire.Event.Unwrap()
+		if ire.Kind != api.KindOutlier {
+			r.hasState[ire.Event.EventID()] = true
+		}
+	}
+	return nil
+}
+
+func (r *gapFillRoomserver) QueryLatestEventsAndState(
+	ctx context.Context,
+	request *api.QueryLatestEventsAndStateRequest,
+	response *api.QueryLatestEventsAndStateResponse,
+) error {
+	response.RoomExists = true
+	response.RoomVersion = gomatrixserverlib.RoomVersionV1
+	response.LatestEvents = r.latest
+	return nil
+}
+
+func (r *gapFillRoomserver) QueryStateAfterEvents(
+	ctx context.Context,
+	request *api.QueryStateAfterEventsRequest,
+	response *api.QueryStateAfterEventsResponse,
+) error {
+	response.RoomExists = true
+	response.RoomVersion = gomatrixserverlib.RoomVersionV1
+	for _, eventID := range request.PrevEventIDs {
+		if !r.hasState[eventID] {
+			return nil
+		}
+	}
+	response.PrevEventsExist = true
+	for _, event := range r.state {
+		response.StateEvents = append(response.StateEvents, event.Headered(response.RoomVersion))
+	}
+	return nil
+}
+
+func (r *gapFillRoomserver) QueryEventsByID(
+	ctx context.Context,
+	request *api.QueryEventsByIDRequest,
+	response *api.QueryEventsByIDResponse,
+) error {
+	for _, eventID := range request.EventIDs {
+		if event, ok := r.events[eventID]; ok {
+			response.Events = append(response.Events, event.Headered(gomatrixserverlib.RoomVersionV1))
+		}
+	}
+	return nil
+}
+
+// input returns the input of the event with the given ID, or nil if it wasn't
+// sent to the roomserver.
+func (r *gapFillRoomserver) input(eventID string) *api.InputRoomEvent {
+	for i := range r.inputs {
+		if r.inputs[i].Event.EventID() == eventID {
+			return &r.inputs[i]
+		}
+	}
+	return nil
+}
+
+// gapFillKeyDatabase only knows the signing key of the origin server.
+type gapFillKeyDatabase struct {
+	gomatrixserverlib.KeyDatabase
+	publicKey ed25519.PublicKey
+}
+
+func (d *gapFillKeyDatabase) FetcherName() string { return "gapFillKeyDatabase" }
+
+func (d *gapFillKeyDatabase) FetchKeys(
+	ctx context.Context,
+	requests map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp,
+) (map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult, error) {
+	results := map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult{}
+	for req := range requests {
+		if req.ServerName == "origin" && req.KeyID == gapFillKeyID {
+			results[req] = gomatrixserverlib.PublicKeyLookupResult{
+				VerifyKey:    gomatrixserverlib.VerifyKey{Key: gomatrixserverlib.Base64String(d.publicKey)},
+				ExpiredTS:    gomatrixserverlib.PublicKeyNotExpired,
+				ValidUntilTS: gomatrixserverlib.AsTimestamp(time.Now().Add(time.Hour)),
+			}
+		}
+	}
+	return results, nil
+}
+
+// gapFillTripper answers the federation requests made to the origin server
+// while filling a gap.
+type gapFillTripper struct {
+	events        map[string]gomatrixserverlib.Event
+	missingEvents []gomatrixserverlib.Event
+	stateIDs      map[string]gomatrixserverlib.RespStateIDs
+	paths         []string
+}
+
+func (t *gapFillTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.paths = append(t.paths, req.URL.Path)
+	var body interface{}
+	switch {
+	case strings.HasPrefix(req.URL.Path, "/_matrix/federation/v1/get_missing_events/"):
+		events := []json.RawMessage{}
+		for _, event := range t.missingEvents {
+			events = append(events, event.JSON())
+		}
+		body = getMissingEventsResponse{Events: events}
+	case strings.HasPrefix(req.URL.Path, "/_matrix/federation/v1/state_ids/"):
+		if stateIDs, ok := t.stateIDs[req.URL.Query().Get("event_id")]; ok {
+			body = stateIDs
+		}
+	case strings.HasPrefix(req.URL.Path, "/_matrix/federation/v1/event/"):
+		eventID := strings.TrimPrefix(req.URL.Path, "/_matrix/federation/v1/event/")
+		if event, ok := t.events[eventID]; ok {
+			body = gomatrixserverlib.Transaction{
+				Origin:         "origin",
+				OriginServerTS: gomatrixserverlib.AsTimestamp(time.Now()),
+				PDUs:           []json.RawMessage{event.JSON()},
+			}
+		}
+	}
+	res := &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": []string{"application/json"}},
+		Request:    req,
+	}
+	if body == nil {
+		res.StatusCode = http.StatusNotFound
+		body = struct{}{}
+	}
+	content, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	res.Body = ioutil.NopCloser(strings.NewReader(string(content)))
+	return res, nil
+}
+
+// gapFillTest is a room on the origin server in which the local server knows
+// the create and join events. The origin server then sends a name event and
+// a message that the local server never received, followed by an event that
+// refers to both the join event and the message.
+type gapFillTest struct {
+	create, join, name, message, event gomatrixserverlib.Event
+	roomserver                         *gapFillRoomserver
+	tripper                            *gapFillTripper
+	txn                                *txnReq
+}
+
+func newGapFillTest(t *testing.T) *gapFillTest {
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buildEvent := func(
+		eventType string, stateKey *string, content interface{}, depth int64,
+		prevEvents, authEvents []gomatrixserverlib.Event,
+	) gomatrixserverlib.Event {
+		builder := gomatrixserverlib.EventBuilder{
+			Sender:   "@alice:origin",
+			RoomID:   gapFillRoomID,
+			Type:     eventType,
+			StateKey: stateKey,
+			Depth:    depth,
+		}
+		if err = builder.SetContent(content); err != nil {
+			t.Fatal(err)
+		}
+		var prevRefs, authRefs []gomatrixserverlib.EventReference
+		for _, event := range prevEvents {
+			prevRefs = append(prevRefs, event.EventReference())
+		}
+		for _, event := range authEvents {
+			authRefs = append(authRefs, event.EventReference())
+		}
+		builder.PrevEvents = prevRefs
+		builder.AuthEvents = authRefs
+		event, err := builder.Build(time.Now(), "origin", gapFillKeyID, privateKey, gomatrixserverlib.RoomVersionV1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return event
+	}
+	emptyStateKey := ""
+	aliceStateKey := "@alice:origin"
+
+	test := &gapFillTest{}
+	test.create = buildEvent("m.room.create", &emptyStateKey, map[string]string{"creator": "@alice:origin"}, 1, nil, nil)
+	test.join = buildEvent("m.room.member", &aliceStateKey, map[string]string{"membership": "join"}, 2,
+		[]gomatrixserverlib.Event{test.create}, []gomatrixserverlib.Event{test.create})
+	authEvents := []gomatrixserverlib.Event{test.create, test.join}
+	test.name = buildEvent("m.room.name", &emptyStateKey, map[string]string{"name": "gap"}, 3,
+		[]gomatrixserverlib.Event{test.join}, authEvents)
+	test.message = buildEvent("m.room.message", nil, map[string]string{"body": "missed"}, 4,
+		[]gomatrixserverlib.Event{test.name}, authEvents)
+	test.event = buildEvent("m.room.message", nil, map[string]string{"body": "hello"}, 5,
+		[]gomatrixserverlib.Event{test.join, test.message}, authEvents)
+
+	test.roomserver = &gapFillRoomserver{
+		events: map[string]gomatrixserverlib.Event{
+			test.create.EventID(): test.create,
+			test.join.EventID():   test.join,
+		},
+		hasState: map[string]bool{
+			test.create.EventID(): true,
+			test.join.EventID():   true,
+		},
+		state:  authEvents,
+		latest: []gomatrixserverlib.EventReference{test.join.EventReference()},
+	}
+	test.tripper = &gapFillTripper{events: map[string]gomatrixserverlib.Event{}}
+	for _, event := range []gomatrixserverlib.Event{test.create, test.join, test.name, test.message, test.event} {
+		test.tripper.events[event.EventID()] = event
+	}
+
+	cfg := &config.Dendrite{}
+	cfg.Matrix.ServerName = "localhost"
+	cfg.Matrix.KeyID = "ed25519:test"
+	cfg.Matrix.PrivateKey = privateKey
+	transport := &http.Transport{}
+	transport.RegisterProtocol("matrix", test.tripper)
+	test.txn = &txnReq{
+		context:    context.Background(),
+		cfg:        cfg,
+		query:      test.roomserver,
+		producer:   producers.NewRoomserverProducer(test.roomserver, test.roomserver),
+		keys:       gomatrixserverlib.KeyRing{KeyDatabase: &gapFillKeyDatabase{publicKey: publicKey}},
+		federation: gomatrixserverlib.NewFederationClientWithTransport(cfg.Matrix.ServerName, cfg.Matrix.KeyID, privateKey, transport),
+	}
+	test.txn.Origin = "origin"
+	return test
+}
+
+func TestProcessEventFillsGapWithMissingEvents(t *testing.T) {
+	test := newGapFillTest(t)
+	test.tripper.missingEvents = []gomatrixserverlib.Event{test.message, test.name}
+
+	if err := test.txn.processEvent(test.event, true); err != nil {
+		t.Fatalf("processEvent failed: %v", err)
+	}
+
+	var got []string
+	for _, ire := range test.roomserver.inputs {
+		if ire.Kind != api.KindNew || ire.HasState {
+			t.Errorf("event %q: got kind %d with state %v, want a new event without state", ire.Event.EventID(), ire.Kind, ire.HasState)
+		}
+		got = append(got, ire.Event.EventID())
+	}
+	want := []string{test.name.EventID(), test.message.EventID(), test.event.EventID()}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("got events %v sent to the roomserver, want %v", got, want)
+	}
+	for _, path := range test.tripper.paths {
+		if strings.HasPrefix(path, "/_matrix/federation/v1/state_ids/") {
+			t.Errorf("fetched the state with %q although the gap was filled", path)
+		}
+	}
+}
+
+func TestProcessEventFetchesStateAtGapEdge(t *testing.T) {
+	test := newGapFillTest(t)
+	test.tripper.stateIDs = map[string]gomatrixserverlib.RespStateIDs{
+		test.message.EventID(): {
+			StateEventIDs: []string{test.create.EventID(), test.join.EventID(), test.name.EventID()},
+			AuthEventIDs:  []string{test.create.EventID(), test.join.EventID()},
+		},
+	}
+
+	if err := test.txn.processEvent(test.event, true); err != nil {
+		t.Fatalf("processEvent failed: %v", err)
+	}
+
+	// The state fetched from the origin server is only stored as outliers.
+	if ire := test.roomserver.input(test.name.EventID()); ire == nil || ire.Kind != api.KindOutlier {
+		t.Errorf("got input %+v for the fetched state event, want an outlier", ire)
+	}
+	// The event at the edge of the gap is given the state before it.
+	ire := test.roomserver.input(test.message.EventID())
+	if ire == nil || ire.Kind != api.KindNew || !ire.HasState {
+		t.Fatalf("got input %+v for the event at the edge of the gap, want a new event with state", ire)
+	}
+	if len(ire.StateEventIDs) != 3 {
+		t.Errorf("got state %v for the event at the edge of the gap, want 3 events", ire.StateEventIDs)
+	}
+	// The roomserver resolves the state at the event itself from the state
+	// after both of its prev_events.
+	ire = &test.roomserver.inputs[len(test.roomserver.inputs)-1]
+	if ire.Event.EventID() != test.event.EventID() || ire.Kind != api.KindNew || ire.HasState {
+		t.Errorf("got last input %+v, want the event as a new event without state", ire)
+	}
+}
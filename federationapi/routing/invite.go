@@ -15,17 +15,26 @@
 package routing
 
 import (
-	"context"
+	"encoding/json"
 	"net/http"
 
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
 	"github.com/matrix-org/dendrite/clientapi/producers"
 	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/dendrite/common/keydb"
 	"github.com/matrix-org/dendrite/roomserver/api"
+	roomserverVersion "github.com/matrix-org/dendrite/roomserver/version"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
 )
 
+// The body of a request to /_matrix/federation/v2/invite/{roomID}/{eventID}
+type inviteV2Request struct {
+	RoomVersion     gomatrixserverlib.RoomVersion `json:"room_version"`
+	Event           json.RawMessage               `json:"event"`
+	InviteRoomState json.RawMessage               `json:"invite_room_state"`
+}
+
 // Invite implements /_matrix/federation/v1/invite/{roomID}/{eventID}
 func Invite(
 	httpReq *http.Request,
@@ -36,28 +45,104 @@ func Invite(
 	producer *producers.RoomserverProducer,
 	keys gomatrixserverlib.KeyRing,
 ) util.JSONResponse {
-	// Look up the room version for the room.
+	// The v1 API is only used for rooms of version 1 and 2. We won't know the
+	// room version if we aren't in the room yet, in which case we assume that
+	// the room is version 1, as both versions use the same event format.
+	roomVersion := gomatrixserverlib.RoomVersionV1
 	verReq := api.QueryRoomVersionForRoomRequest{RoomID: roomID}
 	verRes := api.QueryRoomVersionForRoomResponse{}
-	if err := producer.QueryAPI.QueryRoomVersionForRoom(context.Background(), &verReq, &verRes); err != nil {
+	if err := producer.QueryAPI.QueryRoomVersionForRoom(httpReq.Context(), &verReq, &verRes); err == nil {
+		roomVersion = verRes.RoomVersion
+	}
+
+	// Decode the event JSON from the request.
+	event, err := gomatrixserverlib.NewEventFromUntrustedJSON(request.Content(), roomVersion)
+	if err != nil {
 		return util.JSONResponse{
 			Code: http.StatusBadRequest,
-			JSON: jsonerror.UnsupportedRoomVersion(err.Error()),
+			JSON: jsonerror.NotJSON("The request body could not be decoded into valid JSON. " + err.Error()),
 		}
 	}
 
-	// Decode the event JSON from the request.
-	event, err := gomatrixserverlib.NewEventFromUntrustedJSON(request.Content(), verRes.RoomVersion)
-	if err != nil {
+	signedEvent, resErr := processInvite(httpReq, request, event, roomID, eventID, roomVersion, cfg, producer, keys)
+	if resErr != nil {
+		return *resErr
+	}
+
+	// Return the signed event to the originating server, it should then tell
+	// the other servers in the room that we have been invited.
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: gomatrixserverlib.RespInvite{Event: *signedEvent},
+	}
+}
+
+// InviteV2 implements /_matrix/federation/v2/invite/{roomID}/{eventID}
+func InviteV2(
+	httpReq *http.Request,
+	request *gomatrixserverlib.FederationRequest,
+	roomID string,
+	eventID string,
+	cfg *config.Dendrite,
+	producer *producers.RoomserverProducer,
+	keys gomatrixserverlib.KeyRing,
+) util.JSONResponse {
+	var inviteReq inviteV2Request
+	if err := json.Unmarshal(request.Content(), &inviteReq); err != nil {
 		return util.JSONResponse{
 			Code: http.StatusBadRequest,
 			JSON: jsonerror.NotJSON("The request body could not be decoded into valid JSON. " + err.Error()),
 		}
 	}
+	if _, err := roomserverVersion.SupportedRoomVersion(inviteReq.RoomVersion); err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.IncompatibleRoomVersion(string(inviteReq.RoomVersion)),
+		}
+	}
 
+	event, err := gomatrixserverlib.NewEventFromUntrustedJSON(inviteReq.Event, inviteReq.RoomVersion)
+	if err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.BadJSON("The invite event could not be decoded. " + err.Error()),
+		}
+	}
+	// The stripped state of the room is passed alongside the event rather than
+	// in its unsigned section, where the roomserver expects to find it.
+	if len(inviteReq.InviteRoomState) > 0 {
+		if err = event.SetUnsignedField("invite_room_state", inviteReq.InviteRoomState); err != nil {
+			util.GetLogger(httpReq.Context()).WithError(err).Error("event.SetUnsignedField failed")
+			return jsonerror.InternalServerError()
+		}
+	}
+
+	signedEvent, resErr := processInvite(httpReq, request, event, roomID, eventID, inviteReq.RoomVersion, cfg, producer, keys)
+	if resErr != nil {
+		return *resErr
+	}
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: map[string]interface{}{"event": signedEvent},
+	}
+}
+
+// processInvite checks an invite event received over federation, signs it and
+// passes it on to the roomserver. Returns the signed event.
+func processInvite(
+	httpReq *http.Request,
+	request *gomatrixserverlib.FederationRequest,
+	event gomatrixserverlib.Event,
+	roomID, eventID string,
+	roomVersion gomatrixserverlib.RoomVersion,
+	cfg *config.Dendrite,
+	producer *producers.RoomserverProducer,
+	keys gomatrixserverlib.KeyRing,
+) (*gomatrixserverlib.Event, *util.JSONResponse) {
 	// Check that the room ID is correct.
 	if event.RoomID() != roomID {
-		return util.JSONResponse{
+		return nil, &util.JSONResponse{
 			Code: http.StatusBadRequest,
 			JSON: jsonerror.BadJSON("The room ID in the request path must match the room ID in the invite event JSON"),
 		}
@@ -65,7 +150,7 @@ func Invite(
 
 	// Check that the event ID is correct.
 	if event.EventID() != eventID {
-		return util.JSONResponse{
+		return nil, &util.JSONResponse{
 			Code: http.StatusBadRequest,
 			JSON: jsonerror.BadJSON("The event ID in the request path must match the event ID in the invite event JSON"),
 		}
@@ -73,7 +158,7 @@ func Invite(
 
 	// Check that the event is from the server sending the request.
 	if event.Origin() != request.Origin() {
-		return util.JSONResponse{
+		return nil, &util.JSONResponse{
 			Code: http.StatusForbidden,
 			JSON: jsonerror.Forbidden("The invite must be sent by the server it originated on"),
 		}
@@ -86,13 +171,16 @@ func Invite(
 		Message:    redacted.JSON(),
 		AtTS:       event.OriginServerTS(),
 	}}
-	verifyResults, err := keys.VerifyJSONs(httpReq.Context(), verifyRequests)
+	verifyResults, err := keydb.KeyRingForRoomVersion(keys, roomVersion).VerifyJSONs(
+		httpReq.Context(), verifyRequests,
+	)
 	if err != nil {
 		util.GetLogger(httpReq.Context()).WithError(err).Error("keys.VerifyJSONs failed")
-		return jsonerror.InternalServerError()
+		resErr := jsonerror.InternalServerError()
+		return nil, &resErr
 	}
 	if verifyResults[0].Error != nil {
-		return util.JSONResponse{
+		return nil, &util.JSONResponse{
 			Code: http.StatusForbidden,
 			JSON: jsonerror.Forbidden("The invite must be signed by the server it originated on"),
 		}
@@ -104,15 +192,11 @@ func Invite(
 	)
 
 	// Add the invite event to the roomserver.
-	if err = producer.SendInvite(httpReq.Context(), signedEvent); err != nil {
+	if err = producer.SendInvite(httpReq.Context(), signedEvent.Headered(roomVersion)); err != nil {
 		util.GetLogger(httpReq.Context()).WithError(err).Error("producer.SendInvite failed")
-		return jsonerror.InternalServerError()
+		resErr := jsonerror.InternalServerError()
+		return nil, &resErr
 	}
 
-	// Return the signed event to the originating server, it should then tell
-	// the other servers in the room that we have been invited.
-	return util.JSONResponse{
-		Code: http.StatusOK,
-		JSON: gomatrixserverlib.RespInvite{Event: signedEvent},
-	}
+	return &signedEvent, nil
 }
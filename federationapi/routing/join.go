@@ -22,6 +22,7 @@ import (
 	"github.com/matrix-org/dendrite/clientapi/producers"
 	"github.com/matrix-org/dendrite/common"
 	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/dendrite/common/keydb"
 	"github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
@@ -58,6 +59,26 @@ func MakeJoin(
 		}
 	}
 
+	// Check that the joining server supports the version of the room. Servers
+	// that don't tell us which versions they support only support version 1.
+	remoteVersions := httpReq.URL.Query()["ver"]
+	if len(remoteVersions) == 0 {
+		remoteVersions = []string{string(gomatrixserverlib.RoomVersionV1)}
+	}
+	versionSupported := false
+	for _, remoteVersion := range remoteVersions {
+		if gomatrixserverlib.RoomVersion(remoteVersion) == verRes.RoomVersion {
+			versionSupported = true
+			break
+		}
+	}
+	if !versionSupported {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.IncompatibleRoomVersion(string(verRes.RoomVersion)),
+		}
+	}
+
 	// Try building an event for the server
 	builder := gomatrixserverlib.EventBuilder{
 		Sender:   userID,
@@ -167,7 +188,9 @@ func SendJoin(
 		Message:    redacted.JSON(),
 		AtTS:       event.OriginServerTS(),
 	}}
-	verifyResults, err := keys.VerifyJSONs(httpReq.Context(), verifyRequests)
+	verifyResults, err := keydb.KeyRingForRoomVersion(keys, verRes.RoomVersion).VerifyJSONs(
+		httpReq.Context(), verifyRequests,
+	)
 	if err != nil {
 		util.GetLogger(httpReq.Context()).WithError(err).Error("keys.VerifyJSONs failed")
 		return jsonerror.InternalServerError()
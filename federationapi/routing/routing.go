@@ -25,6 +25,7 @@ import (
 	"github.com/matrix-org/dendrite/common"
 	"github.com/matrix-org/dendrite/common/config"
 	federationSenderAPI "github.com/matrix-org/dendrite/federationsender/api"
+	keyServerAPI "github.com/matrix-org/dendrite/keyserver/api"
 	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
@@ -48,16 +49,24 @@ func Setup(
 	aliasAPI roomserverAPI.RoomserverAliasAPI,
 	asAPI appserviceAPI.AppServiceQueryAPI,
 	producer *producers.RoomserverProducer,
+	federationSenderInputAPI federationSenderAPI.FederationSenderInputAPI,
 	federationSenderAPI federationSenderAPI.FederationSenderQueryAPI,
 	keys gomatrixserverlib.KeyRing,
 	federation *gomatrixserverlib.FederationClient,
 	accountDB accounts.Database,
 	deviceDB devices.Database,
+	keyInputAPI keyServerAPI.KeyServerInputAPI,
+	keyQueryAPI keyServerAPI.KeyServerQueryAPI,
+	eduHandlers *EDUHandlers,
 ) {
 	v2keysmux := apiMux.PathPrefix(pathPrefixV2Keys).Subrouter()
 	v1fedmux := apiMux.PathPrefix(pathPrefixV1Federation).Subrouter()
 	v2fedmux := apiMux.PathPrefix(pathPrefixV2Federation).Subrouter()
 
+	wakeup := &FederationWakeups{
+		InputAPI: federationSenderInputAPI,
+	}
+
 	localKeys := common.MakeExternalAPI("localkeys", func(req *http.Request) util.JSONResponse {
 		return LocalKeys(cfg)
 	})
@@ -71,7 +80,7 @@ func Setup(
 	v2keysmux.Handle("/server", localKeys).Methods(http.MethodGet)
 
 	v1fedmux.Handle("/send/{txnID}", common.MakeFedAPI(
-		"federation_send", cfg.Matrix.ServerName, keys,
+		"federation_send", cfg.Matrix.ServerName, keys, wakeup,
 		func(httpReq *http.Request, request *gomatrixserverlib.FederationRequest) util.JSONResponse {
 			vars, err := common.URLDecodeMapValues(mux.Vars(httpReq))
 			if err != nil {
@@ -79,18 +88,21 @@ func Setup(
 			}
 			return Send(
 				httpReq, request, gomatrixserverlib.TransactionID(vars["txnID"]),
-				cfg, query, producer, keys, federation,
+				cfg, query, federationSenderAPI, producer, keys, federation, eduHandlers,
 			)
 		},
 	)).Methods(http.MethodPut, http.MethodOptions)
 
 	v1fedmux.Handle("/invite/{roomID}/{eventID}", common.MakeFedAPI(
-		"federation_invite", cfg.Matrix.ServerName, keys,
+		"federation_invite", cfg.Matrix.ServerName, keys, wakeup,
 		func(httpReq *http.Request, request *gomatrixserverlib.FederationRequest) util.JSONResponse {
 			vars, err := common.URLDecodeMapValues(mux.Vars(httpReq))
 			if err != nil {
 				return util.ErrorResponse(err)
 			}
+			if resErr := checkServerACL(httpReq.Context(), federationSenderAPI, request.Origin(), vars["roomID"]); resErr != nil {
+				return *resErr
+			}
 			return Invite(
 				httpReq, request, vars["roomID"], vars["eventID"],
 				cfg, producer, keys,
@@ -98,6 +110,23 @@ func Setup(
 		},
 	)).Methods(http.MethodPut, http.MethodOptions)
 
+	v2fedmux.Handle("/invite/{roomID}/{eventID}", common.MakeFedAPI(
+		"federation_invite_v2", cfg.Matrix.ServerName, keys, wakeup,
+		func(httpReq *http.Request, request *gomatrixserverlib.FederationRequest) util.JSONResponse {
+			vars, err := common.URLDecodeMapValues(mux.Vars(httpReq))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			if resErr := checkServerACL(httpReq.Context(), federationSenderAPI, request.Origin(), vars["roomID"]); resErr != nil {
+				return *resErr
+			}
+			return InviteV2(
+				httpReq, request, vars["roomID"], vars["eventID"],
+				cfg, producer, keys,
+			)
+		},
+	)).Methods(http.MethodPut, http.MethodOptions)
+
 	v1fedmux.Handle("/3pid/onbind", common.MakeExternalAPI("3pid_onbind",
 		func(req *http.Request) util.JSONResponse {
 			return CreateInvitesFrom3PIDInvites(req, query, asAPI, cfg, producer, federation, accountDB)
@@ -105,12 +134,15 @@ func Setup(
 	)).Methods(http.MethodPost, http.MethodOptions)
 
 	v1fedmux.Handle("/exchange_third_party_invite/{roomID}", common.MakeFedAPI(
-		"exchange_third_party_invite", cfg.Matrix.ServerName, keys,
+		"exchange_third_party_invite", cfg.Matrix.ServerName, keys, wakeup,
 		func(httpReq *http.Request, request *gomatrixserverlib.FederationRequest) util.JSONResponse {
 			vars, err := common.URLDecodeMapValues(mux.Vars(httpReq))
 			if err != nil {
 				return util.ErrorResponse(err)
 			}
+			if resErr := checkServerACL(httpReq.Context(), federationSenderAPI, request.Origin(), vars["roomID"]); resErr != nil {
+				return *resErr
+			}
 			return ExchangeThirdPartyInvite(
 				httpReq, request, vars["roomID"], query, cfg, federation, producer,
 			)
@@ -118,25 +150,28 @@ func Setup(
 	)).Methods(http.MethodPut, http.MethodOptions)
 
 	v1fedmux.Handle("/event/{eventID}", common.MakeFedAPI(
-		"federation_get_event", cfg.Matrix.ServerName, keys,
+		"federation_get_event", cfg.Matrix.ServerName, keys, wakeup,
 		func(httpReq *http.Request, request *gomatrixserverlib.FederationRequest) util.JSONResponse {
 			vars, err := common.URLDecodeMapValues(mux.Vars(httpReq))
 			if err != nil {
 				return util.ErrorResponse(err)
 			}
 			return GetEvent(
-				httpReq.Context(), request, query, vars["eventID"],
+				httpReq.Context(), request, query, federationSenderAPI, vars["eventID"],
 			)
 		},
 	)).Methods(http.MethodGet)
 
 	v1fedmux.Handle("/state/{roomID}", common.MakeFedAPI(
-		"federation_get_state", cfg.Matrix.ServerName, keys,
+		"federation_get_state", cfg.Matrix.ServerName, keys, wakeup,
 		func(httpReq *http.Request, request *gomatrixserverlib.FederationRequest) util.JSONResponse {
 			vars, err := common.URLDecodeMapValues(mux.Vars(httpReq))
 			if err != nil {
 				return util.ErrorResponse(err)
 			}
+			if resErr := checkServerACL(httpReq.Context(), federationSenderAPI, request.Origin(), vars["roomID"]); resErr != nil {
+				return *resErr
+			}
 			return GetState(
 				httpReq.Context(), request, query, vars["roomID"],
 			)
@@ -144,12 +179,15 @@ func Setup(
 	)).Methods(http.MethodGet)
 
 	v1fedmux.Handle("/state_ids/{roomID}", common.MakeFedAPI(
-		"federation_get_state_ids", cfg.Matrix.ServerName, keys,
+		"federation_get_state_ids", cfg.Matrix.ServerName, keys, wakeup,
 		func(httpReq *http.Request, request *gomatrixserverlib.FederationRequest) util.JSONResponse {
 			vars, err := common.URLDecodeMapValues(mux.Vars(httpReq))
 			if err != nil {
 				return util.ErrorResponse(err)
 			}
+			if resErr := checkServerACL(httpReq.Context(), federationSenderAPI, request.Origin(), vars["roomID"]); resErr != nil {
+				return *resErr
+			}
 			return GetStateIDs(
 				httpReq.Context(), request, query, vars["roomID"],
 			)
@@ -157,9 +195,12 @@ func Setup(
 	)).Methods(http.MethodGet)
 
 	v1fedmux.Handle("/event_auth/{roomID}/{eventID}", common.MakeFedAPI(
-		"federation_get_event_auth", cfg.Matrix.ServerName, keys,
+		"federation_get_event_auth", cfg.Matrix.ServerName, keys, wakeup,
 		func(httpReq *http.Request, request *gomatrixserverlib.FederationRequest) util.JSONResponse {
 			vars := mux.Vars(httpReq)
+			if resErr := checkServerACL(httpReq.Context(), federationSenderAPI, request.Origin(), vars["roomID"]); resErr != nil {
+				return *resErr
+			}
 			return GetEventAuth(
 				httpReq.Context(), request, query, vars["roomID"], vars["eventID"],
 			)
@@ -167,7 +208,7 @@ func Setup(
 	)).Methods(http.MethodGet)
 
 	v1fedmux.Handle("/query/directory", common.MakeFedAPI(
-		"federation_query_room_alias", cfg.Matrix.ServerName, keys,
+		"federation_query_room_alias", cfg.Matrix.ServerName, keys, wakeup,
 		func(httpReq *http.Request, request *gomatrixserverlib.FederationRequest) util.JSONResponse {
 			return RoomAliasToID(
 				httpReq, federation, cfg, aliasAPI, federationSenderAPI,
@@ -176,7 +217,7 @@ func Setup(
 	)).Methods(http.MethodGet)
 
 	v1fedmux.Handle("/query/profile", common.MakeFedAPI(
-		"federation_query_profile", cfg.Matrix.ServerName, keys,
+		"federation_query_profile", cfg.Matrix.ServerName, keys, wakeup,
 		func(httpReq *http.Request, request *gomatrixserverlib.FederationRequest) util.JSONResponse {
 			return GetProfile(
 				httpReq, accountDB, cfg, asAPI,
@@ -185,7 +226,7 @@ func Setup(
 	)).Methods(http.MethodGet)
 
 	v1fedmux.Handle("/user/devices/{userID}", common.MakeFedAPI(
-		"federation_user_devices", cfg.Matrix.ServerName, keys,
+		"federation_user_devices", cfg.Matrix.ServerName, keys, wakeup,
 		func(httpReq *http.Request, request *gomatrixserverlib.FederationRequest) util.JSONResponse {
 			vars, err := common.URLDecodeMapValues(mux.Vars(httpReq))
 			if err != nil {
@@ -197,13 +238,30 @@ func Setup(
 		},
 	)).Methods(http.MethodGet)
 
+	v1fedmux.Handle("/user/keys/query", common.MakeFedAPI(
+		"federation_user_keys_query", cfg.Matrix.ServerName, keys, wakeup,
+		func(httpReq *http.Request, request *gomatrixserverlib.FederationRequest) util.JSONResponse {
+			return QueryDeviceKeys(httpReq, request, cfg, keyQueryAPI)
+		},
+	)).Methods(http.MethodPost)
+
+	v1fedmux.Handle("/user/keys/claim", common.MakeFedAPI(
+		"federation_user_keys_claim", cfg.Matrix.ServerName, keys, wakeup,
+		func(httpReq *http.Request, request *gomatrixserverlib.FederationRequest) util.JSONResponse {
+			return ClaimOneTimeKeys(httpReq, request, cfg, keyInputAPI)
+		},
+	)).Methods(http.MethodPost)
+
 	v1fedmux.Handle("/make_join/{roomID}/{userID}", common.MakeFedAPI(
-		"federation_make_join", cfg.Matrix.ServerName, keys,
+		"federation_make_join", cfg.Matrix.ServerName, keys, wakeup,
 		func(httpReq *http.Request, request *gomatrixserverlib.FederationRequest) util.JSONResponse {
 			vars, err := common.URLDecodeMapValues(mux.Vars(httpReq))
 			if err != nil {
 				return util.ErrorResponse(err)
 			}
+			if resErr := checkServerACL(httpReq.Context(), federationSenderAPI, request.Origin(), vars["roomID"]); resErr != nil {
+				return *resErr
+			}
 			roomID := vars["roomID"]
 			userID := vars["userID"]
 			return MakeJoin(
@@ -213,12 +271,15 @@ func Setup(
 	)).Methods(http.MethodGet)
 
 	v2fedmux.Handle("/send_join/{roomID}/{userID}", common.MakeFedAPI(
-		"federation_send_join", cfg.Matrix.ServerName, keys,
+		"federation_send_join", cfg.Matrix.ServerName, keys, wakeup,
 		func(httpReq *http.Request, request *gomatrixserverlib.FederationRequest) util.JSONResponse {
 			vars, err := common.URLDecodeMapValues(mux.Vars(httpReq))
 			if err != nil {
 				return util.ErrorResponse(err)
 			}
+			if resErr := checkServerACL(httpReq.Context(), federationSenderAPI, request.Origin(), vars["roomID"]); resErr != nil {
+				return *resErr
+			}
 			roomID := vars["roomID"]
 			userID := vars["userID"]
 			return SendJoin(
@@ -228,12 +289,15 @@ func Setup(
 	)).Methods(http.MethodPut)
 
 	v1fedmux.Handle("/make_leave/{roomID}/{userID}", common.MakeFedAPI(
-		"federation_make_leave", cfg.Matrix.ServerName, keys,
+		"federation_make_leave", cfg.Matrix.ServerName, keys, wakeup,
 		func(httpReq *http.Request, request *gomatrixserverlib.FederationRequest) util.JSONResponse {
 			vars, err := common.URLDecodeMapValues(mux.Vars(httpReq))
 			if err != nil {
 				return util.ErrorResponse(err)
 			}
+			if resErr := checkServerACL(httpReq.Context(), federationSenderAPI, request.Origin(), vars["roomID"]); resErr != nil {
+				return *resErr
+			}
 			roomID := vars["roomID"]
 			userID := vars["userID"]
 			return MakeLeave(
@@ -243,12 +307,15 @@ func Setup(
 	)).Methods(http.MethodGet)
 
 	v2fedmux.Handle("/send_leave/{roomID}/{userID}", common.MakeFedAPI(
-		"federation_send_leave", cfg.Matrix.ServerName, keys,
+		"federation_send_leave", cfg.Matrix.ServerName, keys, wakeup,
 		func(httpReq *http.Request, request *gomatrixserverlib.FederationRequest) util.JSONResponse {
 			vars, err := common.URLDecodeMapValues(mux.Vars(httpReq))
 			if err != nil {
 				return util.ErrorResponse(err)
 			}
+			if resErr := checkServerACL(httpReq.Context(), federationSenderAPI, request.Origin(), vars["roomID"]); resErr != nil {
+				return *resErr
+			}
 			roomID := vars["roomID"]
 			userID := vars["userID"]
 			return SendLeave(
@@ -265,23 +332,29 @@ func Setup(
 	)).Methods(http.MethodGet)
 
 	v1fedmux.Handle("/get_missing_events/{roomID}", common.MakeFedAPI(
-		"federation_get_missing_events", cfg.Matrix.ServerName, keys,
+		"federation_get_missing_events", cfg.Matrix.ServerName, keys, wakeup,
 		func(httpReq *http.Request, request *gomatrixserverlib.FederationRequest) util.JSONResponse {
 			vars, err := common.URLDecodeMapValues(mux.Vars(httpReq))
 			if err != nil {
 				return util.ErrorResponse(err)
 			}
+			if resErr := checkServerACL(httpReq.Context(), federationSenderAPI, request.Origin(), vars["roomID"]); resErr != nil {
+				return *resErr
+			}
 			return GetMissingEvents(httpReq, request, query, vars["roomID"])
 		},
 	)).Methods(http.MethodPost)
 
 	v1fedmux.Handle("/backfill/{roomID}", common.MakeFedAPI(
-		"federation_backfill", cfg.Matrix.ServerName, keys,
+		"federation_backfill", cfg.Matrix.ServerName, keys, wakeup,
 		func(httpReq *http.Request, request *gomatrixserverlib.FederationRequest) util.JSONResponse {
 			vars, err := common.URLDecodeMapValues(mux.Vars(httpReq))
 			if err != nil {
 				return util.ErrorResponse(err)
 			}
+			if resErr := checkServerACL(httpReq.Context(), federationSenderAPI, request.Origin(), vars["roomID"]); resErr != nil {
+				return *resErr
+			}
 			return Backfill(httpReq, request, query, vars["roomID"], cfg)
 		},
 	)).Methods(http.MethodGet)
@@ -23,6 +23,8 @@ import (
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
 	"github.com/matrix-org/dendrite/clientapi/producers"
 	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/dendrite/common/keydb"
+	federationSenderAPI "github.com/matrix-org/dendrite/federationsender/api"
 	"github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
@@ -35,16 +37,21 @@ func Send(
 	txnID gomatrixserverlib.TransactionID,
 	cfg *config.Dendrite,
 	query api.RoomserverQueryAPI,
+	federationSenderAPI federationSenderAPI.FederationSenderQueryAPI,
 	producer *producers.RoomserverProducer,
 	keys gomatrixserverlib.KeyRing,
 	federation *gomatrixserverlib.FederationClient,
+	eduHandlers *EDUHandlers,
 ) util.JSONResponse {
 	t := txnReq{
-		context:    httpReq.Context(),
-		query:      query,
-		producer:   producer,
-		keys:       keys,
-		federation: federation,
+		context:     httpReq.Context(),
+		cfg:         cfg,
+		query:       query,
+		fsAPI:       federationSenderAPI,
+		producer:    producer,
+		keys:        keys,
+		federation:  federation,
+		eduHandlers: eduHandlers,
 	}
 
 	var txnEvents struct {
@@ -60,6 +67,14 @@ func Send(
 	}
 
 	t.PDUs = txnEvents.PDUs
+	for _, rawEDU := range txnEvents.EDUs {
+		var edu gomatrixserverlib.EDU
+		if err := json.Unmarshal(rawEDU, &edu); err != nil {
+			util.GetLogger(httpReq.Context()).WithError(err).Warn("Transaction: Failed to parse EDU, skipping it")
+			continue
+		}
+		t.EDUs = append(t.EDUs, edu)
+	}
 	t.Origin = request.Origin()
 	t.TransactionID = txnID
 	t.Destination = cfg.Matrix.ServerName
@@ -80,11 +95,14 @@ func Send(
 
 type txnReq struct {
 	gomatrixserverlib.Transaction
-	context    context.Context
-	query      api.RoomserverQueryAPI
-	producer   *producers.RoomserverProducer
-	keys       gomatrixserverlib.KeyRing
-	federation *gomatrixserverlib.FederationClient
+	context     context.Context
+	cfg         *config.Dendrite
+	query       api.RoomserverQueryAPI
+	fsAPI       federationSenderAPI.FederationSenderQueryAPI
+	producer    *producers.RoomserverProducer
+	keys        gomatrixserverlib.KeyRing
+	federation  *gomatrixserverlib.FederationClient
+	eduHandlers *EDUHandlers
 }
 
 func (t *txnReq) processTransaction() (*gomatrixserverlib.RespSend, error) {
@@ -97,6 +115,15 @@ func (t *txnReq) processTransaction() (*gomatrixserverlib.RespSend, error) {
 			util.GetLogger(t.context).WithError(err).Warn("Transaction: Failed to extract room ID from event")
 			return nil, err
 		}
+		banned, err := isServerBannedFromRoom(t.context, t.fsAPI, t.Origin, header.RoomID)
+		if err != nil {
+			return nil, err
+		}
+		if banned {
+			// Drop the events of servers that the server ACL of the room denies.
+			util.GetLogger(t.context).WithField("room_id", header.RoomID).Warn("Transaction: Dropping event from server banned by the room's server ACL")
+			continue
+		}
 		verReq := api.QueryRoomVersionForRoomRequest{RoomID: header.RoomID}
 		verRes := api.QueryRoomVersionForRoomResponse{}
 		if err := t.query.QueryRoomVersionForRoom(t.context, &verReq, &verRes); err != nil {
@@ -108,7 +135,9 @@ func (t *txnReq) processTransaction() (*gomatrixserverlib.RespSend, error) {
 			util.GetLogger(t.context).WithError(err).Warnf("Transaction: Failed to parse event JSON of event %q", event.EventID())
 			return nil, err
 		}
-		if err := gomatrixserverlib.VerifyAllEventSignatures(t.context, []gomatrixserverlib.Event{event}, t.keys); err != nil {
+		if err := gomatrixserverlib.VerifyAllEventSignatures(
+			t.context, []gomatrixserverlib.Event{event}, keydb.KeyRingForRoomVersion(t.keys, verRes.RoomVersion),
+		); err != nil {
 			util.GetLogger(t.context).WithError(err).Warnf("Transaction: Couldn't validate signature of event %q", event.EventID())
 			return nil, err
 		}
@@ -118,7 +147,7 @@ func (t *txnReq) processTransaction() (*gomatrixserverlib.RespSend, error) {
 	// Process the events.
 	results := map[string]gomatrixserverlib.PDUResult{}
 	for _, e := range pdus {
-		err := t.processEvent(e.Unwrap())
+		err := t.processEvent(e.Unwrap(), true)
 		if err != nil {
 			// If the error is due to the event itself being bad then we skip
 			// it and move onto the next event. We report an error so that the
@@ -152,8 +181,9 @@ func (t *txnReq) processTransaction() (*gomatrixserverlib.RespSend, error) {
 		}
 	}
 
-	// TODO: Process the EDUs.
-	util.GetLogger(t.context).Infof("Processed %d PDUs from transaction %q", len(results), t.TransactionID)
+	t.eduHandlers.processEDUs(t.context, t.Origin, t.EDUs)
+
+	util.GetLogger(t.context).Infof("Processed %d PDUs and %d EDUs from transaction %q", len(results), len(t.EDUs), t.TransactionID)
 	return &gomatrixserverlib.RespSend{PDUs: results}, nil
 }
 
@@ -163,7 +193,12 @@ type unknownRoomError struct {
 
 func (e unknownRoomError) Error() string { return fmt.Sprintf("unknown room %q", e.roomID) }
 
-func (t *txnReq) processEvent(e gomatrixserverlib.Event) error {
+// processEvent checks that the event is allowed and passes it to the
+// roomserver. If we don't know about the prev_events of the event then we try
+// to fill in the gap, but only for events that came in the transaction itself
+// (isInboundTxn) and not for the events that we fetched to fill a gap, so
+// that we don't keep walking further back through the room history.
+func (t *txnReq) processEvent(e gomatrixserverlib.Event, isInboundTxn bool) error {
 	prevEventIDs := e.PrevEventIDs()
 
 	// Fetch the state needed to authenticate the event.
@@ -189,7 +224,7 @@ func (t *txnReq) processEvent(e gomatrixserverlib.Event) error {
 	}
 
 	if !stateResp.PrevEventsExist {
-		return t.processEventWithMissingState(e, stateResp.RoomVersion)
+		return t.processEventWithMissingState(e, stateResp.RoomVersion, isInboundTxn)
 	}
 
 	// Check that the event is allowed by the state at the event.
@@ -227,47 +262,113 @@ func checkAllowedByState(e gomatrixserverlib.Event, stateEvents []gomatrixserver
 	return gomatrixserverlib.Allowed(e, &authUsingState)
 }
 
-func (t *txnReq) processEventWithMissingState(e gomatrixserverlib.Event, roomVersion gomatrixserverlib.RoomVersion) error {
+func (t *txnReq) processEventWithMissingState(
+	e gomatrixserverlib.Event, roomVersion gomatrixserverlib.RoomVersion, isInboundTxn bool,
+) error {
 	// We are missing the previous events for this events.
 	// This means that there is a gap in our view of the history of the
 	// room. There two ways that we can handle such a gap:
 	//   1) We can fill in the gap using /get_missing_events
 	//   2) We can leave the gap and request the state of the room at
-	//      this event from the remote server using either /state_ids
-	//      or /state.
-	// Synapse will attempt to do 1 and if that fails or if the gap is
-	// too large then it will attempt 2.
-	// Synapse will use /state_ids if possible since usually the state
-	// is largely unchanged and it is more efficient to fetch a list of
-	// event ids and then use /event to fetch the individual events.
-	// However not all version of synapse support /state_ids so you may
+	//      the edge of the gap from the remote server using either
+	//      /state_ids or /state.
+	// Like synapse, we attempt to do 1 and if that fails or if the gap is
+	// too large then we attempt 2.
+	// We use /state_ids if possible since usually the state is largely
+	// unchanged and it is more efficient to fetch a list of event ids and
+	// then use /event to fetch the individual events that we don't have.
+	// However not all version of synapse support /state_ids so we may
 	// need to fallback to /state.
-	// TODO: Attempt to fill in the gap using /get_missing_events
-	// TODO: Attempt to fetch the state using /state_ids and /events
-	state, err := t.federation.LookupState(t.context, t.Origin, e.RoomID(), e.EventID(), roomVersion)
+	if isInboundTxn {
+		filled, err := t.fillGap(e, roomVersion)
+		if err != nil {
+			util.GetLogger(t.context).WithError(err).WithField("event_id", e.EventID()).Warn(
+				"Failed to fill gap using /get_missing_events, fetching state instead",
+			)
+		} else if filled {
+			// All of the prev_events of the event are now known to the
+			// roomserver, so it can work out the state at the event itself.
+			return t.processEvent(e, false)
+		}
+	}
+
+	// We don't take the state at the event from the remote server as it is.
+	// Instead we pass the prev_events that we are missing to the roomserver
+	// along with the state before each of them. The roomserver then resolves
+	// the state at the event from the state after all of its prev_events, so
+	// the state that we already know about on our side of the gap is kept.
+	for _, prevEventID := range e.PrevEventIDs() {
+		exists, err := t.prevEventsExist(e.RoomID(), []string{prevEventID})
+		if err != nil {
+			return err
+		}
+		if exists {
+			continue
+		}
+		if err = t.processGapEdge(e.RoomID(), prevEventID, roomVersion); err != nil {
+			return err
+		}
+	}
+	exists, err := t.prevEventsExist(e.RoomID(), e.PrevEventIDs())
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("prev_events of event %q are still missing after fetching them", e.EventID())
+	}
+	return t.processEvent(e, false)
+}
+
+// prevEventsExist returns true if the roomserver knows the state after all of
+// the given events, which means that they aren't just outliers.
+func (t *txnReq) prevEventsExist(roomID string, eventIDs []string) (bool, error) {
+	stateReq := api.QueryStateAfterEventsRequest{
+		RoomID:       roomID,
+		PrevEventIDs: eventIDs,
+	}
+	var stateRes api.QueryStateAfterEventsResponse
+	if err := t.query.QueryStateAfterEvents(t.context, &stateReq, &stateRes); err != nil {
+		return false, err
+	}
+	return stateRes.PrevEventsExist, nil
+}
+
+// processGapEdge fetches an event at the edge of a gap in the room history,
+// and the state before it, from the origin server. The state and the auth
+// events are passed to the roomserver as outliers and the event itself is
+// passed with that state.
+func (t *txnReq) processGapEdge(
+	roomID, eventID string, roomVersion gomatrixserverlib.RoomVersion,
+) error {
+	e, err := t.fetchEvent(roomID, eventID, roomVersion)
+	if err != nil {
+		return err
+	}
+	state, err := t.lookupState(roomID, eventID, roomVersion)
 	if err != nil {
 		return err
 	}
 	// Check that the returned state is valid.
-	if err := state.Check(t.context, t.keys); err != nil {
+	if err = state.Check(t.context, keydb.KeyRingForRoomVersion(t.keys, roomVersion)); err != nil {
 		return err
 	}
 	// Check that the event is allowed by the state.
+	authEvents := state.StateEvents
 retryAllowedState:
-	if err := checkAllowedByState(e, state.StateEvents); err != nil {
+	if err = checkAllowedByState(e, authEvents); err != nil {
 		switch missing := err.(type) {
 		case gomatrixserverlib.MissingAuthEventError:
-			// An auth event was missing so let's look up that event over federation
-			for _, s := range state.StateEvents {
-				if s.EventID() != missing.AuthEventID {
-					continue
-				}
-				err = t.processEventWithMissingState(s, roomVersion)
-				// If there was no error retrieving the event from federation then
-				// we assume that it succeeded, so retry the original state check
-				if err == nil {
-					goto retryAllowedState
-				}
+			// An auth event was missing so let's look up that event over
+			// federation and store it as an outlier.
+			authEvent, fetchErr := t.fetchEvent(roomID, missing.AuthEventID, roomVersion)
+			if fetchErr == nil {
+				fetchErr = t.processOutlier(authEvent, roomVersion)
+			}
+			// If there was no error retrieving the event from federation then
+			// we assume that it succeeded, so retry the original state check
+			if fetchErr == nil {
+				authEvents = append(authEvents, authEvent)
+				goto retryAllowedState
 			}
 		default:
 		}
@@ -275,5 +376,18 @@ retryAllowedState:
 	}
 
 	// pass the event along with the state to the roomserver
-	return t.producer.SendEventWithState(t.context, state, e.Headered(roomVersion))
+	return t.producer.SendEventWithState(t.context, *state, e.Headered(roomVersion))
+}
+
+// processOutlier passes an event that isn't part of the room timeline, such
+// as an auth event fetched from the origin server, to the roomserver.
+func (t *txnReq) processOutlier(
+	e gomatrixserverlib.Event, roomVersion gomatrixserverlib.RoomVersion,
+) error {
+	_, err := t.producer.SendInputRoomEvents(t.context, []api.InputRoomEvent{{
+		Kind:         api.KindOutlier,
+		Event:        e.Headered(roomVersion),
+		AuthEventIDs: e.AuthEventIDs(),
+	}})
+	return err
 }
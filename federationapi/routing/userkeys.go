@@ -0,0 +1,107 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/common/config"
+	keyServerAPI "github.com/matrix-org/dendrite/keyserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+// QueryDeviceKeys implements POST /_matrix/federation/v1/user/keys/query
+func QueryDeviceKeys(
+	httpReq *http.Request,
+	request *gomatrixserverlib.FederationRequest,
+	cfg *config.Dendrite,
+	keyQueryAPI keyServerAPI.KeyServerQueryAPI,
+) util.JSONResponse {
+	var queryReq keyServerAPI.QueryDeviceKeysRequest
+	if err := json.Unmarshal(request.Content(), &queryReq); err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.NotJSON("The request body could not be decoded into valid JSON. " + err.Error()),
+		}
+	}
+	for userID := range queryReq.DeviceKeys {
+		if resErr := checkLocalUser(cfg, userID); resErr != nil {
+			return *resErr
+		}
+	}
+
+	var queryRes keyServerAPI.QueryDeviceKeysResponse
+	if err := keyQueryAPI.QueryDeviceKeys(httpReq.Context(), &queryReq, &queryRes); err != nil {
+		util.GetLogger(httpReq.Context()).WithError(err).Error("keyQueryAPI.QueryDeviceKeys failed")
+		return jsonerror.InternalServerError()
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: queryRes,
+	}
+}
+
+// ClaimOneTimeKeys implements POST /_matrix/federation/v1/user/keys/claim
+func ClaimOneTimeKeys(
+	httpReq *http.Request,
+	request *gomatrixserverlib.FederationRequest,
+	cfg *config.Dendrite,
+	keyInputAPI keyServerAPI.KeyServerInputAPI,
+) util.JSONResponse {
+	var claimReq keyServerAPI.InputClaimOneTimeKeysRequest
+	if err := json.Unmarshal(request.Content(), &claimReq); err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.NotJSON("The request body could not be decoded into valid JSON. " + err.Error()),
+		}
+	}
+	for userID := range claimReq.OneTimeKeys {
+		if resErr := checkLocalUser(cfg, userID); resErr != nil {
+			return *resErr
+		}
+	}
+
+	var claimRes keyServerAPI.InputClaimOneTimeKeysResponse
+	if err := keyInputAPI.InputClaimOneTimeKeys(httpReq.Context(), &claimReq, &claimRes); err != nil {
+		util.GetLogger(httpReq.Context()).WithError(err).Error("keyInputAPI.InputClaimOneTimeKeys failed")
+		return jsonerror.InternalServerError()
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: claimRes,
+	}
+}
+
+// checkLocalUser returns an error response if the user ID isn't valid or
+// doesn't belong to this server.
+func checkLocalUser(cfg *config.Dendrite, userID string) *util.JSONResponse {
+	_, domain, err := gomatrixserverlib.SplitID('@', userID)
+	if err != nil {
+		return &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("Invalid user ID " + userID),
+		}
+	}
+	if domain != cfg.Matrix.ServerName {
+		return &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("User " + userID + " does not belong to this server"),
+		}
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	federationSenderAPI "github.com/matrix-org/dendrite/federationsender/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+	"github.com/sirupsen/logrus"
+)
+
+// How often we will tell the federation sender about a given origin. Busy
+// servers send us many requests, and there is no need to pass every one of
+// them on.
+const wakeupInterval = time.Minute
+
+// FederationWakeups tells the federation sender when a remote server has
+// sent us a valid request, so that it can stop backing off from it.
+type FederationWakeups struct {
+	InputAPI federationSenderAPI.FederationSenderInputAPI
+	origins  sync.Map // gomatrixserverlib.ServerName -> time.Time
+}
+
+// Wakeup implements common.FederationWakeup. Origins that we told the
+// federation sender about recently are skipped without starting a goroutine,
+// otherwise the federation sender is told in the background.
+func (f *FederationWakeups) Wakeup(ctx context.Context, origin gomatrixserverlib.ServerName) {
+	now := time.Now()
+	if last, loaded := f.origins.LoadOrStore(origin, now); loaded {
+		if now.Sub(last.(time.Time)) < wakeupInterval {
+			return
+		}
+		f.origins.Store(origin, now)
+	}
+	go func() {
+		request := federationSenderAPI.InputServersAliveRequest{
+			Servers: []gomatrixserverlib.ServerName{origin},
+		}
+		var response federationSenderAPI.InputServersAliveResponse
+		if err := f.InputAPI.InputServersAlive(ctx, &request, &response); err != nil {
+			util.GetLogger(ctx).WithError(err).WithFields(logrus.Fields{
+				"origin": origin,
+			}).Error("Failed to tell the federation sender that a server is alive")
+			// Let the next request from the origin try again.
+			f.origins.Delete(origin)
+		}
+	}()
+}
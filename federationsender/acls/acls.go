@@ -0,0 +1,211 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package acls
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/sirupsen/logrus"
+)
+
+// MRoomServerACL is the type of the state event that holds the server ACL of
+// a room. See https://matrix.org/docs/spec/client_server/r0.6.0#server-access-control-lists-acls-for-rooms
+const MRoomServerACL = "m.room.server_acl"
+
+// ServerACLs caches the server ACLs of the rooms we know about. Rooms are
+// loaded from the roomserver the first time they are needed and are then kept
+// up to date with OnServerACLUpdate as new ACL events reach the current state
+// and with OnRedactedEvent when they are redacted.
+type ServerACLs struct {
+	query api.RoomserverQueryAPI
+	mutex sync.RWMutex
+	// The compiled ACL of each room, or nil if the room has no ACL.
+	rooms map[string]*serverACL
+}
+
+// NewServerACLs creates an empty ACL cache that loads the ACLs of rooms it
+// doesn't know about yet from the roomserver.
+func NewServerACLs(query api.RoomserverQueryAPI) *ServerACLs {
+	return &ServerACLs{
+		query: query,
+		rooms: make(map[string]*serverACL),
+	}
+}
+
+type serverACLContent struct {
+	Allow           []string `json:"allow"`
+	Deny            []string `json:"deny"`
+	AllowIPLiterals *bool    `json:"allow_ip_literals"`
+}
+
+type serverACL struct {
+	// The ID of the m.room.server_acl event that the ACL was compiled from.
+	eventID         string
+	allow           []*regexp.Regexp
+	deny            []*regexp.Regexp
+	allowIPLiterals bool
+}
+
+// OnServerACLUpdate replaces the cached ACL of the room of the given
+// m.room.server_acl event. Events of other types are ignored.
+func (s *ServerACLs) OnServerACLUpdate(event *gomatrixserverlib.Event) {
+	if event.Type() != MRoomServerACL || !event.StateKeyEquals("") {
+		return
+	}
+	acl, err := compileServerACL(event.EventID(), event.Content())
+	if err != nil {
+		logrus.WithError(err).WithField("event_id", event.EventID()).Warn("Ignoring invalid server ACL event")
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.rooms[event.RoomID()] = acl
+}
+
+// OnRedactedEvent forgets the cached ACL of a room if it was compiled from the
+// redacted event, so that the redacted ACL is loaded from the roomserver the
+// next time it is needed.
+func (s *ServerACLs) OnRedactedEvent(roomID, redactedEventID string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if acl, ok := s.rooms[roomID]; ok && acl != nil && acl.eventID == redactedEventID {
+		delete(s.rooms, roomID)
+	}
+}
+
+// IsServerBannedFromRoom returns true if the server ACL of the room denies
+// the given server. Rooms without an ACL don't ban anyone.
+func (s *ServerACLs) IsServerBannedFromRoom(
+	ctx context.Context, serverName gomatrixserverlib.ServerName, roomID string,
+) (bool, error) {
+	s.mutex.RLock()
+	acl, ok := s.rooms[roomID]
+	s.mutex.RUnlock()
+	if !ok {
+		var err error
+		if acl, err = s.load(ctx, roomID); err != nil {
+			return false, err
+		}
+	}
+	if acl == nil {
+		return false, nil
+	}
+	return !acl.allows(serverName), nil
+}
+
+// load fetches the current ACL of a room from the roomserver and caches it.
+// Rooms that the roomserver doesn't know about aren't cached, so that remote
+// servers can't fill the cache by asking about made up rooms.
+func (s *ServerACLs) load(ctx context.Context, roomID string) (*serverACL, error) {
+	req := api.QueryLatestEventsAndStateRequest{
+		RoomID:       roomID,
+		StateToFetch: []gomatrixserverlib.StateKeyTuple{{EventType: MRoomServerACL, StateKey: ""}},
+	}
+	var res api.QueryLatestEventsAndStateResponse
+	if err := s.query.QueryLatestEventsAndState(ctx, &req, &res); err != nil {
+		return nil, err
+	}
+	if !res.RoomExists {
+		return nil, nil
+	}
+
+	var acl *serverACL
+	for _, event := range res.StateEvents {
+		compiled, err := compileServerACL(event.EventID(), event.Content())
+		if err != nil {
+			logrus.WithError(err).WithField("event_id", event.EventID()).Warn("Ignoring invalid server ACL event")
+			continue
+		}
+		acl = compiled
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	// An update may have arrived while we were talking to the roomserver, in
+	// which case it is newer than what we loaded.
+	if current, ok := s.rooms[roomID]; ok {
+		return current, nil
+	}
+	s.rooms[roomID] = acl
+	return acl, nil
+}
+
+func compileServerACL(eventID string, content []byte) (*serverACL, error) {
+	var c serverACLContent
+	if err := json.Unmarshal(content, &c); err != nil {
+		return nil, err
+	}
+	acl := &serverACL{
+		eventID:         eventID,
+		allowIPLiterals: c.AllowIPLiterals == nil || *c.AllowIPLiterals,
+	}
+	var err error
+	if acl.allow, err = compileGlobs(c.Allow); err != nil {
+		return nil, err
+	}
+	if acl.deny, err = compileGlobs(c.Deny); err != nil {
+		return nil, err
+	}
+	return acl, nil
+}
+
+// compileGlobs turns the server name globs of an ACL, where "*" matches any
+// number of characters and "?" matches exactly one, into regular expressions.
+func compileGlobs(globs []string) ([]*regexp.Regexp, error) {
+	result := make([]*regexp.Regexp, 0, len(globs))
+	for _, glob := range globs {
+		pattern := regexp.QuoteMeta(glob)
+		pattern = strings.Replace(pattern, `\*`, ".*", -1)
+		pattern = strings.Replace(pattern, `\?`, ".", -1)
+		re, err := regexp.Compile("(?i)^" + pattern + "$")
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, re)
+	}
+	return result, nil
+}
+
+// allows checks a server against the ACL. The port of the server name is
+// ignored. Deny rules take precedence over allow rules, and servers that
+// don't match any allow rule are denied.
+func (acl *serverACL) allows(serverName gomatrixserverlib.ServerName) bool {
+	host := string(serverName)
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	if !acl.allowIPLiterals && net.ParseIP(host) != nil {
+		return false
+	}
+	for _, re := range acl.deny {
+		if re.MatchString(host) {
+			return false
+		}
+	}
+	for _, re := range acl.allow {
+		if re.MatchString(host) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,134 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package acls
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+func TestServerACLAllows(t *testing.T) {
+	acl, err := compileServerACL("$acl:example.com", []byte(`{
+		"allow": ["*"],
+		"deny": ["evil.example.com", "*.evil.example.com", "bad?.org"],
+		"allow_ip_literals": false
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := map[gomatrixserverlib.ServerName]bool{
+		"example.com":            true,
+		"example.com:8448":       true,
+		"evil.example.com":       false,
+		"EVIL.example.com:8448":  false,
+		"sub.evil.example.com":   false,
+		"notevil.example.com":    true,
+		"bad1.org":               false,
+		"bad12.org":              true,
+		"1.2.3.4":                false,
+		"1.2.3.4:8448":           false,
+		"[2001:db8::1]:8448":     false,
+		"[2001:db8::1]":          false,
+		"not.an.ip.1.2.3.4.test": true,
+	}
+	for serverName, want := range tests {
+		if got := acl.allows(serverName); got != want {
+			t.Errorf("allows(%q) = %v, want %v", serverName, got, want)
+		}
+	}
+}
+
+func TestServerACLDefaults(t *testing.T) {
+	// Servers must be allowed explicitly, but IP literals are allowed unless
+	// the ACL says otherwise.
+	acl, err := compileServerACL("$acl:example.com", []byte(`{"allow": ["*.example.com", "1.2.3.4"]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := map[gomatrixserverlib.ServerName]bool{
+		"a.example.com": true,
+		"example.org":   false,
+		"1.2.3.4:8448":  true,
+		"5.6.7.8":       false,
+	}
+	for serverName, want := range tests {
+		if got := acl.allows(serverName); got != want {
+			t.Errorf("allows(%q) = %v, want %v", serverName, got, want)
+		}
+	}
+}
+
+type aclQueryAPI struct {
+	api.RoomserverQueryAPI
+	aclContent string
+	loads      int
+}
+
+func (q *aclQueryAPI) QueryLatestEventsAndState(
+	ctx context.Context,
+	request *api.QueryLatestEventsAndStateRequest,
+	response *api.QueryLatestEventsAndStateResponse,
+) error {
+	q.loads++
+	response.RoomExists = true
+	event, err := gomatrixserverlib.NewEventFromTrustedJSON([]byte(fmt.Sprintf(
+		`{"event_id":"$acl:example.com","room_id":%q,"sender":"@alice:example.com","type":%q,"state_key":"","content":%s}`,
+		request.RoomID, MRoomServerACL, q.aclContent,
+	)), false, gomatrixserverlib.RoomVersionV1)
+	if err != nil {
+		return err
+	}
+	response.StateEvents = []gomatrixserverlib.HeaderedEvent{event.Headered(gomatrixserverlib.RoomVersionV1)}
+	return nil
+}
+
+func TestServerACLRedaction(t *testing.T) {
+	ctx := context.Background()
+	query := &aclQueryAPI{aclContent: `{"allow":["*"],"deny":["evil.example.com"]}`}
+	acls := NewServerACLs(query)
+	banned := func(serverName gomatrixserverlib.ServerName) bool {
+		result, err := acls.IsServerBannedFromRoom(ctx, serverName, "!room:example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return result
+	}
+
+	if !banned("evil.example.com") || banned("good.example.com") {
+		t.Fatalf("the ACL wasn't loaded from the roomserver")
+	}
+
+	// Redacting another event keeps the cached ACL.
+	acls.OnRedactedEvent("!room:example.com", "$other:example.com")
+	banned("evil.example.com")
+	if query.loads != 1 {
+		t.Errorf("got %d loads after redacting another event, want 1", query.loads)
+	}
+
+	// Redacting the ACL event loads it again, and a redacted ACL allows no
+	// servers at all.
+	query.aclContent = `{}`
+	acls.OnRedactedEvent("!room:example.com", "$acl:example.com")
+	if !banned("good.example.com") {
+		t.Errorf("the redacted ACL wasn't loaded from the roomserver")
+	}
+	if query.loads != 2 {
+		t.Errorf("got %d loads after redacting the ACL, want 2", query.loads)
+	}
+}
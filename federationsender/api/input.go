@@ -0,0 +1,62 @@
+package api
+
+import (
+	"context"
+	"net/http"
+
+	commonHTTP "github.com/matrix-org/dendrite/common/http"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/opentracing/opentracing-go"
+)
+
+// InputServersAliveRequest is a request to InputServersAlive
+type InputServersAliveRequest struct {
+	// The servers that we have just had a successful request from.
+	Servers []gomatrixserverlib.ServerName `json:"servers"`
+}
+
+// InputServersAliveResponse is a response to InputServersAlive
+type InputServersAliveResponse struct{}
+
+// FederationSenderInputAPI is used to tell the federation sender about
+// things that happened elsewhere.
+type FederationSenderInputAPI interface {
+	// Tell the federation sender that the given servers are reachable, so
+	// that it stops backing off from them and retries anything it has been
+	// holding back for them.
+	InputServersAlive(
+		ctx context.Context,
+		request *InputServersAliveRequest,
+		response *InputServersAliveResponse,
+	) error
+}
+
+// FederationSenderInputServersAlivePath is the HTTP path for the InputServersAlive API.
+const FederationSenderInputServersAlivePath = "/api/federationsender/inputServersAlive"
+
+// NewFederationSenderInputAPIHTTP creates a FederationSenderInputAPI implemented by talking to a HTTP POST API.
+// If httpClient is nil then it uses the http.DefaultClient
+func NewFederationSenderInputAPIHTTP(federationSenderURL string, httpClient *http.Client) FederationSenderInputAPI {
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	return &httpFederationSenderInputAPI{federationSenderURL, httpClient}
+}
+
+type httpFederationSenderInputAPI struct {
+	federationSenderURL string
+	httpClient          *http.Client
+}
+
+// InputServersAlive implements FederationSenderInputAPI
+func (h *httpFederationSenderInputAPI) InputServersAlive(
+	ctx context.Context,
+	request *InputServersAliveRequest,
+	response *InputServersAliveResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "InputServersAlive")
+	defer span.Finish()
+
+	apiURL := h.federationSenderURL + FederationSenderInputServersAlivePath
+	return commonHTTP.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
+}
@@ -31,6 +31,17 @@ type QueryJoinedHostServerNamesInRoomResponse struct {
 	ServerNames []gomatrixserverlib.ServerName `json:"server_names"`
 }
 
+// QueryServerBannedFromRoomRequest is a request to QueryServerBannedFromRoom
+type QueryServerBannedFromRoomRequest struct {
+	ServerName gomatrixserverlib.ServerName `json:"server_name"`
+	RoomID     string                       `json:"room_id"`
+}
+
+// QueryServerBannedFromRoomResponse is a response to QueryServerBannedFromRoom
+type QueryServerBannedFromRoomResponse struct {
+	Banned bool `json:"banned"`
+}
+
 // FederationSenderQueryAPI is used to query information from the federation sender.
 type FederationSenderQueryAPI interface {
 	// Query the joined hosts and the membership events accounting for their participation in a room.
@@ -49,6 +60,12 @@ type FederationSenderQueryAPI interface {
 		request *QueryJoinedHostServerNamesInRoomRequest,
 		response *QueryJoinedHostServerNamesInRoomResponse,
 	) error
+	// Query whether the server ACL of a room denies a server.
+	QueryServerBannedFromRoom(
+		ctx context.Context,
+		request *QueryServerBannedFromRoomRequest,
+		response *QueryServerBannedFromRoomResponse,
+	) error
 }
 
 // FederationSenderQueryJoinedHostsInRoomPath is the HTTP path for the QueryJoinedHostsInRoom API.
@@ -57,6 +74,9 @@ const FederationSenderQueryJoinedHostsInRoomPath = "/api/federationsender/queryJ
 // FederationSenderQueryJoinedHostServerNamesInRoomPath is the HTTP path for the QueryJoinedHostServerNamesInRoom API.
 const FederationSenderQueryJoinedHostServerNamesInRoomPath = "/api/federationsender/queryJoinedHostServerNamesInRoom"
 
+// FederationSenderQueryServerBannedFromRoomPath is the HTTP path for the QueryServerBannedFromRoom API.
+const FederationSenderQueryServerBannedFromRoomPath = "/api/federationsender/queryServerBannedFromRoom"
+
 // NewFederationSenderQueryAPIHTTP creates a FederationSenderQueryAPI implemented by talking to a HTTP POST API.
 // If httpClient is nil then it uses the http.DefaultClient
 func NewFederationSenderQueryAPIHTTP(federationSenderURL string, httpClient *http.Client) FederationSenderQueryAPI {
@@ -96,3 +116,16 @@ func (h *httpFederationSenderQueryAPI) QueryJoinedHostServerNamesInRoom(
 	apiURL := h.federationSenderURL + FederationSenderQueryJoinedHostServerNamesInRoomPath
 	return commonHTTP.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
 }
+
+// QueryServerBannedFromRoom implements FederationSenderQueryAPI
+func (h *httpFederationSenderQueryAPI) QueryServerBannedFromRoom(
+	ctx context.Context,
+	request *QueryServerBannedFromRoomRequest,
+	response *QueryServerBannedFromRoomResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "QueryServerBannedFromRoom")
+	defer span.Finish()
+
+	apiURL := h.federationSenderURL + FederationSenderQueryServerBannedFromRoomPath
+	return commonHTTP.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
+}
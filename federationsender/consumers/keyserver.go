@@ -0,0 +1,148 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumers
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/dendrite/federationsender/acls"
+	"github.com/matrix-org/dendrite/federationsender/queue"
+	"github.com/matrix-org/dendrite/federationsender/storage"
+	"github.com/matrix-org/dendrite/keyserver/api"
+	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/Shopify/sarama.v1"
+)
+
+// OutputKeyChangeEventConsumer consumes device key changes that originate in
+// the key server.
+type OutputKeyChangeEventConsumer struct {
+	consumer   *common.ContinualConsumer
+	db         storage.Database
+	queues     *queue.OutgoingQueues
+	acls       *acls.ServerACLs
+	rsQueryAPI roomserverAPI.RoomserverQueryAPI
+	ServerName gomatrixserverlib.ServerName
+}
+
+// NewOutputKeyChangeEventConsumer creates a new OutputKeyChangeEventConsumer. Call Start() to begin consuming from the key server.
+func NewOutputKeyChangeEventConsumer(
+	cfg *config.Dendrite,
+	kafkaConsumer sarama.Consumer,
+	queues *queue.OutgoingQueues,
+	store storage.Database,
+	rsQueryAPI roomserverAPI.RoomserverQueryAPI,
+	serverACLs *acls.ServerACLs,
+) *OutputKeyChangeEventConsumer {
+	consumer := common.ContinualConsumer{
+		Topic:          string(cfg.Kafka.Topics.OutputKeyChangeEvent),
+		Consumer:       kafkaConsumer,
+		PartitionStore: store,
+	}
+	c := &OutputKeyChangeEventConsumer{
+		consumer:   &consumer,
+		queues:     queues,
+		db:         store,
+		acls:       serverACLs,
+		rsQueryAPI: rsQueryAPI,
+		ServerName: cfg.Matrix.ServerName,
+	}
+	consumer.ProcessMessage = c.onMessage
+
+	return c
+}
+
+// Start consuming from the key server
+func (t *OutputKeyChangeEventConsumer) Start() error {
+	return t.consumer.Start()
+}
+
+// onMessage is called for OutputKeyChangeEvent received from the key server.
+// Parses the msg, creates a m.device_list_update EDU and sends it to every
+// server that shares a room with the user.
+func (t *OutputKeyChangeEventConsumer) onMessage(msg *sarama.ConsumerMessage) error {
+	var okc api.OutputKeyChangeEvent
+	if err := json.Unmarshal(msg.Value, &okc); err != nil {
+		// Skip this msg but continue processing messages.
+		log.WithError(err).Errorf("keyserver output log: message parse failed")
+		return nil
+	}
+
+	// We only want to send device list updates for our own users. Updates
+	// for remote users have come to us over federation already.
+	_, domain, err := gomatrixserverlib.SplitID('@', okc.UserID)
+	if err != nil {
+		log.WithError(err).WithField("user_id", okc.UserID).Error("keyserver output log: invalid user ID")
+		return nil
+	}
+	if domain != t.ServerName {
+		return nil
+	}
+
+	ctx := context.TODO()
+	var queryRes roomserverAPI.QueryRoomsForUserResponse
+	if err = t.rsQueryAPI.QueryRoomsForUser(
+		ctx, &roomserverAPI.QueryRoomsForUserRequest{UserID: okc.UserID}, &queryRes,
+	); err != nil {
+		return err
+	}
+
+	serverSet := map[gomatrixserverlib.ServerName]bool{}
+	for _, roomID := range queryRes.RoomIDs {
+		joined, err := t.db.GetJoinedHosts(ctx, roomID)
+		if err != nil {
+			return err
+		}
+		names := make([]gomatrixserverlib.ServerName, len(joined))
+		for i := range joined {
+			names[i] = joined[i].ServerName
+		}
+		if names, err = filterBannedServers(ctx, t.acls, roomID, names); err != nil {
+			return err
+		}
+		for _, serverName := range names {
+			serverSet[serverName] = true
+		}
+	}
+	names := make([]gomatrixserverlib.ServerName, 0, len(serverSet))
+	for serverName := range serverSet {
+		names = append(names, serverName)
+	}
+
+	// The messages of a user are always written to the same partition, so
+	// the offsets of their messages increase with each update and can be
+	// used as the stream ID of the update. We don't keep track of previous
+	// updates, so prev_id is left empty.
+	update := map[string]interface{}{
+		"user_id":   okc.UserID,
+		"device_id": okc.DeviceID,
+		"stream_id": msg.Offset,
+		"prev_id":   []int64{},
+		"deleted":   okc.Deleted,
+	}
+	if len(okc.Keys) > 0 {
+		update["keys"] = okc.Keys
+	}
+	edu := &gomatrixserverlib.EDU{Type: "m.device_list_update"}
+	if edu.Content, err = json.Marshal(update); err != nil {
+		return err
+	}
+
+	return t.queues.SendEDU(edu, t.ServerName, names)
+}
@@ -0,0 +1,145 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumers
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/dendrite/federationsender/acls"
+	"github.com/matrix-org/dendrite/federationsender/queue"
+	"github.com/matrix-org/dendrite/federationsender/storage"
+	"github.com/matrix-org/dendrite/presenceserver/api"
+	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/Shopify/sarama.v1"
+)
+
+// OutputPresenceEventConsumer consumes events that originate in the presence server.
+type OutputPresenceEventConsumer struct {
+	consumer   *common.ContinualConsumer
+	db         storage.Database
+	queues     *queue.OutgoingQueues
+	acls       *acls.ServerACLs
+	rsQueryAPI roomserverAPI.RoomserverQueryAPI
+	ServerName gomatrixserverlib.ServerName
+}
+
+// NewOutputPresenceEventConsumer creates a new OutputPresenceEventConsumer. Call Start() to begin consuming from presence servers.
+func NewOutputPresenceEventConsumer(
+	cfg *config.Dendrite,
+	kafkaConsumer sarama.Consumer,
+	queues *queue.OutgoingQueues,
+	store storage.Database,
+	rsQueryAPI roomserverAPI.RoomserverQueryAPI,
+	serverACLs *acls.ServerACLs,
+) *OutputPresenceEventConsumer {
+	consumer := common.ContinualConsumer{
+		Topic:          string(cfg.Kafka.Topics.OutputPresenceEvent),
+		Consumer:       kafkaConsumer,
+		PartitionStore: store,
+	}
+	c := &OutputPresenceEventConsumer{
+		consumer:   &consumer,
+		queues:     queues,
+		db:         store,
+		acls:       serverACLs,
+		rsQueryAPI: rsQueryAPI,
+		ServerName: cfg.Matrix.ServerName,
+	}
+	consumer.ProcessMessage = c.onMessage
+
+	return c
+}
+
+// Start consuming from presence servers
+func (t *OutputPresenceEventConsumer) Start() error {
+	return t.consumer.Start()
+}
+
+// onMessage is called for OutputPresenceEvent received from the presence
+// servers. Parses the msg, creates a matrix federation EDU and sends it to
+// every server that shares a room with the user.
+func (t *OutputPresenceEventConsumer) onMessage(msg *sarama.ConsumerMessage) error {
+	var ope api.OutputPresenceEvent
+	if err := json.Unmarshal(msg.Value, &ope); err != nil {
+		// Skip this msg but continue processing messages.
+		log.WithError(err).Errorf("presenceserver output log: message parse failed")
+		return nil
+	}
+
+	// We only want to send presence for our own users. Presence for remote
+	// users has come to us over federation already.
+	_, domain, err := gomatrixserverlib.SplitID('@', ope.UserID)
+	if err != nil {
+		log.WithError(err).WithField("user_id", ope.UserID).Error("presenceserver output log: invalid user ID")
+		return nil
+	}
+	if domain != t.ServerName {
+		return nil
+	}
+
+	ctx := context.TODO()
+	var queryRes roomserverAPI.QueryRoomsForUserResponse
+	if err = t.rsQueryAPI.QueryRoomsForUser(
+		ctx, &roomserverAPI.QueryRoomsForUserRequest{UserID: ope.UserID}, &queryRes,
+	); err != nil {
+		return err
+	}
+
+	serverSet := map[gomatrixserverlib.ServerName]bool{}
+	for _, roomID := range queryRes.RoomIDs {
+		joined, err := t.db.GetJoinedHosts(ctx, roomID)
+		if err != nil {
+			return err
+		}
+		names := make([]gomatrixserverlib.ServerName, len(joined))
+		for i := range joined {
+			names[i] = joined[i].ServerName
+		}
+		if names, err = filterBannedServers(ctx, t.acls, roomID, names); err != nil {
+			return err
+		}
+		for _, serverName := range names {
+			serverSet[serverName] = true
+		}
+	}
+	names := make([]gomatrixserverlib.ServerName, 0, len(serverSet))
+	for serverName := range serverSet {
+		names = append(names, serverName)
+	}
+
+	update := map[string]interface{}{
+		"user_id":          ope.UserID,
+		"presence":         ope.Presence,
+		"currently_active": ope.CurrentlyActive,
+		"last_active_ago":  time.Since(ope.LastActiveTS.Time()).Nanoseconds() / int64(time.Millisecond),
+	}
+	if ope.StatusMsg != "" {
+		update["status_msg"] = ope.StatusMsg
+	}
+	edu := &gomatrixserverlib.EDU{Type: "m.presence"}
+	if edu.Content, err = json.Marshal(map[string]interface{}{
+		"push": []interface{}{update},
+	}); err != nil {
+		return err
+	}
+
+	return t.queues.SendEDU(edu, t.ServerName, names)
+}
@@ -0,0 +1,121 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumers
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/dendrite/federationsender/acls"
+	"github.com/matrix-org/dendrite/federationsender/queue"
+	"github.com/matrix-org/dendrite/federationsender/storage"
+	"github.com/matrix-org/gomatrixserverlib"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/Shopify/sarama.v1"
+)
+
+// OutputReceiptEventConsumer consumes receipts that originate in the client API.
+type OutputReceiptEventConsumer struct {
+	consumer   *common.ContinualConsumer
+	db         storage.Database
+	queues     *queue.OutgoingQueues
+	acls       *acls.ServerACLs
+	ServerName gomatrixserverlib.ServerName
+}
+
+// NewOutputReceiptEventConsumer creates a new OutputReceiptEventConsumer. Call Start() to begin consuming receipts.
+func NewOutputReceiptEventConsumer(
+	cfg *config.Dendrite,
+	kafkaConsumer sarama.Consumer,
+	queues *queue.OutgoingQueues,
+	store storage.Database,
+	serverACLs *acls.ServerACLs,
+) *OutputReceiptEventConsumer {
+	consumer := common.ContinualConsumer{
+		Topic:          string(cfg.Kafka.Topics.OutputReceiptEvent),
+		Consumer:       kafkaConsumer,
+		PartitionStore: store,
+	}
+	c := &OutputReceiptEventConsumer{
+		consumer:   &consumer,
+		queues:     queues,
+		db:         store,
+		acls:       serverACLs,
+		ServerName: cfg.Matrix.ServerName,
+	}
+	consumer.ProcessMessage = c.onMessage
+
+	return c
+}
+
+// Start consuming receipts
+func (t *OutputReceiptEventConsumer) Start() error {
+	return t.consumer.Start()
+}
+
+// onMessage is called for receipts sent by users. Parses the msg, creates a
+// matrix federation EDU and sends it to joined hosts.
+func (t *OutputReceiptEventConsumer) onMessage(msg *sarama.ConsumerMessage) error {
+	var receipt common.Receipt
+	if err := json.Unmarshal(msg.Value, &receipt); err != nil {
+		// Skip this msg but continue processing messages.
+		log.WithError(err).Errorf("receipt output log: message parse failed")
+		return nil
+	}
+
+	// We only want to send receipts for our own users. Receipts for remote
+	// users have come to us over federation already.
+	_, domain, err := gomatrixserverlib.SplitID('@', receipt.UserID)
+	if err != nil {
+		log.WithError(err).WithField("user_id", receipt.UserID).Error("receipt output log: invalid user ID")
+		return nil
+	}
+	if domain != t.ServerName {
+		return nil
+	}
+
+	joined, err := t.db.GetJoinedHosts(context.TODO(), receipt.RoomID)
+	if err != nil {
+		return err
+	}
+
+	names := make([]gomatrixserverlib.ServerName, len(joined))
+	for i := range joined {
+		names[i] = joined[i].ServerName
+	}
+	if names, err = filterBannedServers(context.TODO(), t.acls, receipt.RoomID, names); err != nil {
+		return err
+	}
+
+	edu := &gomatrixserverlib.EDU{Type: "m.receipt"}
+	if edu.Content, err = json.Marshal(map[string]interface{}{
+		receipt.RoomID: map[string]interface{}{
+			receipt.Type: map[string]interface{}{
+				receipt.UserID: map[string]interface{}{
+					"event_ids": []string{receipt.EventID},
+					"data": map[string]interface{}{
+						"ts": receipt.Timestamp,
+					},
+				},
+			},
+		},
+	}); err != nil {
+		return err
+	}
+
+	return t.queues.SendEDU(edu, t.ServerName, names)
+}
@@ -21,6 +21,7 @@ import (
 
 	"github.com/matrix-org/dendrite/common"
 	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/dendrite/federationsender/acls"
 	"github.com/matrix-org/dendrite/federationsender/queue"
 	"github.com/matrix-org/dendrite/federationsender/storage"
 	"github.com/matrix-org/dendrite/federationsender/types"
@@ -36,6 +37,7 @@ type OutputRoomEventConsumer struct {
 	db                 storage.Database
 	queues             *queue.OutgoingQueues
 	query              api.RoomserverQueryAPI
+	acls               *acls.ServerACLs
 }
 
 // NewOutputRoomEventConsumer creates a new OutputRoomEventConsumer. Call Start() to begin consuming from room servers.
@@ -45,6 +47,7 @@ func NewOutputRoomEventConsumer(
 	queues *queue.OutgoingQueues,
 	store storage.Database,
 	queryAPI api.RoomserverQueryAPI,
+	serverACLs *acls.ServerACLs,
 ) *OutputRoomEventConsumer {
 	consumer := common.ContinualConsumer{
 		Topic:          string(cfg.Kafka.Topics.OutputRoomEvent),
@@ -56,6 +59,7 @@ func NewOutputRoomEventConsumer(
 		db:                 store,
 		queues:             queues,
 		query:              queryAPI,
+		acls:               serverACLs,
 	}
 	consumer.ProcessMessage = s.onMessage
 
@@ -79,6 +83,13 @@ func (s *OutputRoomEventConsumer) onMessage(msg *sarama.ConsumerMessage) error {
 		log.WithError(err).Errorf("roomserver output log: message parse failure")
 		return nil
 	}
+	if output.Type == api.OutputTypeRedactedEvent {
+		// The server ACL of the room may have been redacted.
+		s.acls.OnRedactedEvent(
+			output.RedactedEvent.RedactedBecause.RoomID(), output.RedactedEvent.RedactedEventID,
+		)
+		return nil
+	}
 	if output.Type != api.OutputTypeNewRoomEvent {
 		log.WithField("type", output.Type).Debug(
 			"roomserver output log: ignoring unknown output type",
@@ -134,6 +145,11 @@ func (s *OutputRoomEventConsumer) processMessage(ore api.OutputNewRoomEvent) err
 		return err
 	}
 
+	// Keep the server ACLs up to date with the current state of the room.
+	for i := range addsStateEvents {
+		s.acls.OnServerACLUpdate(&addsStateEvents[i])
+	}
+
 	if oldJoinedHosts == nil {
 		// This means that there is nothing to update as this is a duplicate
 		// message.
@@ -152,6 +168,12 @@ func (s *OutputRoomEventConsumer) processMessage(ore api.OutputNewRoomEvent) err
 	if err != nil {
 		return err
 	}
+	joinedHostsAtEvent, err = filterBannedServers(
+		context.TODO(), s.acls, ore.Event.RoomID(), joinedHostsAtEvent,
+	)
+	if err != nil {
+		return err
+	}
 
 	// Send the event.
 	return s.queues.SendEvent(
@@ -247,6 +269,25 @@ func joinedHostsFromEvents(evs []gomatrixserverlib.Event) ([]types.JoinedHost, e
 	return joinedHosts, nil
 }
 
+// filterBannedServers removes the servers that are denied by the server ACL
+// of the room from a list of destinations.
+func filterBannedServers(
+	ctx context.Context, serverACLs *acls.ServerACLs, roomID string,
+	serverNames []gomatrixserverlib.ServerName,
+) ([]gomatrixserverlib.ServerName, error) {
+	result := make([]gomatrixserverlib.ServerName, 0, len(serverNames))
+	for _, serverName := range serverNames {
+		banned, err := serverACLs.IsServerBannedFromRoom(ctx, serverName, roomID)
+		if err != nil {
+			return nil, err
+		}
+		if !banned {
+			result = append(result, serverName)
+		}
+	}
+	return result, nil
+}
+
 // combineDeltas combines two deltas into a single delta.
 // Assumes that the order of operations is add(1), remove(1), add(2), remove(2).
 // Removes duplicate entries and redundant operations from each delta.
@@ -0,0 +1,119 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumers
+
+import (
+	"encoding/json"
+
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/dendrite/federationsender/queue"
+	"github.com/matrix-org/dendrite/federationsender/storage"
+	"github.com/matrix-org/gomatrixserverlib"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/Shopify/sarama.v1"
+)
+
+// OutputSendToDeviceEventConsumer consumes send-to-device messages that
+// originate in the client API.
+type OutputSendToDeviceEventConsumer struct {
+	consumer   *common.ContinualConsumer
+	db         storage.Database
+	queues     *queue.OutgoingQueues
+	ServerName gomatrixserverlib.ServerName
+}
+
+// NewOutputSendToDeviceEventConsumer creates a new OutputSendToDeviceEventConsumer. Call Start() to begin consuming send-to-device messages.
+func NewOutputSendToDeviceEventConsumer(
+	cfg *config.Dendrite,
+	kafkaConsumer sarama.Consumer,
+	queues *queue.OutgoingQueues,
+	store storage.Database,
+) *OutputSendToDeviceEventConsumer {
+	consumer := common.ContinualConsumer{
+		Topic:          string(cfg.Kafka.Topics.OutputSendToDeviceEvent),
+		Consumer:       kafkaConsumer,
+		PartitionStore: store,
+	}
+	c := &OutputSendToDeviceEventConsumer{
+		consumer:   &consumer,
+		queues:     queues,
+		db:         store,
+		ServerName: cfg.Matrix.ServerName,
+	}
+	consumer.ProcessMessage = c.onMessage
+
+	return c
+}
+
+// Start consuming send-to-device messages
+func (t *OutputSendToDeviceEventConsumer) Start() error {
+	return t.consumer.Start()
+}
+
+// onMessage is called for send-to-device messages sent by our users. Parses
+// the msg, and sends a m.direct_to_device EDU to each server that the messages
+// are addressed to.
+func (t *OutputSendToDeviceEventConsumer) onMessage(msg *sarama.ConsumerMessage) error {
+	var output common.SendToDevice
+	if err := json.Unmarshal(msg.Value, &output); err != nil {
+		// Skip this msg but continue processing messages.
+		log.WithError(err).Errorf("send-to-device output log: message parse failed")
+		return nil
+	}
+
+	// We only want to relay messages sent by our own users. Messages from
+	// remote users have come to us over federation already.
+	_, domain, err := gomatrixserverlib.SplitID('@', output.Sender)
+	if err != nil {
+		log.WithError(err).WithField("sender", output.Sender).Error("send-to-device output log: invalid user ID")
+		return nil
+	}
+	if domain != t.ServerName {
+		return nil
+	}
+
+	byServer := map[gomatrixserverlib.ServerName]map[string]map[string]json.RawMessage{}
+	for userID, devices := range output.Messages {
+		_, serverName, err := gomatrixserverlib.SplitID('@', userID)
+		if err != nil {
+			log.WithError(err).WithField("user_id", userID).Error("send-to-device output log: invalid user ID")
+			continue
+		}
+		if serverName == t.ServerName {
+			continue
+		}
+		if _, ok := byServer[serverName]; !ok {
+			byServer[serverName] = map[string]map[string]json.RawMessage{}
+		}
+		byServer[serverName][userID] = devices
+	}
+
+	for serverName, messages := range byServer {
+		edu := &gomatrixserverlib.EDU{Type: "m.direct_to_device"}
+		if edu.Content, err = json.Marshal(map[string]interface{}{
+			"sender":     output.Sender,
+			"type":       output.Type,
+			"message_id": output.MessageID,
+			"messages":   messages,
+		}); err != nil {
+			return err
+		}
+		if err = t.queues.SendEDU(edu, t.ServerName, []gomatrixserverlib.ServerName{serverName}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -18,6 +18,7 @@ import (
 
 	"github.com/matrix-org/dendrite/common"
 	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/dendrite/federationsender/acls"
 	"github.com/matrix-org/dendrite/federationsender/queue"
 	"github.com/matrix-org/dendrite/federationsender/storage"
 	"github.com/matrix-org/dendrite/typingserver/api"
@@ -31,6 +32,7 @@ type OutputTypingEventConsumer struct {
 	consumer   *common.ContinualConsumer
 	db         storage.Database
 	queues     *queue.OutgoingQueues
+	acls       *acls.ServerACLs
 	ServerName gomatrixserverlib.ServerName
 }
 
@@ -40,6 +42,7 @@ func NewOutputTypingEventConsumer(
 	kafkaConsumer sarama.Consumer,
 	queues *queue.OutgoingQueues,
 	store storage.Database,
+	serverACLs *acls.ServerACLs,
 ) *OutputTypingEventConsumer {
 	consumer := common.ContinualConsumer{
 		Topic:          string(cfg.Kafka.Topics.OutputTypingEvent),
@@ -50,6 +53,7 @@ func NewOutputTypingEventConsumer(
 		consumer:   &consumer,
 		queues:     queues,
 		db:         store,
+		acls:       serverACLs,
 		ServerName: cfg.Matrix.ServerName,
 	}
 	consumer.ProcessMessage = c.onMessage
@@ -73,6 +77,17 @@ func (t *OutputTypingEventConsumer) onMessage(msg *sarama.ConsumerMessage) error
 		return nil
 	}
 
+	// We only want to send typing events for our own users. Typing events
+	// for remote users have come to us over federation already.
+	_, domain, err := gomatrixserverlib.SplitID('@', ote.Event.UserID)
+	if err != nil {
+		log.WithError(err).WithField("user_id", ote.Event.UserID).Error("typingserver output log: invalid user ID")
+		return nil
+	}
+	if domain != t.ServerName {
+		return nil
+	}
+
 	joined, err := t.db.GetJoinedHosts(context.TODO(), ote.Event.RoomID)
 	if err != nil {
 		return err
@@ -82,6 +97,9 @@ func (t *OutputTypingEventConsumer) onMessage(msg *sarama.ConsumerMessage) error
 	for i := range joined {
 		names[i] = joined[i].ServerName
 	}
+	if names, err = filterBannedServers(context.TODO(), t.acls, ote.Event.RoomID, names); err != nil {
+		return err
+	}
 
 	edu := &gomatrixserverlib.EDU{Type: ote.Event.Type}
 	if edu.Content, err = json.Marshal(map[string]interface{}{
@@ -18,8 +18,10 @@ import (
 	"net/http"
 
 	"github.com/matrix-org/dendrite/common/basecomponent"
+	"github.com/matrix-org/dendrite/federationsender/acls"
 	"github.com/matrix-org/dendrite/federationsender/api"
 	"github.com/matrix-org/dendrite/federationsender/consumers"
+	"github.com/matrix-org/dendrite/federationsender/input"
 	"github.com/matrix-org/dendrite/federationsender/query"
 	"github.com/matrix-org/dendrite/federationsender/queue"
 	"github.com/matrix-org/dendrite/federationsender/storage"
@@ -29,38 +31,81 @@ import (
 )
 
 // SetupFederationSenderComponent sets up and registers HTTP handlers for the
-// FederationSender component.
+// FederationSender component. Returns instances of the federation sender
+// APIs, allowing other components running in the same process to hit them
+// directly instead of having to use HTTP.
 func SetupFederationSenderComponent(
 	base *basecomponent.BaseDendrite,
 	federation *gomatrixserverlib.FederationClient,
 	rsQueryAPI roomserverAPI.RoomserverQueryAPI,
-) api.FederationSenderQueryAPI {
+) (api.FederationSenderInputAPI, api.FederationSenderQueryAPI) {
 	federationSenderDB, err := storage.NewDatabase(string(base.Cfg.Database.FederationSender))
 	if err != nil {
 		logrus.WithError(err).Panic("failed to connect to federation sender db")
 	}
 
-	queues := queue.NewOutgoingQueues(base.Cfg.Matrix.ServerName, federation)
+	queues, err := queue.NewOutgoingQueues(
+		federationSenderDB, base.Cfg.Matrix.ServerName, federation,
+	)
+	if err != nil {
+		logrus.WithError(err).Panic("failed to load outgoing federation queues")
+	}
+
+	serverACLs := acls.NewServerACLs(rsQueryAPI)
 
 	rsConsumer := consumers.NewOutputRoomEventConsumer(
 		base.Cfg, base.KafkaConsumer, queues,
-		federationSenderDB, rsQueryAPI,
+		federationSenderDB, rsQueryAPI, serverACLs,
 	)
 	if err = rsConsumer.Start(); err != nil {
 		logrus.WithError(err).Panic("failed to start room server consumer")
 	}
 
 	tsConsumer := consumers.NewOutputTypingEventConsumer(
-		base.Cfg, base.KafkaConsumer, queues, federationSenderDB,
+		base.Cfg, base.KafkaConsumer, queues, federationSenderDB, serverACLs,
 	)
 	if err := tsConsumer.Start(); err != nil {
 		logrus.WithError(err).Panic("failed to start typing server consumer")
 	}
 
+	stdConsumer := consumers.NewOutputSendToDeviceEventConsumer(
+		base.Cfg, base.KafkaConsumer, queues, federationSenderDB,
+	)
+	if err := stdConsumer.Start(); err != nil {
+		logrus.WithError(err).Panic("failed to start send-to-device consumer")
+	}
+
+	receiptConsumer := consumers.NewOutputReceiptEventConsumer(
+		base.Cfg, base.KafkaConsumer, queues, federationSenderDB, serverACLs,
+	)
+	if err := receiptConsumer.Start(); err != nil {
+		logrus.WithError(err).Panic("failed to start receipt consumer")
+	}
+
+	psConsumer := consumers.NewOutputPresenceEventConsumer(
+		base.Cfg, base.KafkaConsumer, queues, federationSenderDB, rsQueryAPI, serverACLs,
+	)
+	if err := psConsumer.Start(); err != nil {
+		logrus.WithError(err).Panic("failed to start presence server consumer")
+	}
+
+	keyConsumer := consumers.NewOutputKeyChangeEventConsumer(
+		base.Cfg, base.KafkaConsumer, queues, federationSenderDB, rsQueryAPI, serverACLs,
+	)
+	if err := keyConsumer.Start(); err != nil {
+		logrus.WithError(err).Panic("failed to start key server consumer")
+	}
+
+	inputAPI := input.FederationSenderInputAPI{
+		Queues: queues,
+	}
+	inputAPI.SetupHTTP(http.DefaultServeMux)
+
 	queryAPI := query.FederationSenderQueryAPI{
-		DB: federationSenderDB,
+		DB:   federationSenderDB,
+		ACLs: serverACLs,
 	}
 	queryAPI.SetupHTTP(http.DefaultServeMux)
 
-	return &queryAPI
+	return &inputAPI, &queryAPI
 }
@@ -0,0 +1,59 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package input
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/federationsender/api"
+	"github.com/matrix-org/dendrite/federationsender/queue"
+	"github.com/matrix-org/util"
+)
+
+// FederationSenderInputAPI is an implementation of api.FederationSenderInputAPI
+type FederationSenderInputAPI struct {
+	Queues *queue.OutgoingQueues
+}
+
+// InputServersAlive implements api.FederationSenderInputAPI
+func (f *FederationSenderInputAPI) InputServersAlive(
+	ctx context.Context,
+	request *api.InputServersAliveRequest,
+	response *api.InputServersAliveResponse,
+) error {
+	f.Queues.ServersAlive(request.Servers)
+	return nil
+}
+
+// SetupHTTP adds the FederationSenderInputAPI handlers to the http.ServeMux.
+func (f *FederationSenderInputAPI) SetupHTTP(servMux *http.ServeMux) {
+	servMux.Handle(
+		api.FederationSenderInputServersAlivePath,
+		common.MakeInternalAPI("InputServersAlive", func(req *http.Request) util.JSONResponse {
+			var request api.InputServersAliveRequest
+			var response api.InputServersAliveResponse
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				return util.MessageResponse(http.StatusBadRequest, err.Error())
+			}
+			if err := f.InputServersAlive(req.Context(), &request, &response); err != nil {
+				return util.ErrorResponse(err)
+			}
+			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
+		}),
+	)
+}
@@ -6,6 +6,7 @@ import (
 	"net/http"
 
 	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/federationsender/acls"
 	"github.com/matrix-org/dendrite/federationsender/api"
 	"github.com/matrix-org/dendrite/federationsender/types"
 	"github.com/matrix-org/gomatrixserverlib"
@@ -21,7 +22,8 @@ type FederationSenderQueryDatabase interface {
 
 // FederationSenderQueryAPI is an implementation of api.FederationSenderQueryAPI
 type FederationSenderQueryAPI struct {
-	DB FederationSenderQueryDatabase
+	DB   FederationSenderQueryDatabase
+	ACLs *acls.ServerACLs
 }
 
 // QueryJoinedHostsInRoom implements api.FederationSenderQueryAPI
@@ -55,6 +57,16 @@ func (f *FederationSenderQueryAPI) QueryJoinedHostServerNamesInRoom(
 	return
 }
 
+// QueryServerBannedFromRoom implements api.FederationSenderQueryAPI
+func (f *FederationSenderQueryAPI) QueryServerBannedFromRoom(
+	ctx context.Context,
+	request *api.QueryServerBannedFromRoomRequest,
+	response *api.QueryServerBannedFromRoomResponse,
+) (err error) {
+	response.Banned, err = f.ACLs.IsServerBannedFromRoom(ctx, request.ServerName, request.RoomID)
+	return
+}
+
 // SetupHTTP adds the FederationSenderQueryAPI handlers to the http.ServeMux.
 func (f *FederationSenderQueryAPI) SetupHTTP(servMux *http.ServeMux) {
 	servMux.Handle(
@@ -85,4 +97,18 @@ func (f *FederationSenderQueryAPI) SetupHTTP(servMux *http.ServeMux) {
 			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
 		}),
 	)
+	servMux.Handle(
+		api.FederationSenderQueryServerBannedFromRoomPath,
+		common.MakeInternalAPI("QueryServerBannedFromRoom", func(req *http.Request) util.JSONResponse {
+			var request api.QueryServerBannedFromRoomRequest
+			var response api.QueryServerBannedFromRoomResponse
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				return util.ErrorResponse(err)
+			}
+			if err := f.QueryServerBannedFromRoom(req.Context(), &request, &response); err != nil {
+				return util.ErrorResponse(err)
+			}
+			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
+		}),
+	)
 }
@@ -0,0 +1,132 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package queue
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+const (
+	// The interval to wait after the first failure before retrying.
+	retryInitialInterval = 2 * time.Second
+	// The longest interval we will wait between two attempts.
+	retryMaxInterval = time.Hour
+	// The number of consecutive failures after which a destination is
+	// considered to be uncooperative and is marked as backing off.
+	backoffThreshold = 5
+)
+
+// RetryState describes how we are retrying requests to a destination.
+type RetryState struct {
+	// The number of consecutive attempts to send to the destination that
+	// have failed. Reset to zero once a transaction succeeds.
+	FailedAttempts uint32 `json:"failed_attempts"`
+	// Whether the destination has failed often enough that we consider it
+	// to be uncooperative.
+	BackingOff bool `json:"backing_off"`
+	// The time at which the next attempt will be made, if a retry is
+	// currently scheduled.
+	RetryAt time.Time `json:"retry_at,omitempty"`
+}
+
+// backoff tracks the failures for a single destination and works out how
+// long to wait before trying again. It is safe to use from multiple
+// goroutines.
+type backoff struct {
+	mutex          sync.Mutex
+	failedAttempts uint32
+	retryAt        time.Time
+	// interrupt is used to cut a wait short when we learn that the
+	// destination is alive again.
+	interrupt chan struct{}
+}
+
+func newBackoff() *backoff {
+	return &backoff{
+		interrupt: make(chan struct{}, 1),
+	}
+}
+
+// success resets the failure count after a successful request.
+func (b *backoff) success() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.failedAttempts = 0
+	b.retryAt = time.Time{}
+}
+
+// failure records a failed request and returns how long to wait before
+// the next attempt.
+func (b *backoff) failure() time.Duration {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.failedAttempts++
+	wait := backoffInterval(b.failedAttempts)
+	b.retryAt = time.Now().Add(wait)
+	return wait
+}
+
+// wait blocks until either the duration has elapsed or the destination
+// has been marked as alive.
+func (b *backoff) wait(duration time.Duration) {
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-b.interrupt:
+	}
+}
+
+// alive clears any failures for the destination and interrupts a pending
+// wait so that sending is retried straight away.
+func (b *backoff) alive() {
+	b.success()
+	select {
+	case b.interrupt <- struct{}{}:
+	default:
+	}
+}
+
+// state returns a snapshot of the retry state.
+func (b *backoff) state() RetryState {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return RetryState{
+		FailedAttempts: b.failedAttempts,
+		BackingOff:     b.failedAttempts >= backoffThreshold,
+		RetryAt:        b.retryAt,
+	}
+}
+
+// backoffInterval returns the interval to wait after the given number of
+// consecutive failures. The interval doubles with each failure up to
+// retryMaxInterval, and is then jittered by up to half of its length so
+// that retries to many servers do not all line up.
+func backoffInterval(failedAttempts uint32) time.Duration {
+	if failedAttempts == 0 {
+		return 0
+	}
+	interval := retryInitialInterval
+	for i := uint32(1); i < failedAttempts && interval < retryMaxInterval; i++ {
+		interval *= 2
+	}
+	if interval > retryMaxInterval {
+		interval = retryMaxInterval
+	}
+	jitter := time.Duration(rand.Int63n(int64(interval / 2)))
+	return interval/2 + jitter
+}
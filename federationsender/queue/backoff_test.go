@@ -0,0 +1,73 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package queue
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoffInterval(t *testing.T) {
+	tests := []struct {
+		failedAttempts uint32
+		min, max       time.Duration
+	}{
+		{1, time.Second, 2 * time.Second},
+		{2, 2 * time.Second, 4 * time.Second},
+		{3, 4 * time.Second, 8 * time.Second},
+		{30, retryMaxInterval / 2, retryMaxInterval},
+	}
+	for _, tt := range tests {
+		for i := 0; i < 100; i++ {
+			got := backoffInterval(tt.failedAttempts)
+			if got < tt.min || got > tt.max {
+				t.Fatalf(
+					"backoffInterval(%d) = %s, want between %s and %s",
+					tt.failedAttempts, got, tt.min, tt.max,
+				)
+			}
+		}
+	}
+}
+
+func TestBackoffState(t *testing.T) {
+	b := newBackoff()
+	for i := 0; i < backoffThreshold; i++ {
+		if b.state().BackingOff {
+			t.Fatalf("backing off after only %d failures", i)
+		}
+		b.failure()
+	}
+	if !b.state().BackingOff {
+		t.Fatalf("not backing off after %d failures", backoffThreshold)
+	}
+
+	b.alive()
+	if state := b.state(); state.BackingOff || state.FailedAttempts != 0 {
+		t.Fatalf("alive did not reset the retry state: %+v", state)
+	}
+
+	// alive should interrupt a wait rather than making us sit it out.
+	done := make(chan struct{})
+	go func() {
+		b.wait(time.Hour)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("wait was not interrupted by alive")
+	}
+}
@@ -21,49 +21,84 @@ import (
 	"sync"
 	"time"
 
+	"github.com/matrix-org/dendrite/federationsender/storage"
+	"github.com/matrix-org/dendrite/federationsender/types"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
 	log "github.com/sirupsen/logrus"
 )
 
+const (
+	// The maximum number of PDUs that the spec allows in a transaction.
+	maxPDUsPerTransaction = 50
+	// The maximum number of EDUs that the spec allows in a transaction.
+	maxEDUsPerTransaction = 100
+)
+
 // destinationQueue is a queue of events for a single destination.
 // It is responsible for sending the events to the destination and
 // ensures that only one request is in flight to a given destination
 // at a time.
 type destinationQueue struct {
-	client      *gomatrixserverlib.FederationClient
+	db          storage.Database
+	client      transactionSender
 	origin      gomatrixserverlib.ServerName
 	destination gomatrixserverlib.ServerName
-	// The running mutex protects running, sentCounter, lastTransactionIDs and
-	// pendingEvents, pendingEDUs.
+	backoff     *backoff
+	// The running mutex protects running, sentCounter, lastTransactionIDs,
+	// retryTransactions, pendingEvents and pendingEDUs.
 	runningMutex       sync.Mutex
 	running            bool
 	sentCounter        int
 	lastTransactionIDs []gomatrixserverlib.TransactionID
-	pendingEvents      []*gomatrixserverlib.HeaderedEvent
-	pendingEDUs        []*gomatrixserverlib.EDU
+	retryTransactions  []*queuedTransaction
+	pendingEvents      []*types.QueuedPDU
+	pendingEDUs        []*types.QueuedEDU
+}
+
+// queuedTransaction is a transaction along with the positions of the PDUs
+// and EDUs that it contains in the queue database, so that they can be
+// removed from the database once the transaction has been sent.
+type queuedTransaction struct {
+	transaction gomatrixserverlib.Transaction
+	pduNIDs     []int64
+	eduNIDs     []int64
 }
 
 // Send event adds the event to the pending queue for the destination.
 // If the queue is empty then it starts a background goroutine to
 // start sending events to that destination.
-func (oq *destinationQueue) sendEvent(ev *gomatrixserverlib.HeaderedEvent) {
+func (oq *destinationQueue) sendEvent(pdu *types.QueuedPDU) {
 	oq.runningMutex.Lock()
 	defer oq.runningMutex.Unlock()
-	oq.pendingEvents = append(oq.pendingEvents, ev)
-	if !oq.running {
-		oq.running = true
-		go oq.backgroundSend()
-	}
+	oq.pendingEvents = append(oq.pendingEvents, pdu)
+	oq.wakeup()
 }
 
 // sendEDU adds the EDU event to the pending queue for the destination.
 // If the queue is empty then it starts a background goroutine to
 // start sending event to that destination.
-func (oq *destinationQueue) sendEDU(e *gomatrixserverlib.EDU) {
+func (oq *destinationQueue) sendEDU(edu *types.QueuedEDU) {
+	oq.runningMutex.Lock()
+	defer oq.runningMutex.Unlock()
+	oq.pendingEDUs = append(oq.pendingEDUs, edu)
+	oq.wakeup()
+}
+
+// retryTransaction adds a transaction that was batched up before a restart
+// of the federation sender, and which must be sent again with the same
+// transaction ID before anything else is sent to the destination.
+func (oq *destinationQueue) retryTransaction(t *queuedTransaction) {
 	oq.runningMutex.Lock()
 	defer oq.runningMutex.Unlock()
-	oq.pendingEDUs = append(oq.pendingEDUs, e)
+	oq.retryTransactions = append(oq.retryTransactions, t)
+	oq.lastTransactionIDs = []gomatrixserverlib.TransactionID{t.transaction.TransactionID}
+	oq.wakeup()
+}
+
+// wakeup starts the background goroutine if it isn't already running.
+// The runningMutex must be held by the caller.
+func (oq *destinationQueue) wakeup() {
 	if !oq.running {
 		oq.running = true
 		go oq.backgroundSend()
@@ -71,36 +106,84 @@ func (oq *destinationQueue) sendEDU(e *gomatrixserverlib.EDU) {
 }
 
 func (oq *destinationQueue) backgroundSend() {
+	var t *queuedTransaction
 	for {
-		t := oq.next()
+		// If the previous transaction failed then we retry it as-is, so
+		// that the remote server can deduplicate it using the transaction
+		// ID if it did in fact receive it the first time.
 		if t == nil {
-			// If the queue is empty then stop processing for this destination.
-			// TODO: Remove this destination from the queue map.
-			return
+			if t = oq.next(); t == nil {
+				// If the queue is empty then stop processing for this destination.
+				// TODO: Remove this destination from the queue map.
+				return
+			}
+			oq.storeTransactionID(t)
 		}
 
-		// TODO: handle retries.
-		// TODO: blacklist uncooperative servers.
-
-		util.GetLogger(context.TODO()).Infof("Sending transaction %q containing %d PDUs, %d EDUs", t.TransactionID, len(t.PDUs), len(t.EDUs))
+		util.GetLogger(context.TODO()).Infof("Sending transaction %q containing %d PDUs, %d EDUs", t.transaction.TransactionID, len(t.transaction.PDUs), len(t.transaction.EDUs))
 
-		_, err := oq.client.SendTransaction(context.TODO(), *t)
+		_, err := oq.client.SendTransaction(context.TODO(), t.transaction)
 		if err != nil {
+			wait := oq.backoff.failure()
+			state := oq.backoff.state()
 			log.WithFields(log.Fields{
-				"destination": oq.destination,
-				log.ErrorKey:  err,
-			}).Info("problem sending transaction")
+				"destination":     oq.destination,
+				"transaction_id":  t.transaction.TransactionID,
+				"failed_attempts": state.FailedAttempts,
+				"backing_off":     state.BackingOff,
+				"retry_in":        wait,
+				log.ErrorKey:      err,
+			}).Info("problem sending transaction, will retry")
+			oq.backoff.wait(wait)
+			continue
 		}
+
+		oq.backoff.success()
+		if err = oq.db.DeleteQueued(context.TODO(), t.pduNIDs, t.eduNIDs); err != nil {
+			// The transaction was sent, so the worst that can happen is
+			// that it is sent again after a restart.
+			log.WithFields(log.Fields{
+				"destination":    oq.destination,
+				"transaction_id": t.transaction.TransactionID,
+				log.ErrorKey:     err,
+			}).Error("failed to remove sent transaction from the queue database")
+		}
+		t = nil
 	}
 }
 
-// next creates a new transaction from the pending event queue
-// and flushes the queue.
+// storeTransactionID remembers which transaction the PDUs and EDUs went into,
+// so that the same transaction can be retried if we are restarted before it
+// has been sent.
+func (oq *destinationQueue) storeTransactionID(t *queuedTransaction) {
+	if err := oq.db.SetQueueTransactionID(
+		context.TODO(), t.transaction.TransactionID, t.pduNIDs, t.eduNIDs,
+	); err != nil {
+		// If this fails then the PDUs and EDUs will be put into a new
+		// transaction after a restart, which the remote server will cope
+		// with, so there's no reason not to send them now.
+		log.WithFields(log.Fields{
+			"destination":    oq.destination,
+			"transaction_id": t.transaction.TransactionID,
+			log.ErrorKey:     err,
+		}).Error("failed to store transaction ID in the queue database")
+	}
+}
+
+// next returns the next transaction to send. Transactions recovered from the
+// database are returned first, otherwise a new transaction is created from
+// the pending event queue, taking as many PDUs and EDUs as the spec allows.
 // Returns nil if the queue was empty.
-func (oq *destinationQueue) next() *gomatrixserverlib.Transaction {
+func (oq *destinationQueue) next() *queuedTransaction {
 	oq.runningMutex.Lock()
 	defer oq.runningMutex.Unlock()
 
+	if len(oq.retryTransactions) > 0 {
+		t := oq.retryTransactions[0]
+		oq.retryTransactions = oq.retryTransactions[1:]
+		return t
+	}
+
 	if len(oq.pendingEvents) == 0 && len(oq.pendingEDUs) == 0 {
 		oq.running = false
 		return nil
@@ -122,19 +205,32 @@ func (oq *destinationQueue) next() *gomatrixserverlib.Transaction {
 
 	oq.lastTransactionIDs = []gomatrixserverlib.TransactionID{t.TransactionID}
 
-	for _, pdu := range oq.pendingEvents {
+	qt := &queuedTransaction{}
+
+	pdus := oq.pendingEvents
+	if len(pdus) > maxPDUsPerTransaction {
+		pdus = pdus[:maxPDUsPerTransaction]
+	}
+	for _, pdu := range pdus {
 		// Append the JSON of the event, since this is a json.RawMessage type in the
 		// gomatrixserverlib.Transaction struct
-		t.PDUs = append(t.PDUs, (*pdu).JSON())
+		t.PDUs = append(t.PDUs, pdu.Event.JSON())
+		qt.pduNIDs = append(qt.pduNIDs, pdu.NID)
 	}
-	oq.pendingEvents = nil
+	oq.pendingEvents = oq.pendingEvents[len(pdus):]
 	oq.sentCounter += len(t.PDUs)
 
-	for _, edu := range oq.pendingEDUs {
-		t.EDUs = append(t.EDUs, *edu)
+	edus := oq.pendingEDUs
+	if len(edus) > maxEDUsPerTransaction {
+		edus = edus[:maxEDUsPerTransaction]
+	}
+	for _, edu := range edus {
+		t.EDUs = append(t.EDUs, *edu.EDU)
+		qt.eduNIDs = append(qt.eduNIDs, edu.NID)
 	}
-	oq.pendingEDUs = nil
+	oq.pendingEDUs = oq.pendingEDUs[len(edus):]
 	oq.sentCounter += len(t.EDUs)
 
-	return &t
+	qt.transaction = t
+	return qt
 }
@@ -15,30 +15,139 @@
 package queue
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"sync"
+	"time"
 
+	"github.com/matrix-org/dendrite/federationsender/storage"
+	"github.com/matrix-org/dendrite/federationsender/types"
 	"github.com/matrix-org/gomatrixserverlib"
 	log "github.com/sirupsen/logrus"
 )
 
+// transactionSender is the part of the federation client that the queues
+// use to send transactions.
+type transactionSender interface {
+	SendTransaction(ctx context.Context, t gomatrixserverlib.Transaction) (gomatrixserverlib.RespSend, error)
+}
+
 // OutgoingQueues is a collection of queues for sending transactions to other
 // matrix servers
 type OutgoingQueues struct {
+	db     storage.Database
 	origin gomatrixserverlib.ServerName
-	client *gomatrixserverlib.FederationClient
+	client transactionSender
 	// The queuesMutex protects queues
 	queuesMutex sync.Mutex
 	queues      map[gomatrixserverlib.ServerName]*destinationQueue
 }
 
-// NewOutgoingQueues makes a new OutgoingQueues
-func NewOutgoingQueues(origin gomatrixserverlib.ServerName, client *gomatrixserverlib.FederationClient) *OutgoingQueues {
-	return &OutgoingQueues{
+// NewOutgoingQueues makes a new OutgoingQueues. Anything that was still
+// waiting to be sent when the federation sender was last stopped is loaded
+// from the database and sending is resumed.
+func NewOutgoingQueues(
+	db storage.Database,
+	origin gomatrixserverlib.ServerName,
+	client *gomatrixserverlib.FederationClient,
+) (*OutgoingQueues, error) {
+	oqs := &OutgoingQueues{
+		db:     db,
 		origin: origin,
 		client: client,
 		queues: map[gomatrixserverlib.ServerName]*destinationQueue{},
 	}
+	if err := oqs.resume(context.Background()); err != nil {
+		return nil, err
+	}
+	return oqs, nil
+}
+
+// resume reloads the queued PDUs and EDUs from the database. Those that had
+// already been batched into a transaction are sent again in the same
+// transaction, the rest are queued up as though they had just been sent.
+func (oqs *OutgoingQueues) resume(ctx context.Context) error {
+	pdus, edus, err := oqs.db.GetQueued(ctx)
+	if err != nil {
+		return err
+	}
+
+	type transactionKey struct {
+		destination   gomatrixserverlib.ServerName
+		transactionID gomatrixserverlib.TransactionID
+	}
+	transactions := map[transactionKey]*queuedTransaction{}
+	var order []transactionKey
+	getTransaction := func(
+		destination gomatrixserverlib.ServerName,
+		transactionID gomatrixserverlib.TransactionID,
+	) *queuedTransaction {
+		key := transactionKey{destination, transactionID}
+		t := transactions[key]
+		if t == nil {
+			t = &queuedTransaction{
+				transaction: gomatrixserverlib.Transaction{
+					TransactionID:  transactionID,
+					Origin:         oqs.origin,
+					Destination:    destination,
+					OriginServerTS: gomatrixserverlib.AsTimestamp(time.Now()),
+					PreviousIDs:    []gomatrixserverlib.TransactionID{},
+					PDUs:           []json.RawMessage{},
+					EDUs:           []gomatrixserverlib.EDU{},
+				},
+			}
+			transactions[key] = t
+			order = append(order, key)
+		}
+		return t
+	}
+
+	var pendingPDUs []*types.QueuedPDU
+	var pendingEDUs []*types.QueuedEDU
+	for i := range pdus {
+		pdu := &pdus[i]
+		if pdu.TransactionID == "" {
+			pendingPDUs = append(pendingPDUs, pdu)
+			continue
+		}
+		t := getTransaction(pdu.ServerName, pdu.TransactionID)
+		t.transaction.PDUs = append(t.transaction.PDUs, pdu.Event.JSON())
+		t.pduNIDs = append(t.pduNIDs, pdu.NID)
+	}
+	for i := range edus {
+		edu := &edus[i]
+		if edu.TransactionID == "" {
+			pendingEDUs = append(pendingEDUs, edu)
+			continue
+		}
+		t := getTransaction(edu.ServerName, edu.TransactionID)
+		t.transaction.EDUs = append(t.transaction.EDUs, *edu.EDU)
+		t.eduNIDs = append(t.eduNIDs, edu.NID)
+	}
+
+	oqs.queuesMutex.Lock()
+	defer oqs.queuesMutex.Unlock()
+
+	// The transactions that were already in flight must go first.
+	for _, key := range order {
+		oqs.getQueue(key.destination).retryTransaction(transactions[key])
+	}
+	for _, pdu := range pendingPDUs {
+		oqs.getQueue(pdu.ServerName).sendEvent(pdu)
+	}
+	for _, edu := range pendingEDUs {
+		oqs.getQueue(edu.ServerName).sendEDU(edu)
+	}
+
+	if len(pdus) > 0 || len(edus) > 0 {
+		log.WithFields(log.Fields{
+			"pdus":         len(pdus),
+			"edus":         len(edus),
+			"transactions": len(order),
+		}).Info("Resuming outgoing federation queues")
+	}
+	return nil
 }
 
 // SendEvent sends an event to the destinations
@@ -61,20 +170,25 @@ func (oqs *OutgoingQueues) SendEvent(
 		"destinations": destinations, "event": ev.EventID(),
 	}).Info("Sending event")
 
+	if len(destinations) == 0 {
+		return nil
+	}
+
+	// Store the event before queueing it, so that it will still be sent if
+	// we are restarted before we get the chance.
+	nids, err := oqs.db.QueuePDU(context.TODO(), ev, destinations)
+	if err != nil {
+		return err
+	}
+
 	oqs.queuesMutex.Lock()
 	defer oqs.queuesMutex.Unlock()
-	for _, destination := range destinations {
-		oq := oqs.queues[destination]
-		if oq == nil {
-			oq = &destinationQueue{
-				origin:      oqs.origin,
-				destination: destination,
-				client:      oqs.client,
-			}
-			oqs.queues[destination] = oq
-		}
-
-		oq.sendEvent(ev)
+	for i, destination := range destinations {
+		oqs.getQueue(destination).sendEvent(&types.QueuedPDU{
+			NID:        nids[i],
+			ServerName: destination,
+			Event:      ev,
+		})
 	}
 
 	return nil
@@ -96,29 +210,74 @@ func (oqs *OutgoingQueues) SendEDU(
 	// Remove our own server from the list of destinations.
 	destinations = filterDestinations(oqs.origin, destinations)
 
-	if len(destinations) > 0 {
-		log.WithFields(log.Fields{
-			"destinations": destinations, "edu_type": e.Type,
-		}).Info("Sending EDU event")
+	if len(destinations) == 0 {
+		return nil
+	}
+
+	log.WithFields(log.Fields{
+		"destinations": destinations, "edu_type": e.Type,
+	}).Info("Sending EDU event")
+
+	// Store the EDU before queueing it, so that it will still be sent if
+	// we are restarted before we get the chance.
+	nids, err := oqs.db.QueueEDU(context.TODO(), e, destinations)
+	if err != nil {
+		return err
 	}
 
 	oqs.queuesMutex.Lock()
 	defer oqs.queuesMutex.Unlock()
-	for _, destination := range destinations {
-		oq := oqs.queues[destination]
-		if oq == nil {
-			oq = &destinationQueue{
-				origin:      oqs.origin,
-				destination: destination,
-				client:      oqs.client,
-			}
-			oqs.queues[destination] = oq
+	for i, destination := range destinations {
+		oqs.getQueue(destination).sendEDU(&types.QueuedEDU{
+			NID:        nids[i],
+			ServerName: destination,
+			EDU:        e,
+		})
+	}
+
+	return nil
+}
+
+// getQueue returns the queue for the destination, creating it if needed.
+// The queuesMutex must be held by the caller.
+func (oqs *OutgoingQueues) getQueue(destination gomatrixserverlib.ServerName) *destinationQueue {
+	oq := oqs.queues[destination]
+	if oq == nil {
+		oq = &destinationQueue{
+			db:          oqs.db,
+			origin:      oqs.origin,
+			destination: destination,
+			client:      oqs.client,
+			backoff:     newBackoff(),
 		}
+		oqs.queues[destination] = oq
+	}
+	return oq
+}
 
-		oq.sendEDU(e)
+// ServersAlive clears the retry state of the given destinations, e.g. after
+// we have received a valid request from them, and retries any transactions
+// that are waiting to be sent to them straight away.
+func (oqs *OutgoingQueues) ServersAlive(servers []gomatrixserverlib.ServerName) {
+	oqs.queuesMutex.Lock()
+	defer oqs.queuesMutex.Unlock()
+	for _, server := range servers {
+		if oq := oqs.queues[server]; oq != nil {
+			oq.backoff.alive()
+		}
 	}
+}
 
-	return nil
+// RetryStates returns the retry state of every destination that we have
+// tried to send to.
+func (oqs *OutgoingQueues) RetryStates() map[gomatrixserverlib.ServerName]RetryState {
+	oqs.queuesMutex.Lock()
+	defer oqs.queuesMutex.Unlock()
+	states := make(map[gomatrixserverlib.ServerName]RetryState, len(oqs.queues))
+	for destination, oq := range oqs.queues {
+		states[destination] = oq.backoff.state()
+	}
+	return states
 }
 
 // filterDestinations removes our own server from the list of destinations.
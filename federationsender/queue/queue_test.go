@@ -0,0 +1,176 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package queue
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/federationsender/storage"
+	"github.com/matrix-org/dendrite/federationsender/types"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// fakeQueueDatabase implements the queue part of storage.Database.
+type fakeQueueDatabase struct {
+	storage.Database
+	pdus []types.QueuedPDU
+	edus []types.QueuedEDU
+
+	mutex      sync.Mutex
+	deletedPDU []int64
+	deletedEDU []int64
+}
+
+func (d *fakeQueueDatabase) GetQueued(ctx context.Context) ([]types.QueuedPDU, []types.QueuedEDU, error) {
+	return d.pdus, d.edus, nil
+}
+
+func (d *fakeQueueDatabase) SetQueueTransactionID(
+	ctx context.Context, transactionID gomatrixserverlib.TransactionID, pduNIDs, eduNIDs []int64,
+) error {
+	return nil
+}
+
+func (d *fakeQueueDatabase) DeleteQueued(ctx context.Context, pduNIDs, eduNIDs []int64) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.deletedPDU = append(d.deletedPDU, pduNIDs...)
+	d.deletedEDU = append(d.deletedEDU, eduNIDs...)
+	return nil
+}
+
+// fakeSender records the transactions that the queues send.
+type fakeSender struct {
+	sent chan gomatrixserverlib.Transaction
+}
+
+func (s *fakeSender) SendTransaction(
+	ctx context.Context, t gomatrixserverlib.Transaction,
+) (gomatrixserverlib.RespSend, error) {
+	s.sent <- t
+	return gomatrixserverlib.RespSend{}, nil
+}
+
+func (s *fakeSender) next(t *testing.T) gomatrixserverlib.Transaction {
+	select {
+	case txn := <-s.sent:
+		return txn
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for a transaction")
+		return gomatrixserverlib.Transaction{}
+	}
+}
+
+func TestTransactionBatching(t *testing.T) {
+	oq := &destinationQueue{destination: "remote", origin: "local"}
+	for i := 0; i < 120; i++ {
+		oq.pendingEvents = append(oq.pendingEvents, &types.QueuedPDU{
+			NID: int64(i), Event: &gomatrixserverlib.HeaderedEvent{},
+		})
+	}
+	for i := 0; i < 150; i++ {
+		oq.pendingEDUs = append(oq.pendingEDUs, &types.QueuedEDU{
+			NID: int64(i), EDU: &gomatrixserverlib.EDU{Type: "m.typing"},
+		})
+	}
+
+	want := []struct{ pdus, edus int }{
+		{maxPDUsPerTransaction, maxEDUsPerTransaction},
+		{maxPDUsPerTransaction, 50},
+		{20, 0},
+	}
+	var previousID gomatrixserverlib.TransactionID
+	for i, w := range want {
+		qt := oq.next()
+		if qt == nil {
+			t.Fatalf("transaction %d: queue was empty", i)
+		}
+		if len(qt.transaction.PDUs) != w.pdus || len(qt.pduNIDs) != w.pdus {
+			t.Errorf("transaction %d: got %d PDUs, want %d", i, len(qt.transaction.PDUs), w.pdus)
+		}
+		if len(qt.transaction.EDUs) != w.edus || len(qt.eduNIDs) != w.edus {
+			t.Errorf("transaction %d: got %d EDUs, want %d", i, len(qt.transaction.EDUs), w.edus)
+		}
+		if previousID != "" && (len(qt.transaction.PreviousIDs) != 1 || qt.transaction.PreviousIDs[0] != previousID) {
+			t.Errorf("transaction %d: got previous IDs %v, want [%s]", i, qt.transaction.PreviousIDs, previousID)
+		}
+		previousID = qt.transaction.TransactionID
+	}
+	if qt := oq.next(); qt != nil {
+		t.Errorf("expected the queue to be empty, got a transaction with %d PDUs", len(qt.transaction.PDUs))
+	}
+}
+
+func TestResumeAfterRestart(t *testing.T) {
+	edu := &gomatrixserverlib.EDU{Type: "m.typing"}
+	db := &fakeQueueDatabase{
+		pdus: []types.QueuedPDU{
+			{NID: 1, ServerName: "remote", TransactionID: "inflight", Event: &gomatrixserverlib.HeaderedEvent{}},
+			{NID: 2, ServerName: "remote", TransactionID: "inflight", Event: &gomatrixserverlib.HeaderedEvent{}},
+			{NID: 3, ServerName: "remote", Event: &gomatrixserverlib.HeaderedEvent{}},
+		},
+		edus: []types.QueuedEDU{
+			{NID: 4, ServerName: "remote", EDU: edu},
+		},
+	}
+	sender := &fakeSender{sent: make(chan gomatrixserverlib.Transaction, 10)}
+	oqs := &OutgoingQueues{
+		db:     db,
+		origin: "local",
+		client: sender,
+		queues: map[gomatrixserverlib.ServerName]*destinationQueue{},
+	}
+	if err := oqs.resume(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// The transaction that was in flight must be sent again as it was.
+	first := sender.next(t)
+	if first.TransactionID != "inflight" || len(first.PDUs) != 2 || len(first.EDUs) != 0 {
+		t.Fatalf("got transaction %q with %d PDUs and %d EDUs, want %q with 2 PDUs",
+			first.TransactionID, len(first.PDUs), len(first.EDUs), "inflight")
+	}
+	if first.Destination != "remote" || first.Origin != "local" {
+		t.Errorf("got transaction from %q to %q, want from %q to %q", first.Origin, first.Destination, "local", "remote")
+	}
+
+	// Everything else goes into a new transaction that follows it.
+	second := sender.next(t)
+	if second.TransactionID == "inflight" || len(second.PDUs) != 1 || len(second.EDUs) != 1 {
+		t.Fatalf("got transaction %q with %d PDUs and %d EDUs, want a new one with 1 PDU and 1 EDU",
+			second.TransactionID, len(second.PDUs), len(second.EDUs))
+	}
+	if len(second.PreviousIDs) != 1 || second.PreviousIDs[0] != "inflight" {
+		t.Errorf("got previous IDs %v, want [inflight]", second.PreviousIDs)
+	}
+
+	// Wait for the queue to remove the sent transactions from the database.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		db.mutex.Lock()
+		done := len(db.deletedPDU) == 3 && len(db.deletedEDU) == 1
+		db.mutex.Unlock()
+		if done {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("sent PDUs and EDUs were not removed from the queue database: %v %v", db.deletedPDU, db.deletedEDU)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
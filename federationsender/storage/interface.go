@@ -19,10 +19,16 @@ import (
 
 	"github.com/matrix-org/dendrite/common"
 	"github.com/matrix-org/dendrite/federationsender/types"
+	"github.com/matrix-org/gomatrixserverlib"
 )
 
 type Database interface {
 	common.PartitionStorer
 	UpdateRoom(ctx context.Context, roomID, oldEventID, newEventID string, addHosts []types.JoinedHost, removeHosts []string) (joinedHosts []types.JoinedHost, err error)
 	GetJoinedHosts(ctx context.Context, roomID string) ([]types.JoinedHost, error)
+	QueuePDU(ctx context.Context, event *gomatrixserverlib.HeaderedEvent, destinations []gomatrixserverlib.ServerName) (nids []int64, err error)
+	QueueEDU(ctx context.Context, edu *gomatrixserverlib.EDU, destinations []gomatrixserverlib.ServerName) (nids []int64, err error)
+	SetQueueTransactionID(ctx context.Context, transactionID gomatrixserverlib.TransactionID, pduNIDs, eduNIDs []int64) error
+	DeleteQueued(ctx context.Context, pduNIDs, eduNIDs []int64) error
+	GetQueued(ctx context.Context) ([]types.QueuedPDU, []types.QueuedEDU, error)
 }
@@ -0,0 +1,144 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+
+	"github.com/lib/pq"
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/federationsender/types"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const queuePDUsSchema = `
+-- The queue_pdus table stores the PDUs that are waiting to be sent to each
+-- destination, so that they survive restarts of the federation sender.
+CREATE TABLE IF NOT EXISTS federationsender_queue_pdus (
+    -- The position of the PDU in the queue.
+    pdu_nid BIGSERIAL PRIMARY KEY,
+    -- The server that the PDU is to be sent to.
+    server_name TEXT NOT NULL,
+    -- The transaction ID that the PDU was batched into, or the empty string
+    -- if it has not been batched into a transaction yet.
+    transaction_id TEXT NOT NULL DEFAULT '',
+    -- The headered JSON of the event.
+    headered_event_json TEXT NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS federationsender_queue_pdus_server_name_idx
+    ON federationsender_queue_pdus (server_name);
+`
+
+const insertQueuePDUSQL = "" +
+	"INSERT INTO federationsender_queue_pdus (server_name, headered_event_json)" +
+	" VALUES ($1, $2) RETURNING pdu_nid"
+
+const updateQueuePDUsTransactionIDSQL = "" +
+	"UPDATE federationsender_queue_pdus SET transaction_id = $1" +
+	" WHERE pdu_nid = ANY($2)"
+
+const deleteQueuePDUsSQL = "" +
+	"DELETE FROM federationsender_queue_pdus WHERE pdu_nid = ANY($1)"
+
+const selectQueuePDUsSQL = "" +
+	"SELECT pdu_nid, server_name, transaction_id, headered_event_json" +
+	" FROM federationsender_queue_pdus ORDER BY pdu_nid ASC"
+
+type queuePDUsStatements struct {
+	insertQueuePDUStmt               *sql.Stmt
+	updateQueuePDUsTransactionIDStmt *sql.Stmt
+	deleteQueuePDUsStmt              *sql.Stmt
+	selectQueuePDUsStmt              *sql.Stmt
+}
+
+func (s *queuePDUsStatements) prepare(db *sql.DB) (err error) {
+	_, err = db.Exec(queuePDUsSchema)
+	if err != nil {
+		return
+	}
+	if s.insertQueuePDUStmt, err = db.Prepare(insertQueuePDUSQL); err != nil {
+		return
+	}
+	if s.updateQueuePDUsTransactionIDStmt, err = db.Prepare(updateQueuePDUsTransactionIDSQL); err != nil {
+		return
+	}
+	if s.deleteQueuePDUsStmt, err = db.Prepare(deleteQueuePDUsSQL); err != nil {
+		return
+	}
+	if s.selectQueuePDUsStmt, err = db.Prepare(selectQueuePDUsSQL); err != nil {
+		return
+	}
+	return
+}
+
+func (s *queuePDUsStatements) insertQueuePDU(
+	ctx context.Context, txn *sql.Tx,
+	serverName gomatrixserverlib.ServerName,
+	event *gomatrixserverlib.HeaderedEvent,
+) (nid int64, err error) {
+	eventJSON, err := json.Marshal(event)
+	if err != nil {
+		return 0, err
+	}
+	stmt := common.TxStmt(txn, s.insertQueuePDUStmt)
+	err = stmt.QueryRowContext(ctx, serverName, string(eventJSON)).Scan(&nid)
+	return
+}
+
+func (s *queuePDUsStatements) updateQueuePDUsTransactionID(
+	ctx context.Context, txn *sql.Tx,
+	transactionID gomatrixserverlib.TransactionID, nids []int64,
+) error {
+	stmt := common.TxStmt(txn, s.updateQueuePDUsTransactionIDStmt)
+	_, err := stmt.ExecContext(ctx, transactionID, pq.Int64Array(nids))
+	return err
+}
+
+func (s *queuePDUsStatements) deleteQueuePDUs(
+	ctx context.Context, txn *sql.Tx, nids []int64,
+) error {
+	stmt := common.TxStmt(txn, s.deleteQueuePDUsStmt)
+	_, err := stmt.ExecContext(ctx, pq.Int64Array(nids))
+	return err
+}
+
+func (s *queuePDUsStatements) selectQueuePDUs(
+	ctx context.Context, txn *sql.Tx,
+) ([]types.QueuedPDU, error) {
+	stmt := common.TxStmt(txn, s.selectQueuePDUsStmt)
+	rows, err := stmt.QueryContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer common.CloseAndLogIfError(ctx, rows, "selectQueuePDUs: rows.close() failed")
+
+	var result []types.QueuedPDU
+	for rows.Next() {
+		var pdu types.QueuedPDU
+		var eventJSON []byte
+		if err = rows.Scan(&pdu.NID, &pdu.ServerName, &pdu.TransactionID, &eventJSON); err != nil {
+			return nil, err
+		}
+		pdu.Event = &gomatrixserverlib.HeaderedEvent{}
+		if err = json.Unmarshal(eventJSON, pdu.Event); err != nil {
+			return nil, err
+		}
+		result = append(result, pdu)
+	}
+	return result, rows.Err()
+}
@@ -21,12 +21,15 @@ import (
 
 	"github.com/matrix-org/dendrite/common"
 	"github.com/matrix-org/dendrite/federationsender/types"
+	"github.com/matrix-org/gomatrixserverlib"
 )
 
 // Database stores information needed by the federation sender
 type Database struct {
 	joinedHostsStatements
 	roomStatements
+	queuePDUsStatements
+	queueEDUsStatements
 	common.PartitionOffsetStatements
 	db *sql.DB
 }
@@ -55,6 +58,14 @@ func (d *Database) prepare() error {
 		return err
 	}
 
+	if err = d.queuePDUsStatements.prepare(d.db); err != nil {
+		return err
+	}
+
+	if err = d.queueEDUsStatements.prepare(d.db); err != nil {
+		return err
+	}
+
 	return d.PartitionOffsetStatements.Prepare(d.db, "federationsender")
 }
 
@@ -120,3 +131,85 @@ func (d *Database) GetJoinedHosts(
 ) ([]types.JoinedHost, error) {
 	return d.selectJoinedHosts(ctx, roomID)
 }
+
+// QueuePDU stores a PDU that is waiting to be sent to each of the given
+// destinations. Returns the queue position for each destination, in the same
+// order as the destinations.
+func (d *Database) QueuePDU(
+	ctx context.Context, event *gomatrixserverlib.HeaderedEvent,
+	destinations []gomatrixserverlib.ServerName,
+) (nids []int64, err error) {
+	err = common.WithTransaction(d.db, func(txn *sql.Tx) error {
+		for _, destination := range destinations {
+			nid, err := d.insertQueuePDU(ctx, txn, destination, event)
+			if err != nil {
+				return err
+			}
+			nids = append(nids, nid)
+		}
+		return nil
+	})
+	return
+}
+
+// QueueEDU stores an EDU that is waiting to be sent to each of the given
+// destinations. Returns the queue position for each destination, in the same
+// order as the destinations.
+func (d *Database) QueueEDU(
+	ctx context.Context, edu *gomatrixserverlib.EDU,
+	destinations []gomatrixserverlib.ServerName,
+) (nids []int64, err error) {
+	err = common.WithTransaction(d.db, func(txn *sql.Tx) error {
+		for _, destination := range destinations {
+			nid, err := d.insertQueueEDU(ctx, txn, destination, edu)
+			if err != nil {
+				return err
+			}
+			nids = append(nids, nid)
+		}
+		return nil
+	})
+	return
+}
+
+// SetQueueTransactionID records that the queued PDUs and EDUs have been
+// batched into the given transaction.
+func (d *Database) SetQueueTransactionID(
+	ctx context.Context, transactionID gomatrixserverlib.TransactionID,
+	pduNIDs, eduNIDs []int64,
+) error {
+	return common.WithTransaction(d.db, func(txn *sql.Tx) error {
+		if err := d.updateQueuePDUsTransactionID(ctx, txn, transactionID, pduNIDs); err != nil {
+			return err
+		}
+		return d.updateQueueEDUsTransactionID(ctx, txn, transactionID, eduNIDs)
+	})
+}
+
+// DeleteQueued removes PDUs and EDUs from the queue once they have been
+// sent successfully.
+func (d *Database) DeleteQueued(
+	ctx context.Context, pduNIDs, eduNIDs []int64,
+) error {
+	return common.WithTransaction(d.db, func(txn *sql.Tx) error {
+		if err := d.deleteQueuePDUs(ctx, txn, pduNIDs); err != nil {
+			return err
+		}
+		return d.deleteQueueEDUs(ctx, txn, eduNIDs)
+	})
+}
+
+// GetQueued returns every PDU and EDU that is still waiting to be sent, in
+// the order that they were queued.
+func (d *Database) GetQueued(
+	ctx context.Context,
+) (pdus []types.QueuedPDU, edus []types.QueuedEDU, err error) {
+	err = common.WithTransaction(d.db, func(txn *sql.Tx) error {
+		if pdus, err = d.selectQueuePDUs(ctx, txn); err != nil {
+			return err
+		}
+		edus, err = d.selectQueueEDUs(ctx, txn)
+		return err
+	})
+	return
+}
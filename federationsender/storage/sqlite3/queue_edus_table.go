@@ -0,0 +1,154 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/federationsender/types"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const queueEDUsSchema = `
+-- The queue_edus table stores the EDUs that are waiting to be sent to each
+-- destination, so that they survive restarts of the federation sender.
+CREATE TABLE IF NOT EXISTS federationsender_queue_edus (
+    -- The position of the EDU in the queue.
+    edu_nid INTEGER PRIMARY KEY AUTOINCREMENT,
+    -- The server that the EDU is to be sent to.
+    server_name TEXT NOT NULL,
+    -- The transaction ID that the EDU was batched into, or the empty string
+    -- if it has not been batched into a transaction yet.
+    transaction_id TEXT NOT NULL DEFAULT '',
+    -- The JSON of the EDU.
+    edu_json TEXT NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS federationsender_queue_edus_server_name_idx
+    ON federationsender_queue_edus (server_name);
+`
+
+const insertQueueEDUSQL = "" +
+	"INSERT INTO federationsender_queue_edus (server_name, edu_json)" +
+	" VALUES ($1, $2)"
+
+const updateQueueEDUTransactionIDSQL = "" +
+	"UPDATE federationsender_queue_edus SET transaction_id = $1" +
+	" WHERE edu_nid = $2"
+
+const deleteQueueEDUSQL = "" +
+	"DELETE FROM federationsender_queue_edus WHERE edu_nid = $1"
+
+const selectQueueEDUsSQL = "" +
+	"SELECT edu_nid, server_name, transaction_id, edu_json" +
+	" FROM federationsender_queue_edus ORDER BY edu_nid ASC"
+
+type queueEDUsStatements struct {
+	insertQueueEDUStmt              *sql.Stmt
+	updateQueueEDUTransactionIDStmt *sql.Stmt
+	deleteQueueEDUStmt              *sql.Stmt
+	selectQueueEDUsStmt             *sql.Stmt
+}
+
+func (s *queueEDUsStatements) prepare(db *sql.DB) (err error) {
+	_, err = db.Exec(queueEDUsSchema)
+	if err != nil {
+		return
+	}
+	if s.insertQueueEDUStmt, err = db.Prepare(insertQueueEDUSQL); err != nil {
+		return
+	}
+	if s.updateQueueEDUTransactionIDStmt, err = db.Prepare(updateQueueEDUTransactionIDSQL); err != nil {
+		return
+	}
+	if s.deleteQueueEDUStmt, err = db.Prepare(deleteQueueEDUSQL); err != nil {
+		return
+	}
+	if s.selectQueueEDUsStmt, err = db.Prepare(selectQueueEDUsSQL); err != nil {
+		return
+	}
+	return
+}
+
+func (s *queueEDUsStatements) insertQueueEDU(
+	ctx context.Context, txn *sql.Tx,
+	serverName gomatrixserverlib.ServerName,
+	edu *gomatrixserverlib.EDU,
+) (int64, error) {
+	eduJSON, err := json.Marshal(edu)
+	if err != nil {
+		return 0, err
+	}
+	stmt := common.TxStmt(txn, s.insertQueueEDUStmt)
+	res, err := stmt.ExecContext(ctx, serverName, string(eduJSON))
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+func (s *queueEDUsStatements) updateQueueEDUsTransactionID(
+	ctx context.Context, txn *sql.Tx,
+	transactionID gomatrixserverlib.TransactionID, nids []int64,
+) error {
+	for _, nid := range nids {
+		stmt := common.TxStmt(txn, s.updateQueueEDUTransactionIDStmt)
+		if _, err := stmt.ExecContext(ctx, transactionID, nid); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *queueEDUsStatements) deleteQueueEDUs(
+	ctx context.Context, txn *sql.Tx, nids []int64,
+) error {
+	for _, nid := range nids {
+		stmt := common.TxStmt(txn, s.deleteQueueEDUStmt)
+		if _, err := stmt.ExecContext(ctx, nid); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *queueEDUsStatements) selectQueueEDUs(
+	ctx context.Context, txn *sql.Tx,
+) ([]types.QueuedEDU, error) {
+	stmt := common.TxStmt(txn, s.selectQueueEDUsStmt)
+	rows, err := stmt.QueryContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer common.CloseAndLogIfError(ctx, rows, "selectQueueEDUs: rows.close() failed")
+
+	var result []types.QueuedEDU
+	for rows.Next() {
+		var edu types.QueuedEDU
+		var eduJSON []byte
+		if err = rows.Scan(&edu.NID, &edu.ServerName, &edu.TransactionID, &eduJSON); err != nil {
+			return nil, err
+		}
+		edu.EDU = &gomatrixserverlib.EDU{}
+		if err = json.Unmarshal(eduJSON, edu.EDU); err != nil {
+			return nil, err
+		}
+		result = append(result, edu)
+	}
+	return result, rows.Err()
+}
@@ -43,3 +43,29 @@ func (e EventIDMismatchError) Error() string {
 		e.DatabaseID, e.RoomServerID,
 	)
 }
+
+// A QueuedPDU is a PDU that is waiting to be sent to a destination.
+type QueuedPDU struct {
+	// The position of the PDU in the queue.
+	NID int64
+	// The server that the PDU is to be sent to.
+	ServerName gomatrixserverlib.ServerName
+	// The transaction that the PDU was batched into, or empty if it has not
+	// been batched into a transaction yet.
+	TransactionID gomatrixserverlib.TransactionID
+	// The PDU itself.
+	Event *gomatrixserverlib.HeaderedEvent
+}
+
+// A QueuedEDU is an EDU that is waiting to be sent to a destination.
+type QueuedEDU struct {
+	// The position of the EDU in the queue.
+	NID int64
+	// The server that the EDU is to be sent to.
+	ServerName gomatrixserverlib.ServerName
+	// The transaction that the EDU was batched into, or empty if it has not
+	// been batched into a transaction yet.
+	TransactionID gomatrixserverlib.TransactionID
+	// The EDU itself.
+	EDU *gomatrixserverlib.EDU
+}
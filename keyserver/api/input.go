@@ -0,0 +1,150 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	commonHTTP "github.com/matrix-org/dendrite/common/http"
+	opentracing "github.com/opentracing/opentracing-go"
+)
+
+// InputClaimOneTimeKeysRequest is a request to InputClaimOneTimeKeys
+type InputClaimOneTimeKeysRequest struct {
+	// A map from local user ID to device ID to the algorithm of the key to
+	// claim for that device.
+	OneTimeKeys map[string]map[string]string `json:"one_time_keys"`
+}
+
+// InputClaimOneTimeKeysResponse is a response to InputClaimOneTimeKeys
+type InputClaimOneTimeKeysResponse struct {
+	// A map from user ID to device ID to key ID to the claimed key. Devices
+	// that have no keys of the requested algorithm left are omitted.
+	OneTimeKeys map[string]map[string]map[string]json.RawMessage `json:"one_time_keys"`
+}
+
+// InputDeviceListUpdateRequest is a request to InputDeviceListUpdate
+type InputDeviceListUpdateRequest struct {
+	// The ID of the remote user whose device changed.
+	UserID string `json:"user_id"`
+	// The ID of the device that changed.
+	DeviceID string `json:"device_id"`
+	// The new device keys, if the remote server sent them.
+	Keys json.RawMessage `json:"keys,omitempty"`
+	// Whether the device was deleted.
+	Deleted bool `json:"deleted"`
+}
+
+// InputDeviceListUpdateResponse is a response to InputDeviceListUpdate
+type InputDeviceListUpdateResponse struct{}
+
+// InputDeleteDeviceKeysRequest is a request to InputDeleteDeviceKeys
+type InputDeleteDeviceKeysRequest struct {
+	// The ID of the local user whose devices were removed.
+	UserID string `json:"user_id"`
+	// The IDs of the removed devices.
+	DeviceIDs []string `json:"device_ids"`
+}
+
+// InputDeleteDeviceKeysResponse is a response to InputDeleteDeviceKeys
+type InputDeleteDeviceKeysResponse struct{}
+
+// KeyServerInputAPI is used to make changes to the keys of local devices.
+type KeyServerInputAPI interface {
+	// Claim one-time keys, removing them so that they are never handed out
+	// again.
+	InputClaimOneTimeKeys(
+		ctx context.Context,
+		request *InputClaimOneTimeKeysRequest,
+		response *InputClaimOneTimeKeysResponse,
+	) error
+	// Record that another server told us that a device of one of its users
+	// changed, so that the local users who share a room with them are told.
+	InputDeviceListUpdate(
+		ctx context.Context,
+		request *InputDeviceListUpdateRequest,
+		response *InputDeviceListUpdateResponse,
+	) error
+	// Remove the keys of local devices that were removed, and tell the
+	// users who share a room with their owner that the devices are gone.
+	InputDeleteDeviceKeys(
+		ctx context.Context,
+		request *InputDeleteDeviceKeysRequest,
+		response *InputDeleteDeviceKeysResponse,
+	) error
+}
+
+// KeyServerInputClaimOneTimeKeysPath is the HTTP path for the InputClaimOneTimeKeys API.
+const KeyServerInputClaimOneTimeKeysPath = "/api/keyserver/inputClaimOneTimeKeys"
+
+// KeyServerInputDeviceListUpdatePath is the HTTP path for the InputDeviceListUpdate API.
+const KeyServerInputDeviceListUpdatePath = "/api/keyserver/inputDeviceListUpdate"
+
+// KeyServerInputDeleteDeviceKeysPath is the HTTP path for the InputDeleteDeviceKeys API.
+const KeyServerInputDeleteDeviceKeysPath = "/api/keyserver/inputDeleteDeviceKeys"
+
+// NewKeyServerInputAPIHTTP creates a KeyServerInputAPI implemented by talking to a HTTP POST API.
+func NewKeyServerInputAPIHTTP(keyServerURL string, httpClient *http.Client) KeyServerInputAPI {
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	return &httpKeyServerInputAPI{keyServerURL, httpClient}
+}
+
+type httpKeyServerInputAPI struct {
+	keyServerURL string
+	httpClient   *http.Client
+}
+
+// InputClaimOneTimeKeys implements KeyServerInputAPI
+func (h *httpKeyServerInputAPI) InputClaimOneTimeKeys(
+	ctx context.Context,
+	request *InputClaimOneTimeKeysRequest,
+	response *InputClaimOneTimeKeysResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "InputClaimOneTimeKeys")
+	defer span.Finish()
+
+	apiURL := h.keyServerURL + KeyServerInputClaimOneTimeKeysPath
+	return commonHTTP.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
+}
+
+// InputDeviceListUpdate implements KeyServerInputAPI
+func (h *httpKeyServerInputAPI) InputDeviceListUpdate(
+	ctx context.Context,
+	request *InputDeviceListUpdateRequest,
+	response *InputDeviceListUpdateResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "InputDeviceListUpdate")
+	defer span.Finish()
+
+	apiURL := h.keyServerURL + KeyServerInputDeviceListUpdatePath
+	return commonHTTP.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
+}
+
+// InputDeleteDeviceKeys implements KeyServerInputAPI
+func (h *httpKeyServerInputAPI) InputDeleteDeviceKeys(
+	ctx context.Context,
+	request *InputDeleteDeviceKeysRequest,
+	response *InputDeleteDeviceKeysResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "InputDeleteDeviceKeys")
+	defer span.Finish()
+
+	apiURL := h.keyServerURL + KeyServerInputDeleteDeviceKeysPath
+	return commonHTTP.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
+}
@@ -0,0 +1,32 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import "encoding/json"
+
+// OutputKeyChangeEvent is an entry in the key server output kafka log. It is
+// written whenever a local user uploads new keys for one of their devices, so
+// that the sync API can tell the users that share a room with them and the
+// federation sender can tell the servers that share a room with them. It is
+// also written when another server tells us that the devices of one of its
+// users have changed.
+type OutputKeyChangeEvent struct {
+	UserID   string `json:"user_id"`
+	DeviceID string `json:"device_id"`
+	// The new device keys, if they are known.
+	Keys json.RawMessage `json:"keys,omitempty"`
+	// Whether the device was deleted.
+	Deleted bool `json:"deleted,omitempty"`
+}
@@ -0,0 +1,112 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package api provides the types that are used to communicate with the key server.
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	commonHTTP "github.com/matrix-org/dendrite/common/http"
+	opentracing "github.com/opentracing/opentracing-go"
+)
+
+// QueryDeviceKeysRequest is a request to QueryDeviceKeys
+type QueryDeviceKeysRequest struct {
+	// A map from local user ID to the IDs of the devices to return the keys
+	// for. An empty list means all of the devices of that user.
+	DeviceKeys map[string][]string `json:"device_keys"`
+}
+
+// QueryDeviceKeysResponse is a response to QueryDeviceKeys
+type QueryDeviceKeysResponse struct {
+	// A map from user ID to device ID to the signed device keys, as they
+	// were uploaded by the device. Devices without keys are omitted.
+	DeviceKeys map[string]map[string]json.RawMessage `json:"device_keys"`
+}
+
+// QueryOneTimeKeyCountsRequest is a request to QueryOneTimeKeyCounts
+type QueryOneTimeKeyCountsRequest struct {
+	UserID   string `json:"user_id"`
+	DeviceID string `json:"device_id"`
+}
+
+// QueryOneTimeKeyCountsResponse is a response to QueryOneTimeKeyCounts
+type QueryOneTimeKeyCountsResponse struct {
+	// A map from key algorithm to the number of unclaimed one-time keys of
+	// that algorithm that the device has.
+	Counts map[string]int `json:"counts"`
+}
+
+// KeyServerQueryAPI is used to query the keys of local devices.
+type KeyServerQueryAPI interface {
+	QueryDeviceKeys(
+		ctx context.Context,
+		request *QueryDeviceKeysRequest,
+		response *QueryDeviceKeysResponse,
+	) error
+
+	QueryOneTimeKeyCounts(
+		ctx context.Context,
+		request *QueryOneTimeKeyCountsRequest,
+		response *QueryOneTimeKeyCountsResponse,
+	) error
+}
+
+// KeyServerQueryDeviceKeysPath is the HTTP path for the QueryDeviceKeys API.
+const KeyServerQueryDeviceKeysPath = "/api/keyserver/queryDeviceKeys"
+
+// KeyServerQueryOneTimeKeyCountsPath is the HTTP path for the QueryOneTimeKeyCounts API.
+const KeyServerQueryOneTimeKeyCountsPath = "/api/keyserver/queryOneTimeKeyCounts"
+
+// NewKeyServerQueryAPIHTTP creates a KeyServerQueryAPI implemented by talking to a HTTP POST API.
+func NewKeyServerQueryAPIHTTP(keyServerURL string, httpClient *http.Client) KeyServerQueryAPI {
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	return &httpKeyServerQueryAPI{keyServerURL, httpClient}
+}
+
+type httpKeyServerQueryAPI struct {
+	keyServerURL string
+	httpClient   *http.Client
+}
+
+// QueryDeviceKeys implements KeyServerQueryAPI
+func (h *httpKeyServerQueryAPI) QueryDeviceKeys(
+	ctx context.Context,
+	request *QueryDeviceKeysRequest,
+	response *QueryDeviceKeysResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "QueryDeviceKeys")
+	defer span.Finish()
+
+	apiURL := h.keyServerURL + KeyServerQueryDeviceKeysPath
+	return commonHTTP.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
+}
+
+// QueryOneTimeKeyCounts implements KeyServerQueryAPI
+func (h *httpKeyServerQueryAPI) QueryOneTimeKeyCounts(
+	ctx context.Context,
+	request *QueryOneTimeKeyCountsRequest,
+	response *QueryOneTimeKeyCountsResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "QueryOneTimeKeyCounts")
+	defer span.Finish()
+
+	apiURL := h.keyServerURL + KeyServerQueryOneTimeKeyCountsPath
+	return commonHTTP.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
+}
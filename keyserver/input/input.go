@@ -0,0 +1,129 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package input
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/keyserver/api"
+	"github.com/matrix-org/dendrite/keyserver/producers"
+	"github.com/matrix-org/dendrite/keyserver/storage"
+	"github.com/matrix-org/util"
+)
+
+// KeyServerInputAPI implements api.KeyServerInputAPI
+type KeyServerInputAPI struct {
+	DB       storage.Database
+	Producer *producers.KeyChangeProducer
+}
+
+// InputClaimOneTimeKeys implements api.KeyServerInputAPI
+func (k *KeyServerInputAPI) InputClaimOneTimeKeys(
+	ctx context.Context,
+	request *api.InputClaimOneTimeKeysRequest,
+	response *api.InputClaimOneTimeKeysResponse,
+) error {
+	response.OneTimeKeys = make(map[string]map[string]map[string]json.RawMessage)
+	for userID, devices := range request.OneTimeKeys {
+		for deviceID, algorithm := range devices {
+			claimed, err := k.DB.ClaimOneTimeKey(ctx, userID, deviceID, algorithm)
+			if err != nil {
+				return err
+			}
+			if len(claimed) == 0 {
+				continue
+			}
+			if _, ok := response.OneTimeKeys[userID]; !ok {
+				response.OneTimeKeys[userID] = make(map[string]map[string]json.RawMessage)
+			}
+			response.OneTimeKeys[userID][deviceID] = claimed
+		}
+	}
+	return nil
+}
+
+// InputDeviceListUpdate implements api.KeyServerInputAPI
+func (k *KeyServerInputAPI) InputDeviceListUpdate(
+	ctx context.Context,
+	request *api.InputDeviceListUpdateRequest,
+	response *api.InputDeviceListUpdateResponse,
+) error {
+	// We don't store the keys of remote devices, as /keys/query asks the
+	// remote server for them. The change only needs to reach the sync API.
+	return k.Producer.SendKeyChange(request.UserID, request.DeviceID, request.Keys, request.Deleted)
+}
+
+// InputDeleteDeviceKeys implements api.KeyServerInputAPI
+func (k *KeyServerInputAPI) InputDeleteDeviceKeys(
+	ctx context.Context,
+	request *api.InputDeleteDeviceKeysRequest,
+	response *api.InputDeleteDeviceKeysResponse,
+) error {
+	for _, deviceID := range request.DeviceIDs {
+		if err := k.DB.DeleteDeviceKeys(ctx, request.UserID, deviceID); err != nil {
+			return err
+		}
+		if err := k.Producer.SendKeyChange(request.UserID, deviceID, nil, true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SetupHTTP adds the KeyServerInputAPI handlers to the http.ServeMux.
+func (k *KeyServerInputAPI) SetupHTTP(servMux *http.ServeMux) {
+	servMux.Handle(api.KeyServerInputClaimOneTimeKeysPath,
+		common.MakeInternalAPI("inputClaimOneTimeKeys", func(req *http.Request) util.JSONResponse {
+			var request api.InputClaimOneTimeKeysRequest
+			var response api.InputClaimOneTimeKeysResponse
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				return util.MessageResponse(http.StatusBadRequest, err.Error())
+			}
+			if err := k.InputClaimOneTimeKeys(req.Context(), &request, &response); err != nil {
+				return util.ErrorResponse(err)
+			}
+			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
+		}),
+	)
+	servMux.Handle(api.KeyServerInputDeviceListUpdatePath,
+		common.MakeInternalAPI("inputDeviceListUpdate", func(req *http.Request) util.JSONResponse {
+			var request api.InputDeviceListUpdateRequest
+			var response api.InputDeviceListUpdateResponse
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				return util.MessageResponse(http.StatusBadRequest, err.Error())
+			}
+			if err := k.InputDeviceListUpdate(req.Context(), &request, &response); err != nil {
+				return util.ErrorResponse(err)
+			}
+			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
+		}),
+	)
+	servMux.Handle(api.KeyServerInputDeleteDeviceKeysPath,
+		common.MakeInternalAPI("inputDeleteDeviceKeys", func(req *http.Request) util.JSONResponse {
+			var request api.InputDeleteDeviceKeysRequest
+			var response api.InputDeleteDeviceKeysResponse
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				return util.MessageResponse(http.StatusBadRequest, err.Error())
+			}
+			if err := k.InputDeleteDeviceKeys(req.Context(), &request, &response); err != nil {
+				return util.ErrorResponse(err)
+			}
+			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
+		}),
+	)
+}
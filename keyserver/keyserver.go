@@ -0,0 +1,62 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keyserver
+
+import (
+	"net/http"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/devices"
+	"github.com/matrix-org/dendrite/common/basecomponent"
+	"github.com/matrix-org/dendrite/keyserver/api"
+	"github.com/matrix-org/dendrite/keyserver/input"
+	"github.com/matrix-org/dendrite/keyserver/producers"
+	"github.com/matrix-org/dendrite/keyserver/query"
+	"github.com/matrix-org/dendrite/keyserver/routing"
+	"github.com/matrix-org/dendrite/keyserver/storage"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/sirupsen/logrus"
+)
+
+// SetupKeyServerComponent sets up and registers HTTP handlers for the
+// KeyServer component. Returns instances of the key server APIs, allowing
+// other components running in the same process to hit the APIs directly
+// instead of having to use HTTP.
+func SetupKeyServerComponent(
+	base *basecomponent.BaseDendrite,
+	deviceDB devices.Database,
+	federation *gomatrixserverlib.FederationClient,
+) (api.KeyServerInputAPI, api.KeyServerQueryAPI) {
+	keyDB, err := storage.NewDatabase(string(base.Cfg.Database.KeyServer))
+	if err != nil {
+		logrus.WithError(err).Panic("failed to connect to key server db")
+	}
+
+	producer := &producers.KeyChangeProducer{
+		Topic:    string(base.Cfg.Kafka.Topics.OutputKeyChangeEvent),
+		Producer: base.KafkaProducer,
+	}
+
+	inputAPI := &input.KeyServerInputAPI{DB: keyDB, Producer: producer}
+	inputAPI.SetupHTTP(http.DefaultServeMux)
+
+	queryAPI := &query.KeyServerQueryAPI{DB: keyDB}
+	queryAPI.SetupHTTP(http.DefaultServeMux)
+
+	routing.Setup(
+		base.APIMux, base.Cfg, deviceDB, keyDB, queryAPI, inputAPI, producer, federation,
+	)
+
+	return inputAPI, queryAPI
+}
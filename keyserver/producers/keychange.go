@@ -0,0 +1,52 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package producers
+
+import (
+	"encoding/json"
+
+	"github.com/matrix-org/dendrite/keyserver/api"
+	sarama "gopkg.in/Shopify/sarama.v1"
+)
+
+// KeyChangeProducer produces events for the sync API server to consume
+type KeyChangeProducer struct {
+	Topic    string
+	Producer sarama.SyncProducer
+}
+
+// SendKeyChange sends an event telling the sync API server and the federation
+// sender that the keys of a device have changed.
+func (p *KeyChangeProducer) SendKeyChange(
+	userID, deviceID string, keys json.RawMessage, deleted bool,
+) error {
+	value, err := json.Marshal(api.OutputKeyChangeEvent{
+		UserID:   userID,
+		DeviceID: deviceID,
+		Keys:     keys,
+		Deleted:  deleted,
+	})
+	if err != nil {
+		return err
+	}
+
+	m := &sarama.ProducerMessage{
+		Topic: p.Topic,
+		Key:   sarama.StringEncoder(userID),
+		Value: sarama.ByteEncoder(value),
+	}
+	_, _, err = p.Producer.SendMessage(m)
+	return err
+}
@@ -0,0 +1,90 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package query
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/keyserver/api"
+	"github.com/matrix-org/dendrite/keyserver/storage"
+	"github.com/matrix-org/util"
+)
+
+// KeyServerQueryAPI is an implementation of api.KeyServerQueryAPI
+type KeyServerQueryAPI struct {
+	DB storage.Database
+}
+
+// QueryDeviceKeys implements api.KeyServerQueryAPI
+func (k *KeyServerQueryAPI) QueryDeviceKeys(
+	ctx context.Context,
+	request *api.QueryDeviceKeysRequest,
+	response *api.QueryDeviceKeysResponse,
+) error {
+	response.DeviceKeys = make(map[string]map[string]json.RawMessage)
+	for userID, deviceIDs := range request.DeviceKeys {
+		keys, err := k.DB.DeviceKeysForUser(ctx, userID, deviceIDs)
+		if err != nil {
+			return err
+		}
+		response.DeviceKeys[userID] = keys
+	}
+	return nil
+}
+
+// QueryOneTimeKeyCounts implements api.KeyServerQueryAPI
+func (k *KeyServerQueryAPI) QueryOneTimeKeyCounts(
+	ctx context.Context,
+	request *api.QueryOneTimeKeyCountsRequest,
+	response *api.QueryOneTimeKeyCountsResponse,
+) (err error) {
+	response.Counts, err = k.DB.OneTimeKeyCounts(ctx, request.UserID, request.DeviceID)
+	return
+}
+
+// SetupHTTP adds the KeyServerQueryAPI handlers to the http.ServeMux.
+func (k *KeyServerQueryAPI) SetupHTTP(servMux *http.ServeMux) {
+	servMux.Handle(
+		api.KeyServerQueryDeviceKeysPath,
+		common.MakeInternalAPI("QueryDeviceKeys", func(req *http.Request) util.JSONResponse {
+			var request api.QueryDeviceKeysRequest
+			var response api.QueryDeviceKeysResponse
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				return util.ErrorResponse(err)
+			}
+			if err := k.QueryDeviceKeys(req.Context(), &request, &response); err != nil {
+				return util.ErrorResponse(err)
+			}
+			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
+		}),
+	)
+	servMux.Handle(
+		api.KeyServerQueryOneTimeKeyCountsPath,
+		common.MakeInternalAPI("QueryOneTimeKeyCounts", func(req *http.Request) util.JSONResponse {
+			var request api.QueryOneTimeKeyCountsRequest
+			var response api.QueryOneTimeKeyCountsResponse
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				return util.ErrorResponse(err)
+			}
+			if err := k.QueryOneTimeKeyCounts(req.Context(), &request, &response); err != nil {
+				return util.ErrorResponse(err)
+			}
+			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
+		}),
+	)
+}
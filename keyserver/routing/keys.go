@@ -0,0 +1,300 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/dendrite/keyserver/api"
+	"github.com/matrix-org/dendrite/keyserver/producers"
+	"github.com/matrix-org/dendrite/keyserver/storage"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+// How long we wait for remote servers to answer key queries and claims if
+// the client doesn't tell us.
+const defaultRemoteKeysTimeout = 10 * time.Second
+
+type uploadKeysRequest struct {
+	DeviceKeys  json.RawMessage            `json:"device_keys"`
+	OneTimeKeys map[string]json.RawMessage `json:"one_time_keys"`
+}
+
+type uploadKeysResponse struct {
+	OneTimeKeyCounts map[string]int `json:"one_time_key_counts"`
+}
+
+// The fields of the device keys that we check. The keys themselves are stored
+// exactly as they were uploaded so that their signatures stay valid.
+type deviceKeysHeader struct {
+	UserID   string `json:"user_id"`
+	DeviceID string `json:"device_id"`
+}
+
+// UploadKeys implements POST /keys/upload
+func UploadKeys(
+	req *http.Request, device *authtypes.Device,
+	keyDB storage.Database, producer *producers.KeyChangeProducer,
+) util.JSONResponse {
+	var r uploadKeysRequest
+	if resErr := httputil.UnmarshalJSONRequest(req, &r); resErr != nil {
+		return *resErr
+	}
+
+	if len(r.DeviceKeys) > 0 {
+		var header deviceKeysHeader
+		if err := json.Unmarshal(r.DeviceKeys, &header); err != nil {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.BadJSON("The device keys could not be decoded: " + err.Error()),
+			}
+		}
+		if header.UserID != device.UserID || header.DeviceID != device.ID {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue("The device keys must be for the device making the request"),
+			}
+		}
+		changed, err := keyDB.StoreDeviceKeys(req.Context(), device.UserID, device.ID, r.DeviceKeys)
+		if err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("keyDB.StoreDeviceKeys failed")
+			return jsonerror.InternalServerError()
+		}
+		if changed {
+			if err = producer.SendKeyChange(device.UserID, device.ID, r.DeviceKeys, false); err != nil {
+				util.GetLogger(req.Context()).WithError(err).Error("producer.SendKeyChange failed")
+				return jsonerror.InternalServerError()
+			}
+		}
+	}
+
+	if len(r.OneTimeKeys) > 0 {
+		for keyName := range r.OneTimeKeys {
+			if parts := strings.SplitN(keyName, ":", 2); len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+				return util.JSONResponse{
+					Code: http.StatusBadRequest,
+					JSON: jsonerror.InvalidArgumentValue("One-time keys must be named <algorithm>:<key_id>"),
+				}
+			}
+		}
+		if err := keyDB.StoreOneTimeKeys(req.Context(), device.UserID, device.ID, r.OneTimeKeys); err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("keyDB.StoreOneTimeKeys failed")
+			return jsonerror.InternalServerError()
+		}
+	}
+
+	counts, err := keyDB.OneTimeKeyCounts(req.Context(), device.UserID, device.ID)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("keyDB.OneTimeKeyCounts failed")
+		return jsonerror.InternalServerError()
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: uploadKeysResponse{OneTimeKeyCounts: counts},
+	}
+}
+
+type queryKeysRequest struct {
+	Timeout    int64               `json:"timeout"`
+	DeviceKeys map[string][]string `json:"device_keys"`
+	Token      string              `json:"token"`
+}
+
+type queryKeysResponse struct {
+	Failures   map[string]interface{}                `json:"failures"`
+	DeviceKeys map[string]map[string]json.RawMessage `json:"device_keys"`
+}
+
+// QueryKeys implements POST /keys/query
+func QueryKeys(
+	req *http.Request, cfg *config.Dendrite,
+	queryAPI api.KeyServerQueryAPI,
+	federation *gomatrixserverlib.FederationClient,
+) util.JSONResponse {
+	var r queryKeysRequest
+	if resErr := httputil.UnmarshalJSONRequest(req, &r); resErr != nil {
+		return *resErr
+	}
+
+	res := queryKeysResponse{
+		Failures:   map[string]interface{}{},
+		DeviceKeys: map[string]map[string]json.RawMessage{},
+	}
+	byServer, resErr := groupByServer(r.DeviceKeys)
+	if resErr != nil {
+		return *resErr
+	}
+
+	ctx, cancel := context.WithTimeout(req.Context(), remoteKeysTimeout(r.Timeout))
+	defer cancel()
+	for serverName, deviceKeys := range byServer {
+		if serverName == cfg.Matrix.ServerName {
+			queryReq := api.QueryDeviceKeysRequest{DeviceKeys: deviceKeys}
+			var queryRes api.QueryDeviceKeysResponse
+			if err := queryAPI.QueryDeviceKeys(req.Context(), &queryReq, &queryRes); err != nil {
+				util.GetLogger(req.Context()).WithError(err).Error("queryAPI.QueryDeviceKeys failed")
+				return jsonerror.InternalServerError()
+			}
+			for userID, keys := range queryRes.DeviceKeys {
+				res.DeviceKeys[userID] = keys
+			}
+			continue
+		}
+
+		request := gomatrixserverlib.NewFederationRequest(
+			http.MethodPost, serverName, "/_matrix/federation/v1/user/keys/query",
+		)
+		if err := request.SetContent(api.QueryDeviceKeysRequest{DeviceKeys: deviceKeys}); err != nil {
+			return util.ErrorResponse(err)
+		}
+		var remoteRes api.QueryDeviceKeysResponse
+		if err := common.DoFederationRequest(ctx, cfg, federation, request, &remoteRes); err != nil {
+			res.Failures[string(serverName)] = remoteFailure(err)
+			continue
+		}
+		for userID, keys := range remoteRes.DeviceKeys {
+			// Only accept keys for the users that we asked the server about.
+			if _, ok := deviceKeys[userID]; ok {
+				res.DeviceKeys[userID] = keys
+			}
+		}
+	}
+
+	return util.JSONResponse{Code: http.StatusOK, JSON: res}
+}
+
+type claimKeysRequest struct {
+	Timeout     int64                        `json:"timeout"`
+	OneTimeKeys map[string]map[string]string `json:"one_time_keys"`
+}
+
+type claimKeysResponse struct {
+	Failures    map[string]interface{}                           `json:"failures"`
+	OneTimeKeys map[string]map[string]map[string]json.RawMessage `json:"one_time_keys"`
+}
+
+// ClaimKeys implements POST /keys/claim
+func ClaimKeys(
+	req *http.Request, cfg *config.Dendrite,
+	inputAPI api.KeyServerInputAPI,
+	federation *gomatrixserverlib.FederationClient,
+) util.JSONResponse {
+	var r claimKeysRequest
+	if resErr := httputil.UnmarshalJSONRequest(req, &r); resErr != nil {
+		return *resErr
+	}
+
+	res := claimKeysResponse{
+		Failures:    map[string]interface{}{},
+		OneTimeKeys: map[string]map[string]map[string]json.RawMessage{},
+	}
+	byServer := map[gomatrixserverlib.ServerName]map[string]map[string]string{}
+	for userID, devices := range r.OneTimeKeys {
+		_, serverName, err := gomatrixserverlib.SplitID('@', userID)
+		if err != nil {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue("Invalid user ID " + userID),
+			}
+		}
+		if _, ok := byServer[serverName]; !ok {
+			byServer[serverName] = map[string]map[string]string{}
+		}
+		byServer[serverName][userID] = devices
+	}
+
+	ctx, cancel := context.WithTimeout(req.Context(), remoteKeysTimeout(r.Timeout))
+	defer cancel()
+	for serverName, oneTimeKeys := range byServer {
+		if serverName == cfg.Matrix.ServerName {
+			claimReq := api.InputClaimOneTimeKeysRequest{OneTimeKeys: oneTimeKeys}
+			var claimRes api.InputClaimOneTimeKeysResponse
+			if err := inputAPI.InputClaimOneTimeKeys(req.Context(), &claimReq, &claimRes); err != nil {
+				util.GetLogger(req.Context()).WithError(err).Error("inputAPI.InputClaimOneTimeKeys failed")
+				return jsonerror.InternalServerError()
+			}
+			for userID, keys := range claimRes.OneTimeKeys {
+				res.OneTimeKeys[userID] = keys
+			}
+			continue
+		}
+
+		request := gomatrixserverlib.NewFederationRequest(
+			http.MethodPost, serverName, "/_matrix/federation/v1/user/keys/claim",
+		)
+		if err := request.SetContent(api.InputClaimOneTimeKeysRequest{OneTimeKeys: oneTimeKeys}); err != nil {
+			return util.ErrorResponse(err)
+		}
+		var remoteRes api.InputClaimOneTimeKeysResponse
+		if err := common.DoFederationRequest(ctx, cfg, federation, request, &remoteRes); err != nil {
+			res.Failures[string(serverName)] = remoteFailure(err)
+			continue
+		}
+		for userID, keys := range remoteRes.OneTimeKeys {
+			if _, ok := oneTimeKeys[userID]; ok {
+				res.OneTimeKeys[userID] = keys
+			}
+		}
+	}
+
+	return util.JSONResponse{Code: http.StatusOK, JSON: res}
+}
+
+// groupByServer splits a map keyed by user ID by the server of each user.
+func groupByServer(
+	byUser map[string][]string,
+) (map[gomatrixserverlib.ServerName]map[string][]string, *util.JSONResponse) {
+	byServer := map[gomatrixserverlib.ServerName]map[string][]string{}
+	for userID, deviceIDs := range byUser {
+		_, serverName, err := gomatrixserverlib.SplitID('@', userID)
+		if err != nil {
+			return nil, &util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue("Invalid user ID " + userID),
+			}
+		}
+		if _, ok := byServer[serverName]; !ok {
+			byServer[serverName] = map[string][]string{}
+		}
+		byServer[serverName][userID] = deviceIDs
+	}
+	return byServer, nil
+}
+
+func remoteKeysTimeout(timeoutMS int64) time.Duration {
+	if timeoutMS <= 0 {
+		return defaultRemoteKeysTimeout
+	}
+	return time.Duration(timeoutMS) * time.Millisecond
+}
+
+// remoteFailure builds the entry that is reported in the "failures" section
+// of the response for a server that we couldn't get keys from.
+func remoteFailure(err error) map[string]interface{} {
+	return map[string]interface{}{
+		"status":  http.StatusServiceUnavailable,
+		"message": err.Error(),
+	}
+}
@@ -0,0 +1,76 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/matrix-org/dendrite/clientapi/auth"
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/devices"
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/dendrite/keyserver/api"
+	"github.com/matrix-org/dendrite/keyserver/producers"
+	"github.com/matrix-org/dendrite/keyserver/storage"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+const pathPrefixR0 = "/_matrix/client/r0"
+
+// Setup configures the given mux with key server listeners
+func Setup(
+	apiMux *mux.Router, cfg *config.Dendrite,
+	deviceDB devices.Database, keyDB storage.Database,
+	queryAPI api.KeyServerQueryAPI, inputAPI api.KeyServerInputAPI,
+	producer *producers.KeyChangeProducer,
+	federation *gomatrixserverlib.FederationClient,
+) {
+	r0mux := apiMux.PathPrefix(pathPrefixR0).Subrouter()
+
+	authData := auth.Data{
+		AccountDB:   nil,
+		DeviceDB:    deviceDB,
+		AppServices: nil,
+	}
+
+	r0mux.Handle("/keys/upload",
+		common.MakeAuthAPI("keys_upload", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+			return UploadKeys(req, device, keyDB, producer)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
+	// Some clients still send the device ID in the path, which has been
+	// deprecated in favour of the device of the access token.
+	r0mux.Handle("/keys/upload/{deviceID}",
+		common.MakeAuthAPI("keys_upload", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+			return UploadKeys(req, device, keyDB, producer)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
+	r0mux.Handle("/keys/query",
+		common.MakeAuthAPI("keys_query", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+			return QueryKeys(req, cfg, queryAPI, federation)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
+	r0mux.Handle("/keys/claim",
+		common.MakeAuthAPI("keys_claim", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+			return ClaimKeys(req, cfg, inputAPI, federation)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+}
@@ -0,0 +1,44 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"context"
+	"encoding/json"
+)
+
+// Database stores the end-to-end encryption keys of local devices.
+type Database interface {
+	// StoreDeviceKeys stores the signed device keys of a device, replacing
+	// any keys that it had before. Returns true if the keys are different to
+	// the ones that were stored before.
+	StoreDeviceKeys(ctx context.Context, userID, deviceID string, keyJSON json.RawMessage) (bool, error)
+	// StoreOneTimeKeys stores one-time keys for a device. The keys are keyed
+	// by "<algorithm>:<key ID>". Keys that have been stored before are ignored.
+	StoreOneTimeKeys(ctx context.Context, userID, deviceID string, keys map[string]json.RawMessage) error
+	// DeviceKeysForUser returns the device keys of a user, keyed by device
+	// ID. If deviceIDs is empty then the keys of all the user's devices are
+	// returned. Devices without keys are omitted.
+	DeviceKeysForUser(ctx context.Context, userID string, deviceIDs []string) (map[string]json.RawMessage, error)
+	// OneTimeKeyCounts returns the number of unclaimed one-time keys of each
+	// algorithm that a device has.
+	OneTimeKeyCounts(ctx context.Context, userID, deviceID string) (map[string]int, error)
+	// ClaimOneTimeKey removes a one-time key of the given algorithm for a
+	// device and returns it keyed by "<algorithm>:<key ID>". Returns an empty
+	// map if the device has no keys of that algorithm left.
+	ClaimOneTimeKey(ctx context.Context, userID, deviceID, algorithm string) (map[string]json.RawMessage, error)
+	// DeleteDeviceKeys removes all of the keys of a device.
+	DeleteDeviceKeys(ctx context.Context, userID, deviceID string) error
+}
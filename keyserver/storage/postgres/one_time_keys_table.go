@@ -0,0 +1,153 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+
+	"github.com/matrix-org/dendrite/common"
+)
+
+const oneTimeKeysSchema = `
+-- Stores the one-time keys that each device has uploaded and that have not
+-- been claimed yet.
+CREATE TABLE IF NOT EXISTS keyserver_one_time_keys (
+    -- The Matrix user ID of the owner of the device.
+    user_id TEXT NOT NULL,
+    -- The ID of the device.
+    device_id TEXT NOT NULL,
+    -- The algorithm of the key, e.g. "signed_curve25519".
+    algorithm TEXT NOT NULL,
+    -- The ID of the key, unique per device and algorithm.
+    key_id TEXT NOT NULL,
+    -- The key JSON, as uploaded by the device.
+    key_json TEXT NOT NULL,
+    CONSTRAINT keyserver_one_time_keys_unique UNIQUE (user_id, device_id, algorithm, key_id)
+);
+`
+
+const insertOneTimeKeySQL = "" +
+	"INSERT INTO keyserver_one_time_keys (user_id, device_id, algorithm, key_id, key_json)" +
+	" VALUES ($1, $2, $3, $4, $5)" +
+	" ON CONFLICT ON CONSTRAINT keyserver_one_time_keys_unique DO NOTHING"
+
+const selectOneTimeKeyCountsSQL = "" +
+	"SELECT algorithm, COUNT(key_id) FROM keyserver_one_time_keys" +
+	" WHERE user_id = $1 AND device_id = $2 GROUP BY algorithm"
+
+const selectOneTimeKeyForUpdateSQL = "" +
+	"SELECT key_id, key_json FROM keyserver_one_time_keys" +
+	" WHERE user_id = $1 AND device_id = $2 AND algorithm = $3" +
+	" LIMIT 1 FOR UPDATE"
+
+const deleteOneTimeKeySQL = "" +
+	"DELETE FROM keyserver_one_time_keys" +
+	" WHERE user_id = $1 AND device_id = $2 AND algorithm = $3 AND key_id = $4"
+
+const deleteOneTimeKeysForDeviceSQL = "" +
+	"DELETE FROM keyserver_one_time_keys WHERE user_id = $1 AND device_id = $2"
+
+type oneTimeKeysStatements struct {
+	insertOneTimeKeyStmt           *sql.Stmt
+	selectOneTimeKeyCountsStmt     *sql.Stmt
+	selectOneTimeKeyForUpdateStmt  *sql.Stmt
+	deleteOneTimeKeyStmt           *sql.Stmt
+	deleteOneTimeKeysForDeviceStmt *sql.Stmt
+}
+
+func (s *oneTimeKeysStatements) prepare(db *sql.DB) (err error) {
+	_, err = db.Exec(oneTimeKeysSchema)
+	if err != nil {
+		return
+	}
+	if s.insertOneTimeKeyStmt, err = db.Prepare(insertOneTimeKeySQL); err != nil {
+		return
+	}
+	if s.selectOneTimeKeyCountsStmt, err = db.Prepare(selectOneTimeKeyCountsSQL); err != nil {
+		return
+	}
+	if s.selectOneTimeKeyForUpdateStmt, err = db.Prepare(selectOneTimeKeyForUpdateSQL); err != nil {
+		return
+	}
+	if s.deleteOneTimeKeyStmt, err = db.Prepare(deleteOneTimeKeySQL); err != nil {
+		return
+	}
+	if s.deleteOneTimeKeysForDeviceStmt, err = db.Prepare(deleteOneTimeKeysForDeviceSQL); err != nil {
+		return
+	}
+	return
+}
+
+func (s *oneTimeKeysStatements) insertOneTimeKey(
+	ctx context.Context, txn *sql.Tx,
+	userID, deviceID, algorithm, keyID string, keyJSON json.RawMessage,
+) error {
+	stmt := common.TxStmt(txn, s.insertOneTimeKeyStmt)
+	_, err := stmt.ExecContext(ctx, userID, deviceID, algorithm, keyID, string(keyJSON))
+	return err
+}
+
+func (s *oneTimeKeysStatements) selectOneTimeKeyCounts(
+	ctx context.Context, userID, deviceID string,
+) (map[string]int, error) {
+	rows, err := s.selectOneTimeKeyCountsStmt.QueryContext(ctx, userID, deviceID)
+	if err != nil {
+		return nil, err
+	}
+	defer common.CloseAndLogIfError(ctx, rows, "selectOneTimeKeyCounts: rows.close() failed")
+
+	counts := make(map[string]int)
+	for rows.Next() {
+		var algorithm string
+		var count int
+		if err = rows.Scan(&algorithm, &count); err != nil {
+			return nil, err
+		}
+		counts[algorithm] = count
+	}
+	return counts, rows.Err()
+}
+
+// selectOneTimeKeyForUpdate returns the ID and JSON of one of the device's
+// keys of the given algorithm, or an empty key ID if there are none left.
+func (s *oneTimeKeysStatements) selectOneTimeKeyForUpdate(
+	ctx context.Context, txn *sql.Tx, userID, deviceID, algorithm string,
+) (keyID string, keyJSON json.RawMessage, err error) {
+	var keyJSONStr string
+	stmt := common.TxStmt(txn, s.selectOneTimeKeyForUpdateStmt)
+	err = stmt.QueryRowContext(ctx, userID, deviceID, algorithm).Scan(&keyID, &keyJSONStr)
+	if err == sql.ErrNoRows {
+		return "", nil, nil
+	}
+	return keyID, json.RawMessage(keyJSONStr), err
+}
+
+func (s *oneTimeKeysStatements) deleteOneTimeKey(
+	ctx context.Context, txn *sql.Tx, userID, deviceID, algorithm, keyID string,
+) error {
+	stmt := common.TxStmt(txn, s.deleteOneTimeKeyStmt)
+	_, err := stmt.ExecContext(ctx, userID, deviceID, algorithm, keyID)
+	return err
+}
+
+func (s *oneTimeKeysStatements) deleteOneTimeKeysForDevice(
+	ctx context.Context, txn *sql.Tx, userID, deviceID string,
+) error {
+	stmt := common.TxStmt(txn, s.deleteOneTimeKeysForDeviceStmt)
+	_, err := stmt.ExecContext(ctx, userID, deviceID)
+	return err
+}
@@ -0,0 +1,132 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"strings"
+
+	"github.com/matrix-org/dendrite/common"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// Database stores the end-to-end encryption keys of local devices.
+type Database struct {
+	deviceKeysStatements
+	oneTimeKeysStatements
+	db *sql.DB
+}
+
+// NewDatabase opens a new database
+func NewDatabase(dataSourceName string) (*Database, error) {
+	var result Database
+	var err error
+	if result.db, err = sql.Open(common.SQLiteDriverName(), dataSourceName); err != nil {
+		return nil, err
+	}
+	if err = result.deviceKeysStatements.prepare(result.db); err != nil {
+		return nil, err
+	}
+	if err = result.oneTimeKeysStatements.prepare(result.db); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// StoreDeviceKeys implements storage.Database
+func (d *Database) StoreDeviceKeys(
+	ctx context.Context, userID, deviceID string, keyJSON json.RawMessage,
+) (changed bool, err error) {
+	err = common.WithTransaction(d.db, func(txn *sql.Tx) error {
+		oldKeyJSON, err := d.selectDeviceKeys(ctx, txn, userID, deviceID)
+		if err != nil {
+			return err
+		}
+		if bytes.Equal(oldKeyJSON, keyJSON) {
+			return nil
+		}
+		changed = true
+		return d.upsertDeviceKeys(ctx, txn, userID, deviceID, keyJSON)
+	})
+	return
+}
+
+// StoreOneTimeKeys implements storage.Database
+func (d *Database) StoreOneTimeKeys(
+	ctx context.Context, userID, deviceID string, keys map[string]json.RawMessage,
+) error {
+	return common.WithTransaction(d.db, func(txn *sql.Tx) error {
+		for algorithmAndKeyID, keyJSON := range keys {
+			algorithm, keyID := splitAlgorithmAndKeyID(algorithmAndKeyID)
+			if err := d.insertOneTimeKey(ctx, txn, userID, deviceID, algorithm, keyID, keyJSON); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// DeviceKeysForUser implements storage.Database
+func (d *Database) DeviceKeysForUser(
+	ctx context.Context, userID string, deviceIDs []string,
+) (map[string]json.RawMessage, error) {
+	return d.selectDeviceKeysForUser(ctx, userID, deviceIDs)
+}
+
+// OneTimeKeyCounts implements storage.Database
+func (d *Database) OneTimeKeyCounts(
+	ctx context.Context, userID, deviceID string,
+) (map[string]int, error) {
+	return d.selectOneTimeKeyCounts(ctx, userID, deviceID)
+}
+
+// ClaimOneTimeKey implements storage.Database
+func (d *Database) ClaimOneTimeKey(
+	ctx context.Context, userID, deviceID, algorithm string,
+) (claimed map[string]json.RawMessage, err error) {
+	claimed = make(map[string]json.RawMessage)
+	err = common.WithTransaction(d.db, func(txn *sql.Tx) error {
+		keyID, keyJSON, err := d.selectOneTimeKeyForUpdate(ctx, txn, userID, deviceID, algorithm)
+		if err != nil || keyID == "" {
+			return err
+		}
+		claimed[algorithm+":"+keyID] = keyJSON
+		return d.deleteOneTimeKey(ctx, txn, userID, deviceID, algorithm, keyID)
+	})
+	return
+}
+
+// DeleteDeviceKeys implements storage.Database
+func (d *Database) DeleteDeviceKeys(ctx context.Context, userID, deviceID string) error {
+	return common.WithTransaction(d.db, func(txn *sql.Tx) error {
+		if err := d.deleteDeviceKeys(ctx, txn, userID, deviceID); err != nil {
+			return err
+		}
+		return d.deleteOneTimeKeysForDevice(ctx, txn, userID, deviceID)
+	})
+}
+
+// splitAlgorithmAndKeyID splits a one-time key name of the form
+// "<algorithm>:<key ID>" into its parts.
+func splitAlgorithmAndKeyID(algorithmAndKeyID string) (algorithm, keyID string) {
+	parts := strings.SplitN(algorithmAndKeyID, ":", 2)
+	if len(parts) != 2 {
+		return parts[0], ""
+	}
+	return parts[0], parts[1]
+}
@@ -0,0 +1,94 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package api provides the types that are used to communicate with the presence server.
+package api
+
+import (
+	"context"
+	"net/http"
+
+	commonHTTP "github.com/matrix-org/dendrite/common/http"
+	"github.com/matrix-org/gomatrixserverlib"
+	opentracing "github.com/opentracing/opentracing-go"
+)
+
+// The presence states that a user can be in.
+const (
+	PresenceOnline      = "online"
+	PresenceUnavailable = "unavailable"
+	PresenceOffline     = "offline"
+)
+
+// InputPresenceEvent is an event for notifying the presence server about a
+// change in the presence of a user, or that they have been active.
+type InputPresenceEvent struct {
+	// UserID of the user to update the presence of.
+	UserID string `json:"user_id"`
+	// Presence is the new presence state of the user.
+	Presence string `json:"presence"`
+	// StatusMsg is the new status message of the user. If nil, the user keeps
+	// their current status message.
+	StatusMsg *string `json:"status_msg,omitempty"`
+	// LastActiveTS is when the user was last active.
+	LastActiveTS gomatrixserverlib.Timestamp `json:"last_active_ts"`
+	// CurrentlyActive is true if the user is actively using their client.
+	CurrentlyActive bool `json:"currently_active"`
+}
+
+// InputPresenceEventRequest is a request to PresenceServerInputAPI
+type InputPresenceEventRequest struct {
+	InputPresenceEvent InputPresenceEvent `json:"input_presence_event"`
+}
+
+// InputPresenceEventResponse is a response to InputPresenceEvent
+type InputPresenceEventResponse struct{}
+
+// PresenceServerInputAPI is used to write events to the presence server.
+type PresenceServerInputAPI interface {
+	InputPresenceEvent(
+		ctx context.Context,
+		request *InputPresenceEventRequest,
+		response *InputPresenceEventResponse,
+	) error
+}
+
+// PresenceServerInputPresenceEventPath is the HTTP path for the InputPresenceEvent API.
+const PresenceServerInputPresenceEventPath = "/api/presenceserver/input"
+
+// NewPresenceServerInputAPIHTTP creates a PresenceServerInputAPI implemented by talking to a HTTP POST API.
+func NewPresenceServerInputAPIHTTP(presenceServerURL string, httpClient *http.Client) PresenceServerInputAPI {
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	return &httpPresenceServerInputAPI{presenceServerURL, httpClient}
+}
+
+type httpPresenceServerInputAPI struct {
+	presenceServerURL string
+	httpClient        *http.Client
+}
+
+// InputPresenceEvent implements PresenceServerInputAPI
+func (h *httpPresenceServerInputAPI) InputPresenceEvent(
+	ctx context.Context,
+	request *InputPresenceEventRequest,
+	response *InputPresenceEventResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "InputPresenceEvent")
+	defer span.Finish()
+
+	apiURL := h.presenceServerURL + PresenceServerInputPresenceEventPath
+	return commonHTTP.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
+}
@@ -0,0 +1,28 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import "github.com/matrix-org/gomatrixserverlib"
+
+// OutputPresenceEvent is an entry in presence server output kafka log.
+// It is sent whenever the presence state, status message or activity of a
+// user changes.
+type OutputPresenceEvent struct {
+	UserID          string                      `json:"user_id"`
+	Presence        string                      `json:"presence"`
+	StatusMsg       string                      `json:"status_msg"`
+	LastActiveTS    gomatrixserverlib.Timestamp `json:"last_active_ts"`
+	CurrentlyActive bool                        `json:"currently_active"`
+}
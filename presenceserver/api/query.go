@@ -0,0 +1,81 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"context"
+	"net/http"
+
+	commonHTTP "github.com/matrix-org/dendrite/common/http"
+	"github.com/matrix-org/gomatrixserverlib"
+	opentracing "github.com/opentracing/opentracing-go"
+)
+
+// QueryPresenceForUserRequest is a request to QueryPresenceForUser
+type QueryPresenceForUserRequest struct {
+	// The user ID to look up the presence of.
+	UserID string `json:"user_id"`
+}
+
+// QueryPresenceForUserResponse is a response to QueryPresenceForUser
+type QueryPresenceForUserResponse struct {
+	// The presence state of the user. Users that we know nothing about are
+	// reported as offline.
+	Presence string `json:"presence"`
+	// The status message of the user, if they have set one.
+	StatusMsg string `json:"status_msg"`
+	// When the user was last active, or 0 if it is not known.
+	LastActiveTS gomatrixserverlib.Timestamp `json:"last_active_ts"`
+	// Whether the user is actively using their client.
+	CurrentlyActive bool `json:"currently_active"`
+}
+
+// PresenceServerQueryAPI is used to query the presence of users.
+type PresenceServerQueryAPI interface {
+	QueryPresenceForUser(
+		ctx context.Context,
+		request *QueryPresenceForUserRequest,
+		response *QueryPresenceForUserResponse,
+	) error
+}
+
+// PresenceServerQueryPresenceForUserPath is the HTTP path for the QueryPresenceForUser API.
+const PresenceServerQueryPresenceForUserPath = "/api/presenceserver/queryPresenceForUser"
+
+// NewPresenceServerQueryAPIHTTP creates a PresenceServerQueryAPI implemented by talking to a HTTP POST API.
+func NewPresenceServerQueryAPIHTTP(presenceServerURL string, httpClient *http.Client) PresenceServerQueryAPI {
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	return &httpPresenceServerQueryAPI{presenceServerURL, httpClient}
+}
+
+type httpPresenceServerQueryAPI struct {
+	presenceServerURL string
+	httpClient        *http.Client
+}
+
+// QueryPresenceForUser implements PresenceServerQueryAPI
+func (h *httpPresenceServerQueryAPI) QueryPresenceForUser(
+	ctx context.Context,
+	request *QueryPresenceForUserRequest,
+	response *QueryPresenceForUserResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "QueryPresenceForUser")
+	defer span.Finish()
+
+	apiURL := h.presenceServerURL + PresenceServerQueryPresenceForUserPath
+	return commonHTTP.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
+}
@@ -0,0 +1,139 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cache
+
+import (
+	"sync"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// How long a user can go without doing anything before they are considered
+// idle and are marked as unavailable.
+const defaultIdleTimeout = 5 * time.Minute
+
+// The presence states that the cache deals with. These match the states in
+// presenceserver/api.
+const (
+	presenceOnline      = "online"
+	presenceUnavailable = "unavailable"
+	presenceOffline     = "offline"
+)
+
+// UserPresence is the presence of a single user.
+type UserPresence struct {
+	Presence        string
+	StatusMsg       string
+	LastActiveTS    gomatrixserverlib.Timestamp
+	CurrentlyActive bool
+}
+
+// IdleCallbackFn is a function called right after a user has been marked as
+// unavailable because they have been idle for too long.
+type IdleCallbackFn func(userID string, presence UserPresence)
+
+type userData struct {
+	presence  UserPresence
+	idleTimer *time.Timer
+}
+
+// PresenceCache maintains the presence of each user that we know about.
+type PresenceCache struct {
+	sync.RWMutex
+	data         map[string]*userData
+	idleTimeout  time.Duration
+	idleCallback IdleCallbackFn
+}
+
+// NewPresenceCache returns a new PresenceCache initialised for use.
+func NewPresenceCache() *PresenceCache {
+	return &PresenceCache{
+		data:        make(map[string]*userData),
+		idleTimeout: defaultIdleTimeout,
+	}
+}
+
+// SetIdleCallback sets a callback function that is called right after a user
+// is marked as unavailable due to being idle.
+func (c *PresenceCache) SetIdleCallback(fn IdleCallbackFn) {
+	c.idleCallback = fn
+}
+
+// GetPresence returns the presence of a user. Users that we know nothing
+// about are reported as offline.
+func (c *PresenceCache) GetPresence(userID string) UserPresence {
+	c.RLock()
+	defer c.RUnlock()
+
+	if data, ok := c.data[userID]; ok {
+		return data.presence
+	}
+	return UserPresence{Presence: presenceOffline}
+}
+
+// SetPresence updates the presence of a user. Users who are online and active
+// are marked as unavailable once they have been idle for the idle timeout.
+// Returns true if the presence state, status message or activity of the user
+// changed, as opposed to only their last active time.
+func (c *PresenceCache) SetPresence(userID string, presence UserPresence) (changed bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	data, ok := c.data[userID]
+	if !ok {
+		data = &userData{presence: UserPresence{Presence: presenceOffline}}
+		c.data[userID] = data
+	}
+	old := data.presence
+	changed = old.Presence != presence.Presence ||
+		old.StatusMsg != presence.StatusMsg ||
+		old.CurrentlyActive != presence.CurrentlyActive
+	data.presence = presence
+
+	if data.idleTimer != nil {
+		data.idleTimer.Stop()
+		data.idleTimer = nil
+	}
+	if presence.Presence == presenceOnline {
+		idleAt := presence.LastActiveTS.Time().Add(c.idleTimeout)
+		lastActiveTS := presence.LastActiveTS
+		data.idleTimer = time.AfterFunc(time.Until(idleAt), func() {
+			c.markIdle(userID, lastActiveTS)
+		})
+	}
+	return
+}
+
+// markIdle marks a user as unavailable, unless they have been active since
+// the given time.
+func (c *PresenceCache) markIdle(userID string, lastActiveTS gomatrixserverlib.Timestamp) {
+	c.Lock()
+	data, ok := c.data[userID]
+	if !ok || data.presence.Presence != presenceOnline || data.presence.LastActiveTS != lastActiveTS {
+		// The user has done something since the timer was started.
+		c.Unlock()
+		return
+	}
+	data.presence.Presence = presenceUnavailable
+	data.presence.CurrentlyActive = false
+	data.idleTimer = nil
+	presence := data.presence
+	c.Unlock()
+
+	if c.idleCallback != nil {
+		c.idleCallback(userID, presence)
+	}
+}
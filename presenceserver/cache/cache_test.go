@@ -0,0 +1,89 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cache
+
+import (
+	"testing"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+func TestPresenceCache(t *testing.T) {
+	pCache := NewPresenceCache()
+	if pCache == nil {
+		t.Fatal("NewPresenceCache failed")
+	}
+
+	t.Run("SetPresence", func(t *testing.T) {
+		testSetPresence(t, pCache)
+	})
+
+	t.Run("IdleTimeout", func(t *testing.T) {
+		testIdleTimeout(t, pCache)
+	})
+}
+
+func testSetPresence(t *testing.T, pCache *PresenceCache) {
+	if got := pCache.GetPresence("@unknown:localhost"); got.Presence != presenceOffline {
+		t.Errorf("unknown user: got presence %q, want %q", got.Presence, presenceOffline)
+	}
+
+	now := gomatrixserverlib.AsTimestamp(time.Now())
+	tests := []struct {
+		presence    UserPresence
+		wantChanged bool
+	}{
+		{UserPresence{Presence: presenceOnline, LastActiveTS: now, CurrentlyActive: true}, true},
+		// Only the last active time changes.
+		{UserPresence{Presence: presenceOnline, LastActiveTS: now + 1000, CurrentlyActive: true}, false},
+		{UserPresence{Presence: presenceOnline, StatusMsg: "busy", LastActiveTS: now + 2000, CurrentlyActive: true}, true},
+		{UserPresence{Presence: presenceUnavailable, StatusMsg: "busy", LastActiveTS: now + 3000}, true},
+	}
+
+	for _, tt := range tests {
+		if changed := pCache.SetPresence("@user1:localhost", tt.presence); changed != tt.wantChanged {
+			t.Errorf("SetPresence(%+v): got changed %v, want %v", tt.presence, changed, tt.wantChanged)
+		}
+		if got := pCache.GetPresence("@user1:localhost"); got != tt.presence {
+			t.Errorf("GetPresence: got %+v, want %+v", got, tt.presence)
+		}
+	}
+}
+
+func testIdleTimeout(t *testing.T, pCache *PresenceCache) {
+	idle := make(chan UserPresence, 1)
+	pCache.SetIdleCallback(func(userID string, presence UserPresence) {
+		idle <- presence
+	})
+
+	// The user was last active long enough ago that they are idle already.
+	lastActive := gomatrixserverlib.AsTimestamp(time.Now().Add(-defaultIdleTimeout))
+	pCache.SetPresence("@user2:localhost", UserPresence{
+		Presence: presenceOnline, LastActiveTS: lastActive, CurrentlyActive: true,
+	})
+
+	select {
+	case presence := <-idle:
+		if presence.Presence != presenceUnavailable || presence.CurrentlyActive {
+			t.Errorf("idle callback: got %+v, want unavailable and not currently active", presence)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for the user to be marked as idle")
+	}
+	if got := pCache.GetPresence("@user2:localhost"); got.Presence != presenceUnavailable {
+		t.Errorf("GetPresence: got presence %q, want %q", got.Presence, presenceUnavailable)
+	}
+}
@@ -0,0 +1,105 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package input
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/presenceserver/api"
+	"github.com/matrix-org/dendrite/presenceserver/cache"
+	"github.com/matrix-org/util"
+	"gopkg.in/Shopify/sarama.v1"
+)
+
+// PresenceServerInputAPI implements api.PresenceServerInputAPI
+type PresenceServerInputAPI struct {
+	// Cache to store the current presence of each user.
+	Cache *cache.PresenceCache
+	// The kafka topic to output new presence events to.
+	OutputPresenceEventTopic string
+	// kafka producer
+	Producer sarama.SyncProducer
+}
+
+// InputPresenceEvent implements api.PresenceServerInputAPI
+func (p *PresenceServerInputAPI) InputPresenceEvent(
+	ctx context.Context,
+	request *api.InputPresenceEventRequest,
+	response *api.InputPresenceEventResponse,
+) error {
+	ipe := &request.InputPresenceEvent
+	presence := cache.UserPresence{
+		Presence:        ipe.Presence,
+		LastActiveTS:    ipe.LastActiveTS,
+		CurrentlyActive: ipe.CurrentlyActive,
+	}
+	if ipe.StatusMsg != nil {
+		presence.StatusMsg = *ipe.StatusMsg
+	} else {
+		presence.StatusMsg = p.Cache.GetPresence(ipe.UserID).StatusMsg
+	}
+
+	// Only let the other components know about the update if something other
+	// than the last active time changed, as that changes all the time.
+	if !p.Cache.SetPresence(ipe.UserID, presence) {
+		return nil
+	}
+	return p.SendPresence(ipe.UserID, presence)
+}
+
+// SendPresence sends the presence of a user to the output kafka log.
+func (p *PresenceServerInputAPI) SendPresence(userID string, presence cache.UserPresence) error {
+	ope := &api.OutputPresenceEvent{
+		UserID:          userID,
+		Presence:        presence.Presence,
+		StatusMsg:       presence.StatusMsg,
+		LastActiveTS:    presence.LastActiveTS,
+		CurrentlyActive: presence.CurrentlyActive,
+	}
+
+	eventJSON, err := json.Marshal(ope)
+	if err != nil {
+		return err
+	}
+
+	m := &sarama.ProducerMessage{
+		Topic: p.OutputPresenceEventTopic,
+		Key:   sarama.StringEncoder(userID),
+		Value: sarama.ByteEncoder(eventJSON),
+	}
+
+	_, _, err = p.Producer.SendMessage(m)
+	return err
+}
+
+// SetupHTTP adds the PresenceServerInputAPI handlers to the http.ServeMux.
+func (p *PresenceServerInputAPI) SetupHTTP(servMux *http.ServeMux) {
+	servMux.Handle(api.PresenceServerInputPresenceEventPath,
+		common.MakeInternalAPI("inputPresenceEvent", func(req *http.Request) util.JSONResponse {
+			var request api.InputPresenceEventRequest
+			var response api.InputPresenceEventResponse
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				return util.MessageResponse(http.StatusBadRequest, err.Error())
+			}
+			if err := p.InputPresenceEvent(req.Context(), &request, &response); err != nil {
+				return util.ErrorResponse(err)
+			}
+			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
+		}),
+	)
+}
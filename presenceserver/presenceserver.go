@@ -0,0 +1,55 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package presenceserver
+
+import (
+	"net/http"
+
+	"github.com/matrix-org/dendrite/common/basecomponent"
+	"github.com/matrix-org/dendrite/presenceserver/api"
+	"github.com/matrix-org/dendrite/presenceserver/cache"
+	"github.com/matrix-org/dendrite/presenceserver/input"
+	"github.com/matrix-org/dendrite/presenceserver/query"
+	"github.com/sirupsen/logrus"
+)
+
+// SetupPresenceServerComponent sets up and registers HTTP handlers for the
+// PresenceServer component. Returns instances of the various presence server
+// APIs, allowing other components running in the same process to hit the
+// APIs directly instead of having to use HTTP.
+func SetupPresenceServerComponent(
+	base *basecomponent.BaseDendrite,
+	presenceCache *cache.PresenceCache,
+) (api.PresenceServerInputAPI, api.PresenceServerQueryAPI) {
+	inputAPI := &input.PresenceServerInputAPI{
+		Cache:                    presenceCache,
+		Producer:                 base.KafkaProducer,
+		OutputPresenceEventTopic: string(base.Cfg.Kafka.Topics.OutputPresenceEvent),
+	}
+	queryAPI := &query.PresenceServerQueryAPI{
+		Cache: presenceCache,
+	}
+
+	// Let the other components know when users go idle.
+	presenceCache.SetIdleCallback(func(userID string, presence cache.UserPresence) {
+		if err := inputAPI.SendPresence(userID, presence); err != nil {
+			logrus.WithError(err).WithField("user_id", userID).Error("Failed to send idle presence")
+		}
+	})
+
+	inputAPI.SetupHTTP(http.DefaultServeMux)
+	queryAPI.SetupHTTP(http.DefaultServeMux)
+	return inputAPI, queryAPI
+}
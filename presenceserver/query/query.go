@@ -0,0 +1,63 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package query
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/presenceserver/api"
+	"github.com/matrix-org/dendrite/presenceserver/cache"
+	"github.com/matrix-org/util"
+)
+
+// PresenceServerQueryAPI implements api.PresenceServerQueryAPI
+type PresenceServerQueryAPI struct {
+	// Cache to look up the current presence of each user in.
+	Cache *cache.PresenceCache
+}
+
+// QueryPresenceForUser implements api.PresenceServerQueryAPI
+func (p *PresenceServerQueryAPI) QueryPresenceForUser(
+	ctx context.Context,
+	request *api.QueryPresenceForUserRequest,
+	response *api.QueryPresenceForUserResponse,
+) error {
+	presence := p.Cache.GetPresence(request.UserID)
+	response.Presence = presence.Presence
+	response.StatusMsg = presence.StatusMsg
+	response.LastActiveTS = presence.LastActiveTS
+	response.CurrentlyActive = presence.CurrentlyActive
+	return nil
+}
+
+// SetupHTTP adds the PresenceServerQueryAPI handlers to the http.ServeMux.
+func (p *PresenceServerQueryAPI) SetupHTTP(servMux *http.ServeMux) {
+	servMux.Handle(api.PresenceServerQueryPresenceForUserPath,
+		common.MakeInternalAPI("queryPresenceForUser", func(req *http.Request) util.JSONResponse {
+			var request api.QueryPresenceForUserRequest
+			var response api.QueryPresenceForUserResponse
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				return util.ErrorResponse(err)
+			}
+			if err := p.QueryPresenceForUser(req.Context(), &request, &response); err != nil {
+				return util.ErrorResponse(err)
+			}
+			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
+		}),
+	)
+}
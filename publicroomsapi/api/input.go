@@ -0,0 +1,72 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"context"
+	"net/http"
+
+	commonHTTP "github.com/matrix-org/dendrite/common/http"
+	opentracing "github.com/opentracing/opentracing-go"
+)
+
+// InputRoomVisibilityRequest is a request to InputRoomVisibility
+type InputRoomVisibilityRequest struct {
+	RoomID string `json:"room_id"`
+	// Either "public" or "private".
+	Visibility string `json:"visibility"`
+}
+
+// InputRoomVisibilityResponse is a response to InputRoomVisibility
+type InputRoomVisibilityResponse struct{}
+
+// PublicRoomsInputAPI is used to make changes to the room directory.
+type PublicRoomsInputAPI interface {
+	// Publish a room in the room directory, or remove it from the directory.
+	InputRoomVisibility(
+		ctx context.Context,
+		request *InputRoomVisibilityRequest,
+		response *InputRoomVisibilityResponse,
+	) error
+}
+
+// PublicRoomsInputRoomVisibilityPath is the HTTP path for the InputRoomVisibility API.
+const PublicRoomsInputRoomVisibilityPath = "/api/publicrooms/inputRoomVisibility"
+
+// NewPublicRoomsInputAPIHTTP creates a PublicRoomsInputAPI implemented by talking to a HTTP POST API.
+func NewPublicRoomsInputAPIHTTP(publicRoomsURL string, httpClient *http.Client) PublicRoomsInputAPI {
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	return &httpPublicRoomsInputAPI{publicRoomsURL, httpClient}
+}
+
+type httpPublicRoomsInputAPI struct {
+	publicRoomsURL string
+	httpClient     *http.Client
+}
+
+// InputRoomVisibility implements PublicRoomsInputAPI
+func (h *httpPublicRoomsInputAPI) InputRoomVisibility(
+	ctx context.Context,
+	request *InputRoomVisibilityRequest,
+	response *InputRoomVisibilityResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "InputRoomVisibility")
+	defer span.Finish()
+
+	apiURL := h.publicRoomsURL + PublicRoomsInputRoomVisibilityPath
+	return commonHTTP.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
+}
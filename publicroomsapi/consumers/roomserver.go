@@ -71,30 +71,39 @@ func (s *OutputRoomEventConsumer) onMessage(msg *sarama.ConsumerMessage) error {
 		return nil
 	}
 
-	if output.Type != api.OutputTypeNewRoomEvent {
+	switch output.Type {
+	case api.OutputTypeNewRoomEvent:
+		return s.onNewRoomEvent(context.TODO(), *output.NewRoomEvent)
+	case api.OutputTypeRedactedEvent:
+		return s.onRedactedEvent(context.TODO(), *output.RedactedEvent)
+	default:
 		log.WithField("type", output.Type).Debug(
 			"roomserver output log: ignoring unknown output type",
 		)
 		return nil
 	}
+}
 
-	ev := output.NewRoomEvent.Event
+func (s *OutputRoomEventConsumer) onNewRoomEvent(
+	ctx context.Context, msg api.OutputNewRoomEvent,
+) error {
+	ev := msg.Event
 	log.WithFields(log.Fields{
 		"event_id": ev.EventID(),
 		"room_id":  ev.RoomID(),
 		"type":     ev.Type(),
 	}).Info("received event from roomserver")
 
-	addQueryReq := api.QueryEventsByIDRequest{EventIDs: output.NewRoomEvent.AddsStateEventIDs}
+	addQueryReq := api.QueryEventsByIDRequest{EventIDs: msg.AddsStateEventIDs}
 	var addQueryRes api.QueryEventsByIDResponse
-	if err := s.query.QueryEventsByID(context.TODO(), &addQueryReq, &addQueryRes); err != nil {
+	if err := s.query.QueryEventsByID(ctx, &addQueryReq, &addQueryRes); err != nil {
 		log.Warn(err)
 		return err
 	}
 
-	remQueryReq := api.QueryEventsByIDRequest{EventIDs: output.NewRoomEvent.RemovesStateEventIDs}
+	remQueryReq := api.QueryEventsByIDRequest{EventIDs: msg.RemovesStateEventIDs}
 	var remQueryRes api.QueryEventsByIDResponse
-	if err := s.query.QueryEventsByID(context.TODO(), &remQueryReq, &remQueryRes); err != nil {
+	if err := s.query.QueryEventsByID(ctx, &remQueryReq, &remQueryRes); err != nil {
 		log.Warn(err)
 		return err
 	}
@@ -107,5 +116,47 @@ func (s *OutputRoomEventConsumer) onMessage(msg *sarama.ConsumerMessage) error {
 		remQueryEvents = append(remQueryEvents, headeredEvent.Event)
 	}
 
-	return s.db.UpdateRoomFromEvents(context.TODO(), addQueryEvents, remQueryEvents)
+	return s.db.UpdateRoomFromEvents(ctx, addQueryEvents, remQueryEvents)
+}
+
+// onRedactedEvent updates the room when one of the state events of its
+// current state gets redacted, e.g. so that a redacted room name or topic is
+// no longer listed in the room directory.
+func (s *OutputRoomEventConsumer) onRedactedEvent(
+	ctx context.Context, msg api.OutputRedactedEvent,
+) error {
+	// The roomserver only serves the redacted form of the event from now on.
+	eventsReq := api.QueryEventsByIDRequest{EventIDs: []string{msg.RedactedEventID}}
+	var eventsRes api.QueryEventsByIDResponse
+	if err := s.query.QueryEventsByID(ctx, &eventsReq, &eventsRes); err != nil {
+		log.Warn(err)
+		return err
+	}
+	if len(eventsRes.Events) == 0 {
+		return nil
+	}
+	ev := eventsRes.Events[0].Event
+	// Redactions keep the membership of member events and the creator of
+	// create events, so they don't change anything that we track for them.
+	if ev.StateKey() == nil || ev.Type() == gomatrixserverlib.MRoomMember || ev.Type() == gomatrixserverlib.MRoomCreate {
+		return nil
+	}
+
+	stateReq := api.QueryLatestEventsAndStateRequest{
+		RoomID: ev.RoomID(),
+		StateToFetch: []gomatrixserverlib.StateKeyTuple{
+			{EventType: ev.Type(), StateKey: *ev.StateKey()},
+		},
+	}
+	var stateRes api.QueryLatestEventsAndStateResponse
+	if err := s.query.QueryLatestEventsAndState(ctx, &stateReq, &stateRes); err != nil {
+		log.Warn(err)
+		return err
+	}
+	if len(stateRes.StateEvents) == 0 || stateRes.StateEvents[0].EventID() != ev.EventID() {
+		// The event isn't part of the current state of the room anymore.
+		return nil
+	}
+
+	return s.db.UpdateRoomFromEvents(ctx, []gomatrixserverlib.Event{ev}, nil)
 }
@@ -0,0 +1,59 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package input
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/publicroomsapi/api"
+	"github.com/matrix-org/dendrite/publicroomsapi/storage"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+// PublicRoomsInputAPI implements api.PublicRoomsInputAPI
+type PublicRoomsInputAPI struct {
+	DB storage.Database
+}
+
+// InputRoomVisibility implements api.PublicRoomsInputAPI
+func (p *PublicRoomsInputAPI) InputRoomVisibility(
+	ctx context.Context,
+	request *api.InputRoomVisibilityRequest,
+	response *api.InputRoomVisibilityResponse,
+) error {
+	isPublic := request.Visibility == gomatrixserverlib.Public
+	return p.DB.SetRoomVisibility(ctx, isPublic, request.RoomID)
+}
+
+// SetupHTTP adds the PublicRoomsInputAPI handlers to the http.ServeMux.
+func (p *PublicRoomsInputAPI) SetupHTTP(servMux *http.ServeMux) {
+	servMux.Handle(api.PublicRoomsInputRoomVisibilityPath,
+		common.MakeInternalAPI("inputRoomVisibility", func(req *http.Request) util.JSONResponse {
+			var request api.InputRoomVisibilityRequest
+			var response api.InputRoomVisibilityResponse
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				return util.MessageResponse(http.StatusBadRequest, err.Error())
+			}
+			if err := p.InputRoomVisibility(req.Context(), &request, &response); err != nil {
+				return util.ErrorResponse(err)
+			}
+			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
+		}),
+	)
+}
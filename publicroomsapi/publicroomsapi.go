@@ -15,9 +15,13 @@
 package publicroomsapi
 
 import (
+	"net/http"
+
 	"github.com/matrix-org/dendrite/clientapi/auth/storage/devices"
 	"github.com/matrix-org/dendrite/common/basecomponent"
+	"github.com/matrix-org/dendrite/publicroomsapi/api"
 	"github.com/matrix-org/dendrite/publicroomsapi/consumers"
+	"github.com/matrix-org/dendrite/publicroomsapi/input"
 	"github.com/matrix-org/dendrite/publicroomsapi/routing"
 	"github.com/matrix-org/dendrite/publicroomsapi/storage"
 	"github.com/matrix-org/dendrite/publicroomsapi/types"
@@ -27,14 +31,16 @@ import (
 )
 
 // SetupPublicRoomsAPIComponent sets up and registers HTTP handlers for the PublicRoomsAPI
-// component.
+// component. Returns an instance of the public rooms input API, allowing other
+// components running in the same process to hit the API directly instead of
+// having to use HTTP.
 func SetupPublicRoomsAPIComponent(
 	base *basecomponent.BaseDendrite,
 	deviceDB devices.Database,
 	rsQueryAPI roomserverAPI.RoomserverQueryAPI,
 	fedClient *gomatrixserverlib.FederationClient,
 	extRoomsProvider types.ExternalPublicRoomsProvider,
-) {
+) api.PublicRoomsInputAPI {
 	publicRoomsDB, err := storage.NewPublicRoomsServerDatabase(string(base.Cfg.Database.PublicRoomsAPI))
 	if err != nil {
 		logrus.WithError(err).Panicf("failed to connect to public rooms db")
@@ -47,5 +53,10 @@ func SetupPublicRoomsAPIComponent(
 		logrus.WithError(err).Panic("failed to start public rooms server consumer")
 	}
 
+	inputAPI := &input.PublicRoomsInputAPI{DB: publicRoomsDB}
+	inputAPI.SetupHTTP(http.DefaultServeMux)
+
 	routing.Setup(base.APIMux, deviceDB, publicRoomsDB, fedClient, extRoomsProvider)
+
+	return inputAPI
 }
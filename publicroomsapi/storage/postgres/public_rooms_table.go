@@ -107,7 +107,8 @@ const selectRoomVisibilitySQL = "" +
 
 const insertNewRoomSQL = "" +
 	"INSERT INTO publicroomsapi_public_rooms(room_id)" +
-	" VALUES ($1)"
+	" VALUES ($1)" +
+	" ON CONFLICT (room_id) DO NOTHING"
 
 const incrementJoinedMembersInRoomSQL = "" +
 	"UPDATE publicroomsapi_public_rooms" +
@@ -64,10 +64,15 @@ func (d *PublicRoomsServerDatabase) GetRoomVisibility(
 
 // SetRoomVisibility updates the visibility attribute of a room. This attribute
 // must be set to true if the room is publicly visible, false if not.
+// A room that was just created may not have been added from its events yet, in
+// which case it is added here so that the visibility isn't lost.
 // Returns an error if the update failed.
 func (d *PublicRoomsServerDatabase) SetRoomVisibility(
 	ctx context.Context, visible bool, roomID string,
 ) error {
+	if err := d.statements.insertNewRoom(ctx, roomID); err != nil {
+		return err
+	}
 	return d.statements.updateRoomAttribute(ctx, "visibility", visible, roomID)
 }
 
@@ -0,0 +1,86 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package api provides the types that are used to communicate with the push server.
+package api
+
+import (
+	"context"
+	"net/http"
+
+	commonHTTP "github.com/matrix-org/dendrite/common/http"
+	opentracing "github.com/opentracing/opentracing-go"
+)
+
+// NotificationCounts are the numbers of unread events in a room that a user
+// was notified about.
+type NotificationCounts struct {
+	// The number of unread events that matched a push rule with a notify
+	// action.
+	NotificationCount int64 `json:"notification_count"`
+	// The number of those events that also set the highlight tweak.
+	HighlightCount int64 `json:"highlight_count"`
+}
+
+// QueryNotificationCountsRequest is a request to QueryNotificationCounts
+type QueryNotificationCountsRequest struct {
+	UserID  string   `json:"user_id"`
+	RoomIDs []string `json:"room_ids"`
+}
+
+// QueryNotificationCountsResponse is a response to QueryNotificationCounts
+type QueryNotificationCountsResponse struct {
+	// A map from room ID to the counts of the user in that room. Rooms
+	// without any unread notifications are omitted.
+	Counts map[string]NotificationCounts `json:"counts"`
+}
+
+// PushServerQueryAPI is used to query the unread notification counts of
+// local users.
+type PushServerQueryAPI interface {
+	QueryNotificationCounts(
+		ctx context.Context,
+		request *QueryNotificationCountsRequest,
+		response *QueryNotificationCountsResponse,
+	) error
+}
+
+// PushServerQueryNotificationCountsPath is the HTTP path for the QueryNotificationCounts API.
+const PushServerQueryNotificationCountsPath = "/api/pushserver/queryNotificationCounts"
+
+// NewPushServerQueryAPIHTTP creates a PushServerQueryAPI implemented by talking to a HTTP POST API.
+func NewPushServerQueryAPIHTTP(pushServerURL string, httpClient *http.Client) PushServerQueryAPI {
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	return &httpPushServerQueryAPI{pushServerURL, httpClient}
+}
+
+type httpPushServerQueryAPI struct {
+	pushServerURL string
+	httpClient    *http.Client
+}
+
+// QueryNotificationCounts implements PushServerQueryAPI
+func (h *httpPushServerQueryAPI) QueryNotificationCounts(
+	ctx context.Context,
+	request *QueryNotificationCountsRequest,
+	response *QueryNotificationCountsResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "QueryNotificationCounts")
+	defer span.Finish()
+
+	apiURL := h.pushServerURL + PushServerQueryNotificationCountsPath
+	return commonHTTP.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
+}
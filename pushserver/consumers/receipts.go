@@ -0,0 +1,91 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumers
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/dendrite/pushserver/storage"
+	"github.com/matrix-org/gomatrixserverlib"
+	log "github.com/sirupsen/logrus"
+	sarama "gopkg.in/Shopify/sarama.v1"
+)
+
+// OutputReceiptEventConsumer consumes read receipts that originated in the
+// client API or came in over federation.
+type OutputReceiptEventConsumer struct {
+	receiptConsumer *common.ContinualConsumer
+	db              storage.Database
+	serverName      gomatrixserverlib.ServerName
+}
+
+// NewOutputReceiptEventConsumer creates a new OutputReceiptEventConsumer.
+// Call Start() to begin consuming receipts.
+func NewOutputReceiptEventConsumer(
+	cfg *config.Dendrite,
+	kafkaConsumer sarama.Consumer,
+	store storage.Database,
+) *OutputReceiptEventConsumer {
+	consumer := common.ContinualConsumer{
+		Topic:          string(cfg.Kafka.Topics.OutputReceiptEvent),
+		Consumer:       kafkaConsumer,
+		PartitionStore: store,
+	}
+	s := &OutputReceiptEventConsumer{
+		receiptConsumer: &consumer,
+		db:              store,
+		serverName:      cfg.Matrix.ServerName,
+	}
+	consumer.ProcessMessage = s.onMessage
+
+	return s
+}
+
+// Start consuming receipts
+func (s *OutputReceiptEventConsumer) Start() error {
+	return s.receiptConsumer.Start()
+}
+
+// onMessage resets the notification counts of a local user in a room when
+// they send a read receipt for it. We don't keep track of which events the
+// user was notified about, so the receipt is assumed to be for the latest
+// event in the room.
+func (s *OutputReceiptEventConsumer) onMessage(msg *sarama.ConsumerMessage) error {
+	var output common.Receipt
+	if err := json.Unmarshal(msg.Value, &output); err != nil {
+		// If the message was invalid, log it and move on to the next message in the stream
+		log.WithError(err).Errorf("receipt output log: message parse failure")
+		return nil
+	}
+	if output.Type != "m.read" {
+		return nil
+	}
+	_, domain, err := gomatrixserverlib.SplitID('@', output.UserID)
+	if err != nil || domain != s.serverName {
+		return nil
+	}
+
+	if err = s.db.ResetNotificationCounts(context.TODO(), output.UserID, output.RoomID); err != nil {
+		log.WithFields(log.Fields{
+			"room_id":    output.RoomID,
+			"user_id":    output.UserID,
+			log.ErrorKey: err,
+		}).Panicf("receipt output log: failed to reset notification counts")
+	}
+	return nil
+}
@@ -0,0 +1,335 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumers
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/dendrite/common/pushrules"
+	"github.com/matrix-org/dendrite/pushserver/pushgateway"
+	"github.com/matrix-org/dendrite/pushserver/storage"
+	"github.com/matrix-org/dendrite/pushserver/types"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	log "github.com/sirupsen/logrus"
+	sarama "gopkg.in/Shopify/sarama.v1"
+)
+
+// OutputRoomEventConsumer consumes events that originated in the room server
+// and notifies the local users that the events are relevant to.
+type OutputRoomEventConsumer struct {
+	roomServerConsumer *common.ContinualConsumer
+	db                 storage.Database
+	accountDB          accounts.Database
+	query              api.RoomserverQueryAPI
+	gateway            *pushgateway.Client
+	serverName         gomatrixserverlib.ServerName
+}
+
+// NewOutputRoomEventConsumer creates a new OutputRoomEventConsumer. Call Start() to begin consuming from room servers.
+func NewOutputRoomEventConsumer(
+	cfg *config.Dendrite,
+	kafkaConsumer sarama.Consumer,
+	store storage.Database,
+	accountDB accounts.Database,
+	queryAPI api.RoomserverQueryAPI,
+	gateway *pushgateway.Client,
+) *OutputRoomEventConsumer {
+	consumer := common.ContinualConsumer{
+		Topic:          string(cfg.Kafka.Topics.OutputRoomEvent),
+		Consumer:       kafkaConsumer,
+		PartitionStore: store,
+	}
+	s := &OutputRoomEventConsumer{
+		roomServerConsumer: &consumer,
+		db:                 store,
+		accountDB:          accountDB,
+		query:              queryAPI,
+		gateway:            gateway,
+		serverName:         cfg.Matrix.ServerName,
+	}
+	consumer.ProcessMessage = s.onMessage
+
+	return s
+}
+
+// Start consuming from room servers
+func (s *OutputRoomEventConsumer) Start() error {
+	return s.roomServerConsumer.Start()
+}
+
+// onMessage is called when the push server receives a new event from the room server output log.
+func (s *OutputRoomEventConsumer) onMessage(msg *sarama.ConsumerMessage) error {
+	var output api.OutputEvent
+	if err := json.Unmarshal(msg.Value, &output); err != nil {
+		// If the message was invalid, log it and move on to the next message in the stream
+		log.WithError(err).Errorf("roomserver output log: message parse failure")
+		return nil
+	}
+	if output.Type != api.OutputTypeNewRoomEvent {
+		log.WithField("type", output.Type).Debug(
+			"roomserver output log: ignoring unknown output type",
+		)
+		return nil
+	}
+	ev := output.NewRoomEvent.Event.Event
+
+	if err := s.processEvent(context.TODO(), &ev); err != nil {
+		// panic rather than lose track of the notifications of the users
+		log.WithFields(log.Fields{
+			"event_id":   ev.EventID(),
+			"room_id":    ev.RoomID(),
+			log.ErrorKey: err,
+		}).Panicf("roomserver output log: failed to process notifications")
+	}
+	return nil
+}
+
+// roomContext is the information about the room of an event that is needed
+// to evaluate push rules and to build notifications.
+type roomContext struct {
+	members     map[string]string // joined user ID -> display name
+	powerLevels *gomatrixserverlib.Event
+	name        string
+	alias       string
+}
+
+// processEvent evaluates the push rules of every local user that the event
+// may be relevant to. Users that should be notified get their notification
+// counts incremented and notifications sent to their pushers.
+func (s *OutputRoomEventConsumer) processEvent(ctx context.Context, ev *gomatrixserverlib.Event) error {
+	room, err := s.loadRoomContext(ctx, ev)
+	if err != nil {
+		return err
+	}
+
+	// Local users that are joined to the room, and the target of an invite
+	// who isn't joined yet.
+	var userIDs []string
+	for userID := range room.members {
+		userIDs = append(userIDs, userID)
+	}
+	if ev.Type() == gomatrixserverlib.MRoomMember && ev.StateKey() != nil {
+		if membership, merr := ev.Membership(); merr == nil && membership == gomatrixserverlib.Invite {
+			if _, ok := room.members[*ev.StateKey()]; !ok {
+				userIDs = append(userIDs, *ev.StateKey())
+			}
+		}
+	}
+
+	for _, userID := range userIDs {
+		_, domain, err := gomatrixserverlib.SplitID('@', userID)
+		if err != nil || domain != s.serverName || userID == ev.Sender() {
+			continue
+		}
+		if err = s.notifyUser(ctx, userID, ev, room); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *OutputRoomEventConsumer) loadRoomContext(
+	ctx context.Context, ev *gomatrixserverlib.Event,
+) (*roomContext, error) {
+	room := roomContext{members: map[string]string{}}
+
+	membersReq := api.QueryMembershipsForRoomRequest{
+		JoinedOnly: true,
+		RoomID:     ev.RoomID(),
+		Sender:     ev.Sender(),
+	}
+	var membersRes api.QueryMembershipsForRoomResponse
+	if err := s.query.QueryMembershipsForRoom(ctx, &membersReq, &membersRes); err != nil {
+		return nil, err
+	}
+	for _, member := range membersRes.JoinEvents {
+		if member.StateKey == nil {
+			continue
+		}
+		var content struct {
+			DisplayName string `json:"displayname"`
+		}
+		_ = json.Unmarshal(member.Content, &content)
+		room.members[*member.StateKey] = content.DisplayName
+	}
+
+	stateReq := api.QueryLatestEventsAndStateRequest{
+		RoomID: ev.RoomID(),
+		StateToFetch: []gomatrixserverlib.StateKeyTuple{
+			{EventType: gomatrixserverlib.MRoomPowerLevels, StateKey: ""},
+			{EventType: "m.room.name", StateKey: ""},
+			{EventType: "m.room.canonical_alias", StateKey: ""},
+		},
+	}
+	var stateRes api.QueryLatestEventsAndStateResponse
+	if err := s.query.QueryLatestEventsAndState(ctx, &stateReq, &stateRes); err != nil {
+		return nil, err
+	}
+	for i := range stateRes.StateEvents {
+		event := stateRes.StateEvents[i].Event
+		var content struct {
+			Name  string `json:"name"`
+			Alias string `json:"alias"`
+		}
+		switch event.Type() {
+		case gomatrixserverlib.MRoomPowerLevels:
+			room.powerLevels = &event
+		case "m.room.name":
+			_ = json.Unmarshal(event.Content(), &content)
+			room.name = content.Name
+		case "m.room.canonical_alias":
+			_ = json.Unmarshal(event.Content(), &content)
+			room.alias = content.Alias
+		}
+	}
+	return &room, nil
+}
+
+func (s *OutputRoomEventConsumer) notifyUser(
+	ctx context.Context, userID string, ev *gomatrixserverlib.Event, room *roomContext,
+) error {
+	localpart, _, err := gomatrixserverlib.SplitID('@', userID)
+	if err != nil {
+		return err
+	}
+	data, err := s.accountDB.GetAccountDataByType(ctx, localpart, "", pushrules.AccountDataType)
+	if err != nil {
+		return err
+	}
+	ruleSets, err := pushrules.FromAccountData(data, localpart, s.serverName)
+	if err != nil {
+		// The user has broken push rules, which shouldn't stop everyone else
+		// from getting notified.
+		log.WithError(err).WithField("user_id", userID).Warn("Failed to parse push rules")
+		return nil
+	}
+	actions, err := ruleSets.Global.Evaluate(ev, &pushrules.EvaluationContext{
+		UserDisplayName: room.members[userID],
+		RoomMemberCount: len(room.members),
+		PowerLevels:     room.powerLevels,
+	})
+	if err != nil {
+		log.WithError(err).WithField("event_id", ev.EventID()).Warn("Failed to evaluate push rules")
+		return nil
+	}
+	if !pushrules.ShouldNotify(actions) {
+		return nil
+	}
+
+	if err = s.db.IncrementNotificationCounts(
+		ctx, userID, ev.RoomID(), pushrules.ShouldHighlight(actions),
+	); err != nil {
+		return err
+	}
+
+	pushers, err := s.db.PushersForUser(ctx, userID)
+	if err != nil || len(pushers) == 0 {
+		return err
+	}
+	unread, err := s.db.TotalNotificationCount(ctx, userID)
+	if err != nil {
+		return err
+	}
+
+	notification := pushgateway.Notification{
+		EventID:           ev.EventID(),
+		RoomID:            ev.RoomID(),
+		Type:              ev.Type(),
+		Sender:            ev.Sender(),
+		SenderDisplayName: room.members[ev.Sender()],
+		RoomName:          room.name,
+		RoomAlias:         room.alias,
+		UserIsTarget:      ev.StateKey() != nil && *ev.StateKey() == userID,
+		Priority:          "low",
+		Content:           ev.Content(),
+		Counts:            &pushgateway.Counts{Unread: unread},
+	}
+	tweaks := map[string]interface{}{}
+	for _, action := range actions {
+		if action.Kind != pushrules.SetTweakAction {
+			continue
+		}
+		if action.Value == nil {
+			tweaks[action.Tweak] = true
+		} else {
+			tweaks[action.Tweak] = action.Value
+		}
+	}
+	if _, ok := tweaks[pushrules.SoundTweak]; ok {
+		notification.Priority = "high"
+	}
+
+	for _, pusher := range pushers {
+		go s.sendNotification(userID, pusher, notification, tweaks)
+	}
+	return nil
+}
+
+// sendNotification sends a notification to a single pusher. Pushers that the
+// push gateway rejects are removed.
+func (s *OutputRoomEventConsumer) sendNotification(
+	userID string, pusher types.Pusher, notification pushgateway.Notification,
+	tweaks map[string]interface{},
+) {
+	logger := log.WithFields(log.Fields{
+		"user_id":  userID,
+		"app_id":   pusher.AppID,
+		"event_id": notification.EventID,
+	})
+	var data map[string]interface{}
+	if err := json.Unmarshal(pusher.Data, &data); err != nil {
+		logger.WithError(err).Error("Failed to parse pusher data")
+		return
+	}
+	url, _ := data["url"].(string)
+	delete(data, "url")
+	if format, _ := data["format"].(string); format == types.EventIDOnlyFormat {
+		notification = pushgateway.Notification{
+			EventID:  notification.EventID,
+			RoomID:   notification.RoomID,
+			Priority: notification.Priority,
+			Counts:   notification.Counts,
+		}
+	}
+	notification.Devices = []pushgateway.Device{{
+		AppID:     pusher.AppID,
+		PushKey:   pusher.PushKey,
+		PushKeyTS: int64(pusher.PushKeyTS) / int64(time.Second/time.Millisecond),
+		Data:      data,
+		Tweaks:    tweaks,
+	}}
+
+	ctx := context.Background()
+	rejected, err := s.gateway.Notify(ctx, url, &pushgateway.NotifyRequest{Notification: notification})
+	if err != nil {
+		logger.WithError(err).Error("Failed to send notification to push gateway")
+		return
+	}
+	for _, pushKey := range rejected {
+		if pushKey != pusher.PushKey {
+			continue
+		}
+		logger.Info("Push gateway rejected the push key, removing pusher")
+		if err = s.db.RemovePusher(ctx, userID, pusher.AppID, pusher.PushKey); err != nil {
+			logger.WithError(err).Error("Failed to remove rejected pusher")
+		}
+	}
+}
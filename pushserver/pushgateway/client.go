@@ -0,0 +1,164 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package pushgateway implements a client for the push gateway API described
+// in https://matrix.org/docs/spec/push_gateway/r0.1.1
+package pushgateway
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// The defaults for how often and how long we retry sending a notification to
+// a push gateway that can't be reached.
+const (
+	defaultMaxAttempts    = 5
+	defaultInitialBackoff = time.Second
+	defaultMaxBackoff     = time.Minute
+)
+
+// NotifyRequest is the body of a request to /_matrix/push/v1/notify
+type NotifyRequest struct {
+	Notification Notification `json:"notification"`
+}
+
+// Notification is a notification about an event for the devices of a user.
+type Notification struct {
+	EventID           string          `json:"event_id,omitempty"`
+	RoomID            string          `json:"room_id,omitempty"`
+	Type              string          `json:"type,omitempty"`
+	Sender            string          `json:"sender,omitempty"`
+	SenderDisplayName string          `json:"sender_display_name,omitempty"`
+	RoomName          string          `json:"room_name,omitempty"`
+	RoomAlias         string          `json:"room_alias,omitempty"`
+	UserIsTarget      bool            `json:"user_is_target,omitempty"`
+	Priority          string          `json:"prio,omitempty"`
+	Content           json.RawMessage `json:"content,omitempty"`
+	Counts            *Counts         `json:"counts,omitempty"`
+	Devices           []Device        `json:"devices"`
+}
+
+// Counts are the badge counts of the user.
+type Counts struct {
+	Unread int64 `json:"unread"`
+}
+
+// Device is a device that the notification should be sent to.
+type Device struct {
+	AppID   string `json:"app_id"`
+	PushKey string `json:"pushkey"`
+	// PushKeyTS is when the push key was last updated, in seconds since
+	// the epoch.
+	PushKeyTS int64                  `json:"pushkey_ts,omitempty"`
+	Data      map[string]interface{} `json:"data,omitempty"`
+	Tweaks    map[string]interface{} `json:"tweaks,omitempty"`
+}
+
+// NotifyResponse is the response of a push gateway to /_matrix/push/v1/notify
+type NotifyResponse struct {
+	// The push keys that the gateway doesn't know about anymore. Their
+	// pushers should be removed.
+	Rejected []string `json:"rejected"`
+}
+
+// Client sends notifications to push gateways.
+type Client struct {
+	HTTPClient *http.Client
+	// MaxAttempts is the number of times that a notification is sent before
+	// giving up.
+	MaxAttempts int
+	// InitialBackoff is how long we wait before the first retry. The wait
+	// doubles after every attempt, up to MaxBackoff.
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+}
+
+// NewClient creates a Client with the default retry settings.
+func NewClient() *Client {
+	return &Client{
+		HTTPClient:     &http.Client{Timeout: 30 * time.Second},
+		MaxAttempts:    defaultMaxAttempts,
+		InitialBackoff: defaultInitialBackoff,
+		MaxBackoff:     defaultMaxBackoff,
+	}
+}
+
+// errPermanent wraps errors that won't go away by trying again.
+type errPermanent struct {
+	err error
+}
+
+func (e errPermanent) Error() string {
+	return e.err.Error()
+}
+
+// Notify sends the notification to the push gateway at the given URL. Failed
+// attempts are retried with exponential backoff unless the gateway rejected
+// the request itself. Returns the push keys that the gateway rejected.
+func (c *Client) Notify(ctx context.Context, url string, req *NotifyRequest) ([]string, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	backoff := c.InitialBackoff
+	for attempt := 1; ; attempt++ {
+		res, err := c.notifyOnce(ctx, url, body)
+		if err == nil {
+			return res.Rejected, nil
+		}
+		if _, ok := err.(errPermanent); ok || attempt >= c.MaxAttempts {
+			return nil, err
+		}
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		if backoff *= 2; backoff > c.MaxBackoff {
+			backoff = c.MaxBackoff
+		}
+	}
+}
+
+func (c *Client) notifyOnce(ctx context.Context, url string, body []byte) (*NotifyResponse, error) {
+	httpReq, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, errPermanent{err}
+	}
+	httpReq = httpReq.WithContext(ctx)
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpRes, err := c.HTTPClient.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer httpRes.Body.Close() // nolint: errcheck
+
+	if httpRes.StatusCode != http.StatusOK {
+		err = fmt.Errorf("push gateway %s responded with %d", url, httpRes.StatusCode)
+		if httpRes.StatusCode >= 400 && httpRes.StatusCode < 500 {
+			return nil, errPermanent{err}
+		}
+		return nil, err
+	}
+	var res NotifyResponse
+	if err = json.NewDecoder(httpRes.Body).Decode(&res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
@@ -0,0 +1,122 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pushgateway
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// fakeGateway is a push gateway that fails the first failures requests with
+// a server error and then rejects the push key "bad".
+type fakeGateway struct {
+	failures int
+	requests []NotifyRequest
+}
+
+func (g *fakeGateway) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Path != "/_matrix/push/v1/notify" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	var notifyReq NotifyRequest
+	if err := json.NewDecoder(req.Body).Decode(&notifyReq); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	g.requests = append(g.requests, notifyReq)
+	if len(g.requests) <= g.failures {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	var res NotifyResponse
+	for _, device := range notifyReq.Notification.Devices {
+		if device.PushKey == "bad" {
+			res.Rejected = append(res.Rejected, device.PushKey)
+		}
+	}
+	_ = json.NewEncoder(w).Encode(res)
+}
+
+func testClient() *Client {
+	return &Client{
+		HTTPClient:     http.DefaultClient,
+		MaxAttempts:    3,
+		InitialBackoff: time.Millisecond,
+		MaxBackoff:     time.Millisecond,
+	}
+}
+
+func testRequest() *NotifyRequest {
+	return &NotifyRequest{Notification: Notification{
+		EventID: "$event:localhost",
+		RoomID:  "!room:localhost",
+		Counts:  &Counts{Unread: 1},
+		Devices: []Device{
+			{AppID: "org.example.app", PushKey: "good"},
+			{AppID: "org.example.app", PushKey: "bad"},
+		},
+	}}
+}
+
+func TestNotifyRetries(t *testing.T) {
+	gateway := &fakeGateway{failures: 2}
+	server := httptest.NewServer(gateway)
+	defer server.Close()
+
+	rejected, err := testClient().Notify(context.Background(), server.URL+"/_matrix/push/v1/notify", testRequest())
+	if err != nil {
+		t.Fatalf("Notify failed: %s", err)
+	}
+	if len(gateway.requests) != 3 {
+		t.Errorf("gateway got %d requests, want 3", len(gateway.requests))
+	}
+	if len(rejected) != 1 || rejected[0] != "bad" {
+		t.Errorf("rejected = %v, want [bad]", rejected)
+	}
+	if got := gateway.requests[0].Notification.EventID; got != "$event:localhost" {
+		t.Errorf("gateway got event ID %q, want $event:localhost", got)
+	}
+}
+
+func TestNotifyGivesUp(t *testing.T) {
+	gateway := &fakeGateway{failures: 5}
+	server := httptest.NewServer(gateway)
+	defer server.Close()
+
+	if _, err := testClient().Notify(context.Background(), server.URL+"/_matrix/push/v1/notify", testRequest()); err == nil {
+		t.Fatal("Notify succeeded, want error")
+	}
+	if len(gateway.requests) != 3 {
+		t.Errorf("gateway got %d requests, want 3", len(gateway.requests))
+	}
+}
+
+func TestNotifyDoesNotRetryClientErrors(t *testing.T) {
+	gateway := &fakeGateway{}
+	server := httptest.NewServer(gateway)
+	defer server.Close()
+
+	if _, err := testClient().Notify(context.Background(), server.URL+"/wrong/path", testRequest()); err == nil {
+		t.Fatal("Notify succeeded, want error")
+	}
+	if len(gateway.requests) != 0 {
+		t.Errorf("gateway got %d requests, want 0", len(gateway.requests))
+	}
+}
@@ -0,0 +1,68 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pushserver
+
+import (
+	"net/http"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/devices"
+	"github.com/matrix-org/dendrite/common/basecomponent"
+	"github.com/matrix-org/dendrite/pushserver/api"
+	"github.com/matrix-org/dendrite/pushserver/consumers"
+	"github.com/matrix-org/dendrite/pushserver/pushgateway"
+	"github.com/matrix-org/dendrite/pushserver/query"
+	"github.com/matrix-org/dendrite/pushserver/routing"
+	"github.com/matrix-org/dendrite/pushserver/storage"
+	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/sirupsen/logrus"
+)
+
+// SetupPushServerComponent sets up and registers HTTP handlers for the
+// PushServer component. Returns an instance of the push server query API,
+// allowing other components running in the same process to hit the API
+// directly instead of having to use HTTP.
+func SetupPushServerComponent(
+	base *basecomponent.BaseDendrite,
+	accountDB accounts.Database,
+	deviceDB devices.Database,
+	rsQueryAPI roomserverAPI.RoomserverQueryAPI,
+) api.PushServerQueryAPI {
+	pushDB, err := storage.NewDatabase(string(base.Cfg.Database.PushServer))
+	if err != nil {
+		logrus.WithError(err).Panic("failed to connect to push server db")
+	}
+
+	rsConsumer := consumers.NewOutputRoomEventConsumer(
+		base.Cfg, base.KafkaConsumer, pushDB, accountDB, rsQueryAPI, pushgateway.NewClient(),
+	)
+	if err = rsConsumer.Start(); err != nil {
+		logrus.WithError(err).Panic("failed to start room server consumer")
+	}
+
+	receiptConsumer := consumers.NewOutputReceiptEventConsumer(
+		base.Cfg, base.KafkaConsumer, pushDB,
+	)
+	if err = receiptConsumer.Start(); err != nil {
+		logrus.WithError(err).Panic("failed to start receipt consumer")
+	}
+
+	queryAPI := &query.PushServerQueryAPI{DB: pushDB}
+	queryAPI.SetupHTTP(http.DefaultServeMux)
+
+	routing.Setup(base.APIMux, deviceDB, pushDB)
+
+	return queryAPI
+}
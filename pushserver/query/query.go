@@ -0,0 +1,59 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package query
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/pushserver/api"
+	"github.com/matrix-org/dendrite/pushserver/storage"
+	"github.com/matrix-org/util"
+)
+
+// PushServerQueryAPI is an implementation of api.PushServerQueryAPI
+type PushServerQueryAPI struct {
+	DB storage.Database
+}
+
+// QueryNotificationCounts implements api.PushServerQueryAPI
+func (p *PushServerQueryAPI) QueryNotificationCounts(
+	ctx context.Context,
+	request *api.QueryNotificationCountsRequest,
+	response *api.QueryNotificationCountsResponse,
+) (err error) {
+	response.Counts, err = p.DB.NotificationCounts(ctx, request.UserID, request.RoomIDs)
+	return
+}
+
+// SetupHTTP adds the PushServerQueryAPI handlers to the http.ServeMux.
+func (p *PushServerQueryAPI) SetupHTTP(servMux *http.ServeMux) {
+	servMux.Handle(
+		api.PushServerQueryNotificationCountsPath,
+		common.MakeInternalAPI("QueryNotificationCounts", func(req *http.Request) util.JSONResponse {
+			var request api.QueryNotificationCountsRequest
+			var response api.QueryNotificationCountsResponse
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				return util.ErrorResponse(err)
+			}
+			if err := p.QueryNotificationCounts(req.Context(), &request, &response); err != nil {
+				return util.ErrorResponse(err)
+			}
+			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
+		}),
+	)
+}
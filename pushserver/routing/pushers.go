@@ -0,0 +1,135 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/pushserver/storage"
+	"github.com/matrix-org/dendrite/pushserver/types"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+// The path that push gateway URLs must have.
+const pushGatewayNotifyPath = "/_matrix/push/v1/notify"
+
+type setPusherRequest struct {
+	PushKey string `json:"pushkey"`
+	// Kind is null when the pusher should be removed.
+	Kind              *string         `json:"kind"`
+	AppID             string          `json:"app_id"`
+	AppDisplayName    string          `json:"app_display_name"`
+	DeviceDisplayName string          `json:"device_display_name"`
+	ProfileTag        string          `json:"profile_tag"`
+	Language          string          `json:"lang"`
+	Data              json.RawMessage `json:"data"`
+	Append            bool            `json:"append"`
+}
+
+// GetPushers implements GET /pushers
+func GetPushers(
+	req *http.Request, device *authtypes.Device, pushDB storage.Database,
+) util.JSONResponse {
+	pushers, err := pushDB.PushersForUser(req.Context(), device.UserID)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("pushDB.PushersForUser failed")
+		return jsonerror.InternalServerError()
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: map[string][]types.Pusher{"pushers": pushers},
+	}
+}
+
+// SetPusher implements POST /pushers/set
+func SetPusher(
+	req *http.Request, device *authtypes.Device, pushDB storage.Database,
+) util.JSONResponse {
+	var r setPusherRequest
+	if resErr := httputil.UnmarshalJSONRequest(req, &r); resErr != nil {
+		return *resErr
+	}
+	if r.PushKey == "" || r.AppID == "" {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.MissingArgument("pushkey and app_id are required"),
+		}
+	}
+	if len(r.AppID) > 64 || len(r.PushKey) > 512 {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("app_id or pushkey is too long"),
+		}
+	}
+
+	if r.Kind == nil {
+		if err := pushDB.RemovePusher(req.Context(), device.UserID, r.AppID, r.PushKey); err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("pushDB.RemovePusher failed")
+			return jsonerror.InternalServerError()
+		}
+		return util.JSONResponse{Code: http.StatusOK, JSON: struct{}{}}
+	}
+
+	if *r.Kind != types.HTTPPusherKind {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("Only http pushers are supported"),
+		}
+	}
+	if r.AppDisplayName == "" || r.DeviceDisplayName == "" || r.Language == "" || len(r.Data) == 0 {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.MissingArgument("app_display_name, device_display_name, lang and data are required"),
+		}
+	}
+	var data types.PusherData
+	if err := json.Unmarshal(r.Data, &data); err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.BadJSON("The pusher data could not be decoded: " + err.Error()),
+		}
+	}
+	if gatewayURL, err := url.Parse(data.URL); err != nil || gatewayURL.Path != pushGatewayNotifyPath {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("data.url must be an URL with the path " + pushGatewayNotifyPath),
+		}
+	}
+
+	pusher := types.Pusher{
+		UserID:            device.UserID,
+		Kind:              *r.Kind,
+		AppID:             r.AppID,
+		AppDisplayName:    r.AppDisplayName,
+		DeviceDisplayName: r.DeviceDisplayName,
+		PushKey:           r.PushKey,
+		PushKeyTS:         gomatrixserverlib.AsTimestamp(time.Now()),
+		ProfileTag:        r.ProfileTag,
+		Language:          r.Language,
+		Data:              r.Data,
+	}
+	if err := pushDB.StorePusher(req.Context(), &pusher, !r.Append); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("pushDB.StorePusher failed")
+		return jsonerror.InternalServerError()
+	}
+	return util.JSONResponse{Code: http.StatusOK, JSON: struct{}{}}
+}
@@ -0,0 +1,54 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/matrix-org/dendrite/clientapi/auth"
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/devices"
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/pushserver/storage"
+	"github.com/matrix-org/util"
+)
+
+const pathPrefixR0 = "/_matrix/client/r0"
+
+// Setup configures the given mux with push server listeners
+func Setup(
+	apiMux *mux.Router, deviceDB devices.Database, pushDB storage.Database,
+) {
+	r0mux := apiMux.PathPrefix(pathPrefixR0).Subrouter()
+
+	authData := auth.Data{
+		AccountDB:   nil,
+		DeviceDB:    deviceDB,
+		AppServices: nil,
+	}
+
+	r0mux.Handle("/pushers",
+		common.MakeAuthAPI("get_pushers", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+			return GetPushers(req, device, pushDB)
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+
+	r0mux.Handle("/pushers/set",
+		common.MakeAuthAPI("set_pusher", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+			return SetPusher(req, device, pushDB)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+}
@@ -0,0 +1,50 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"context"
+
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/pushserver/api"
+	"github.com/matrix-org/dendrite/pushserver/types"
+)
+
+// Database stores the pushers and the unread notification counts of local
+// users.
+type Database interface {
+	common.PartitionStorer
+	// StorePusher adds a pusher or replaces the user's pusher with the same
+	// app ID and push key. If exclusive is true then pushers of other users
+	// with the same app ID and push key are removed.
+	StorePusher(ctx context.Context, pusher *types.Pusher, exclusive bool) error
+	// RemovePusher removes the user's pusher with the given app ID and push
+	// key, if there is one.
+	RemovePusher(ctx context.Context, userID, appID, pushKey string) error
+	// PushersForUser returns all of the pushers of a user.
+	PushersForUser(ctx context.Context, userID string) ([]types.Pusher, error)
+	// IncrementNotificationCounts records that the user was notified about an
+	// event in a room.
+	IncrementNotificationCounts(ctx context.Context, userID, roomID string, highlight bool) error
+	// ResetNotificationCounts records that the user has read all of the events
+	// in a room.
+	ResetNotificationCounts(ctx context.Context, userID, roomID string) error
+	// NotificationCounts returns the counts of the user in each of the given
+	// rooms. Rooms without unread notifications are omitted.
+	NotificationCounts(ctx context.Context, userID string, roomIDs []string) (map[string]api.NotificationCounts, error)
+	// TotalNotificationCount returns the number of unread notifications of the
+	// user across all rooms.
+	TotalNotificationCount(ctx context.Context, userID string) (int64, error)
+}
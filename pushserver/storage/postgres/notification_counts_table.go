@@ -0,0 +1,130 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/pushserver/api"
+)
+
+const notificationCountsSchema = `
+-- Stores the number of unread events in each room that local users were
+-- notified about. Rows are removed when the user reads the room.
+CREATE TABLE IF NOT EXISTS pushserver_notification_counts (
+    -- The Matrix user ID of the user.
+    user_id TEXT NOT NULL,
+    -- The ID of the room.
+    room_id TEXT NOT NULL,
+    -- The number of events that the user was notified about.
+    notification_count BIGINT NOT NULL,
+    -- The number of those events that were highlighted.
+    highlight_count BIGINT NOT NULL,
+    CONSTRAINT pushserver_notification_counts_unique UNIQUE (user_id, room_id)
+);
+`
+
+const incrementNotificationCountsSQL = "" +
+	"INSERT INTO pushserver_notification_counts (user_id, room_id, notification_count, highlight_count)" +
+	" VALUES ($1, $2, 1, $3)" +
+	" ON CONFLICT ON CONSTRAINT pushserver_notification_counts_unique" +
+	" DO UPDATE SET notification_count = pushserver_notification_counts.notification_count + 1," +
+	" highlight_count = pushserver_notification_counts.highlight_count + $3"
+
+const deleteNotificationCountsSQL = "" +
+	"DELETE FROM pushserver_notification_counts WHERE user_id = $1 AND room_id = $2"
+
+const selectNotificationCountsForUserSQL = "" +
+	"SELECT room_id, notification_count, highlight_count FROM pushserver_notification_counts" +
+	" WHERE user_id = $1"
+
+const selectTotalNotificationCountSQL = "" +
+	"SELECT COALESCE(SUM(notification_count), 0) FROM pushserver_notification_counts" +
+	" WHERE user_id = $1"
+
+type notificationCountsStatements struct {
+	incrementNotificationCountsStmt     *sql.Stmt
+	deleteNotificationCountsStmt        *sql.Stmt
+	selectNotificationCountsForUserStmt *sql.Stmt
+	selectTotalNotificationCountStmt    *sql.Stmt
+}
+
+func (s *notificationCountsStatements) prepare(db *sql.DB) (err error) {
+	_, err = db.Exec(notificationCountsSchema)
+	if err != nil {
+		return
+	}
+	if s.incrementNotificationCountsStmt, err = db.Prepare(incrementNotificationCountsSQL); err != nil {
+		return
+	}
+	if s.deleteNotificationCountsStmt, err = db.Prepare(deleteNotificationCountsSQL); err != nil {
+		return
+	}
+	if s.selectNotificationCountsForUserStmt, err = db.Prepare(selectNotificationCountsForUserSQL); err != nil {
+		return
+	}
+	if s.selectTotalNotificationCountStmt, err = db.Prepare(selectTotalNotificationCountSQL); err != nil {
+		return
+	}
+	return
+}
+
+func (s *notificationCountsStatements) incrementNotificationCounts(
+	ctx context.Context, userID, roomID string, highlight bool,
+) error {
+	var highlightIncrement int64
+	if highlight {
+		highlightIncrement = 1
+	}
+	_, err := s.incrementNotificationCountsStmt.ExecContext(ctx, userID, roomID, highlightIncrement)
+	return err
+}
+
+func (s *notificationCountsStatements) deleteNotificationCounts(
+	ctx context.Context, userID, roomID string,
+) error {
+	_, err := s.deleteNotificationCountsStmt.ExecContext(ctx, userID, roomID)
+	return err
+}
+
+func (s *notificationCountsStatements) selectNotificationCountsForUser(
+	ctx context.Context, userID string,
+) (map[string]api.NotificationCounts, error) {
+	rows, err := s.selectNotificationCountsForUserStmt.QueryContext(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer common.CloseAndLogIfError(ctx, rows, "selectNotificationCountsForUser: rows.close() failed")
+
+	result := make(map[string]api.NotificationCounts)
+	for rows.Next() {
+		var roomID string
+		var counts api.NotificationCounts
+		if err = rows.Scan(&roomID, &counts.NotificationCount, &counts.HighlightCount); err != nil {
+			return nil, err
+		}
+		result[roomID] = counts
+	}
+	return result, rows.Err()
+}
+
+func (s *notificationCountsStatements) selectTotalNotificationCount(
+	ctx context.Context, userID string,
+) (count int64, err error) {
+	err = s.selectTotalNotificationCountStmt.QueryRowContext(ctx, userID).Scan(&count)
+	return
+}
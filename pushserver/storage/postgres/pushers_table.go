@@ -0,0 +1,151 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/pushserver/types"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const pushersSchema = `
+-- Stores the pushers that clients have registered for local users.
+CREATE TABLE IF NOT EXISTS pushserver_pushers (
+    -- The Matrix user ID of the owner of the pusher.
+    user_id TEXT NOT NULL,
+    -- The kind of pusher, e.g. "http".
+    kind TEXT NOT NULL,
+    -- The ID of the application that the pusher sends notifications to.
+    app_id TEXT NOT NULL,
+    app_display_name TEXT NOT NULL,
+    device_display_name TEXT NOT NULL,
+    -- The key that identifies the device to the push gateway.
+    pushkey TEXT NOT NULL,
+    -- When the push key was last set, in milliseconds since the epoch.
+    pushkey_ts_ms BIGINT NOT NULL,
+    profile_tag TEXT NOT NULL,
+    lang TEXT NOT NULL,
+    -- The pusher data JSON, e.g. the URL of the push gateway.
+    data TEXT NOT NULL,
+    CONSTRAINT pushserver_pushers_unique UNIQUE (user_id, app_id, pushkey)
+);
+
+CREATE INDEX IF NOT EXISTS pushserver_pushers_app_id_pushkey_idx
+    ON pushserver_pushers (app_id, pushkey);
+`
+
+const upsertPusherSQL = "" +
+	"INSERT INTO pushserver_pushers (user_id, kind, app_id, app_display_name, device_display_name," +
+	" pushkey, pushkey_ts_ms, profile_tag, lang, data)" +
+	" VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)" +
+	" ON CONFLICT ON CONSTRAINT pushserver_pushers_unique" +
+	" DO UPDATE SET kind = $2, app_display_name = $4, device_display_name = $5," +
+	" pushkey_ts_ms = $7, profile_tag = $8, lang = $9, data = $10"
+
+const deletePusherSQL = "" +
+	"DELETE FROM pushserver_pushers WHERE user_id = $1 AND app_id = $2 AND pushkey = $3"
+
+const deleteOtherUsersPushersSQL = "" +
+	"DELETE FROM pushserver_pushers WHERE app_id = $1 AND pushkey = $2 AND user_id != $3"
+
+const selectPushersForUserSQL = "" +
+	"SELECT kind, app_id, app_display_name, device_display_name, pushkey, pushkey_ts_ms," +
+	" profile_tag, lang, data FROM pushserver_pushers WHERE user_id = $1"
+
+type pushersStatements struct {
+	upsertPusherStmt            *sql.Stmt
+	deletePusherStmt            *sql.Stmt
+	deleteOtherUsersPushersStmt *sql.Stmt
+	selectPushersForUserStmt    *sql.Stmt
+}
+
+func (s *pushersStatements) prepare(db *sql.DB) (err error) {
+	_, err = db.Exec(pushersSchema)
+	if err != nil {
+		return
+	}
+	if s.upsertPusherStmt, err = db.Prepare(upsertPusherSQL); err != nil {
+		return
+	}
+	if s.deletePusherStmt, err = db.Prepare(deletePusherSQL); err != nil {
+		return
+	}
+	if s.deleteOtherUsersPushersStmt, err = db.Prepare(deleteOtherUsersPushersSQL); err != nil {
+		return
+	}
+	if s.selectPushersForUserStmt, err = db.Prepare(selectPushersForUserSQL); err != nil {
+		return
+	}
+	return
+}
+
+func (s *pushersStatements) upsertPusher(
+	ctx context.Context, txn *sql.Tx, pusher *types.Pusher,
+) error {
+	stmt := common.TxStmt(txn, s.upsertPusherStmt)
+	_, err := stmt.ExecContext(
+		ctx, pusher.UserID, pusher.Kind, pusher.AppID, pusher.AppDisplayName,
+		pusher.DeviceDisplayName, pusher.PushKey, pusher.PushKeyTS,
+		pusher.ProfileTag, pusher.Language, string(pusher.Data),
+	)
+	return err
+}
+
+func (s *pushersStatements) deletePusher(
+	ctx context.Context, txn *sql.Tx, userID, appID, pushKey string,
+) error {
+	stmt := common.TxStmt(txn, s.deletePusherStmt)
+	_, err := stmt.ExecContext(ctx, userID, appID, pushKey)
+	return err
+}
+
+func (s *pushersStatements) deleteOtherUsersPushers(
+	ctx context.Context, txn *sql.Tx, appID, pushKey, userID string,
+) error {
+	stmt := common.TxStmt(txn, s.deleteOtherUsersPushersStmt)
+	_, err := stmt.ExecContext(ctx, appID, pushKey, userID)
+	return err
+}
+
+func (s *pushersStatements) selectPushersForUser(
+	ctx context.Context, userID string,
+) ([]types.Pusher, error) {
+	rows, err := s.selectPushersForUserStmt.QueryContext(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer common.CloseAndLogIfError(ctx, rows, "selectPushersForUser: rows.close() failed")
+
+	pushers := []types.Pusher{}
+	for rows.Next() {
+		pusher := types.Pusher{UserID: userID}
+		var pushKeyTS int64
+		var data string
+		if err = rows.Scan(
+			&pusher.Kind, &pusher.AppID, &pusher.AppDisplayName, &pusher.DeviceDisplayName,
+			&pusher.PushKey, &pushKeyTS, &pusher.ProfileTag, &pusher.Language, &data,
+		); err != nil {
+			return nil, err
+		}
+		pusher.PushKeyTS = gomatrixserverlib.Timestamp(pushKeyTS)
+		pusher.Data = json.RawMessage(data)
+		pushers = append(pushers, pusher)
+	}
+	return pushers, rows.Err()
+}
@@ -0,0 +1,120 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+
+	// Import the postgres database driver.
+	_ "github.com/lib/pq"
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/pushserver/api"
+	"github.com/matrix-org/dendrite/pushserver/types"
+)
+
+// Database stores the pushers and the unread notification counts of local
+// users.
+type Database struct {
+	pushersStatements
+	notificationCountsStatements
+	common.PartitionOffsetStatements
+	db *sql.DB
+}
+
+// NewDatabase opens a new database
+func NewDatabase(dataSourceName string) (*Database, error) {
+	var result Database
+	var err error
+	if result.db, err = sql.Open("postgres", dataSourceName); err != nil {
+		return nil, err
+	}
+	if err = result.pushersStatements.prepare(result.db); err != nil {
+		return nil, err
+	}
+	if err = result.notificationCountsStatements.prepare(result.db); err != nil {
+		return nil, err
+	}
+	if err = result.PartitionOffsetStatements.Prepare(result.db, "pushserver"); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// StorePusher implements storage.Database
+func (d *Database) StorePusher(
+	ctx context.Context, pusher *types.Pusher, exclusive bool,
+) error {
+	return common.WithTransaction(d.db, func(txn *sql.Tx) error {
+		if exclusive {
+			if err := d.deleteOtherUsersPushers(ctx, txn, pusher.AppID, pusher.PushKey, pusher.UserID); err != nil {
+				return err
+			}
+		}
+		return d.upsertPusher(ctx, txn, pusher)
+	})
+}
+
+// RemovePusher implements storage.Database
+func (d *Database) RemovePusher(
+	ctx context.Context, userID, appID, pushKey string,
+) error {
+	return d.deletePusher(ctx, nil, userID, appID, pushKey)
+}
+
+// PushersForUser implements storage.Database
+func (d *Database) PushersForUser(
+	ctx context.Context, userID string,
+) ([]types.Pusher, error) {
+	return d.selectPushersForUser(ctx, userID)
+}
+
+// IncrementNotificationCounts implements storage.Database
+func (d *Database) IncrementNotificationCounts(
+	ctx context.Context, userID, roomID string, highlight bool,
+) error {
+	return d.incrementNotificationCounts(ctx, userID, roomID, highlight)
+}
+
+// ResetNotificationCounts implements storage.Database
+func (d *Database) ResetNotificationCounts(
+	ctx context.Context, userID, roomID string,
+) error {
+	return d.deleteNotificationCounts(ctx, userID, roomID)
+}
+
+// NotificationCounts implements storage.Database
+func (d *Database) NotificationCounts(
+	ctx context.Context, userID string, roomIDs []string,
+) (map[string]api.NotificationCounts, error) {
+	all, err := d.selectNotificationCountsForUser(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[string]api.NotificationCounts)
+	for _, roomID := range roomIDs {
+		if counts, ok := all[roomID]; ok {
+			result[roomID] = counts
+		}
+	}
+	return result, nil
+}
+
+// TotalNotificationCount implements storage.Database
+func (d *Database) TotalNotificationCount(
+	ctx context.Context, userID string,
+) (int64, error) {
+	return d.selectTotalNotificationCount(ctx, userID)
+}
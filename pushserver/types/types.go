@@ -0,0 +1,51 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package types
+
+import (
+	"encoding/json"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// HTTPPusherKind is the kind of pusher that sends notifications to a push
+// gateway over HTTP. It is the only kind of pusher that we support.
+const HTTPPusherKind = "http"
+
+// EventIDOnlyFormat is the pusher data format which asks for notifications to
+// only contain the event ID, the room ID and the counts.
+const EventIDOnlyFormat = "event_id_only"
+
+// Pusher is a pusher that a client registered for a user, as described in
+// https://matrix.org/docs/spec/client_server/r0.6.0#post-matrix-client-r0-pushers-set
+type Pusher struct {
+	UserID            string                      `json:"-"`
+	Kind              string                      `json:"kind"`
+	AppID             string                      `json:"app_id"`
+	AppDisplayName    string                      `json:"app_display_name"`
+	DeviceDisplayName string                      `json:"device_display_name"`
+	PushKey           string                      `json:"pushkey"`
+	PushKeyTS         gomatrixserverlib.Timestamp `json:"-"`
+	ProfileTag        string                      `json:"profile_tag,omitempty"`
+	Language          string                      `json:"lang"`
+	Data              json.RawMessage             `json:"data"`
+}
+
+// PusherData holds the fields of the pusher data that the push server uses.
+// Everything else in the data is passed on to the push gateway as it is.
+type PusherData struct {
+	URL    string `json:"url"`
+	Format string `json:"format"`
+}
@@ -15,6 +15,8 @@
 package api
 
 import (
+	"encoding/json"
+
 	"github.com/matrix-org/gomatrixserverlib"
 )
 
@@ -28,6 +30,8 @@ const (
 	OutputTypeNewInviteEvent OutputType = "new_invite_event"
 	// OutputTypeRetireInviteEvent indicates that the event is an OutputRetireInviteEvent
 	OutputTypeRetireInviteEvent OutputType = "retire_invite_event"
+	// OutputTypeRedactedEvent indicates that the event is an OutputRedactedEvent
+	OutputTypeRedactedEvent OutputType = "redacted_event"
 )
 
 // An OutputEvent is an entry in the roomserver output kafka log.
@@ -41,6 +45,8 @@ type OutputEvent struct {
 	NewInviteEvent *OutputNewInviteEvent `json:"new_invite_event,omitempty"`
 	// The content of event with type OutputTypeRetireInviteEvent
 	RetireInviteEvent *OutputRetireInviteEvent `json:"retire_invite_event,omitempty"`
+	// The content of event with type OutputTypeRedactedEvent
+	RedactedEvent *OutputRedactedEvent `json:"redacted_event,omitempty"`
 }
 
 // An OutputNewRoomEvent is written when the roomserver receives a new event.
@@ -118,6 +124,34 @@ type OutputNewRoomEvent struct {
 type OutputNewInviteEvent struct {
 	// The "m.room.member" invite event.
 	Event gomatrixserverlib.HeaderedEvent `json:"event"`
+	// Some of the state of the room, such as its name and join rules, so
+	// that the invited user can tell what the room is before joining it.
+	// For invites from remote servers this is the invite_room_state that
+	// the invite arrived with.
+	InviteRoomState []StrippedEvent `json:"invite_room_state"`
+}
+
+// A StrippedEvent is a state event with only the keys that are needed to
+// show a room to a user who hasn't joined it.
+type StrippedEvent struct {
+	Type     string          `json:"type"`
+	StateKey string          `json:"state_key"`
+	Content  json.RawMessage `json:"content"`
+	Sender   string          `json:"sender"`
+}
+
+// NewStrippedEvent strips a state event down to a StrippedEvent.
+func NewStrippedEvent(event *gomatrixserverlib.Event) StrippedEvent {
+	var stateKey string
+	if event.StateKey() != nil {
+		stateKey = *event.StateKey()
+	}
+	return StrippedEvent{
+		Type:     event.Type(),
+		StateKey: stateKey,
+		Content:  event.Content(),
+		Sender:   event.Sender(),
+	}
 }
 
 // An OutputRetireInviteEvent is written whenever an existing invite is no longer
@@ -136,3 +170,14 @@ type OutputRetireInviteEvent struct {
 	// "leave" or "ban".
 	Membership string
 }
+
+// An OutputRedactedEvent is written whenever a redaction is applied to an
+// event, which happens once the roomserver has both the redaction and the
+// redacted event and has checked that the redaction is allowed. Consumers
+// should replace their copy of the redacted event with its redacted form.
+type OutputRedactedEvent struct {
+	// The ID of the event that was redacted.
+	RedactedEventID string `json:"redacted_event_id"`
+	// The "m.room.redaction" event that redacted the event.
+	RedactedBecause gomatrixserverlib.HeaderedEvent `json:"redacted_because"`
+}
@@ -271,6 +271,36 @@ type QueryRoomVersionForRoomResponse struct {
 	RoomVersion gomatrixserverlib.RoomVersion `json:"room_version"`
 }
 
+// QueryRoomsForUserRequest is a request to QueryRoomsForUser
+type QueryRoomsForUserRequest struct {
+	// The user ID to look up the rooms of.
+	UserID string `json:"user_id"`
+	// The membership that the user has in the rooms to look up, one of
+	// "join", "invite" or "leave". Defaults to "join".
+	WantMembership string `json:"want_membership"`
+}
+
+// QueryRoomsForUserResponse is a response to QueryRoomsForUser
+type QueryRoomsForUserResponse struct {
+	// The IDs of the rooms that the user currently has the membership in.
+	RoomIDs []string `json:"room_ids"`
+}
+
+// QueryUserAllowedToSeeEventsRequest is a request to QueryUserAllowedToSeeEvents
+type QueryUserAllowedToSeeEventsRequest struct {
+	// The ID of the local user who wants to see the events.
+	UserID string `json:"user_id"`
+	// The IDs of the events to check.
+	EventIDs []string `json:"event_ids"`
+}
+
+// QueryUserAllowedToSeeEventsResponse is a response to QueryUserAllowedToSeeEvents
+type QueryUserAllowedToSeeEventsResponse struct {
+	// Whether the user is allowed to see each event, by event ID. Events that
+	// the room server doesn't know about are never allowed.
+	AllowedToSeeEvents map[string]bool `json:"allowed_to_see_events"`
+}
+
 // RoomserverQueryAPI is used to query information from the room server.
 type RoomserverQueryAPI interface {
 	// Query the latest events and state for a room from the room server.
@@ -322,6 +352,15 @@ type RoomserverQueryAPI interface {
 		response *QueryServerAllowedToSeeEventResponse,
 	) error
 
+	// Query whether a local user is allowed to see each of a list of events,
+	// according to the history visibility of the room and the membership of
+	// the user at each event.
+	QueryUserAllowedToSeeEvents(
+		ctx context.Context,
+		request *QueryUserAllowedToSeeEventsRequest,
+		response *QueryUserAllowedToSeeEventsResponse,
+	) error
+
 	// Query missing events for a room from roomserver
 	QueryMissingEvents(
 		ctx context.Context,
@@ -364,6 +403,13 @@ type RoomserverQueryAPI interface {
 		request *QueryRoomVersionForRoomRequest,
 		response *QueryRoomVersionForRoomResponse,
 	) error
+
+	// Query the rooms that a user is currently joined to.
+	QueryRoomsForUser(
+		ctx context.Context,
+		request *QueryRoomsForUserRequest,
+		response *QueryRoomsForUserResponse,
+	) error
 }
 
 // RoomserverQueryLatestEventsAndStatePath is the HTTP path for the QueryLatestEventsAndState API.
@@ -387,6 +433,9 @@ const RoomserverQueryInvitesForUserPath = "/api/roomserver/queryInvitesForUser"
 // RoomserverQueryServerAllowedToSeeEventPath is the HTTP path for the QueryServerAllowedToSeeEvent API
 const RoomserverQueryServerAllowedToSeeEventPath = "/api/roomserver/queryServerAllowedToSeeEvent"
 
+// RoomserverQueryUserAllowedToSeeEventsPath is the HTTP path for the QueryUserAllowedToSeeEvents API
+const RoomserverQueryUserAllowedToSeeEventsPath = "/api/roomserver/queryUserAllowedToSeeEvents"
+
 // RoomserverQueryMissingEventsPath is the HTTP path for the QueryMissingEvents API
 const RoomserverQueryMissingEventsPath = "/api/roomserver/queryMissingEvents"
 
@@ -405,6 +454,9 @@ const RoomserverQueryRoomVersionCapabilitiesPath = "/api/roomserver/queryRoomVer
 // RoomserverQueryRoomVersionCapabilitiesPath is the HTTP path for the QueryRoomVersionCapabilities API
 const RoomserverQueryRoomVersionForRoomPath = "/api/roomserver/queryRoomVersionForRoom"
 
+// RoomserverQueryRoomsForUserPath is the HTTP path for the QueryRoomsForUser API
+const RoomserverQueryRoomsForUserPath = "/api/roomserver/queryRoomsForUser"
+
 // NewRoomserverQueryAPIHTTP creates a RoomserverQueryAPI implemented by talking to a HTTP POST API.
 // If httpClient is nil then it uses the http.DefaultClient
 func NewRoomserverQueryAPIHTTP(roomserverURL string, httpClient *http.Client) RoomserverQueryAPI {
@@ -510,6 +562,19 @@ func (h *httpRoomserverQueryAPI) QueryServerAllowedToSeeEvent(
 	return commonHTTP.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
 }
 
+// QueryUserAllowedToSeeEvents implements RoomserverQueryAPI
+func (h *httpRoomserverQueryAPI) QueryUserAllowedToSeeEvents(
+	ctx context.Context,
+	request *QueryUserAllowedToSeeEventsRequest,
+	response *QueryUserAllowedToSeeEventsResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "QueryUserAllowedToSeeEvents")
+	defer span.Finish()
+
+	apiURL := h.roomserverURL + RoomserverQueryUserAllowedToSeeEventsPath
+	return commonHTTP.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
+}
+
 // QueryMissingEvents implements RoomServerQueryAPI
 func (h *httpRoomserverQueryAPI) QueryMissingEvents(
 	ctx context.Context,
@@ -587,3 +652,16 @@ func (h *httpRoomserverQueryAPI) QueryRoomVersionForRoom(
 	apiURL := h.roomserverURL + RoomserverQueryRoomVersionForRoomPath
 	return commonHTTP.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
 }
+
+// QueryRoomsForUser implements RoomserverQueryAPI
+func (h *httpRoomserverQueryAPI) QueryRoomsForUser(
+	ctx context.Context,
+	request *QueryRoomsForUserRequest,
+	response *QueryRoomsForUserResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "QueryRoomsForUser")
+	defer span.Finish()
+
+	apiURL := h.roomserverURL + RoomserverQueryRoomsForUserPath
+	return commonHTTP.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
+}
@@ -52,6 +52,54 @@ func IsServerAllowed(
 	return false
 }
 
+// IsUserAllowed returns true if the local user is allowed to see an event
+// in the room, given the state at the event. This function implements
+// https://matrix.org/docs/spec/client_server/r0.6.0#id87
+func IsUserAllowed(
+	userID string,
+	userCurrentlyInRoom bool,
+	stateAtEvent []gomatrixserverlib.Event,
+) bool {
+	historyVisibility := historyVisibilityForRoom(stateAtEvent)
+	membership := userMembership(userID, stateAtEvent)
+
+	// 1. If the history_visibility was set to world_readable, allow.
+	if historyVisibility == "world_readable" {
+		return true
+	}
+	// 2. If the user's membership was join, allow.
+	if membership == gomatrixserverlib.Join {
+		return true
+	}
+	// 3. If history_visibility was set to shared, and the user joined the room at any point after the event was sent, allow.
+	if historyVisibility == "shared" && userCurrentlyInRoom {
+		return true
+	}
+	// 4. If the user's membership was invite, and the history_visibility was set to invited, allow.
+	if membership == gomatrixserverlib.Invite && historyVisibility == "invited" {
+		return true
+	}
+
+	// 5. Otherwise, deny.
+	return false
+}
+
+// userMembership returns the membership of the user in the given state, or
+// an empty string if the user has no membership event in it. If there are
+// several membership events for the user then the last one wins.
+func userMembership(userID string, stateEvents []gomatrixserverlib.Event) string {
+	var membership string
+	for _, ev := range stateEvents {
+		if ev.Type() != gomatrixserverlib.MRoomMember || !ev.StateKeyEquals(userID) {
+			continue
+		}
+		if m, err := ev.Membership(); err == nil {
+			membership = m
+		}
+	}
+	return membership
+}
+
 func historyVisibilityForRoom(authEvents []gomatrixserverlib.Event) string {
 	// https://matrix.org/docs/spec/client_server/r0.6.0#id87
 	// By default if no history_visibility is set, or if the value is not understood, the visibility is assumed to be shared.
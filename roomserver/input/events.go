@@ -35,6 +35,7 @@ type RoomEventDatabase interface {
 	StoreEvent(
 		ctx context.Context,
 		event gomatrixserverlib.Event,
+		roomVersion gomatrixserverlib.RoomVersion,
 		txnAndSessionID *api.TransactionID,
 		authEventNIDs []types.EventNID,
 	) (types.RoomNID, types.StateAtEvent, error)
@@ -64,6 +65,7 @@ type RoomEventDatabase interface {
 	// Build a membership updater for the target user in a room.
 	MembershipUpdater(
 		ctx context.Context, roomID, targerUserID string,
+		roomVersion gomatrixserverlib.RoomVersion,
 	) (types.MembershipUpdater, error)
 	// Look up event ID by transaction's info.
 	// This is used to determine if the room event is processed/processing already.
@@ -76,6 +78,26 @@ type RoomEventDatabase interface {
 	GetRoomVersionForRoom(
 		ctx context.Context, roomID string,
 	) (gomatrixserverlib.RoomVersion, error)
+	// Look up the numeric IDs for a list of events.
+	// Returns an error if there was a problem talking to the database.
+	EventNIDs(
+		ctx context.Context, eventIDs []string,
+	) (map[string]types.EventNID, error)
+	// Store a redaction event so that it can be applied once we have the
+	// event it redacts.
+	StoreRedaction(
+		ctx context.Context, redactionEventID, redactsEventID string,
+	) error
+	// Look up the IDs of the redactions of an event that haven't been applied.
+	PendingRedactions(
+		ctx context.Context, redactsEventID string,
+	) ([]string, error)
+	// Replace the stored event with its redacted form and mark the redaction
+	// as applied. Returns false if the redaction had already been applied.
+	RedactEvent(
+		ctx context.Context, redactionEventID string,
+		eventNID types.EventNID, redactedEvent gomatrixserverlib.Event,
+	) (bool, error)
 }
 
 // OutputRoomEventWriter has the APIs needed to write an event to the output logs.
@@ -117,7 +139,7 @@ func processRoomEvent(
 	}
 
 	// Store the event
-	roomNID, stateAtEvent, err := db.StoreEvent(ctx, event, input.TransactionID, authEventNIDs)
+	roomNID, stateAtEvent, err := db.StoreEvent(ctx, event, headered.RoomVersion, input.TransactionID, authEventNIDs)
 	if err != nil {
 		return
 	}
@@ -125,8 +147,8 @@ func processRoomEvent(
 	if input.Kind == api.KindOutlier {
 		// For outliers we can stop after we've stored the event itself as it
 		// doesn't have any associated state to store and we don't need to
-		// notify anyone about it.
-		return event.EventID(), nil
+		// notify anyone about it. It may however complete a redaction.
+		return event.EventID(), processRedactions(ctx, db, ow, headered)
 	}
 
 	if stateAtEvent.BeforeStateSnapshotNID == 0 {
@@ -144,9 +166,16 @@ func processRoomEvent(
 	}
 
 	// Update the extremities of the event graph for the room
-	return event.EventID(), updateLatestEvents(
+	if err = updateLatestEvents(
 		ctx, db, ow, roomNID, stateAtEvent, event, input.SendAsServer, input.TransactionID,
-	)
+	); err != nil {
+		return
+	}
+
+	// Apply the redactions that the event completes. This is done after the
+	// event was written to the output log so that the other components know
+	// about the event before they are told to redact it.
+	return event.EventID(), processRedactions(ctx, db, ow, headered)
 }
 
 func calculateAndSetState(
@@ -193,7 +222,7 @@ func processInviteEvent(
 	roomID := input.Event.RoomID()
 	targetUserID := *input.Event.StateKey()
 
-	updater, err := db.MembershipUpdater(ctx, roomID, targetUserID)
+	updater, err := db.MembershipUpdater(ctx, roomID, targetUserID, input.Event.RoomVersion)
 	if err != nil {
 		return err
 	}
@@ -237,7 +266,9 @@ func processInviteEvent(
 	}
 
 	event := input.Event.Unwrap()
-	outputUpdates, err := updateToInviteMembership(updater, &event, nil)
+	outputUpdates, err := updateToInviteMembership(
+		updater, &event, inviteRoomStateFromUnsigned(&event), nil, input.Event.RoomVersion,
+	)
 	if err != nil {
 		return err
 	}
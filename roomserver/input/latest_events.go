@@ -19,6 +19,9 @@ package input
 import (
 	"bytes"
 	"context"
+	"encoding/base64"
+	"fmt"
+	"strings"
 
 	"github.com/matrix-org/dendrite/common"
 	"github.com/matrix-org/dendrite/roomserver/api"
@@ -113,7 +116,14 @@ type latestEventsUpdater struct {
 }
 
 func (u *latestEventsUpdater) doUpdateLatestEvents() error {
-	prevEvents := u.event.PrevEvents()
+	roomVersion, err := u.db.GetRoomVersionForRoom(u.ctx, u.event.RoomID())
+	if err != nil {
+		return err
+	}
+	prevEvents, err := prevEventReferences(u.event, roomVersion)
+	if err != nil {
+		return err
+	}
 	oldLatest := u.updater.LatestEvents()
 	u.lastEventIDSent = u.updater.LastEventIDSent()
 	u.oldStateNID = u.updater.CurrentStateSnapshotNID()
@@ -146,7 +156,7 @@ func (u *latestEventsUpdater) doUpdateLatestEvents() error {
 		return err
 	}
 
-	updates, err := updateMemberships(u.ctx, u.db, u.updater, u.removed, u.added)
+	updates, err := updateMemberships(u.ctx, u.db, u.updater, u.newStateNID, u.removed, u.added, roomVersion)
 	if err != nil {
 		return err
 	}
@@ -204,6 +214,38 @@ func (u *latestEventsUpdater) latestState() error {
 	return err
 }
 
+// prevEventReferences returns the references to the prev_events of the event.
+// Events in rooms with hash-based event IDs only refer to their prev_events by
+// ID, so the reference hashes are decoded from the IDs to match the hashes that
+// are stored for the referenced events.
+func prevEventReferences(
+	event gomatrixserverlib.Event, roomVersion gomatrixserverlib.RoomVersion,
+) ([]gomatrixserverlib.EventReference, error) {
+	eventIDFormat, err := roomVersion.EventIDFormat()
+	if err != nil {
+		return nil, err
+	}
+	var encoding *base64.Encoding
+	switch eventIDFormat {
+	case gomatrixserverlib.EventIDFormatV1:
+		return event.PrevEvents(), nil
+	case gomatrixserverlib.EventIDFormatV2:
+		encoding = base64.RawStdEncoding
+	default:
+		encoding = base64.RawURLEncoding
+	}
+	prevEventIDs := event.PrevEventIDs()
+	result := make([]gomatrixserverlib.EventReference, len(prevEventIDs))
+	for i, eventID := range prevEventIDs {
+		eventSHA256, err := encoding.DecodeString(strings.TrimPrefix(eventID, "$"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid prev event ID %q: %w", eventID, err)
+		}
+		result[i] = gomatrixserverlib.EventReference{EventID: eventID, EventSHA256: eventSHA256}
+	}
+	return result, nil
+}
+
 func calculateLatest(
 	oldLatest []types.StateAtEventAndReference,
 	alreadyReferenced bool,
@@ -0,0 +1,67 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package input
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"golang.org/x/crypto/ed25519"
+)
+
+func TestPrevEventReferences(t *testing.T) {
+	_, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	build := func(roomVersion gomatrixserverlib.RoomVersion, prevEvents interface{}) gomatrixserverlib.Event {
+		builder := gomatrixserverlib.EventBuilder{
+			Sender:     "@alice:localhost",
+			RoomID:     "!room:localhost",
+			Type:       "m.room.message",
+			PrevEvents: prevEvents,
+			AuthEvents: []gomatrixserverlib.EventReference{},
+		}
+		if err = builder.SetContent(map[string]string{"body": "hello"}); err != nil {
+			t.Fatal(err)
+		}
+		event, err := builder.Build(time.Now(), "localhost", "ed25519:test", privateKey, roomVersion)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return event
+	}
+
+	for _, roomVersion := range []gomatrixserverlib.RoomVersion{
+		gomatrixserverlib.RoomVersionV1,
+		gomatrixserverlib.RoomVersionV3,
+		gomatrixserverlib.RoomVersionV4,
+		gomatrixserverlib.RoomVersionV5,
+	} {
+		prev := build(roomVersion, []gomatrixserverlib.EventReference{})
+		event := build(roomVersion, []gomatrixserverlib.EventReference{prev.EventReference()})
+
+		refs, err := prevEventReferences(event, roomVersion)
+		if err != nil {
+			t.Fatalf("room version %s: %s", roomVersion, err)
+		}
+		want := prev.EventReference()
+		if len(refs) != 1 || refs[0].EventID != want.EventID || !bytes.Equal(refs[0].EventSHA256, want.EventSHA256) {
+			t.Errorf("room version %s: got %v, want [%v]", roomVersion, refs, want)
+		}
+	}
+}
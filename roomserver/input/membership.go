@@ -16,9 +16,11 @@ package input
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 
 	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/roomserver/state"
 	"github.com/matrix-org/dendrite/roomserver/types"
 	"github.com/matrix-org/gomatrixserverlib"
 )
@@ -31,7 +33,9 @@ func updateMemberships(
 	ctx context.Context,
 	db RoomEventDatabase,
 	updater types.RoomRecentEventsUpdater,
+	stateNID types.StateSnapshotNID,
 	removed, added []types.StateEntry,
+	roomVersion gomatrixserverlib.RoomVersion,
 ) ([]api.OutputEvent, error) {
 	changes := membershipChanges(removed, added)
 	var eventNIDs []types.EventNID
@@ -70,7 +74,16 @@ func updateMemberships(
 				ae = &ev.Event
 			}
 		}
-		if updates, err = updateMembership(updater, targetUserNID, re, ae, updates); err != nil {
+		var inviteRoomState []api.StrippedEvent
+		if ae != nil {
+			if membership, merr := ae.Membership(); merr == nil && membership == gomatrixserverlib.Invite {
+				inviteRoomState, err = inviteRoomStateAtSnapshot(ctx, db, stateNID, ae)
+				if err != nil {
+					return nil, err
+				}
+			}
+		}
+		if updates, err = updateMembership(updater, targetUserNID, re, ae, inviteRoomState, updates, roomVersion); err != nil {
 			return nil, err
 		}
 	}
@@ -80,7 +93,9 @@ func updateMemberships(
 func updateMembership(
 	updater types.RoomRecentEventsUpdater, targetUserNID types.EventStateKeyNID,
 	remove, add *gomatrixserverlib.Event,
+	inviteRoomState []api.StrippedEvent,
 	updates []api.OutputEvent,
+	roomVersion gomatrixserverlib.RoomVersion,
 ) ([]api.OutputEvent, error) {
 	var err error
 	// Default the membership to Leave if no event was added or removed.
@@ -112,7 +127,7 @@ func updateMembership(
 
 	switch newMembership {
 	case gomatrixserverlib.Invite:
-		return updateToInviteMembership(mu, add, updates)
+		return updateToInviteMembership(mu, add, inviteRoomState, updates, roomVersion)
 	case gomatrixserverlib.Join:
 		return updateToJoinMembership(mu, add, updates)
 	case gomatrixserverlib.Leave, gomatrixserverlib.Ban:
@@ -125,7 +140,9 @@ func updateMembership(
 }
 
 func updateToInviteMembership(
-	mu types.MembershipUpdater, add *gomatrixserverlib.Event, updates []api.OutputEvent,
+	mu types.MembershipUpdater, add *gomatrixserverlib.Event,
+	inviteRoomState []api.StrippedEvent, updates []api.OutputEvent,
+	roomVersion gomatrixserverlib.RoomVersion,
 ) ([]api.OutputEvent, error) {
 	// We may have already sent the invite to the user, either because we are
 	// reprocessing this event, or because the we received this invite from a
@@ -136,14 +153,14 @@ func updateToInviteMembership(
 		return nil, err
 	}
 	if needsSending {
-		roomVersion := gomatrixserverlib.RoomVersionV1
 		// We notify the consumers using a special event even though we will
 		// notify them about the change in current state as part of the normal
 		// room event stream. This ensures that the consumers only have to
 		// consider a single stream of events when determining whether a user
 		// is invited, rather than having to combine multiple streams themselves.
 		onie := api.OutputNewInviteEvent{
-			Event: (*add).Headered(roomVersion),
+			Event:           (*add).Headered(roomVersion),
+			InviteRoomState: inviteRoomState,
 		}
 		updates = append(updates, api.OutputEvent{
 			Type:           api.OutputTypeNewInviteEvent,
@@ -221,6 +238,65 @@ func updateToLeaveMembership(
 	return updates, nil
 }
 
+// inviteRoomStateTypes are the types of state events that are shared with
+// users who are invited to a room, along with the membership of the inviter.
+var inviteRoomStateTypes = []string{
+	gomatrixserverlib.MRoomJoinRules,
+	"m.room.canonical_alias",
+	"m.room.avatar",
+	"m.room.encryption",
+	"m.room.name",
+}
+
+// inviteRoomStateAtSnapshot returns the stripped state of the room at the
+// given snapshot that is shared with the target of an invite event.
+func inviteRoomStateAtSnapshot(
+	ctx context.Context, db RoomEventDatabase,
+	stateNID types.StateSnapshotNID, invite *gomatrixserverlib.Event,
+) ([]api.StrippedEvent, error) {
+	tuples := []gomatrixserverlib.StateKeyTuple{
+		{EventType: gomatrixserverlib.MRoomMember, StateKey: invite.Sender()},
+	}
+	for _, eventType := range inviteRoomStateTypes {
+		tuples = append(tuples, gomatrixserverlib.StateKeyTuple{EventType: eventType, StateKey: ""})
+	}
+	stateEntries, err := state.NewStateResolution(db).LoadStateAtSnapshotForStringTuples(
+		ctx, stateNID, tuples,
+	)
+	if err != nil {
+		return nil, err
+	}
+	eventNIDs := make([]types.EventNID, len(stateEntries))
+	for i := range stateEntries {
+		eventNIDs[i] = stateEntries[i].EventNID
+	}
+	stateEvents, err := db.Events(ctx, eventNIDs)
+	if err != nil {
+		return nil, err
+	}
+	inviteRoomState := make([]api.StrippedEvent, len(stateEvents))
+	for i := range stateEvents {
+		inviteRoomState[i] = api.NewStrippedEvent(&stateEvents[i].Event)
+	}
+	return inviteRoomState, nil
+}
+
+// inviteRoomStateFromUnsigned returns the stripped state of the room that a
+// remote server sent in the unsigned data of an invite event. Invalid invite
+// room state is ignored as it is only used to show the invite to the user.
+func inviteRoomStateFromUnsigned(invite *gomatrixserverlib.Event) []api.StrippedEvent {
+	var unsigned struct {
+		InviteRoomState []api.StrippedEvent `json:"invite_room_state"`
+	}
+	if len(invite.Unsigned()) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(invite.Unsigned(), &unsigned); err != nil {
+		return nil
+	}
+	return unsigned.InviteRoomState
+}
+
 // membershipChanges pairs up the membership state changes from a sorted list
 // of state removed and a sorted list of state added.
 func membershipChanges(removed, added []types.StateEntry) []stateChange {
@@ -0,0 +1,176 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package input
+
+import (
+	"context"
+
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/roomserver/state"
+	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// processRedactions applies the redactions that become possible now that the
+// event is stored. A redaction can only be applied once we have both the
+// redaction and the event it redacts, which can arrive in any order: if the
+// event is a redaction then it is applied to the event it redacts if we have
+// it, otherwise the redactions of the event that we received before it are
+// applied to it. The redactions that get applied are written to the output
+// log so that the other components can redact their copy of the event.
+func processRedactions(
+	ctx context.Context,
+	db RoomEventDatabase,
+	ow OutputRoomEventWriter,
+	headered gomatrixserverlib.HeaderedEvent,
+) error {
+	event := headered.Unwrap()
+
+	var redactedEventID string
+	var redactionEventIDs []string
+	if event.Type() == gomatrixserverlib.MRoomRedaction {
+		// Events that redact themselves are ignored.
+		if event.Redacts() == "" || event.Redacts() == event.EventID() {
+			return nil
+		}
+		if err := db.StoreRedaction(ctx, event.EventID(), event.Redacts()); err != nil {
+			return err
+		}
+		redactedEventID = event.Redacts()
+		redactionEventIDs = []string{event.EventID()}
+	} else {
+		var err error
+		redactionEventIDs, err = db.PendingRedactions(ctx, event.EventID())
+		if err != nil || len(redactionEventIDs) == 0 {
+			return err
+		}
+		redactedEventID = event.EventID()
+	}
+
+	eventNIDs, err := db.EventNIDs(ctx, append([]string{redactedEventID}, redactionEventIDs...))
+	if err != nil {
+		return err
+	}
+	redactedEventNID, ok := eventNIDs[redactedEventID]
+	if !ok {
+		// We don't have the redacted event yet. The redaction will be applied
+		// when it arrives.
+		return nil
+	}
+	nids := make([]types.EventNID, 0, len(eventNIDs))
+	for _, nid := range eventNIDs {
+		nids = append(nids, nid)
+	}
+	events, err := db.Events(ctx, nids)
+	if err != nil {
+		return err
+	}
+	eventsByID := make(map[string]gomatrixserverlib.Event, len(events))
+	for _, ev := range events {
+		eventsByID[ev.EventID()] = ev.Event
+	}
+	redactedEvent := eventsByID[redactedEventID]
+
+	var updates []api.OutputEvent
+	for _, redactionEventID := range redactionEventIDs {
+		redactionEvent, ok := eventsByID[redactionEventID]
+		if !ok {
+			continue
+		}
+		allowed, err := redactionAllowed(ctx, db, redactionEvent, redactedEvent)
+		if err != nil {
+			return err
+		}
+		if !allowed {
+			continue
+		}
+		redacted, err := common.RedactEvent(&redactedEvent, &redactionEvent, headered.RoomVersion)
+		if err != nil {
+			return err
+		}
+		applied, err := db.RedactEvent(ctx, redactionEventID, redactedEventNID, *redacted)
+		if err != nil {
+			return err
+		}
+		redactedEvent = *redacted
+		if !applied {
+			continue
+		}
+		updates = append(updates, api.OutputEvent{
+			Type: api.OutputTypeRedactedEvent,
+			RedactedEvent: &api.OutputRedactedEvent{
+				RedactedEventID: redactedEventID,
+				RedactedBecause: redactionEvent.Headered(headered.RoomVersion),
+			},
+		})
+	}
+
+	if len(updates) == 0 {
+		return nil
+	}
+	return ow.WriteOutputEvents(event.RoomID(), updates)
+}
+
+// redactionAllowed checks whether the sender of the redaction is allowed to
+// redact the event. The auth rules of the newer room versions accept any
+// redaction into the room, leaving it to the servers to check this before
+// applying the redaction: servers can always redact the events they sent,
+// otherwise the sender needs the "redact" power level at the redaction.
+func redactionAllowed(
+	ctx context.Context,
+	db RoomEventDatabase,
+	redactionEvent, redactedEvent gomatrixserverlib.Event,
+) (bool, error) {
+	if redactionEvent.RoomID() != redactedEvent.RoomID() {
+		return false, nil
+	}
+
+	_, redactionDomain, err := gomatrixserverlib.SplitID('@', redactionEvent.Sender())
+	if err != nil {
+		return false, nil
+	}
+	_, redactedDomain, err := gomatrixserverlib.SplitID('@', redactedEvent.Sender())
+	if err != nil {
+		return false, nil
+	}
+	if redactionDomain == redactedDomain {
+		return true, nil
+	}
+
+	snapshotNID, err := db.SnapshotNIDFromEventID(ctx, redactionEvent.EventID())
+	if err != nil || snapshotNID == 0 {
+		// We don't know the state at the redaction, e.g. because it is an
+		// outlier, so we can't tell whether the sender had enough power.
+		return false, err
+	}
+	stateEntries, err := state.NewStateResolution(db).LoadStateAtSnapshotForStringTuples(
+		ctx, snapshotNID, []gomatrixserverlib.StateKeyTuple{
+			{EventType: gomatrixserverlib.MRoomPowerLevels, StateKey: ""},
+		},
+	)
+	if err != nil || len(stateEntries) == 0 {
+		return false, err
+	}
+	powerLevelsEvents, err := db.Events(ctx, []types.EventNID{stateEntries[0].EventNID})
+	if err != nil || len(powerLevelsEvents) == 0 {
+		return false, err
+	}
+	powerLevels, err := gomatrixserverlib.NewPowerLevelContentFromEvent(powerLevelsEvents[0].Event)
+	if err != nil {
+		return false, nil
+	}
+	return powerLevels.UserLevel(redactionEvent.Sender()) >= powerLevels.Redact, nil
+}
@@ -0,0 +1,370 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package input
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/gomatrixserverlib"
+	"golang.org/x/crypto/ed25519"
+)
+
+const redactionTestRoomID = "!room:localhost"
+
+// fakeRedactionDatabase implements the parts of RoomEventDatabase that are
+// used to apply redactions. The state at every event with a snapshot is the
+// power levels event, if there is one.
+type fakeRedactionDatabase struct {
+	RoomEventDatabase
+	events      map[types.EventNID]types.Event
+	nids        map[string]types.EventNID
+	snapshots   map[string]types.StateSnapshotNID
+	pending     map[string][]string
+	applied     map[string]bool
+	powerLevels types.EventNID
+}
+
+func newFakeRedactionDatabase() *fakeRedactionDatabase {
+	return &fakeRedactionDatabase{
+		events:    map[types.EventNID]types.Event{},
+		nids:      map[string]types.EventNID{},
+		snapshots: map[string]types.StateSnapshotNID{},
+		pending:   map[string][]string{},
+		applied:   map[string]bool{},
+	}
+}
+
+// store adds an event to the database, with a state snapshot if withState is true.
+func (d *fakeRedactionDatabase) store(event gomatrixserverlib.Event, withState bool) types.EventNID {
+	nid := types.EventNID(len(d.events) + 1)
+	d.events[nid] = types.Event{EventNID: nid, Event: event}
+	d.nids[event.EventID()] = nid
+	if withState {
+		d.snapshots[event.EventID()] = 1
+	}
+	return nid
+}
+
+func (d *fakeRedactionDatabase) StoreRedaction(ctx context.Context, redactionEventID, redactsEventID string) error {
+	d.pending[redactsEventID] = append(d.pending[redactsEventID], redactionEventID)
+	return nil
+}
+
+func (d *fakeRedactionDatabase) PendingRedactions(ctx context.Context, redactsEventID string) ([]string, error) {
+	var result []string
+	for _, redactionEventID := range d.pending[redactsEventID] {
+		if !d.applied[redactionEventID] {
+			result = append(result, redactionEventID)
+		}
+	}
+	return result, nil
+}
+
+func (d *fakeRedactionDatabase) EventNIDs(ctx context.Context, eventIDs []string) (map[string]types.EventNID, error) {
+	result := map[string]types.EventNID{}
+	for _, eventID := range eventIDs {
+		if nid, ok := d.nids[eventID]; ok {
+			result[eventID] = nid
+		}
+	}
+	return result, nil
+}
+
+func (d *fakeRedactionDatabase) Events(ctx context.Context, eventNIDs []types.EventNID) ([]types.Event, error) {
+	var result []types.Event
+	for _, nid := range eventNIDs {
+		if event, ok := d.events[nid]; ok {
+			result = append(result, event)
+		}
+	}
+	return result, nil
+}
+
+func (d *fakeRedactionDatabase) RedactEvent(
+	ctx context.Context, redactionEventID string,
+	eventNID types.EventNID, redactedEvent gomatrixserverlib.Event,
+) (bool, error) {
+	if d.applied[redactionEventID] {
+		return false, nil
+	}
+	d.applied[redactionEventID] = true
+	d.events[eventNID] = types.Event{EventNID: eventNID, Event: redactedEvent}
+	return true, nil
+}
+
+func (d *fakeRedactionDatabase) SnapshotNIDFromEventID(ctx context.Context, eventID string) (types.StateSnapshotNID, error) {
+	return d.snapshots[eventID], nil
+}
+
+func (d *fakeRedactionDatabase) EventTypeNIDs(ctx context.Context, eventTypes []string) (map[string]types.EventTypeNID, error) {
+	return map[string]types.EventTypeNID{gomatrixserverlib.MRoomPowerLevels: types.MRoomPowerLevelsNID}, nil
+}
+
+func (d *fakeRedactionDatabase) EventStateKeyNIDs(ctx context.Context, eventStateKeys []string) (map[string]types.EventStateKeyNID, error) {
+	return map[string]types.EventStateKeyNID{"": types.EmptyStateKeyNID}, nil
+}
+
+func (d *fakeRedactionDatabase) StateBlockNIDs(ctx context.Context, stateNIDs []types.StateSnapshotNID) ([]types.StateBlockNIDList, error) {
+	return []types.StateBlockNIDList{{StateSnapshotNID: stateNIDs[0], StateBlockNIDs: []types.StateBlockNID{1}}}, nil
+}
+
+func (d *fakeRedactionDatabase) StateEntriesForTuples(
+	ctx context.Context, stateBlockNIDs []types.StateBlockNID, stateKeyTuples []types.StateKeyTuple,
+) ([]types.StateEntryList, error) {
+	if d.powerLevels == 0 {
+		return nil, nil
+	}
+	return []types.StateEntryList{{
+		StateBlockNID: 1,
+		StateEntries: []types.StateEntry{{
+			StateKeyTuple: types.StateKeyTuple{
+				EventTypeNID:     types.MRoomPowerLevelsNID,
+				EventStateKeyNID: types.EmptyStateKeyNID,
+			},
+			EventNID: d.powerLevels,
+		}},
+	}}, nil
+}
+
+// fakeOutputWriter records the output events that are written.
+type fakeOutputWriter struct {
+	updates []api.OutputEvent
+}
+
+func (w *fakeOutputWriter) WriteOutputEvents(roomID string, updates []api.OutputEvent) error {
+	w.updates = append(w.updates, updates...)
+	return nil
+}
+
+type redactionTestEvents struct {
+	t          *testing.T
+	privateKey ed25519.PrivateKey
+	count      int
+}
+
+func (e *redactionTestEvents) build(sender, eventType string, stateKey *string, redacts string, content interface{}) gomatrixserverlib.Event {
+	e.count++
+	builder := gomatrixserverlib.EventBuilder{
+		Sender:     sender,
+		RoomID:     redactionTestRoomID,
+		Type:       eventType,
+		StateKey:   stateKey,
+		Redacts:    redacts,
+		Depth:      int64(e.count),
+		PrevEvents: []gomatrixserverlib.EventReference{},
+		AuthEvents: []gomatrixserverlib.EventReference{},
+	}
+	if err := builder.SetContent(content); err != nil {
+		e.t.Fatal(err)
+	}
+	_, origin, err := gomatrixserverlib.SplitID('@', sender)
+	if err != nil {
+		e.t.Fatal(err)
+	}
+	event, err := builder.Build(time.Now(), origin, "ed25519:test", e.privateKey, gomatrixserverlib.RoomVersionV1)
+	if err != nil {
+		e.t.Fatal(err)
+	}
+	return event
+}
+
+func (e *redactionTestEvents) message(sender string) gomatrixserverlib.Event {
+	return e.build(sender, "m.room.message", nil, "", map[string]string{"body": "hello"})
+}
+
+func (e *redactionTestEvents) redaction(sender string, redacts gomatrixserverlib.Event) gomatrixserverlib.Event {
+	return e.build(sender, gomatrixserverlib.MRoomRedaction, nil, redacts.EventID(), map[string]string{})
+}
+
+func (e *redactionTestEvents) powerLevels(users map[string]int64) gomatrixserverlib.Event {
+	stateKey := ""
+	return e.build("@alice:localhost", gomatrixserverlib.MRoomPowerLevels, &stateKey, "", map[string]interface{}{
+		"users":  users,
+		"redact": 50,
+	})
+}
+
+func newRedactionTestEvents(t *testing.T) *redactionTestEvents {
+	_, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &redactionTestEvents{t: t, privateKey: privateKey}
+}
+
+// process stores the event and applies the redactions that it makes possible.
+func processTestRedactions(
+	t *testing.T, db *fakeRedactionDatabase, ow *fakeOutputWriter, event gomatrixserverlib.Event,
+) {
+	db.store(event, true)
+	if err := processRedactions(
+		context.Background(), db, ow, event.Headered(gomatrixserverlib.RoomVersionV1),
+	); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func assertRedacted(t *testing.T, db *fakeRedactionDatabase, ow *fakeOutputWriter, redacted, redaction gomatrixserverlib.Event) {
+	t.Helper()
+	if len(ow.updates) != 1 {
+		t.Fatalf("got %d output events, want 1", len(ow.updates))
+	}
+	update := ow.updates[0]
+	if update.Type != api.OutputTypeRedactedEvent || update.RedactedEvent == nil {
+		t.Fatalf("got output event of type %q, want %q", update.Type, api.OutputTypeRedactedEvent)
+	}
+	if update.RedactedEvent.RedactedEventID != redacted.EventID() {
+		t.Errorf("got redacted event ID %s, want %s", update.RedactedEvent.RedactedEventID, redacted.EventID())
+	}
+	if update.RedactedEvent.RedactedBecause.EventID() != redaction.EventID() {
+		t.Errorf("got redaction event ID %s, want %s", update.RedactedEvent.RedactedBecause.EventID(), redaction.EventID())
+	}
+	stored := db.events[db.nids[redacted.EventID()]]
+	if string(stored.Content()) != "{}" {
+		t.Errorf("stored event still has content %s", stored.Content())
+	}
+}
+
+func assertNotRedacted(t *testing.T, db *fakeRedactionDatabase, ow *fakeOutputWriter, event gomatrixserverlib.Event) {
+	t.Helper()
+	if len(ow.updates) != 0 {
+		t.Errorf("got %d output events, want none", len(ow.updates))
+	}
+	stored := db.events[db.nids[event.EventID()]]
+	if string(stored.Content()) != string(event.Content()) {
+		t.Errorf("stored event was redacted to %s", stored.Content())
+	}
+}
+
+func TestRedactionBySameServer(t *testing.T) {
+	events := newRedactionTestEvents(t)
+	db, ow := newFakeRedactionDatabase(), &fakeOutputWriter{}
+
+	message := events.message("@alice:localhost")
+	redaction := events.redaction("@bob:localhost", message)
+	processTestRedactions(t, db, ow, message)
+	processTestRedactions(t, db, ow, redaction)
+
+	assertRedacted(t, db, ow, message, redaction)
+}
+
+func TestRedactionByOtherServer(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		level   int64
+		allowed bool
+	}{
+		{"without power", 0, false},
+		{"with power", 50, true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			events := newRedactionTestEvents(t)
+			db, ow := newFakeRedactionDatabase(), &fakeOutputWriter{}
+			db.powerLevels = db.store(events.powerLevels(map[string]int64{
+				"@alice:localhost": 100,
+				"@mod:remote":      test.level,
+			}), true)
+
+			message := events.message("@alice:localhost")
+			redaction := events.redaction("@mod:remote", message)
+			processTestRedactions(t, db, ow, message)
+			processTestRedactions(t, db, ow, redaction)
+
+			if test.allowed {
+				assertRedacted(t, db, ow, message, redaction)
+			} else {
+				assertNotRedacted(t, db, ow, message)
+			}
+		})
+	}
+}
+
+func TestRedactionWithoutStateIsNotAllowed(t *testing.T) {
+	events := newRedactionTestEvents(t)
+	db, ow := newFakeRedactionDatabase(), &fakeOutputWriter{}
+	db.powerLevels = db.store(events.powerLevels(map[string]int64{"@mod:remote": 100}), true)
+
+	message := events.message("@alice:localhost")
+	redaction := events.redaction("@mod:remote", message)
+	processTestRedactions(t, db, ow, message)
+	// The redaction is an outlier, so we don't know the power levels at it.
+	db.store(redaction, false)
+	if err := processRedactions(
+		context.Background(), db, ow, redaction.Headered(gomatrixserverlib.RoomVersionV1),
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	assertNotRedacted(t, db, ow, message)
+}
+
+func TestRedactionBeforeRedactedEvent(t *testing.T) {
+	events := newRedactionTestEvents(t)
+	db, ow := newFakeRedactionDatabase(), &fakeOutputWriter{}
+
+	message := events.message("@alice:localhost")
+	redaction := events.redaction("@alice:localhost", message)
+
+	// The redaction arrives first and is kept until we have the event.
+	processTestRedactions(t, db, ow, redaction)
+	if len(ow.updates) != 0 {
+		t.Fatalf("got %d output events before the redacted event arrived, want none", len(ow.updates))
+	}
+	if pending := db.pending[message.EventID()]; len(pending) != 1 || pending[0] != redaction.EventID() {
+		t.Fatalf("got pending redactions %v, want [%s]", pending, redaction.EventID())
+	}
+
+	processTestRedactions(t, db, ow, message)
+	assertRedacted(t, db, ow, message, redaction)
+
+	// Processing the redaction again doesn't apply it twice.
+	ow.updates = nil
+	if err := processRedactions(
+		context.Background(), db, ow, redaction.Headered(gomatrixserverlib.RoomVersionV1),
+	); err != nil {
+		t.Fatal(err)
+	}
+	if len(ow.updates) != 0 {
+		t.Errorf("got %d output events for a redaction that was already applied, want none", len(ow.updates))
+	}
+}
+
+func TestRedactedBecause(t *testing.T) {
+	events := newRedactionTestEvents(t)
+	message := events.message("@alice:localhost")
+	redaction := events.redaction("@alice:localhost", message)
+
+	db, ow := newFakeRedactionDatabase(), &fakeOutputWriter{}
+	processTestRedactions(t, db, ow, message)
+	processTestRedactions(t, db, ow, redaction)
+
+	var unsigned struct {
+		RedactedBecause struct {
+			EventID string `json:"event_id"`
+		} `json:"redacted_because"`
+	}
+	stored := db.events[db.nids[message.EventID()]]
+	if err := json.Unmarshal(stored.Unsigned(), &unsigned); err != nil {
+		t.Fatal(err)
+	}
+	if unsigned.RedactedBecause.EventID != redaction.EventID() {
+		t.Errorf("got redacted_because %q, want %q", unsigned.RedactedBecause.EventID, redaction.EventID())
+	}
+}
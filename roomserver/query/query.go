@@ -93,6 +93,11 @@ type RoomserverQueryAPIDatabase interface {
 	GetRoomVersionForRoom(
 		ctx context.Context, roomID string,
 	) (gomatrixserverlib.RoomVersion, error)
+	// Look up the IDs of the rooms that a user currently has the given
+	// membership in.
+	GetRoomIDsForUser(
+		ctx context.Context, userID, membership string,
+	) ([]string, error)
 }
 
 // RoomserverQueryAPI is an implementation of api.RoomserverQueryAPI
@@ -486,6 +491,74 @@ func (r *RoomserverQueryAPI) checkServerAllowedToSeeEvent(
 	return auth.IsServerAllowed(serverName, isServerInRoom, stateAtEvent), nil
 }
 
+// QueryUserAllowedToSeeEvents implements api.RoomserverQueryAPI
+func (r *RoomserverQueryAPI) QueryUserAllowedToSeeEvents(
+	ctx context.Context,
+	request *api.QueryUserAllowedToSeeEventsRequest,
+	response *api.QueryUserAllowedToSeeEventsResponse,
+) error {
+	response.AllowedToSeeEvents = make(map[string]bool, len(request.EventIDs))
+	events, err := r.DB.EventsFromIDs(ctx, request.EventIDs)
+	if err != nil {
+		return err
+	}
+
+	// Only the history visibility and the membership of the user are needed
+	// to decide whether the user can see an event.
+	roomState := state.NewStateResolution(r.DB)
+	stateNeeded := []gomatrixserverlib.StateKeyTuple{
+		{EventType: gomatrixserverlib.MRoomHistoryVisibility, StateKey: ""},
+		{EventType: gomatrixserverlib.MRoomMember, StateKey: request.UserID},
+	}
+	isUserInRoom := make(map[string]bool)
+	// Consecutive events in a room usually share the same state snapshot, so
+	// the state is only loaded once for each snapshot.
+	stateAtSnapshot := make(map[types.StateSnapshotNID][]gomatrixserverlib.Event)
+	for _, event := range events {
+		roomID := event.RoomID()
+		userInRoom, ok := isUserInRoom[roomID]
+		if !ok {
+			userInRoom, err = r.isUserCurrentlyInRoom(ctx, request.UserID, roomID)
+			if err != nil {
+				return err
+			}
+			isUserInRoom[roomID] = userInRoom
+		}
+
+		snapshotNID, err := r.DB.SnapshotNIDFromEventID(ctx, event.EventID())
+		if err != nil {
+			return err
+		}
+		// Outliers don't have any state stored for them, in which case the
+		// defaults apply.
+		stateAtEvent, ok := stateAtSnapshot[snapshotNID]
+		if !ok && snapshotNID != 0 {
+			stateEntries, err := roomState.LoadStateAtSnapshotForStringTuples(ctx, snapshotNID, stateNeeded)
+			if err != nil {
+				return err
+			}
+			if stateAtEvent, err = r.loadStateEvents(ctx, stateEntries); err != nil {
+				return err
+			}
+			stateAtSnapshot[snapshotNID] = stateAtEvent
+		}
+		// Users can see their own membership events as of the membership that
+		// the event gives them, so that e.g. users see their own join event
+		// in rooms where only joined users can see the history. The state is
+		// copied so that the cached state of the snapshot isn't changed.
+		if event.Type() == gomatrixserverlib.MRoomMember && event.StateKeyEquals(request.UserID) {
+			stateAtEvent = append(
+				append([]gomatrixserverlib.Event{}, stateAtEvent...), event.Event,
+			)
+		}
+
+		response.AllowedToSeeEvents[event.EventID()] = auth.IsUserAllowed(
+			request.UserID, userInRoom, stateAtEvent,
+		)
+	}
+	return nil
+}
+
 // QueryMissingEvents implements api.RoomserverQueryAPI
 func (r *RoomserverQueryAPI) QueryMissingEvents(
 	ctx context.Context,
@@ -600,6 +673,15 @@ func (r *RoomserverQueryAPI) isServerCurrentlyInRoom(ctx context.Context, server
 	return auth.IsAnyUserOnServerWithMembership(serverName, gmslEvents, gomatrixserverlib.Join), nil
 }
 
+func (r *RoomserverQueryAPI) isUserCurrentlyInRoom(ctx context.Context, userID, roomID string) (bool, error) {
+	roomNID, err := r.DB.RoomNID(ctx, roomID)
+	if err != nil {
+		return false, err
+	}
+	_, stillInRoom, err := r.DB.GetMembership(ctx, roomNID, userID)
+	return stillInRoom, err
+}
+
 // TODO: Remove this when we have tests to assert correctness of this function
 // nolint:gocyclo
 func (r *RoomserverQueryAPI) scanEventTree(
@@ -888,6 +970,24 @@ func (r *RoomserverQueryAPI) QueryRoomVersionForRoom(
 	return nil
 }
 
+// QueryRoomsForUser implements api.RoomserverQueryAPI
+func (r *RoomserverQueryAPI) QueryRoomsForUser(
+	ctx context.Context,
+	request *api.QueryRoomsForUserRequest,
+	response *api.QueryRoomsForUserResponse,
+) error {
+	membership := request.WantMembership
+	if membership == "" {
+		membership = gomatrixserverlib.Join
+	}
+	roomIDs, err := r.DB.GetRoomIDsForUser(ctx, request.UserID, membership)
+	if err != nil {
+		return err
+	}
+	response.RoomIDs = roomIDs
+	return nil
+}
+
 // SetupHTTP adds the RoomserverQueryAPI handlers to the http.ServeMux.
 // nolint: gocyclo
 func (r *RoomserverQueryAPI) SetupHTTP(servMux *http.ServeMux) {
@@ -989,6 +1089,20 @@ func (r *RoomserverQueryAPI) SetupHTTP(servMux *http.ServeMux) {
 			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
 		}),
 	)
+	servMux.Handle(
+		api.RoomserverQueryUserAllowedToSeeEventsPath,
+		common.MakeInternalAPI("queryUserAllowedToSeeEvents", func(req *http.Request) util.JSONResponse {
+			var request api.QueryUserAllowedToSeeEventsRequest
+			var response api.QueryUserAllowedToSeeEventsResponse
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				return util.ErrorResponse(err)
+			}
+			if err := r.QueryUserAllowedToSeeEvents(req.Context(), &request, &response); err != nil {
+				return util.ErrorResponse(err)
+			}
+			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
+		}),
+	)
 	servMux.Handle(
 		api.RoomserverQueryMissingEventsPath,
 		common.MakeInternalAPI("queryMissingEvents", func(req *http.Request) util.JSONResponse {
@@ -1073,4 +1187,18 @@ func (r *RoomserverQueryAPI) SetupHTTP(servMux *http.ServeMux) {
 			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
 		}),
 	)
+	servMux.Handle(
+		api.RoomserverQueryRoomsForUserPath,
+		common.MakeInternalAPI("queryRoomsForUser", func(req *http.Request) util.JSONResponse {
+			var request api.QueryRoomsForUserRequest
+			var response api.QueryRoomsForUserResponse
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				return util.ErrorResponse(err)
+			}
+			if err := r.QueryRoomsForUser(req.Context(), &request, &response); err != nil {
+				return util.ErrorResponse(err)
+			}
+			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
+		}),
+	)
 }
@@ -17,9 +17,11 @@ package query
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"testing"
 
 	"github.com/matrix-org/dendrite/common/test"
+	"github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/dendrite/roomserver/types"
 	"github.com/matrix-org/gomatrixserverlib"
 )
@@ -155,3 +157,162 @@ func TestGetAuthChainMultiple(t *testing.T) {
 		t.Fatalf("returnedIDs got '%v', expected '%v'", returnedIDs, expectedIDs)
 	}
 }
+
+// visibilityDB implements the parts of RoomserverQueryAPIDatabase that are
+// used to check whether a user is allowed to see events. Each state snapshot
+// is made of a single state block with the same numeric ID.
+type visibilityDB struct {
+	RoomserverQueryAPIDatabase
+	events     map[string]types.Event
+	snapshots  map[string]types.StateSnapshotNID
+	state      map[types.StateSnapshotNID][]types.StateEntry
+	stateLoads int
+}
+
+func (db *visibilityDB) EventsFromIDs(ctx context.Context, eventIDs []string) ([]types.Event, error) {
+	var result []types.Event
+	for _, eventID := range eventIDs {
+		if ev, ok := db.events[eventID]; ok {
+			result = append(result, ev)
+		}
+	}
+	return result, nil
+}
+
+func (db *visibilityDB) Events(ctx context.Context, eventNIDs []types.EventNID) ([]types.Event, error) {
+	var result []types.Event
+	for _, eventNID := range eventNIDs {
+		for _, ev := range db.events {
+			if ev.EventNID == eventNID {
+				result = append(result, ev)
+			}
+		}
+	}
+	return result, nil
+}
+
+func (db *visibilityDB) RoomNID(ctx context.Context, roomID string) (types.RoomNID, error) {
+	return 1, nil
+}
+
+func (db *visibilityDB) GetMembership(
+	ctx context.Context, roomNID types.RoomNID, userID string,
+) (types.EventNID, bool, error) {
+	return 0, true, nil
+}
+
+func (db *visibilityDB) SnapshotNIDFromEventID(ctx context.Context, eventID string) (types.StateSnapshotNID, error) {
+	return db.snapshots[eventID], nil
+}
+
+func (db *visibilityDB) EventTypeNIDs(ctx context.Context, eventTypes []string) (map[string]types.EventTypeNID, error) {
+	return map[string]types.EventTypeNID{
+		gomatrixserverlib.MRoomHistoryVisibility: 1,
+		gomatrixserverlib.MRoomMember:            2,
+	}, nil
+}
+
+func (db *visibilityDB) EventStateKeyNIDs(ctx context.Context, stateKeys []string) (map[string]types.EventStateKeyNID, error) {
+	return map[string]types.EventStateKeyNID{"": 1, "@alice:localhost": 2}, nil
+}
+
+func (db *visibilityDB) StateBlockNIDs(
+	ctx context.Context, stateNIDs []types.StateSnapshotNID,
+) ([]types.StateBlockNIDList, error) {
+	db.stateLoads++
+	var result []types.StateBlockNIDList
+	for _, stateNID := range stateNIDs {
+		result = append(result, types.StateBlockNIDList{
+			StateSnapshotNID: stateNID,
+			StateBlockNIDs:   []types.StateBlockNID{types.StateBlockNID(stateNID)},
+		})
+	}
+	return result, nil
+}
+
+func (db *visibilityDB) StateEntriesForTuples(
+	ctx context.Context, stateBlockNIDs []types.StateBlockNID, stateKeyTuples []types.StateKeyTuple,
+) ([]types.StateEntryList, error) {
+	var result []types.StateEntryList
+	for _, stateBlockNID := range stateBlockNIDs {
+		result = append(result, types.StateEntryList{
+			StateBlockNID: stateBlockNID,
+			StateEntries:  db.state[types.StateSnapshotNID(stateBlockNID)],
+		})
+	}
+	return result, nil
+}
+
+func (db *visibilityDB) addEvent(
+	t *testing.T, eventNID types.EventNID, eventID, eventType string, stateKey *string,
+	content string, snapshotNID types.StateSnapshotNID,
+) {
+	stateKeyJSON := ""
+	if stateKey != nil {
+		stateKeyJSON = fmt.Sprintf(`"state_key":%q,`, *stateKey)
+	}
+	eventJSON := fmt.Sprintf(
+		`{"event_id":%q,"room_id":"!room:localhost","type":%q,%s"sender":"@bob:localhost",`+
+			`"content":%s,"origin_server_ts":0,"prev_events":[],"auth_events":[],"depth":1}`,
+		eventID, eventType, stateKeyJSON, content,
+	)
+	event, err := gomatrixserverlib.NewEventFromTrustedJSON([]byte(eventJSON), false, gomatrixserverlib.RoomVersionV1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.events[eventID] = types.Event{EventNID: eventNID, Event: event}
+	db.snapshots[eventID] = snapshotNID
+}
+
+func TestQueryUserAllowedToSeeEvents(t *testing.T) {
+	const alice = "@alice:localhost"
+	db := &visibilityDB{
+		events:    make(map[string]types.Event),
+		snapshots: make(map[string]types.StateSnapshotNID),
+	}
+	// Only joined members can see the history of the room. Alice joins the
+	// room after the first two messages, which are at the first snapshot.
+	db.addEvent(t, 1, "$history_visibility", gomatrixserverlib.MRoomHistoryVisibility, new(string), `{"history_visibility":"joined"}`, 1)
+	db.addEvent(t, 2, "$message_a", "m.room.message", nil, `{"body":"a"}`, 1)
+	db.addEvent(t, 3, "$message_b", "m.room.message", nil, `{"body":"b"}`, 1)
+	aliceStateKey := alice
+	db.addEvent(t, 4, "$join", gomatrixserverlib.MRoomMember, &aliceStateKey, `{"membership":"join"}`, 1)
+	db.addEvent(t, 5, "$message_c", "m.room.message", nil, `{"body":"c"}`, 2)
+	db.addEvent(t, 6, "$message_d", "m.room.message", nil, `{"body":"d"}`, 2)
+	// Outliers have no state, so the default history visibility applies.
+	db.addEvent(t, 7, "$outlier", "m.room.message", nil, `{"body":"e"}`, 0)
+	historyVisibility := types.StateEntry{
+		StateKeyTuple: types.StateKeyTuple{EventTypeNID: 1, EventStateKeyNID: 1}, EventNID: 1,
+	}
+	db.state = map[types.StateSnapshotNID][]types.StateEntry{
+		1: {historyVisibility},
+		2: {historyVisibility, {StateKeyTuple: types.StateKeyTuple{EventTypeNID: 2, EventStateKeyNID: 2}, EventNID: 4}},
+	}
+
+	r := RoomserverQueryAPI{DB: db}
+	request := api.QueryUserAllowedToSeeEventsRequest{
+		UserID:   alice,
+		EventIDs: []string{"$message_a", "$join", "$message_b", "$message_c", "$message_d", "$outlier"},
+	}
+	var response api.QueryUserAllowedToSeeEventsResponse
+	if err := r.QueryUserAllowedToSeeEvents(context.Background(), &request, &response); err != nil {
+		t.Fatal(err)
+	}
+	for eventID, want := range map[string]bool{
+		"$message_a": false,
+		// Alice sees her own join, but that doesn't let her see the other
+		// events at the same snapshot.
+		"$join":      true,
+		"$message_b": false,
+		"$message_c": true,
+		"$message_d": true,
+		"$outlier":   true,
+	} {
+		if got := response.AllowedToSeeEvents[eventID]; got != want {
+			t.Errorf("%s: got allowed %v, want %v", eventID, got, want)
+		}
+	}
+	if db.stateLoads != 2 {
+		t.Errorf("got state loaded %d times, want once for each of the 2 snapshots", db.stateLoads)
+	}
+}
@@ -18,9 +18,11 @@ package postgres
 import (
 	"context"
 	"database/sql"
+	"fmt"
 
 	"github.com/matrix-org/dendrite/common"
 	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/gomatrixserverlib"
 )
 
 type membershipState int64
@@ -31,6 +33,21 @@ const (
 	membershipStateJoin       membershipState = 3
 )
 
+// membershipStateFromMembership returns the membership state that the given
+// membership of the m.room.member content is stored as.
+func membershipStateFromMembership(membership string) (membershipState, error) {
+	switch membership {
+	case gomatrixserverlib.Join:
+		return membershipStateJoin, nil
+	case gomatrixserverlib.Invite:
+		return membershipStateInvite, nil
+	case gomatrixserverlib.Leave, gomatrixserverlib.Ban:
+		return membershipStateLeaveOrBan, nil
+	default:
+		return 0, fmt.Errorf("unknown membership %q", membership)
+	}
+}
+
 const membershipSchema = `
 -- The membership table is used to coordinate updates between the invite table
 -- and the room state tables.
@@ -86,6 +103,12 @@ const selectMembershipForUpdateSQL = "" +
 	"SELECT membership_nid FROM roomserver_membership" +
 	" WHERE room_nid = $1 AND target_nid = $2 FOR UPDATE"
 
+const selectRoomIDsForUserWithMembershipSQL = "" +
+	"SELECT roomserver_rooms.room_id FROM roomserver_membership" +
+	" JOIN roomserver_rooms ON roomserver_membership.room_nid = roomserver_rooms.room_nid" +
+	" JOIN roomserver_event_state_keys ON roomserver_membership.target_nid = roomserver_event_state_keys.event_state_key_nid" +
+	" WHERE roomserver_event_state_keys.event_state_key = $1 AND roomserver_membership.membership_nid = $2"
+
 const updateMembershipSQL = "" +
 	"UPDATE roomserver_membership SET sender_nid = $3, membership_nid = $4, event_nid = $5" +
 	" WHERE room_nid = $1 AND target_nid = $2"
@@ -96,6 +119,7 @@ type membershipStatements struct {
 	selectMembershipFromRoomAndTargetStmt      *sql.Stmt
 	selectMembershipsFromRoomAndMembershipStmt *sql.Stmt
 	selectMembershipsFromRoomStmt              *sql.Stmt
+	selectRoomIDsForUserWithMembershipStmt     *sql.Stmt
 	updateMembershipStmt                       *sql.Stmt
 }
 
@@ -111,6 +135,7 @@ func (s *membershipStatements) prepare(db *sql.DB) (err error) {
 		{&s.selectMembershipFromRoomAndTargetStmt, selectMembershipFromRoomAndTargetSQL},
 		{&s.selectMembershipsFromRoomAndMembershipStmt, selectMembershipsFromRoomAndMembershipSQL},
 		{&s.selectMembershipsFromRoomStmt, selectMembershipsFromRoomSQL},
+		{&s.selectRoomIDsForUserWithMembershipStmt, selectRoomIDsForUserWithMembershipSQL},
 		{&s.updateMembershipStmt, updateMembershipSQL},
 	}.prepare(db)
 }
@@ -184,6 +209,27 @@ func (s *membershipStatements) selectMembershipsFromRoomAndMembership(
 	return eventNIDs, rows.Err()
 }
 
+// selectRoomIDsForUserWithMembership returns the IDs of the rooms in which the
+// user has the given membership.
+func (s *membershipStatements) selectRoomIDsForUserWithMembership(
+	ctx context.Context, userID string, membership membershipState,
+) (roomIDs []string, err error) {
+	rows, err := s.selectRoomIDsForUserWithMembershipStmt.QueryContext(ctx, userID, membership)
+	if err != nil {
+		return
+	}
+	defer common.CloseAndLogIfError(ctx, rows, "selectRoomIDsForUserWithMembership: rows.close() failed")
+
+	for rows.Next() {
+		var roomID string
+		if err = rows.Scan(&roomID); err != nil {
+			return
+		}
+		roomIDs = append(roomIDs, roomID)
+	}
+	return roomIDs, rows.Err()
+}
+
 func (s *membershipStatements) updateMembership(
 	ctx context.Context,
 	txn *sql.Tx, roomNID types.RoomNID, targetUserNID types.EventStateKeyNID,
@@ -0,0 +1,118 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/common"
+)
+
+const redactionsSchema = `
+-- Stores the redaction events that the roomserver has received along with
+-- whether they have been applied to the event that they redact. A redaction
+-- can't be applied until we have both the redaction and the redacted event.
+CREATE TABLE IF NOT EXISTS roomserver_redactions (
+    -- The event ID of the m.room.redaction event.
+    redaction_event_id TEXT NOT NULL PRIMARY KEY,
+    -- The event ID of the event that the redaction redacts.
+    redacts_event_id TEXT NOT NULL,
+    -- Whether the redaction was checked and applied to the redacted event.
+    validated BOOLEAN NOT NULL DEFAULT FALSE
+);
+CREATE INDEX IF NOT EXISTS roomserver_redactions_redacts_event_id_idx
+    ON roomserver_redactions(redacts_event_id);
+`
+
+const insertRedactionSQL = "" +
+	"INSERT INTO roomserver_redactions (redaction_event_id, redacts_event_id)" +
+	" VALUES ($1, $2)" +
+	" ON CONFLICT DO NOTHING"
+
+const selectPendingRedactionsSQL = "" +
+	"SELECT redaction_event_id FROM roomserver_redactions" +
+	" WHERE redacts_event_id = $1 AND validated = FALSE"
+
+const selectRedactionValidatedSQL = "" +
+	"SELECT validated FROM roomserver_redactions WHERE redaction_event_id = $1"
+
+const markRedactionValidatedSQL = "" +
+	"UPDATE roomserver_redactions SET validated = TRUE WHERE redaction_event_id = $1"
+
+type redactionStatements struct {
+	insertRedactionStmt          *sql.Stmt
+	selectPendingRedactionsStmt  *sql.Stmt
+	selectRedactionValidatedStmt *sql.Stmt
+	markRedactionValidatedStmt   *sql.Stmt
+}
+
+func (s *redactionStatements) prepare(db *sql.DB) (err error) {
+	_, err = db.Exec(redactionsSchema)
+	if err != nil {
+		return
+	}
+	return statementList{
+		{&s.insertRedactionStmt, insertRedactionSQL},
+		{&s.selectPendingRedactionsStmt, selectPendingRedactionsSQL},
+		{&s.selectRedactionValidatedStmt, selectRedactionValidatedSQL},
+		{&s.markRedactionValidatedStmt, markRedactionValidatedSQL},
+	}.prepare(db)
+}
+
+func (s *redactionStatements) insertRedaction(
+	ctx context.Context, redactionEventID, redactsEventID string,
+) error {
+	_, err := s.insertRedactionStmt.ExecContext(ctx, redactionEventID, redactsEventID)
+	return err
+}
+
+func (s *redactionStatements) selectPendingRedactions(
+	ctx context.Context, redactsEventID string,
+) ([]string, error) {
+	rows, err := s.selectPendingRedactionsStmt.QueryContext(ctx, redactsEventID)
+	if err != nil {
+		return nil, err
+	}
+	defer common.CloseAndLogIfError(ctx, rows, "selectPendingRedactions: rows.close() failed")
+
+	var redactionEventIDs []string
+	for rows.Next() {
+		var redactionEventID string
+		if err = rows.Scan(&redactionEventID); err != nil {
+			return nil, err
+		}
+		redactionEventIDs = append(redactionEventIDs, redactionEventID)
+	}
+	return redactionEventIDs, rows.Err()
+}
+
+// selectRedactionValidated returns whether the redaction was applied to the
+// event it redacts. Returns sql.ErrNoRows if there is no such redaction.
+func (s *redactionStatements) selectRedactionValidated(
+	ctx context.Context, txn *sql.Tx, redactionEventID string,
+) (validated bool, err error) {
+	stmt := common.TxStmt(txn, s.selectRedactionValidatedStmt)
+	err = stmt.QueryRowContext(ctx, redactionEventID).Scan(&validated)
+	return
+}
+
+func (s *redactionStatements) markRedactionValidated(
+	ctx context.Context, txn *sql.Tx, redactionEventID string,
+) error {
+	stmt := common.TxStmt(txn, s.markRedactionValidatedStmt)
+	_, err := stmt.ExecContext(ctx, redactionEventID)
+	return err
+}
@@ -20,10 +20,9 @@ import (
 	"database/sql"
 	"encoding/json"
 
-	roomserverVersion "github.com/matrix-org/dendrite/roomserver/version"
-
 	// Import the postgres database driver.
 	_ "github.com/lib/pq"
+	"github.com/matrix-org/dendrite/common"
 	"github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/dendrite/roomserver/types"
 	"github.com/matrix-org/gomatrixserverlib"
@@ -50,7 +49,7 @@ func Open(dataSourceName string) (*Database, error) {
 
 // StoreEvent implements input.EventDatabase
 func (d *Database) StoreEvent(
-	ctx context.Context, event gomatrixserverlib.Event,
+	ctx context.Context, event gomatrixserverlib.Event, roomVersion gomatrixserverlib.RoomVersion,
 	txnAndSessionID *api.TransactionID, authEventNIDs []types.EventNID,
 ) (types.RoomNID, types.StateAtEvent, error) {
 	var (
@@ -74,15 +73,13 @@ func (d *Database) StoreEvent(
 	// TODO: Here we should aim to have two different code paths for new rooms
 	// vs existing ones.
 
-	// Get the default room version. If the client doesn't supply a room_version
-	// then we will use our configured default to create the room.
-	// https://matrix.org/docs/spec/client_server/r0.6.0#post-matrix-client-r0-createroom
-	// Note that the below logic depends on the m.room.create event being the
-	// first event that is persisted to the database when creating or joining a
-	// room.
-	var roomVersion gomatrixserverlib.RoomVersion
-	if roomVersion, err = extractRoomVersionFromCreateEvent(event); err != nil {
-		return 0, types.StateAtEvent{}, err
+	// The room version is only used if this is the first event that we store
+	// for the room. The m.room.create event says which version the room is,
+	// otherwise we trust the version that the event was sent to us with.
+	if event.Type() == gomatrixserverlib.MRoomCreate {
+		if roomVersion, err = extractRoomVersionFromCreateEvent(event); err != nil {
+			return 0, types.StateAtEvent{}, err
+		}
 	}
 
 	if roomNID, err = d.assignRoomNID(ctx, nil, event.RoomID(), roomVersion); err != nil {
@@ -146,7 +143,9 @@ func extractRoomVersionFromCreateEvent(event gomatrixserverlib.Event) (
 	if event.Type() != gomatrixserverlib.MRoomCreate {
 		return gomatrixserverlib.RoomVersion(""), nil
 	}
-	roomVersion = roomserverVersion.DefaultRoomVersion()
+	// The room version defaults to "1" if the create event doesn't name one.
+	// https://matrix.org/docs/spec/client_server/r0.6.0#m-room-create
+	roomVersion = gomatrixserverlib.RoomVersionV1
 	var createContent gomatrixserverlib.CreateContent
 	// The m.room.create event contains an optional "room_version" key in
 	// the event content, so we need to unmarshal that first.
@@ -456,6 +455,42 @@ func (u *roomRecentEventsUpdater) MembershipUpdater(targetUserNID types.EventSta
 	return u.d.membershipUpdaterTxn(u.ctx, u.txn, u.roomNID, targetUserNID)
 }
 
+// StoreRedaction implements input.RoomEventDatabase
+func (d *Database) StoreRedaction(
+	ctx context.Context, redactionEventID, redactsEventID string,
+) error {
+	return d.statements.insertRedaction(ctx, redactionEventID, redactsEventID)
+}
+
+// PendingRedactions implements input.RoomEventDatabase
+func (d *Database) PendingRedactions(
+	ctx context.Context, redactsEventID string,
+) ([]string, error) {
+	return d.statements.selectPendingRedactions(ctx, redactsEventID)
+}
+
+// RedactEvent implements input.RoomEventDatabase
+func (d *Database) RedactEvent(
+	ctx context.Context, redactionEventID string,
+	eventNID types.EventNID, redactedEvent gomatrixserverlib.Event,
+) (applied bool, err error) {
+	err = common.WithTransaction(d.db, func(txn *sql.Tx) error {
+		validated, err := d.statements.selectRedactionValidated(ctx, txn, redactionEventID)
+		if err != nil || validated {
+			return err
+		}
+		if err = d.statements.updateEventJSON(ctx, txn, eventNID, redactedEvent.JSON()); err != nil {
+			return err
+		}
+		if err = d.statements.markRedactionValidated(ctx, txn, redactionEventID); err != nil {
+			return err
+		}
+		applied = true
+		return nil
+	})
+	return
+}
+
 // RoomNID implements query.RoomserverQueryAPIDB
 func (d *Database) RoomNID(ctx context.Context, roomID string) (types.RoomNID, error) {
 	roomNID, err := d.statements.selectRoomNID(ctx, nil, roomID)
@@ -534,6 +569,7 @@ func (d *Database) StateEntriesForTuples(
 // MembershipUpdater implements input.RoomEventDatabase
 func (d *Database) MembershipUpdater(
 	ctx context.Context, roomID, targetUserID string,
+	roomVersion gomatrixserverlib.RoomVersion,
 ) (types.MembershipUpdater, error) {
 	txn, err := d.db.Begin()
 	if err != nil {
@@ -546,8 +582,7 @@ func (d *Database) MembershipUpdater(
 		}
 	}()
 
-	// TODO: Room version here
-	roomNID, err := d.assignRoomNID(ctx, txn, roomID, "1")
+	roomNID, err := d.assignRoomNID(ctx, txn, roomID, roomVersion)
 	if err != nil {
 		return nil, err
 	}
@@ -735,6 +770,17 @@ func (d *Database) GetMembershipEventNIDsForRoom(
 	return d.statements.selectMembershipsFromRoom(ctx, roomNID)
 }
 
+// GetRoomIDsForUser implements query.RoomserverQueryAPIDB
+func (d *Database) GetRoomIDsForUser(
+	ctx context.Context, userID, membership string,
+) ([]string, error) {
+	state, err := membershipStateFromMembership(membership)
+	if err != nil {
+		return nil, err
+	}
+	return d.statements.selectRoomIDsForUserWithMembership(ctx, userID, state)
+}
+
 // EventsFromIDs implements query.RoomserverQueryAPIEventDB
 func (d *Database) EventsFromIDs(ctx context.Context, eventIDs []string) ([]types.Event, error) {
 	nidMap, err := d.EventNIDs(ctx, eventIDs)
@@ -36,6 +36,10 @@ const insertEventJSONSQL = `
 	  ON CONFLICT DO NOTHING
 `
 
+const updateEventJSONSQL = `
+	UPDATE roomserver_event_json SET event_json = $2 WHERE event_nid = $1
+`
+
 // Bulk event JSON lookup by numeric event ID.
 // Sort by the numeric event ID.
 // This means that we can use binary search to lookup by numeric event ID.
@@ -48,6 +52,7 @@ const bulkSelectEventJSONSQL = `
 type eventJSONStatements struct {
 	db                      *sql.DB
 	insertEventJSONStmt     *sql.Stmt
+	updateEventJSONStmt     *sql.Stmt
 	bulkSelectEventJSONStmt *sql.Stmt
 }
 
@@ -59,6 +64,7 @@ func (s *eventJSONStatements) prepare(db *sql.DB) (err error) {
 	}
 	return statementList{
 		{&s.insertEventJSONStmt, insertEventJSONSQL},
+		{&s.updateEventJSONStmt, updateEventJSONSQL},
 		{&s.bulkSelectEventJSONStmt, bulkSelectEventJSONSQL},
 	}.prepare(db)
 }
@@ -70,6 +76,15 @@ func (s *eventJSONStatements) insertEventJSON(
 	return err
 }
 
+// updateEventJSON replaces the JSON of an event, which is done when the event
+// gets redacted.
+func (s *eventJSONStatements) updateEventJSON(
+	ctx context.Context, txn *sql.Tx, eventNID types.EventNID, eventJSON []byte,
+) error {
+	_, err := common.TxStmt(txn, s.updateEventJSONStmt).ExecContext(ctx, int64(eventNID), eventJSON)
+	return err
+}
+
 type eventJSONPair struct {
 	EventNID  types.EventNID
 	EventJSON []byte
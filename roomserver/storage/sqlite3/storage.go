@@ -22,8 +22,6 @@ import (
 	"errors"
 	"net/url"
 
-	roomserverVersion "github.com/matrix-org/dendrite/roomserver/version"
-
 	"github.com/matrix-org/dendrite/common"
 	"github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/dendrite/roomserver/types"
@@ -71,7 +69,7 @@ func Open(dataSourceName string) (*Database, error) {
 
 // StoreEvent implements input.EventDatabase
 func (d *Database) StoreEvent(
-	ctx context.Context, event gomatrixserverlib.Event,
+	ctx context.Context, event gomatrixserverlib.Event, roomVersion gomatrixserverlib.RoomVersion,
 	txnAndSessionID *api.TransactionID, authEventNIDs []types.EventNID,
 ) (types.RoomNID, types.StateAtEvent, error) {
 	var (
@@ -96,15 +94,13 @@ func (d *Database) StoreEvent(
 		// TODO: Here we should aim to have two different code paths for new rooms
 		// vs existing ones.
 
-		// Get the default room version. If the client doesn't supply a room_version
-		// then we will use our configured default to create the room.
-		// https://matrix.org/docs/spec/client_server/r0.6.0#post-matrix-client-r0-createroom
-		// Note that the below logic depends on the m.room.create event being the
-		// first event that is persisted to the database when creating or joining a
-		// room.
-		var roomVersion gomatrixserverlib.RoomVersion
-		if roomVersion, err = extractRoomVersionFromCreateEvent(event); err != nil {
-			return err
+		// The room version is only used if this is the first event that we store
+		// for the room. The m.room.create event says which version the room is,
+		// otherwise we trust the version that the event was sent to us with.
+		if event.Type() == gomatrixserverlib.MRoomCreate {
+			if roomVersion, err = extractRoomVersionFromCreateEvent(event); err != nil {
+				return err
+			}
 		}
 
 		if roomNID, err = d.assignRoomNID(ctx, txn, event.RoomID(), roomVersion); err != nil {
@@ -175,7 +171,9 @@ func extractRoomVersionFromCreateEvent(event gomatrixserverlib.Event) (
 	if event.Type() != gomatrixserverlib.MRoomCreate {
 		return gomatrixserverlib.RoomVersion(""), nil
 	}
-	roomVersion = roomserverVersion.DefaultRoomVersion()
+	// The room version defaults to "1" if the create event doesn't name one.
+	// https://matrix.org/docs/spec/client_server/r0.6.0#m-room-create
+	roomVersion = gomatrixserverlib.RoomVersionV1
 	var createContent gomatrixserverlib.CreateContent
 	// The m.room.create event contains an optional "room_version" key in
 	// the event content, so we need to unmarshal that first.
@@ -323,7 +321,7 @@ func (d *Database) Events(
 				eventJSON.EventJSON, false, roomVersion,
 			)
 			if err != nil {
-				return nil
+				return err
 			}
 		}
 		return nil
@@ -571,6 +569,49 @@ func (u *roomRecentEventsUpdater) MembershipUpdater(targetUserNID types.EventSta
 	return
 }
 
+// StoreRedaction implements input.RoomEventDatabase
+func (d *Database) StoreRedaction(
+	ctx context.Context, redactionEventID, redactsEventID string,
+) error {
+	return common.WithTransaction(d.db, func(txn *sql.Tx) error {
+		return d.statements.insertRedaction(ctx, txn, redactionEventID, redactsEventID)
+	})
+}
+
+// PendingRedactions implements input.RoomEventDatabase
+func (d *Database) PendingRedactions(
+	ctx context.Context, redactsEventID string,
+) ([]string, error) {
+	var redactionEventIDs []string
+	err := common.WithTransaction(d.db, func(txn *sql.Tx) (err error) {
+		redactionEventIDs, err = d.statements.selectPendingRedactions(ctx, txn, redactsEventID)
+		return
+	})
+	return redactionEventIDs, err
+}
+
+// RedactEvent implements input.RoomEventDatabase
+func (d *Database) RedactEvent(
+	ctx context.Context, redactionEventID string,
+	eventNID types.EventNID, redactedEvent gomatrixserverlib.Event,
+) (applied bool, err error) {
+	err = common.WithTransaction(d.db, func(txn *sql.Tx) error {
+		validated, err := d.statements.selectRedactionValidated(ctx, txn, redactionEventID)
+		if err != nil || validated {
+			return err
+		}
+		if err = d.statements.updateEventJSON(ctx, txn, eventNID, redactedEvent.JSON()); err != nil {
+			return err
+		}
+		if err = d.statements.markRedactionValidated(ctx, txn, redactionEventID); err != nil {
+			return err
+		}
+		applied = true
+		return nil
+	})
+	return
+}
+
 // RoomNID implements query.RoomserverQueryAPIDB
 func (d *Database) RoomNID(ctx context.Context, roomID string) (roomNID types.RoomNID, err error) {
 	err = common.WithTransaction(d.db, func(txn *sql.Tx) error {
@@ -657,6 +698,7 @@ func (d *Database) StateEntriesForTuples(
 // MembershipUpdater implements input.RoomEventDatabase
 func (d *Database) MembershipUpdater(
 	ctx context.Context, roomID, targetUserID string,
+	roomVersion gomatrixserverlib.RoomVersion,
 ) (updater types.MembershipUpdater, err error) {
 	var txn *sql.Tx
 	txn, err = d.db.Begin()
@@ -682,8 +724,7 @@ func (d *Database) MembershipUpdater(
 		}
 	}()
 
-	// TODO: Room version here
-	roomNID, err := d.assignRoomNID(ctx, txn, roomID, "1")
+	roomNID, err := d.assignRoomNID(ctx, txn, roomID, roomVersion)
 	if err != nil {
 		return nil, err
 	}
@@ -889,6 +930,21 @@ func (d *Database) GetMembershipEventNIDsForRoom(
 	return
 }
 
+// GetRoomIDsForUser implements query.RoomserverQueryAPIDB
+func (d *Database) GetRoomIDsForUser(
+	ctx context.Context, userID, membership string,
+) (roomIDs []string, err error) {
+	state, err := membershipStateFromMembership(membership)
+	if err != nil {
+		return nil, err
+	}
+	err = common.WithTransaction(d.db, func(txn *sql.Tx) error {
+		roomIDs, err = d.statements.selectRoomIDsForUserWithMembership(ctx, txn, userID, state)
+		return err
+	})
+	return
+}
+
 // EventsFromIDs implements query.RoomserverQueryAPIEventDB
 func (d *Database) EventsFromIDs(ctx context.Context, eventIDs []string) ([]types.Event, error) {
 	nidMap, err := d.EventNIDs(ctx, eventIDs)
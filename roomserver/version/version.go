@@ -43,16 +43,16 @@ var roomVersions = map[gomatrixserverlib.RoomVersion]RoomVersionDescription{
 		Stable:    true,
 	},
 	gomatrixserverlib.RoomVersionV3: RoomVersionDescription{
-		Supported: false,
-		Stable:    false,
+		Supported: true,
+		Stable:    true,
 	},
 	gomatrixserverlib.RoomVersionV4: RoomVersionDescription{
-		Supported: false,
-		Stable:    false,
+		Supported: true,
+		Stable:    true,
 	},
 	gomatrixserverlib.RoomVersionV5: RoomVersionDescription{
-		Supported: false,
-		Stable:    false,
+		Supported: true,
+		Stable:    true,
 	},
 }
 
@@ -0,0 +1,93 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumers
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/dendrite/keyserver/api"
+	"github.com/matrix-org/dendrite/syncapi/storage"
+	"github.com/matrix-org/dendrite/syncapi/sync"
+	"github.com/matrix-org/dendrite/syncapi/types"
+	log "github.com/sirupsen/logrus"
+	sarama "gopkg.in/Shopify/sarama.v1"
+)
+
+// OutputKeyChangeEventConsumer consumes device key changes that originated in
+// the key server.
+type OutputKeyChangeEventConsumer struct {
+	keyChangeConsumer *common.ContinualConsumer
+	db                storage.Database
+	notifier          *sync.Notifier
+}
+
+// NewOutputKeyChangeEventConsumer creates a new OutputKeyChangeEventConsumer.
+// Call Start() to begin consuming from the key server.
+func NewOutputKeyChangeEventConsumer(
+	cfg *config.Dendrite,
+	kafkaConsumer sarama.Consumer,
+	n *sync.Notifier,
+	store storage.Database,
+) *OutputKeyChangeEventConsumer {
+
+	consumer := common.ContinualConsumer{
+		Topic:          string(cfg.Kafka.Topics.OutputKeyChangeEvent),
+		Consumer:       kafkaConsumer,
+		PartitionStore: store,
+	}
+
+	s := &OutputKeyChangeEventConsumer{
+		keyChangeConsumer: &consumer,
+		db:                store,
+		notifier:          n,
+	}
+
+	consumer.ProcessMessage = s.onMessage
+
+	return s
+}
+
+// Start consuming from key server
+func (s *OutputKeyChangeEventConsumer) Start() error {
+	return s.keyChangeConsumer.Start()
+}
+
+func (s *OutputKeyChangeEventConsumer) onMessage(msg *sarama.ConsumerMessage) error {
+	var output api.OutputKeyChangeEvent
+	if err := json.Unmarshal(msg.Value, &output); err != nil {
+		// If the message was invalid, log it and move on to the next message in the stream
+		log.WithError(err).Errorf("key server output log: message parse failure")
+		return nil
+	}
+
+	log.WithFields(log.Fields{
+		"user_id":   output.UserID,
+		"device_id": output.DeviceID,
+	}).Debug("received data from key server")
+
+	pos, err := s.db.AddKeyChange(context.TODO(), output.UserID)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"user_id":    output.UserID,
+			log.ErrorKey: err,
+		}).Panicf("could not save key change")
+	}
+
+	s.notifier.OnNewKeyChange(types.PaginationToken{DeviceListPosition: pos}, output.UserID)
+	return nil
+}
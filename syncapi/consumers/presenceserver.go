@@ -0,0 +1,98 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumers
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/dendrite/presenceserver/api"
+	"github.com/matrix-org/dendrite/syncapi/storage"
+	"github.com/matrix-org/dendrite/syncapi/sync"
+	"github.com/matrix-org/dendrite/syncapi/types"
+	log "github.com/sirupsen/logrus"
+	sarama "gopkg.in/Shopify/sarama.v1"
+)
+
+// OutputPresenceEventConsumer consumes events that originated in the presence server.
+type OutputPresenceEventConsumer struct {
+	presenceConsumer *common.ContinualConsumer
+	db               storage.Database
+	notifier         *sync.Notifier
+}
+
+// NewOutputPresenceEventConsumer creates a new OutputPresenceEventConsumer.
+// Call Start() to begin consuming from the presence server.
+func NewOutputPresenceEventConsumer(
+	cfg *config.Dendrite,
+	kafkaConsumer sarama.Consumer,
+	n *sync.Notifier,
+	store storage.Database,
+) *OutputPresenceEventConsumer {
+
+	consumer := common.ContinualConsumer{
+		Topic:          string(cfg.Kafka.Topics.OutputPresenceEvent),
+		Consumer:       kafkaConsumer,
+		PartitionStore: store,
+	}
+
+	s := &OutputPresenceEventConsumer{
+		presenceConsumer: &consumer,
+		db:               store,
+		notifier:         n,
+	}
+
+	consumer.ProcessMessage = s.onMessage
+
+	return s
+}
+
+// Start consuming from presence server
+func (s *OutputPresenceEventConsumer) Start() error {
+	return s.presenceConsumer.Start()
+}
+
+func (s *OutputPresenceEventConsumer) onMessage(msg *sarama.ConsumerMessage) error {
+	var output api.OutputPresenceEvent
+	if err := json.Unmarshal(msg.Value, &output); err != nil {
+		// If the message was invalid, log it and move on to the next message in the stream
+		log.WithError(err).Errorf("presence server output log: message parse failure")
+		return nil
+	}
+
+	log.WithFields(log.Fields{
+		"user_id":  output.UserID,
+		"presence": output.Presence,
+	}).Debug("received data from presence server")
+
+	pos, err := s.db.UpsertPresence(context.TODO(), types.Presence{
+		UserID:          output.UserID,
+		Presence:        output.Presence,
+		StatusMsg:       output.StatusMsg,
+		LastActiveTS:    output.LastActiveTS,
+		CurrentlyActive: output.CurrentlyActive,
+	})
+	if err != nil {
+		log.WithFields(log.Fields{
+			"user_id":    output.UserID,
+			log.ErrorKey: err,
+		}).Panicf("could not save presence")
+	}
+
+	s.notifier.OnNewPresence(types.PaginationToken{EDUPresencePosition: pos}, output.UserID)
+	return nil
+}
@@ -87,6 +87,8 @@ func (s *OutputRoomEventConsumer) onMessage(msg *sarama.ConsumerMessage) error {
 		return s.onNewInviteEvent(context.TODO(), *output.NewInviteEvent)
 	case api.OutputTypeRetireInviteEvent:
 		return s.onRetireInviteEvent(context.TODO(), *output.RetireInviteEvent)
+	case api.OutputTypeRedactedEvent:
+		return s.onRedactedEvent(context.TODO(), *output.RedactedEvent)
 	default:
 		log.WithField("type", output.Type).Debug(
 			"roomserver output log: ignoring unknown output type",
@@ -146,14 +148,61 @@ func (s *OutputRoomEventConsumer) onNewRoomEvent(
 		}).Panicf("roomserver output log: write event failure")
 		return nil
 	}
+
+	if err = s.indexEventForSearch(ctx, &ev, pduPos); err != nil {
+		// The event is only missing from search results, so carry on.
+		log.WithFields(log.Fields{
+			"event_id":   ev.EventID(),
+			log.ErrorKey: err,
+		}).Error("roomserver output log: failed to index event for search")
+	}
+
 	s.notifier.OnNewEvent(&ev, "", nil, types.PaginationToken{PDUPosition: pduPos})
 
 	return nil
 }
 
+// searchableContentKeys maps the types of the events whose content can be
+// found with /search to the content key that is indexed.
+var searchableContentKeys = map[string]string{
+	"m.room.message": "body",
+	"m.room.name":    "name",
+	"m.room.topic":   "topic",
+}
+
+// indexEventForSearch adds the searchable content of an event, if it has any,
+// to the full-text search index.
+func (s *OutputRoomEventConsumer) indexEventForSearch(
+	ctx context.Context, ev *gomatrixserverlib.HeaderedEvent, pduPos types.StreamPosition,
+) error {
+	key, ok := searchableContentKeys[ev.Type()]
+	if !ok || pduPos == 0 {
+		return nil
+	}
+	var content map[string]interface{}
+	if err := json.Unmarshal(ev.Content(), &content); err != nil {
+		return err
+	}
+	value, ok := content[key].(string)
+	if !ok || value == "" {
+		return nil
+	}
+	return s.db.IndexEventForSearch(ctx, ev.EventID(), ev.RoomID(), "content."+key, value, pduPos)
+}
+
 func (s *OutputRoomEventConsumer) onNewInviteEvent(
 	ctx context.Context, msg api.OutputNewInviteEvent,
 ) error {
+	// The invite room state is kept in the unsigned data of the invite, as
+	// it is when invites are sent over federation.
+	if msg.InviteRoomState != nil {
+		if err := msg.Event.SetUnsignedField("invite_room_state", msg.InviteRoomState); err != nil {
+			log.WithFields(log.Fields{
+				"event_id":   msg.Event.EventID(),
+				log.ErrorKey: err,
+			}).Error("roomserver output log: failed to set invite room state")
+		}
+	}
 	pduPos, err := s.db.AddInviteEvent(ctx, msg.Event)
 	if err != nil {
 		// panic rather than continue with an inconsistent database
@@ -164,14 +213,14 @@ func (s *OutputRoomEventConsumer) onNewInviteEvent(
 		}).Panicf("roomserver output log: write invite failure")
 		return nil
 	}
-	s.notifier.OnNewEvent(&msg.Event, "", nil, types.PaginationToken{PDUPosition: pduPos})
+	s.notifier.OnNewEvent(&msg.Event, "", nil, types.PaginationToken{InvitePosition: pduPos})
 	return nil
 }
 
 func (s *OutputRoomEventConsumer) onRetireInviteEvent(
 	ctx context.Context, msg api.OutputRetireInviteEvent,
 ) error {
-	err := s.db.RetireInviteEvent(ctx, msg.EventID)
+	pos, err := s.db.RetireInviteEvent(ctx, msg.EventID)
 	if err != nil {
 		// panic rather than continue with an inconsistent database
 		log.WithFields(log.Fields{
@@ -180,8 +229,26 @@ func (s *OutputRoomEventConsumer) onRetireInviteEvent(
 		}).Panicf("roomserver output log: remove invite failure")
 		return nil
 	}
-	// TODO: Notify any active sync requests that the invite has been retired.
-	// s.notifier.OnNewEvent(nil, msg.TargetUserID, syncStreamPos)
+	if pos != 0 {
+		s.notifier.OnNewEvent(nil, "", []string{msg.TargetUserID}, types.PaginationToken{InvitePosition: pos})
+	}
+	return nil
+}
+
+func (s *OutputRoomEventConsumer) onRedactedEvent(
+	ctx context.Context, msg api.OutputRedactedEvent,
+) error {
+	err := s.db.RedactEvent(ctx, msg.RedactedEventID, &msg.RedactedBecause)
+	if err != nil {
+		// panic rather than continue with an inconsistent database
+		log.WithFields(log.Fields{
+			"event_id":   msg.RedactedEventID,
+			log.ErrorKey: err,
+		}).Panicf("roomserver output log: redact event failure")
+		return nil
+	}
+	// Clients learn about the redaction from the redaction event itself, which
+	// already went down the sync stream, so there is nothing to notify here.
 	return nil
 }
 
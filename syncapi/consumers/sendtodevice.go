@@ -0,0 +1,148 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumers
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/devices"
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/dendrite/syncapi/storage"
+	"github.com/matrix-org/dendrite/syncapi/sync"
+	"github.com/matrix-org/dendrite/syncapi/types"
+	"github.com/matrix-org/gomatrixserverlib"
+	log "github.com/sirupsen/logrus"
+	sarama "gopkg.in/Shopify/sarama.v1"
+)
+
+// OutputSendToDeviceEventConsumer consumes send-to-device messages that
+// originated in the client API or came in over federation.
+type OutputSendToDeviceEventConsumer struct {
+	sendToDeviceConsumer *common.ContinualConsumer
+	db                   storage.Database
+	deviceDB             devices.Database
+	notifier             *sync.Notifier
+	serverName           gomatrixserverlib.ServerName
+}
+
+// NewOutputSendToDeviceEventConsumer creates a new OutputSendToDeviceEventConsumer.
+// Call Start() to begin consuming send-to-device messages.
+func NewOutputSendToDeviceEventConsumer(
+	cfg *config.Dendrite,
+	kafkaConsumer sarama.Consumer,
+	n *sync.Notifier,
+	store storage.Database,
+	deviceDB devices.Database,
+) *OutputSendToDeviceEventConsumer {
+
+	consumer := common.ContinualConsumer{
+		Topic:          string(cfg.Kafka.Topics.OutputSendToDeviceEvent),
+		Consumer:       kafkaConsumer,
+		PartitionStore: store,
+	}
+
+	s := &OutputSendToDeviceEventConsumer{
+		sendToDeviceConsumer: &consumer,
+		db:                   store,
+		deviceDB:             deviceDB,
+		notifier:             n,
+		serverName:           cfg.Matrix.ServerName,
+	}
+
+	consumer.ProcessMessage = s.onMessage
+
+	return s
+}
+
+// Start consuming send-to-device messages
+func (s *OutputSendToDeviceEventConsumer) Start() error {
+	return s.sendToDeviceConsumer.Start()
+}
+
+func (s *OutputSendToDeviceEventConsumer) onMessage(msg *sarama.ConsumerMessage) error {
+	var output common.SendToDevice
+	if err := json.Unmarshal(msg.Value, &output); err != nil {
+		// If the message was invalid, log it and move on to the next message in the stream
+		log.WithError(err).Errorf("send-to-device output log: message parse failure")
+		return nil
+	}
+
+	log.WithFields(log.Fields{
+		"sender":     output.Sender,
+		"type":       output.Type,
+		"message_id": output.MessageID,
+	}).Debug("received send-to-device messages")
+
+	ctx := context.TODO()
+	for userID, messages := range output.Messages {
+		localpart, domain, err := gomatrixserverlib.SplitID('@', userID)
+		if err != nil {
+			log.WithError(err).WithField("user_id", userID).Error("send-to-device output log: invalid user ID")
+			continue
+		}
+		// Messages for remote users are relayed by the federation sender.
+		if domain != s.serverName {
+			continue
+		}
+
+		var latestPos types.StreamPosition
+		for deviceID, content := range messages {
+			deviceIDs := []string{deviceID}
+			if deviceID == "*" {
+				if deviceIDs, err = s.allDeviceIDs(ctx, localpart); err != nil {
+					return err
+				}
+			}
+			event := types.SendToDeviceEvent{
+				Sender:  output.Sender,
+				Type:    output.Type,
+				Content: content,
+			}
+			for _, id := range deviceIDs {
+				pos, err := s.db.AddSendToDeviceEvent(ctx, userID, id, event)
+				if err != nil {
+					log.WithFields(log.Fields{
+						"user_id":    userID,
+						"device_id":  id,
+						log.ErrorKey: err,
+					}).Panicf("could not save send-to-device message")
+				}
+				latestPos = pos
+			}
+		}
+
+		if latestPos != 0 {
+			s.notifier.OnNewEvent(nil, "", []string{userID}, types.PaginationToken{SendToDevicePosition: latestPos})
+		}
+	}
+	return nil
+}
+
+// allDeviceIDs returns the IDs of all of the devices of a local user.
+func (s *OutputSendToDeviceEventConsumer) allDeviceIDs(
+	ctx context.Context, localpart string,
+) ([]string, error) {
+	userDevices, err := s.deviceDB.GetDevicesByLocalpart(ctx, localpart)
+	if err != nil {
+		return nil, err
+	}
+	deviceIDs := make([]string, 0, len(userDevices))
+	for _, device := range userDevices {
+		deviceIDs = append(deviceIDs, device.ID)
+	}
+	return deviceIDs, nil
+}
@@ -0,0 +1,205 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"database/sql"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/syncapi/storage"
+	"github.com/matrix-org/dendrite/syncapi/sync"
+	"github.com/matrix-org/dendrite/syncapi/types"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+type contextResponse struct {
+	Start        string                          `json:"start"`
+	End          string                          `json:"end"`
+	Event        gomatrixserverlib.ClientEvent   `json:"event"`
+	EventsBefore []gomatrixserverlib.ClientEvent `json:"events_before"`
+	EventsAfter  []gomatrixserverlib.ClientEvent `json:"events_after"`
+	State        []gomatrixserverlib.ClientEvent `json:"state"`
+}
+
+const (
+	defaultContextLimit = 10
+	maxContextLimit     = 100
+)
+
+// OnIncomingContextRequest implements GET /rooms/{roomID}/context/{eventID}.
+// It returns the events that happened just before and after the given event,
+// along with the state of the room at the last of these events. The "start"
+// and "end" tokens can be given to /messages to paginate further backwards
+// and forwards.
+func OnIncomingContextRequest(
+	req *http.Request, device *authtypes.Device, db storage.Database,
+	queryAPI api.RoomserverQueryAPI, roomID, eventID string,
+) util.JSONResponse {
+	limit := defaultContextLimit
+	if s := req.URL.Query().Get("limit"); s != "" {
+		var err error
+		if limit, err = strconv.Atoi(s); err != nil || limit < 0 {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue("limit must be a non-negative integer"),
+			}
+		}
+		if limit > maxContextLimit {
+			limit = maxContextLimit
+		}
+	}
+
+	notFound := util.JSONResponse{
+		Code: http.StatusNotFound,
+		JSON: jsonerror.NotFound("Event not found"),
+	}
+	events, err := db.Events(req.Context(), []string{eventID})
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("db.Events failed")
+		return jsonerror.InternalServerError()
+	}
+	if len(events) == 0 || events[0].RoomID() != roomID {
+		return notFound
+	}
+	event := events[0]
+
+	// Events that the user isn't allowed to see are reported as missing so
+	// that their existence isn't disclosed.
+	visible, err := sync.VisibleEventIDs(req.Context(), queryAPI, device.UserID, []string{eventID})
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("sync.VisibleEventIDs failed")
+		return jsonerror.InternalServerError()
+	}
+	if !visible[eventID] {
+		return notFound
+	}
+
+	pos, err := db.EventPositionInTopology(req.Context(), eventID)
+	if err == sql.ErrNoRows {
+		return notFound
+	}
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("db.EventPositionInTopology failed")
+		return jsonerror.InternalServerError()
+	}
+	maxPos, err := db.MaxTopologicalPosition(req.Context(), roomID)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("db.MaxTopologicalPosition failed")
+		return jsonerror.InternalServerError()
+	}
+
+	// The limit is shared between the events before and after the event, as
+	// the request doesn't say how to split it.
+	beforeLimit := limit / 2
+	afterLimit := limit - beforeLimit
+
+	// A topological token refers to the position just after an event, so
+	// going backwards from the event starts at the position before it.
+	before, err := db.GetEventsInRange(
+		req.Context(),
+		types.NewPaginationTokenFromTypeAndPosition(types.PaginationTokenTypeTopology, pos-1, 0),
+		types.NewPaginationTokenFromTypeAndPosition(types.PaginationTokenTypeTopology, 0, 0),
+		roomID, beforeLimit, true,
+	)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("db.GetEventsInRange failed")
+		return jsonerror.InternalServerError()
+	}
+	after, err := db.GetEventsInRange(
+		req.Context(),
+		types.NewPaginationTokenFromTypeAndPosition(types.PaginationTokenTypeTopology, pos, 0),
+		types.NewPaginationTokenFromTypeAndPosition(types.PaginationTokenTypeTopology, maxPos, 0),
+		roomID, afterLimit, false,
+	)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("db.GetEventsInRange failed")
+		return jsonerror.InternalServerError()
+	}
+	beforeEvents := db.StreamEventsToEvents(nil, before)
+	afterEvents := db.StreamEventsToEvents(nil, after)
+	// The events aren't returned in order from the topology, so sort them
+	// like /messages does: events_before from the most recent one, and
+	// events_after from the oldest one.
+	sort.SliceStable(beforeEvents, func(i, j int) bool {
+		return sortEvents(&beforeEvents[j], &beforeEvents[i])
+	})
+	sort.SliceStable(afterEvents, func(i, j int) bool {
+		return sortEvents(&afterEvents[i], &afterEvents[j])
+	})
+
+	// The tokens are computed from all of the events that we retrieved, even
+	// the hidden ones, so that the client doesn't get them when paginating.
+	// Like in /messages, the token going backwards refers to the position
+	// just before the oldest event.
+	startPos, endPos := pos-1, pos
+	if len(beforeEvents) > 0 {
+		oldestPos, err := db.EventPositionInTopology(req.Context(), beforeEvents[len(beforeEvents)-1].EventID())
+		if err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("db.EventPositionInTopology failed")
+			return jsonerror.InternalServerError()
+		}
+		startPos = oldestPos - 1
+	}
+	if len(afterEvents) > 0 {
+		if endPos, err = db.EventPositionInTopology(req.Context(), afterEvents[len(afterEvents)-1].EventID()); err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("db.EventPositionInTopology failed")
+			return jsonerror.InternalServerError()
+		}
+	}
+	if startPos < 0 {
+		startPos = 0
+	}
+
+	visibleBefore, err := sync.FilterVisibleEvents(req.Context(), queryAPI, device.UserID, beforeEvents)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("sync.FilterVisibleEvents failed")
+		return jsonerror.InternalServerError()
+	}
+	visibleAfter, err := sync.FilterVisibleEvents(req.Context(), queryAPI, device.UserID, afterEvents)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("sync.FilterVisibleEvents failed")
+		return jsonerror.InternalServerError()
+	}
+
+	// The state is the state of the room at the last event that is returned,
+	// so that the client can display the events_after with it.
+	stateEventID := eventID
+	if len(visibleAfter) > 0 {
+		stateEventID = visibleAfter[len(visibleAfter)-1].EventID()
+	}
+	stateEvents, err := stateAfterEvent(req, queryAPI, roomID, stateEventID, nil)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("stateAfterEvent failed")
+		return jsonerror.InternalServerError()
+	}
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: contextResponse{
+			Start:        types.NewPaginationTokenFromTypeAndPosition(types.PaginationTokenTypeTopology, startPos, 0).String(),
+			End:          types.NewPaginationTokenFromTypeAndPosition(types.PaginationTokenTypeTopology, endPos, 0).String(),
+			Event:        gomatrixserverlib.HeaderedToClientEvent(event, gomatrixserverlib.FormatAll),
+			EventsBefore: gomatrixserverlib.HeaderedToClientEvents(visibleBefore, gomatrixserverlib.FormatAll),
+			EventsAfter:  gomatrixserverlib.HeaderedToClientEvents(visibleAfter, gomatrixserverlib.FormatAll),
+			State:        gomatrixserverlib.HeaderedToClientEvents(stateEvents, gomatrixserverlib.FormatAll),
+		},
+	}
+}
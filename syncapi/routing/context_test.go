@@ -0,0 +1,189 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"testing"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/syncapi/storage"
+	"github.com/matrix-org/dendrite/syncapi/types"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const contextTestRoomID = "!room:localhost"
+
+// contextDB holds the events of a room, each at the topological position of
+// its depth.
+type contextDB struct {
+	storage.Database
+	events []types.StreamEvent
+}
+
+func (db *contextDB) Events(ctx context.Context, eventIDs []string) ([]gomatrixserverlib.HeaderedEvent, error) {
+	var result []gomatrixserverlib.HeaderedEvent
+	for _, ev := range db.events {
+		for _, eventID := range eventIDs {
+			if ev.EventID() == eventID {
+				result = append(result, ev.HeaderedEvent)
+			}
+		}
+	}
+	return result, nil
+}
+
+func (db *contextDB) EventPositionInTopology(ctx context.Context, eventID string) (types.StreamPosition, error) {
+	for _, ev := range db.events {
+		if ev.EventID() == eventID {
+			return types.StreamPosition(ev.Depth()), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown event %s", eventID)
+}
+
+func (db *contextDB) MaxTopologicalPosition(ctx context.Context, roomID string) (types.StreamPosition, error) {
+	return types.StreamPosition(len(db.events)), nil
+}
+
+func (db *contextDB) GetEventsInRange(
+	ctx context.Context, from, to *types.PaginationToken, roomID string, limit int, backwardOrdering bool,
+) ([]types.StreamEvent, error) {
+	var result []types.StreamEvent
+	for _, ev := range db.events {
+		pos := types.StreamPosition(ev.Depth())
+		if backwardOrdering && pos <= from.PDUPosition && pos > to.PDUPosition ||
+			!backwardOrdering && pos > from.PDUPosition && pos <= to.PDUPosition {
+			result = append(result, ev)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return (result[i].Depth() < result[j].Depth()) != backwardOrdering
+	})
+	if len(result) > limit {
+		result = result[:limit]
+	}
+	return result, nil
+}
+
+func (db *contextDB) StreamEventsToEvents(device *authtypes.Device, in []types.StreamEvent) []gomatrixserverlib.HeaderedEvent {
+	out := make([]gomatrixserverlib.HeaderedEvent, len(in))
+	for i := range in {
+		out[i] = in[i].HeaderedEvent
+	}
+	return out
+}
+
+// contextQueryAPI hides some of the events from the user, and returns a state
+// event whose ID says which event the state was requested at.
+type contextQueryAPI struct {
+	api.RoomserverQueryAPI
+	hidden map[string]bool
+}
+
+func (q *contextQueryAPI) QueryUserAllowedToSeeEvents(
+	ctx context.Context, req *api.QueryUserAllowedToSeeEventsRequest, res *api.QueryUserAllowedToSeeEventsResponse,
+) error {
+	res.AllowedToSeeEvents = make(map[string]bool)
+	for _, eventID := range req.EventIDs {
+		res.AllowedToSeeEvents[eventID] = !q.hidden[eventID]
+	}
+	return nil
+}
+
+func (q *contextQueryAPI) QueryStateAndAuthChain(
+	ctx context.Context, req *api.QueryStateAndAuthChainRequest, res *api.QueryStateAndAuthChainResponse,
+) error {
+	res.RoomExists, res.PrevEventsExist = true, true
+	stateKey := ""
+	ev, err := newContextEvent("$state_at_"+req.PrevEventIDs[0], "m.room.topic", &stateKey, 0)
+	res.StateEvents = []gomatrixserverlib.HeaderedEvent{ev}
+	return err
+}
+
+func newContextEvent(eventID, eventType string, stateKey *string, depth int) (gomatrixserverlib.HeaderedEvent, error) {
+	stateKeyJSON := ""
+	if stateKey != nil {
+		stateKeyJSON = fmt.Sprintf(`"state_key":%q,`, *stateKey)
+	}
+	eventJSON := fmt.Sprintf(
+		`{"event_id":%q,"room_id":%q,"type":%q,%s"sender":"@alice:localhost","content":{},`+
+			`"origin_server_ts":%d,"prev_events":[],"auth_events":[],"depth":%d}`,
+		eventID, contextTestRoomID, eventType, stateKeyJSON, depth, depth,
+	)
+	ev, err := gomatrixserverlib.NewEventFromTrustedJSON([]byte(eventJSON), false, gomatrixserverlib.RoomVersionV1)
+	return ev.Headered(gomatrixserverlib.RoomVersionV1), err
+}
+
+func TestOnIncomingContextRequest(t *testing.T) {
+	db := &contextDB{}
+	for i := 1; i <= 5; i++ {
+		ev, err := newContextEvent(fmt.Sprintf("$%d", i), "m.room.message", nil, i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		db.events = append(db.events, types.StreamEvent{HeaderedEvent: ev, StreamPosition: types.StreamPosition(i)})
+	}
+	// The user isn't allowed to see the latest event.
+	queryAPI := &contextQueryAPI{hidden: map[string]bool{"$5": true}}
+	device := &authtypes.Device{UserID: "@alice:localhost"}
+
+	for _, tc := range []struct {
+		limit      int
+		wantBefore []string
+		wantAfter  []string
+		wantState  string
+	}{
+		// Without events after the event, the state is the state at it.
+		{limit: 0, wantState: "$state_at_$3"},
+		{limit: 2, wantBefore: []string{"$2"}, wantAfter: []string{"$4"}, wantState: "$state_at_$4"},
+		// The state is at the last event that is returned, not the last
+		// one that was retrieved.
+		{limit: 4, wantBefore: []string{"$2", "$1"}, wantAfter: []string{"$4"}, wantState: "$state_at_$4"},
+	} {
+		req := httptest.NewRequest("GET", fmt.Sprintf("/rooms/%s/context/$3?limit=%d", contextTestRoomID, tc.limit), nil)
+		res := OnIncomingContextRequest(req, device, db, queryAPI, contextTestRoomID, "$3")
+		if res.Code != http.StatusOK {
+			t.Fatalf("limit %d: got status %d, want %d", tc.limit, res.Code, http.StatusOK)
+		}
+		body := res.JSON.(contextResponse)
+		eventIDs := func(events []gomatrixserverlib.ClientEvent) []string {
+			var ids []string
+			for _, ev := range events {
+				ids = append(ids, ev.EventID)
+			}
+			return ids
+		}
+		if got := eventIDs(body.EventsBefore); fmt.Sprint(got) != fmt.Sprint(tc.wantBefore) {
+			t.Errorf("limit %d: got events_before %v, want %v", tc.limit, got, tc.wantBefore)
+		}
+		if got := eventIDs(body.EventsAfter); fmt.Sprint(got) != fmt.Sprint(tc.wantAfter) {
+			t.Errorf("limit %d: got events_after %v, want %v", tc.limit, got, tc.wantAfter)
+		}
+		if len(body.State) != 1 || body.State[0].EventID != tc.wantState {
+			t.Errorf("limit %d: got state %v, want the state at %s", tc.limit, eventIDs(body.State), tc.wantState)
+		}
+	}
+
+	req := httptest.NewRequest("GET", "/rooms/"+contextTestRoomID+"/context/$5", nil)
+	if res := OnIncomingContextRequest(req, device, db, queryAPI, contextTestRoomID, "$5"); res.Code != http.StatusNotFound {
+		t.Errorf("hidden event: got status %d, want %d", res.Code, http.StatusNotFound)
+	}
+}
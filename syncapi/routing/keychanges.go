@@ -0,0 +1,74 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"net/http"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/syncapi/storage"
+	"github.com/matrix-org/dendrite/syncapi/types"
+	"github.com/matrix-org/util"
+)
+
+type keyChangesResponse struct {
+	Changed []string `json:"changed"`
+	Left    []string `json:"left"`
+}
+
+// OnIncomingKeyChangesRequest implements GET /keys/changes. The from and to
+// parameters are sync tokens, so this is served by the sync API which knows
+// the stream positions at which device keys changed.
+func OnIncomingKeyChangesRequest(
+	req *http.Request, device *authtypes.Device, db storage.Database,
+) util.JSONResponse {
+	from, err := types.NewPaginationTokenFromString(req.URL.Query().Get("from"))
+	if err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("Invalid from parameter: " + err.Error()),
+		}
+	}
+	to, err := types.NewPaginationTokenFromString(req.URL.Query().Get("to"))
+	if err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("Invalid to parameter: " + err.Error()),
+		}
+	}
+
+	changed, err := db.KeyChangesInRange(req.Context(), device.UserID, from.DeviceListPosition, to.DeviceListPosition)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("db.KeyChangesInRange failed")
+		return jsonerror.InternalServerError()
+	}
+	left, err := db.UsersLeftInRange(req.Context(), device.UserID, from.PDUPosition, to.PDUPosition)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("db.UsersLeftInRange failed")
+		return jsonerror.InternalServerError()
+	}
+
+	res := keyChangesResponse{
+		Changed: []string{},
+		Left:    []string{},
+	}
+	res.Changed = append(res.Changed, changed...)
+	res.Left = append(res.Left, left...)
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: res,
+	}
+}
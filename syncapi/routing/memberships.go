@@ -0,0 +1,153 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"math"
+	"net/http"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/syncapi/storage"
+	"github.com/matrix-org/dendrite/syncapi/types"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+type getMembershipResponse struct {
+	Chunk []gomatrixserverlib.ClientEvent `json:"chunk"`
+}
+
+// GetMemberships implements GET /rooms/{roomId}/members. The "at" parameter
+// takes a sync or pagination token and returns the memberships of the room as
+// they were at that point. The "membership" and "not_membership" parameters
+// filter the returned memberships. Users that left the room get the
+// memberships at the point they left, at the latest.
+func GetMemberships(
+	req *http.Request, device *authtypes.Device, db storage.Database,
+	queryAPI api.RoomserverQueryAPI, roomID string,
+) util.JSONResponse {
+	eventID, resErr := userLeaveEventID(req, db, roomID, device.UserID)
+	if resErr != nil {
+		return *resErr
+	}
+
+	if at := req.URL.Query().Get("at"); at != "" {
+		atEventID, resErr := membershipsAtEventID(req, db, roomID, at, eventID)
+		if resErr != nil {
+			return *resErr
+		}
+		if atEventID == "" {
+			// There were no events in the room at that point.
+			return util.JSONResponse{
+				Code: http.StatusOK,
+				JSON: getMembershipResponse{Chunk: []gomatrixserverlib.ClientEvent{}},
+			}
+		}
+		eventID = atEventID
+	}
+
+	var stateEvents []gomatrixserverlib.HeaderedEvent
+	var err error
+	if eventID == "" {
+		stateFilter := gomatrixserverlib.DefaultStateFilter()
+		stateFilter.Types = []string{gomatrixserverlib.MRoomMember}
+		stateFilter.Limit = math.MaxInt32
+		stateEvents, err = db.GetStateEventsForRoom(req.Context(), roomID, &stateFilter)
+		if err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("db.GetStateEventsForRoom failed")
+			return jsonerror.InternalServerError()
+		}
+	} else {
+		stateEvents, err = stateAfterEvent(req, queryAPI, roomID, eventID, nil)
+		if err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("stateAfterEvent failed")
+			return jsonerror.InternalServerError()
+		}
+	}
+
+	membership := req.URL.Query().Get("membership")
+	notMembership := req.URL.Query().Get("not_membership")
+	chunk := []gomatrixserverlib.ClientEvent{}
+	for _, event := range stateEvents {
+		if event.Type() != gomatrixserverlib.MRoomMember {
+			continue
+		}
+		eventMembership, err := event.Membership()
+		if err != nil {
+			continue
+		}
+		if !membershipAllowed(membership, notMembership, eventMembership) {
+			continue
+		}
+		chunk = append(chunk, gomatrixserverlib.HeaderedToClientEvent(event, gomatrixserverlib.FormatAll))
+	}
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: getMembershipResponse{Chunk: chunk},
+	}
+}
+
+// membershipsAtEventID returns the ID of the latest event in the room at the
+// point given by the token, or the leave event of the user if that is earlier.
+// An empty string is returned if there were no events in the room yet.
+func membershipsAtEventID(
+	req *http.Request, db storage.Database, roomID, at, leaveEventID string,
+) (string, *util.JSONResponse) {
+	from, err := types.NewPaginationTokenFromString(at)
+	if err != nil {
+		return "", resErrPtr(util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("Invalid at parameter: " + err.Error()),
+		})
+	}
+	to := types.NewPaginationTokenFromTypeAndPosition(from.Type, 0, 0)
+	events, err := db.GetEventsInRange(req.Context(), from, to, roomID, 1, true)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("db.GetEventsInRange failed")
+		return "", resErrPtr(jsonerror.InternalServerError())
+	}
+	if len(events) == 0 {
+		return "", nil
+	}
+	if leaveEventID == "" {
+		return events[0].EventID(), nil
+	}
+
+	leaveEvents, err := db.Events(req.Context(), []string{leaveEventID})
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("db.Events failed")
+		return "", resErrPtr(jsonerror.InternalServerError())
+	}
+	if len(leaveEvents) > 0 && leaveEvents[0].Depth() < events[0].Depth() {
+		return leaveEventID, nil
+	}
+	return events[0].EventID(), nil
+}
+
+// membershipAllowed returns whether a membership passes the "membership" and
+// "not_membership" parameters of the request. If both are given then either
+// of them is enough for the membership to pass.
+func membershipAllowed(membership, notMembership, eventMembership string) bool {
+	if membership == "" && notMembership == "" {
+		return true
+	}
+	if membership != "" && eventMembership == membership {
+		return true
+	}
+	return notMembership != "" && eventMembership != notMembership
+}
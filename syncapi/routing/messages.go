@@ -16,15 +16,18 @@ package routing
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"sort"
 	"strconv"
 
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
 	"github.com/matrix-org/dendrite/common/config"
 	"github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/dendrite/syncapi/storage"
+	"github.com/matrix-org/dendrite/syncapi/sync"
 	"github.com/matrix-org/dendrite/syncapi/types"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
@@ -37,6 +40,7 @@ type messagesReq struct {
 	queryAPI         api.RoomserverQueryAPI
 	federation       *gomatrixserverlib.FederationClient
 	cfg              *config.Dendrite
+	device           *authtypes.Device
 	roomID           string
 	from             *types.PaginationToken
 	to               *types.PaginationToken
@@ -49,6 +53,7 @@ type messagesResp struct {
 	Start string                          `json:"start"`
 	End   string                          `json:"end"`
 	Chunk []gomatrixserverlib.ClientEvent `json:"chunk"`
+	State []gomatrixserverlib.ClientEvent `json:"state,omitempty"`
 }
 
 const defaultMessagesLimit = 10
@@ -57,7 +62,7 @@ const defaultMessagesLimit = 10
 // client-server API.
 // See: https://matrix.org/docs/spec/client_server/latest.html#get-matrix-client-r0-rooms-roomid-messages
 func OnIncomingMessagesRequest(
-	req *http.Request, db storage.Database, roomID string,
+	req *http.Request, device *authtypes.Device, db storage.Database, roomID string,
 	federation *gomatrixserverlib.FederationClient,
 	queryAPI api.RoomserverQueryAPI,
 	cfg *config.Dendrite,
@@ -122,7 +127,17 @@ func OnIncomingMessagesRequest(
 			}
 		}
 	}
-	// TODO: Implement filtering (#587)
+	// TODO: Implement filtering (#587). Only the lazy-loading of members is
+	// supported so far.
+	filter := gomatrixserverlib.DefaultRoomEventFilter()
+	if s := req.URL.Query().Get("filter"); len(s) > 0 {
+		if err = json.Unmarshal([]byte(s), &filter); err != nil {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue("filter could not be parsed: " + err.Error()),
+			}
+		}
+	}
 
 	// Check the room ID's format.
 	if _, _, err = gomatrixserverlib.SplitID('!', roomID); err != nil {
@@ -138,6 +153,7 @@ func OnIncomingMessagesRequest(
 		queryAPI:         queryAPI,
 		federation:       federation,
 		cfg:              cfg,
+		device:           device,
 		roomID:           roomID,
 		from:             from,
 		to:               to,
@@ -160,11 +176,23 @@ func OnIncomingMessagesRequest(
 		"return_end":   end.String(),
 	}).Info("Responding")
 
+	// Clients lazy-loading members are given the membership events of the
+	// senders of the events, as they didn't get them from /sync.
+	var state []gomatrixserverlib.ClientEvent
+	if filter.LazyLoadMembers && len(clientEvents) > 0 {
+		state, err = sync.LazyLoadMembers(req.Context(), db, device, roomID, &filter, clientEvents)
+		if err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("sync.LazyLoadMembers failed")
+			return jsonerror.InternalServerError()
+		}
+	}
+
 	// Respond with the events.
 	return util.JSONResponse{
 		Code: http.StatusOK,
 		JSON: messagesResp{
 			Chunk: clientEvents,
+			State: state,
 			Start: start.String(),
 			End:   end.String(),
 		},
@@ -224,8 +252,17 @@ func (r *messagesReq) retrieveEvents() (
 		})
 	}
 
+	// Only send the events that the user is allowed to see. The pagination
+	// tokens are still computed from all of the events we retrieved so that
+	// the client doesn't get the hidden events on its next request.
+	visibleEvents, err := sync.FilterVisibleEvents(r.ctx, r.queryAPI, r.device.UserID, events)
+	if err != nil {
+		err = fmt.Errorf("FilterVisibleEvents: %w", err)
+		return
+	}
+
 	// Convert all of the events into client events.
-	clientEvents = gomatrixserverlib.HeaderedToClientEvents(events, gomatrixserverlib.FormatAll)
+	clientEvents = gomatrixserverlib.HeaderedToClientEvents(visibleEvents, gomatrixserverlib.FormatAll)
 	// Get the position of the first and the last event in the room's topology.
 	// This position is currently determined by the event's depth, so we could
 	// also use it instead of retrieving from the database. However, if we ever
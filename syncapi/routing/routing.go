@@ -61,7 +61,7 @@ func Setup(
 		if err != nil {
 			return util.ErrorResponse(err)
 		}
-		return OnIncomingStateRequest(req, syncDB, vars["roomID"])
+		return OnIncomingStateRequest(req, device, syncDB, queryAPI, vars["roomID"])
 	})).Methods(http.MethodGet, http.MethodOptions)
 
 	r0mux.Handle("/rooms/{roomID}/state/{type}", common.MakeAuthAPI("room_state", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
@@ -69,7 +69,7 @@ func Setup(
 		if err != nil {
 			return util.ErrorResponse(err)
 		}
-		return OnIncomingStateTypeRequest(req, syncDB, vars["roomID"], vars["type"], "")
+		return OnIncomingStateTypeRequest(req, device, syncDB, queryAPI, vars["roomID"], vars["type"], "")
 	})).Methods(http.MethodGet, http.MethodOptions)
 
 	r0mux.Handle("/rooms/{roomID}/state/{type}/{stateKey}", common.MakeAuthAPI("room_state", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
@@ -77,7 +77,15 @@ func Setup(
 		if err != nil {
 			return util.ErrorResponse(err)
 		}
-		return OnIncomingStateTypeRequest(req, syncDB, vars["roomID"], vars["type"], vars["stateKey"])
+		return OnIncomingStateTypeRequest(req, device, syncDB, queryAPI, vars["roomID"], vars["type"], vars["stateKey"])
+	})).Methods(http.MethodGet, http.MethodOptions)
+
+	r0mux.Handle("/rooms/{roomID}/members", common.MakeAuthAPI("rooms_members", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+		vars, err := common.URLDecodeMapValues(mux.Vars(req))
+		if err != nil {
+			return util.ErrorResponse(err)
+		}
+		return GetMemberships(req, device, syncDB, queryAPI, vars["roomID"])
 	})).Methods(http.MethodGet, http.MethodOptions)
 
 	r0mux.Handle("/rooms/{roomID}/messages", common.MakeAuthAPI("room_messages", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
@@ -85,6 +93,22 @@ func Setup(
 		if err != nil {
 			return util.ErrorResponse(err)
 		}
-		return OnIncomingMessagesRequest(req, syncDB, vars["roomID"], federation, queryAPI, cfg)
+		return OnIncomingMessagesRequest(req, device, syncDB, vars["roomID"], federation, queryAPI, cfg)
 	})).Methods(http.MethodGet, http.MethodOptions)
+
+	r0mux.Handle("/rooms/{roomID}/context/{eventID}", common.MakeAuthAPI("room_context", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+		vars, err := common.URLDecodeMapValues(mux.Vars(req))
+		if err != nil {
+			return util.ErrorResponse(err)
+		}
+		return OnIncomingContextRequest(req, device, syncDB, queryAPI, vars["roomID"], vars["eventID"])
+	})).Methods(http.MethodGet, http.MethodOptions)
+
+	r0mux.Handle("/keys/changes", common.MakeAuthAPI("keys_changes", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+		return OnIncomingKeyChangesRequest(req, device, syncDB)
+	})).Methods(http.MethodGet, http.MethodOptions)
+
+	r0mux.Handle("/search", common.MakeAuthAPI("search", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+		return Search(req, device, syncDB, queryAPI)
+	})).Methods(http.MethodPost, http.MethodOptions)
 }
@@ -0,0 +1,427 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/syncapi/storage"
+	"github.com/matrix-org/dendrite/syncapi/sync"
+	"github.com/matrix-org/dendrite/syncapi/types"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+const (
+	defaultSearchLimit        = 10
+	defaultEventContextLimit  = 5
+	searchOrderByRank         = "rank"
+	searchOrderByRecent       = "recent"
+	searchGroupByRoomID       = "room_id"
+	searchGroupBySender       = "sender"
+	searchKeyContentBody      = "content.body"
+	searchKeyContentName      = "content.name"
+	searchKeyContentTopic     = "content.topic"
+	searchMaxEventContextSize = 100
+	searchMaxLimit            = 100
+	// The number of matching events that are counted for the "count" of the
+	// results. The count is meant to be an approximation, and counting every
+	// match would mean checking the visibility of all of them on every page.
+	searchMaxCount = 1000
+)
+
+type searchRequest struct {
+	SearchCategories struct {
+		RoomEvents *roomEventsCriteria `json:"room_events"`
+	} `json:"search_categories"`
+}
+
+type roomEventsCriteria struct {
+	SearchTerm   string                            `json:"search_term"`
+	Keys         []string                          `json:"keys"`
+	Filter       gomatrixserverlib.RoomEventFilter `json:"filter"`
+	OrderBy      string                            `json:"order_by"`
+	EventContext *eventContextCriteria             `json:"event_context"`
+	Groupings    struct {
+		GroupBy []struct {
+			Key string `json:"key"`
+		} `json:"group_by"`
+	} `json:"groupings"`
+}
+
+type eventContextCriteria struct {
+	BeforeLimit    *int `json:"before_limit"`
+	AfterLimit     *int `json:"after_limit"`
+	IncludeProfile bool `json:"include_profile"`
+}
+
+type searchResponse struct {
+	SearchCategories struct {
+		RoomEvents *roomEventsResults `json:"room_events,omitempty"`
+	} `json:"search_categories"`
+}
+
+type roomEventsResults struct {
+	Count      int                                `json:"count"`
+	Highlights []string                           `json:"highlights"`
+	Results    []searchResult                     `json:"results"`
+	NextBatch  string                             `json:"next_batch,omitempty"`
+	Groups     map[string]map[string]*searchGroup `json:"groups,omitempty"`
+}
+
+type searchResult struct {
+	Rank    float64                       `json:"rank"`
+	Result  gomatrixserverlib.ClientEvent `json:"result"`
+	Context *searchEventContext           `json:"context,omitempty"`
+}
+
+type searchEventContext struct {
+	Start        string                          `json:"start"`
+	End          string                          `json:"end"`
+	EventsBefore []gomatrixserverlib.ClientEvent `json:"events_before"`
+	EventsAfter  []gomatrixserverlib.ClientEvent `json:"events_after"`
+	ProfileInfo  map[string]searchProfile        `json:"profile_info,omitempty"`
+}
+
+type searchProfile struct {
+	DisplayName string `json:"displayname,omitempty"`
+	AvatarURL   string `json:"avatar_url,omitempty"`
+}
+
+type searchGroup struct {
+	Results []string `json:"results"`
+	Order   int      `json:"order"`
+}
+
+// Search implements POST /search. Only the "room_events" category exists.
+// The events of the rooms that the user is joined to are searched, and the
+// events that the user isn't allowed to see are left out of the results.
+func Search(
+	req *http.Request, device *authtypes.Device, db storage.Database,
+	queryAPI api.RoomserverQueryAPI,
+) util.JSONResponse {
+	var r searchRequest
+	if resErr := httputil.UnmarshalJSONRequest(req, &r); resErr != nil {
+		return *resErr
+	}
+
+	var res searchResponse
+	criteria := r.SearchCategories.RoomEvents
+	if criteria == nil {
+		return util.JSONResponse{Code: http.StatusOK, JSON: res}
+	}
+	if resErr := validateRoomEventsCriteria(criteria); resErr != nil {
+		return *resErr
+	}
+
+	var from int64
+	if nextBatch := req.URL.Query().Get("next_batch"); nextBatch != "" {
+		var err error
+		if from, err = strconv.ParseInt(nextBatch, 10, 64); err != nil || from < 0 {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue("Invalid next_batch"),
+			}
+		}
+	}
+
+	results, err := searchRoomEvents(req.Context(), db, queryAPI, device.UserID, criteria, from)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("searchRoomEvents failed")
+		return jsonerror.InternalServerError()
+	}
+	res.SearchCategories.RoomEvents = results
+	return util.JSONResponse{Code: http.StatusOK, JSON: res}
+}
+
+// validateRoomEventsCriteria checks the criteria of a search and fills in the
+// defaults of the parameters that weren't given.
+func validateRoomEventsCriteria(criteria *roomEventsCriteria) *util.JSONResponse {
+	if strings.TrimSpace(criteria.SearchTerm) == "" {
+		return resErrPtr(util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.BadJSON("search_term must not be empty"),
+		})
+	}
+	if len(criteria.Keys) == 0 {
+		criteria.Keys = []string{searchKeyContentBody, searchKeyContentName, searchKeyContentTopic}
+	}
+	for _, key := range criteria.Keys {
+		switch key {
+		case searchKeyContentBody, searchKeyContentName, searchKeyContentTopic:
+		default:
+			return resErrPtr(util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue("Unknown key " + key),
+			})
+		}
+	}
+	switch criteria.OrderBy {
+	case "":
+		criteria.OrderBy = searchOrderByRank
+	case searchOrderByRank, searchOrderByRecent:
+	default:
+		return resErrPtr(util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("order_by must be rank or recent"),
+		})
+	}
+	for _, group := range criteria.Groupings.GroupBy {
+		if group.Key != searchGroupByRoomID && group.Key != searchGroupBySender {
+			return resErrPtr(util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue("Unknown group key " + group.Key),
+			})
+		}
+	}
+	if criteria.Filter.Limit <= 0 {
+		criteria.Filter.Limit = defaultSearchLimit
+	}
+	if criteria.Filter.Limit > searchMaxLimit {
+		criteria.Filter.Limit = searchMaxLimit
+	}
+	return nil
+}
+
+// searchRoomEvents runs a search of the "room_events" category. For results
+// ordered by rank, from is the number of results that were already returned,
+// and for results ordered by recency, it is the stream position that the
+// results start before.
+func searchRoomEvents(
+	ctx context.Context, db storage.Database, queryAPI api.RoomserverQueryAPI,
+	userID string, criteria *roomEventsCriteria, from int64,
+) (*roomEventsResults, error) {
+	filter := &criteria.Filter
+	joinedRoomIDs, err := db.JoinedRoomIDs(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	var roomIDs []string
+	for _, roomID := range joinedRoomIDs {
+		if types.FilterAllowsRoom(filter.Rooms, filter.NotRooms, roomID) {
+			roomIDs = append(roomIDs, roomID)
+		}
+	}
+
+	orderByRecency := criteria.OrderBy == searchOrderByRecent
+	matches, matchingEventIDs, err := db.SearchEvents(
+		ctx, criteria.SearchTerm, roomIDs, criteria.Keys, orderByRecency, from, filter.Limit, searchMaxCount,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	eventIDs := make([]string, 0, len(matches))
+	for _, match := range matches {
+		eventIDs = append(eventIDs, match.EventID)
+	}
+	events, err := db.Events(ctx, eventIDs)
+	if err != nil {
+		return nil, err
+	}
+	eventsByID := make(map[string]gomatrixserverlib.HeaderedEvent, len(events))
+	for _, event := range events {
+		eventsByID[event.EventID()] = event
+	}
+	// The visibility of the matches on this page and of the matches that are
+	// counted is checked at once.
+	visible, err := sync.VisibleEventIDs(ctx, queryAPI, userID, append(eventIDs, matchingEventIDs...))
+	if err != nil {
+		return nil, err
+	}
+	count := 0
+	for _, eventID := range matchingEventIDs {
+		if visible[eventID] {
+			count++
+		}
+	}
+
+	res := &roomEventsResults{
+		Count:      count,
+		Highlights: strings.Fields(criteria.SearchTerm),
+		Results:    []searchResult{},
+	}
+	seen := make(map[string]bool, len(matches))
+	for _, match := range matches {
+		event, ok := eventsByID[match.EventID]
+		if !ok || !visible[match.EventID] || seen[match.EventID] {
+			continue
+		}
+		seen[match.EventID] = true
+		if !types.RoomEventFilterAllows(filter, &event.Event) {
+			continue
+		}
+		result := searchResult{
+			Rank:   match.Rank,
+			Result: gomatrixserverlib.HeaderedToClientEvent(event, gomatrixserverlib.FormatAll),
+		}
+		if criteria.EventContext != nil {
+			result.Context, err = searchResultContext(
+				ctx, db, queryAPI, userID, event, match.StreamPosition, criteria.EventContext,
+			)
+			if err != nil {
+				return nil, err
+			}
+		}
+		res.Results = append(res.Results, result)
+	}
+
+	// There may be more results if the page is full. The next page starts
+	// after the last match, even if it was left out of the results.
+	if len(matches) == filter.Limit {
+		if orderByRecency {
+			res.NextBatch = strconv.FormatInt(int64(matches[len(matches)-1].StreamPosition), 10)
+		} else {
+			res.NextBatch = strconv.FormatInt(from+int64(len(matches)), 10)
+		}
+	}
+
+	if len(criteria.Groupings.GroupBy) > 0 {
+		res.Groups = make(map[string]map[string]*searchGroup)
+		for _, group := range criteria.Groupings.GroupBy {
+			res.Groups[group.Key] = groupSearchResults(group.Key, res.Results)
+		}
+	}
+	return res, nil
+}
+
+// groupSearchResults groups the IDs of the results by their room or sender.
+// The groups are ordered by their first result.
+func groupSearchResults(key string, results []searchResult) map[string]*searchGroup {
+	groups := make(map[string]*searchGroup)
+	for _, result := range results {
+		value := result.Result.RoomID
+		if key == searchGroupBySender {
+			value = result.Result.Sender
+		}
+		group, ok := groups[value]
+		if !ok {
+			group = &searchGroup{Order: len(groups) + 1}
+			groups[value] = group
+		}
+		group.Results = append(group.Results, result.Result.EventID)
+	}
+	return groups
+}
+
+// searchResultContext returns the events around a search result that the user
+// is allowed to see, along with the tokens to paginate further with /messages.
+func searchResultContext(
+	ctx context.Context, db storage.Database, queryAPI api.RoomserverQueryAPI,
+	userID string, event gomatrixserverlib.HeaderedEvent, pos types.StreamPosition,
+	criteria *eventContextCriteria,
+) (*searchEventContext, error) {
+	beforeLimit, afterLimit := defaultEventContextLimit, defaultEventContextLimit
+	if criteria.BeforeLimit != nil && *criteria.BeforeLimit >= 0 {
+		beforeLimit = *criteria.BeforeLimit
+	}
+	if criteria.AfterLimit != nil && *criteria.AfterLimit >= 0 {
+		afterLimit = *criteria.AfterLimit
+	}
+	if beforeLimit > searchMaxEventContextSize {
+		beforeLimit = searchMaxEventContextSize
+	}
+	if afterLimit > searchMaxEventContextSize {
+		afterLimit = searchMaxEventContextSize
+	}
+
+	// Events before the result are returned from the most recent one.
+	before, err := db.GetEventsInRange(
+		ctx,
+		types.NewPaginationTokenFromTypeAndPosition(types.PaginationTokenTypeStream, pos-1, 0),
+		types.NewPaginationTokenFromTypeAndPosition(types.PaginationTokenTypeStream, 0, 0),
+		event.RoomID(), beforeLimit, true,
+	)
+	if err != nil {
+		return nil, err
+	}
+	after, err := db.GetEventsInRange(
+		ctx,
+		types.NewPaginationTokenFromTypeAndPosition(types.PaginationTokenTypeStream, pos, 0),
+		types.NewPaginationTokenFromTypeAndPosition(types.PaginationTokenTypeStream, math.MaxInt64, 0),
+		event.RoomID(), afterLimit, false,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	start, end := pos-1, pos
+	if len(before) > 0 {
+		start = before[len(before)-1].StreamPosition - 1
+	}
+	if len(after) > 0 {
+		end = after[len(after)-1].StreamPosition
+	}
+	res := &searchEventContext{
+		Start: types.NewPaginationTokenFromTypeAndPosition(types.PaginationTokenTypeStream, start, 0).String(),
+		End:   types.NewPaginationTokenFromTypeAndPosition(types.PaginationTokenTypeStream, end, 0).String(),
+	}
+
+	var eventIDs []string
+	for _, ev := range append(append([]types.StreamEvent{}, before...), after...) {
+		eventIDs = append(eventIDs, ev.EventID())
+	}
+	visible, err := sync.VisibleEventIDs(ctx, queryAPI, userID, eventIDs)
+	if err != nil {
+		return nil, err
+	}
+	res.EventsBefore = visibleClientEvents(before, visible)
+	res.EventsAfter = visibleClientEvents(after, visible)
+
+	if criteria.IncludeProfile {
+		senders := map[string]bool{event.Sender(): true}
+		for _, ev := range res.EventsBefore {
+			senders[ev.Sender] = true
+		}
+		for _, ev := range res.EventsAfter {
+			senders[ev.Sender] = true
+		}
+		res.ProfileInfo = make(map[string]searchProfile, len(senders))
+		for sender := range senders {
+			memberEvent, err := db.GetStateEvent(ctx, event.RoomID(), gomatrixserverlib.MRoomMember, sender)
+			if err != nil {
+				return nil, err
+			}
+			var profile searchProfile
+			if memberEvent != nil {
+				// The profile is left empty if the content is invalid.
+				_ = json.Unmarshal(memberEvent.Content(), &profile)
+			}
+			res.ProfileInfo[sender] = profile
+		}
+	}
+	return res, nil
+}
+
+func visibleClientEvents(
+	events []types.StreamEvent, visible map[string]bool,
+) []gomatrixserverlib.ClientEvent {
+	result := []gomatrixserverlib.ClientEvent{}
+	for _, ev := range events {
+		if visible[ev.EventID()] {
+			result = append(result, gomatrixserverlib.HeaderedToClientEvent(ev.HeaderedEvent, gomatrixserverlib.FormatAll))
+		}
+	}
+	return result
+}
@@ -0,0 +1,77 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+func TestGroupSearchResults(t *testing.T) {
+	result := func(eventID, roomID, sender string) searchResult {
+		return searchResult{Result: gomatrixserverlib.ClientEvent{
+			EventID: eventID, RoomID: roomID, Sender: sender,
+		}}
+	}
+	results := []searchResult{
+		result("$1", "!b:localhost", "@alice:localhost"),
+		result("$2", "!a:localhost", "@bob:localhost"),
+		result("$3", "!b:localhost", "@bob:localhost"),
+	}
+
+	byRoom := groupSearchResults(searchGroupByRoomID, results)
+	wantByRoom := map[string]*searchGroup{
+		"!b:localhost": {Results: []string{"$1", "$3"}, Order: 1},
+		"!a:localhost": {Results: []string{"$2"}, Order: 2},
+	}
+	if !reflect.DeepEqual(byRoom, wantByRoom) {
+		t.Errorf("grouped by room: got %+v, want %+v", byRoom, wantByRoom)
+	}
+
+	bySender := groupSearchResults(searchGroupBySender, results)
+	wantBySender := map[string]*searchGroup{
+		"@alice:localhost": {Results: []string{"$1"}, Order: 1},
+		"@bob:localhost":   {Results: []string{"$2", "$3"}, Order: 2},
+	}
+	if !reflect.DeepEqual(bySender, wantBySender) {
+		t.Errorf("grouped by sender: got %+v, want %+v", bySender, wantBySender)
+	}
+
+	if groups := groupSearchResults(searchGroupByRoomID, nil); len(groups) != 0 {
+		t.Errorf("got %d groups for no results, want none", len(groups))
+	}
+}
+
+func TestValidateRoomEventsCriteriaLimit(t *testing.T) {
+	for limit, want := range map[int]int{
+		0:                  defaultSearchLimit,
+		-1:                 defaultSearchLimit,
+		5:                  5,
+		searchMaxLimit:     searchMaxLimit,
+		searchMaxLimit + 1: searchMaxLimit,
+		1000000:            searchMaxLimit,
+	} {
+		criteria := roomEventsCriteria{SearchTerm: "hello"}
+		criteria.Filter.Limit = limit
+		if resErr := validateRoomEventsCriteria(&criteria); resErr != nil {
+			t.Fatalf("limit %d: unexpected error %+v", limit, resErr.JSON)
+		}
+		if criteria.Filter.Limit != want {
+			t.Errorf("limit %d: got %d, want %d", limit, criteria.Filter.Limit, want)
+		}
+	}
+}
@@ -16,9 +16,12 @@ package routing
 
 import (
 	"encoding/json"
+	"fmt"
 	"net/http"
 
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/dendrite/syncapi/storage"
 	"github.com/matrix-org/dendrite/syncapi/types"
 	"github.com/matrix-org/gomatrixserverlib"
@@ -35,21 +38,15 @@ type stateEventInStateResp struct {
 // OnIncomingStateRequest is called when a client makes a /rooms/{roomID}/state
 // request. It will fetch all the state events from the specified room and will
 // append the necessary keys to them if applicable before returning them.
+// Users that left the room get the state of the room at the point they left.
 // Returns an error if something went wrong in the process.
-// TODO: Check if the user is in the room. If not, check if the room's history
-// is publicly visible. Current behaviour is returning an empty array if the
-// user cannot see the room's history.
-func OnIncomingStateRequest(req *http.Request, db storage.Database, roomID string) util.JSONResponse {
-	// TODO(#287): Auth request and handle the case where the user has left (where
-	// we should return the state at the poin they left)
-
-	stateFilter := gomatrixserverlib.DefaultStateFilter()
-	// TODO: stateFilter should not limit the number of state events (or only limits abusive number of events)
-
-	stateEvents, err := db.GetStateEventsForRoom(req.Context(), roomID, &stateFilter)
-	if err != nil {
-		util.GetLogger(req.Context()).WithError(err).Error("db.GetStateEventsForRoom failed")
-		return jsonerror.InternalServerError()
+func OnIncomingStateRequest(
+	req *http.Request, device *authtypes.Device, db storage.Database,
+	queryAPI api.RoomserverQueryAPI, roomID string,
+) util.JSONResponse {
+	stateEvents, resErr := stateVisibleToUser(req, db, queryAPI, roomID, device.UserID)
+	if resErr != nil {
+		return *resErr
 	}
 
 	resp := []stateEventInStateResp{}
@@ -89,11 +86,12 @@ func OnIncomingStateRequest(req *http.Request, db storage.Database, roomID strin
 // OnIncomingStateTypeRequest is called when a client makes a
 // /rooms/{roomID}/state/{type}/{statekey} request. It will look in current
 // state to see if there is an event with that type and state key, if there
-// is then (by default) we return the content, otherwise a 404.
-func OnIncomingStateTypeRequest(req *http.Request, db storage.Database, roomID string, evType, stateKey string) util.JSONResponse {
-	// TODO(#287): Auth request and handle the case where the user has left (where
-	// we should return the state at the poin they left)
-
+// is then (by default) we return the content, otherwise a 404. Users that left
+// the room look in the state of the room at the point they left instead.
+func OnIncomingStateTypeRequest(
+	req *http.Request, device *authtypes.Device, db storage.Database,
+	queryAPI api.RoomserverQueryAPI, roomID string, evType, stateKey string,
+) util.JSONResponse {
 	logger := util.GetLogger(req.Context())
 	logger.WithFields(log.Fields{
 		"roomID":   roomID,
@@ -101,10 +99,30 @@ func OnIncomingStateTypeRequest(req *http.Request, db storage.Database, roomID s
 		"stateKey": stateKey,
 	}).Info("Fetching state")
 
-	event, err := db.GetStateEvent(req.Context(), roomID, evType, stateKey)
-	if err != nil {
-		util.GetLogger(req.Context()).WithError(err).Error("db.GetStateEvent failed")
-		return jsonerror.InternalServerError()
+	leaveEventID, resErr := userLeaveEventID(req, db, roomID, device.UserID)
+	if resErr != nil {
+		return *resErr
+	}
+
+	var event *gomatrixserverlib.HeaderedEvent
+	if leaveEventID == "" {
+		var err error
+		event, err = db.GetStateEvent(req.Context(), roomID, evType, stateKey)
+		if err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("db.GetStateEvent failed")
+			return jsonerror.InternalServerError()
+		}
+	} else {
+		stateEvents, err := stateAfterEvent(req, queryAPI, roomID, leaveEventID, []gomatrixserverlib.StateKeyTuple{
+			{EventType: evType, StateKey: stateKey},
+		})
+		if err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("stateAfterEvent failed")
+			return jsonerror.InternalServerError()
+		}
+		if len(stateEvents) > 0 {
+			event = &stateEvents[0]
+		}
 	}
 
 	if event == nil {
@@ -123,3 +141,123 @@ func OnIncomingStateTypeRequest(req *http.Request, db storage.Database, roomID s
 		JSON: stateEvent.Content,
 	}
 }
+
+// stateVisibleToUser returns the state of the room that the user is allowed to
+// see: the current state if they are in the room or if the room is world
+// readable, or the state at the point they left the room if they left it.
+func stateVisibleToUser(
+	req *http.Request, db storage.Database, queryAPI api.RoomserverQueryAPI,
+	roomID, userID string,
+) ([]gomatrixserverlib.HeaderedEvent, *util.JSONResponse) {
+	leaveEventID, resErr := userLeaveEventID(req, db, roomID, userID)
+	if resErr != nil {
+		return nil, resErr
+	}
+
+	if leaveEventID != "" {
+		stateEvents, err := stateAfterEvent(req, queryAPI, roomID, leaveEventID, nil)
+		if err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("stateAfterEvent failed")
+			return nil, resErrPtr(jsonerror.InternalServerError())
+		}
+		return stateEvents, nil
+	}
+
+	stateFilter := gomatrixserverlib.DefaultStateFilter()
+	// TODO: stateFilter should not limit the number of state events (or only limits abusive number of events)
+
+	stateEvents, err := db.GetStateEventsForRoom(req.Context(), roomID, &stateFilter)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("db.GetStateEventsForRoom failed")
+		return nil, resErrPtr(jsonerror.InternalServerError())
+	}
+	return stateEvents, nil
+}
+
+// userLeaveEventID works out whether the user can see the state of the room.
+// It returns the ID of the event with which the user left or got banned from
+// the room if they did, or an empty string if they can see the current state
+// of the room, i.e. if they are in the room or if the room is world readable.
+func userLeaveEventID(
+	req *http.Request, db storage.Database, roomID, userID string,
+) (string, *util.JSONResponse) {
+	memberEvent, err := db.GetStateEvent(req.Context(), roomID, gomatrixserverlib.MRoomMember, userID)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("db.GetStateEvent failed")
+		return "", resErrPtr(jsonerror.InternalServerError())
+	}
+	if memberEvent != nil {
+		membership, err := memberEvent.Membership()
+		if err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("memberEvent.Membership failed")
+			return "", resErrPtr(jsonerror.InternalServerError())
+		}
+		switch membership {
+		case gomatrixserverlib.Join:
+			return "", nil
+		case gomatrixserverlib.Leave, gomatrixserverlib.Ban:
+			return memberEvent.EventID(), nil
+		}
+	}
+
+	visibilityEvent, err := db.GetStateEvent(req.Context(), roomID, gomatrixserverlib.MRoomHistoryVisibility, "")
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("db.GetStateEvent failed")
+		return "", resErrPtr(jsonerror.InternalServerError())
+	}
+	if visibilityEvent != nil {
+		var content struct {
+			HistoryVisibility string `json:"history_visibility"`
+		}
+		if err = json.Unmarshal(visibilityEvent.Content(), &content); err == nil &&
+			content.HistoryVisibility == "world_readable" {
+			return "", nil
+		}
+	}
+
+	return "", resErrPtr(util.JSONResponse{
+		Code: http.StatusForbidden,
+		JSON: jsonerror.Forbidden("You aren't a member of the room and weren't previously a member of the room."),
+	})
+}
+
+// stateAfterEvent asks the roomserver for the state of the room after the
+// given event. Only the requested state is returned if stateToFetch isn't nil,
+// otherwise the whole state of the room is returned.
+func stateAfterEvent(
+	req *http.Request, queryAPI api.RoomserverQueryAPI,
+	roomID, eventID string, stateToFetch []gomatrixserverlib.StateKeyTuple,
+) ([]gomatrixserverlib.HeaderedEvent, error) {
+	if stateToFetch == nil {
+		stateReq := api.QueryStateAndAuthChainRequest{
+			RoomID:       roomID,
+			PrevEventIDs: []string{eventID},
+		}
+		var stateRes api.QueryStateAndAuthChainResponse
+		if err := queryAPI.QueryStateAndAuthChain(req.Context(), &stateReq, &stateRes); err != nil {
+			return nil, err
+		}
+		if !stateRes.RoomExists || !stateRes.PrevEventsExist {
+			return nil, fmt.Errorf("no state known for the room after event %q", eventID)
+		}
+		return stateRes.StateEvents, nil
+	}
+
+	stateReq := api.QueryStateAfterEventsRequest{
+		RoomID:       roomID,
+		PrevEventIDs: []string{eventID},
+		StateToFetch: stateToFetch,
+	}
+	var stateRes api.QueryStateAfterEventsResponse
+	if err := queryAPI.QueryStateAfterEvents(req.Context(), &stateReq, &stateRes); err != nil {
+		return nil, err
+	}
+	if !stateRes.RoomExists || !stateRes.PrevEventsExist {
+		return nil, fmt.Errorf("no state known for the room after event %q", eventID)
+	}
+	return stateRes.StateEvents, nil
+}
+
+func resErrPtr(res util.JSONResponse) *util.JSONResponse {
+	return &res
+}
@@ -29,17 +29,32 @@ import (
 type Database interface {
 	common.PartitionStorer
 	AllJoinedUsersInRooms(ctx context.Context) (map[string][]string, error)
+	JoinedRoomIDs(ctx context.Context, userID string) ([]string, error)
 	Events(ctx context.Context, eventIDs []string) ([]gomatrixserverlib.HeaderedEvent, error)
 	WriteEvent(context.Context, *gomatrixserverlib.HeaderedEvent, []gomatrixserverlib.HeaderedEvent, []string, []string, *api.TransactionID, bool) (types.StreamPosition, error)
+	// RedactEvent replaces the stored event with its redacted form.
+	RedactEvent(ctx context.Context, redactedEventID string, redactedBecause *gomatrixserverlib.HeaderedEvent) error
 	GetStateEvent(ctx context.Context, roomID, evType, stateKey string) (*gomatrixserverlib.HeaderedEvent, error)
 	GetStateEventsForRoom(ctx context.Context, roomID string, stateFilterPart *gomatrixserverlib.StateFilter) (stateEvents []gomatrixserverlib.HeaderedEvent, err error)
 	SyncPosition(ctx context.Context) (types.PaginationToken, error)
-	IncrementalSync(ctx context.Context, device authtypes.Device, fromPos, toPos types.PaginationToken, numRecentEventsPerRoom int, wantFullState bool) (*types.Response, error)
-	CompleteSync(ctx context.Context, userID string, numRecentEventsPerRoom int) (*types.Response, error)
+	IncrementalSync(ctx context.Context, device authtypes.Device, fromPos, toPos types.PaginationToken, filter *gomatrixserverlib.Filter, wantFullState bool, visible types.VisibleEventsFunc) (*types.Response, error)
+	CompleteSync(ctx context.Context, userID string, filter *gomatrixserverlib.Filter, visible types.VisibleEventsFunc) (*types.Response, error)
 	GetAccountDataInRange(ctx context.Context, userID string, oldPos, newPos types.StreamPosition, accountDataFilterPart *gomatrixserverlib.EventFilter) (map[string][]string, error)
 	UpsertAccountData(ctx context.Context, userID, roomID, dataType string) (types.StreamPosition, error)
 	AddInviteEvent(ctx context.Context, inviteEvent gomatrixserverlib.HeaderedEvent) (types.StreamPosition, error)
-	RetireInviteEvent(ctx context.Context, inviteEventID string) error
+	RetireInviteEvent(ctx context.Context, inviteEventID string) (types.StreamPosition, error)
+	IndexEventForSearch(ctx context.Context, eventID, roomID, key, value string, pos types.StreamPosition) error
+	SearchEvents(ctx context.Context, searchTerm string, roomIDs, keys []string, orderByRecency bool, from int64, limit, countLimit int) ([]types.SearchResult, []string, error)
+	LazyLoadedMembers(ctx context.Context, userID, deviceID, roomID string) (map[string]string, error)
+	AddLazyLoadedMembers(ctx context.Context, userID, deviceID, roomID string, members map[string]string) error
+	AddKeyChange(ctx context.Context, userID string) (types.StreamPosition, error)
+	KeyChangesInRange(ctx context.Context, userID string, oldPos, newPos types.StreamPosition) ([]string, error)
+	UsersLeftInRange(ctx context.Context, userID string, oldPos, newPos types.StreamPosition) ([]string, error)
+	AddSendToDeviceEvent(ctx context.Context, userID, deviceID string, event types.SendToDeviceEvent) (types.StreamPosition, error)
+	SendToDeviceEventsInRange(ctx context.Context, userID, deviceID string, oldPos, newPos types.StreamPosition, limit int) (types.StreamPosition, []types.SendToDeviceEvent, error)
+	DeleteSendToDeviceEvents(ctx context.Context, userID, deviceID string, pos types.StreamPosition) error
+	StoreReceipt(ctx context.Context, roomID, receiptType, userID, eventID string, timestamp gomatrixserverlib.Timestamp) (types.StreamPosition, error)
+	UpsertPresence(ctx context.Context, presence types.Presence) (types.StreamPosition, error)
 	SetTypingTimeoutCallback(fn cache.TimeoutCallbackFn)
 	AddTypingUser(userID, roomID string, expireTime *time.Time) types.StreamPosition
 	RemoveTypingUser(userID, roomID string) types.StreamPosition
@@ -26,14 +26,15 @@ import (
 )
 
 const accountDataSchema = `
--- This sequence is shared between all the tables generated from kafka logs.
-CREATE SEQUENCE IF NOT EXISTS syncapi_stream_id;
+-- The account data stream has a position of its own, separate from the
+-- stream of events.
+CREATE SEQUENCE IF NOT EXISTS syncapi_account_data_id;
 
 -- Stores the types of account data that a user set has globally and in each room
 -- and the stream ID when that type was last updated.
 CREATE TABLE IF NOT EXISTS syncapi_account_data_type (
     -- An incrementing ID which denotes the position in the log that this event resides at.
-    id BIGINT PRIMARY KEY DEFAULT nextval('syncapi_stream_id'),
+    id BIGINT PRIMARY KEY DEFAULT nextval('syncapi_account_data_id'),
     -- ID of the user the data belongs to
     user_id TEXT NOT NULL,
     -- ID of the room the data is related to (empty string if not related to a specific room)
@@ -46,6 +47,12 @@ CREATE TABLE IF NOT EXISTS syncapi_account_data_type (
 );
 
 CREATE UNIQUE INDEX IF NOT EXISTS syncapi_account_data_id_idx ON syncapi_account_data_type(id, type);
+
+-- Account data used to be numbered from syncapi_stream_id, so move existing
+-- tables over to the new sequence and start it after the highest existing ID.
+ALTER TABLE syncapi_account_data_type ALTER COLUMN id SET DEFAULT nextval('syncapi_account_data_id');
+SELECT setval('syncapi_account_data_id', MAX(id)) FROM syncapi_account_data_type
+    HAVING MAX(id) > (SELECT CASE WHEN is_called THEN last_value ELSE last_value - 1 END FROM syncapi_account_data_id);
 `
 
 const insertAccountDataSQL = "" +
@@ -0,0 +1,179 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"math"
+
+	"github.com/lib/pq"
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/syncapi/types"
+)
+
+const eventSearchSchema = `
+-- Stores the searchable text of events, for the /search API.
+CREATE TABLE IF NOT EXISTS syncapi_event_search (
+    -- The ID of the event.
+    event_id TEXT NOT NULL,
+    -- The ID of the room of the event.
+    room_id TEXT NOT NULL,
+    -- The key of the indexed content of the event, e.g. "content.body".
+    key TEXT NOT NULL,
+    -- The indexed content.
+    vector TSVECTOR NOT NULL,
+    -- The stream position of the event.
+    stream_pos BIGINT NOT NULL,
+    CONSTRAINT syncapi_event_search_unique UNIQUE (event_id, key)
+);
+
+CREATE INDEX IF NOT EXISTS syncapi_event_search_vector_idx ON syncapi_event_search USING GIN (vector);
+CREATE INDEX IF NOT EXISTS syncapi_event_search_room_id_idx ON syncapi_event_search (room_id, stream_pos);
+`
+
+const insertEventSearchSQL = "" +
+	"INSERT INTO syncapi_event_search (event_id, room_id, key, vector, stream_pos)" +
+	" VALUES ($1, $2, $3, to_tsvector('english', $4), $5)" +
+	" ON CONFLICT ON CONSTRAINT syncapi_event_search_unique DO NOTHING"
+
+const deleteEventSearchSQL = "" +
+	"DELETE FROM syncapi_event_search WHERE event_id = $1"
+
+const selectEventSearchByRankSQL = "" +
+	"SELECT event_id, room_id, ts_rank_cd(vector, query) AS rank, stream_pos" +
+	" FROM syncapi_event_search, plainto_tsquery('english', $1) AS query" +
+	" WHERE vector @@ query AND room_id = ANY($2) AND key = ANY($3)" +
+	" ORDER BY rank DESC, stream_pos DESC LIMIT $4 OFFSET $5"
+
+const selectEventSearchByRecencySQL = "" +
+	"SELECT event_id, room_id, ts_rank_cd(vector, query) AS rank, stream_pos" +
+	" FROM syncapi_event_search, plainto_tsquery('english', $1) AS query" +
+	" WHERE vector @@ query AND room_id = ANY($2) AND key = ANY($3) AND stream_pos < $5" +
+	" ORDER BY stream_pos DESC LIMIT $4"
+
+const selectEventSearchEventIDsSQL = "" +
+	"SELECT DISTINCT event_id" +
+	" FROM syncapi_event_search, plainto_tsquery('english', $1) AS query" +
+	" WHERE vector @@ query AND room_id = ANY($2) AND key = ANY($3)" +
+	" LIMIT $4"
+
+type eventSearchStatements struct {
+	insertEventSearchStmt          *sql.Stmt
+	deleteEventSearchStmt          *sql.Stmt
+	selectEventSearchByRankStmt    *sql.Stmt
+	selectEventSearchByRecencyStmt *sql.Stmt
+	selectEventSearchEventIDsStmt  *sql.Stmt
+}
+
+func (s *eventSearchStatements) prepare(db *sql.DB) (err error) {
+	_, err = db.Exec(eventSearchSchema)
+	if err != nil {
+		return
+	}
+	if s.insertEventSearchStmt, err = db.Prepare(insertEventSearchSQL); err != nil {
+		return
+	}
+	if s.deleteEventSearchStmt, err = db.Prepare(deleteEventSearchSQL); err != nil {
+		return
+	}
+	if s.selectEventSearchByRankStmt, err = db.Prepare(selectEventSearchByRankSQL); err != nil {
+		return
+	}
+	if s.selectEventSearchByRecencyStmt, err = db.Prepare(selectEventSearchByRecencySQL); err != nil {
+		return
+	}
+	if s.selectEventSearchEventIDsStmt, err = db.Prepare(selectEventSearchEventIDsSQL); err != nil {
+		return
+	}
+	return
+}
+
+func (s *eventSearchStatements) insertEventSearch(
+	ctx context.Context, eventID, roomID, key, value string, streamPos types.StreamPosition,
+) error {
+	_, err := s.insertEventSearchStmt.ExecContext(ctx, eventID, roomID, key, value, streamPos)
+	return err
+}
+
+func (s *eventSearchStatements) deleteEventSearch(
+	ctx context.Context, txn *sql.Tx, eventID string,
+) error {
+	stmt := common.TxStmt(txn, s.deleteEventSearchStmt)
+	_, err := stmt.ExecContext(ctx, eventID)
+	return err
+}
+
+// selectEventSearch returns the events of the given rooms whose content
+// under one of the given keys matches the search term. The results are
+// ordered by rank, skipping the first "from" results, or by recency, only
+// returning events before the stream position "from" if it isn't 0.
+func (s *eventSearchStatements) selectEventSearch(
+	ctx context.Context, searchTerm string, roomIDs, keys []string,
+	orderByRecency bool, from int64, limit int,
+) ([]types.SearchResult, error) {
+	var rows *sql.Rows
+	var err error
+	if orderByRecency {
+		if from == 0 {
+			from = math.MaxInt64
+		}
+		rows, err = s.selectEventSearchByRecencyStmt.QueryContext(
+			ctx, searchTerm, pq.StringArray(roomIDs), pq.StringArray(keys), limit, from,
+		)
+	} else {
+		rows, err = s.selectEventSearchByRankStmt.QueryContext(
+			ctx, searchTerm, pq.StringArray(roomIDs), pq.StringArray(keys), limit, from,
+		)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer common.CloseAndLogIfError(ctx, rows, "selectEventSearch: rows.close() failed")
+
+	var results []types.SearchResult
+	for rows.Next() {
+		var result types.SearchResult
+		if err = rows.Scan(&result.EventID, &result.RoomID, &result.Rank, &result.StreamPosition); err != nil {
+			return nil, err
+		}
+		results = append(results, result)
+	}
+	return results, rows.Err()
+}
+
+// selectEventSearchEventIDs returns the IDs of up to limit events of the given
+// rooms whose content under one of the given keys matches the search term.
+func (s *eventSearchStatements) selectEventSearchEventIDs(
+	ctx context.Context, searchTerm string, roomIDs, keys []string, limit int,
+) ([]string, error) {
+	rows, err := s.selectEventSearchEventIDsStmt.QueryContext(
+		ctx, searchTerm, pq.StringArray(roomIDs), pq.StringArray(keys), limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer common.CloseAndLogIfError(ctx, rows, "selectEventSearchEventIDs: rows.close() failed")
+
+	var eventIDs []string
+	for rows.Next() {
+		var eventID string
+		if err = rows.Scan(&eventID); err != nil {
+			return nil, err
+		}
+		eventIDs = append(eventIDs, eventID)
+	}
+	return eventIDs, rows.Err()
+}
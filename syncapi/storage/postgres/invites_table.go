@@ -26,8 +26,12 @@ import (
 )
 
 const inviteEventsSchema = `
+-- The invite stream has a position of its own, separate from the stream of
+-- events. It is shared with syncapi_retired_invite_events.
+CREATE SEQUENCE IF NOT EXISTS syncapi_invite_id;
+
 CREATE TABLE IF NOT EXISTS syncapi_invite_events (
-	id BIGINT PRIMARY KEY DEFAULT nextval('syncapi_stream_id'),
+	id BIGINT PRIMARY KEY DEFAULT nextval('syncapi_invite_id'),
 	event_id TEXT NOT NULL,
 	room_id TEXT NOT NULL,
 	target_user_id TEXT NOT NULL,
@@ -41,6 +45,12 @@ CREATE INDEX IF NOT EXISTS syncapi_invites_target_user_id_idx
 -- For deleting old invites
 CREATE INDEX IF NOT EXISTS syncapi_invites_event_id_idx
 	ON syncapi_invite_events (event_id);
+
+-- Invites used to be numbered from syncapi_stream_id, so move existing tables
+-- over to the new sequence and start it after the highest existing ID.
+ALTER TABLE syncapi_invite_events ALTER COLUMN id SET DEFAULT nextval('syncapi_invite_id');
+SELECT setval('syncapi_invite_id', MAX(id)) FROM syncapi_invite_events
+	HAVING MAX(id) > (SELECT CASE WHEN is_called THEN last_value ELSE last_value - 1 END FROM syncapi_invite_id);
 `
 
 const insertInviteEventSQL = "" +
@@ -49,7 +59,8 @@ const insertInviteEventSQL = "" +
 	") VALUES ($1, $2, $3, $4) RETURNING id"
 
 const deleteInviteEventSQL = "" +
-	"DELETE FROM syncapi_invite_events WHERE event_id = $1"
+	"DELETE FROM syncapi_invite_events WHERE event_id = $1" +
+	" RETURNING room_id, target_user_id"
 
 const selectInviteEventsInRangeSQL = "" +
 	"SELECT room_id, headered_event_json FROM syncapi_invite_events" +
@@ -105,11 +116,17 @@ func (s *inviteEventsStatements) insertInviteEvent(
 	return
 }
 
+// deleteInviteEvent deletes an invite and returns the room ID and the target
+// user ID of the invite, or empty strings if there is no such invite.
 func (s *inviteEventsStatements) deleteInviteEvent(
-	ctx context.Context, inviteEventID string,
-) error {
-	_, err := s.deleteInviteEventStmt.ExecContext(ctx, inviteEventID)
-	return err
+	ctx context.Context, txn *sql.Tx, inviteEventID string,
+) (roomID, targetUserID string, err error) {
+	stmt := common.TxStmt(txn, s.deleteInviteEventStmt)
+	err = stmt.QueryRowContext(ctx, inviteEventID).Scan(&roomID, &targetUserID)
+	if err == sql.ErrNoRows {
+		return "", "", nil
+	}
+	return
 }
 
 // selectInviteEventsInRange returns a map of room ID to invite event for the
@@ -0,0 +1,170 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/syncapi/types"
+)
+
+const keyChangesSchema = `
+CREATE SEQUENCE IF NOT EXISTS syncapi_key_change_id;
+
+-- Stores the stream position at which each user last changed their device keys.
+CREATE TABLE IF NOT EXISTS syncapi_key_changes (
+    -- An incrementing ID which denotes the position in the device list stream
+    -- that this change resides at.
+    id BIGINT PRIMARY KEY DEFAULT nextval('syncapi_key_change_id'),
+    -- The Matrix user ID of the user whose keys changed.
+    user_id TEXT NOT NULL,
+
+    CONSTRAINT syncapi_key_changes_unique UNIQUE (user_id)
+);
+`
+
+const upsertKeyChangeSQL = "" +
+	"INSERT INTO syncapi_key_changes (user_id) VALUES ($1)" +
+	" ON CONFLICT ON CONSTRAINT syncapi_key_changes_unique" +
+	" DO UPDATE SET id = nextval('syncapi_key_change_id')" +
+	" RETURNING id"
+
+// Selects the users whose keys changed in the given range and who are either
+// the given user or share a joined room with them.
+const selectKeyChangesInRangeSQL = "" +
+	"SELECT user_id FROM syncapi_key_changes" +
+	" WHERE id > $2 AND id <= $3 AND (user_id = $1 OR user_id IN (" +
+	"  SELECT state_key FROM syncapi_current_room_state" +
+	"  WHERE type = 'm.room.member' AND membership = 'join' AND room_id IN (" +
+	"   SELECT room_id FROM syncapi_current_room_state" +
+	"   WHERE type = 'm.room.member' AND membership = 'join' AND state_key = $1" +
+	"  )" +
+	" ))"
+
+// Selects the users who stopped sharing a joined room with the given user in
+// the given range of the event stream. Those are the users who left a room
+// that the given user is joined to and the users who are joined to a room
+// that the given user left, as long as they don't share another joined room.
+const selectUsersLeftInRangeSQL = "" +
+	"SELECT DISTINCT state_key FROM syncapi_current_room_state" +
+	" WHERE type = 'm.room.member' AND state_key != $1 AND ((" +
+	"  membership IN ('leave', 'ban') AND added_at > $2 AND added_at <= $3 AND room_id IN (" +
+	"   SELECT room_id FROM syncapi_current_room_state" +
+	"   WHERE type = 'm.room.member' AND membership = 'join' AND state_key = $1" +
+	"  )" +
+	" ) OR (" +
+	"  membership = 'join' AND room_id IN (" +
+	"   SELECT room_id FROM syncapi_current_room_state" +
+	"   WHERE type = 'm.room.member' AND membership IN ('leave', 'ban') AND state_key = $1" +
+	"   AND added_at > $2 AND added_at <= $3" +
+	"  )" +
+	" )) AND state_key NOT IN (" +
+	"  SELECT state_key FROM syncapi_current_room_state" +
+	"  WHERE type = 'm.room.member' AND membership = 'join' AND room_id IN (" +
+	"   SELECT room_id FROM syncapi_current_room_state" +
+	"   WHERE type = 'm.room.member' AND membership = 'join' AND state_key = $1" +
+	"  )" +
+	" )"
+
+const selectMaxKeyChangeIDSQL = "" +
+	"SELECT MAX(id) FROM syncapi_key_changes"
+
+type keyChangesStatements struct {
+	upsertKeyChangeStmt         *sql.Stmt
+	selectKeyChangesInRangeStmt *sql.Stmt
+	selectUsersLeftInRangeStmt  *sql.Stmt
+	selectMaxKeyChangeIDStmt    *sql.Stmt
+}
+
+func (s *keyChangesStatements) prepare(db *sql.DB) (err error) {
+	_, err = db.Exec(keyChangesSchema)
+	if err != nil {
+		return
+	}
+	if s.upsertKeyChangeStmt, err = db.Prepare(upsertKeyChangeSQL); err != nil {
+		return
+	}
+	if s.selectKeyChangesInRangeStmt, err = db.Prepare(selectKeyChangesInRangeSQL); err != nil {
+		return
+	}
+	if s.selectUsersLeftInRangeStmt, err = db.Prepare(selectUsersLeftInRangeSQL); err != nil {
+		return
+	}
+	if s.selectMaxKeyChangeIDStmt, err = db.Prepare(selectMaxKeyChangeIDSQL); err != nil {
+		return
+	}
+	return
+}
+
+func (s *keyChangesStatements) upsertKeyChange(
+	ctx context.Context, userID string,
+) (pos types.StreamPosition, err error) {
+	err = s.upsertKeyChangeStmt.QueryRowContext(ctx, userID).Scan(&pos)
+	return
+}
+
+func (s *keyChangesStatements) selectKeyChangesInRange(
+	ctx context.Context, userID string, oldPos, newPos types.StreamPosition,
+) ([]string, error) {
+	rows, err := s.selectKeyChangesInRangeStmt.QueryContext(ctx, userID, oldPos, newPos)
+	if err != nil {
+		return nil, err
+	}
+	defer common.CloseAndLogIfError(ctx, rows, "selectKeyChangesInRange: rows.close() failed")
+
+	var userIDs []string
+	for rows.Next() {
+		var changedUserID string
+		if err = rows.Scan(&changedUserID); err != nil {
+			return nil, err
+		}
+		userIDs = append(userIDs, changedUserID)
+	}
+	return userIDs, rows.Err()
+}
+
+func (s *keyChangesStatements) selectUsersLeftInRange(
+	ctx context.Context, userID string, oldPos, newPos types.StreamPosition,
+) ([]string, error) {
+	rows, err := s.selectUsersLeftInRangeStmt.QueryContext(ctx, userID, oldPos, newPos)
+	if err != nil {
+		return nil, err
+	}
+	defer common.CloseAndLogIfError(ctx, rows, "selectUsersLeftInRange: rows.close() failed")
+
+	var userIDs []string
+	for rows.Next() {
+		var leftUserID string
+		if err = rows.Scan(&leftUserID); err != nil {
+			return nil, err
+		}
+		userIDs = append(userIDs, leftUserID)
+	}
+	return userIDs, rows.Err()
+}
+
+func (s *keyChangesStatements) selectMaxKeyChangeID(
+	ctx context.Context, txn *sql.Tx,
+) (id int64, err error) {
+	var nullableID sql.NullInt64
+	stmt := common.TxStmt(txn, s.selectMaxKeyChangeIDStmt)
+	err = stmt.QueryRowContext(ctx).Scan(&nullableID)
+	if nullableID.Valid {
+		id = nullableID.Int64
+	}
+	return
+}
@@ -0,0 +1,139 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/syncapi/types"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const presenceSchema = `
+-- The presence stream has a position of its own, separate from the stream of
+-- events.
+CREATE SEQUENCE IF NOT EXISTS syncapi_presence_id;
+
+-- Stores the latest presence of each user.
+CREATE TABLE IF NOT EXISTS syncapi_presence (
+    -- An incrementing ID which denotes the position in the presence stream.
+    id BIGINT PRIMARY KEY DEFAULT nextval('syncapi_presence_id'),
+    -- The Matrix user ID of the user.
+    user_id TEXT NOT NULL CONSTRAINT syncapi_presence_user_id_unique UNIQUE,
+    -- The presence state of the user, e.g. "online".
+    presence TEXT NOT NULL,
+    -- The status message of the user.
+    status_msg TEXT NOT NULL DEFAULT '',
+    -- When the user was last active, in milliseconds since the epoch.
+    last_active_ts BIGINT NOT NULL,
+    -- Whether the user is actively using their client.
+    currently_active BOOLEAN NOT NULL
+);
+`
+
+const upsertPresenceSQL = "" +
+	"INSERT INTO syncapi_presence (user_id, presence, status_msg, last_active_ts, currently_active)" +
+	" VALUES ($1, $2, $3, $4, $5)" +
+	" ON CONFLICT ON CONSTRAINT syncapi_presence_user_id_unique" +
+	" DO UPDATE SET id = nextval('syncapi_presence_id')," +
+	" presence = $2, status_msg = $3, last_active_ts = $4, currently_active = $5" +
+	" RETURNING id"
+
+// Selects the presence that changed after the given position of users who
+// are either the given user or share a joined room with them.
+const selectPresenceAfterSQL = "" +
+	"SELECT user_id, presence, status_msg, last_active_ts, currently_active FROM syncapi_presence" +
+	" WHERE id > $2 AND (user_id = $1 OR user_id IN (" +
+	"  SELECT state_key FROM syncapi_current_room_state" +
+	"  WHERE type = 'm.room.member' AND membership = 'join' AND room_id IN (" +
+	"   SELECT room_id FROM syncapi_current_room_state" +
+	"   WHERE type = 'm.room.member' AND membership = 'join' AND state_key = $1" +
+	"  )" +
+	" ))"
+
+const selectMaxPresenceIDSQL = "" +
+	"SELECT MAX(id) FROM syncapi_presence"
+
+type presenceStatements struct {
+	upsertPresenceStmt      *sql.Stmt
+	selectPresenceAfterStmt *sql.Stmt
+	selectMaxPresenceIDStmt *sql.Stmt
+}
+
+func (s *presenceStatements) prepare(db *sql.DB) (err error) {
+	_, err = db.Exec(presenceSchema)
+	if err != nil {
+		return
+	}
+	if s.upsertPresenceStmt, err = db.Prepare(upsertPresenceSQL); err != nil {
+		return
+	}
+	if s.selectPresenceAfterStmt, err = db.Prepare(selectPresenceAfterSQL); err != nil {
+		return
+	}
+	if s.selectMaxPresenceIDStmt, err = db.Prepare(selectMaxPresenceIDSQL); err != nil {
+		return
+	}
+	return
+}
+
+func (s *presenceStatements) upsertPresence(
+	ctx context.Context, txn *sql.Tx, presence types.Presence,
+) (pos types.StreamPosition, err error) {
+	stmt := common.TxStmt(txn, s.upsertPresenceStmt)
+	err = stmt.QueryRowContext(
+		ctx, presence.UserID, presence.Presence, presence.StatusMsg,
+		int64(presence.LastActiveTS), presence.CurrentlyActive,
+	).Scan(&pos)
+	return
+}
+
+// selectPresenceAfter returns the presence of the users who are visible to
+// the given user and whose presence changed after the given position.
+func (s *presenceStatements) selectPresenceAfter(
+	ctx context.Context, userID string, pos types.StreamPosition,
+) ([]types.Presence, error) {
+	rows, err := s.selectPresenceAfterStmt.QueryContext(ctx, userID, pos)
+	if err != nil {
+		return nil, err
+	}
+	defer common.CloseAndLogIfError(ctx, rows, "selectPresenceAfter: rows.close() failed")
+
+	var result []types.Presence
+	for rows.Next() {
+		var p types.Presence
+		var lastActiveTS int64
+		if err = rows.Scan(&p.UserID, &p.Presence, &p.StatusMsg, &lastActiveTS, &p.CurrentlyActive); err != nil {
+			return nil, err
+		}
+		p.LastActiveTS = gomatrixserverlib.Timestamp(lastActiveTS)
+		result = append(result, p)
+	}
+	return result, rows.Err()
+}
+
+func (s *presenceStatements) selectMaxPresenceID(
+	ctx context.Context, txn *sql.Tx,
+) (id int64, err error) {
+	var nullableID sql.NullInt64
+	stmt := common.TxStmt(txn, s.selectMaxPresenceIDStmt)
+	err = stmt.QueryRowContext(ctx).Scan(&nullableID)
+	if nullableID.Valid {
+		id = nullableID.Int64
+	}
+	return
+}
@@ -0,0 +1,133 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/lib/pq"
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/syncapi/types"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const receiptsSchema = `
+-- The receipt stream has a position of its own, separate from the stream of
+-- events.
+CREATE SEQUENCE IF NOT EXISTS syncapi_receipt_id;
+
+-- Stores the latest receipt of each type that each user sent in each room.
+CREATE TABLE IF NOT EXISTS syncapi_receipts (
+    -- An incrementing ID which denotes the position in the receipt stream.
+    id BIGINT PRIMARY KEY DEFAULT nextval('syncapi_receipt_id'),
+    -- The room the receipt is for.
+    room_id TEXT NOT NULL,
+    -- The type of the receipt, e.g. "m.read".
+    receipt_type TEXT NOT NULL,
+    -- The Matrix user ID of the user who sent the receipt.
+    user_id TEXT NOT NULL,
+    -- The ID of the event that the receipt is for.
+    event_id TEXT NOT NULL,
+    -- The time at which the receipt was sent, in milliseconds since the epoch.
+    receipt_ts BIGINT NOT NULL,
+
+    CONSTRAINT syncapi_receipts_unique UNIQUE (room_id, receipt_type, user_id)
+);
+
+CREATE INDEX IF NOT EXISTS syncapi_receipts_room_id_idx ON syncapi_receipts(room_id);
+`
+
+const upsertReceiptSQL = "" +
+	"INSERT INTO syncapi_receipts (room_id, receipt_type, user_id, event_id, receipt_ts)" +
+	" VALUES ($1, $2, $3, $4, $5)" +
+	" ON CONFLICT ON CONSTRAINT syncapi_receipts_unique" +
+	" DO UPDATE SET id = nextval('syncapi_receipt_id'), event_id = $4, receipt_ts = $5" +
+	" RETURNING id"
+
+const selectRoomReceiptsAfterSQL = "" +
+	"SELECT room_id, receipt_type, user_id, event_id, receipt_ts FROM syncapi_receipts" +
+	" WHERE room_id = ANY($1) AND id > $2"
+
+const selectMaxReceiptIDSQL = "" +
+	"SELECT MAX(id) FROM syncapi_receipts"
+
+type receiptStatements struct {
+	upsertReceiptStmt           *sql.Stmt
+	selectRoomReceiptsAfterStmt *sql.Stmt
+	selectMaxReceiptIDStmt      *sql.Stmt
+}
+
+func (s *receiptStatements) prepare(db *sql.DB) (err error) {
+	_, err = db.Exec(receiptsSchema)
+	if err != nil {
+		return
+	}
+	if s.upsertReceiptStmt, err = db.Prepare(upsertReceiptSQL); err != nil {
+		return
+	}
+	if s.selectRoomReceiptsAfterStmt, err = db.Prepare(selectRoomReceiptsAfterSQL); err != nil {
+		return
+	}
+	if s.selectMaxReceiptIDStmt, err = db.Prepare(selectMaxReceiptIDSQL); err != nil {
+		return
+	}
+	return
+}
+
+func (s *receiptStatements) upsertReceipt(
+	ctx context.Context, txn *sql.Tx,
+	roomID, receiptType, userID, eventID string, timestamp gomatrixserverlib.Timestamp,
+) (pos types.StreamPosition, err error) {
+	stmt := common.TxStmt(txn, s.upsertReceiptStmt)
+	err = stmt.QueryRowContext(ctx, roomID, receiptType, userID, eventID, int64(timestamp)).Scan(&pos)
+	return
+}
+
+// selectRoomReceiptsAfter returns the receipts in the given rooms that were
+// sent after the given position.
+func (s *receiptStatements) selectRoomReceiptsAfter(
+	ctx context.Context, roomIDs []string, pos types.StreamPosition,
+) ([]common.Receipt, error) {
+	rows, err := s.selectRoomReceiptsAfterStmt.QueryContext(ctx, pq.StringArray(roomIDs), pos)
+	if err != nil {
+		return nil, err
+	}
+	defer common.CloseAndLogIfError(ctx, rows, "selectRoomReceiptsAfter: rows.close() failed")
+
+	var receipts []common.Receipt
+	for rows.Next() {
+		var r common.Receipt
+		var timestamp int64
+		if err = rows.Scan(&r.RoomID, &r.Type, &r.UserID, &r.EventID, &timestamp); err != nil {
+			return nil, err
+		}
+		r.Timestamp = gomatrixserverlib.Timestamp(timestamp)
+		receipts = append(receipts, r)
+	}
+	return receipts, rows.Err()
+}
+
+func (s *receiptStatements) selectMaxReceiptID(
+	ctx context.Context, txn *sql.Tx,
+) (id int64, err error) {
+	var nullableID sql.NullInt64
+	stmt := common.TxStmt(txn, s.selectMaxReceiptIDStmt)
+	err = stmt.QueryRowContext(ctx).Scan(&nullableID)
+	if nullableID.Valid {
+		id = nullableID.Int64
+	}
+	return
+}
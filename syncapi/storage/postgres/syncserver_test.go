@@ -0,0 +1,114 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/matrix-org/dendrite/syncapi/types"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+func mustMemberEvent(
+	t *testing.T, pos types.StreamPosition, roomID, userID, membership, unsigned string,
+) types.StreamEvent {
+	eventJSON := fmt.Sprintf(
+		`{"event_id":"$%d:localhost","room_id":%q,"type":"m.room.member","state_key":%q,`+
+			`"sender":%q,"content":{"membership":%q},"unsigned":%s,"origin_server_ts":0,`+
+			`"prev_events":[],"auth_events":[],"depth":1}`,
+		pos, roomID, userID, userID, membership, unsigned,
+	)
+	ev, err := gomatrixserverlib.NewEventFromTrustedJSON([]byte(eventJSON), false, gomatrixserverlib.RoomVersionV1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return types.StreamEvent{
+		HeaderedEvent:  ev.Headered(gomatrixserverlib.RoomVersionV1),
+		StreamPosition: pos,
+	}
+}
+
+func TestPrevMembershipFromEvent(t *testing.T) {
+	for unsigned, want := range map[string]string{
+		`{}`:                      "",
+		`{"prev_content":{}}`:     "",
+		`{"prev_content":"join"}`: "",
+		`{"prev_content":{"membership":"invite"}}`:                              "invite",
+		`{"prev_content":{"membership":"leave"}}`:                               "leave",
+		`{"replaces_state":"$0:localhost"}`:                                     "",
+		`{"prev_content":{"membership":["join"]}}`:                              "",
+		`{"prev_sender":"@bob:localhost","prev_content":{"membership":"join"}}`: "join",
+	} {
+		ev := mustMemberEvent(t, 1, "!room:localhost", "@alice:localhost", "join", unsigned)
+		if got := prevMembershipFromEvent(&ev.HeaderedEvent); got != want {
+			t.Errorf("unsigned %s: got membership %q, want %q", unsigned, got, want)
+		}
+	}
+}
+
+func TestGetMembershipChanges(t *testing.T) {
+	const alice, bob = "@alice:localhost", "@bob:localhost"
+	events := []types.StreamEvent{
+		// Alice changes her display name in a room she was already in.
+		mustMemberEvent(t, 1, "!noop:localhost", alice, "join", `{"prev_content":{"membership":"join"}}`),
+		// Alice joins a room and then leaves it again.
+		mustMemberEvent(t, 2, "!left:localhost", alice, "join", `{}`),
+		mustMemberEvent(t, 5, "!left:localhost", alice, "leave", `{"prev_content":{"membership":"join"}}`),
+		// Alice accepts an invite.
+		mustMemberEvent(t, 3, "!joined:localhost", alice, "join", `{"prev_content":{"membership":"invite"}}`),
+		// Alice leaves and rejoins a room, which is a change even though she
+		// ends up joined to it.
+		mustMemberEvent(t, 4, "!rejoined:localhost", alice, "leave", `{"prev_content":{"membership":"join"}}`),
+		mustMemberEvent(t, 6, "!rejoined:localhost", alice, "join", `{"prev_content":{"membership":"leave"}}`),
+		// Bob's membership doesn't concern Alice.
+		mustMemberEvent(t, 7, "!bob:localhost", bob, "join", `{}`),
+	}
+	eventMap := make(map[string]types.StreamEvent)
+	for _, ev := range events {
+		eventMap[ev.EventID()] = ev
+	}
+
+	changes := getMembershipChanges(eventMap, alice)
+	for roomID, want := range map[string]struct {
+		membership string
+		latestPos  types.StreamPosition
+		changed    bool
+	}{
+		"!noop:localhost":     {gomatrixserverlib.Join, 1, false},
+		"!left:localhost":     {gomatrixserverlib.Leave, 5, true},
+		"!joined:localhost":   {gomatrixserverlib.Join, 3, true},
+		"!rejoined:localhost": {gomatrixserverlib.Join, 6, true},
+	} {
+		change, ok := changes[roomID]
+		if !ok {
+			t.Errorf("%s: no membership change", roomID)
+			continue
+		}
+		if change.membership != want.membership || change.latest.StreamPosition != want.latestPos || change.changed != want.changed {
+			t.Errorf(
+				"%s: got membership %s at %d (changed: %v), want %s at %d (changed: %v)", roomID,
+				change.membership, change.latest.StreamPosition, change.changed,
+				want.membership, want.latestPos, want.changed,
+			)
+		}
+	}
+	if _, ok := changes["!bob:localhost"]; ok {
+		t.Error("got a membership change for a room with only another user's membership")
+	}
+	if len(changes) != 4 {
+		t.Errorf("got %d membership changes, want 4", len(changes))
+	}
+}
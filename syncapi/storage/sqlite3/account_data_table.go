@@ -33,6 +33,12 @@ CREATE TABLE IF NOT EXISTS syncapi_account_data_type (
     type TEXT NOT NULL,
     UNIQUE (user_id, room_id, type)
 );
+
+-- Account data used to be numbered from the global stream, so start the
+-- account data stream after the highest existing ID.
+UPDATE syncapi_stream_id
+  SET stream_id = MAX(stream_id, (SELECT COALESCE(MAX(id), 0) FROM syncapi_account_data_type))
+  WHERE stream_name = 'account_data';
 `
 
 const insertAccountDataSQL = "" +
@@ -77,7 +83,7 @@ func (s *accountDataStatements) insertAccountData(
 	ctx context.Context, txn *sql.Tx,
 	userID, roomID, dataType string,
 ) (pos types.StreamPosition, err error) {
-	pos, err = s.streamIDStatements.nextStreamID(ctx, txn)
+	pos, err = s.streamIDStatements.nextAccountDataID(ctx, txn)
 	if err != nil {
 		return
 	}
@@ -121,15 +127,8 @@ func (s *accountDataStatements) selectAccountDataInRange(
 		// and positional parameters makes the query annoyingly hard to do, it's easier
 		// and clearer to do it in Go-land. If there are no filters for [not]types then
 		// this gets skipped.
-		for _, includeType := range accountDataFilterPart.Types {
-			if includeType != dataType { // TODO: wildcard support
-				continue
-			}
-		}
-		for _, excludeType := range accountDataFilterPart.NotTypes {
-			if excludeType == dataType { // TODO: wildcard support
-				continue
-			}
+		if !types.FilterAllowsType(accountDataFilterPart.Types, accountDataFilterPart.NotTypes, dataType) {
+			continue
 		}
 
 		if len(data[roomID]) > 0 {
@@ -73,6 +73,9 @@ const selectJoinedUsersSQL = "" +
 const selectStateEventSQL = "" +
 	"SELECT headered_event_json FROM syncapi_current_room_state WHERE room_id = $1 AND type = $2 AND state_key = $3"
 
+const updateStateEventJSONSQL = "" +
+	"UPDATE syncapi_current_room_state SET headered_event_json = $1 WHERE event_id = $2"
+
 const selectEventsWithEventIDsSQL = "" +
 	// TODO: The session_id and transaction_id blanks are here because otherwise
 	// the rowsToStreamEvents expects there to be exactly five columns. We need to
@@ -89,6 +92,7 @@ type currentRoomStateStatements struct {
 	selectCurrentStateStmt          *sql.Stmt
 	selectJoinedUsersStmt           *sql.Stmt
 	selectStateEventStmt            *sql.Stmt
+	updateStateEventJSONStmt        *sql.Stmt
 }
 
 func (s *currentRoomStateStatements) prepare(db *sql.DB, streamID *streamIDStatements) (err error) {
@@ -115,6 +119,9 @@ func (s *currentRoomStateStatements) prepare(db *sql.DB, streamID *streamIDState
 	if s.selectStateEventStmt, err = db.Prepare(selectStateEventSQL); err != nil {
 		return
 	}
+	if s.updateStateEventJSONStmt, err = db.Prepare(updateStateEventJSONSQL); err != nil {
+		return
+	}
 	return
 }
 
@@ -231,6 +238,20 @@ func (s *currentRoomStateStatements) upsertRoomState(
 	return err
 }
 
+// updateStateEventJSON replaces the JSON of a state event, which is done when the
+// event gets redacted.
+func (s *currentRoomStateStatements) updateStateEventJSON(
+	ctx context.Context, txn *sql.Tx, event *gomatrixserverlib.HeaderedEvent,
+) error {
+	headeredJSON, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	stmt := common.TxStmt(txn, s.updateStateEventJSONStmt)
+	_, err = stmt.ExecContext(ctx, headeredJSON, event.EventID())
+	return err
+}
+
 func (s *currentRoomStateStatements) selectEventsWithEventIDs(
 	ctx context.Context, txn *sql.Tx, eventIDs []string,
 ) ([]types.StreamEvent, error) {
@@ -254,7 +275,6 @@ func rowsToEvents(rows *sql.Rows) ([]gomatrixserverlib.HeaderedEvent, error) {
 		if err := rows.Scan(&eventBytes); err != nil {
 			return nil, err
 		}
-		// TODO: Handle redacted events
 		var ev gomatrixserverlib.HeaderedEvent
 		if err := json.Unmarshal(eventBytes, &ev); err != nil {
 			return nil, err
@@ -265,9 +285,9 @@ func rowsToEvents(rows *sql.Rows) ([]gomatrixserverlib.HeaderedEvent, error) {
 }
 
 func (s *currentRoomStateStatements) selectStateEvent(
-	ctx context.Context, roomID, evType, stateKey string,
+	ctx context.Context, txn *sql.Tx, roomID, evType, stateKey string,
 ) (*gomatrixserverlib.HeaderedEvent, error) {
-	stmt := s.selectStateEventStmt
+	stmt := common.TxStmt(txn, s.selectStateEventStmt)
 	var res []byte
 	err := stmt.QueryRowContext(ctx, roomID, evType, stateKey).Scan(&res)
 	if err == sql.ErrNoRows {
@@ -0,0 +1,235 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/syncapi/types"
+	log "github.com/sirupsen/logrus"
+)
+
+// The searchable text of events is kept in an FTS5 table, which needs SQLite
+// to be built with FTS5 support, e.g. by building Dendrite with the
+// "sqlite_fts5" tag.
+const eventSearchSchema = `
+-- Stores the searchable text of events, for the /search API. "value" is the
+-- indexed content of the event under "key", e.g. "content.body".
+CREATE VIRTUAL TABLE IF NOT EXISTS syncapi_event_search USING fts5(
+    value, event_id UNINDEXED, room_id UNINDEXED, key UNINDEXED, stream_pos UNINDEXED
+);
+`
+
+const insertEventSearchSQL = "" +
+	"INSERT INTO syncapi_event_search (value, event_id, room_id, key, stream_pos)" +
+	" VALUES ($1, $2, $3, $4, $5)"
+
+const deleteEventSearchSQL = "" +
+	"DELETE FROM syncapi_event_search WHERE event_id = $1"
+
+// FTS5 tables can't have constraints, so the existing row of the event and
+// key is deleted before inserting, in case the event is indexed again.
+const deleteEventSearchKeySQL = "" +
+	"DELETE FROM syncapi_event_search WHERE event_id = $1 AND key = $2"
+
+// The lists of rooms and keys are filled in when the query is run, and the
+// limit and offset are appended after them. SQLite numbers the parameters in
+// the order that they appear in the query.
+const selectEventSearchSQL = "" +
+	"SELECT event_id, room_id, -bm25(syncapi_event_search) AS score, stream_pos" +
+	" FROM syncapi_event_search" +
+	" WHERE syncapi_event_search MATCH $1 AND stream_pos < $2" +
+	" AND room_id IN ($3) AND key IN ($4)"
+
+const selectEventSearchByRankSQL = "" +
+	selectEventSearchSQL + " ORDER BY score DESC, stream_pos DESC"
+
+const selectEventSearchByRecencySQL = "" +
+	selectEventSearchSQL + " ORDER BY stream_pos DESC"
+
+const selectEventSearchEventIDsSQL = "" +
+	"SELECT DISTINCT event_id FROM syncapi_event_search" +
+	" WHERE syncapi_event_search MATCH $1 AND room_id IN ($2) AND key IN ($3)"
+
+var errSearchUnsupported = errors.New("full-text search needs SQLite to be built with FTS5")
+
+type eventSearchStatements struct {
+	db *sql.DB
+	// Whether SQLite was built without FTS5, in which case events aren't
+	// indexed and searches fail.
+	unsupported              bool
+	insertEventSearchStmt    *sql.Stmt
+	deleteEventSearchStmt    *sql.Stmt
+	deleteEventSearchKeyStmt *sql.Stmt
+}
+
+func (s *eventSearchStatements) prepare(db *sql.DB) (err error) {
+	s.db = db
+	_, err = db.Exec(eventSearchSchema)
+	if err != nil {
+		if strings.Contains(err.Error(), "fts5") {
+			log.WithError(err).Warn("SQLite was built without FTS5, /search is disabled")
+			s.unsupported = true
+			return nil
+		}
+		return
+	}
+	if s.insertEventSearchStmt, err = db.Prepare(insertEventSearchSQL); err != nil {
+		return
+	}
+	if s.deleteEventSearchStmt, err = db.Prepare(deleteEventSearchSQL); err != nil {
+		return
+	}
+	if s.deleteEventSearchKeyStmt, err = db.Prepare(deleteEventSearchKeySQL); err != nil {
+		return
+	}
+	return
+}
+
+func (s *eventSearchStatements) insertEventSearch(
+	ctx context.Context, txn *sql.Tx, eventID, roomID, key, value string, streamPos types.StreamPosition,
+) error {
+	if s.unsupported {
+		return nil
+	}
+	if _, err := common.TxStmt(txn, s.deleteEventSearchKeyStmt).ExecContext(ctx, eventID, key); err != nil {
+		return err
+	}
+	_, err := common.TxStmt(txn, s.insertEventSearchStmt).ExecContext(ctx, value, eventID, roomID, key, streamPos)
+	return err
+}
+
+func (s *eventSearchStatements) deleteEventSearch(
+	ctx context.Context, txn *sql.Tx, eventID string,
+) error {
+	if s.unsupported {
+		return nil
+	}
+	stmt := common.TxStmt(txn, s.deleteEventSearchStmt)
+	_, err := stmt.ExecContext(ctx, eventID)
+	return err
+}
+
+// selectEventSearch returns the events of the given rooms whose content
+// under one of the given keys matches the search term. The results are
+// ordered by rank, skipping the first "from" results, or by recency, only
+// returning events before the stream position "from" if it isn't 0.
+func (s *eventSearchStatements) selectEventSearch(
+	ctx context.Context, searchTerm string, roomIDs, keys []string,
+	orderByRecency bool, from int64, limit int,
+) ([]types.SearchResult, error) {
+	if s.unsupported {
+		return nil, errSearchUnsupported
+	}
+	match := ftsMatchQuery(searchTerm)
+	if match == "" || len(roomIDs) == 0 || len(keys) == 0 {
+		return nil, nil
+	}
+	query, offset, before := selectEventSearchByRankSQL, from, int64(math.MaxInt64)
+	if orderByRecency {
+		query, offset = selectEventSearchByRecencySQL, 0
+		if from != 0 {
+			before = from
+		}
+	}
+	params := []interface{}{match, before}
+	query, params = withRoomsAndKeys(query, "($3)", "($4)", params, roomIDs, keys)
+	query += fmt.Sprintf(" LIMIT $%d OFFSET $%d", len(params)+1, len(params)+2)
+	params = append(params, limit, offset)
+
+	rows, err := s.db.QueryContext(ctx, query, params...)
+	if err != nil {
+		return nil, err
+	}
+	defer common.CloseAndLogIfError(ctx, rows, "selectEventSearch: rows.close() failed")
+
+	var results []types.SearchResult
+	for rows.Next() {
+		var result types.SearchResult
+		if err = rows.Scan(&result.EventID, &result.RoomID, &result.Rank, &result.StreamPosition); err != nil {
+			return nil, err
+		}
+		results = append(results, result)
+	}
+	return results, rows.Err()
+}
+
+// selectEventSearchEventIDs returns the IDs of up to limit events of the given
+// rooms whose content under one of the given keys matches the search term.
+func (s *eventSearchStatements) selectEventSearchEventIDs(
+	ctx context.Context, searchTerm string, roomIDs, keys []string, limit int,
+) ([]string, error) {
+	if s.unsupported {
+		return nil, errSearchUnsupported
+	}
+	match := ftsMatchQuery(searchTerm)
+	if match == "" || len(roomIDs) == 0 || len(keys) == 0 {
+		return nil, nil
+	}
+	query, params := withRoomsAndKeys(
+		selectEventSearchEventIDsSQL, "($2)", "($3)", []interface{}{match}, roomIDs, keys,
+	)
+	query += fmt.Sprintf(" LIMIT $%d", len(params)+1)
+	params = append(params, limit)
+	rows, err := s.db.QueryContext(ctx, query, params...)
+	if err != nil {
+		return nil, err
+	}
+	defer common.CloseAndLogIfError(ctx, rows, "selectEventSearchEventIDs: rows.close() failed")
+
+	var eventIDs []string
+	for rows.Next() {
+		var eventID string
+		if err = rows.Scan(&eventID); err != nil {
+			return nil, err
+		}
+		eventIDs = append(eventIDs, eventID)
+	}
+	return eventIDs, rows.Err()
+}
+
+// withRoomsAndKeys fills in the lists of room IDs and keys of a query. Their
+// parameters are appended to the given ones.
+func withRoomsAndKeys(
+	query, roomsPlaceholder, keysPlaceholder string, params []interface{},
+	roomIDs, keys []string,
+) (string, []interface{}) {
+	query = strings.Replace(query, roomsPlaceholder, common.QueryVariadicOffset(len(roomIDs), len(params)), 1)
+	query = strings.Replace(query, keysPlaceholder, common.QueryVariadicOffset(len(keys), len(params)+len(roomIDs)), 1)
+	for _, roomID := range roomIDs {
+		params = append(params, roomID)
+	}
+	for _, key := range keys {
+		params = append(params, key)
+	}
+	return query, params
+}
+
+// ftsMatchQuery turns a search term into an FTS5 query which matches the
+// events containing all of its words. The words are quoted so that the FTS5
+// query syntax in the search term isn't interpreted.
+func ftsMatchQuery(searchTerm string) string {
+	words := strings.Fields(searchTerm)
+	for i, word := range words {
+		words[i] = `"` + strings.Replace(word, `"`, `""`, -1) + `"`
+	}
+	return strings.Join(words, " ")
+}
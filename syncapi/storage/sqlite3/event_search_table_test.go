@@ -0,0 +1,89 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+
+	"github.com/matrix-org/dendrite/common"
+)
+
+func TestFTSMatchQuery(t *testing.T) {
+	for searchTerm, want := range map[string]string{
+		"":                    "",
+		"   ":                 "",
+		"hello":               `"hello"`,
+		"  hello   world ":    `"hello" "world"`,
+		`say "hi"`:            `"say" """hi"""`,
+		"body:secret OR NOT*": `"body:secret" "OR" "NOT*"`,
+	} {
+		if got := ftsMatchQuery(searchTerm); got != want {
+			t.Errorf("ftsMatchQuery(%q): got %s, want %s", searchTerm, got, want)
+		}
+	}
+}
+
+func TestEventSearchIndexesEventsOnce(t *testing.T) {
+	db, err := sql.Open(common.SQLiteDriverName(), "file::memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close() // nolint: errcheck
+	var s eventSearchStatements
+	if err = s.prepare(db); err != nil {
+		t.Fatal(err)
+	}
+	if s.unsupported {
+		t.Skip("SQLite was built without FTS5")
+	}
+
+	ctx := context.Background()
+	// The same event is indexed twice, e.g. because Kafka redelivered it.
+	for i := 0; i < 2; i++ {
+		if err = s.insertEventSearch(ctx, nil, "$a:localhost", "!room:localhost", "content.body", "hello world", 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = s.insertEventSearch(ctx, nil, "$a:localhost", "!room:localhost", "content.name", "hello", 1); err != nil {
+		t.Fatal(err)
+	}
+
+	rooms, keys := []string{"!room:localhost"}, []string{"content.body", "content.name"}
+	results, err := s.selectEventSearch(ctx, "hello", rooms, keys, false, 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 {
+		t.Errorf("got %d results, want one for each key", len(results))
+	}
+	eventIDs, err := s.selectEventSearchEventIDs(ctx, "hello", rooms, keys, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(eventIDs) != 1 || eventIDs[0] != "$a:localhost" {
+		t.Errorf("got matching event IDs %v, want [$a:localhost]", eventIDs)
+	}
+	if err = s.insertEventSearch(ctx, nil, "$b:localhost", "!room:localhost", "content.body", "hello again", 2); err != nil {
+		t.Fatal(err)
+	}
+	if eventIDs, err = s.selectEventSearchEventIDs(ctx, "hello", rooms, keys, 1); err != nil {
+		t.Fatal(err)
+	}
+	if len(eventIDs) != 1 {
+		t.Errorf("got matching event IDs %v, want only one of them", eventIDs)
+	}
+}
@@ -36,6 +36,12 @@ CREATE TABLE IF NOT EXISTS syncapi_invite_events (
 
 CREATE INDEX IF NOT EXISTS syncapi_invites_target_user_id_idx ON syncapi_invite_events (target_user_id, id);
 CREATE INDEX IF NOT EXISTS syncapi_invites_event_id_idx ON syncapi_invite_events (event_id);
+
+-- Invites used to be numbered from the global stream, so start the invite
+-- stream after the highest existing ID.
+UPDATE syncapi_stream_id
+  SET stream_id = MAX(stream_id, (SELECT COALESCE(MAX(id), 0) FROM syncapi_invite_events))
+  WHERE stream_name = 'invite';
 `
 
 const insertInviteEventSQL = "" +
@@ -43,6 +49,9 @@ const insertInviteEventSQL = "" +
 	" (id, room_id, event_id, target_user_id, headered_event_json)" +
 	" VALUES ($1, $2, $3, $4, $5)"
 
+const selectInviteEventSQL = "" +
+	"SELECT room_id, target_user_id FROM syncapi_invite_events WHERE event_id = $1"
+
 const deleteInviteEventSQL = "" +
 	"DELETE FROM syncapi_invite_events WHERE event_id = $1"
 
@@ -58,6 +67,7 @@ type inviteEventsStatements struct {
 	streamIDStatements            *streamIDStatements
 	insertInviteEventStmt         *sql.Stmt
 	selectInviteEventsInRangeStmt *sql.Stmt
+	selectInviteEventStmt         *sql.Stmt
 	deleteInviteEventStmt         *sql.Stmt
 	selectMaxInviteIDStmt         *sql.Stmt
 }
@@ -74,6 +84,9 @@ func (s *inviteEventsStatements) prepare(db *sql.DB, streamID *streamIDStatement
 	if s.selectInviteEventsInRangeStmt, err = db.Prepare(selectInviteEventsInRangeSQL); err != nil {
 		return
 	}
+	if s.selectInviteEventStmt, err = db.Prepare(selectInviteEventSQL); err != nil {
+		return
+	}
 	if s.deleteInviteEventStmt, err = db.Prepare(deleteInviteEventSQL); err != nil {
 		return
 	}
@@ -103,11 +116,20 @@ func (s *inviteEventsStatements) insertInviteEvent(
 	return
 }
 
+// deleteInviteEvent deletes an invite and returns the room ID and the target
+// user ID of the invite, or empty strings if there is no such invite.
 func (s *inviteEventsStatements) deleteInviteEvent(
-	ctx context.Context, inviteEventID string,
-) error {
-	_, err := s.deleteInviteEventStmt.ExecContext(ctx, inviteEventID)
-	return err
+	ctx context.Context, txn *sql.Tx, inviteEventID string,
+) (roomID, targetUserID string, err error) {
+	err = txn.Stmt(s.selectInviteEventStmt).QueryRowContext(ctx, inviteEventID).Scan(&roomID, &targetUserID)
+	if err == sql.ErrNoRows {
+		return "", "", nil
+	}
+	if err != nil {
+		return
+	}
+	_, err = txn.Stmt(s.deleteInviteEventStmt).ExecContext(ctx, inviteEventID)
+	return
 }
 
 // selectInviteEventsInRange returns a map of room ID to invite event for the
@@ -0,0 +1,99 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/common"
+)
+
+const lazyLoadedMembersSchema = `
+-- Stores the membership events that have been sent to each device of a user
+-- that lazy-loads the members of its rooms, so that they aren't sent again.
+CREATE TABLE IF NOT EXISTS syncapi_lazy_loaded_members (
+    -- The user ID of the owner of the device.
+    user_id TEXT NOT NULL,
+    -- The ID of the device.
+    device_id TEXT NOT NULL,
+    -- The ID of the room.
+    room_id TEXT NOT NULL,
+    -- The user ID of the member, i.e. the state key of the membership event.
+    member_user_id TEXT NOT NULL,
+    -- The ID of the membership event that was sent to the device.
+    event_id TEXT NOT NULL,
+    UNIQUE (user_id, device_id, room_id, member_user_id)
+);
+`
+
+const upsertLazyLoadedMemberSQL = "" +
+	"INSERT INTO syncapi_lazy_loaded_members (user_id, device_id, room_id, member_user_id, event_id)" +
+	" VALUES ($1, $2, $3, $4, $5)" +
+	" ON CONFLICT (user_id, device_id, room_id, member_user_id)" +
+	" DO UPDATE SET event_id = excluded.event_id"
+
+const selectLazyLoadedMembersSQL = "" +
+	"SELECT member_user_id, event_id FROM syncapi_lazy_loaded_members" +
+	" WHERE user_id = $1 AND device_id = $2 AND room_id = $3"
+
+type lazyLoadedMembersStatements struct {
+	upsertLazyLoadedMemberStmt  *sql.Stmt
+	selectLazyLoadedMembersStmt *sql.Stmt
+}
+
+func (s *lazyLoadedMembersStatements) prepare(db *sql.DB) (err error) {
+	_, err = db.Exec(lazyLoadedMembersSchema)
+	if err != nil {
+		return
+	}
+	if s.upsertLazyLoadedMemberStmt, err = db.Prepare(upsertLazyLoadedMemberSQL); err != nil {
+		return
+	}
+	if s.selectLazyLoadedMembersStmt, err = db.Prepare(selectLazyLoadedMembersSQL); err != nil {
+		return
+	}
+	return
+}
+
+func (s *lazyLoadedMembersStatements) upsertLazyLoadedMember(
+	ctx context.Context, txn *sql.Tx, userID, deviceID, roomID, memberUserID, eventID string,
+) error {
+	stmt := common.TxStmt(txn, s.upsertLazyLoadedMemberStmt)
+	_, err := stmt.ExecContext(ctx, userID, deviceID, roomID, memberUserID, eventID)
+	return err
+}
+
+// selectLazyLoadedMembers returns the IDs of the membership events that were
+// sent to the device for the room, keyed by the user ID of the member.
+func (s *lazyLoadedMembersStatements) selectLazyLoadedMembers(
+	ctx context.Context, userID, deviceID, roomID string,
+) (map[string]string, error) {
+	rows, err := s.selectLazyLoadedMembersStmt.QueryContext(ctx, userID, deviceID, roomID)
+	if err != nil {
+		return nil, err
+	}
+	defer common.CloseAndLogIfError(ctx, rows, "selectLazyLoadedMembers: rows.close() failed")
+
+	members := make(map[string]string)
+	for rows.Next() {
+		var memberUserID, eventID string
+		if err = rows.Scan(&memberUserID, &eventID); err != nil {
+			return nil, err
+		}
+		members[memberUserID] = eventID
+	}
+	return members, rows.Err()
+}
@@ -0,0 +1,134 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/syncapi/types"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const presenceSchema = `
+CREATE TABLE IF NOT EXISTS syncapi_presence (
+    id INTEGER PRIMARY KEY,
+    user_id TEXT NOT NULL,
+    presence TEXT NOT NULL,
+    status_msg TEXT NOT NULL DEFAULT '',
+    last_active_ts BIGINT NOT NULL,
+    currently_active BOOLEAN NOT NULL,
+    UNIQUE (user_id)
+);
+`
+
+const upsertPresenceSQL = "" +
+	"INSERT INTO syncapi_presence (id, user_id, presence, status_msg, last_active_ts, currently_active)" +
+	" VALUES ($1, $2, $3, $4, $5, $6)" +
+	" ON CONFLICT (user_id) DO UPDATE" +
+	" SET id = EXCLUDED.id, presence = EXCLUDED.presence, status_msg = EXCLUDED.status_msg," +
+	" last_active_ts = EXCLUDED.last_active_ts, currently_active = EXCLUDED.currently_active"
+
+// Selects the presence that changed after the given position of users who
+// are either the given user or share a joined room with them.
+const selectPresenceAfterSQL = "" +
+	"SELECT user_id, presence, status_msg, last_active_ts, currently_active FROM syncapi_presence" +
+	" WHERE (user_id = $1 OR user_id IN (" +
+	"  SELECT state_key FROM syncapi_current_room_state" +
+	"  WHERE type = 'm.room.member' AND membership = 'join' AND room_id IN (" +
+	"   SELECT room_id FROM syncapi_current_room_state" +
+	"   WHERE type = 'm.room.member' AND membership = 'join' AND state_key = $1" +
+	"  )" +
+	" )) AND id > $2"
+
+const selectMaxPresenceIDSQL = "" +
+	"SELECT MAX(id) FROM syncapi_presence"
+
+type presenceStatements struct {
+	streamIDStatements      *streamIDStatements
+	upsertPresenceStmt      *sql.Stmt
+	selectPresenceAfterStmt *sql.Stmt
+	selectMaxPresenceIDStmt *sql.Stmt
+}
+
+func (s *presenceStatements) prepare(db *sql.DB, streamID *streamIDStatements) (err error) {
+	s.streamIDStatements = streamID
+	_, err = db.Exec(presenceSchema)
+	if err != nil {
+		return
+	}
+	if s.upsertPresenceStmt, err = db.Prepare(upsertPresenceSQL); err != nil {
+		return
+	}
+	if s.selectPresenceAfterStmt, err = db.Prepare(selectPresenceAfterSQL); err != nil {
+		return
+	}
+	if s.selectMaxPresenceIDStmt, err = db.Prepare(selectMaxPresenceIDSQL); err != nil {
+		return
+	}
+	return
+}
+
+func (s *presenceStatements) upsertPresence(
+	ctx context.Context, txn *sql.Tx, presence types.Presence,
+) (pos types.StreamPosition, err error) {
+	pos, err = s.streamIDStatements.nextPresenceID(ctx, txn)
+	if err != nil {
+		return
+	}
+	stmt := common.TxStmt(txn, s.upsertPresenceStmt)
+	_, err = stmt.ExecContext(
+		ctx, pos, presence.UserID, presence.Presence, presence.StatusMsg,
+		int64(presence.LastActiveTS), presence.CurrentlyActive,
+	)
+	return
+}
+
+// selectPresenceAfter returns the presence of the users who are visible to
+// the given user and whose presence changed after the given position.
+func (s *presenceStatements) selectPresenceAfter(
+	ctx context.Context, userID string, pos types.StreamPosition,
+) ([]types.Presence, error) {
+	rows, err := s.selectPresenceAfterStmt.QueryContext(ctx, userID, pos)
+	if err != nil {
+		return nil, err
+	}
+	defer common.CloseAndLogIfError(ctx, rows, "selectPresenceAfter: rows.close() failed")
+
+	var result []types.Presence
+	for rows.Next() {
+		var p types.Presence
+		var lastActiveTS int64
+		if err = rows.Scan(&p.UserID, &p.Presence, &p.StatusMsg, &lastActiveTS, &p.CurrentlyActive); err != nil {
+			return nil, err
+		}
+		p.LastActiveTS = gomatrixserverlib.Timestamp(lastActiveTS)
+		result = append(result, p)
+	}
+	return result, rows.Err()
+}
+
+func (s *presenceStatements) selectMaxPresenceID(
+	ctx context.Context, txn *sql.Tx,
+) (id int64, err error) {
+	var nullableID sql.NullInt64
+	stmt := common.TxStmt(txn, s.selectMaxPresenceIDStmt)
+	err = stmt.QueryRowContext(ctx).Scan(&nullableID)
+	if nullableID.Valid {
+		id = nullableID.Int64
+	}
+	return
+}
@@ -0,0 +1,119 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/syncapi/types"
+)
+
+const retiredInvitesSchema = `
+-- Stores the invites that are no longer active, e.g. because they were
+-- rejected or rescinded, so that incremental syncs can tell the invited
+-- users about them.
+CREATE TABLE IF NOT EXISTS syncapi_retired_invite_events (
+	id INTEGER PRIMARY KEY,
+	event_id TEXT NOT NULL,
+	room_id TEXT NOT NULL,
+	target_user_id TEXT NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS syncapi_retired_invites_target_user_id_idx ON syncapi_retired_invite_events (target_user_id, id);
+`
+
+const insertRetiredInviteSQL = "" +
+	"INSERT INTO syncapi_retired_invite_events" +
+	" (id, event_id, room_id, target_user_id)" +
+	" VALUES ($1, $2, $3, $4)"
+
+const selectRetiredInvitesInRangeSQL = "" +
+	"SELECT DISTINCT room_id FROM syncapi_retired_invite_events" +
+	" WHERE target_user_id = $1 AND id > $2 AND id <= $3"
+
+const selectMaxRetiredInviteIDSQL = "" +
+	"SELECT MAX(id) FROM syncapi_retired_invite_events"
+
+type retiredInvitesStatements struct {
+	streamIDStatements              *streamIDStatements
+	insertRetiredInviteStmt         *sql.Stmt
+	selectRetiredInvitesInRangeStmt *sql.Stmt
+	selectMaxRetiredInviteIDStmt    *sql.Stmt
+}
+
+func (s *retiredInvitesStatements) prepare(db *sql.DB, streamID *streamIDStatements) (err error) {
+	s.streamIDStatements = streamID
+	_, err = db.Exec(retiredInvitesSchema)
+	if err != nil {
+		return
+	}
+	if s.insertRetiredInviteStmt, err = db.Prepare(insertRetiredInviteSQL); err != nil {
+		return
+	}
+	if s.selectRetiredInvitesInRangeStmt, err = db.Prepare(selectRetiredInvitesInRangeSQL); err != nil {
+		return
+	}
+	if s.selectMaxRetiredInviteIDStmt, err = db.Prepare(selectMaxRetiredInviteIDSQL); err != nil {
+		return
+	}
+	return
+}
+
+func (s *retiredInvitesStatements) insertRetiredInvite(
+	ctx context.Context, txn *sql.Tx, eventID, roomID, targetUserID string,
+) (streamPos types.StreamPosition, err error) {
+	streamPos, err = s.streamIDStatements.nextInviteID(ctx, txn)
+	if err != nil {
+		return
+	}
+	_, err = txn.Stmt(s.insertRetiredInviteStmt).ExecContext(ctx, streamPos, eventID, roomID, targetUserID)
+	return
+}
+
+// selectRetiredInvitesInRange returns the IDs of the rooms in which an invite
+// for the target user ID was retired in the supplied range.
+func (s *retiredInvitesStatements) selectRetiredInvitesInRange(
+	ctx context.Context, txn *sql.Tx, targetUserID string, startPos, endPos types.StreamPosition,
+) ([]string, error) {
+	stmt := common.TxStmt(txn, s.selectRetiredInvitesInRangeStmt)
+	rows, err := stmt.QueryContext(ctx, targetUserID, startPos, endPos)
+	if err != nil {
+		return nil, err
+	}
+	defer common.CloseAndLogIfError(ctx, rows, "selectRetiredInvitesInRange: rows.close() failed")
+	var roomIDs []string
+	for rows.Next() {
+		var roomID string
+		if err = rows.Scan(&roomID); err != nil {
+			return nil, err
+		}
+		roomIDs = append(roomIDs, roomID)
+	}
+	return roomIDs, rows.Err()
+}
+
+func (s *retiredInvitesStatements) selectMaxRetiredInviteID(
+	ctx context.Context, txn *sql.Tx,
+) (id int64, err error) {
+	var nullableID sql.NullInt64
+	stmt := common.TxStmt(txn, s.selectMaxRetiredInviteIDStmt)
+	err = stmt.QueryRowContext(ctx).Scan(&nullableID)
+	if nullableID.Valid {
+		id = nullableID.Int64
+	}
+	return
+}
@@ -0,0 +1,142 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/syncapi/types"
+)
+
+const sendToDeviceSchema = `
+CREATE TABLE IF NOT EXISTS syncapi_send_to_device (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id TEXT NOT NULL,
+    device_id TEXT NOT NULL,
+    event_json TEXT NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS syncapi_send_to_device_user_id_device_id_idx ON syncapi_send_to_device(user_id, device_id);
+`
+
+const insertSendToDeviceMessageSQL = "" +
+	"INSERT INTO syncapi_send_to_device (user_id, device_id, event_json)" +
+	" VALUES ($1, $2, $3)"
+
+const selectSendToDeviceMessagesSQL = "" +
+	"SELECT id, event_json FROM syncapi_send_to_device" +
+	" WHERE user_id = $1 AND device_id = $2 AND id > $3 AND id <= $4" +
+	" ORDER BY id ASC LIMIT $5"
+
+const deleteSendToDeviceMessagesSQL = "" +
+	"DELETE FROM syncapi_send_to_device" +
+	" WHERE user_id = $1 AND device_id = $2 AND id <= $3"
+
+const selectMaxSendToDeviceMessageIDSQL = "" +
+	"SELECT MAX(id) FROM syncapi_send_to_device"
+
+type sendToDeviceStatements struct {
+	insertSendToDeviceMessageStmt      *sql.Stmt
+	selectSendToDeviceMessagesStmt     *sql.Stmt
+	deleteSendToDeviceMessagesStmt     *sql.Stmt
+	selectMaxSendToDeviceMessageIDStmt *sql.Stmt
+}
+
+func (s *sendToDeviceStatements) prepare(db *sql.DB) (err error) {
+	_, err = db.Exec(sendToDeviceSchema)
+	if err != nil {
+		return
+	}
+	if s.insertSendToDeviceMessageStmt, err = db.Prepare(insertSendToDeviceMessageSQL); err != nil {
+		return
+	}
+	if s.selectSendToDeviceMessagesStmt, err = db.Prepare(selectSendToDeviceMessagesSQL); err != nil {
+		return
+	}
+	if s.deleteSendToDeviceMessagesStmt, err = db.Prepare(deleteSendToDeviceMessagesSQL); err != nil {
+		return
+	}
+	if s.selectMaxSendToDeviceMessageIDStmt, err = db.Prepare(selectMaxSendToDeviceMessageIDSQL); err != nil {
+		return
+	}
+	return
+}
+
+func (s *sendToDeviceStatements) insertSendToDeviceMessage(
+	ctx context.Context, txn *sql.Tx, userID, deviceID string, event types.SendToDeviceEvent,
+) (pos types.StreamPosition, err error) {
+	eventJSON, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+	stmt := common.TxStmt(txn, s.insertSendToDeviceMessageStmt)
+	res, err := stmt.ExecContext(ctx, userID, deviceID, string(eventJSON))
+	if err != nil {
+		return
+	}
+	id, err := res.LastInsertId()
+	return types.StreamPosition(id), err
+}
+
+// selectSendToDeviceMessages returns up to limit messages for the device in
+// the given range, along with the position of the last message returned.
+func (s *sendToDeviceStatements) selectSendToDeviceMessages(
+	ctx context.Context, userID, deviceID string,
+	oldPos, newPos types.StreamPosition, limit int,
+) (lastPos types.StreamPosition, events []types.SendToDeviceEvent, err error) {
+	rows, err := s.selectSendToDeviceMessagesStmt.QueryContext(ctx, userID, deviceID, oldPos, newPos, limit)
+	if err != nil {
+		return
+	}
+	defer common.CloseAndLogIfError(ctx, rows, "selectSendToDeviceMessages: rows.close() failed")
+
+	for rows.Next() {
+		var id types.StreamPosition
+		var eventJSON string
+		if err = rows.Scan(&id, &eventJSON); err != nil {
+			return
+		}
+		var event types.SendToDeviceEvent
+		if err = json.Unmarshal([]byte(eventJSON), &event); err != nil {
+			return
+		}
+		events = append(events, event)
+		lastPos = id
+	}
+	err = rows.Err()
+	return
+}
+
+func (s *sendToDeviceStatements) deleteSendToDeviceMessages(
+	ctx context.Context, userID, deviceID string, pos types.StreamPosition,
+) error {
+	_, err := s.deleteSendToDeviceMessagesStmt.ExecContext(ctx, userID, deviceID, pos)
+	return err
+}
+
+func (s *sendToDeviceStatements) selectMaxSendToDeviceMessageID(
+	ctx context.Context, txn *sql.Tx,
+) (id int64, err error) {
+	var nullableID sql.NullInt64
+	stmt := common.TxStmt(txn, s.selectMaxSendToDeviceMessageIDStmt)
+	err = stmt.QueryRowContext(ctx).Scan(&nullableID)
+	if nullableID.Valid {
+		id = nullableID.Int64
+	}
+	return
+}
@@ -18,6 +18,16 @@ CREATE TABLE IF NOT EXISTS syncapi_stream_id (
 );
 INSERT INTO syncapi_stream_id (stream_name, stream_id) VALUES ("global", 0)
   ON CONFLICT DO NOTHING;
+INSERT INTO syncapi_stream_id (stream_name, stream_id) VALUES ("receipt", 0)
+  ON CONFLICT DO NOTHING;
+INSERT INTO syncapi_stream_id (stream_name, stream_id) VALUES ("presence", 0)
+  ON CONFLICT DO NOTHING;
+INSERT INTO syncapi_stream_id (stream_name, stream_id) VALUES ("account_data", 0)
+  ON CONFLICT DO NOTHING;
+INSERT INTO syncapi_stream_id (stream_name, stream_id) VALUES ("invite", 0)
+  ON CONFLICT DO NOTHING;
+INSERT INTO syncapi_stream_id (stream_name, stream_id) VALUES ("key_change", 0)
+  ON CONFLICT DO NOTHING;
 `
 
 const increaseStreamIDStmt = "" +
@@ -46,12 +56,46 @@ func (s *streamIDStatements) prepare(db *sql.DB) (err error) {
 }
 
 func (s *streamIDStatements) nextStreamID(ctx context.Context, txn *sql.Tx) (pos types.StreamPosition, err error) {
+	return s.nextID(ctx, txn, "global")
+}
+
+// nextReceiptID returns the next position in the receipt stream, which is
+// separate from the global stream.
+func (s *streamIDStatements) nextReceiptID(ctx context.Context, txn *sql.Tx) (pos types.StreamPosition, err error) {
+	return s.nextID(ctx, txn, "receipt")
+}
+
+// nextPresenceID returns the next position in the presence stream, which is
+// separate from the global stream.
+func (s *streamIDStatements) nextPresenceID(ctx context.Context, txn *sql.Tx) (pos types.StreamPosition, err error) {
+	return s.nextID(ctx, txn, "presence")
+}
+
+// nextAccountDataID returns the next position in the account data stream,
+// which is separate from the global stream.
+func (s *streamIDStatements) nextAccountDataID(ctx context.Context, txn *sql.Tx) (pos types.StreamPosition, err error) {
+	return s.nextID(ctx, txn, "account_data")
+}
+
+// nextInviteID returns the next position in the invite stream, which is
+// separate from the global stream and shared by new and retired invites.
+func (s *streamIDStatements) nextInviteID(ctx context.Context, txn *sql.Tx) (pos types.StreamPosition, err error) {
+	return s.nextID(ctx, txn, "invite")
+}
+
+// nextKeyChangeID returns the next position in the device list stream, which
+// is separate from the global stream.
+func (s *streamIDStatements) nextKeyChangeID(ctx context.Context, txn *sql.Tx) (pos types.StreamPosition, err error) {
+	return s.nextID(ctx, txn, "key_change")
+}
+
+func (s *streamIDStatements) nextID(ctx context.Context, txn *sql.Tx, streamName string) (pos types.StreamPosition, err error) {
 	increaseStmt := common.TxStmt(txn, s.increaseStreamIDStmt)
 	selectStmt := common.TxStmt(txn, s.selectStreamIDStmt)
-	if _, err = increaseStmt.ExecContext(ctx, "global"); err != nil {
+	if _, err = increaseStmt.ExecContext(ctx, streamName); err != nil {
 		return
 	}
-	if err = selectStmt.QueryRowContext(ctx, "global").Scan(&pos); err != nil {
+	if err = selectStmt.QueryRowContext(ctx, streamName).Scan(&pos); err != nil {
 		return
 	}
 	return
@@ -22,6 +22,7 @@ import (
 	"errors"
 	"fmt"
 	"net/url"
+	"sort"
 	"time"
 
 	"github.com/sirupsen/logrus"
@@ -57,6 +58,13 @@ type SyncServerDatasource struct {
 	events              outputRoomEventsStatements
 	roomstate           currentRoomStateStatements
 	invites             inviteEventsStatements
+	retiredInvites      retiredInvitesStatements
+	lazyLoadedMembers   lazyLoadedMembersStatements
+	eventSearch         eventSearchStatements
+	keyChanges          keyChangesStatements
+	sendToDevice        sendToDeviceStatements
+	receipts            receiptStatements
+	presence            presenceStatements
 	typingCache         *cache.TypingCache
 	topology            outputRoomEventsTopologyStatements
 	backwardExtremities backwardExtremitiesStatements
@@ -107,6 +115,27 @@ func (d *SyncServerDatasource) prepare() (err error) {
 	if err := d.invites.prepare(d.db, &d.streamID); err != nil {
 		return err
 	}
+	if err := d.retiredInvites.prepare(d.db, &d.streamID); err != nil {
+		return err
+	}
+	if err := d.lazyLoadedMembers.prepare(d.db); err != nil {
+		return err
+	}
+	if err := d.eventSearch.prepare(d.db); err != nil {
+		return err
+	}
+	if err := d.keyChanges.prepare(d.db, &d.streamID); err != nil {
+		return err
+	}
+	if err := d.sendToDevice.prepare(d.db); err != nil {
+		return err
+	}
+	if err := d.receipts.prepare(d.db, &d.streamID); err != nil {
+		return err
+	}
+	if err := d.presence.prepare(d.db, &d.streamID); err != nil {
+		return err
+	}
 	if err := d.topology.prepare(d.db); err != nil {
 		return err
 	}
@@ -116,6 +145,40 @@ func (d *SyncServerDatasource) prepare() (err error) {
 	return nil
 }
 
+// JoinedRoomIDs returns the IDs of the rooms that the user is joined to.
+func (d *SyncServerDatasource) JoinedRoomIDs(ctx context.Context, userID string) ([]string, error) {
+	return d.roomstate.selectRoomIDsWithMembership(ctx, nil, userID, gomatrixserverlib.Join)
+}
+
+// IndexEventForSearch adds the content of an event under the given key, e.g.
+// "content.body", to the full-text search index.
+func (d *SyncServerDatasource) IndexEventForSearch(
+	ctx context.Context, eventID, roomID, key, value string, pos types.StreamPosition,
+) error {
+	return common.WithTransaction(d.db, func(txn *sql.Tx) error {
+		return d.eventSearch.insertEventSearch(ctx, txn, eventID, roomID, key, value, pos)
+	})
+}
+
+// SearchEvents returns the events of the given rooms whose content under one
+// of the given keys matches the search term, along with the IDs of up to
+// countLimit of the matching events so that they can be counted. The results are ordered by
+// rank, skipping the first "from" results, or by recency, starting before the
+// stream position "from" if it isn't 0.
+func (d *SyncServerDatasource) SearchEvents(
+	ctx context.Context, searchTerm string, roomIDs, keys []string,
+	orderByRecency bool, from int64, limit, countLimit int,
+) (results []types.SearchResult, matchingEventIDs []string, err error) {
+	results, err = d.eventSearch.selectEventSearch(
+		ctx, searchTerm, roomIDs, keys, orderByRecency, from, limit,
+	)
+	if err != nil {
+		return nil, nil, err
+	}
+	matchingEventIDs, err = d.eventSearch.selectEventSearchEventIDs(ctx, searchTerm, roomIDs, keys, countLimit)
+	return
+}
+
 // AllJoinedUsersInRooms returns a map of room ID to a list of all joined user IDs.
 func (d *SyncServerDatasource) AllJoinedUsersInRooms(ctx context.Context) (map[string][]string, error) {
 	return d.roomstate.selectJoinedUsers(ctx)
@@ -137,6 +200,60 @@ func (d *SyncServerDatasource) Events(ctx context.Context, eventIDs []string) ([
 	return d.StreamEventsToEvents(nil, streamEvents), nil
 }
 
+// RedactEvent replaces the stored copies of the event with their redacted
+// form, so that the event is only served redacted from now on. Does nothing
+// if we don't have the event.
+func (d *SyncServerDatasource) RedactEvent(
+	ctx context.Context, redactedEventID string, redactedBecause *gomatrixserverlib.HeaderedEvent,
+) error {
+	redactionEvent := redactedBecause.Unwrap()
+	return common.WithTransaction(d.db, func(txn *sql.Tx) error {
+		streamEvents, err := d.events.selectEvents(ctx, txn, []string{redactedEventID})
+		if err != nil {
+			return err
+		}
+		for i := range streamEvents {
+			redacted, err := redactHeaderedEvent(&streamEvents[i].HeaderedEvent, &redactionEvent)
+			if err != nil {
+				return err
+			}
+			if err = d.events.updateEventJSON(ctx, txn, redacted); err != nil {
+				return err
+			}
+		}
+		// The redacted content mustn't be found by searches any more.
+		if err = d.eventSearch.deleteEventSearch(ctx, txn, redactedEventID); err != nil {
+			return err
+		}
+		stateEvents, err := d.roomstate.selectEventsWithEventIDs(ctx, txn, []string{redactedEventID})
+		if err != nil {
+			return err
+		}
+		for i := range stateEvents {
+			redacted, err := redactHeaderedEvent(&stateEvents[i].HeaderedEvent, &redactionEvent)
+			if err != nil {
+				return err
+			}
+			if err = d.roomstate.updateStateEventJSON(ctx, txn, redacted); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func redactHeaderedEvent(
+	event *gomatrixserverlib.HeaderedEvent, redactionEvent *gomatrixserverlib.Event,
+) (*gomatrixserverlib.HeaderedEvent, error) {
+	unwrapped := event.Unwrap()
+	redacted, err := common.RedactEvent(&unwrapped, redactionEvent, event.RoomVersion)
+	if err != nil {
+		return nil, err
+	}
+	headered := redacted.Headered(event.RoomVersion)
+	return &headered, nil
+}
+
 // handleBackwardExtremities adds this event as a backwards extremity if and only if we do not have all of
 // the events listed in the event's 'prev_events'. This function also updates the backwards extremities table
 // to account for the fact that the given event is no longer a backwards extremity, but may be marked as such.
@@ -250,7 +367,7 @@ func (d *SyncServerDatasource) updateRoomState(
 func (d *SyncServerDatasource) GetStateEvent(
 	ctx context.Context, roomID, evType, stateKey string,
 ) (*gomatrixserverlib.HeaderedEvent, error) {
-	return d.roomstate.selectStateEvent(ctx, roomID, evType, stateKey)
+	return d.roomstate.selectStateEvent(ctx, nil, roomID, evType, stateKey)
 }
 
 // GetStateEventsForRoom fetches the state events for a given room.
@@ -373,36 +490,12 @@ func (d *SyncServerDatasource) EventPositionInTopology(
 	return d.topology.selectPositionInTopology(ctx, nil, eventID)
 }
 
-// SyncStreamPosition returns the latest position in the sync stream. Returns 0 if there are no events yet.
-func (d *SyncServerDatasource) SyncStreamPosition(ctx context.Context) (pos types.StreamPosition, err error) {
-	err = common.WithTransaction(d.db, func(txn *sql.Tx) error {
-		pos, err = d.syncStreamPositionTx(ctx, txn)
-		return err
-	})
-	return
-}
-
-func (d *SyncServerDatasource) syncStreamPositionTx(
-	ctx context.Context, txn *sql.Tx,
-) (types.StreamPosition, error) {
-	maxID, err := d.events.selectMaxEventID(ctx, txn)
+// SyncStreamPosition returns the latest position in the PDU stream. Returns 0 if there are no events yet.
+func (d *SyncServerDatasource) SyncStreamPosition(ctx context.Context) (types.StreamPosition, error) {
+	maxID, err := d.events.selectMaxEventID(ctx, nil)
 	if err != nil {
 		return 0, err
 	}
-	maxAccountDataID, err := d.accountData.selectMaxAccountDataID(ctx, txn)
-	if err != nil {
-		return 0, err
-	}
-	if maxAccountDataID > maxID {
-		maxID = maxAccountDataID
-	}
-	maxInviteID, err := d.invites.selectMaxInviteID(ctx, txn)
-	if err != nil {
-		return 0, err
-	}
-	if maxInviteID > maxID {
-		maxID = maxInviteID
-	}
 	return types.StreamPosition(maxID), nil
 }
 
@@ -414,22 +507,45 @@ func (d *SyncServerDatasource) syncPositionTx(
 	if err != nil {
 		return sp, err
 	}
+	sp.PDUPosition = types.StreamPosition(maxEventID)
 	maxAccountDataID, err := d.accountData.selectMaxAccountDataID(ctx, txn)
 	if err != nil {
 		return sp, err
 	}
-	if maxAccountDataID > maxEventID {
-		maxEventID = maxAccountDataID
-	}
+	sp.AccountDataPosition = types.StreamPosition(maxAccountDataID)
 	maxInviteID, err := d.invites.selectMaxInviteID(ctx, txn)
 	if err != nil {
 		return sp, err
 	}
-	if maxInviteID > maxEventID {
-		maxEventID = maxInviteID
+	maxRetiredInviteID, err := d.retiredInvites.selectMaxRetiredInviteID(ctx, txn)
+	if err != nil {
+		return sp, err
 	}
-	sp.PDUPosition = types.StreamPosition(maxEventID)
+	if maxRetiredInviteID > maxInviteID {
+		maxInviteID = maxRetiredInviteID
+	}
+	sp.InvitePosition = types.StreamPosition(maxInviteID)
+	maxKeyChangeID, err := d.keyChanges.selectMaxKeyChangeID(ctx, txn)
+	if err != nil {
+		return sp, err
+	}
+	sp.DeviceListPosition = types.StreamPosition(maxKeyChangeID)
 	sp.EDUTypingPosition = types.StreamPosition(d.typingCache.GetLatestSyncPosition())
+	maxSendToDeviceID, err := d.sendToDevice.selectMaxSendToDeviceMessageID(ctx, txn)
+	if err != nil {
+		return sp, err
+	}
+	sp.SendToDevicePosition = types.StreamPosition(maxSendToDeviceID)
+	maxReceiptID, err := d.receipts.selectMaxReceiptID(ctx, txn)
+	if err != nil {
+		return sp, err
+	}
+	sp.EDUReceiptPosition = types.StreamPosition(maxReceiptID)
+	maxPresenceID, err := d.presence.selectMaxPresenceID(ctx, txn)
+	if err != nil {
+		return sp, err
+	}
+	sp.EDUPresencePosition = types.StreamPosition(maxPresenceID)
 	return
 }
 
@@ -439,7 +555,9 @@ func (d *SyncServerDatasource) addPDUDeltaToResponse(
 	ctx context.Context,
 	device authtypes.Device,
 	fromPos, toPos types.StreamPosition,
-	numRecentEventsPerRoom int,
+	timelineFilter *gomatrixserverlib.RoomEventFilter,
+	visible types.VisibleEventsFunc,
+	lazyLoadMembers bool,
 	wantFullState bool,
 	res *types.Response,
 ) (joinedRoomIDs []string, err error) {
@@ -455,7 +573,11 @@ func (d *SyncServerDatasource) addPDUDeltaToResponse(
 		}
 	}()
 
-	stateFilterPart := gomatrixserverlib.DefaultStateFilter() // TODO: use filter provided in request
+	// The state filter of the request is applied once the response has been
+	// built, as the unfiltered state is needed to find the membership changes
+	// of the user.
+	stateFilterPart := gomatrixserverlib.DefaultStateFilter()
+	stateFilterPart.LazyLoadMembers = lazyLoadMembers
 
 	// Work out which rooms to return in the response. This is done by getting not only the currently
 	// joined rooms, but also which rooms have membership transitions for this user between the 2 PDU stream positions.
@@ -476,17 +598,12 @@ func (d *SyncServerDatasource) addPDUDeltaToResponse(
 	}
 
 	for _, delta := range deltas {
-		err = d.addRoomDeltaToResponse(ctx, &device, txn, fromPos, toPos, delta, numRecentEventsPerRoom, res)
+		err = d.addRoomDeltaToResponse(ctx, &device, txn, fromPos, toPos, delta, timelineFilter, visible, res)
 		if err != nil {
 			return nil, err
 		}
 	}
 
-	// TODO: This should be done in getStateDeltas
-	if err = d.addInvitesToResponse(ctx, txn, device.UserID, fromPos, toPos, res); err != nil {
-		return nil, err
-	}
-
 	succeeded = true
 	return joinedRoomIDs, nil
 }
@@ -525,9 +642,102 @@ func (d *SyncServerDatasource) addTypingDeltaToResponse(
 	return nil
 }
 
+// addReceiptDeltaToResponse adds all read receipts in the joined rooms to a
+// sync response since the specified position.
+func (d *SyncServerDatasource) addReceiptDeltaToResponse(
+	ctx context.Context,
+	since types.PaginationToken,
+	joinedRoomIDs []string,
+	res *types.Response,
+) error {
+	receipts, err := d.receipts.selectRoomReceiptsAfter(ctx, joinedRoomIDs, since.EDUReceiptPosition)
+	if err != nil {
+		return err
+	}
+
+	// Group the receipts by room, then by event ID, receipt type and user.
+	contents := make(map[string]map[string]map[string]map[string]interface{})
+	for _, receipt := range receipts {
+		content, ok := contents[receipt.RoomID]
+		if !ok {
+			content = make(map[string]map[string]map[string]interface{})
+			contents[receipt.RoomID] = content
+		}
+		if _, ok = content[receipt.EventID]; !ok {
+			content[receipt.EventID] = make(map[string]map[string]interface{})
+		}
+		if _, ok = content[receipt.EventID][receipt.Type]; !ok {
+			content[receipt.EventID][receipt.Type] = make(map[string]interface{})
+		}
+		content[receipt.EventID][receipt.Type][receipt.UserID] = map[string]interface{}{
+			"ts": receipt.Timestamp,
+		}
+	}
+
+	var jr types.JoinResponse
+	var ok bool
+	for roomID, content := range contents {
+		ev := gomatrixserverlib.ClientEvent{
+			Type: "m.receipt",
+		}
+		ev.Content, err = json.Marshal(content)
+		if err != nil {
+			return err
+		}
+
+		if jr, ok = res.Rooms.Join[roomID]; !ok {
+			jr = *types.NewJoinResponse()
+		}
+		jr.Ephemeral.Events = append(jr.Ephemeral.Events, ev)
+		res.Rooms.Join[roomID] = jr
+	}
+	return nil
+}
+
+// addPresenceDeltaToResponse adds the presence of the user and of everyone
+// who shares a joined room with them to a sync response since the specified
+// position.
+func (d *SyncServerDatasource) addPresenceDeltaToResponse(
+	ctx context.Context,
+	userID string,
+	since types.PaginationToken,
+	res *types.Response,
+) error {
+	presences, err := d.presence.selectPresenceAfter(ctx, userID, since.EDUPresencePosition)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for _, presence := range presences {
+		content := map[string]interface{}{
+			"presence":         presence.Presence,
+			"currently_active": presence.CurrentlyActive,
+		}
+		if presence.LastActiveTS != 0 {
+			content["last_active_ago"] = now.Sub(presence.LastActiveTS.Time()).Nanoseconds() / int64(time.Millisecond)
+		}
+		if presence.StatusMsg != "" {
+			content["status_msg"] = presence.StatusMsg
+		}
+		ev := gomatrixserverlib.ClientEvent{
+			Type:   "m.presence",
+			Sender: presence.UserID,
+		}
+		ev.Content, err = json.Marshal(content)
+		if err != nil {
+			return err
+		}
+		res.Presence.Events = append(res.Presence.Events, ev)
+	}
+	return nil
+}
+
 // addEDUDeltaToResponse adds updates for EDUs of each type since fromPos if
 // the positions of that type are not equal in fromPos and toPos.
 func (d *SyncServerDatasource) addEDUDeltaToResponse(
+	ctx context.Context,
+	userID string,
 	fromPos, toPos types.PaginationToken,
 	joinedRoomIDs []string,
 	res *types.Response,
@@ -537,6 +747,24 @@ func (d *SyncServerDatasource) addEDUDeltaToResponse(
 		err = d.addTypingDeltaToResponse(
 			fromPos, joinedRoomIDs, res,
 		)
+		if err != nil {
+			return
+		}
+	}
+
+	if fromPos.EDUReceiptPosition != toPos.EDUReceiptPosition {
+		err = d.addReceiptDeltaToResponse(
+			ctx, fromPos, joinedRoomIDs, res,
+		)
+		if err != nil {
+			return
+		}
+	}
+
+	if fromPos.EDUPresencePosition != toPos.EDUPresencePosition {
+		err = d.addPresenceDeltaToResponse(
+			ctx, userID, fromPos, res,
+		)
 	}
 
 	return
@@ -551,8 +779,9 @@ func (d *SyncServerDatasource) IncrementalSync(
 	ctx context.Context,
 	device authtypes.Device,
 	fromPos, toPos types.PaginationToken,
-	numRecentEventsPerRoom int,
+	filter *gomatrixserverlib.Filter,
 	wantFullState bool,
+	visible types.VisibleEventsFunc,
 ) (*types.Response, error) {
 	nextBatchPos := fromPos.WithUpdates(toPos)
 	res := types.NewResponse(nextBatchPos)
@@ -561,7 +790,8 @@ func (d *SyncServerDatasource) IncrementalSync(
 	var err error
 	if fromPos.PDUPosition != toPos.PDUPosition || wantFullState {
 		joinedRoomIDs, err = d.addPDUDeltaToResponse(
-			ctx, device, fromPos.PDUPosition, toPos.PDUPosition, numRecentEventsPerRoom, wantFullState, res,
+			ctx, device, fromPos.PDUPosition, toPos.PDUPosition, &filter.Room.Timeline, visible,
+			filter.Room.State.LazyLoadMembers, wantFullState, res,
 		)
 	} else {
 		joinedRoomIDs, err = d.roomstate.selectRoomIDsWithMembership(
@@ -572,13 +802,23 @@ func (d *SyncServerDatasource) IncrementalSync(
 		return nil, err
 	}
 
+	if fromPos.InvitePosition != toPos.InvitePosition {
+		err = d.addInviteDeltaToResponse(
+			ctx, device.UserID, fromPos.InvitePosition, toPos.InvitePosition, joinedRoomIDs, res,
+		)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	err = d.addEDUDeltaToResponse(
-		fromPos, toPos, joinedRoomIDs, res,
+		ctx, device.UserID, fromPos, toPos, joinedRoomIDs, res,
 	)
 	if err != nil {
 		return nil, err
 	}
 
+	types.FilterResponse(res, filter)
 	return res, nil
 }
 
@@ -587,7 +827,9 @@ func (d *SyncServerDatasource) IncrementalSync(
 func (d *SyncServerDatasource) getResponseWithPDUsForCompleteSync(
 	ctx context.Context,
 	userID string,
-	numRecentEventsPerRoom int,
+	timelineFilter *gomatrixserverlib.RoomEventFilter,
+	visible types.VisibleEventsFunc,
+	lazyLoadMembers, includeLeave bool,
 ) (
 	res *types.Response,
 	toPos types.PaginationToken,
@@ -624,22 +866,23 @@ func (d *SyncServerDatasource) getResponseWithPDUsForCompleteSync(
 		return
 	}
 
-	stateFilterPart := gomatrixserverlib.DefaultStateFilter() // TODO: use filter provided in request
+	// The state filter of the request is applied once the response has been
+	// built.
+	stateFilterPart := gomatrixserverlib.DefaultStateFilter()
+	stateFilterPart.LazyLoadMembers = lazyLoadMembers
 
 	// Build up a /sync response. Add joined rooms.
 	for _, roomID := range joinedRoomIDs {
 		var stateEvents []gomatrixserverlib.HeaderedEvent
-		stateEvents, err = d.roomstate.selectCurrentState(ctx, txn, roomID, &stateFilterPart)
+		stateEvents, err = d.roomstate.selectCurrentState(ctx, txn, roomID, withoutLazyLoadedMembers(&stateFilterPart))
 		if err != nil {
 			return
 		}
 		//fmt.Println("State events:", stateEvents)
-		// TODO: When filters are added, we may need to call this multiple times to get enough events.
-		//       See: https://github.com/matrix-org/synapse/blob/v0.19.3/synapse/handlers/sync.py#L316
-		var recentStreamEvents []types.StreamEvent
-		recentStreamEvents, err = d.events.selectRecentEvents(
-			ctx, txn, roomID, types.StreamPosition(0), toPos.PDUPosition,
-			numRecentEventsPerRoom, true, true,
+		var recentStreamEvents, paginateFrom []types.StreamEvent
+		var limited bool
+		recentStreamEvents, paginateFrom, limited, err = d.selectFilteredRecentEvents(
+			ctx, txn, roomID, types.StreamPosition(0), toPos.PDUPosition, timelineFilter, visible,
 		)
 		if err != nil {
 			return
@@ -648,29 +891,35 @@ func (d *SyncServerDatasource) getResponseWithPDUsForCompleteSync(
 
 		// Retrieve the backward topology position, i.e. the position of the
 		// oldest event in the room's topology.
-		var backwardTopologyPos types.StreamPosition
-		backwardTopologyPos, err = d.topology.selectPositionInTopology(ctx, txn, recentStreamEvents[0].EventID())
-		if backwardTopologyPos-1 <= 0 {
-			backwardTopologyPos = types.StreamPosition(1)
-		} else {
-			backwardTopologyPos--
-		}
+		backwardTopologyPos := d.getBackwardTopologyPos(ctx, txn, paginateFrom)
 
 		// We don't include a device here as we don't need to send down
 		// transaction IDs for complete syncs
 		recentEvents := d.StreamEventsToEvents(nil, recentStreamEvents)
-		stateEvents = removeDuplicates(stateEvents, recentEvents)
+		stateEvents, err = d.stateAtTimelineStart(ctx, txn, stateEvents, recentEvents)
+		if err != nil {
+			return
+		}
 		jr := types.NewJoinResponse()
 		jr.Timeline.PrevBatch = types.NewPaginationTokenFromTypeAndPosition(
 			types.PaginationTokenTypeTopology, backwardTopologyPos, 0,
 		).String()
 		jr.Timeline.Events = gomatrixserverlib.HeaderedToClientEvents(recentEvents, gomatrixserverlib.FormatSync)
-		jr.Timeline.Limited = true
+		jr.Timeline.Limited = limited
 		jr.State.Events = gomatrixserverlib.HeaderedToClientEvents(stateEvents, gomatrixserverlib.FormatSync)
 		res.Rooms.Join[roomID] = *jr
 	}
 
-	if err = d.addInvitesToResponse(ctx, txn, userID, 0, toPos.PDUPosition, res); err != nil {
+	if includeLeave {
+		err = d.addArchivedRoomsToResponse(
+			ctx, txn, userID, toPos.PDUPosition, timelineFilter, visible, &stateFilterPart, res,
+		)
+		if err != nil {
+			return
+		}
+	}
+
+	if err = d.addInvitesToResponse(ctx, txn, userID, 0, toPos.InvitePosition, res); err != nil {
 		return
 	}
 
@@ -680,10 +929,12 @@ func (d *SyncServerDatasource) getResponseWithPDUsForCompleteSync(
 
 // CompleteSync returns a complete /sync API response for the given user.
 func (d *SyncServerDatasource) CompleteSync(
-	ctx context.Context, userID string, numRecentEventsPerRoom int,
+	ctx context.Context, userID string, filter *gomatrixserverlib.Filter,
+	visible types.VisibleEventsFunc,
 ) (*types.Response, error) {
 	res, toPos, joinedRoomIDs, err := d.getResponseWithPDUsForCompleteSync(
-		ctx, userID, numRecentEventsPerRoom,
+		ctx, userID, &filter.Room.Timeline, visible,
+		filter.Room.State.LazyLoadMembers, filter.Room.IncludeLeave,
 	)
 	if err != nil {
 		return nil, err
@@ -691,12 +942,13 @@ func (d *SyncServerDatasource) CompleteSync(
 
 	// Use a zero value SyncPosition for fromPos so all EDU states are added.
 	err = d.addEDUDeltaToResponse(
-		types.PaginationToken{}, toPos, joinedRoomIDs, res,
+		ctx, userID, types.PaginationToken{}, toPos, joinedRoomIDs, res,
 	)
 	if err != nil {
 		return nil, err
 	}
 
+	types.FilterResponse(res, filter)
 	return res, nil
 }
 
@@ -738,6 +990,93 @@ func (d *SyncServerDatasource) UpsertAccountData(
 	return
 }
 
+// AddKeyChange records that the device keys of a user have changed.
+// Returns the stream position at which the change was stored.
+func (d *SyncServerDatasource) AddKeyChange(
+	ctx context.Context, userID string,
+) (sp types.StreamPosition, err error) {
+	err = common.WithTransaction(d.db, func(txn *sql.Tx) error {
+		sp, err = d.keyChanges.upsertKeyChange(ctx, txn, userID)
+		return err
+	})
+	return
+}
+
+// KeyChangesInRange returns the IDs of the users whose device keys changed
+// between the two positions and who are either the given user or share a
+// joined room with them.
+func (d *SyncServerDatasource) KeyChangesInRange(
+	ctx context.Context, userID string, oldPos, newPos types.StreamPosition,
+) ([]string, error) {
+	return d.keyChanges.selectKeyChangesInRange(ctx, userID, oldPos, newPos)
+}
+
+// UsersLeftInRange returns the IDs of the users who stopped sharing a joined
+// room with the given user between the two positions in the event stream, so
+// that the user's devices no longer need to track their device lists.
+func (d *SyncServerDatasource) UsersLeftInRange(
+	ctx context.Context, userID string, oldPos, newPos types.StreamPosition,
+) ([]string, error) {
+	return d.keyChanges.selectUsersLeftInRange(ctx, userID, oldPos, newPos)
+}
+
+// AddSendToDeviceEvent stores a send-to-device message for a device until
+// the device has acknowledged it. Returns the position in the send-to-device
+// stream at which the message was stored.
+func (d *SyncServerDatasource) AddSendToDeviceEvent(
+	ctx context.Context, userID, deviceID string, event types.SendToDeviceEvent,
+) (sp types.StreamPosition, err error) {
+	err = common.WithTransaction(d.db, func(txn *sql.Tx) error {
+		sp, err = d.sendToDevice.insertSendToDeviceMessage(ctx, txn, userID, deviceID, event)
+		return err
+	})
+	return
+}
+
+// SendToDeviceEventsInRange returns up to limit send-to-device messages for
+// the device between the two positions, along with the position of the last
+// message returned.
+func (d *SyncServerDatasource) SendToDeviceEventsInRange(
+	ctx context.Context, userID, deviceID string,
+	oldPos, newPos types.StreamPosition, limit int,
+) (types.StreamPosition, []types.SendToDeviceEvent, error) {
+	return d.sendToDevice.selectSendToDeviceMessages(ctx, userID, deviceID, oldPos, newPos, limit)
+}
+
+// DeleteSendToDeviceEvents deletes the send-to-device messages for the device
+// up to and including the given position, once the device has acknowledged
+// them.
+func (d *SyncServerDatasource) DeleteSendToDeviceEvents(
+	ctx context.Context, userID, deviceID string, pos types.StreamPosition,
+) error {
+	return d.sendToDevice.deleteSendToDeviceMessages(ctx, userID, deviceID, pos)
+}
+
+// StoreReceipt stores the latest receipt of the given type that the user has
+// sent in the room, replacing any earlier one. Returns the position in the
+// receipt stream at which the receipt was stored.
+func (d *SyncServerDatasource) StoreReceipt(
+	ctx context.Context, roomID, receiptType, userID, eventID string, timestamp gomatrixserverlib.Timestamp,
+) (sp types.StreamPosition, err error) {
+	err = common.WithTransaction(d.db, func(txn *sql.Tx) error {
+		sp, err = d.receipts.upsertReceipt(ctx, txn, roomID, receiptType, userID, eventID, timestamp)
+		return err
+	})
+	return
+}
+
+// UpsertPresence stores the latest presence of a user, replacing any earlier
+// one. Returns the position in the presence stream at which it was stored.
+func (d *SyncServerDatasource) UpsertPresence(
+	ctx context.Context, presence types.Presence,
+) (sp types.StreamPosition, err error) {
+	err = common.WithTransaction(d.db, func(txn *sql.Tx) error {
+		sp, err = d.presence.upsertPresence(ctx, txn, presence)
+		return err
+	})
+	return
+}
+
 // AddInviteEvent stores a new invite event for a user.
 // If the invite was successfully stored this returns the stream ID it was stored at.
 // Returns an error if there was a problem communicating with the database.
@@ -745,7 +1084,7 @@ func (d *SyncServerDatasource) AddInviteEvent(
 	ctx context.Context, inviteEvent gomatrixserverlib.HeaderedEvent,
 ) (streamPos types.StreamPosition, err error) {
 	err = common.WithTransaction(d.db, func(txn *sql.Tx) error {
-		streamPos, err = d.streamID.nextStreamID(ctx, txn)
+		streamPos, err = d.streamID.nextInviteID(ctx, txn)
 		if err != nil {
 			return err
 		}
@@ -754,15 +1093,50 @@ func (d *SyncServerDatasource) AddInviteEvent(
 	return
 }
 
-// RetireInviteEvent removes an old invite event from the database.
-// Returns an error if there was a problem communicating with the database.
+// RetireInviteEvent removes an old invite event from the database and records
+// the retirement so that incremental syncs can tell the invited user about it.
+// Returns the stream position of the retirement, or 0 if there was no such
+// invite. Returns an error if there was a problem communicating with the database.
 func (d *SyncServerDatasource) RetireInviteEvent(
 	ctx context.Context, inviteEventID string,
+) (streamPos types.StreamPosition, err error) {
+	err = common.WithTransaction(d.db, func(txn *sql.Tx) error {
+		roomID, targetUserID, err := d.invites.deleteInviteEvent(ctx, txn, inviteEventID)
+		if err != nil || roomID == "" {
+			return err
+		}
+		streamPos, err = d.retiredInvites.insertRetiredInvite(
+			ctx, txn, inviteEventID, roomID, targetUserID,
+		)
+		return err
+	})
+	return
+}
+
+// LazyLoadedMembers returns the IDs of the membership events of the room that
+// were sent to a device which lazy-loads members, keyed by the user ID of the
+// member.
+func (d *SyncServerDatasource) LazyLoadedMembers(
+	ctx context.Context, userID, deviceID, roomID string,
+) (map[string]string, error) {
+	return d.lazyLoadedMembers.selectLazyLoadedMembers(ctx, userID, deviceID, roomID)
+}
+
+// AddLazyLoadedMembers records that the given membership events, keyed by the
+// user ID of the member, were sent to a device which lazy-loads members.
+func (d *SyncServerDatasource) AddLazyLoadedMembers(
+	ctx context.Context, userID, deviceID, roomID string, members map[string]string,
 ) error {
-	// TODO: Record that invite has been retired in a stream so that we can
-	// notify the user in an incremental sync.
-	err := d.invites.deleteInviteEvent(ctx, inviteEventID)
-	return err
+	return common.WithTransaction(d.db, func(txn *sql.Tx) error {
+		for memberUserID, eventID := range members {
+			if err := d.lazyLoadedMembers.upsertLazyLoadedMember(
+				ctx, txn, userID, deviceID, roomID, memberUserID, eventID,
+			); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
 }
 
 func (d *SyncServerDatasource) SetTypingTimeoutCallback(fn cache.TimeoutCallbackFn) {
@@ -798,16 +1172,71 @@ func (d *SyncServerDatasource) addInvitesToResponse(
 		return err
 	}
 	for roomID, inviteEvent := range invites {
-		ir := types.NewInviteResponse()
-		ir.InviteState.Events = gomatrixserverlib.HeaderedToClientEvents(
-			[]gomatrixserverlib.HeaderedEvent{inviteEvent}, gomatrixserverlib.FormatSync,
-		)
-		// TODO: add the invite state from the invite event.
+		ir, err := types.NewInviteResponse(inviteEvent)
+		if err != nil {
+			return err
+		}
 		res.Rooms.Invite[roomID] = *ir
 	}
 	return nil
 }
 
+// addInviteDeltaToResponse adds the invites that the user received between the
+// two positions to a sync response. Rooms in which an invite of the user was
+// retired, e.g. because it was rejected or rescinded, are added to the "leave"
+// section so that clients stop showing the invite, unless the response already
+// tells the client about the room in another way.
+func (d *SyncServerDatasource) addInviteDeltaToResponse(
+	ctx context.Context,
+	userID string,
+	fromPos, toPos types.StreamPosition,
+	joinedRoomIDs []string,
+	res *types.Response,
+) (err error) {
+	txn, err := d.db.BeginTx(ctx, &txReadOnlySnapshot)
+	if err != nil {
+		return err
+	}
+	var succeeded bool
+	defer func() {
+		txerr := common.EndTransaction(txn, &succeeded)
+		if err == nil && txerr != nil {
+			err = txerr
+		}
+	}()
+
+	if err = d.addInvitesToResponse(ctx, txn, userID, fromPos, toPos, res); err != nil {
+		return err
+	}
+
+	retiredRoomIDs, err := d.retiredInvites.selectRetiredInvitesInRange(ctx, txn, userID, fromPos, toPos)
+	if err != nil {
+		return err
+	}
+	joined := make(map[string]bool, len(joinedRoomIDs))
+	for _, roomID := range joinedRoomIDs {
+		joined[roomID] = true
+	}
+	for _, roomID := range retiredRoomIDs {
+		if joined[roomID] {
+			continue
+		}
+		if _, ok := res.Rooms.Join[roomID]; ok {
+			continue
+		}
+		if _, ok := res.Rooms.Invite[roomID]; ok {
+			continue
+		}
+		if _, ok := res.Rooms.Leave[roomID]; ok {
+			continue
+		}
+		res.Rooms.Leave[roomID] = *types.NewLeaveResponse()
+	}
+
+	succeeded = true
+	return nil
+}
+
 // Retrieve the backward topology position, i.e. the position of the
 // oldest event in the room's topology.
 func (d *SyncServerDatasource) getBackwardTopologyPos(
@@ -825,6 +1254,144 @@ func (d *SyncServerDatasource) getBackwardTopologyPos(
 	return
 }
 
+// maxFilteredRecentEventsScanned is the number of events that
+// selectFilteredRecentEvents looks at before giving up on filling a timeline.
+const maxFilteredRecentEventsScanned = 1000
+
+// selectFilteredRecentEvents returns the most recent events in the room
+// between the two positions that pass the timeline filter and that the user
+// is allowed to see, up to the limit of the filter and in chronological order.
+// The events are selected in batches so that the events excluded by the
+// filter or hidden by the history visibility don't count towards the limit.
+// One more event than the limit is looked for, so that limited is true if
+// there are older events in the range that the client hasn't been sent.
+// At most maxFilteredRecentEventsScanned events are looked at, so a filter
+// that excludes most of a busy room doesn't scan the whole room. If the
+// limit is hit then limited is true, and paginateFrom holds the oldest event
+// looked at rather than the timeline so that the prev_batch token of the
+// timeline lets the client carry on from where the scan stopped.
+func (d *SyncServerDatasource) selectFilteredRecentEvents(
+	ctx context.Context, txn *sql.Tx, roomID string,
+	fromPos, toPos types.StreamPosition,
+	timelineFilter *gomatrixserverlib.RoomEventFilter,
+	visible types.VisibleEventsFunc,
+) (events, paginateFrom []types.StreamEvent, limited bool, err error) {
+	events = []types.StreamEvent{}
+	if !types.FilterAllowsRoom(timelineFilter.Rooms, timelineFilter.NotRooms, roomID) {
+		return events, events, false, nil
+	}
+	wanted := timelineFilter.Limit + 1
+	scanned := 0
+	var oldest types.StreamEvent
+	for len(events) < wanted && toPos > fromPos {
+		if scanned >= maxFilteredRecentEventsScanned {
+			// There may be more events that pass the filter in the rest of
+			// the range, but the client has to paginate to find them.
+			sortStreamEvents(events)
+			return events, []types.StreamEvent{oldest}, true, nil
+		}
+		// The batch is ordered from the most recent event to the oldest one.
+		var batch []types.StreamEvent
+		batch, err = d.events.selectRecentEvents(
+			ctx, txn, roomID, fromPos, toPos, wanted, false, true,
+		)
+		if err != nil {
+			return nil, nil, false, err
+		}
+		scanned += len(batch)
+		var allowed []types.StreamEvent
+		for _, ev := range batch {
+			if types.RoomEventFilterAllows(timelineFilter, &ev.Event) {
+				allowed = append(allowed, ev)
+			}
+		}
+		if allowed, err = visible.Filter(ctx, allowed); err != nil {
+			return nil, nil, false, err
+		}
+		for _, ev := range allowed {
+			if len(events) < wanted {
+				events = append(events, ev)
+			}
+		}
+		if len(batch) < wanted {
+			break
+		}
+		oldest = batch[len(batch)-1]
+		toPos = oldest.StreamPosition - 1
+	}
+	if len(events) > timelineFilter.Limit {
+		events = events[:timelineFilter.Limit]
+		limited = true
+	}
+	sortStreamEvents(events)
+	return events, events, limited, nil
+}
+
+// sortStreamEvents sorts the events in chronological order.
+func sortStreamEvents(events []types.StreamEvent) {
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].StreamPosition < events[j].StreamPosition
+	})
+}
+
+// stateAtTimelineStart returns the state of a room at the start of a
+// timeline, given the state after the timeline events. The state events in
+// the timeline are swapped for the state events that they replaced, which
+// are taken from the replaces_state key of their unsigned data.
+func (d *SyncServerDatasource) stateAtTimelineStart(
+	ctx context.Context, txn *sql.Tx,
+	stateEvents, timeline []gomatrixserverlib.HeaderedEvent,
+) ([]gomatrixserverlib.HeaderedEvent, error) {
+	type stateKeyTuple struct {
+		eventType string
+		stateKey  string
+	}
+	changed := make(map[stateKeyTuple]bool)
+	var replacedEventIDs []string
+	for _, ev := range timeline {
+		if ev.StateKey() == nil {
+			continue
+		}
+		key := stateKeyTuple{ev.Type(), *ev.StateKey()}
+		if changed[key] {
+			// Only the first change in the timeline tells us the state at
+			// its start.
+			continue
+		}
+		changed[key] = true
+		var prev types.PrevEventRef
+		if len(ev.Unsigned()) > 0 {
+			if err := json.Unmarshal(ev.Unsigned(), &prev); err != nil {
+				return nil, err
+			}
+		}
+		if prev.ReplacesState != "" {
+			replacedEventIDs = append(replacedEventIDs, prev.ReplacesState)
+		}
+	}
+
+	result := make([]gomatrixserverlib.HeaderedEvent, 0, len(stateEvents))
+	for _, ev := range stateEvents {
+		if ev.StateKey() != nil && changed[stateKeyTuple{ev.Type(), *ev.StateKey()}] {
+			continue
+		}
+		result = append(result, ev)
+	}
+	if len(replacedEventIDs) == 0 {
+		return result, nil
+	}
+	// The replaced events are no longer in the current state, so they are
+	// looked up in the stream of events.
+	replaced, err := d.events.selectEvents(ctx, txn, replacedEventIDs)
+	if err != nil {
+		return nil, err
+	}
+	for _, ev := range replaced {
+		result = append(result, ev.HeaderedEvent)
+	}
+	return result, nil
+}
+
 // addRoomDeltaToResponse adds a room state delta to a sync response
 func (d *SyncServerDatasource) addRoomDeltaToResponse(
 	ctx context.Context,
@@ -832,29 +1399,36 @@ func (d *SyncServerDatasource) addRoomDeltaToResponse(
 	txn *sql.Tx,
 	fromPos, toPos types.StreamPosition,
 	delta stateDelta,
-	numRecentEventsPerRoom int,
+	timelineFilter *gomatrixserverlib.RoomEventFilter,
+	visible types.VisibleEventsFunc,
 	res *types.Response,
 ) error {
 	endPos := toPos
-	if delta.membershipPos > 0 && delta.membership == gomatrixserverlib.Leave {
-		// make sure we don't leak recent events after the leave event.
-		// TODO: History visibility makes this somewhat complex to handle correctly. For example:
-		// TODO: This doesn't work for join -> leave in a single /sync request (see events prior to join).
-		// TODO: This will fail on join -> leave -> sensitive msg -> join -> leave
-		//       in a single /sync request
-		// This is all "okay" assuming history_visibility == "shared" which it is by default.
+	if delta.membershipPos > 0 && (delta.membership == gomatrixserverlib.Leave || delta.membership == gomatrixserverlib.Ban) {
+		// make sure we don't leak recent events after the leave event. The
+		// events before it that the user isn't allowed to see are removed
+		// by the history visibility checks when the timeline is selected.
 		endPos = delta.membershipPos
 	}
-	recentStreamEvents, err := d.events.selectRecentEvents(
-		ctx, txn, delta.roomID, types.StreamPosition(fromPos), types.StreamPosition(endPos),
-		numRecentEventsPerRoom, true, true,
+	recentStreamEvents, paginateFrom, limited, err := d.selectFilteredRecentEvents(
+		ctx, txn, delta.roomID, fromPos, endPos, timelineFilter, visible,
 	)
 	if err != nil {
 		return err
 	}
 	recentEvents := d.StreamEventsToEvents(device, recentStreamEvents)
-	delta.stateEvents = removeDuplicates(delta.stateEvents, recentEvents)
-	backwardTopologyPos := d.getBackwardTopologyPos(ctx, txn, recentStreamEvents)
+	if limited {
+		// There is a gap between the events the client already has and the
+		// timeline, so the state has to be given as of the start of the
+		// timeline for the client to be able to fill the gap.
+		delta.stateEvents, err = d.stateAtTimelineStart(ctx, txn, delta.stateEvents, recentEvents)
+		if err != nil {
+			return err
+		}
+	} else {
+		delta.stateEvents = removeDuplicates(delta.stateEvents, recentEvents) // roll back
+	}
+	backwardTopologyPos := d.getBackwardTopologyPos(ctx, txn, paginateFrom)
 
 	switch delta.membership {
 	case gomatrixserverlib.Join:
@@ -864,20 +1438,18 @@ func (d *SyncServerDatasource) addRoomDeltaToResponse(
 			types.PaginationTokenTypeTopology, backwardTopologyPos, 0,
 		).String()
 		jr.Timeline.Events = gomatrixserverlib.HeaderedToClientEvents(recentEvents, gomatrixserverlib.FormatSync)
-		jr.Timeline.Limited = false // TODO: if len(events) >= numRecents + 1 and then set limited:true
+		jr.Timeline.Limited = limited
 		jr.State.Events = gomatrixserverlib.HeaderedToClientEvents(delta.stateEvents, gomatrixserverlib.FormatSync)
 		res.Rooms.Join[delta.roomID] = *jr
 	case gomatrixserverlib.Leave:
 		fallthrough // transitions to leave are the same as ban
 	case gomatrixserverlib.Ban:
-		// TODO: recentEvents may contain events that this user is not allowed to see because they are
-		//       no longer in the room.
 		lr := types.NewLeaveResponse()
 		lr.Timeline.PrevBatch = types.NewPaginationTokenFromTypeAndPosition(
 			types.PaginationTokenTypeTopology, backwardTopologyPos, 0,
 		).String()
 		lr.Timeline.Events = gomatrixserverlib.HeaderedToClientEvents(recentEvents, gomatrixserverlib.FormatSync)
-		lr.Timeline.Limited = false // TODO: if len(events) >= numRecents + 1 and then set limited:true
+		lr.Timeline.Limited = limited
 		lr.State.Events = gomatrixserverlib.HeaderedToClientEvents(delta.stateEvents, gomatrixserverlib.FormatSync)
 		res.Rooms.Leave[delta.roomID] = *lr
 	}
@@ -983,10 +1555,10 @@ func (d *SyncServerDatasource) getStateDeltas(
 	// Implement membership change algorithm: https://github.com/matrix-org/synapse/blob/v0.19.3/synapse/handlers/sync.py#L821
 	// - Get membership list changes for this user in this sync response
 	// - For each room which has membership list changes:
-	//     * Check if the room is 'newly joined' (insufficient to just check for a join event because we allow dupe joins TODO).
-	//       If it is, then we need to send the full room state down (and 'limited' is always true).
+	//     * Check if the room is 'newly joined', i.e. the user wasn't joined at fromPos.
+	//       If it is, then we need to send the full room state down.
 	//     * Check if user is still CURRENTLY invited to the room. If so, add room to 'invited' block.
-	//     * Check if the user is CURRENTLY (TODO) left/banned. If so, add room to 'archived' block.
+	//     * Check if the user's latest membership in the range is leave/ban. If so, add room to 'archived' block.
 	// - Get all CURRENTLY joined rooms, and add them to 'joined' block.
 	var deltas []stateDelta
 
@@ -995,38 +1567,31 @@ func (d *SyncServerDatasource) getStateDeltas(
 	if err != nil {
 		return nil, nil, err
 	}
-	state, err := d.fetchStateEvents(ctx, txn, stateNeeded, eventMap)
-	if err != nil {
-		return nil, nil, err
-	}
-
-	for roomID, stateStreamEvents := range state {
-		for _, ev := range stateStreamEvents {
-			// TODO: Currently this will incorrectly add rooms which were ALREADY joined but they sent another no-op join event.
-			//       We should be checking if the user was already joined at fromPos and not proceed if so. As a result of this,
-			//       dupe join events will result in the entire room state coming down to the client again. This is added in
-			//       the 'state' part of the response though, so is transparent modulo bandwidth concerns as it is not added to
-			//       the timeline.
-			if membership := getMembershipFromEvent(&ev.HeaderedEvent, userID); membership != "" {
-				if membership == gomatrixserverlib.Join {
-					// send full room state down instead of a delta
-					var s []types.StreamEvent
-					s, err = d.currentStateStreamEventsForRoom(ctx, txn, roomID, stateFilterPart)
-					if err != nil {
-						return nil, nil, err
-					}
-					state[roomID] = s
-					continue // we'll add this room in when we do joined rooms
-				}
 
-				deltas = append(deltas, stateDelta{
-					membership:    membership,
-					membershipPos: ev.StreamPosition,
-					stateEvents:   d.StreamEventsToEvents(device, stateStreamEvents),
-					roomID:        roomID,
-				})
-				break
+	newlyJoined := make(map[string]bool)
+	for roomID, change := range getMembershipChanges(eventMap, userID) {
+		if !change.changed {
+			// The user only sent no-op membership events, e.g. a join to
+			// update their display name, so the client already has the room.
+			continue
+		}
+		switch change.membership {
+		case gomatrixserverlib.Join:
+			// send full room state down instead of a delta when we add
+			// this room in with the joined rooms
+			newlyJoined[roomID] = true
+		case gomatrixserverlib.Leave, gomatrixserverlib.Ban:
+			var stateEvents []gomatrixserverlib.HeaderedEvent
+			stateEvents, err = d.stateAtLeave(ctx, txn, roomID, change.latest.StreamPosition, stateFilterPart)
+			if err != nil {
+				return nil, nil, err
 			}
+			deltas = append(deltas, stateDelta{
+				membership:    change.membership,
+				membershipPos: change.latest.StreamPosition,
+				stateEvents:   stateEvents,
+				roomID:        roomID,
+			})
 		}
 	}
 
@@ -1035,7 +1600,27 @@ func (d *SyncServerDatasource) getStateDeltas(
 	if err != nil {
 		return nil, nil, err
 	}
+	// Only the state deltas of rooms that the user was already joined to are
+	// needed, as the other rooms either get their full state or were left.
+	joinedStateNeeded := make(map[string]map[string]bool)
 	for _, joinedRoomID := range joinedRoomIDs {
+		if ids, ok := stateNeeded[joinedRoomID]; ok && !newlyJoined[joinedRoomID] {
+			joinedStateNeeded[joinedRoomID] = ids
+		}
+	}
+	state, err := d.fetchStateEvents(ctx, txn, joinedStateNeeded, eventMap)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, joinedRoomID := range joinedRoomIDs {
+		if newlyJoined[joinedRoomID] {
+			var s []types.StreamEvent
+			s, err = d.currentStateStreamEventsForRoom(ctx, txn, joinedRoomID, stateFilterPart)
+			if err != nil {
+				return nil, nil, err
+			}
+			state[joinedRoomID] = s
+		}
 		deltas = append(deltas, stateDelta{
 			membership:  gomatrixserverlib.Join,
 			stateEvents: d.StreamEventsToEvents(device, state[joinedRoomID]),
@@ -1077,30 +1662,26 @@ func (d *SyncServerDatasource) getStateDeltasForFullStateSync(
 	}
 
 	// Get all the state events ever between these two positions
-	stateNeeded, eventMap, err := d.events.selectStateInRange(ctx, txn, fromPos, toPos, stateFilterPart)
+	_, eventMap, err := d.events.selectStateInRange(ctx, txn, fromPos, toPos, stateFilterPart)
 	if err != nil {
 		return nil, nil, err
 	}
-	state, err := d.fetchStateEvents(ctx, txn, stateNeeded, eventMap)
-	if err != nil {
-		return nil, nil, err
-	}
-
-	for roomID, stateStreamEvents := range state {
-		for _, ev := range stateStreamEvents {
-			if membership := getMembershipFromEvent(&ev.HeaderedEvent, userID); membership != "" {
-				if membership != gomatrixserverlib.Join { // We've already added full state for all joined rooms above.
-					deltas = append(deltas, stateDelta{
-						membership:    membership,
-						membershipPos: ev.StreamPosition,
-						stateEvents:   d.StreamEventsToEvents(device, stateStreamEvents),
-						roomID:        roomID,
-					})
-				}
 
-				break
-			}
+	for roomID, change := range getMembershipChanges(eventMap, userID) {
+		// We've already added full state for all joined rooms above.
+		if !change.changed || (change.membership != gomatrixserverlib.Leave && change.membership != gomatrixserverlib.Ban) {
+			continue
 		}
+		stateEvents, stateErr := d.stateAtLeave(ctx, txn, roomID, change.latest.StreamPosition, stateFilterPart)
+		if stateErr != nil {
+			return nil, nil, stateErr
+		}
+		deltas = append(deltas, stateDelta{
+			membership:    change.membership,
+			membershipPos: change.latest.StreamPosition,
+			stateEvents:   stateEvents,
+			roomID:        roomID,
+		})
 	}
 
 	return deltas, joinedRoomIDs, nil
@@ -1110,7 +1691,7 @@ func (d *SyncServerDatasource) currentStateStreamEventsForRoom(
 	ctx context.Context, txn *sql.Tx, roomID string,
 	stateFilterPart *gomatrixserverlib.StateFilter,
 ) ([]types.StreamEvent, error) {
-	allState, err := d.roomstate.selectCurrentState(ctx, txn, roomID, stateFilterPart)
+	allState, err := d.roomstate.selectCurrentState(ctx, txn, roomID, withoutLazyLoadedMembers(stateFilterPart))
 	if err != nil {
 		return nil, err
 	}
@@ -1121,6 +1702,105 @@ func (d *SyncServerDatasource) currentStateStreamEventsForRoom(
 	return s, nil
 }
 
+// withoutLazyLoadedMembers returns the state filter to use when selecting the
+// full state of a room. Membership events are left out if the client
+// lazy-loads members, as the ones it needs are added once the timelines of
+// the response are known.
+func withoutLazyLoadedMembers(
+	stateFilterPart *gomatrixserverlib.StateFilter,
+) *gomatrixserverlib.StateFilter {
+	if !stateFilterPart.LazyLoadMembers {
+		return stateFilterPart
+	}
+	filter := *stateFilterPart
+	filter.NotTypes = append(
+		append([]string{}, stateFilterPart.NotTypes...), gomatrixserverlib.MRoomMember,
+	)
+	return &filter
+}
+
+// stateAtLeave returns the state of a room just after the membership event of
+// a user who left or was banned from the room at the given stream position.
+// The current state of the room is rolled back over the state events that
+// were sent after the user left, so that none of them are leaked to the user.
+func (d *SyncServerDatasource) stateAtLeave(
+	ctx context.Context, txn *sql.Tx, roomID string, leavePos types.StreamPosition,
+	stateFilterPart *gomatrixserverlib.StateFilter,
+) ([]gomatrixserverlib.HeaderedEvent, error) {
+	currentState, err := d.roomstate.selectCurrentState(ctx, txn, roomID, stateFilterPart)
+	if err != nil {
+		return nil, err
+	}
+	later, err := d.events.selectRoomStateChanges(ctx, txn, roomID, leavePos)
+	if err != nil {
+		return nil, err
+	}
+	return d.stateAtTimelineStart(ctx, txn, currentState, d.StreamEventsToEvents(nil, later))
+}
+
+// addArchivedRoomsToResponse adds the rooms that the user has left or been
+// banned from to the leave section of a complete sync response. The timeline
+// of each room ends with the event that removed the user from the room.
+func (d *SyncServerDatasource) addArchivedRoomsToResponse(
+	ctx context.Context, txn *sql.Tx, userID string,
+	toPos types.StreamPosition,
+	timelineFilter *gomatrixserverlib.RoomEventFilter,
+	visible types.VisibleEventsFunc,
+	stateFilterPart *gomatrixserverlib.StateFilter,
+	res *types.Response,
+) error {
+	for _, membership := range []string{gomatrixserverlib.Leave, gomatrixserverlib.Ban} {
+		roomIDs, err := d.roomstate.selectRoomIDsWithMembership(ctx, txn, userID, membership)
+		if err != nil {
+			return err
+		}
+		for _, roomID := range roomIDs {
+			var leavePos types.StreamPosition
+			leavePos, err = d.membershipPosition(ctx, txn, roomID, userID)
+			if err != nil {
+				return err
+			}
+			if leavePos == 0 || leavePos > toPos {
+				// The membership event isn't part of the stream that the
+				// client can see, so there is no timeline to give.
+				continue
+			}
+			var stateEvents []gomatrixserverlib.HeaderedEvent
+			stateEvents, err = d.stateAtLeave(ctx, txn, roomID, leavePos, stateFilterPart)
+			if err != nil {
+				return err
+			}
+			delta := stateDelta{
+				membership:    membership,
+				membershipPos: leavePos,
+				stateEvents:   stateEvents,
+				roomID:        roomID,
+			}
+			err = d.addRoomDeltaToResponse(ctx, nil, txn, 0, toPos, delta, timelineFilter, visible, res)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// membershipPosition returns the stream position of the current membership
+// event of the user in the room, or 0 if the event isn't in the stream.
+func (d *SyncServerDatasource) membershipPosition(
+	ctx context.Context, txn *sql.Tx, roomID, userID string,
+) (types.StreamPosition, error) {
+	ev, err := d.roomstate.selectStateEvent(ctx, txn, roomID, gomatrixserverlib.MRoomMember, userID)
+	if err != nil || ev == nil {
+		return 0, err
+	}
+	streamEvents, err := d.events.selectEvents(ctx, txn, []string{ev.EventID()})
+	if err != nil || len(streamEvents) == 0 {
+		return 0, err
+	}
+	return streamEvents[0].StreamPosition, nil
+}
+
 // StreamEventsToEvents converts streamEvent to Event. If device is non-nil and
 // matches the streamevent.transactionID device then the transaction ID gets
 // added to the unsigned section of the output event.
@@ -1181,3 +1861,66 @@ func getMembershipFromEvent(ev *gomatrixserverlib.HeaderedEvent, userID string)
 	}
 	return ""
 }
+
+// membershipChange is how the membership of a user in a room changed between
+// two stream positions.
+type membershipChange struct {
+	// The latest membership event of the user in the range, and its membership.
+	latest     types.StreamEvent
+	membership string
+	// Whether the membership of the user is different at any point in the
+	// range from what it was at the start of the range. This is false if the
+	// user only sent no-op membership events, e.g. a join to change their
+	// display name.
+	changed bool
+}
+
+// getMembershipChanges returns how the membership of the user changed in each
+// room that has membership events for the user amongst the given state
+// events. The membership of the user at the start of the range is taken from
+// the prev_content of their first membership event in the range.
+func getMembershipChanges(
+	eventMap map[string]types.StreamEvent, userID string,
+) map[string]*membershipChange {
+	var memberEvents []types.StreamEvent
+	for _, ev := range eventMap {
+		if getMembershipFromEvent(&ev.HeaderedEvent, userID) != "" {
+			memberEvents = append(memberEvents, ev)
+		}
+	}
+	sort.Slice(memberEvents, func(i, j int) bool {
+		return memberEvents[i].StreamPosition < memberEvents[j].StreamPosition
+	})
+
+	changes := make(map[string]*membershipChange)
+	for _, ev := range memberEvents {
+		change, ok := changes[ev.RoomID()]
+		if !ok {
+			change = &membershipChange{membership: prevMembershipFromEvent(&ev.HeaderedEvent)}
+			changes[ev.RoomID()] = change
+		}
+		membership := getMembershipFromEvent(&ev.HeaderedEvent, userID)
+		if membership != change.membership {
+			change.changed = true
+		}
+		change.latest = ev
+		change.membership = membership
+	}
+	return changes
+}
+
+// prevMembershipFromEvent returns the membership that a membership event
+// replaced, or an empty string if the user had no membership before it.
+func prevMembershipFromEvent(ev *gomatrixserverlib.HeaderedEvent) string {
+	var prev types.PrevEventRef
+	if len(ev.Unsigned()) == 0 || json.Unmarshal(ev.Unsigned(), &prev) != nil {
+		return ""
+	}
+	var content struct {
+		Membership string `json:"membership"`
+	}
+	if len(prev.PrevContent) == 0 || json.Unmarshal(prev.PrevContent, &content) != nil {
+		return ""
+	}
+	return content.Membership
+}
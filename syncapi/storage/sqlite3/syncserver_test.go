@@ -0,0 +1,484 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/matrix-org/dendrite/syncapi/types"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// mustNewTestDatasource returns a datasource backed by a database in a
+// temporary directory, and a function to remove it again.
+func mustNewTestDatasource(t *testing.T) (*SyncServerDatasource, func()) {
+	dir, err := ioutil.TempDir("", "syncapi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := NewSyncServerDatasource("file:" + filepath.Join(dir, "syncapi.db"))
+	if err != nil {
+		os.RemoveAll(dir) // nolint: errcheck
+		t.Fatal(err)
+	}
+	return d, func() {
+		d.db.Close()      // nolint: errcheck
+		os.RemoveAll(dir) // nolint: errcheck
+	}
+}
+
+// mustEvent returns an event with the given number in its event ID. The event
+// is a state event if stateKey is non-nil.
+func mustEvent(
+	t *testing.T, n int, roomID, sender, eventType string, stateKey *string, content, unsigned string,
+) gomatrixserverlib.HeaderedEvent {
+	stateKeyJSON := ""
+	if stateKey != nil {
+		stateKeyJSON = fmt.Sprintf(`"state_key":%q,`, *stateKey)
+	}
+	eventJSON := fmt.Sprintf(
+		`{"event_id":"$%d:localhost","room_id":%q,"type":%q,%s"sender":%q,`+
+			`"content":%s,"unsigned":%s,"origin_server_ts":0,`+
+			`"prev_events":[],"auth_events":[],"depth":%d}`,
+		n, roomID, eventType, stateKeyJSON, sender, content, unsigned, n,
+	)
+	ev, err := gomatrixserverlib.NewEventFromTrustedJSON([]byte(eventJSON), false, gomatrixserverlib.RoomVersionV1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ev.Headered(gomatrixserverlib.RoomVersionV1)
+}
+
+func mustMemberEvent(
+	t *testing.T, pos types.StreamPosition, roomID, userID, membership, unsigned string,
+) types.StreamEvent {
+	content := fmt.Sprintf(`{"membership":%q}`, membership)
+	return types.StreamEvent{
+		HeaderedEvent:  mustEvent(t, int(pos), roomID, userID, gomatrixserverlib.MRoomMember, &userID, content, unsigned),
+		StreamPosition: pos,
+	}
+}
+
+func TestPrevMembershipFromEvent(t *testing.T) {
+	for unsigned, want := range map[string]string{
+		`{}`:                      "",
+		`{"prev_content":{}}`:     "",
+		`{"prev_content":"join"}`: "",
+		`{"prev_content":{"membership":"invite"}}`:                              "invite",
+		`{"prev_content":{"membership":"leave"}}`:                               "leave",
+		`{"replaces_state":"$0:localhost"}`:                                     "",
+		`{"prev_content":{"membership":["join"]}}`:                              "",
+		`{"prev_sender":"@bob:localhost","prev_content":{"membership":"join"}}`: "join",
+	} {
+		ev := mustMemberEvent(t, 1, "!room:localhost", "@alice:localhost", "join", unsigned)
+		if got := prevMembershipFromEvent(&ev.HeaderedEvent); got != want {
+			t.Errorf("unsigned %s: got membership %q, want %q", unsigned, got, want)
+		}
+	}
+}
+
+func TestGetMembershipChanges(t *testing.T) {
+	const alice, bob = "@alice:localhost", "@bob:localhost"
+	events := []types.StreamEvent{
+		// Alice changes her display name in a room she was already in.
+		mustMemberEvent(t, 1, "!noop:localhost", alice, "join", `{"prev_content":{"membership":"join"}}`),
+		// Alice joins a room and then leaves it again.
+		mustMemberEvent(t, 2, "!left:localhost", alice, "join", `{}`),
+		mustMemberEvent(t, 5, "!left:localhost", alice, "leave", `{"prev_content":{"membership":"join"}}`),
+		// Alice accepts an invite.
+		mustMemberEvent(t, 3, "!joined:localhost", alice, "join", `{"prev_content":{"membership":"invite"}}`),
+		// Alice leaves and rejoins a room, which is a change even though she
+		// ends up joined to it.
+		mustMemberEvent(t, 4, "!rejoined:localhost", alice, "leave", `{"prev_content":{"membership":"join"}}`),
+		mustMemberEvent(t, 6, "!rejoined:localhost", alice, "join", `{"prev_content":{"membership":"leave"}}`),
+		// Bob's membership doesn't concern Alice.
+		mustMemberEvent(t, 7, "!bob:localhost", bob, "join", `{}`),
+	}
+	eventMap := make(map[string]types.StreamEvent)
+	for _, ev := range events {
+		eventMap[ev.EventID()] = ev
+	}
+
+	changes := getMembershipChanges(eventMap, alice)
+	for roomID, want := range map[string]struct {
+		membership string
+		latestPos  types.StreamPosition
+		changed    bool
+	}{
+		"!noop:localhost":     {gomatrixserverlib.Join, 1, false},
+		"!left:localhost":     {gomatrixserverlib.Leave, 5, true},
+		"!joined:localhost":   {gomatrixserverlib.Join, 3, true},
+		"!rejoined:localhost": {gomatrixserverlib.Join, 6, true},
+	} {
+		change, ok := changes[roomID]
+		if !ok {
+			t.Errorf("%s: no membership change", roomID)
+			continue
+		}
+		if change.membership != want.membership || change.latest.StreamPosition != want.latestPos || change.changed != want.changed {
+			t.Errorf(
+				"%s: got membership %s at %d (changed: %v), want %s at %d (changed: %v)", roomID,
+				change.membership, change.latest.StreamPosition, change.changed,
+				want.membership, want.latestPos, want.changed,
+			)
+		}
+	}
+	if _, ok := changes["!bob:localhost"]; ok {
+		t.Error("got a membership change for a room with only another user's membership")
+	}
+	if len(changes) != 4 {
+		t.Errorf("got %d membership changes, want 4", len(changes))
+	}
+}
+
+func TestSelectFilteredRecentEventsStopsScanning(t *testing.T) {
+	d, closeDB := mustNewTestDatasource(t)
+	defer closeDB()
+	ctx := context.Background()
+
+	const roomID, alice = "!room:localhost", "@alice:localhost"
+	// A topic change is followed by more messages than are scanned.
+	topic := mustEvent(t, 1, roomID, alice, "m.room.topic", new(string), `{"topic":"old"}`, `{}`)
+	if _, err := d.WriteEvent(ctx, &topic, nil, nil, nil, nil, false); err != nil {
+		t.Fatal(err)
+	}
+	var latestPos types.StreamPosition
+	for i := 2; i <= maxFilteredRecentEventsScanned+2; i++ {
+		msg := mustEvent(t, i, roomID, alice, "m.room.message", nil, `{"body":"hello"}`, `{}`)
+		pos, err := d.WriteEvent(ctx, &msg, nil, nil, nil, nil, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		latestPos = pos
+	}
+
+	filter := gomatrixserverlib.DefaultRoomEventFilter()
+	filter.Limit = 9
+	filter.Types = []string{"m.room.topic"}
+	events, paginateFrom, limited, err := d.selectFilteredRecentEvents(ctx, nil, roomID, 0, latestPos, &filter, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 0 || !limited {
+		t.Errorf("got %d events (limited: %v), want none and a limited timeline", len(events), limited)
+	}
+	if len(paginateFrom) != 1 || paginateFrom[0].StreamPosition != latestPos-maxFilteredRecentEventsScanned+1 {
+		t.Errorf("got %v to paginate from, want the oldest of the scanned events", paginateFrom)
+	}
+
+	// Without the filter the timeline is filled from the first batch.
+	filter.Types = nil
+	events, paginateFrom, limited, err = d.selectFilteredRecentEvents(ctx, nil, roomID, 0, latestPos, &filter, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != filter.Limit || !limited {
+		t.Fatalf("got %d events (limited: %v), want %d and a limited timeline", len(events), limited, filter.Limit)
+	}
+	if events[len(events)-1].StreamPosition != latestPos {
+		t.Errorf("got a timeline ending at %d, want %d", events[len(events)-1].StreamPosition, latestPos)
+	}
+	if len(paginateFrom) != len(events) || paginateFrom[0].EventID() != events[0].EventID() {
+		t.Error("want to paginate from the start of the timeline")
+	}
+}
+
+func TestLimitedTimelineState(t *testing.T) {
+	d, closeDB := mustNewTestDatasource(t)
+	defer closeDB()
+	ctx := context.Background()
+
+	const roomID, alice = "!room:localhost", "@alice:localhost"
+	oldTopic := mustEvent(t, 1, roomID, alice, "m.room.topic", new(string), `{"topic":"old"}`, `{}`)
+	newTopic := mustEvent(
+		t, 5, roomID, alice, "m.room.topic", new(string), `{"topic":"new"}`,
+		`{"replaces_state":"$1:localhost","prev_content":{"topic":"old"}}`,
+	)
+	for i := 1; i <= 6; i++ {
+		var err error
+		switch i {
+		case 1:
+			_, err = d.WriteEvent(ctx, &oldTopic, []gomatrixserverlib.HeaderedEvent{oldTopic}, []string{oldTopic.EventID()}, nil, nil, false)
+		case 5:
+			_, err = d.WriteEvent(ctx, &newTopic, []gomatrixserverlib.HeaderedEvent{newTopic}, []string{newTopic.EventID()}, []string{oldTopic.EventID()}, nil, false)
+		default:
+			msg := mustEvent(t, i, roomID, alice, "m.room.message", nil, `{"body":"hello"}`, `{}`)
+			_, err = d.WriteEvent(ctx, &msg, nil, nil, nil, nil, false)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	stateFilter := gomatrixserverlib.DefaultStateFilter()
+	currentState, err := d.roomstate.selectCurrentState(ctx, nil, roomID, &stateFilter)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The state at the start of a timeline that changes the topic has the
+	// topic from before the change.
+	msg := mustEvent(t, 6, roomID, alice, "m.room.message", nil, `{"body":"hello"}`, `{}`)
+	state, err := d.stateAtTimelineStart(ctx, nil, currentState, []gomatrixserverlib.HeaderedEvent{newTopic, msg})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(state) != 1 || state[0].EventID() != oldTopic.EventID() {
+		t.Errorf("got state %v at the start of the timeline, want the old topic", state)
+	}
+
+	for _, tc := range []struct {
+		limit       int
+		wantLimited bool
+		wantEvents  int
+		wantState   []string
+	}{
+		// The timeline starts with the new topic, so the state is as of
+		// before it and the client can paginate to the earlier messages.
+		{limit: 2, wantLimited: true, wantEvents: 2, wantState: []string{oldTopic.EventID()}},
+		// Every event since the last sync fits in the timeline, so the state
+		// events already in the timeline aren't repeated.
+		{limit: 10, wantLimited: false, wantEvents: 5},
+	} {
+		timelineFilter := gomatrixserverlib.DefaultRoomEventFilter()
+		timelineFilter.Limit = tc.limit
+		delta := stateDelta{
+			roomID:      roomID,
+			stateEvents: currentState,
+			membership:  gomatrixserverlib.Join,
+		}
+		res := types.NewResponse(types.PaginationToken{})
+		if err = d.addRoomDeltaToResponse(ctx, nil, nil, 1, 6, delta, &timelineFilter, nil, res); err != nil {
+			t.Fatal(err)
+		}
+		jr := res.Rooms.Join[roomID]
+		if jr.Timeline.Limited != tc.wantLimited || len(jr.Timeline.Events) != tc.wantEvents {
+			t.Errorf("limit %d: got %d events (limited: %v), want %d (limited: %v)",
+				tc.limit, len(jr.Timeline.Events), jr.Timeline.Limited, tc.wantEvents, tc.wantLimited)
+		}
+		var gotState []string
+		for _, ev := range jr.State.Events {
+			gotState = append(gotState, ev.EventID)
+		}
+		if fmt.Sprint(gotState) != fmt.Sprint(tc.wantState) {
+			t.Errorf("limit %d: got state %v, want %v", tc.limit, gotState, tc.wantState)
+		}
+		prevBatch, err := types.NewPaginationTokenFromString(jr.Timeline.PrevBatch)
+		if err != nil {
+			t.Fatalf("limit %d: prev_batch %q: %s", tc.limit, jr.Timeline.PrevBatch, err)
+		}
+		// The events are at the topological position of their depth, and
+		// pagination continues from just before the first event.
+		firstDepth := types.StreamPosition(7 - tc.wantEvents)
+		if prevBatch.Type != types.PaginationTokenTypeTopology || prevBatch.PDUPosition != firstDepth-1 {
+			t.Errorf("limit %d: got prev_batch %s, want a topology token at %d", tc.limit, jr.Timeline.PrevBatch, firstDepth-1)
+		}
+	}
+}
+
+func TestSelectFilteredRecentEventsVisibility(t *testing.T) {
+	d, closeDB := mustNewTestDatasource(t)
+	defer closeDB()
+	ctx := context.Background()
+
+	const roomID, alice = "!room:localhost", "@alice:localhost"
+	var latestPos types.StreamPosition
+	for i := 1; i <= 6; i++ {
+		msg := mustEvent(t, i, roomID, alice, "m.room.message", nil, `{"body":"hello"}`, `{}`)
+		pos, err := d.WriteEvent(ctx, &msg, nil, nil, nil, nil, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		latestPos = pos
+	}
+	// The user isn't allowed to see the first three events, e.g. because
+	// they were sent before the user joined the room.
+	visible := func(ctx context.Context, eventIDs []string) (map[string]bool, error) {
+		result := make(map[string]bool)
+		for _, eventID := range eventIDs {
+			result[eventID] = eventID > "$3:localhost"
+		}
+		return result, nil
+	}
+
+	for _, tc := range []struct {
+		limit       int
+		wantEvents  []string
+		wantLimited bool
+	}{
+		// The hidden events don't make the timeline limited.
+		{limit: 3, wantEvents: []string{"$4:localhost", "$5:localhost", "$6:localhost"}},
+		{limit: 10, wantEvents: []string{"$4:localhost", "$5:localhost", "$6:localhost"}},
+		{limit: 2, wantEvents: []string{"$5:localhost", "$6:localhost"}, wantLimited: true},
+	} {
+		filter := gomatrixserverlib.DefaultRoomEventFilter()
+		filter.Limit = tc.limit
+		events, paginateFrom, limited, err := d.selectFilteredRecentEvents(ctx, nil, roomID, 0, latestPos, &filter, visible)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, ev := range events {
+			got = append(got, ev.EventID())
+		}
+		if fmt.Sprint(got) != fmt.Sprint(tc.wantEvents) || limited != tc.wantLimited {
+			t.Errorf("limit %d: got %v (limited: %v), want %v (limited: %v)", tc.limit, got, limited, tc.wantEvents, tc.wantLimited)
+		}
+		if len(paginateFrom) == 0 || paginateFrom[0].EventID() != tc.wantEvents[0] {
+			t.Errorf("limit %d: want to paginate from the first visible event", tc.limit)
+		}
+	}
+}
+
+func TestDeviceListsChangedAndLeft(t *testing.T) {
+	d, closeDB := mustNewTestDatasource(t)
+	defer closeDB()
+	ctx := context.Background()
+
+	const roomA, roomB = "!a:localhost", "!b:localhost"
+	const alice, bob, charlie = "@alice:localhost", "@bob:localhost", "@charlie:localhost"
+	memberships := []struct {
+		roomID, userID, membership string
+	}{
+		{roomA, alice, "join"},
+		{roomA, bob, "join"},
+		{roomA, charlie, "join"},
+		{roomB, alice, "join"},
+		{roomB, charlie, "join"},
+		{roomA, bob, "leave"},
+		{roomA, charlie, "leave"},
+		{roomB, alice, "leave"},
+	}
+	current := map[string]string{}
+	writeMemberships := func(from, to int) {
+		for i := from; i < to; i++ {
+			m := memberships[i]
+			ev := mustMemberEvent(t, types.StreamPosition(i+1), m.roomID, m.userID, m.membership, `{}`).HeaderedEvent
+			var removeStateEventIDs []string
+			if prevEventID, ok := current[m.roomID+m.userID]; ok {
+				removeStateEventIDs = []string{prevEventID}
+			}
+			if _, err := d.WriteEvent(
+				ctx, &ev, []gomatrixserverlib.HeaderedEvent{ev}, []string{ev.EventID()}, removeStateEventIDs, nil, false,
+			); err != nil {
+				t.Fatal(err)
+			}
+			current[m.roomID+m.userID] = ev.EventID()
+		}
+	}
+	wantUsers := func(what string, got []string, err error, want ...string) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("%s: got %v, want %v", what, got, want)
+		}
+	}
+	writeMemberships(0, 5)
+
+	// Key changes have their own stream, separate from the room events.
+	pos, err := d.AddKeyChange(ctx, bob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pos != 1 {
+		t.Errorf("got key change position %d, want 1", pos)
+	}
+	latest, err := d.SyncPosition(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if latest.PDUPosition != 5 || latest.DeviceListPosition != 1 {
+		t.Errorf("got sync position %s, want PDU position 5 and device list position 1", latest.String())
+	}
+	changed, err := d.KeyChangesInRange(ctx, alice, 0, latest.DeviceListPosition)
+	wantUsers("changed", changed, err, bob)
+
+	// Charlie still shares room B with Alice after leaving room A.
+	writeMemberships(5, 7)
+	left, err := d.UsersLeftInRange(ctx, alice, 5, 7)
+	wantUsers("left after bob and charlie left room A", left, err, bob)
+
+	// Once Alice leaves room B she doesn't share a room with Charlie either.
+	writeMemberships(7, 8)
+	left, err = d.UsersLeftInRange(ctx, alice, 7, 8)
+	wantUsers("left after alice left room B", left, err, charlie)
+}
+
+func TestSelectPresenceAfter(t *testing.T) {
+	d, closeDB := mustNewTestDatasource(t)
+	defer closeDB()
+	ctx := context.Background()
+
+	const roomID, alice, bob = "!room:localhost", "@alice:localhost", "@bob:localhost"
+	for i, userID := range []string{alice, bob} {
+		ev := mustMemberEvent(t, types.StreamPosition(i+1), roomID, userID, "join", `{}`).HeaderedEvent
+		if _, err := d.WriteEvent(
+			ctx, &ev, []gomatrixserverlib.HeaderedEvent{ev}, []string{ev.EventID()}, nil, nil, false,
+		); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pos, err := d.UpsertPresence(ctx, types.Presence{UserID: bob, Presence: "online"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	presences, err := d.presence.selectPresenceAfter(ctx, alice, pos-1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(presences) != 1 || presences[0].UserID != bob {
+		t.Errorf("got presence %+v, want the presence of %s", presences, bob)
+	}
+	if presences, err = d.presence.selectPresenceAfter(ctx, alice, pos); err != nil {
+		t.Fatal(err)
+	}
+	if len(presences) != 0 {
+		t.Errorf("got presence %+v after the latest position, want none", presences)
+	}
+}
+
+func TestAccountDataStreamStartsAfterExistingRows(t *testing.T) {
+	d, closeDB := mustNewTestDatasource(t)
+	defer closeDB()
+	ctx := context.Background()
+
+	// Simulate a database from before account data had a stream of its own,
+	// where the rows were numbered from the global stream.
+	if _, err := d.db.Exec(
+		"INSERT INTO syncapi_account_data_type (id, user_id, room_id, type) VALUES (100, '@alice:localhost', '', 'm.push_rules')",
+	); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.db.Exec("UPDATE syncapi_stream_id SET stream_id = 0 WHERE stream_name = 'account_data'"); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.prepare(); err != nil {
+		t.Fatal(err)
+	}
+
+	pos, err := d.UpsertAccountData(ctx, "@bob:localhost", "", "m.push_rules")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pos != 101 {
+		t.Errorf("got account data position %d, want 101", pos)
+	}
+}
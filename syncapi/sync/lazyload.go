@@ -0,0 +1,121 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sync
+
+import (
+	"context"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/syncapi/storage"
+	"github.com/matrix-org/dendrite/syncapi/types"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// LazyLoadMembers returns the membership events that a client lazy-loading
+// members needs to display a chunk of events returned by /messages, i.e. the
+// ones of the senders of the events. Unless the filter asks for redundant
+// members, the ones that the device was already sent are left out.
+func LazyLoadMembers(
+	ctx context.Context, db storage.Database, device *authtypes.Device, roomID string,
+	filter *gomatrixserverlib.RoomEventFilter, chunk []gomatrixserverlib.ClientEvent,
+) ([]gomatrixserverlib.ClientEvent, error) {
+	stateFilter := gomatrixserverlib.DefaultStateFilter()
+	return lazyLoadMembers(
+		ctx, db, device, roomID, &stateFilter, nil, chunk, true, !filter.IncludeRedundantMembers,
+	)
+}
+
+// lazyLoadMembers returns the state of a room with only the membership events
+// that are needed for its timeline. If addMissing is true then the current
+// membership events of the senders which aren't in the state are added. The
+// membership events that end up being sent to the device are recorded.
+func lazyLoadMembers(
+	ctx context.Context, db storage.Database, device *authtypes.Device, roomID string,
+	stateFilter *gomatrixserverlib.StateFilter,
+	state, timeline []gomatrixserverlib.ClientEvent,
+	addMissing, skipRedundant bool,
+) ([]gomatrixserverlib.ClientEvent, error) {
+	needed := map[string]bool{device.UserID: true}
+	inTimeline := make(map[string]bool)
+	for _, ev := range timeline {
+		needed[ev.Sender] = true
+		// The client learns about membership changes in the timeline from
+		// the timeline itself.
+		if ev.Type == gomatrixserverlib.MRoomMember && ev.StateKey != nil {
+			inTimeline[*ev.StateKey] = true
+		}
+	}
+
+	result := make([]gomatrixserverlib.ClientEvent, 0, len(state))
+	inState := make(map[string]bool)
+	for _, ev := range state {
+		if ev.Type != gomatrixserverlib.MRoomMember || ev.StateKey == nil {
+			result = append(result, ev)
+		} else if needed[*ev.StateKey] {
+			inState[*ev.StateKey] = true
+			result = append(result, ev)
+		}
+	}
+
+	if addMissing {
+		var missing []gomatrixserverlib.ClientEvent
+		for userID := range needed {
+			if inState[userID] || inTimeline[userID] {
+				continue
+			}
+			ev, err := db.GetStateEvent(ctx, roomID, gomatrixserverlib.MRoomMember, userID)
+			if err != nil {
+				return nil, err
+			}
+			if ev != nil {
+				missing = append(missing, gomatrixserverlib.HeaderedToClientEvent(*ev, gomatrixserverlib.FormatSync))
+			}
+		}
+		result = append(result, types.FilterStateEvents(stateFilter, roomID, missing)...)
+	}
+
+	var sent map[string]string
+	if skipRedundant {
+		var err error
+		sent, err = db.LazyLoadedMembers(ctx, device.UserID, device.ID, roomID)
+		if err != nil {
+			return nil, err
+		}
+	}
+	members := make(map[string]string)
+	filtered := result[:0]
+	for _, ev := range result {
+		if ev.Type == gomatrixserverlib.MRoomMember && ev.StateKey != nil {
+			if sent[*ev.StateKey] == ev.EventID {
+				continue
+			}
+			members[*ev.StateKey] = ev.EventID
+		}
+		filtered = append(filtered, ev)
+	}
+	for _, ev := range timeline {
+		if ev.Type == gomatrixserverlib.MRoomMember && ev.StateKey != nil {
+			members[*ev.StateKey] = ev.EventID
+		}
+	}
+	if len(members) > 0 {
+		if err := db.AddLazyLoadedMembers(
+			ctx, device.UserID, device.ID, roomID, members,
+		); err != nil {
+			return nil, err
+		}
+	}
+	return filtered, nil
+}
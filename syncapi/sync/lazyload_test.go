@@ -0,0 +1,218 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sync
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"testing"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/syncapi/storage"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const testRoomID = "!room:localhost"
+
+// fakeLazyLoadDatabase holds the current membership events of a room and the
+// members that were sent to the device.
+type fakeLazyLoadDatabase struct {
+	storage.Database
+	members map[string]*gomatrixserverlib.HeaderedEvent
+	sent    map[string]string
+}
+
+func (d *fakeLazyLoadDatabase) GetStateEvent(
+	ctx context.Context, roomID, evType, stateKey string,
+) (*gomatrixserverlib.HeaderedEvent, error) {
+	if evType != gomatrixserverlib.MRoomMember {
+		return nil, nil
+	}
+	return d.members[stateKey], nil
+}
+
+func (d *fakeLazyLoadDatabase) LazyLoadedMembers(
+	ctx context.Context, userID, deviceID, roomID string,
+) (map[string]string, error) {
+	sent := make(map[string]string)
+	for userID, eventID := range d.sent {
+		sent[userID] = eventID
+	}
+	return sent, nil
+}
+
+func (d *fakeLazyLoadDatabase) AddLazyLoadedMembers(
+	ctx context.Context, userID, deviceID, roomID string, members map[string]string,
+) error {
+	for userID, eventID := range members {
+		d.sent[userID] = eventID
+	}
+	return nil
+}
+
+func mustTestEvent(t *testing.T, eventID, sender, eventType string, stateKey *string) gomatrixserverlib.HeaderedEvent {
+	stateKeyJSON := ""
+	if stateKey != nil {
+		stateKeyJSON = fmt.Sprintf(`"state_key":%q,`, *stateKey)
+	}
+	eventJSON := fmt.Sprintf(
+		`{"event_id":%q,"room_id":%q,"type":%q,%s"sender":%q,"content":{"membership":"join"},`+
+			`"origin_server_ts":0,"prev_events":[],"auth_events":[],"depth":1}`,
+		eventID, testRoomID, eventType, stateKeyJSON, sender,
+	)
+	ev, err := gomatrixserverlib.NewEventFromTrustedJSON([]byte(eventJSON), false, gomatrixserverlib.RoomVersionV1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ev.Headered(gomatrixserverlib.RoomVersionV1)
+}
+
+func memberEvent(t *testing.T, userID string) gomatrixserverlib.HeaderedEvent {
+	return mustTestEvent(t, "$member_"+userID, userID, gomatrixserverlib.MRoomMember, &userID)
+}
+
+func messageEvent(t *testing.T, sender string) gomatrixserverlib.HeaderedEvent {
+	return mustTestEvent(t, "$message_"+sender, sender, "m.room.message", nil)
+}
+
+func clientEvents(events ...gomatrixserverlib.HeaderedEvent) []gomatrixserverlib.ClientEvent {
+	return gomatrixserverlib.HeaderedToClientEvents(events, gomatrixserverlib.FormatSync)
+}
+
+func eventIDs(events []gomatrixserverlib.ClientEvent) []string {
+	ids := make([]string, 0, len(events))
+	for _, ev := range events {
+		ids = append(ids, ev.EventID)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func TestLazyLoadMembers(t *testing.T) {
+	const alice, bob, carol, dave = "@alice:localhost", "@bob:localhost", "@carol:localhost", "@dave:localhost"
+	device := &authtypes.Device{UserID: alice, ID: "DEVICE"}
+	topic := mustTestEvent(t, "$topic", alice, "m.room.topic", new(string))
+	// Bob sends a message and Dave joins, so the client needs their
+	// memberships but not Carol's.
+	timeline := clientEvents(messageEvent(t, bob), memberEvent(t, dave))
+	stateFilter := gomatrixserverlib.DefaultStateFilter()
+
+	for _, tc := range []struct {
+		name          string
+		state         []gomatrixserverlib.ClientEvent
+		sent          map[string]string
+		addMissing    bool
+		skipRedundant bool
+		want          []string
+	}{
+		{
+			name:  "members not needed for the timeline are removed",
+			state: clientEvents(topic, memberEvent(t, alice), memberEvent(t, bob), memberEvent(t, carol)),
+			want:  []string{"$member_" + alice, "$member_" + bob, "$topic"},
+		},
+		{
+			name:       "missing members are added",
+			state:      clientEvents(topic),
+			addMissing: true,
+			want:       []string{"$member_" + alice, "$member_" + bob, "$topic"},
+		},
+		{
+			name:  "missing members aren't added unless asked",
+			state: clientEvents(topic),
+			want:  []string{"$topic"},
+		},
+		{
+			name:          "members already sent are skipped",
+			state:         clientEvents(topic, memberEvent(t, alice), memberEvent(t, bob)),
+			sent:          map[string]string{bob: "$member_" + bob, alice: "$old_member_" + alice},
+			skipRedundant: true,
+			want:          []string{"$member_" + alice, "$topic"},
+		},
+		{
+			name:  "redundant members are sent if asked",
+			state: clientEvents(topic, memberEvent(t, alice), memberEvent(t, bob)),
+			sent:  map[string]string{bob: "$member_" + bob},
+			want:  []string{"$member_" + alice, "$member_" + bob, "$topic"},
+		},
+	} {
+		db := &fakeLazyLoadDatabase{
+			members: map[string]*gomatrixserverlib.HeaderedEvent{},
+			sent:    map[string]string{},
+		}
+		for _, userID := range []string{alice, bob, carol, dave} {
+			ev := memberEvent(t, userID)
+			db.members[userID] = &ev
+		}
+		for userID, eventID := range tc.sent {
+			db.sent[userID] = eventID
+		}
+		got, err := lazyLoadMembers(
+			context.Background(), db, device, testRoomID, &stateFilter,
+			tc.state, timeline, tc.addMissing, tc.skipRedundant,
+		)
+		if err != nil {
+			t.Fatalf("%s: %s", tc.name, err)
+		}
+		if fmt.Sprint(eventIDs(got)) != fmt.Sprint(tc.want) {
+			t.Errorf("%s: got state %v, want %v", tc.name, eventIDs(got), tc.want)
+		}
+		if db.sent[dave] != "$member_"+dave {
+			t.Errorf("%s: membership of %s in the timeline wasn't recorded as sent", tc.name, dave)
+		}
+		if _, ok := db.sent[carol]; ok {
+			t.Errorf("%s: membership of %s was recorded as sent", tc.name, carol)
+		}
+	}
+}
+
+func TestLazyLoadMembersForMessages(t *testing.T) {
+	const alice, bob = "@alice:localhost", "@bob:localhost"
+	device := &authtypes.Device{UserID: alice, ID: "DEVICE"}
+	aliceMember, bobMember := memberEvent(t, alice), memberEvent(t, bob)
+	db := &fakeLazyLoadDatabase{
+		members: map[string]*gomatrixserverlib.HeaderedEvent{alice: &aliceMember, bob: &bobMember},
+		sent:    map[string]string{alice: aliceMember.EventID()},
+	}
+	chunk := clientEvents(messageEvent(t, bob))
+
+	filter := gomatrixserverlib.DefaultRoomEventFilter()
+	filter.LazyLoadMembers = true
+	state, err := LazyLoadMembers(context.Background(), db, device, testRoomID, &filter, chunk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{bobMember.EventID()}; fmt.Sprint(eventIDs(state)) != fmt.Sprint(want) {
+		t.Errorf("got state %v, want %v", eventIDs(state), want)
+	}
+
+	// Bob's membership was sent with the first chunk.
+	state, err = LazyLoadMembers(context.Background(), db, device, testRoomID, &filter, chunk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(state) != 0 {
+		t.Errorf("got state %v, want the redundant members to be left out", eventIDs(state))
+	}
+
+	filter.IncludeRedundantMembers = true
+	state, err = LazyLoadMembers(context.Background(), db, device, testRoomID, &filter, chunk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{aliceMember.EventID(), bobMember.EventID()}; fmt.Sprint(eventIDs(state)) != fmt.Sprint(want) {
+		t.Errorf("got state %v, want %v", eventIDs(state), want)
+	}
+}
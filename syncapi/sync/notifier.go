@@ -120,6 +120,43 @@ func (n *Notifier) OnNewEvent(
 	}
 }
 
+// OnNewKeyChange is called when the device keys of a user change. It wakes up
+// the user and everyone who shares a joined room with them, as they will all
+// want to know about the change in the device_lists section of /sync.
+func (n *Notifier) OnNewKeyChange(posUpdate types.PaginationToken, userID string) {
+	n.onNewUserUpdate(posUpdate, userID)
+}
+
+// OnNewPresence is called when the presence of a user changes. It wakes up
+// the user and everyone who shares a joined room with them, as they will all
+// want to know about the change in the presence section of /sync.
+func (n *Notifier) OnNewPresence(posUpdate types.PaginationToken, userID string) {
+	n.onNewUserUpdate(posUpdate, userID)
+}
+
+// onNewUserUpdate wakes up a user and everyone who shares a joined room with
+// them.
+func (n *Notifier) onNewUserUpdate(posUpdate types.PaginationToken, userID string) {
+	n.streamLock.Lock()
+	defer n.streamLock.Unlock()
+	latestPos := n.currPos.WithUpdates(posUpdate)
+	n.currPos = latestPos
+
+	n.removeEmptyUserStreams()
+
+	usersToNotify := userIDSet{}
+	usersToNotify.add(userID)
+	for _, joinedUsers := range n.roomIDToJoinedUsers {
+		if _, ok := joinedUsers[userID]; !ok {
+			continue
+		}
+		for joinedUserID := range joinedUsers {
+			usersToNotify.add(joinedUserID)
+		}
+	}
+	n.wakeupUsers(usersToNotify.values(), latestPos)
+}
+
 // GetListener returns a UserStreamListener that can be used to wait for
 // updates for a user. Must be closed.
 // notify for anything before sincePos
@@ -350,7 +350,7 @@ func newTestSyncRequest(userID string, since types.PaginationToken) syncRequest
 		timeout:       1 * time.Minute,
 		since:         &since,
 		wantFullState: false,
-		limit:         defaultTimelineLimit,
+		filter:        gomatrixserverlib.DefaultFilter(),
 		log:           util.GetLogger(context.TODO()),
 		ctx:           context.TODO(),
 	}
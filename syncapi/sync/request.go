@@ -16,13 +16,19 @@ package sync
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
-
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	presenceAPI "github.com/matrix-org/dendrite/presenceserver/api"
 	"github.com/matrix-org/dendrite/syncapi/types"
+	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
 	log "github.com/sirupsen/logrus"
 )
@@ -34,33 +40,83 @@ const defaultTimelineLimit = 20
 type syncRequest struct {
 	ctx           context.Context
 	device        authtypes.Device
-	limit         int
+	filter        gomatrixserverlib.Filter
 	timeout       time.Duration
 	since         *types.PaginationToken // nil means that no since token was supplied
 	wantFullState bool
+	setPresence   string
 	log           *log.Entry
 }
 
-func newSyncRequest(req *http.Request, device authtypes.Device) (*syncRequest, error) {
+func newSyncRequest(
+	req *http.Request, device authtypes.Device, accountDB accounts.Database,
+	currentPos types.PaginationToken,
+) (*syncRequest, error) {
 	timeout := getTimeout(req.URL.Query().Get("timeout"))
 	fullState := req.URL.Query().Get("full_state")
 	wantFullState := fullState != "" && fullState != "false"
-	since, err := getPaginationToken(req.URL.Query().Get("since"))
+	since, err := getPaginationToken(req.URL.Query().Get("since"), currentPos)
+	if err != nil {
+		return nil, err
+	}
+	setPresence := req.URL.Query().Get("set_presence")
+	switch setPresence {
+	case "":
+		setPresence = presenceAPI.PresenceOnline
+	case presenceAPI.PresenceOnline, presenceAPI.PresenceOffline, presenceAPI.PresenceUnavailable:
+	default:
+		return nil, jsonerror.InvalidParam(fmt.Sprintf("invalid set_presence %q", setPresence))
+	}
+	filter, err := getFilter(req.Context(), accountDB, device.UserID, req.URL.Query().Get("filter"))
 	if err != nil {
 		return nil, err
 	}
-	// TODO: Additional query params: set_presence, filter
+	if filter.Room.Timeline.Limit <= 0 {
+		filter.Room.Timeline.Limit = defaultTimelineLimit
+	}
 	return &syncRequest{
 		ctx:           req.Context(),
 		device:        device,
+		filter:        *filter,
 		timeout:       timeout,
 		since:         since,
 		wantFullState: wantFullState,
-		limit:         defaultTimelineLimit, // TODO: read from filter
+		setPresence:   setPresence,
 		log:           util.GetLogger(req.Context()),
 	}, nil
 }
 
+// getFilter returns the filter given in the 'filter' query parameter, which
+// is either the ID of a filter the user uploaded before or a filter encoded
+// as JSON. The default filter is returned if no filter was given.
+func getFilter(
+	ctx context.Context, accountDB accounts.Database, userID, filterParam string,
+) (*gomatrixserverlib.Filter, error) {
+	filter := gomatrixserverlib.DefaultFilter()
+	if filterParam == "" {
+		return &filter, nil
+	}
+	if strings.HasPrefix(filterParam, "{") {
+		// Fields missing from an inline filter keep their default values.
+		if err := json.Unmarshal([]byte(filterParam), &filter); err != nil {
+			return nil, fmt.Errorf("the filter could not be decoded: %s", err)
+		}
+		if err := filter.Validate(); err != nil {
+			return nil, err
+		}
+		return &filter, nil
+	}
+	localpart, _, err := gomatrixserverlib.SplitID('@', userID)
+	if err != nil {
+		return nil, err
+	}
+	stored, err := accountDB.GetFilter(ctx, localpart, filterParam)
+	if err != nil {
+		return nil, fmt.Errorf("no filter with ID %q", filterParam)
+	}
+	return stored, nil
+}
+
 func getTimeout(timeoutMS string) time.Duration {
 	if timeoutMS == "" {
 		return defaultSyncTimeout
@@ -76,11 +132,12 @@ func getTimeout(timeoutMS string) time.Duration {
 // types.PaginationToken. If the string is empty then (nil, nil) is returned.
 // There are two forms of tokens: The full length form containing all PDU and EDU
 // positions separated by "_", and the short form containing only the PDU
-// position. Short form can be used for, e.g., `prev_batch` tokens.
-func getPaginationToken(since string) (*types.PaginationToken, error) {
+// position. Short form can be used for, e.g., `prev_batch` tokens. Positions
+// missing from the token are taken from the current position.
+func getPaginationToken(since string, currentPos types.PaginationToken) (*types.PaginationToken, error) {
 	if since == "" {
 		return nil, nil
 	}
 
-	return types.NewPaginationTokenFromString(since)
+	return types.NewSyncTokenFromString(since, currentPos)
 }
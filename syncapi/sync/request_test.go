@@ -0,0 +1,55 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sync
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	presenceAPI "github.com/matrix-org/dendrite/presenceserver/api"
+	"github.com/matrix-org/dendrite/syncapi/types"
+)
+
+func TestNewSyncRequestSetPresence(t *testing.T) {
+	device := authtypes.Device{UserID: "@alice:localhost"}
+	for param, want := range map[string]string{
+		"":            presenceAPI.PresenceOnline,
+		"online":      presenceAPI.PresenceOnline,
+		"offline":     presenceAPI.PresenceOffline,
+		"unavailable": presenceAPI.PresenceUnavailable,
+	} {
+		req := httptest.NewRequest("GET", "/sync?set_presence="+param, nil)
+		syncReq, err := newSyncRequest(req, device, nil, types.PaginationToken{})
+		if err != nil {
+			t.Errorf("set_presence=%q: unexpected error: %s", param, err)
+			continue
+		}
+		if syncReq.setPresence != want {
+			t.Errorf("set_presence=%q: got presence %q, want %q", param, syncReq.setPresence, want)
+		}
+	}
+
+	req := httptest.NewRequest("GET", "/sync?set_presence=busy", nil)
+	_, err := newSyncRequest(req, device, nil, types.PaginationToken{})
+	e, ok := err.(*jsonerror.MatrixError)
+	if !ok {
+		t.Fatalf("set_presence=busy: got error %v, want a Matrix error", err)
+	}
+	if e.ErrCode != "M_INVALID_PARAM" {
+		t.Errorf("set_presence=busy: got error code %s, want M_INVALID_PARAM", e.ErrCode)
+	}
+}
@@ -15,12 +15,17 @@
 package sync
 
 import (
+	"context"
 	"net/http"
 	"time"
 
 	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
 	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	keyserverAPI "github.com/matrix-org/dendrite/keyserver/api"
+	presenceAPI "github.com/matrix-org/dendrite/presenceserver/api"
+	pushAPI "github.com/matrix-org/dendrite/pushserver/api"
+	"github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/dendrite/syncapi/storage"
 	"github.com/matrix-org/dendrite/syncapi/types"
 	"github.com/matrix-org/gomatrixserverlib"
@@ -28,16 +33,30 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
+// The maximum number of send-to-device messages that are sent to a device in a
+// single /sync response.
+const maxSendToDeviceEventsPerSync = 100
+
 // RequestPool manages HTTP long-poll connections for /sync
 type RequestPool struct {
-	db        storage.Database
-	accountDB accounts.Database
-	notifier  *Notifier
+	db          storage.Database
+	accountDB   accounts.Database
+	notifier    *Notifier
+	keyQueryAPI keyserverAPI.KeyServerQueryAPI
+	presenceAPI presenceAPI.PresenceServerInputAPI
+	pushAPI     pushAPI.PushServerQueryAPI
+	queryAPI    api.RoomserverQueryAPI
 }
 
 // NewRequestPool makes a new RequestPool
-func NewRequestPool(db storage.Database, n *Notifier, adb accounts.Database) *RequestPool {
-	return &RequestPool{db, adb, n}
+func NewRequestPool(
+	db storage.Database, n *Notifier, adb accounts.Database,
+	keyQueryAPI keyserverAPI.KeyServerQueryAPI,
+	presenceInputAPI presenceAPI.PresenceServerInputAPI,
+	pushQueryAPI pushAPI.PushServerQueryAPI,
+	queryAPI api.RoomserverQueryAPI,
+) *RequestPool {
+	return &RequestPool{db, adb, n, keyQueryAPI, presenceInputAPI, pushQueryAPI, queryAPI}
 }
 
 // OnIncomingSyncRequest is called when a client makes a /sync request. This function MUST be
@@ -48,8 +67,14 @@ func (rp *RequestPool) OnIncomingSyncRequest(req *http.Request, device *authtype
 
 	// Extract values from request
 	userID := device.UserID
-	syncReq, err := newSyncRequest(req, *device)
+	syncReq, err := newSyncRequest(req, *device, rp.accountDB, rp.notifier.CurrentPosition())
 	if err != nil {
+		if e, ok := err.(*jsonerror.MatrixError); ok {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: e,
+			}
+		}
 		return util.JSONResponse{
 			Code: http.StatusBadRequest,
 			JSON: jsonerror.Unknown(err.Error()),
@@ -61,6 +86,8 @@ func (rp *RequestPool) OnIncomingSyncRequest(req *http.Request, device *authtype
 		"timeout": syncReq.timeout,
 	})
 
+	rp.updatePresence(syncReq)
+
 	currPos := rp.notifier.CurrentPosition()
 
 	if shouldReturnImmediately(syncReq) {
@@ -132,32 +159,217 @@ func (rp *RequestPool) OnIncomingSyncRequest(req *http.Request, device *authtype
 	}
 }
 
+// updatePresence lets the presence server know that the user is active, using
+// the presence that they asked for in the sync request. Syncing with a presence
+// of "offline" leaves the presence of the user untouched.
+func (rp *RequestPool) updatePresence(req *syncRequest) {
+	if req.setPresence == presenceAPI.PresenceOffline {
+		return
+	}
+	presenceReq := presenceAPI.InputPresenceEventRequest{
+		InputPresenceEvent: presenceAPI.InputPresenceEvent{
+			UserID:          req.device.UserID,
+			Presence:        req.setPresence,
+			LastActiveTS:    gomatrixserverlib.AsTimestamp(time.Now()),
+			CurrentlyActive: req.setPresence == presenceAPI.PresenceOnline,
+		},
+	}
+	var presenceRes presenceAPI.InputPresenceEventResponse
+	if err := rp.presenceAPI.InputPresenceEvent(req.ctx, &presenceReq, &presenceRes); err != nil {
+		// Failing to update the presence of the user shouldn't stop them from
+		// syncing.
+		req.log.WithError(err).Error("rp.presenceAPI.InputPresenceEvent failed")
+	}
+}
+
 func (rp *RequestPool) currentSyncForUser(req syncRequest, latestPos types.PaginationToken) (res *types.Response, err error) {
 	// TODO: handle ignored users
+	// The events that the history visibility of the rooms doesn't allow the
+	// user to see, e.g. events that happened while they weren't in the room,
+	// are left out of the timelines.
+	visible := func(ctx context.Context, eventIDs []string) (map[string]bool, error) {
+		return VisibleEventIDs(ctx, rp.queryAPI, req.device.UserID, eventIDs)
+	}
 	if req.since == nil {
-		res, err = rp.db.CompleteSync(req.ctx, req.device.UserID, req.limit)
+		res, err = rp.db.CompleteSync(req.ctx, req.device.UserID, &req.filter, visible)
 	} else {
-		res, err = rp.db.IncrementalSync(req.ctx, req.device, *req.since, latestPos, req.limit, req.wantFullState)
+		res, err = rp.db.IncrementalSync(req.ctx, req.device, *req.since, latestPos, &req.filter, req.wantFullState, visible)
+	}
+
+	if err != nil {
+		return
+	}
+
+	res, err = rp.filterLazyLoadedMembers(res, req)
+	if err != nil {
+		return
+	}
+
+	res, err = rp.appendAccountData(res, req.device.UserID, req, latestPos.AccountDataPosition)
+	if err != nil {
+		return
+	}
+
+	res, err = rp.appendDeviceLists(res, req, latestPos)
+	if err != nil {
+		return
 	}
 
+	res, err = rp.appendSendToDevice(res, req)
 	if err != nil {
 		return
 	}
 
-	accountDataFilter := gomatrixserverlib.DefaultEventFilter() // TODO: use filter provided in req instead
-	res, err = rp.appendAccountData(res, req.device.UserID, req, latestPos.PDUPosition, &accountDataFilter)
+	res, err = rp.appendUnreadNotifications(res, req)
 	return
 }
 
+// filterLazyLoadedMembers applies the lazy_load_members option of the state
+// filter to the response. The state of each room only keeps the membership
+// events of the user and of the senders of the events in its timeline, and
+// unless the client asked for redundant members, the ones that the device
+// was already sent are left out.
+func (rp *RequestPool) filterLazyLoadedMembers(
+	data *types.Response, req syncRequest,
+) (*types.Response, error) {
+	if !req.filter.Room.State.LazyLoadMembers {
+		return data, nil
+	}
+	// Initial and full state syncs start afresh, so the members that were
+	// sent before are sent again.
+	skipRedundant := !req.filter.Room.State.IncludeRedundantMembers &&
+		req.since != nil && !req.wantFullState
+	for roomID, jr := range data.Rooms.Join {
+		state, err := lazyLoadMembers(
+			req.ctx, rp.db, &req.device, roomID, &req.filter.Room.State,
+			jr.State.Events, jr.Timeline.Events, true, skipRedundant,
+		)
+		if err != nil {
+			return nil, err
+		}
+		jr.State.Events = state
+		data.Rooms.Join[roomID] = jr
+	}
+	for roomID, lr := range data.Rooms.Leave {
+		// The current state of a room that the user left may contain changes
+		// they aren't allowed to see, so no memberships are added for them.
+		state, err := lazyLoadMembers(
+			req.ctx, rp.db, &req.device, roomID, &req.filter.Room.State,
+			lr.State.Events, lr.Timeline.Events, false, skipRedundant,
+		)
+		if err != nil {
+			return nil, err
+		}
+		lr.State.Events = state
+		data.Rooms.Leave[roomID] = lr
+	}
+	return data, nil
+}
+
+// appendUnreadNotifications adds the unread notification counts of the user
+// to the joined rooms in the response.
+func (rp *RequestPool) appendUnreadNotifications(
+	data *types.Response, req syncRequest,
+) (*types.Response, error) {
+	if len(data.Rooms.Join) == 0 {
+		return data, nil
+	}
+	queryReq := pushAPI.QueryNotificationCountsRequest{UserID: req.device.UserID}
+	for roomID := range data.Rooms.Join {
+		queryReq.RoomIDs = append(queryReq.RoomIDs, roomID)
+	}
+	var queryRes pushAPI.QueryNotificationCountsResponse
+	if err := rp.pushAPI.QueryNotificationCounts(req.ctx, &queryReq, &queryRes); err != nil {
+		return nil, err
+	}
+	for roomID, counts := range queryRes.Counts {
+		jr := data.Rooms.Join[roomID]
+		jr.UnreadNotifications.NotificationCount = counts.NotificationCount
+		jr.UnreadNotifications.HighlightCount = counts.HighlightCount
+		data.Rooms.Join[roomID] = jr
+	}
+	return data, nil
+}
+
+// appendSendToDevice adds the send-to-device messages for the device to the
+// response. Messages are kept until the client acknowledges them by syncing
+// with a since token that is past them, at which point they are deleted.
+func (rp *RequestPool) appendSendToDevice(
+	data *types.Response, req syncRequest,
+) (*types.Response, error) {
+	var fromPos types.StreamPosition
+	if req.since != nil {
+		fromPos = req.since.SendToDevicePosition
+		if err := rp.db.DeleteSendToDeviceEvents(
+			req.ctx, req.device.UserID, req.device.ID, fromPos,
+		); err != nil {
+			return nil, err
+		}
+	}
+
+	nextBatch, err := types.NewPaginationTokenFromString(data.NextBatch)
+	if err != nil {
+		return nil, err
+	}
+	lastPos, events, err := rp.db.SendToDeviceEventsInRange(
+		req.ctx, req.device.UserID, req.device.ID,
+		fromPos, nextBatch.SendToDevicePosition, maxSendToDeviceEventsPerSync,
+	)
+	if err != nil {
+		return nil, err
+	}
+	data.ToDevice.Events = append(data.ToDevice.Events, events...)
+
+	// If there were more messages than we could send in one go then the
+	// next sync needs to pick up where this one left off.
+	if len(events) == maxSendToDeviceEventsPerSync {
+		nextBatch.SendToDevicePosition = lastPos
+		data.NextBatch = nextBatch.String()
+	}
+	return data, nil
+}
+
+// appendDeviceLists adds the users whose device keys changed since the last
+// sync, the users that the user no longer shares a room with and the number
+// of one-time keys the device has left to the response.
+func (rp *RequestPool) appendDeviceLists(
+	data *types.Response, req syncRequest, latestPos types.PaginationToken,
+) (*types.Response, error) {
+	if req.since != nil {
+		changed, err := rp.db.KeyChangesInRange(
+			req.ctx, req.device.UserID, req.since.DeviceListPosition, latestPos.DeviceListPosition,
+		)
+		if err != nil {
+			return nil, err
+		}
+		data.DeviceLists.Changed = append(data.DeviceLists.Changed, changed...)
+
+		left, err := rp.db.UsersLeftInRange(
+			req.ctx, req.device.UserID, req.since.PDUPosition, latestPos.PDUPosition,
+		)
+		if err != nil {
+			return nil, err
+		}
+		data.DeviceLists.Left = append(data.DeviceLists.Left, left...)
+	}
+
+	queryReq := keyserverAPI.QueryOneTimeKeyCountsRequest{
+		UserID:   req.device.UserID,
+		DeviceID: req.device.ID,
+	}
+	var queryRes keyserverAPI.QueryOneTimeKeyCountsResponse
+	if err := rp.keyQueryAPI.QueryOneTimeKeyCounts(req.ctx, &queryReq, &queryRes); err != nil {
+		return nil, err
+	}
+	for algorithm, count := range queryRes.Counts {
+		data.DeviceOneTimeKeysCount[algorithm] = count
+	}
+	return data, nil
+}
+
 func (rp *RequestPool) appendAccountData(
 	data *types.Response, userID string, req syncRequest, currentPos types.StreamPosition,
-	accountDataFilter *gomatrixserverlib.EventFilter,
 ) (*types.Response, error) {
-	// TODO: Account data doesn't have a sync position of its own, meaning that
-	// account data might be sent multiple time to the client if multiple account
-	// data keys were set between two message. This isn't a huge issue since the
-	// duplicate data doesn't represent a huge quantity of data, but an optimisation
-	// here would be making sure each data is sent only once to the client.
 	localpart, _, err := gomatrixserverlib.SplitID('@', userID)
 	if err != nil {
 		return nil, err
@@ -172,11 +384,11 @@ func (rp *RequestPool) appendAccountData(
 		if err != nil {
 			return nil, err
 		}
-		data.AccountData.Events = global
+		data.AccountData.Events = types.FilterEvents(&req.filter.AccountData, global)
 
 		for r, j := range data.Rooms.Join {
 			if len(rooms[r]) > 0 {
-				j.AccountData.Events = rooms[r]
+				j.AccountData.Events = types.FilterRoomEvents(&req.filter.Room.AccountData, r, rooms[r])
 				data.Rooms.Join[r] = j
 			}
 		}
@@ -184,11 +396,14 @@ func (rp *RequestPool) appendAccountData(
 		return data, nil
 	}
 
-	// Sync is not initial, get all account data since the latest sync
+	// Sync is not initial, get all account data since the latest sync. The
+	// global and room account data have filters of their own, which are
+	// applied below.
+	accountDataFilter := gomatrixserverlib.DefaultEventFilter()
 	dataTypes, err := rp.db.GetAccountDataInRange(
 		req.ctx, userID,
-		types.StreamPosition(req.since.PDUPosition), types.StreamPosition(currentPos),
-		accountDataFilter,
+		types.StreamPosition(req.since.AccountDataPosition), types.StreamPosition(currentPos),
+		&accountDataFilter,
 	)
 	if err != nil {
 		return nil, err
@@ -200,6 +415,9 @@ func (rp *RequestPool) appendAccountData(
 
 	// Iterate over the rooms
 	for roomID, dataTypes := range dataTypes {
+		if roomID != "" && !types.FilterAllowsRoom(req.filter.Room.Rooms, req.filter.Room.NotRooms, roomID) {
+			continue
+		}
 		events := []gomatrixserverlib.ClientEvent{}
 		// Request the missing data from the database
 		for _, dataType := range dataTypes {
@@ -215,10 +433,10 @@ func (rp *RequestPool) appendAccountData(
 		// Append the data to the response
 		if len(roomID) > 0 {
 			jr := data.Rooms.Join[roomID]
-			jr.AccountData.Events = events
+			jr.AccountData.Events = types.FilterRoomEvents(&req.filter.Room.AccountData, roomID, events)
 			data.Rooms.Join[roomID] = jr
 		} else {
-			data.AccountData.Events = events
+			data.AccountData.Events = types.FilterEvents(&req.filter.AccountData, events)
 		}
 	}
 
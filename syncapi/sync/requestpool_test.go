@@ -0,0 +1,105 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sync
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/syncapi/types"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+func TestFilterLazyLoadedMembers(t *testing.T) {
+	const alice, bob, carol = "@alice:localhost", "@bob:localhost", "@carol:localhost"
+	aliceMember, bobMember, carolMember := memberEvent(t, alice), memberEvent(t, bob), memberEvent(t, carol)
+	const joinedRoomID, leftRoomID = testRoomID, "!left:localhost"
+
+	newResponse := func() *types.Response {
+		res := types.NewResponse(types.PaginationToken{})
+		jr := types.NewJoinResponse()
+		jr.Timeline.Events = clientEvents(messageEvent(t, bob))
+		jr.State.Events = clientEvents(aliceMember, carolMember)
+		res.Rooms.Join[joinedRoomID] = *jr
+		lr := types.NewLeaveResponse()
+		lr.Timeline.Events = clientEvents(messageEvent(t, bob))
+		lr.State.Events = clientEvents(carolMember)
+		res.Rooms.Leave[leftRoomID] = *lr
+		return res
+	}
+
+	for _, tc := range []struct {
+		name      string
+		lazyLoad  bool
+		since     *types.PaginationToken
+		sent      map[string]string
+		wantJoin  []string
+		wantLeave []string
+	}{
+		{
+			name:      "all members are kept without lazy-loading",
+			wantJoin:  []string{aliceMember.EventID(), carolMember.EventID()},
+			wantLeave: []string{carolMember.EventID()},
+		},
+		{
+			// Bob's membership is added to the joined room, but not to the
+			// room that the user left as it is taken from the current state.
+			name:      "initial sync",
+			lazyLoad:  true,
+			sent:      map[string]string{bob: bobMember.EventID()},
+			wantJoin:  []string{aliceMember.EventID(), bobMember.EventID()},
+			wantLeave: []string{},
+		},
+		{
+			name:      "incremental sync skips the members already sent",
+			lazyLoad:  true,
+			since:     &types.PaginationToken{},
+			sent:      map[string]string{bob: bobMember.EventID()},
+			wantJoin:  []string{aliceMember.EventID()},
+			wantLeave: []string{},
+		},
+	} {
+		db := &fakeLazyLoadDatabase{
+			members: map[string]*gomatrixserverlib.HeaderedEvent{
+				alice: &aliceMember, bob: &bobMember, carol: &carolMember,
+			},
+			sent: map[string]string{},
+		}
+		for userID, eventID := range tc.sent {
+			db.sent[userID] = eventID
+		}
+		rp := &RequestPool{db: db}
+		req := syncRequest{
+			ctx:    context.Background(),
+			device: authtypes.Device{UserID: alice, ID: "DEVICE"},
+			filter: gomatrixserverlib.DefaultFilter(),
+			since:  tc.since,
+		}
+		req.filter.Room.State.LazyLoadMembers = tc.lazyLoad
+
+		res, err := rp.filterLazyLoadedMembers(newResponse(), req)
+		if err != nil {
+			t.Fatalf("%s: %s", tc.name, err)
+		}
+		if got := eventIDs(res.Rooms.Join[joinedRoomID].State.Events); fmt.Sprint(got) != fmt.Sprint(tc.wantJoin) {
+			t.Errorf("%s: got joined room state %v, want %v", tc.name, got, tc.wantJoin)
+		}
+		if got := eventIDs(res.Rooms.Leave[leftRoomID].State.Events); fmt.Sprint(got) != fmt.Sprint(tc.wantLeave) {
+			t.Errorf("%s: got left room state %v, want %v", tc.name, got, tc.wantLeave)
+		}
+	}
+}
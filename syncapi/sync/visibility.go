@@ -0,0 +1,66 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sync
+
+import (
+	"context"
+
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// VisibleEventIDs asks the roomserver which of the given events the user is
+// allowed to see, according to the history visibility of the room and the
+// membership of the user at each event.
+func VisibleEventIDs(
+	ctx context.Context, queryAPI api.RoomserverQueryAPI,
+	userID string, eventIDs []string,
+) (map[string]bool, error) {
+	if len(eventIDs) == 0 {
+		return map[string]bool{}, nil
+	}
+	queryReq := api.QueryUserAllowedToSeeEventsRequest{
+		UserID:   userID,
+		EventIDs: eventIDs,
+	}
+	var queryRes api.QueryUserAllowedToSeeEventsResponse
+	if err := queryAPI.QueryUserAllowedToSeeEvents(ctx, &queryReq, &queryRes); err != nil {
+		return nil, err
+	}
+	return queryRes.AllowedToSeeEvents, nil
+}
+
+// FilterVisibleEvents removes the events that the user isn't allowed to see
+// from the given slice.
+func FilterVisibleEvents(
+	ctx context.Context, queryAPI api.RoomserverQueryAPI,
+	userID string, events []gomatrixserverlib.HeaderedEvent,
+) ([]gomatrixserverlib.HeaderedEvent, error) {
+	eventIDs := make([]string, len(events))
+	for i := range events {
+		eventIDs[i] = events[i].EventID()
+	}
+	visible, err := VisibleEventIDs(ctx, queryAPI, userID, eventIDs)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]gomatrixserverlib.HeaderedEvent, 0, len(events))
+	for _, event := range events {
+		if visible[event.EventID()] {
+			result = append(result, event)
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,207 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package types
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// FilterAllowsRoom returns whether the room passes the rooms and not_rooms
+// lists of a filter. A nil rooms list allows every room that isn't excluded.
+func FilterAllowsRoom(rooms, notRooms []string, roomID string) bool {
+	for _, r := range notRooms {
+		if r == roomID {
+			return false
+		}
+	}
+	if rooms == nil {
+		return true
+	}
+	for _, r := range rooms {
+		if r == roomID {
+			return true
+		}
+	}
+	return false
+}
+
+// FilterAllowsSender returns whether the sender passes the senders and
+// not_senders lists of a filter.
+func FilterAllowsSender(senders, notSenders []string, sender string) bool {
+	// The rooms and senders lists work the same way.
+	return FilterAllowsRoom(senders, notSenders, sender)
+}
+
+// FilterAllowsType returns whether the event type passes the types and
+// not_types lists of a filter. The entries of the lists can use '*' as a
+// wildcard which matches any sequence of characters.
+func FilterAllowsType(types, notTypes []string, eventType string) bool {
+	for _, t := range notTypes {
+		if typeMatches(t, eventType) {
+			return false
+		}
+	}
+	if types == nil {
+		return true
+	}
+	for _, t := range types {
+		if typeMatches(t, eventType) {
+			return true
+		}
+	}
+	return false
+}
+
+// typeMatches returns whether the event type matches the given pattern, in
+// which '*' matches any sequence of characters.
+func typeMatches(pattern, eventType string) bool {
+	parts := strings.Split(pattern, "*")
+	if len(parts) == 1 {
+		return pattern == eventType
+	}
+	if !strings.HasPrefix(eventType, parts[0]) {
+		return false
+	}
+	rest := eventType[len(parts[0]):]
+	for _, part := range parts[1 : len(parts)-1] {
+		i := strings.Index(rest, part)
+		if i < 0 {
+			return false
+		}
+		rest = rest[i+len(part):]
+	}
+	return strings.HasSuffix(rest, parts[len(parts)-1])
+}
+
+// filterAllowsContainsURL returns whether the event content passes the
+// contains_url part of a filter.
+func filterAllowsContainsURL(containsURL *bool, content []byte) bool {
+	if containsURL == nil {
+		return true
+	}
+	var c map[string]interface{}
+	if err := json.Unmarshal(content, &c); err != nil {
+		return !*containsURL
+	}
+	_, ok := c["url"]
+	return ok == *containsURL
+}
+
+// RoomEventFilterAllows returns whether the event passes the senders, types
+// and contains_url parts of a room event filter.
+func RoomEventFilterAllows(
+	filter *gomatrixserverlib.RoomEventFilter, event *gomatrixserverlib.Event,
+) bool {
+	return FilterAllowsSender(filter.Senders, filter.NotSenders, event.Sender()) &&
+		FilterAllowsType(filter.Types, filter.NotTypes, event.Type()) &&
+		filterAllowsContainsURL(filter.ContainsURL, event.Content())
+}
+
+// filterClientEvents returns the events that pass the given senders, types
+// and contains_url parts of a filter, up to limit events. A limit of zero or
+// less doesn't restrict the number of events.
+func filterClientEvents(
+	events []gomatrixserverlib.ClientEvent,
+	senders, notSenders, types, notTypes []string, containsURL *bool, limit int,
+) []gomatrixserverlib.ClientEvent {
+	filtered := make([]gomatrixserverlib.ClientEvent, 0, len(events))
+	for _, ev := range events {
+		if limit > 0 && len(filtered) >= limit {
+			break
+		}
+		if !FilterAllowsSender(senders, notSenders, ev.Sender) ||
+			!FilterAllowsType(types, notTypes, ev.Type) ||
+			!filterAllowsContainsURL(containsURL, ev.Content) {
+			continue
+		}
+		filtered = append(filtered, ev)
+	}
+	return filtered
+}
+
+// FilterEvents returns the events that pass an event filter, which is used
+// for the presence and account data sections of a /sync response.
+func FilterEvents(
+	filter *gomatrixserverlib.EventFilter, events []gomatrixserverlib.ClientEvent,
+) []gomatrixserverlib.ClientEvent {
+	return filterClientEvents(
+		events, filter.Senders, filter.NotSenders, filter.Types, filter.NotTypes, nil, filter.Limit,
+	)
+}
+
+// FilterRoomEvents returns the events of the room that pass a room event
+// filter, or none if the filter excludes the room.
+func FilterRoomEvents(
+	filter *gomatrixserverlib.RoomEventFilter, roomID string, events []gomatrixserverlib.ClientEvent,
+) []gomatrixserverlib.ClientEvent {
+	if !FilterAllowsRoom(filter.Rooms, filter.NotRooms, roomID) {
+		return []gomatrixserverlib.ClientEvent{}
+	}
+	return filterClientEvents(
+		events, filter.Senders, filter.NotSenders, filter.Types, filter.NotTypes,
+		filter.ContainsURL, filter.Limit,
+	)
+}
+
+// FilterStateEvents returns the state events of the room that pass a state
+// filter, or none if the filter excludes the room. The limit of the filter
+// isn't applied as clients need the whole state they asked for.
+func FilterStateEvents(
+	filter *gomatrixserverlib.StateFilter, roomID string, events []gomatrixserverlib.ClientEvent,
+) []gomatrixserverlib.ClientEvent {
+	if !FilterAllowsRoom(filter.Rooms, filter.NotRooms, roomID) {
+		return []gomatrixserverlib.ClientEvent{}
+	}
+	return filterClientEvents(
+		events, filter.Senders, filter.NotSenders, filter.Types, filter.NotTypes,
+		filter.ContainsURL, 0,
+	)
+}
+
+// FilterResponse applies the room, state, ephemeral and presence parts of a
+// filter to a /sync response. Rooms excluded by the room filter are removed
+// and the state and ephemeral events of the remaining rooms are filtered.
+// The timeline filter isn't applied here: timeline events must be filtered
+// when they are selected so that the excluded events don't count towards
+// the timeline limit.
+func FilterResponse(res *Response, filter *gomatrixserverlib.Filter) {
+	roomFilter := &filter.Room
+	for roomID, jr := range res.Rooms.Join {
+		if !FilterAllowsRoom(roomFilter.Rooms, roomFilter.NotRooms, roomID) {
+			delete(res.Rooms.Join, roomID)
+			continue
+		}
+		jr.State.Events = FilterStateEvents(&roomFilter.State, roomID, jr.State.Events)
+		jr.Ephemeral.Events = FilterRoomEvents(&roomFilter.Ephemeral, roomID, jr.Ephemeral.Events)
+		res.Rooms.Join[roomID] = jr
+	}
+	for roomID, lr := range res.Rooms.Leave {
+		if !FilterAllowsRoom(roomFilter.Rooms, roomFilter.NotRooms, roomID) {
+			delete(res.Rooms.Leave, roomID)
+			continue
+		}
+		lr.State.Events = FilterStateEvents(&roomFilter.State, roomID, lr.State.Events)
+		res.Rooms.Leave[roomID] = lr
+	}
+	for roomID := range res.Rooms.Invite {
+		if !FilterAllowsRoom(roomFilter.Rooms, roomFilter.NotRooms, roomID) {
+			delete(res.Rooms.Invite, roomID)
+		}
+	}
+	res.Presence.Events = FilterEvents(&filter.Presence, res.Presence.Events)
+}
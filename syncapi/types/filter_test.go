@@ -0,0 +1,84 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package types
+
+import (
+	"testing"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+func TestFilterAllowsType(t *testing.T) {
+	tests := []struct {
+		types     []string
+		notTypes  []string
+		eventType string
+		want      bool
+	}{
+		{nil, nil, "m.room.message", true},
+		{[]string{}, nil, "m.room.message", false},
+		{[]string{"m.room.message"}, nil, "m.room.message", true},
+		{[]string{"m.room.message"}, nil, "m.room.member", false},
+		{[]string{"m.room.*"}, nil, "m.room.member", true},
+		{[]string{"m.*.member"}, nil, "m.room.member", true},
+		{[]string{"*"}, nil, "org.example.custom", true},
+		{[]string{"m.room.*"}, nil, "m.presence", false},
+		{nil, []string{"m.room.member"}, "m.room.member", false},
+		{nil, []string{"m.room.*"}, "m.room.message", false},
+		{[]string{"m.room.*"}, []string{"m.room.member"}, "m.room.member", false},
+		{[]string{"m.room.*"}, []string{"m.room.member"}, "m.room.topic", true},
+	}
+	for _, tt := range tests {
+		if got := FilterAllowsType(tt.types, tt.notTypes, tt.eventType); got != tt.want {
+			t.Errorf("FilterAllowsType(%v, %v, %q) = %v, want %v", tt.types, tt.notTypes, tt.eventType, got, tt.want)
+		}
+	}
+}
+
+func TestFilterResponse(t *testing.T) {
+	res := NewResponse(PaginationToken{})
+	for _, roomID := range []string{"!a:localhost", "!b:localhost"} {
+		jr := NewJoinResponse()
+		jr.State.Events = []gomatrixserverlib.ClientEvent{
+			{Type: "m.room.name", Sender: "@alice:localhost", Content: []byte(`{}`)},
+			{Type: "m.room.member", Sender: "@bob:localhost", Content: []byte(`{}`)},
+		}
+		jr.Ephemeral.Events = []gomatrixserverlib.ClientEvent{
+			{Type: "m.typing", Content: []byte(`{}`)},
+			{Type: "m.receipt", Content: []byte(`{}`)},
+		}
+		res.Rooms.Join[roomID] = *jr
+	}
+
+	filter := gomatrixserverlib.DefaultFilter()
+	filter.Room.NotRooms = []string{"!b:localhost"}
+	filter.Room.State.NotSenders = []string{"@bob:localhost"}
+	filter.Room.Ephemeral.Types = []string{"m.receipt"}
+	FilterResponse(res, &filter)
+
+	if _, ok := res.Rooms.Join["!b:localhost"]; ok {
+		t.Fatalf("room excluded by the room filter is in the response")
+	}
+	jr, ok := res.Rooms.Join["!a:localhost"]
+	if !ok {
+		t.Fatalf("room allowed by the room filter is missing from the response")
+	}
+	if len(jr.State.Events) != 1 || jr.State.Events[0].Type != "m.room.name" {
+		t.Errorf("state events weren't filtered: %+v", jr.State.Events)
+	}
+	if len(jr.Ephemeral.Events) != 1 || jr.Ephemeral.Events[0].Type != "m.receipt" {
+		t.Errorf("ephemeral events weren't filtered: %+v", jr.Ephemeral.Events)
+	}
+}
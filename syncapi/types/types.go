@@ -15,6 +15,7 @@
 package types
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -46,6 +47,41 @@ type StreamEvent struct {
 	ExcludeFromSync bool
 }
 
+// VisibleEventsFunc returns which of the given events the user that is
+// syncing is allowed to see, according to the history visibility of the
+// rooms. A nil VisibleEventsFunc allows every event.
+type VisibleEventsFunc func(ctx context.Context, eventIDs []string) (map[string]bool, error)
+
+// Filter returns the events that the user is allowed to see.
+func (f VisibleEventsFunc) Filter(ctx context.Context, events []StreamEvent) ([]StreamEvent, error) {
+	if f == nil || len(events) == 0 {
+		return events, nil
+	}
+	eventIDs := make([]string, len(events))
+	for i := range events {
+		eventIDs[i] = events[i].EventID()
+	}
+	visible, err := f(ctx, eventIDs)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]StreamEvent, 0, len(events))
+	for _, ev := range events {
+		if visible[ev.EventID()] {
+			result = append(result, ev)
+		}
+	}
+	return result, nil
+}
+
+// SearchResult is an event whose content matched a /search query.
+type SearchResult struct {
+	EventID        string
+	RoomID         string
+	Rank           float64
+	StreamPosition StreamPosition
+}
+
 // PaginationTokenType represents the type of a pagination token.
 // It can be either "s" (representing a position in the whole stream of events)
 // or "t" (representing a position in a room's topology/depth).
@@ -63,9 +99,15 @@ const (
 // /sync or /messages, for example.
 type PaginationToken struct {
 	//Position StreamPosition
-	Type              PaginationTokenType
-	PDUPosition       StreamPosition
-	EDUTypingPosition StreamPosition
+	Type                 PaginationTokenType
+	PDUPosition          StreamPosition
+	EDUTypingPosition    StreamPosition
+	EDUReceiptPosition   StreamPosition
+	EDUPresencePosition  StreamPosition
+	SendToDevicePosition StreamPosition
+	AccountDataPosition  StreamPosition
+	InvitePosition       StreamPosition
+	DeviceListPosition   StreamPosition
 }
 
 // NewPaginationTokenFromString takes a string of the form "xyyyy..." where "x"
@@ -75,8 +117,32 @@ type PaginationToken struct {
 // isn't a known type (returns ErrInvalidPaginationTokenType in the latter
 // case).
 func NewPaginationTokenFromString(s string) (token *PaginationToken, err error) {
+	token, _, err = parsePaginationToken(s)
+	return
+}
+
+// NewSyncTokenFromString parses a /sync "since" token in the same way as
+// NewPaginationTokenFromString, except that the positions missing from the
+// token are taken from current instead of being 0. Tokens issued before a
+// position was added don't contain it, and treating it as 0 would make the
+// first sync after an upgrade replay the whole of that stream.
+func NewSyncTokenFromString(s string, current PaginationToken) (*PaginationToken, error) {
+	token, n, err := parsePaginationToken(s)
+	if err != nil {
+		return nil, err
+	}
+	fields, currentFields := token.positions(), current.positions()
+	for i := n; i < len(fields); i++ {
+		*fields[i] = *currentFields[i]
+	}
+	return token, nil
+}
+
+// parsePaginationToken parses a pagination token and returns it along with
+// the number of positions that the string contained.
+func parsePaginationToken(s string) (token *PaginationToken, n int, err error) {
 	if len(s) == 0 {
-		return nil, ErrInvalidPaginationTokenLen
+		return nil, 0, ErrInvalidPaginationTokenLen
 	}
 
 	token = new(PaginationToken)
@@ -91,26 +157,20 @@ func NewPaginationTokenFromString(s string) (token *PaginationToken, err error)
 		positions = strings.Split(s, "_")
 	}
 
-	// Try to get the PDU position.
-	if len(positions) >= 1 {
-		if pduPos, err := strconv.ParseInt(positions[0], 10, 64); err != nil {
-			return nil, err
-		} else if pduPos < 0 {
-			return nil, errors.New("negative PDU position not allowed")
-		} else {
-			token.PDUPosition = StreamPosition(pduPos)
+	fields := token.positions()
+	for i, position := range positions {
+		if i >= len(fields) {
+			break
 		}
-	}
-
-	// Try to get the typing position.
-	if len(positions) >= 2 {
-		if typPos, err := strconv.ParseInt(positions[1], 10, 64); err != nil {
-			return nil, err
-		} else if typPos < 0 {
-			return nil, errors.New("negative EDU typing position not allowed")
-		} else {
-			token.EDUTypingPosition = StreamPosition(typPos)
+		pos, err := strconv.ParseInt(position, 10, 64)
+		if err != nil {
+			return nil, 0, err
 		}
+		if pos < 0 {
+			return nil, 0, errors.New("negative stream position not allowed")
+		}
+		*fields[i] = StreamPosition(pos)
+		n++
 	}
 
 	return
@@ -128,10 +188,25 @@ func NewPaginationTokenFromTypeAndPosition(
 	}
 }
 
+// positions returns the stream positions of the token in the order in which
+// they appear in its string form. New positions must be added to the end so
+// that tokens issued before they existed can still be parsed.
+func (p *PaginationToken) positions() []*StreamPosition {
+	return []*StreamPosition{
+		&p.PDUPosition, &p.EDUTypingPosition, &p.SendToDevicePosition,
+		&p.EDUReceiptPosition, &p.EDUPresencePosition,
+		&p.AccountDataPosition, &p.InvitePosition, &p.DeviceListPosition,
+	}
+}
+
 // String translates a PaginationToken to a string of the "xyyyy..." (see
 // NewPaginationToken to know what it represents).
 func (p *PaginationToken) String() string {
-	return fmt.Sprintf("%s%d_%d", p.Type, p.PDUPosition, p.EDUTypingPosition)
+	positions := []string{}
+	for _, pos := range p.positions() {
+		positions = append(positions, strconv.FormatInt(int64(*pos), 10))
+	}
+	return string(p.Type) + strings.Join(positions, "_")
 }
 
 // WithUpdates returns a copy of the PaginationToken with updates applied from another PaginationToken.
@@ -139,19 +214,41 @@ func (p *PaginationToken) String() string {
 // and its value will replace the corresponding value in the PaginationToken on which WithUpdates is called.
 func (pt *PaginationToken) WithUpdates(other PaginationToken) PaginationToken {
 	ret := *pt
-	if other.PDUPosition != 0 {
-		ret.PDUPosition = other.PDUPosition
-	}
-	if other.EDUTypingPosition != 0 {
-		ret.EDUTypingPosition = other.EDUTypingPosition
+	updates := other.positions()
+	for i, pos := range ret.positions() {
+		if *updates[i] != 0 {
+			*pos = *updates[i]
+		}
 	}
 	return ret
 }
 
 // IsAfter returns whether one PaginationToken refers to states newer than another PaginationToken.
 func (sp *PaginationToken) IsAfter(other PaginationToken) bool {
-	return sp.PDUPosition > other.PDUPosition ||
-		sp.EDUTypingPosition > other.EDUTypingPosition
+	others := other.positions()
+	for i, pos := range sp.positions() {
+		if *pos > *others[i] {
+			return true
+		}
+	}
+	return false
+}
+
+// SendToDeviceEvent represents a message sent directly to a device, as found
+// in the to_device section of a /sync response.
+type SendToDeviceEvent struct {
+	Sender  string          `json:"sender"`
+	Type    string          `json:"type"`
+	Content json.RawMessage `json:"content"`
+}
+
+// Presence is the latest presence of a user.
+type Presence struct {
+	UserID          string
+	Presence        string
+	StatusMsg       string
+	LastActiveTS    gomatrixserverlib.Timestamp
+	CurrentlyActive bool
 }
 
 // PrevEventRef represents a reference to a previous event in a state event upgrade
@@ -175,6 +272,14 @@ type Response struct {
 		Invite map[string]InviteResponse `json:"invite"`
 		Leave  map[string]LeaveResponse  `json:"leave"`
 	} `json:"rooms"`
+	ToDevice struct {
+		Events []SendToDeviceEvent `json:"events"`
+	} `json:"to_device"`
+	DeviceLists struct {
+		Changed []string `json:"changed"`
+		Left    []string `json:"left"`
+	} `json:"device_lists"`
+	DeviceOneTimeKeysCount map[string]int `json:"device_one_time_keys_count"`
 }
 
 // NewResponse creates an empty response with initialised maps.
@@ -194,14 +299,15 @@ func NewResponse(token PaginationToken) *Response {
 	//       This also applies to NewJoinResponse, NewInviteResponse and NewLeaveResponse.
 	res.AccountData.Events = make([]gomatrixserverlib.ClientEvent, 0)
 	res.Presence.Events = make([]gomatrixserverlib.ClientEvent, 0)
+	res.DeviceLists.Changed = make([]string, 0)
+	res.DeviceLists.Left = make([]string, 0)
+	res.DeviceOneTimeKeysCount = make(map[string]int)
+	res.ToDevice.Events = make([]SendToDeviceEvent, 0)
 
 	// Fill next_batch with a pagination token. Since this is a response to a sync request, we can assume
 	// we'll always return a stream token.
-	res.NextBatch = NewPaginationTokenFromTypeAndPosition(
-		PaginationTokenTypeStream,
-		StreamPosition(token.PDUPosition),
-		StreamPosition(token.EDUTypingPosition),
-	).String()
+	token.Type = PaginationTokenTypeStream
+	res.NextBatch = token.String()
 
 	return &res
 }
@@ -213,7 +319,10 @@ func (r *Response) IsEmpty() bool {
 		len(r.Rooms.Invite) == 0 &&
 		len(r.Rooms.Leave) == 0 &&
 		len(r.AccountData.Events) == 0 &&
-		len(r.Presence.Events) == 0
+		len(r.Presence.Events) == 0 &&
+		len(r.DeviceLists.Changed) == 0 &&
+		len(r.DeviceLists.Left) == 0 &&
+		len(r.ToDevice.Events) == 0
 }
 
 // JoinResponse represents a /sync response for a room which is under the 'join' key.
@@ -232,6 +341,10 @@ type JoinResponse struct {
 	AccountData struct {
 		Events []gomatrixserverlib.ClientEvent `json:"events"`
 	} `json:"account_data"`
+	UnreadNotifications struct {
+		HighlightCount    int64 `json:"highlight_count"`
+		NotificationCount int64 `json:"notification_count"`
+	} `json:"unread_notifications"`
 }
 
 // NewJoinResponse creates an empty response with initialised arrays.
@@ -247,15 +360,33 @@ func NewJoinResponse() *JoinResponse {
 // InviteResponse represents a /sync response for a room which is under the 'invite' key.
 type InviteResponse struct {
 	InviteState struct {
-		Events []gomatrixserverlib.ClientEvent `json:"events"`
+		// The stripped state events of the room followed by the invite event.
+		Events []json.RawMessage `json:"events"`
 	} `json:"invite_state"`
 }
 
-// NewInviteResponse creates an empty response with initialised arrays.
-func NewInviteResponse() *InviteResponse {
+// NewInviteResponse creates a response for an invite event. The stripped
+// state of the room is taken from the invite_room_state key of the unsigned
+// data of the invite, and is left out if it isn't valid.
+func NewInviteResponse(inviteEvent gomatrixserverlib.HeaderedEvent) (*InviteResponse, error) {
 	res := InviteResponse{}
-	res.InviteState.Events = make([]gomatrixserverlib.ClientEvent, 0)
-	return &res
+	res.InviteState.Events = make([]json.RawMessage, 0)
+	var unsigned struct {
+		InviteRoomState []json.RawMessage `json:"invite_room_state"`
+	}
+	if len(inviteEvent.Unsigned()) > 0 {
+		if err := json.Unmarshal(inviteEvent.Unsigned(), &unsigned); err == nil {
+			res.InviteState.Events = append(res.InviteState.Events, unsigned.InviteRoomState...)
+		}
+	}
+	eventJSON, err := json.Marshal(
+		gomatrixserverlib.HeaderedToClientEvent(inviteEvent, gomatrixserverlib.FormatSync),
+	)
+	if err != nil {
+		return nil, err
+	}
+	res.InviteState.Events = append(res.InviteState.Events, eventJSON)
+	return &res, nil
 }
 
 // LeaveResponse represents a /sync response for a room which is under the 'leave' key.
@@ -1,6 +1,11 @@
 package types
 
-import "testing"
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
 
 func TestNewPaginationTokenFromString(t *testing.T) {
 	shouldPass := map[string]PaginationToken{
@@ -18,9 +23,35 @@ func TestNewPaginationTokenFromString(t *testing.T) {
 			EDUTypingPosition: 1,
 		},
 		"t3_1_4": PaginationToken{
-			Type:              PaginationTokenTypeTopology,
-			PDUPosition:       3,
-			EDUTypingPosition: 1,
+			Type:                 PaginationTokenTypeTopology,
+			PDUPosition:          3,
+			EDUTypingPosition:    1,
+			SendToDevicePosition: 4,
+		},
+		"s5_1_2_6": PaginationToken{
+			Type:                 PaginationTokenTypeStream,
+			PDUPosition:          5,
+			EDUTypingPosition:    1,
+			EDUReceiptPosition:   6,
+			SendToDevicePosition: 2,
+		},
+		"s5_1_2_6_3": PaginationToken{
+			Type:                 PaginationTokenTypeStream,
+			PDUPosition:          5,
+			EDUTypingPosition:    1,
+			EDUReceiptPosition:   6,
+			EDUPresencePosition:  3,
+			SendToDevicePosition: 2,
+		},
+		"s5_1_2_6_3_8_9": PaginationToken{
+			Type:                 PaginationTokenTypeStream,
+			PDUPosition:          5,
+			EDUTypingPosition:    1,
+			EDUReceiptPosition:   6,
+			EDUPresencePosition:  3,
+			SendToDevicePosition: 2,
+			AccountDataPosition:  8,
+			InvitePosition:       9,
 		},
 	}
 
@@ -50,3 +81,78 @@ func TestNewPaginationTokenFromString(t *testing.T) {
 		}
 	}
 }
+
+func TestNewSyncTokenFromString(t *testing.T) {
+	current := PaginationToken{
+		Type:                 PaginationTokenTypeStream,
+		PDUPosition:          50,
+		EDUTypingPosition:    51,
+		SendToDevicePosition: 52,
+		EDUReceiptPosition:   53,
+		EDUPresencePosition:  54,
+		AccountDataPosition:  55,
+		InvitePosition:       56,
+		DeviceListPosition:   57,
+	}
+	tests := map[string]PaginationToken{
+		// A token from before account data, invites and device lists had their
+		// own positions.
+		"s5_1_2_6_3": PaginationToken{
+			Type:                 PaginationTokenTypeStream,
+			PDUPosition:          5,
+			EDUTypingPosition:    1,
+			SendToDevicePosition: 2,
+			EDUReceiptPosition:   6,
+			EDUPresencePosition:  3,
+			AccountDataPosition:  55,
+			InvitePosition:       56,
+			DeviceListPosition:   57,
+		},
+		// Positions that are present are used even if they are 0.
+		"s5_0_0_0_0_0_0_0": PaginationToken{
+			Type:        PaginationTokenTypeStream,
+			PDUPosition: 5,
+		},
+	}
+	for test, expected := range tests {
+		result, err := NewSyncTokenFromString(test, current)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if *result != expected {
+			t.Errorf("%s: expected %v but got %v", test, expected.String(), result.String())
+		}
+	}
+}
+
+func TestNewInviteResponse(t *testing.T) {
+	eventJSON := []byte(`{"auth_events":[],"content":{"membership":"invite"},"depth":1,"event_id":"$invite:localhost","origin":"localhost","origin_server_ts":1,"prev_events":[],"room_id":"!a:localhost","sender":"@alice:localhost","state_key":"@bob:localhost","type":"m.room.member","unsigned":{"invite_room_state":[{"type":"m.room.name","state_key":"","content":{"name":"Test room"},"sender":"@alice:localhost"}]}}`)
+	event, err := gomatrixserverlib.NewEventFromTrustedJSON(eventJSON, false, gomatrixserverlib.RoomVersionV1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := NewInviteResponse(event.Headered(gomatrixserverlib.RoomVersionV1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.InviteState.Events) != 2 {
+		t.Fatalf("expected 2 invite state events, got %d", len(res.InviteState.Events))
+	}
+	var stripped, invite struct {
+		Type     string `json:"type"`
+		StateKey string `json:"state_key"`
+	}
+	if err = json.Unmarshal(res.InviteState.Events[0], &stripped); err != nil {
+		t.Fatal(err)
+	}
+	if stripped.Type != "m.room.name" {
+		t.Errorf("expected the room name first, got %q", stripped.Type)
+	}
+	if err = json.Unmarshal(res.InviteState.Events[1], &invite); err != nil {
+		t.Fatal(err)
+	}
+	if invite.Type != "m.room.member" || invite.StateKey != "@bob:localhost" {
+		t.Errorf("expected the invite event last, got %q for %q", invite.Type, invite.StateKey)
+	}
+}